@@ -0,0 +1,266 @@
+//! Read-only advice about an upcoming migration.
+//!
+//! Teams often want to know what a migration will touch long before they
+//! schedule it. The [`Advisor`] runs the rules of an upgrade without
+//! changing any code and records every site as a [`Hint`] in a
+//! [`HINTS_FILE`] that editors and CI can show inline ("changes in v2: needs
+//! port and timeout").
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::advisor::{Advisor, HINTS_FILE};
+//! use refactor::analyzer::UpgradeConfig;
+//!
+//! let advisor = Advisor::new(UpgradeConfig::from_file("upgrade.yaml")?)?;
+//! let hints = advisor.advise("./my-project")?;
+//! hints.save(std::path::Path::new("./my-project").join(HINTS_FILE))?;
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::analyzer::{RuleMode, UpgradeConfig};
+use crate::error::Result;
+use crate::quickfix::QuickFixer;
+use crate::runner::{UpgradeRunner, is_generated};
+
+/// Default name of the hints file, at the project root.
+pub const HINTS_FILE: &str = ".refactor-hints.json";
+
+/// Version of the hints file format.
+const FORMAT_VERSION: u32 = 1;
+
+/// A site an upgrade will change, for an editor to show inline.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Hint {
+    /// File containing the site, relative to the project root.
+    pub path: PathBuf,
+    /// 1-based line of the start of the site.
+    pub line: usize,
+    /// 1-based column of the start of the site.
+    pub column: usize,
+    /// 1-based line of the end of the site.
+    pub end_line: usize,
+    /// 1-based column just past the end of the site.
+    pub end_column: usize,
+    /// Rule that matched the site.
+    pub rule: String,
+    /// What changes, for display.
+    pub message: String,
+    /// The code the upgrade will write.
+    pub replacement: String,
+    /// Whether the upgrade rewrites the site itself; otherwise it only
+    /// reports it for manual changes.
+    pub automatic: bool,
+}
+
+/// The hints of one upgrade for a project.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct HintsFile {
+    /// Version of the file format.
+    pub version: u32,
+    /// Name of the upgrade.
+    pub pack: String,
+    /// Library version the upgrade is from.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub from_version: Option<String>,
+    /// Library version the upgrade is to.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub to_version: Option<String>,
+    /// Date the hints were generated, as `YYYY-MM-DD`.
+    pub generated: String,
+    /// The hints, by file and position.
+    pub hints: Vec<Hint>,
+}
+
+impl HintsFile {
+    /// Load a hints file.
+    pub fn load(path: impl AsRef<Path>) -> Result<Self> {
+        Ok(serde_json::from_str(&fs::read_to_string(path)?)?)
+    }
+
+    /// Write the hints file.
+    pub fn save(&self, path: impl AsRef<Path>) -> Result<()> {
+        fs::write(path, serde_json::to_string_pretty(self)? + "\n")?;
+        Ok(())
+    }
+
+    /// Number of files with hints.
+    pub fn files(&self) -> usize {
+        let mut paths: Vec<&Path> = self.hints.iter().map(|h| h.path.as_path()).collect();
+        paths.dedup();
+        paths.len()
+    }
+}
+
+/// Collects hints for the sites an upgrade would change.
+pub struct Advisor {
+    config: UpgradeConfig,
+    runner: UpgradeRunner,
+    fixer: QuickFixer,
+    modes: HashMap<String, RuleMode>,
+}
+
+impl Advisor {
+    /// Compile the rules of `config`.
+    pub fn new(config: UpgradeConfig) -> Result<Self> {
+        Self::with_runner(UpgradeRunner::new(config))
+    }
+
+    /// Compile the rules of `runner`, advising on the files it would run
+    /// against, such as after the globs of the project it is configured
+    /// for.
+    pub fn with_runner(runner: UpgradeRunner) -> Result<Self> {
+        let config = runner.config().clone();
+        let modes = config
+            .transforms
+            .iter()
+            .map(|rule| (rule.name(), rule.mode))
+            .collect();
+        let fixer = QuickFixer::new(config.clone())?;
+        Ok(Self {
+            config,
+            runner: runner.dry_run(),
+            fixer,
+            modes,
+        })
+    }
+
+    /// Hints for the files of the project at `root`. Generated files are
+    /// skipped, as the upgrade skips them. No file is written.
+    pub fn advise(&self, root: impl AsRef<Path>) -> Result<HintsFile> {
+        let root = root.as_ref();
+        let files = self.runner.select_files(root)?;
+
+        let mut hints = Vec::new();
+        for path in files {
+            let source = fs::read_to_string(&path)?;
+            if is_generated(&source) {
+                continue;
+            }
+            let rel = path.strip_prefix(root).unwrap_or(&path);
+            hints.extend(self.hints(rel, &source));
+        }
+        Ok(HintsFile {
+            version: FORMAT_VERSION,
+            pack: self.config.name.clone(),
+            from_version: self.config.from_version.clone(),
+            to_version: self.config.to_version.clone(),
+            generated: crate::codemod::chrono_lite_date(),
+            hints,
+        })
+    }
+
+    /// Hints for one file's `source`, in order of position.
+    pub fn hints(&self, path: &Path, source: &str) -> Vec<Hint> {
+        let mut hints: Vec<Hint> = self
+            .fixer
+            .all_fixes(path, source)
+            .into_iter()
+            .flat_map(|fix| {
+                let automatic = self.modes.get(&fix.rule) != Some(&RuleMode::Suggest);
+                let message = match &self.config.to_version {
+                    Some(version) => format!("Changes in {}: {}", version, fix.title),
+                    None => fix.title.clone(),
+                };
+                fix.edits.into_iter().map(move |edit| {
+                    let (end_line, end_column) = position(source, edit.end);
+                    Hint {
+                        path: path.to_path_buf(),
+                        line: edit.line,
+                        column: edit.column,
+                        end_line,
+                        end_column,
+                        rule: fix.rule.clone(),
+                        message: message.clone(),
+                        replacement: edit.text,
+                        automatic,
+                    }
+                })
+            })
+            .collect();
+        hints.sort_by_key(|hint| (hint.line, hint.column));
+        hints
+    }
+}
+
+/// 1-based line and column of byte `offset` in `source`.
+fn position(source: &str, offset: usize) -> (usize, usize) {
+    let before = &source[..offset.min(source.len())];
+    let line = before.matches('\n').count() + 1;
+    let column = before.len() - before.rfind('\n').map_or(0, |i| i + 1) + 1;
+    (line, column)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformRule, TransformSpec};
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_advise_writes_no_code() {
+        let mut config = UpgradeConfig::new("pool-v2", "Upgrade pool")
+            .with_extensions(vec!["go".to_string()])
+            .with_versions("v1", "v2");
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "Dial".to_string(),
+                new_name: "Connect".to_string(),
+            })
+            .with_id("rename-dial"),
+        );
+        config.add_transform(
+            TransformRule::new(TransformSpec::ReplacePattern {
+                pattern: r"NewPool\(\)".to_string(),
+                replacement: "NewPool(port, timeout)".to_string(),
+            })
+            .with_id("new-pool")
+            .with_message("needs port and timeout")
+            .suggest_only(),
+        );
+
+        let dir = TempDir::new().unwrap();
+        let source = "package main\n\nfunc main() {\n\tp := NewPool()\n\tc := Dial(p)\n}\n";
+        fs::write(dir.path().join("main.go"), source).unwrap();
+        fs::write(
+            dir.path().join("gen.go"),
+            "// Code generated by mockgen. DO NOT EDIT.\n\npackage main\n\nvar c = Dial(nil)\n",
+        )
+        .unwrap();
+
+        let hints_config = config.clone();
+        let hints = Advisor::new(config).unwrap().advise(dir.path()).unwrap();
+        assert_eq!(
+            fs::read_to_string(dir.path().join("main.go")).unwrap(),
+            source
+        );
+        assert_eq!(hints.pack, "pool-v2");
+        assert_eq!(hints.files(), 1);
+        assert_eq!(hints.hints.len(), 2);
+
+        let new_pool = &hints.hints[0];
+        assert_eq!(new_pool.path, PathBuf::from("main.go"));
+        assert_eq!((new_pool.line, new_pool.column), (4, 7));
+        assert_eq!((new_pool.end_line, new_pool.end_column), (4, 16));
+        assert_eq!(new_pool.message, "Changes in v2: needs port and timeout");
+        assert!(!new_pool.automatic);
+        assert_eq!(hints.hints[1].rule, "rename-dial");
+        assert!(hints.hints[1].automatic);
+
+        let file = dir.path().join(HINTS_FILE);
+        hints.save(&file).unwrap();
+        assert_eq!(HintsFile::load(&file).unwrap().hints, hints.hints);
+        // Files the runner excludes get no hints
+        let runner = UpgradeRunner::new(hints_config).exclude("main.go");
+        let hints = Advisor::with_runner(runner)
+            .unwrap()
+            .advise(dir.path())
+            .unwrap();
+        assert!(hints.hints.is_empty());
+    }
+}
@@ -0,0 +1,527 @@
+//! Semantic-versioning classification of API changes.
+//!
+//! Library authors need to know whether a release is allowed to ship the
+//! changes it contains: removing an API or changing a signature needs a
+//! major release, adding an API needs at least a minor one. [`ApiDiff`]
+//! classifies every change between two versions of a library as
+//! [`Compatibility::Breaking`], [`Compatibility::Compatible`] or
+//! [`Compatibility::Patch`], and [`ApiDiff::violations`] lists the changes a
+//! release of a given level must not contain, for gating releases in CI.
+//! [`ApiDiff::migration_guide`] renders the breaking changes as a Markdown
+//! guide with before/after snippets, to ship alongside the generated pack.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::{LibraryAnalyzer, release_level};
+//!
+//! let diff = LibraryAnalyzer::new("./my-library")?.api_diff("v1.2.0", "v1.3.0")?;
+//! let release = release_level("v1.2.0", "v1.3.0").unwrap();
+//! for entry in diff.violations(release) {
+//!     eprintln!("{}", entry.violation(release));
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use serde::Serialize;
+use std::collections::{HashMap, HashSet};
+use std::fmt;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use super::change::{ApiChange, ApiType, ChangeKind};
+use super::detector::ChangeDetector;
+use super::generator::format_change_detail;
+use super::implementers::{Implementer, find_implementers};
+use super::signature::ApiSignature;
+use crate::error::Result;
+
+static VERSION: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"(\d+)\.(\d+)(?:\.(\d+))?").expect("invalid version regex"));
+
+/// How compatible a change is, ordered from least to most disruptive.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Compatibility {
+    /// No change to the API; a patch release is enough.
+    Patch,
+    /// Existing callers keep working; needs a minor release.
+    Compatible,
+    /// Existing callers break; needs a major release.
+    Breaking,
+}
+
+impl Compatibility {
+    /// The semantic version component a release with this change bumps.
+    pub fn bump(&self) -> &'static str {
+        match self {
+            Compatibility::Patch => "patch",
+            Compatibility::Compatible => "minor",
+            Compatibility::Breaking => "major",
+        }
+    }
+
+    /// The compatibility of `change`.
+    pub fn of(change: &ApiChange) -> Self {
+        match &change.kind {
+            ChangeKind::ParameterAdded { has_default, .. } if *has_default => {
+                Compatibility::Compatible
+            }
+            ChangeKind::ConstantChanged { .. } => Compatibility::Compatible,
+            _ => Compatibility::Breaking,
+        }
+    }
+}
+
+impl fmt::Display for Compatibility {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let name = match self {
+            Compatibility::Patch => "patch",
+            Compatibility::Compatible => "compatible",
+            Compatibility::Breaking => "breaking",
+        };
+        write!(f, "{}", name)
+    }
+}
+
+/// One classified change.
+#[derive(Debug, Clone, Serialize)]
+pub struct ApiDiffEntry {
+    /// How compatible the change is.
+    pub level: Compatibility,
+    /// The kind of change (`Signature Changed`, `API Added`, ...).
+    pub kind: String,
+    /// What changed.
+    pub detail: String,
+    /// File the API is declared in.
+    pub file: PathBuf,
+    /// How callers used the API before the change.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub before: Option<String>,
+    /// How callers use the API after the change.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub after: Option<String>,
+    /// What callers need to do.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub notes: Option<String>,
+    /// Whether the generated pack migrates callers automatically.
+    pub automated: bool,
+}
+
+impl ApiDiffEntry {
+    /// A message for this change in a release of level `release`: "`Connect`
+    /// signature changed on a minor release".
+    pub fn violation(&self, release: Compatibility) -> String {
+        format!(
+            "{} ({}) on a {} release; it needs a {} release",
+            self.detail,
+            self.file.display(),
+            release.bump(),
+            self.level.bump()
+        )
+    }
+}
+
+impl fmt::Display for ApiDiffEntry {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{:<10} {}: {} ({})",
+            self.level,
+            self.kind,
+            self.detail,
+            self.file.display()
+        )
+    }
+}
+
+/// The classified API changes between two versions of a library.
+#[derive(Debug, Clone, Serialize)]
+pub struct ApiDiff {
+    /// The old version.
+    pub from: String,
+    /// The new version.
+    pub to: String,
+    /// The changes, most disruptive first.
+    pub entries: Vec<ApiDiffEntry>,
+    /// The changes as detected, for checking clients.
+    #[serde(skip)]
+    changes: Vec<ApiChange>,
+}
+
+impl ApiDiff {
+    /// Classify the changes between two sets of API signatures. APIs added
+    /// in `new_apis` are compatible changes; the rest come from `detector`.
+    pub fn between(
+        from: impl Into<String>,
+        to: impl Into<String>,
+        old_apis: &HashMap<PathBuf, Vec<ApiSignature>>,
+        new_apis: &HashMap<PathBuf, Vec<ApiSignature>>,
+        detector: &ChangeDetector,
+    ) -> Self {
+        let changes = detector.detect(old_apis, new_apis);
+        let renamed: HashSet<&str> = changes
+            .iter()
+            .filter_map(|change| change.replacement.as_deref())
+            .collect();
+        let old: HashSet<String> = old_apis
+            .values()
+            .flatten()
+            .map(ApiSignature::unique_id)
+            .collect();
+        let mut added: Vec<&ApiSignature> = new_apis
+            .values()
+            .flatten()
+            .filter(|sig| {
+                sig.is_exported
+                    && !old.contains(&sig.unique_id())
+                    && !renamed.contains(sig.name.as_str())
+            })
+            .collect();
+        added.sort_by(|a, b| {
+            (&a.location.file, a.location.line).cmp(&(&b.location.file, b.location.line))
+        });
+
+        let old_by_name = by_name(old_apis);
+        let new_by_name = by_name(new_apis);
+        let mut entries: Vec<ApiDiffEntry> = changes
+            .iter()
+            .map(|change| {
+                let (before, after) = snippets(&change.kind, &old_by_name, &new_by_name);
+                ApiDiffEntry {
+                    level: Compatibility::of(change),
+                    kind: change.kind.name().to_string(),
+                    detail: format_change_detail(&change.kind),
+                    file: change.file_path.clone(),
+                    before,
+                    after,
+                    notes: change.metadata.migration_notes.clone(),
+                    automated: change.kind.is_auto_transformable(),
+                }
+            })
+            .chain(added.into_iter().map(|sig| ApiDiffEntry {
+                level: Compatibility::Compatible,
+                kind: "API Added".to_string(),
+                detail: format!("{} `{}` added", sig.kind.name(), sig.name),
+                file: sig.location.file.clone(),
+                before: None,
+                after: Some(usage(sig)),
+                notes: None,
+                automated: false,
+            }))
+            .collect();
+        entries.sort_by(|a, b| b.level.cmp(&a.level));
+        Self {
+            from: from.into(),
+            to: to.into(),
+            entries,
+            changes,
+        }
+    }
+
+    /// The types of the Go client at `client` that implement a changed
+    /// interface and break with it (see [`find_implementers`]).
+    pub fn implementers(&self, client: impl AsRef<Path>) -> Result<Vec<Implementer>> {
+        find_implementers(client, &self.changes)
+    }
+
+    /// The smallest release that may ship these changes.
+    pub fn required(&self) -> Compatibility {
+        self.entries
+            .iter()
+            .map(|entry| entry.level)
+            .max()
+            .unwrap_or(Compatibility::Patch)
+    }
+
+    /// The changes a release of level `release` must not contain.
+    pub fn violations(&self, release: Compatibility) -> Vec<&ApiDiffEntry> {
+        self.entries
+            .iter()
+            .filter(|entry| entry.level > release)
+            .collect()
+    }
+
+    /// A Markdown migration guide for users of `library`: each breaking
+    /// change with before/after snippets, then the other changes.
+    pub fn migration_guide(&self, library: &str) -> String {
+        let breaking = self.violations(Compatibility::Compatible);
+        let others: Vec<&ApiDiffEntry> = self
+            .entries
+            .iter()
+            .filter(|entry| entry.level < Compatibility::Breaking)
+            .collect();
+
+        let mut md = format!(
+            "# Migrating {} from {} to {}\n\n",
+            library, self.from, self.to
+        );
+        if breaking.is_empty() {
+            md.push_str("This release has no breaking changes; no code needs to change.\n");
+        } else {
+            let automated = breaking.iter().filter(|entry| entry.automated).count();
+            md.push_str(&format!(
+                "This release has {} breaking change(s). {} of them are migrated \
+                 automatically by the release's migration pack; the rest need the \
+                 manual changes below.\n",
+                breaking.len(),
+                automated
+            ));
+            md.push_str("\n## Breaking changes\n");
+        }
+        for entry in &breaking {
+            md.push_str(&format!("\n### {}\n\n", entry.detail));
+            md.push_str(&format!("{} in `{}`", entry.kind, entry.file.display()));
+            md.push_str(if entry.automated {
+                " (migrated automatically).\n"
+            } else {
+                " (needs manual changes).\n"
+            });
+            if let Some(notes) = &entry.notes {
+                md.push_str(&format!("\n{}.\n", notes.trim_end_matches('.')));
+            }
+            let fence = fence(&entry.file);
+            for (label, snippet) in [("Before", &entry.before), ("After", &entry.after)] {
+                if let Some(snippet) = snippet {
+                    md.push_str(&format!("\n{}:\n\n```{}\n{}\n```\n", label, fence, snippet));
+                }
+            }
+        }
+        if !others.is_empty() {
+            md.push_str("\n## Other changes\n\n");
+            for entry in others {
+                md.push_str(&format!(
+                    "- {} (`{}`)\n",
+                    entry.detail,
+                    entry.file.display()
+                ));
+            }
+        }
+        md
+    }
+}
+
+impl fmt::Display for ApiDiff {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(f, "API changes {} -> {}", self.from, self.to)?;
+        for entry in &self.entries {
+            writeln!(f, "  {}", entry)?;
+        }
+        let count = |level| {
+            self.entries
+                .iter()
+                .filter(|entry| entry.level == level)
+                .count()
+        };
+        write!(
+            f,
+            "{} breaking, {} compatible; needs a {} release",
+            count(Compatibility::Breaking),
+            count(Compatibility::Compatible),
+            self.required().bump()
+        )
+    }
+}
+
+/// APIs by name, for finding both sides of a change.
+fn by_name(apis: &HashMap<PathBuf, Vec<ApiSignature>>) -> HashMap<&str, &ApiSignature> {
+    apis.values()
+        .flatten()
+        .map(|sig| (sig.name.as_str(), sig))
+        .collect()
+}
+
+/// How callers use `sig`: a call with its required arguments for functions,
+/// its name otherwise.
+fn usage(sig: &ApiSignature) -> String {
+    if !matches!(sig.kind, ApiType::Function | ApiType::Method) {
+        return sig.name.clone();
+    }
+    let args: Vec<String> = sig
+        .parameters
+        .iter()
+        .filter(|param| !param.has_default && !param.is_optional)
+        .map(|param| {
+            if param.is_variadic {
+                format!("{}...", param.name)
+            } else {
+                param.name.clone()
+            }
+        })
+        .collect();
+    format!("{}({})", sig.name, args.join(", "))
+}
+
+/// Before and after snippets for a change, from the APIs it affects.
+fn snippets(
+    kind: &ChangeKind,
+    old: &HashMap<&str, &ApiSignature>,
+    new: &HashMap<&str, &ApiSignature>,
+) -> (Option<String>, Option<String>) {
+    let both = |old_name: &str, new_name: &str| {
+        (
+            old.get(old_name).map(|sig| usage(sig)),
+            new.get(new_name).map(|sig| usage(sig)),
+        )
+    };
+    match kind {
+        ChangeKind::FunctionRenamed {
+            old_name, new_name, ..
+        } => both(old_name, new_name),
+        ChangeKind::TypeRenamed { old_name, new_name } => {
+            (Some(old_name.clone()), Some(new_name.clone()))
+        }
+        ChangeKind::ImportRenamed { old_path, new_path } => {
+            (Some(old_path.clone()), Some(new_path.clone()))
+        }
+        ChangeKind::SignatureChanged { name, .. }
+        | ChangeKind::ParameterAdded {
+            function_name: name,
+            ..
+        }
+        | ChangeKind::ParameterRemoved {
+            function_name: name,
+            ..
+        }
+        | ChangeKind::ParameterReordered {
+            function_name: name,
+            ..
+        } => both(name, name),
+        ChangeKind::ApiRemoved { name, .. } => (old.get(name.as_str()).map(|sig| usage(sig)), None),
+        ChangeKind::TypeChanged { .. }
+        | ChangeKind::MethodMoved { .. }
+        | ChangeKind::ConstantChanged { .. }
+        | ChangeKind::InterfaceChanged { .. } => (None, None),
+    }
+}
+
+/// The Markdown code fence language of a source file.
+fn fence(file: &std::path::Path) -> &'static str {
+    match file.extension().and_then(|ext| ext.to_str()) {
+        Some("go") => "go",
+        Some("rs") => "rust",
+        Some("py") | Some("pyi") => "python",
+        Some("ts") | Some("tsx") => "typescript",
+        Some("js") | Some("jsx") => "javascript",
+        _ => "",
+    }
+}
+
+/// The kind of release going from version `from` to `to` (`v1.2.0` to
+/// `v1.3.0` is a minor release). Before 1.0, a minor release may break
+/// callers. Returns `None` if either is not a version or `to` is not newer.
+pub fn release_level(from: &str, to: &str) -> Option<Compatibility> {
+    let parse = |version: &str| {
+        let caps = VERSION.captures_iter(version).last()?;
+        let part = |i| {
+            caps.get(i)
+                .map_or(Some(0), |m: regex::Match| m.as_str().parse::<u64>().ok())
+        };
+        Some((part(1)?, part(2)?, part(3)?))
+    };
+    let (from, to) = (parse(from)?, parse(to)?);
+    if to <= from {
+        return None;
+    }
+    Some(if to.0 > from.0 || (from.0 == 0 && to.1 > from.1) {
+        Compatibility::Breaking
+    } else if to.1 > from.1 {
+        Compatibility::Compatible
+    } else {
+        Compatibility::Patch
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{Parameter, SourceLocation, TypeInfo};
+
+    fn function(name: &str, params: &[&str]) -> ApiSignature {
+        let mut sig = ApiSignature::function(name, SourceLocation::new("pool/conn.go", 1, 1));
+        sig.parameters = params
+            .iter()
+            .map(|p| Parameter::new(*p).with_type(TypeInfo::simple("string")))
+            .collect();
+        sig
+    }
+
+    #[test]
+    fn test_api_diff() {
+        let file = PathBuf::from("pool/conn.go");
+        let old = HashMap::from([(
+            file.clone(),
+            vec![function("Connect", &["addr"]), function("Ping", &[])],
+        )]);
+        let new = HashMap::from([(
+            file,
+            vec![
+                function("Connect", &["addr", "timeout"]),
+                function("Ping", &[]),
+                function("Stats", &[]),
+            ],
+        )]);
+        let diff = ApiDiff::between("v1.2.0", "v1.3.0", &old, &new, &ChangeDetector::new());
+
+        assert_eq!(diff.required(), Compatibility::Breaking);
+        assert_eq!(diff.entries[0].level, Compatibility::Breaking);
+        assert!(diff.entries[0].detail.contains("Connect"));
+        let added = diff.entries.last().unwrap();
+        assert_eq!(added.level, Compatibility::Compatible);
+        assert_eq!(added.detail, "function `Stats` added");
+
+        let violations = diff.violations(Compatibility::Compatible);
+        assert_eq!(violations.len(), diff.entries.len() - 1);
+        assert!(
+            violations[0]
+                .violation(Compatibility::Compatible)
+                .contains("on a minor release; it needs a major release")
+        );
+        assert!(diff.violations(Compatibility::Breaking).is_empty());
+        assert!(diff.to_string().ends_with("needs a major release"));
+
+        let connect = &diff.entries[0];
+        assert_eq!(connect.before.as_deref(), Some("Connect(addr)"));
+        assert_eq!(connect.after.as_deref(), Some("Connect(addr, timeout)"));
+        let guide = diff.migration_guide("pool");
+        assert!(guide.starts_with("# Migrating pool from v1.2.0 to v1.3.0\n"));
+        assert!(guide.contains("## Breaking changes"));
+        assert!(guide.contains("Before:\n\n```go\nConnect(addr)\n```"));
+        assert!(guide.contains("## Other changes\n\n- function `Stats` added (`pool/conn.go`)"));
+
+        let unchanged = ApiDiff::between("v1", "v1.0.1", &old, &old, &ChangeDetector::new());
+        assert_eq!(unchanged.required(), Compatibility::Patch);
+        assert!(
+            unchanged
+                .migration_guide("pool")
+                .contains("no breaking changes")
+        );
+    }
+
+    #[test]
+    fn test_release_level() {
+        assert_eq!(
+            release_level("v1.2.0", "v1.3.0"),
+            Some(Compatibility::Compatible)
+        );
+        assert_eq!(
+            release_level("v1.2.0", "v2.0.0"),
+            Some(Compatibility::Breaking)
+        );
+        assert_eq!(
+            release_level("v1.2.0", "v1.2.1"),
+            Some(Compatibility::Patch)
+        );
+        assert_eq!(
+            release_level("v0.4.1", "v0.5.0"),
+            Some(Compatibility::Breaking)
+        );
+        assert_eq!(
+            release_level("mylib-1.4", "mylib-1.5"),
+            Some(Compatibility::Compatible)
+        );
+        assert_eq!(release_level("v1.3.0", "v1.2.0"), None);
+        assert_eq!(release_level("main", "v1.2.0"), None);
+    }
+}
@@ -113,6 +113,9 @@ pub enum ChangeKind {
         param_type: Option<TypeInfo>,
         position: usize,
         has_default: bool,
+        /// Number of parameters the function took before.
+        #[serde(default)]
+        old_param_count: usize,
     },
 
     /// Parameter removed from function.
@@ -151,6 +154,24 @@ pub enum ChangeKind {
         new_location: String,
     },
 
+    /// Methods of an interface were added, removed or changed, breaking
+    /// the types implementing it.
+    #[serde(rename = "interface_changed")]
+    InterfaceChanged {
+        name: String,
+        /// Method signatures before the change.
+        old_methods: Vec<String>,
+        /// Signatures of the methods added.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        added: Vec<String>,
+        /// Signatures of the methods removed.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        removed: Vec<String>,
+        /// New signatures of the methods whose signature changed.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        changed: Vec<String>,
+    },
+
     /// Constant value changed.
     #[serde(rename = "constant_changed")]
     ConstantChanged {
@@ -176,6 +197,7 @@ impl ChangeKind {
             ChangeKind::TypeRenamed { .. } => "Type Renamed",
             ChangeKind::TypeChanged { .. } => "Type Definition Changed",
             ChangeKind::MethodMoved { .. } => "Method Moved",
+            ChangeKind::InterfaceChanged { .. } => "Interface Changed",
             ChangeKind::ConstantChanged { .. } => "Constant Changed",
         }
     }
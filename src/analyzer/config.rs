@@ -1,15 +1,30 @@
 //! Serializable configuration for upgrade definitions.
 
+use regex::Regex;
 use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fmt;
 use std::path::Path;
+use std::sync::{Arc, LazyLock};
 
 use crate::codemod::Upgrade;
 use crate::error::{RefactorError, Result};
 use crate::matcher::Matcher;
-use crate::transform::TransformBuilder;
+use crate::plugin::{PluginRegistry, PluginSpec, Rewriter};
+use crate::semantics::SemanticsVersion;
+use crate::transform::{
+    CallArgument, CallRewrite, ClassRename, ContextInjection, ExportRename, Guard,
+    GuardedTransform, KeyRename, LiteralField, LiteralRewrite, MethodRename, MoveExport,
+    PathRename, Removal, RemovedCall, StringRewrite, SymbolRename, TagRewrite, TextTransform,
+    Transform, TransformBuilder, TypeRename, ValueMap, VariantRename, javascript, structural,
+};
 
 use super::change::ApiChange;
 
+/// A `{{name}}` reference to a named value in a rule template.
+static VALUE_REF: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"\{\{\s*(\w+)\s*\}\}").expect("invalid value reference regex"));
+
 /// A serializable specification for a transform.
 #[derive(Debug, Clone, Serialize, Deserialize)]
 #[serde(tag = "type")]
@@ -36,9 +51,425 @@ pub enum TransformSpec {
     /// Update an import path.
     #[serde(rename = "rename_import")]
     RenameImport { old_path: String, new_path: String },
+
+    /// Replace code matching a template with `$name` metavariables
+    /// (see [`crate::transform::structural`]).
+    #[serde(rename = "replace_structural")]
+    ReplaceStructural {
+        pattern: String,
+        replacement: String,
+    },
+
+    /// Rename a function and edit the arguments of its calls (see
+    /// [`CallRewrite`]).
+    #[serde(rename = "rewrite_call")]
+    RewriteCall {
+        /// Function to rewrite calls of; may be qualified (`pool.connect`).
+        function: String,
+        /// New name of the function.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        new_name: Option<String>,
+        /// Only rewrite calls with exactly this many positional arguments.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        arity: Option<usize>,
+        /// Arguments to remove: positional indices or keyword names.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        remove: Vec<String>,
+        /// Original indices of the positional arguments, in their new order.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        order: Vec<usize>,
+        /// Keyword arguments to rename.
+        #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+        keywords: BTreeMap<String, String>,
+        /// Arguments to add.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        add: Vec<CallArgument>,
+        /// Go function type of the function before the rewrite; references
+        /// to it that are not calls are adapted with function literals of
+        /// this type instead of being marked.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        signature: Option<String>,
+    },
+
+    /// Map old values to new ones in an argument of calls and in
+    /// comparisons (see [`ValueMap`]).
+    #[serde(rename = "map_values")]
+    MapValues {
+        /// Function whose argument is mapped; may be qualified
+        /// (`pool.SetMode`).
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        function: Option<String>,
+        /// The mapped argument: a positional index or keyword name (default
+        /// `0`).
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        argument: Option<String>,
+        /// Expression whose comparisons with values are mapped
+        /// (`conn.Status()`).
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        compared: Option<String>,
+        /// Old values to new ones, as source text.
+        values: BTreeMap<String, String>,
+    },
+
+    /// Handle the calls of a function removed from the API (see
+    /// [`RemovedCall`]). Every call is also reported as a diagnostic,
+    /// whatever the strategy.
+    #[serde(rename = "remove_call")]
+    RemoveCall {
+        /// Removed function; may be qualified (`mylib.DeprecatedFn`).
+        function: String,
+        /// What to do with each call (default `todo`).
+        #[serde(default)]
+        strategy: Removal,
+        /// Expression replacing each call, for the `replace` strategy;
+        /// `${args}` is the call's argument list.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        replacement: Option<String>,
+    },
+
+    /// Rename, add and key the fields of a struct type's composite literals
+    /// (see [`LiteralRewrite`]).
+    #[serde(rename = "rewrite_literal")]
+    RewriteLiteral {
+        /// Type whose literals are rewritten; may be qualified
+        /// (`pool.Config`).
+        type_name: String,
+        /// Fields of the type in their declared order before the upgrade;
+        /// positional literals are converted to keyed form.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        fields: Vec<String>,
+        /// Fields to rename.
+        #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+        rename: BTreeMap<String, String>,
+        /// Fields to add where a literal does not set them.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        add: Vec<LiteralField>,
+    },
+
+    /// Rewrite the content of string literals, such as configuration keys
+    /// and endpoint paths (see [`StringRewrite`]).
+    #[serde(rename = "rewrite_string")]
+    RewriteString {
+        /// Content of the literals to rewrite, as written in the source.
+        from: String,
+        /// New content.
+        to: String,
+        /// Also rewrite literals starting with `from`, keeping the rest of
+        /// their content (`/v1/users` to `/v2/users`).
+        #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+        prefix: bool,
+        /// Only rewrite literals passed to this function; may be qualified
+        /// (`viper.Get`).
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        function: Option<String>,
+        /// The argument of the function: a positional index or keyword name
+        /// (default `0`).
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        argument: Option<String>,
+    },
+
+    /// Rename, add and remove the keys of Go struct field tags (see
+    /// [`TagRewrite`]).
+    #[serde(rename = "rewrite_tag")]
+    RewriteTag {
+        /// Only rewrite the fields of this struct type.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        type_name: Option<String>,
+        /// Only rewrite the tag of this field.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        field: Option<String>,
+        /// Names to rename under each key (`json: {user_id: uid}`).
+        #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+        rename: BTreeMap<String, BTreeMap<String, String>>,
+        /// Keys to add to tags without them, with their values.
+        #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+        add: BTreeMap<String, String>,
+        /// Keys to remove.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        remove: Vec<String>,
+    },
+
+    /// Rename a key of YAML, JSON or TOML configuration files (see
+    /// [`KeyRename`]).
+    #[serde(rename = "rename_key")]
+    RenameKey {
+        /// Dotted path of the key (`server.port`).
+        key: String,
+        /// New name of the key's last segment.
+        new_name: String,
+    },
+
+    /// Rename a dotted module path (`import a.b`, `from a.b import c`,
+    /// `a.b.c`), as used by Python.
+    #[serde(rename = "rename_module")]
+    RenameModule { old_path: String, new_path: String },
+
+    /// Rename a JavaScript or TypeScript module specifier and its subpaths
+    /// in ES module imports and exports, `import()` and `require()`.
+    #[serde(rename = "rename_specifier")]
+    RenameSpecifier { old_path: String, new_path: String },
+
+    /// Rename an export of a JavaScript or TypeScript module in files that
+    /// import the module.
+    #[serde(rename = "rename_export")]
+    RenameExport {
+        module: String,
+        old_name: String,
+        new_name: String,
+    },
+
+    /// Move an export of a JavaScript or TypeScript module to another
+    /// module, splitting the import statements of its clients (see
+    /// [`MoveExport`]).
+    #[serde(rename = "move_export")]
+    MoveExport {
+        name: String,
+        from_module: String,
+        to_module: String,
+    },
+
+    /// Rename a symbol of a package inside the processed module, in the
+    /// package itself and in the module's other packages (see
+    /// [`SymbolRename`]).
+    #[serde(rename = "rename_symbol")]
+    RenameSymbol {
+        /// Directory of the package, relative to the module root.
+        package: String,
+        old_name: String,
+        new_name: String,
+    },
+
+    /// Rename a Java class or move it to another package, in imports,
+    /// static imports, qualified names and simple-name uses (see
+    /// [`ClassRename`]).
+    #[serde(rename = "rename_class")]
+    RenameClass {
+        /// Fully qualified name of the class (`com.acme.Client`).
+        old_name: String,
+        /// New fully qualified name.
+        new_name: String,
+    },
+
+    /// Rename a method of a Java class in the files that use the class (see
+    /// [`MethodRename`]).
+    #[serde(rename = "rename_method")]
+    RenameMethod {
+        /// Fully qualified name of the class.
+        class: String,
+        old_name: String,
+        new_name: String,
+    },
+
+    /// Rename or move a Rust item or module, in paths and `use`
+    /// declarations (see [`PathRename`]).
+    #[serde(rename = "rename_path")]
+    RenamePath { old_path: String, new_path: String },
+
+    /// Rename a Go type where code uses it, but not in strings, comments or
+    /// field selectors (see [`TypeRename`]).
+    #[serde(rename = "rename_go_type")]
+    RenameGoType {
+        /// Import path of the package declaring the type; uses qualified by
+        /// its name are renamed. Without it, unqualified uses are renamed.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        package: Option<String>,
+        old_name: String,
+        new_name: String,
+        /// Also rename client types defined from the type under its own
+        /// name, and their uses in the packages importing them.
+        #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+        transitive: bool,
+    },
+
+    /// Add a `context.Context` first parameter to a Go function and pass a
+    /// context at its calls (see [`ContextInjection`]).
+    #[serde(rename = "inject_context")]
+    InjectContext {
+        /// Name of the function.
+        function: String,
+        /// Import path of the package declaring the function; calls
+        /// qualified by its name are rewritten. Without it, the declaration
+        /// and unqualified calls are rewritten.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        package: Option<String>,
+        /// Name of the added parameter (default `ctx`).
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        parameter: Option<String>,
+        /// Context passed by callers without one in scope (default
+        /// `context.TODO()`).
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        fallback: Option<String>,
+        /// Go function type of the function before the change; the function
+        /// used as a value is adapted with function literals of this type
+        /// instead of being marked.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        signature: Option<String>,
+    },
+
+    /// Rename a variant of a Rust enum (see [`VariantRename`]).
+    #[serde(rename = "rename_variant")]
+    RenameVariant {
+        /// Name of the enum, as it is written before `::`.
+        enum_name: String,
+        old_name: String,
+        new_name: String,
+    },
 }
 
 impl TransformSpec {
+    /// Get a short human-readable description.
+    pub fn describe(&self) -> String {
+        match self {
+            TransformSpec::ReplaceLiteral { from, to } => {
+                format!("replace_literal {} -> {}", from, to)
+            }
+            TransformSpec::ReplacePattern {
+                pattern,
+                replacement,
+            } => format!("replace_pattern {} -> {}", pattern, replacement),
+            TransformSpec::RenameFunction { old_name, new_name } => {
+                format!("rename_function {} -> {}", old_name, new_name)
+            }
+            TransformSpec::RenameType { old_name, new_name } => {
+                format!("rename_type {} -> {}", old_name, new_name)
+            }
+            TransformSpec::RenameImport { old_path, new_path } => {
+                format!("rename_import {} -> {}", old_path, new_path)
+            }
+            TransformSpec::ReplaceStructural {
+                pattern,
+                replacement,
+            } => format!(
+                "{} {} {}",
+                one_line(pattern),
+                structural::ARROW,
+                one_line(replacement)
+            ),
+            TransformSpec::RewriteCall {
+                function, new_name, ..
+            } => match new_name {
+                Some(new_name) => format!("rewrite_call {} -> {}", function, new_name),
+                None => format!("rewrite_call {}", function),
+            },
+            TransformSpec::MapValues {
+                function,
+                compared,
+                values,
+                ..
+            } => {
+                let subject = match (function, compared) {
+                    (Some(function), Some(compared)) => format!("{}, {}", function, compared),
+                    (Some(function), None) => function.clone(),
+                    (None, compared) => compared.clone().unwrap_or_default(),
+                };
+                format!("map_values {} ({} value(s))", subject, values.len())
+            }
+            TransformSpec::RewriteLiteral { type_name, .. } => {
+                format!("rewrite_literal {}", type_name)
+            }
+            TransformSpec::RewriteString {
+                from, to, function, ..
+            } => match function {
+                Some(function) => format!("rewrite_string {:?} -> {:?} in {}", from, to, function),
+                None => format!("rewrite_string {:?} -> {:?}", from, to),
+            },
+            TransformSpec::RenameKey { key, new_name } => {
+                format!("rename_key {} -> {}", key, new_name)
+            }
+            TransformSpec::RewriteTag {
+                type_name, field, ..
+            } => match (type_name, field) {
+                (Some(type_name), Some(field)) => format!("rewrite_tag {}.{}", type_name, field),
+                (Some(name), None) | (None, Some(name)) => format!("rewrite_tag {}", name),
+                (None, None) => "rewrite_tag".to_string(),
+            },
+            TransformSpec::RemoveCall {
+                function, strategy, ..
+            } => format!("remove_call {} ({})", function, strategy),
+            TransformSpec::RenameModule { old_path, new_path } => {
+                format!("rename_module {} -> {}", old_path, new_path)
+            }
+            TransformSpec::RenameSpecifier { old_path, new_path } => {
+                format!("rename_specifier {} -> {}", old_path, new_path)
+            }
+            TransformSpec::RenameExport {
+                module,
+                old_name,
+                new_name,
+            } => format!("rename_export {}: {} -> {}", module, old_name, new_name),
+            TransformSpec::MoveExport {
+                name,
+                from_module,
+                to_module,
+            } => format!("move_export {}: {} -> {}", name, from_module, to_module),
+            TransformSpec::RenameSymbol {
+                package,
+                old_name,
+                new_name,
+            } => format!("rename_symbol {}: {} -> {}", package, old_name, new_name),
+            TransformSpec::RenameClass { old_name, new_name } => {
+                format!("rename_class {} -> {}", old_name, new_name)
+            }
+            TransformSpec::RenameMethod {
+                class,
+                old_name,
+                new_name,
+            } => format!("rename_method {}: {} -> {}", class, old_name, new_name),
+            TransformSpec::RenamePath { old_path, new_path } => {
+                format!("rename_path {} -> {}", old_path, new_path)
+            }
+            TransformSpec::RenameVariant {
+                enum_name,
+                old_name,
+                new_name,
+            } => format!("rename_variant {}: {} -> {}", enum_name, old_name, new_name),
+            TransformSpec::RenameGoType {
+                package,
+                old_name,
+                new_name,
+                ..
+            } => match package {
+                Some(package) => {
+                    format!("rename_go_type {}: {} -> {}", package, old_name, new_name)
+                }
+                None => format!("rename_go_type {} -> {}", old_name, new_name),
+            },
+            TransformSpec::InjectContext {
+                function, package, ..
+            } => match package {
+                Some(package) => format!("inject_context {}: {}", package, function),
+                None => format!("inject_context {}", function),
+            },
+        }
+    }
+
+    /// A short description in prose, such as `rename GetUser -> FetchUser`.
+    pub fn summary(&self) -> String {
+        if let TransformSpec::ReplaceStructural {
+            pattern,
+            replacement,
+        } = self
+        {
+            return format!("rewrite {} -> {}", one_line(pattern), one_line(replacement));
+        }
+        let description = self.describe();
+        let (kind, rest) = description
+            .split_once(' ')
+            .unwrap_or((description.as_str(), ""));
+        let verb = match kind {
+            "rewrite_call" => "rewrite call",
+            "map_values" => "map values of",
+            "rewrite_literal" => "rewrite literals of",
+            "rewrite_string" => "rewrite string",
+            "rewrite_tag" => "rewrite tags of",
+            "rename_key" => "rename key",
+            "inject_context" => "add context to",
+            "remove_call" => "handle removed",
+            _ => kind.split('_').next().unwrap_or(kind),
+        };
+        format!("{} {}", verb, rest)
+    }
+
     /// Convert this spec to a pattern and replacement.
     pub fn to_pattern_replacement(&self) -> (String, String) {
         match self {
@@ -50,7 +481,13 @@ impl TransformSpec {
             } => (pattern.clone(), replacement.clone()),
 
             TransformSpec::RenameFunction { old_name, new_name } => {
-                let pattern = format!(r"\b{}\s*(\(|::<)", regex::escape(old_name));
+                // Go generic calls and declarations put type arguments or
+                // parameters between the name and the `(`
+                let pattern = format!(
+                    r"\b{}\s*(\(|::<|{}\s*\()",
+                    regex::escape(old_name),
+                    structural::type_arguments()
+                );
                 let replacement = format!("{}$1", new_name);
                 (pattern, replacement)
             }
@@ -65,7 +502,869 @@ impl TransformSpec {
                 let replacement = format!("$1{}$1", new_path);
                 (pattern, replacement)
             }
+
+            TransformSpec::ReplaceStructural {
+                pattern,
+                replacement,
+            } => (
+                structural::compile_pattern(pattern),
+                structural::compile_replacement(pattern, replacement),
+            ),
+
+            // The replacement is computed per call by `call_rewrite`
+            TransformSpec::RewriteCall { .. } => (
+                self.call_rewrite()
+                    .expect("rewrite_call has a call rewrite")
+                    .pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::MapValues { .. } => (
+                self.value_map()
+                    .expect("map_values has a value map")
+                    .pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::RewriteLiteral { .. } => (
+                self.literal_rewrite()
+                    .expect("rewrite_literal has a literal rewrite")
+                    .pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::RewriteString { .. } => (
+                self.string_rewrite()
+                    .expect("rewrite_string has a string rewrite")
+                    .pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::RenameKey { key, new_name } => {
+                (KeyRename::new(key, new_name).pattern(), "$0".to_string())
+            }
+
+            TransformSpec::RewriteTag { .. } => (
+                self.tag_rewrite()
+                    .expect("rewrite_tag has a tag rewrite")
+                    .pattern(),
+                "$0".to_string(),
+            ),
+
+            // The replacement template only applies to the `replace` strategy
+            TransformSpec::RemoveCall { replacement, .. } => (
+                self.removed_call()
+                    .expect("remove_call has a removed call")
+                    .pattern(),
+                replacement.clone().unwrap_or_else(|| "$0".to_string()),
+            ),
+
+            TransformSpec::RenameModule { old_path, new_path } => {
+                let pattern = format!(r"(^|[^\w.]){}\b", regex::escape(old_path));
+                let replacement = format!("${{1}}{}", new_path);
+                (pattern, replacement)
+            }
+
+            TransformSpec::RenameSpecifier { old_path, new_path } => (
+                javascript::specifier_pattern(old_path),
+                format!("${{pre}}{}${{post}}", new_path),
+            ),
+
+            // Limited to files importing the module by `file_guard`
+            TransformSpec::RenameExport {
+                module,
+                old_name,
+                new_name,
+            } => (
+                ExportRename::new(module, old_name, new_name).pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::MoveExport {
+                name,
+                from_module,
+                to_module,
+            } => (
+                MoveExport::new(name, from_module, to_module).pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::RenameSymbol { .. } => (
+                self.symbol_rename()
+                    .expect("rename_symbol has a symbol rename")
+                    .pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::RenameGoType { .. } => (
+                self.type_rename()
+                    .expect("rename_go_type has a type rename")
+                    .pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::InjectContext { .. } => (
+                self.context_injection()
+                    .expect("inject_context has a context injection")
+                    .pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::RenameClass { old_name, new_name } => (
+                ClassRename::new(old_name, new_name).pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::RenameMethod {
+                class,
+                old_name,
+                new_name,
+            } => (
+                MethodRename::new(class, old_name, new_name).pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::RenamePath { old_path, new_path } => (
+                PathRename::new(old_path, new_path).pattern(),
+                "$0".to_string(),
+            ),
+
+            TransformSpec::RenameVariant {
+                enum_name,
+                old_name,
+                new_name,
+            } => (
+                VariantRename::new(enum_name, old_name, new_name).pattern(),
+                "$0".to_string(),
+            ),
+        }
+    }
+
+    /// Regex a file must contain for this spec to apply to it.
+    pub fn file_guard(&self) -> Option<String> {
+        match self {
+            TransformSpec::RenameExport { module, .. } => Some(javascript::imports_module(module)),
+            TransformSpec::RenameSymbol { .. } => self.symbol_rename().map(|r| r.file_pattern()),
+            TransformSpec::RenameGoType { .. } => self.type_rename().and_then(|r| r.file_pattern()),
+            TransformSpec::InjectContext { .. } => {
+                self.context_injection().and_then(|r| r.file_pattern())
+            }
+            TransformSpec::RenameClass { old_name, new_name } => {
+                Some(ClassRename::new(old_name, new_name).file_pattern())
+            }
+            TransformSpec::RenameMethod {
+                class,
+                old_name,
+                new_name,
+            } => Some(MethodRename::new(class, old_name, new_name).file_pattern()),
+            _ => None,
+        }
+    }
+
+    /// The rewriter computing this spec's replacements, for specs that need
+    /// more than a template.
+    pub fn rewriter(&self) -> Option<Arc<dyn Rewriter>> {
+        match self {
+            TransformSpec::RewriteCall { .. } => self
+                .call_rewrite()
+                .map(|r| Arc::new(r) as Arc<dyn Rewriter>),
+            TransformSpec::MapValues { .. } => {
+                self.value_map().map(|r| Arc::new(r) as Arc<dyn Rewriter>)
+            }
+            TransformSpec::RewriteLiteral { .. } => self
+                .literal_rewrite()
+                .map(|r| Arc::new(r) as Arc<dyn Rewriter>),
+            TransformSpec::RewriteString { .. } => self
+                .string_rewrite()
+                .map(|r| Arc::new(r) as Arc<dyn Rewriter>),
+            TransformSpec::RewriteTag { .. } => {
+                self.tag_rewrite().map(|r| Arc::new(r) as Arc<dyn Rewriter>)
+            }
+            TransformSpec::RenameKey { key, new_name } => {
+                Some(Arc::new(KeyRename::new(key, new_name)))
+            }
+            TransformSpec::InjectContext { .. } => self
+                .context_injection()
+                .map(|r| Arc::new(r) as Arc<dyn Rewriter>),
+            TransformSpec::RemoveCall { .. } => self
+                .removed_call()
+                .map(|r| Arc::new(r) as Arc<dyn Rewriter>),
+            TransformSpec::MoveExport {
+                name,
+                from_module,
+                to_module,
+            } => Some(Arc::new(MoveExport::new(name, from_module, to_module))),
+            TransformSpec::RenameExport {
+                module,
+                old_name,
+                new_name,
+            } => Some(Arc::new(ExportRename::new(module, old_name, new_name))),
+            TransformSpec::RenameSymbol { .. } => self
+                .symbol_rename()
+                .map(|r| Arc::new(r) as Arc<dyn Rewriter>),
+            TransformSpec::RenameGoType { .. } => {
+                self.type_rename().map(|r| Arc::new(r) as Arc<dyn Rewriter>)
+            }
+            TransformSpec::RenameClass { old_name, new_name } => {
+                Some(Arc::new(ClassRename::new(old_name, new_name)))
+            }
+            TransformSpec::RenameMethod {
+                class,
+                old_name,
+                new_name,
+            } => Some(Arc::new(MethodRename::new(class, old_name, new_name))),
+            TransformSpec::RenamePath { old_path, new_path } => {
+                Some(Arc::new(PathRename::new(old_path, new_path)))
+            }
+            TransformSpec::RenameVariant {
+                enum_name,
+                old_name,
+                new_name,
+            } => Some(Arc::new(VariantRename::new(enum_name, old_name, new_name))),
+            _ => None,
+        }
+    }
+
+    /// The symbol rename of a `rename_symbol` spec.
+    pub fn symbol_rename(&self) -> Option<SymbolRename> {
+        match self {
+            TransformSpec::RenameSymbol {
+                package,
+                old_name,
+                new_name,
+            } => Some(SymbolRename::new(package, old_name, new_name)),
+            _ => None,
+        }
+    }
+
+    /// The context injection of an `inject_context` spec.
+    pub fn context_injection(&self) -> Option<ContextInjection> {
+        match self {
+            TransformSpec::InjectContext {
+                function,
+                package,
+                parameter,
+                fallback,
+                signature,
+            } => {
+                let mut inject = ContextInjection::new(function);
+                if let Some(package) = package {
+                    inject = inject.package(package);
+                }
+                if let Some(parameter) = parameter {
+                    inject = inject.parameter(parameter);
+                }
+                if let Some(fallback) = fallback {
+                    inject = inject.fallback(fallback);
+                }
+                if let Some(signature) = signature {
+                    inject = inject.signature(signature);
+                }
+                Some(inject)
+            }
+            _ => None,
+        }
+    }
+
+    /// The type rename of a `rename_go_type` spec.
+    pub fn type_rename(&self) -> Option<TypeRename> {
+        match self {
+            TransformSpec::RenameGoType {
+                package,
+                old_name,
+                new_name,
+                transitive,
+            } => {
+                let rename = TypeRename::new(old_name, new_name).transitive(*transitive);
+                Some(match package {
+                    Some(package) => rename.package(package),
+                    None => rename,
+                })
+            }
+            _ => None,
+        }
+    }
+
+    /// The value map of a `map_values` spec.
+    pub fn value_map(&self) -> Option<ValueMap> {
+        let TransformSpec::MapValues {
+            function,
+            argument,
+            compared,
+            values,
+        } = self
+        else {
+            return None;
+        };
+        let mut map = values
+            .iter()
+            .fold(ValueMap::new(), |map, (old, new)| map.value(old, new));
+        if let Some(function) = function {
+            map = map.function(function);
+        }
+        if let Some(argument) = argument {
+            map = map.argument(argument);
+        }
+        if let Some(compared) = compared {
+            map = map.compared(compared);
+        }
+        Some(map)
+    }
+
+    /// The string rewrite of a `rewrite_string` spec.
+    pub fn string_rewrite(&self) -> Option<StringRewrite> {
+        let TransformSpec::RewriteString {
+            from,
+            to,
+            prefix,
+            function,
+            argument,
+        } = self
+        else {
+            return None;
+        };
+        let mut rewrite = StringRewrite::new(from, to);
+        if *prefix {
+            rewrite = rewrite.prefix();
+        }
+        if let Some(function) = function {
+            rewrite = rewrite.function(function);
+        }
+        if let Some(argument) = argument {
+            rewrite = rewrite.argument(argument);
+        }
+        Some(rewrite)
+    }
+
+    /// The tag rewrite of a `rewrite_tag` spec.
+    pub fn tag_rewrite(&self) -> Option<TagRewrite> {
+        let TransformSpec::RewriteTag {
+            type_name,
+            field,
+            rename,
+            add,
+            remove,
+        } = self
+        else {
+            return None;
+        };
+        let mut rewrite = TagRewrite::new();
+        if let Some(type_name) = type_name {
+            rewrite = rewrite.type_name(type_name);
+        }
+        if let Some(field) = field {
+            rewrite = rewrite.field(field);
+        }
+        for (key, names) in rename {
+            for (from, to) in names {
+                rewrite = rewrite.rename(key, from, to);
+            }
+        }
+        for (key, value) in add {
+            rewrite = rewrite.add(key, value);
+        }
+        for key in remove {
+            rewrite = rewrite.remove(key);
+        }
+        Some(rewrite)
+    }
+
+    /// The removed call of a `remove_call` spec.
+    pub fn removed_call(&self) -> Option<RemovedCall> {
+        match self {
+            TransformSpec::RemoveCall {
+                function, strategy, ..
+            } => Some(RemovedCall::new(function, *strategy)),
+            _ => None,
+        }
+    }
+
+    /// Check if every match of this spec is reported as a diagnostic, even
+    /// when it is rewritten.
+    pub fn reports_sites(&self) -> bool {
+        matches!(self, TransformSpec::RemoveCall { .. })
+    }
+
+    /// The literal rewrite of a `rewrite_literal` spec.
+    pub fn literal_rewrite(&self) -> Option<LiteralRewrite> {
+        let TransformSpec::RewriteLiteral {
+            type_name,
+            fields,
+            rename,
+            add,
+        } = self
+        else {
+            return None;
+        };
+        let rewrite = LiteralRewrite::new(type_name).fields(fields.clone());
+        let rewrite = rename.iter().fold(rewrite, |rewrite, (from, to)| {
+            rewrite.rename_field(from, to)
+        });
+        Some(
+            add.iter()
+                .fold(rewrite, |rewrite, field| rewrite.add_field(field.clone())),
+        )
+    }
+
+    /// The call rewrite of a `rewrite_call` spec.
+    pub fn call_rewrite(&self) -> Option<CallRewrite> {
+        let TransformSpec::RewriteCall {
+            function,
+            new_name,
+            arity,
+            remove,
+            order,
+            keywords,
+            add,
+            signature,
+        } = self
+        else {
+            return None;
+        };
+        let mut rewrite = CallRewrite::new(function).order(order.clone());
+        if let Some(new_name) = new_name {
+            rewrite = rewrite.rename(new_name);
+        }
+        if let Some(signature) = signature {
+            rewrite = rewrite.signature(signature);
+        }
+        if let Some(arity) = arity {
+            rewrite = rewrite.arity(*arity);
+        }
+        rewrite = remove.iter().fold(rewrite, |rewrite, argument| {
+            rewrite.remove_argument(argument)
+        });
+        rewrite = keywords.iter().fold(rewrite, |rewrite, (from, to)| {
+            rewrite.rename_keyword(from, to)
+        });
+        Some(add.iter().fold(rewrite, |rewrite, argument| {
+            rewrite.add_argument(argument.clone())
+        }))
+    }
+}
+
+/// A predicate that must hold for a rule to fire.
+///
+/// All configured conditions must hold. Captures may be referenced by name
+/// or by index (e.g. `"2"` for the second group of a `replace_pattern`).
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct RuleCondition {
+    /// Glob patterns the file path must match (any of them).
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub paths: Vec<String>,
+
+    /// Regex the file content must match.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub file_contains: Option<String>,
+
+    /// Regex the matched text must match.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub matched: Option<String>,
+
+    /// Regexes that individual captures must match.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub captures: BTreeMap<String, String>,
+
+    /// Captures that must be literal values.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub literal: Vec<String>,
+
+    /// Constraint on the Go version declared by the go.mod of the file's
+    /// module (e.g. `>=1.22`).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub go_version: Option<String>,
+
+    /// Go feature the version of the file's module must have (e.g.
+    /// `loopvar` or `min`).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub go_feature: Option<String>,
+}
+
+impl RuleCondition {
+    /// Convert this condition to a transform guard.
+    pub fn to_guard(&self) -> Guard {
+        let mut guard = Guard::new();
+        for pattern in &self.paths {
+            guard = guard.path(pattern);
+        }
+        if let Some(pattern) = &self.file_contains {
+            guard = guard.file_contains(pattern);
+        }
+        if let Some(pattern) = &self.matched {
+            guard = guard.matched(pattern);
+        }
+        for (name, pattern) in &self.captures {
+            guard = guard.capture(name, pattern);
+        }
+        for name in &self.literal {
+            guard = guard.capture_is_literal(name);
+        }
+        if let Some(constraint) = &self.go_version {
+            guard = guard.go_version(constraint);
+        }
+        if let Some(feature) = &self.go_feature {
+            guard = guard.go_feature(feature);
+        }
+        guard
+    }
+}
+
+/// Whether a rule rewrites code or only reports matches.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum RuleMode {
+    /// Rewrite matches.
+    #[default]
+    Apply,
+    /// Report matches as diagnostics with a suggested fix, never rewriting.
+    Suggest,
+}
+
+impl RuleMode {
+    fn is_default(&self) -> bool {
+        *self == RuleMode::Apply
+    }
+}
+
+/// How serious a match of a rule left in the code is, for CI gates (see
+/// the `check` command).
+#[derive(
+    Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize,
+)]
+#[serde(rename_all = "lowercase")]
+pub enum RuleSeverity {
+    /// Worth knowing, never blocking.
+    Info,
+    /// Should be migrated.
+    #[default]
+    #[serde(alias = "warning")]
+    Warn,
+    /// Must be migrated, such as a use of an API already removed.
+    Error,
+}
+
+impl RuleSeverity {
+    fn is_default(&self) -> bool {
+        *self == RuleSeverity::Warn
+    }
+}
+
+impl fmt::Display for RuleSeverity {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            RuleSeverity::Info => write!(f, "info"),
+            RuleSeverity::Warn => write!(f, "warn"),
+            RuleSeverity::Error => write!(f, "error"),
+        }
+    }
+}
+
+/// `template` on one line, for descriptions of multi-line templates.
+fn one_line(template: &str) -> String {
+    template.split_whitespace().collect::<Vec<_>>().join(" ")
+}
+
+/// A transform specification with optional guards.
+///
+/// # Example YAML
+///
+/// ```yaml
+/// - id: drop-sync-flag
+///   type: replace_pattern
+///   pattern: 'Save\((\w+), ([^)]+)\)'
+///   replacement: 'Save($1)'
+///   when:
+///     paths: ["internal/**"]
+///     literal: ["2"]
+///   unless:
+///     file_contains: "// keep-sync"
+/// - id: flag-deprecated-fn
+///   mode: suggest
+///   message: DeprecatedFn is going away; use ReplacementFn
+///   type: rename_function
+///   old_name: DeprecatedFn
+///   new_name: ReplacementFn
+/// - id: connect-timeout
+///   type: replace_pattern
+///   pattern: 'pool\.Connect\(([^)]+)\)'
+///   replacement: 'pool.Connect($1, 30*time.Second)'
+///   imports: ["github.com/acme/pool/v3"]
+/// - id: open-with-context
+///   type: replace_pattern
+///   pattern: 'Open\(([^)]*)\)'
+///   replacement: 'Open(ctx, $1)'
+///   matcher: is-db-call
+///   rewriter: order-args
+/// ```
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TransformRule {
+    /// Identifier used to refer to this rule in reports.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub id: Option<String>,
+
+    /// Message explaining the rule, shown with diagnostics.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub message: Option<String>,
+
+    /// Whether the rule rewrites code or only reports matches.
+    #[serde(default, skip_serializing_if = "RuleMode::is_default")]
+    pub mode: RuleMode,
+
+    /// How serious a match left in the code is (default `warn`).
+    #[serde(default, skip_serializing_if = "RuleSeverity::is_default")]
+    pub severity: RuleSeverity,
+
+    /// The transform to apply.
+    #[serde(flatten)]
+    pub spec: TransformSpec,
+
+    /// Only fire where this condition holds.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub when: Option<RuleCondition>,
+
+    /// Never fire where this condition holds.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub unless: Option<RuleCondition>,
+
+    /// Import paths the replacement may reference; added to rewritten
+    /// files when needed (standard library packages are resolved
+    /// automatically).
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub imports: Vec<String>,
+
+    /// Plugin that decides whether each match fires (see
+    /// [`crate::plugin`]).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub matcher: Option<String>,
+
+    /// Plugin that computes the replacement of each match.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rewriter: Option<String>,
+
+    /// Globs of the files the rule edits instead of those with the
+    /// config's extensions, such as `**/*.yaml` or `**/Dockerfile`, for
+    /// configuration and other files changed along with the code.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub files: Vec<String>,
+}
+
+impl TransformRule {
+    /// Create an unguarded rule.
+    pub fn new(spec: TransformSpec) -> Self {
+        Self {
+            id: None,
+            message: None,
+            mode: RuleMode::Apply,
+            severity: RuleSeverity::Warn,
+            spec,
+            when: None,
+            unless: None,
+            imports: Vec::new(),
+            matcher: None,
+            rewriter: None,
+            files: Vec::new(),
+        }
+    }
+
+    /// Set the rule identifier.
+    pub fn with_id(mut self, id: impl Into<String>) -> Self {
+        self.id = Some(id.into());
+        self
+    }
+
+    /// Limit the rule to the files matching `globs`, whatever their
+    /// extension.
+    pub fn with_files(mut self, globs: impl IntoIterator<Item = impl Into<String>>) -> Self {
+        self.files = globs.into_iter().map(Into::into).collect();
+        self
+    }
+
+    /// Set how serious a match left in the code is.
+    pub fn with_severity(mut self, severity: RuleSeverity) -> Self {
+        self.severity = severity;
+        self
+    }
+
+    /// Set the rule message.
+    pub fn with_message(mut self, message: impl Into<String>) -> Self {
+        self.message = Some(message.into());
+        self
+    }
+
+    /// Only report matches as diagnostics; never rewrite code.
+    pub fn suggest_only(mut self) -> Self {
+        self.mode = RuleMode::Suggest;
+        self
+    }
+
+    /// Check if this rule only reports matches.
+    pub fn is_suggest_only(&self) -> bool {
+        self.mode == RuleMode::Suggest
+    }
+
+    /// Name used to refer to this rule in reports.
+    pub fn name(&self) -> String {
+        self.id.clone().unwrap_or_else(|| self.spec.describe())
+    }
+
+    /// Stable identifier of this rule: its `id`, or one derived from what
+    /// the rule does (`rename-function-getuser-fetchuser`), which stays the
+    /// same wherever the rule moves in its file.
+    pub fn rule_id(&self) -> String {
+        if let Some(id) = &self.id {
+            return id.clone();
+        }
+        let slug: Vec<String> = self
+            .spec
+            .describe()
+            .split(|c: char| !c.is_alphanumeric())
+            .filter(|word| !word.is_empty())
+            .map(str::to_lowercase)
+            .collect();
+        slug.join("-")
+    }
+
+    /// A commit message for the changes of this rule alone:
+    /// `refactor: rename GetUser -> FetchUser (rule get-user-rename)`.
+    pub fn commit_message(&self) -> String {
+        match &self.id {
+            Some(id) => format!("refactor: {} (rule {})", self.spec.summary(), id),
+            None => format!("refactor: {}", self.spec.summary()),
+        }
+    }
+
+    /// Only fire where the condition holds.
+    pub fn when(mut self, condition: RuleCondition) -> Self {
+        self.when = Some(condition);
+        self
+    }
+
+    /// Never fire where the condition holds.
+    pub fn unless(mut self, condition: RuleCondition) -> Self {
+        self.unless = Some(condition);
+        self
+    }
+
+    /// Declare an import path the replacement may reference.
+    pub fn with_import(mut self, path: impl Into<String>) -> Self {
+        self.imports.push(path.into());
+        self
+    }
+
+    /// Filter matches with the named matcher plugin.
+    pub fn with_matcher(mut self, name: impl Into<String>) -> Self {
+        self.matcher = Some(name.into());
+        self
+    }
+
+    /// Compute replacements with the named rewriter plugin.
+    pub fn with_rewriter(mut self, name: impl Into<String>) -> Self {
+        self.rewriter = Some(name.into());
+        self
+    }
+
+    /// Check if this rule has any guards.
+    pub fn is_guarded(&self) -> bool {
+        self.when.is_some() || self.unless.is_some()
+    }
+
+    /// Check if this rule refers to a matcher or rewriter plugin.
+    pub fn uses_plugins(&self) -> bool {
+        self.matcher.is_some() || self.rewriter.is_some()
+    }
+
+    /// Check if this rule depends on the Go version of a file's module.
+    pub fn uses_go_version(&self) -> bool {
+        [&self.when, &self.unless]
+            .into_iter()
+            .flatten()
+            .any(|condition| condition.go_version.is_some() || condition.go_feature.is_some())
+    }
+
+    /// Check if this rule compiles to more than a regex replacement.
+    /// Structural rules do, to compare repeated metavariables.
+    fn needs_transform(&self) -> bool {
+        matches!(self.spec, TransformSpec::ReplaceStructural { .. })
+            || self.is_guarded()
+            || self.uses_plugins()
+            || self.spec.file_guard().is_some()
+            || self.spec.rewriter().is_some()
+    }
+
+    /// Compile this rule into a guarded transform.
+    ///
+    /// Fails if the rule uses plugins; see [`TransformRule::to_transform_with`].
+    pub fn to_transform(&self) -> Result<GuardedTransform> {
+        self.to_transform_with(&PluginRegistry::new())
+    }
+
+    /// Compile this rule, resolving its plugins in `plugins`.
+    pub fn to_transform_with(&self, plugins: &PluginRegistry) -> Result<GuardedTransform> {
+        if let TransformSpec::RemoveCall {
+            strategy: Removal::Replace,
+            replacement: None,
+            ..
+        } = &self.spec
+        {
+            return Err(RefactorError::InvalidConfig(format!(
+                "Rule '{}' uses the replace strategy without a replacement",
+                self.name()
+            )));
+        }
+        let (pattern, replacement) = self.spec.to_pattern_replacement();
+        let mut transform = GuardedTransform::new(&pattern, &replacement)?;
+        let when = match (&self.when, self.spec.file_guard()) {
+            (Some(condition), Some(pattern)) => Some(condition.to_guard().file_contains(pattern)),
+            (Some(condition), None) => Some(condition.to_guard()),
+            (None, Some(pattern)) => Some(Guard::new().file_contains(pattern)),
+            (None, None) => None,
+        };
+        if let Some(guard) = when {
+            transform = transform.when(guard)?;
+        }
+        if let Some(condition) = &self.unless {
+            transform = transform.unless(condition.to_guard())?;
+        }
+        if let Some(name) = &self.matcher {
+            transform = transform.matcher(plugins.matcher(name)?);
+        }
+        match (self.spec.rewriter(), &self.rewriter) {
+            (Some(_), Some(name)) => {
+                return Err(RefactorError::InvalidConfig(format!(
+                    "Rule '{}' cannot use rewriter '{}': the rule computes its own replacements",
+                    self.name(),
+                    name
+                )));
+            }
+            (Some(rewriter), None) => transform = transform.rewriter(rewriter),
+            (None, Some(name)) => transform = transform.rewriter(plugins.rewriter(name)?),
+            (None, None) => {}
         }
+        Ok(transform)
+    }
+
+    /// Add this rule to a transform builder.
+    ///
+    /// Suggest-only rules never rewrite code, so they are not added. Fails
+    /// if the rule does not compile.
+    pub fn add_to(&self, builder: TransformBuilder) -> Result<TransformBuilder> {
+        if self.is_suggest_only() {
+            return Ok(builder);
+        }
+        if !self.needs_transform() {
+            let (pattern, replacement) = self.spec.to_pattern_replacement();
+            return Ok(builder.custom(TextTransform::replace_regex(
+                Regex::new(&pattern)?,
+                replacement,
+            )));
+        }
+        Ok(builder.custom(self.to_transform()?))
+    }
+}
+
+impl From<TransformSpec> for TransformRule {
+    fn from(spec: TransformSpec) -> Self {
+        Self::new(spec)
     }
 }
 
@@ -109,12 +1408,26 @@ pub struct UpgradeConfig {
     pub exclude_patterns: Vec<String>,
 
     /// The transforms to apply.
-    pub transforms: Vec<TransformSpec>,
+    pub transforms: Vec<TransformRule>,
 
     /// Original detected changes (optional, for reference).
     #[serde(default, skip_serializing_if = "Vec::is_empty")]
     pub changes: Vec<ApiChange>,
 
+    /// Named values, such as library defaults, that rule replacements and
+    /// messages can reference as `{{name}}`.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub values: BTreeMap<String, String>,
+
+    /// External matcher and rewriter plugins, by name.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub plugins: BTreeMap<String, PluginSpec>,
+
+    /// The dependency this upgrade migrates (e.g. `github.com/acme/pool`),
+    /// as named by the project's package manager.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub module: Option<String>,
+
     /// Library version this upgrade is from.
     #[serde(skip_serializing_if = "Option::is_none")]
     pub from_version: Option<String>,
@@ -122,6 +1435,22 @@ pub struct UpgradeConfig {
     /// Library version this upgrade is to.
     #[serde(skip_serializing_if = "Option::is_none")]
     pub to_version: Option<String>,
+
+    /// Names of upgrades that must be applied before this one, such as the
+    /// upgrade of a library whose new types this library's new version
+    /// uses.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub requires: Vec<String>,
+
+    /// Engine semantics the upgrade was written and tested against (see
+    /// [`crate::semantics`]). Unpinned upgrades follow the engine's current
+    /// semantics.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub engine: Option<SemanticsVersion>,
+
+    /// Whether the external plugins may run; never read from a file.
+    #[serde(skip)]
+    plugins_allowed: bool,
 }
 
 impl Default for UpgradeConfig {
@@ -137,8 +1466,14 @@ impl Default for UpgradeConfig {
             ],
             transforms: Vec::new(),
             changes: Vec::new(),
+            values: BTreeMap::new(),
+            plugins: BTreeMap::new(),
+            module: None,
             from_version: None,
             to_version: None,
+            requires: Vec::new(),
+            engine: None,
+            plugins_allowed: false,
         }
     }
 }
@@ -153,9 +1488,9 @@ impl UpgradeConfig {
         }
     }
 
-    /// Add a transform specification.
-    pub fn add_transform(&mut self, transform: TransformSpec) {
-        self.transforms.push(transform);
+    /// Add a transform specification or rule.
+    pub fn add_transform(&mut self, transform: impl Into<TransformRule>) {
+        self.transforms.push(transform.into());
     }
 
     /// Set target extensions.
@@ -177,6 +1512,83 @@ impl UpgradeConfig {
         self
     }
 
+    /// Set the dependency this upgrade migrates.
+    pub fn with_module(mut self, module: impl Into<String>) -> Self {
+        self.module = Some(module.into());
+        self
+    }
+
+    /// Pin the engine semantics the upgrade follows.
+    pub fn with_engine(mut self, version: SemanticsVersion) -> Self {
+        self.engine = Some(version);
+        self
+    }
+
+    /// Append the rules of `other`, to run as one upgrade named `self+other`
+    /// from `self`'s version to `other`'s.
+    ///
+    /// Extensions, exclude globs, values and plugins are combined; where
+    /// both declare a value, `self`'s is kept (`other`'s rules were resolved
+    /// with their own), and a plugin `other` declares differently is renamed
+    /// `name@other` for `other`'s rules. If both are pinned to engine
+    /// semantics, the newer version is kept; an unpinned config follows the
+    /// current semantics, so the merge does too.
+    pub fn merge(&mut self, mut other: UpgradeConfig) {
+        self.name = format!("{}+{}", self.name, other.name);
+        self.engine = self.engine.zip(other.engine).map(|(a, b)| a.max(b));
+        self.plugins_allowed &= other.plugins_allowed;
+        self.module = self.module.take().or(other.module);
+        self.from_version = self.from_version.take().or(other.from_version);
+        self.to_version = other.to_version.or(self.to_version.take());
+        for (name, spec) in std::mem::take(&mut other.plugins) {
+            match self.plugins.get(&name) {
+                Some(existing) if *existing != spec => {
+                    let renamed = format!("{}@{}", name, other.name);
+                    for rule in &mut other.transforms {
+                        for plugin in [&mut rule.matcher, &mut rule.rewriter]
+                            .into_iter()
+                            .flatten()
+                        {
+                            if *plugin == name {
+                                plugin.clone_from(&renamed);
+                            }
+                        }
+                    }
+                    self.plugins.insert(renamed, spec);
+                }
+                Some(_) => {}
+                None => {
+                    self.plugins.insert(name, spec);
+                }
+            }
+        }
+        for (name, value) in other.values {
+            self.values.entry(name).or_insert(value);
+        }
+        for (list, more) in [
+            (&mut self.extensions, other.extensions),
+            (&mut self.exclude_patterns, other.exclude_patterns),
+            (&mut self.requires, other.requires),
+        ] {
+            for item in more {
+                if !list.contains(&item) {
+                    list.push(item);
+                }
+            }
+        }
+        // Requirements met by the merged upgrades themselves are dropped
+        let merged: Vec<String> = self.name.split('+').map(String::from).collect();
+        self.requires.retain(|name| !merged.contains(name));
+        self.changes.extend(other.changes);
+        self.transforms.extend(other.transforms);
+    }
+
+    /// Require upgrade `name` to be applied before this one.
+    pub fn requires(mut self, name: impl Into<String>) -> Self {
+        self.requires.push(name.into());
+        self
+    }
+
     /// Load config from a YAML file.
     pub fn from_yaml(path: impl AsRef<Path>) -> Result<Self> {
         let content = std::fs::read_to_string(path.as_ref()).map_err(|e| {
@@ -186,9 +1598,11 @@ impl UpgradeConfig {
             ))
         })?;
 
-        serde_yaml::from_str(&content).map_err(|e| {
+        let mut config: Self = serde_yaml::from_str(&content).map_err(|e| {
             RefactorError::InvalidConfig(format!("Failed to parse YAML config: {}", e))
-        })
+        })?;
+        config.resolve_values()?;
+        Ok(config)
     }
 
     /// Load config from a JSON file.
@@ -200,9 +1614,103 @@ impl UpgradeConfig {
             ))
         })?;
 
-        serde_json::from_str(&content).map_err(|e| {
+        let mut config: Self = serde_json::from_str(&content).map_err(|e| {
             RefactorError::InvalidConfig(format!("Failed to parse JSON config: {}", e))
-        })
+        })?;
+        config.resolve_values()?;
+        Ok(config)
+    }
+
+    /// Substitute `{{name}}` references to [`values`](Self::values) in rule
+    /// replacements and messages. Configs loaded from files are resolved
+    /// already.
+    pub fn resolve_values(&mut self) -> Result<()> {
+        let values = &self.values;
+        let expand = |template: &mut String| -> Result<()> {
+            if let Some(caps) = VALUE_REF
+                .captures_iter(template)
+                .find(|caps| !values.contains_key(&caps[1]))
+            {
+                return Err(RefactorError::InvalidConfig(format!(
+                    "Unknown value '{}' in '{}'",
+                    &caps[1], template
+                )));
+            }
+            *template = VALUE_REF
+                .replace_all(template, |caps: &regex::Captures| values[&caps[1]].clone())
+                .into_owned();
+            Ok(())
+        };
+
+        for rule in &mut self.transforms {
+            if let Some(message) = &mut rule.message {
+                expand(message)?;
+            }
+            match &mut rule.spec {
+                TransformSpec::ReplaceLiteral { to, .. } => expand(to)?,
+                TransformSpec::ReplacePattern { replacement, .. }
+                | TransformSpec::ReplaceStructural { replacement, .. } => expand(replacement)?,
+                TransformSpec::RenameFunction { new_name, .. }
+                | TransformSpec::RenameType { new_name, .. } => expand(new_name)?,
+                TransformSpec::RenameImport { new_path, .. }
+                | TransformSpec::RenameModule { new_path, .. }
+                | TransformSpec::RenameSpecifier { new_path, .. }
+                | TransformSpec::RenamePath { new_path, .. } => expand(new_path)?,
+                TransformSpec::RenameExport { new_name, .. }
+                | TransformSpec::RenameSymbol { new_name, .. }
+                | TransformSpec::RenameClass { new_name, .. }
+                | TransformSpec::RenameMethod { new_name, .. }
+                | TransformSpec::RenameVariant { new_name, .. }
+                | TransformSpec::RenameGoType { new_name, .. } => expand(new_name)?,
+                TransformSpec::MoveExport { to_module, .. } => expand(to_module)?,
+                TransformSpec::RewriteCall { new_name, add, .. } => {
+                    if let Some(new_name) = new_name {
+                        expand(new_name)?;
+                    }
+                    for argument in add {
+                        expand(&mut argument.value)?;
+                    }
+                }
+                TransformSpec::MapValues { values, .. } => {
+                    for new in values.values_mut() {
+                        expand(new)?;
+                    }
+                }
+                TransformSpec::RewriteString { to, .. } => expand(to)?,
+                TransformSpec::RenameKey { new_name, .. } => expand(new_name)?,
+                TransformSpec::InjectContext {
+                    fallback: Some(fallback),
+                    ..
+                } => expand(fallback)?,
+                TransformSpec::InjectContext { .. } => {}
+                TransformSpec::RewriteTag { add, .. } => {
+                    for value in add.values_mut() {
+                        expand(value)?;
+                    }
+                }
+                TransformSpec::RemoveCall {
+                    replacement: Some(replacement),
+                    ..
+                } => expand(replacement)?,
+                TransformSpec::RemoveCall { .. } => {}
+                TransformSpec::RewriteLiteral { add, .. } => {
+                    for value in add.iter_mut().filter_map(|field| field.value.as_mut()) {
+                        expand(value)?;
+                    }
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Load config from a YAML or JSON file, based on its extension.
+    pub fn from_file(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref();
+        if path.extension().is_some_and(|e| e == "json") {
+            Self::from_json(path)
+        } else {
+            Self::from_yaml(path)
+        }
     }
 
     /// Save config to a YAML file.
@@ -233,6 +1741,84 @@ impl UpgradeConfig {
         })
     }
 
+    /// Keep the rules named in `only` (every rule if it is empty), except
+    /// those named in `skip`. Rules are named by their
+    /// [`rule_id`](TransformRule::rule_id) or [`name`](TransformRule::name).
+    /// Fails on a name no rule has, listing the ids of the rules, and on a
+    /// name more than one rule has, which could not select just one of them.
+    pub fn select_rules(&mut self, only: &[String], skip: &[String]) -> Result<()> {
+        let named = |rule: &TransformRule, names: &[String]| {
+            names
+                .iter()
+                .any(|name| *name == rule.rule_id() || *name == rule.name())
+        };
+        for name in only.iter().chain(skip) {
+            let matching: Vec<usize> = (0..self.transforms.len())
+                .filter(|&index| named(&self.transforms[index], std::slice::from_ref(name)))
+                .collect();
+            match matching[..] {
+                [] => {
+                    let ids: Vec<String> =
+                        self.transforms.iter().map(TransformRule::rule_id).collect();
+                    return Err(RefactorError::InvalidConfig(format!(
+                        "Upgrade '{}' has no rule '{}'; its rules are: {}",
+                        self.name,
+                        name,
+                        ids.join(", ")
+                    )));
+                }
+                [_] => {}
+                [first, second, ..] => {
+                    return Err(RefactorError::InvalidConfig(format!(
+                        "Rules {} and {} of upgrade '{}' are both named '{}'; give one of them its own `id`",
+                        first + 1,
+                        second + 1,
+                        self.name,
+                        name
+                    )));
+                }
+            }
+        }
+        self.transforms
+            .retain(|rule| (only.is_empty() || named(rule, only)) && !named(rule, skip));
+        Ok(())
+    }
+
+    /// The globs of the files rules edit besides those with the config's
+    /// extensions, such as configuration files changed along with the code.
+    pub fn companion_files(&self) -> Vec<String> {
+        let mut globs: Vec<String> = Vec::new();
+        for glob in self.transforms.iter().flat_map(|rule| &rule.files) {
+            if !globs.contains(glob) {
+                globs.push(glob.clone());
+            }
+        }
+        globs
+    }
+
+    /// Allow the external plugins this config declares to run. They run
+    /// commands named by the config, so this is off by default and only
+    /// for configs the user trusts.
+    pub fn allow_plugins(mut self, allow: bool) -> Self {
+        self.plugins_allowed = allow;
+        self
+    }
+
+    /// Whether the external plugins this config declares may run.
+    pub fn plugins_allowed(&self) -> bool {
+        self.plugins_allowed
+    }
+
+    /// A registry of the plugins declared in this config. Unless they are
+    /// [allowed](Self::allow_plugins), rules using them fail to compile.
+    pub fn plugin_registry(&self) -> PluginRegistry {
+        if self.plugins_allowed {
+            PluginRegistry::from_specs(&self.plugins)
+        } else {
+            PluginRegistry::denying(&self.plugins)
+        }
+    }
+
     /// Convert to an Upgrade implementation.
     pub fn to_upgrade(&self) -> ConfigBasedUpgrade {
         ConfigBasedUpgrade {
@@ -267,6 +1853,36 @@ impl ConfigBasedUpgrade {
     pub fn config(&self) -> &UpgradeConfig {
         &self.config
     }
+
+    /// The transformations to apply, failing on a rule that does not
+    /// compile.
+    pub fn try_transform(&self) -> Result<TransformBuilder> {
+        let mut builder = TransformBuilder::new();
+        let plugins = self.config.plugin_registry();
+
+        for rule in &self.config.transforms {
+            builder = if rule.uses_plugins() && !rule.is_suggest_only() {
+                builder.custom(rule.to_transform_with(&plugins)?)
+            } else {
+                rule.add_to(builder)?
+            };
+        }
+
+        Ok(builder)
+    }
+}
+
+/// A rule that failed to compile, failing every file it is applied to.
+struct InvalidRule(String);
+
+impl Transform for InvalidRule {
+    fn apply(&self, _source: &str, _path: &Path) -> Result<String> {
+        Err(RefactorError::InvalidConfig(self.0.clone()))
+    }
+
+    fn describe(&self) -> String {
+        format!("Invalid rule: {}", self.0)
+    }
 }
 
 impl Upgrade for ConfigBasedUpgrade {
@@ -295,21 +1911,67 @@ impl Upgrade for ConfigBasedUpgrade {
         }
     }
 
+    /// The transformations to apply. A rule that does not compile fails
+    /// each file instead; [`try_transform`](ConfigBasedUpgrade::try_transform)
+    /// reports it up front.
     fn transform(&self) -> TransformBuilder {
-        let mut builder = TransformBuilder::new();
-
-        for spec in &self.config.transforms {
-            let (pattern, replacement) = spec.to_pattern_replacement();
-            builder = builder.replace_pattern(&pattern, &replacement);
-        }
-
-        builder
+        self.try_transform()
+            .unwrap_or_else(|e| TransformBuilder::new().custom(InvalidRule(e.to_string())))
     }
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::transform::Transform;
+
+    #[test]
+    fn test_merge_engine_pins() {
+        let old = SemanticsVersion::new(0, 2);
+        let new = SemanticsVersion::new(0, 3);
+        let merged = |a: Option<SemanticsVersion>, b: Option<SemanticsVersion>| {
+            let mut config = UpgradeConfig::new("a", "A");
+            config.engine = a;
+            let mut other = UpgradeConfig::new("b", "B");
+            other.engine = b;
+            config.merge(other);
+            config.engine
+        };
+        assert_eq!(merged(Some(old), Some(new)), Some(new));
+        assert_eq!(merged(None, Some(old)), None);
+        assert_eq!(merged(Some(old), None), None);
+    }
+
+    #[test]
+    fn test_merge_keeps_every_field() {
+        let plugin = |program: &str| PluginSpec {
+            command: vec![program.to_string()],
+        };
+        let mut a = UpgradeConfig::new("a", "A");
+        a.exclude_patterns = vec!["gen/**".to_string()];
+        a.values.insert("timeout".to_string(), "30".to_string());
+        a.plugins.insert("order".to_string(), plugin("a.py"));
+        let mut b = UpgradeConfig::new("b", "B").requires("a").requires("proto");
+        b.exclude_patterns = vec!["gen/**".to_string(), "vendor/**".to_string()];
+        b.values.insert("retries".to_string(), "3".to_string());
+        b.plugins.insert("order".to_string(), plugin("b.py"));
+        b.plugins.insert("check".to_string(), plugin("check.py"));
+        let mut rule = TransformRule::new(TransformSpec::ReplaceLiteral {
+            from: "x".to_string(),
+            to: "y".to_string(),
+        });
+        rule.rewriter = Some("order".to_string());
+        b.add_transform(rule);
+
+        a.merge(b);
+        assert_eq!(a.exclude_patterns, ["gen/**", "vendor/**"]);
+        assert_eq!(a.requires, ["proto"]);
+        assert_eq!(a.values.len(), 2);
+        let plugins: Vec<_> = a.plugins.keys().map(String::as_str).collect();
+        assert_eq!(plugins, ["check", "order", "order@b"]);
+        assert_eq!(a.transforms[0].rewriter.as_deref(), Some("order@b"));
+        assert_eq!(a.plugins["order@b"], plugin("b.py"));
+    }
 
     #[test]
     fn test_transform_spec_rename_function() {
@@ -348,6 +2010,30 @@ mod tests {
         assert_eq!(replacement, "new.api");
     }
 
+    #[test]
+    fn test_rule_commit_message() {
+        let rule = TransformRule::new(TransformSpec::RenameFunction {
+            old_name: "GetUser".to_string(),
+            new_name: "FetchUser".to_string(),
+        });
+        assert_eq!(
+            rule.clone().with_id("get-user-rename").commit_message(),
+            "refactor: rename GetUser -> FetchUser (rule get-user-rename)"
+        );
+        assert_eq!(
+            rule.commit_message(),
+            "refactor: rename GetUser -> FetchUser"
+        );
+        let structural = TransformSpec::ReplaceStructural {
+            pattern: "errors.Wrap($e, $m)".to_string(),
+            replacement: "fmt.Errorf($m, $e)".to_string(),
+        };
+        assert_eq!(
+            structural.summary(),
+            "rewrite errors.Wrap($e, $m) -> fmt.Errorf($m, $e)"
+        );
+    }
+
     #[test]
     fn test_upgrade_config_serialization() {
         let mut config = UpgradeConfig::new("test-upgrade", "A test upgrade");
@@ -379,6 +2065,13 @@ mod tests {
         assert_eq!(upgrade.name(), "my-upgrade");
         assert_eq!(upgrade.description(), "My upgrade");
         assert!(!upgrade.transform().is_empty());
+
+        // A malformed pattern fails instead of panicking
+        config.add_transform(TransformSpec::ReplacePattern {
+            pattern: "old(".to_string(),
+            replacement: "new".to_string(),
+        });
+        assert!(config.to_upgrade().try_transform().is_err());
     }
 
     #[test]
@@ -412,4 +2105,414 @@ transforms:
         assert_eq!(config.extensions.len(), 2);
         assert_eq!(config.transforms.len(), 2);
     }
+
+    #[test]
+    fn test_transform_rule_with_guards_yaml() {
+        let yaml = r#"
+name: guarded
+description: Guarded upgrade
+transforms:
+  - type: replace_pattern
+    pattern: 'Save\((\w+), ([^)]+)\)'
+    replacement: 'Save($1)'
+    when:
+      paths: ["internal/**"]
+      literal: ["2"]
+  - type: replace_literal
+    from: old
+    to: new
+"#;
+
+        let config: UpgradeConfig = serde_yaml::from_str(yaml).unwrap();
+        assert_eq!(config.transforms.len(), 2);
+        assert!(config.transforms[0].is_guarded());
+        assert_eq!(
+            config.transforms[0].when.as_ref().unwrap().literal,
+            vec!["2".to_string()]
+        );
+        assert!(!config.transforms[1].is_guarded());
+
+        let transform = config.to_upgrade().transform();
+        let source = "Save(d, true)\nSave(d, sync)\nold";
+        let inside = transform
+            .apply(source, Path::new("/repo/internal/store.go"))
+            .unwrap();
+        assert_eq!(inside, "Save(d)\nSave(d, sync)\nnew");
+
+        let outside = transform
+            .apply(source, Path::new("/repo/cmd/main.go"))
+            .unwrap();
+        assert_eq!(outside, "Save(d, true)\nSave(d, sync)\nnew");
+    }
+
+    #[test]
+    fn test_transform_rule_round_trip() {
+        let mut config = UpgradeConfig::new("guarded", "Guarded upgrade");
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "old".to_string(),
+                new_name: "new".to_string(),
+            })
+            .unless(RuleCondition {
+                paths: vec!["vendor/**".to_string()],
+                ..Default::default()
+            }),
+        );
+
+        let json = serde_json::to_string(&config).unwrap();
+        assert!(json.contains("\"type\":\"rename_function\""));
+        assert!(json.contains("\"unless\""));
+
+        let parsed: UpgradeConfig = serde_json::from_str(&json).unwrap();
+        assert_eq!(parsed.transforms[0].unless, config.transforms[0].unless);
+    }
+
+    #[test]
+    fn test_suggest_only_rule_not_applied() {
+        let mut config = UpgradeConfig::new("flags", "Flag deprecated calls");
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "DeprecatedFn".to_string(),
+                new_name: "ReplacementFn".to_string(),
+            })
+            .with_id("flag-deprecated")
+            .suggest_only(),
+        );
+
+        let transform = config.to_upgrade().transform();
+        assert!(transform.is_empty());
+
+        let json = serde_json::to_string(&config).unwrap();
+        assert!(json.contains("\"mode\":\"suggest\""));
+        let parsed: UpgradeConfig = serde_json::from_str(&json).unwrap();
+        assert!(parsed.transforms[0].is_suggest_only());
+        assert_eq!(parsed.transforms[0].name(), "flag-deprecated");
+    }
+
+    #[test]
+    fn test_values_are_substituted_on_load() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("upgrade.json");
+        std::fs::write(
+            &path,
+            r#"{"name": "t", "description": "t",
+                "values": {"DefaultTimeout": "pool.DefaultTimeout"},
+                "transforms": [{"type": "replace_pattern",
+                                "pattern": "Dial\\(([^)]*)\\)",
+                                "replacement": "Dial($1, {{ DefaultTimeout }})",
+                                "message": "Pass {{DefaultTimeout}}"}]}"#,
+        )
+        .unwrap();
+
+        let config = UpgradeConfig::from_json(&path).unwrap();
+        let rule = &config.transforms[0];
+        assert_eq!(rule.message.as_deref(), Some("Pass pool.DefaultTimeout"));
+        let (_, replacement) = rule.spec.to_pattern_replacement();
+        assert_eq!(replacement, "Dial($1, pool.DefaultTimeout)");
+
+        std::fs::write(
+            &path,
+            r#"{"name": "t", "description": "t", "transforms": [
+                {"type": "replace_literal", "from": "a", "to": "{{Missing}}"}]}"#,
+        )
+        .unwrap();
+        assert!(UpgradeConfig::from_json(&path).is_err());
+    }
+
+    #[test]
+    fn test_rewrite_call_rule() {
+        let rule: TransformRule = serde_json::from_str(
+            r#"{"type": "rewrite_call", "function": "requests.get",
+                "new_name": "http.get", "keywords": {"verify": "tls_verify"},
+                "add": [{"keyword": "timeout", "value": "30"}]}"#,
+        )
+        .unwrap();
+        let transform = rule.to_transform().unwrap();
+        let result = transform
+            .apply(
+                "r = requests.get(url, verify=False)\n",
+                Path::new("client.py"),
+            )
+            .unwrap();
+        assert_eq!(result, "r = http.get(url, tls_verify=False, timeout=30)\n");
+
+        let with_plugin = rule.clone().with_rewriter("custom");
+        assert!(
+            with_plugin
+                .to_transform_with(&PluginRegistry::new())
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_map_values_rule() {
+        let rule: TransformRule = serde_json::from_str(
+            r#"{"type": "map_values", "function": "pool.SetMode", "argument": "1",
+                "compared": "c.Mode()", "values": {"\"fast\"": "pool.ModeFast"}}"#,
+        )
+        .unwrap();
+        assert_eq!(
+            rule.spec.summary(),
+            "map values of pool.SetMode, c.Mode() (1 value(s))"
+        );
+        let transform = rule.to_transform().unwrap();
+        let result = transform
+            .apply(
+                "pool.SetMode(c, \"fast\")\nif c.Mode() != \"fast\" {\n",
+                Path::new("main.go"),
+            )
+            .unwrap();
+        assert_eq!(
+            result,
+            "pool.SetMode(c, pool.ModeFast)\nif c.Mode() != pool.ModeFast {\n"
+        );
+    }
+
+    #[test]
+    fn test_rewrite_literal_rule() {
+        let rule: TransformRule = serde_json::from_str(
+            r#"{"type": "rewrite_literal", "type_name": "pool.Config",
+                "fields": ["Host", "Timeout"], "rename": {"Timeout": "DialTimeout"},
+                "add": [{"name": "Port", "value": "5432"}]}"#,
+        )
+        .unwrap();
+        assert_eq!(rule.spec.summary(), "rewrite literals of pool.Config");
+        let transform = rule.to_transform().unwrap();
+        let result = transform
+            .apply(
+                "a := pool.Config{\"db\", time.Second}\nb := &pool.Config{Timeout: 5}\n",
+                Path::new("main.go"),
+            )
+            .unwrap();
+        assert_eq!(
+            result,
+            "a := pool.Config{Host: \"db\", DialTimeout: time.Second, Port: 5432}\nb := &pool.Config{DialTimeout: 5, Port: 5432}\n"
+        );
+    }
+
+    #[test]
+    fn test_transform_spec_rename_module() {
+        let spec = TransformSpec::RenameModule {
+            old_path: "acme.client".to_string(),
+            new_path: "acme.sdk.client".to_string(),
+        };
+        let (pattern, replacement) = spec.to_pattern_replacement();
+        let transform = GuardedTransform::new(&pattern, &replacement).unwrap();
+        let source = "import acme.client\nfrom acme.client.auth import Token\nimport acme.clients\nc = acme.client.Client()\n";
+        assert_eq!(
+            transform.apply(source, Path::new("app.py")).unwrap(),
+            "import acme.sdk.client\nfrom acme.sdk.client.auth import Token\nimport acme.clients\nc = acme.sdk.client.Client()\n"
+        );
+    }
+
+    #[test]
+    fn test_rename_export_rule() {
+        let rule: TransformRule = serde_json::from_str(
+            r#"{"type": "rename_export", "module": "@acme/sdk",
+                "old_name": "createClient", "new_name": "connect",
+                "when": {"paths": ["src/**"]}}"#,
+        )
+        .unwrap();
+        let transform = rule.to_transform().unwrap();
+
+        let source = "const { createClient } = require('@acme/sdk');
+const c = createClient(url);
+";
+        assert_eq!(
+            transform.apply(source, Path::new("src/app.js")).unwrap(),
+            "const { connect } = require('@acme/sdk');
+const c = connect(url);
+"
+        );
+        let esm = "import * as sdk from \"@acme/sdk\";
+sdk.createClient(url);
+";
+        assert_eq!(
+            transform.apply(esm, Path::new("src/app.ts")).unwrap(),
+            "import * as sdk from \"@acme/sdk\";
+sdk.connect(url);
+"
+        );
+        // Files that do not import the module, or fail the rule's own guard
+        let local = "function createClient() {}
+createClient();
+";
+        assert_eq!(
+            transform.apply(local, Path::new("src/app.ts")).unwrap(),
+            local
+        );
+        assert_eq!(
+            transform.apply(source, Path::new("test/app.js")).unwrap(),
+            source
+        );
+    }
+
+    #[test]
+    fn test_move_export_and_rename_specifier_rules() {
+        let mut config = UpgradeConfig::new("sdk-v2", "SDK v2");
+        config.add_transform(TransformSpec::MoveExport {
+            name: "retry".to_string(),
+            from_module: "@acme/sdk".to_string(),
+            to_module: "@acme/sdk/retry".to_string(),
+        });
+        config.add_transform(TransformSpec::RenameSpecifier {
+            old_path: "@acme/sdk".to_string(),
+            new_path: "@acme/client".to_string(),
+        });
+        let upgrade = ConfigBasedUpgrade::new(config);
+        let result = upgrade
+            .transform()
+            .apply(
+                "import { connect, retry } from '@acme/sdk';
+",
+                Path::new("app.ts"),
+            )
+            .unwrap();
+        assert_eq!(
+            result,
+            "import { connect } from '@acme/client';
+import { retry } from '@acme/client/retry';
+"
+        );
+    }
+
+    #[test]
+    fn test_java_rename_rules() {
+        let mut config = UpgradeConfig::new("acme-v2", "Acme v2");
+        config.add_transform(TransformSpec::RenameClass {
+            old_name: "com.acme.Client".to_string(),
+            new_name: "com.acme.v2.AcmeClient".to_string(),
+        });
+        config.add_transform(TransformSpec::RenameMethod {
+            class: "com.acme.v2.AcmeClient".to_string(),
+            old_name: "connect".to_string(),
+            new_name: "open".to_string(),
+        });
+        let upgrade = ConfigBasedUpgrade::new(config);
+        let result = upgrade
+            .transform()
+            .apply(
+                "import com.acme.Client;\n\nClient c = new Client();\nc.connect(url);\n",
+                Path::new("App.java"),
+            )
+            .unwrap();
+        assert_eq!(
+            result,
+            "import com.acme.v2.AcmeClient;\n\nAcmeClient c = new AcmeClient();\nc.open(url);\n"
+        );
+    }
+
+    #[test]
+    fn test_select_rules() {
+        let mut config = UpgradeConfig::new("v2", "");
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "GetUser".to_string(),
+                new_name: "FetchUser".to_string(),
+            })
+            .with_id("rename-get-user"),
+        );
+        config.add_transform(TransformSpec::RenameType {
+            old_name: "Client".to_string(),
+            new_name: "Conn".to_string(),
+        });
+        config.add_transform(TransformSpec::RewriteCall {
+            function: "Connect".to_string(),
+            new_name: None,
+            arity: Some(1),
+            remove: Vec::new(),
+            order: Vec::new(),
+            keywords: BTreeMap::new(),
+            add: vec![CallArgument::positional(1, "ctx")],
+            signature: None,
+        });
+        let ids: Vec<String> = config.transforms.iter().map(|r| r.rule_id()).collect();
+        assert_eq!(
+            ids,
+            [
+                "rename-get-user",
+                "rename-type-client-conn",
+                "rewrite-call-connect"
+            ]
+        );
+
+        let mut selected = config.clone();
+        selected
+            .select_rules(&[], &["rewrite-call-connect".to_string()])
+            .unwrap();
+        assert_eq!(selected.transforms.len(), 2);
+
+        let mut selected = config.clone();
+        selected
+            .select_rules(
+                &[
+                    "rename-get-user".to_string(),
+                    "rename_type Client -> Conn".to_string(),
+                ],
+                &["rename-get-user".to_string()],
+            )
+            .unwrap();
+        assert_eq!(selected.transforms[0].rule_id(), "rename-type-client-conn");
+        assert_eq!(selected.transforms.len(), 1);
+
+        let error = config
+            .select_rules(&["rename-get-usr".to_string()], &[])
+            .unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Invalid configuration: Upgrade 'v2' has no rule 'rename-get-usr'; its rules are: rename-get-user, rename-type-client-conn, rewrite-call-connect"
+        );
+
+        // Merged configs may share an id, which only matters when selected
+        let mut other = UpgradeConfig::new("v3", "");
+        other.add_transform(
+            TransformRule::new(TransformSpec::RenameType {
+                old_name: "Server".to_string(),
+                new_name: "Host".to_string(),
+            })
+            .with_id("rename-get-user"),
+        );
+        config.merge(other);
+        let mut merged = config.clone();
+        merged.select_rules(&[], &[]).unwrap();
+        assert_eq!(merged.transforms.len(), 4);
+        let mut merged = config.clone();
+        merged
+            .select_rules(&[], &["rewrite-call-connect".to_string()])
+            .unwrap();
+        assert_eq!(merged.transforms.len(), 3);
+        let error = config
+            .select_rules(&["rename-get-user".to_string()], &[])
+            .unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Invalid configuration: Rules 1 and 4 of upgrade 'v2+v3' are both named 'rename-get-user'; give one of them its own `id`"
+        );
+    }
+
+    #[test]
+    fn test_rust_rename_rules() {
+        let mut config = UpgradeConfig::new("acme-2", "Acme 2.0");
+        config.add_transform(TransformSpec::RenamePath {
+            old_path: "acme::client::Client".to_string(),
+            new_path: "acme::Client".to_string(),
+        });
+        config.add_transform(TransformSpec::RenameVariant {
+            enum_name: "Mode".to_string(),
+            old_name: "Sync".to_string(),
+            new_name: "Blocking".to_string(),
+        });
+        let upgrade = ConfigBasedUpgrade::new(config);
+        let result = upgrade
+            .transform()
+            .apply(
+                "use acme::client::{Client, Mode};\n\nlet c = Client::new(Mode::Sync);\n",
+                Path::new("src/main.rs"),
+            )
+            .unwrap();
+        assert_eq!(
+            result,
+            "use acme::client::{Mode};\nuse acme::Client;\n\nlet c = Client::new(Mode::Blocking);\n"
+        );
+    }
 }
@@ -0,0 +1,366 @@
+//! Default values for parameters added by a library upgrade.
+//!
+//! When a new version of a function takes an extra required parameter,
+//! existing call sites need a value for it. [`DefaultInference`] picks one,
+//! in order of preference:
+//!
+//! 1. an expression available at call sites whose last segment names the
+//!    parameter, such as the `Timeout` field of the client's config struct;
+//! 2. a library constant named after the parameter, such as
+//!    `mylib.DefaultPort` for a `port` parameter;
+//! 3. the zero value of the parameter's type (`0`, `""`, `nil`,
+//!    `Options{}`, `context.TODO()` for a Go context, `None`, ...).
+//!
+//! Every value records where it came from, so reports can say why it was
+//! chosen.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::analyzer::{DefaultInference, TypeInfo};
+//!
+//! let inference = DefaultInference::new("go")
+//!     .with_package("mylib")
+//!     .with_constant("DefaultPort", Some(TypeInfo::simple("int")));
+//!
+//! let port = inference.infer("port", Some(&TypeInfo::simple("int"))).unwrap();
+//! assert_eq!(port.value, "mylib.DefaultPort");
+//! assert_eq!(port.source.to_string(), "library constant `DefaultPort`");
+//! ```
+
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fmt;
+use std::path::Path;
+use std::sync::LazyLock;
+
+use super::signature::TypeInfo;
+
+static GO_PACKAGE: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"(?m)^package\s+(\w+)").expect("invalid package regex"));
+
+static GO_CONSTANT: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?m)^(?:const[ \t]+|\t)(Default\w*)(?:[ \t]+([\w.*\[\]]+))?[ \t]*=")
+        .expect("invalid Go constant regex")
+});
+
+static RUST_CONSTANT: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?m)^\s*pub\s+const\s+(DEFAULT_\w+)\s*:\s*([^=]+?)\s*=")
+        .expect("invalid Rust constant regex")
+});
+
+static PYTHON_CONSTANT: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?m)^(DEFAULT_\w+)\s*(?::\s*([\w.]+))?\s*=")
+        .expect("invalid Python constant regex")
+});
+
+static TS_CONSTANT: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?m)^export\s+const\s+((?:DEFAULT_|default)\w+)\s*(?::\s*([\w.]+))?\s*=")
+        .expect("invalid TypeScript constant regex")
+});
+
+/// Where an inferred default value came from.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(tag = "kind", rename_all = "snake_case")]
+pub enum DefaultSource {
+    /// An expression available at call sites, e.g. a client config field.
+    ConfigField { expr: String },
+    /// A constant exported by the library.
+    Constant { name: String },
+    /// The zero value of the parameter's type.
+    ZeroValue { type_name: String },
+}
+
+impl fmt::Display for DefaultSource {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            DefaultSource::ConfigField { expr } => write!(f, "config field `{}`", expr),
+            DefaultSource::Constant { name } => write!(f, "library constant `{}`", name),
+            DefaultSource::ZeroValue { type_name } => write!(f, "zero value of `{}`", type_name),
+        }
+    }
+}
+
+/// A value to pass for a new parameter.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct InferredDefault {
+    /// Expression to pass at call sites.
+    pub value: String,
+    /// Why this value was chosen.
+    pub source: DefaultSource,
+}
+
+/// Infers default values for new parameters.
+#[derive(Debug, Clone, Default)]
+pub struct DefaultInference {
+    language: String,
+    package: Option<String>,
+    constants: Vec<(String, Option<TypeInfo>)>,
+    config_fields: Vec<String>,
+}
+
+impl DefaultInference {
+    /// Create an inference for files with the given extension (e.g. `go`).
+    pub fn new(language: impl Into<String>) -> Self {
+        Self {
+            language: language.into(),
+            ..Default::default()
+        }
+    }
+
+    /// The file extension this inference applies to.
+    pub fn language(&self) -> &str {
+        &self.language
+    }
+
+    /// Qualify library constants and types with this package or module name.
+    pub fn with_package(mut self, package: impl Into<String>) -> Self {
+        self.package = Some(package.into());
+        self
+    }
+
+    /// Add a library constant.
+    pub fn with_constant(mut self, name: impl Into<String>, type_info: Option<TypeInfo>) -> Self {
+        self.constants.push((name.into(), type_info));
+        self
+    }
+
+    /// Add an expression available at call sites, such as `cfg.Timeout`.
+    pub fn with_config_field(mut self, expr: impl Into<String>) -> Self {
+        self.config_fields.push(expr.into());
+        self
+    }
+
+    /// Record the `Default*` / `DEFAULT_*` constants declared in a library
+    /// source file. For Go files the package name is recorded too.
+    pub fn scan(mut self, path: &Path, source: &str) -> Self {
+        let ext = path.extension().and_then(|e| e.to_str()).unwrap_or("");
+        let regex = match ext {
+            "go" => &GO_CONSTANT,
+            "rs" => &RUST_CONSTANT,
+            "py" => &PYTHON_CONSTANT,
+            "ts" | "tsx" | "js" => &TS_CONSTANT,
+            _ => return self,
+        };
+        if ext == "go"
+            && self.package.is_none()
+            && let Some(caps) = GO_PACKAGE.captures(source)
+        {
+            self.package = Some(caps[1].to_string());
+        }
+        for caps in regex.captures_iter(source) {
+            let type_info = caps.get(2).map(|t| TypeInfo::simple(t.as_str().trim()));
+            self.constants.push((caps[1].to_string(), type_info));
+        }
+        self
+    }
+
+    /// The discovered constants as named values for rule templates, e.g.
+    /// `DefaultPort` → `mylib.DefaultPort`.
+    pub fn values(&self) -> BTreeMap<String, String> {
+        self.constants
+            .iter()
+            .map(|(name, _)| (name.clone(), self.qualify(name)))
+            .collect()
+    }
+
+    /// Infer a value for parameter `name` of type `type_info`.
+    ///
+    /// Returns `None` if nothing matches and the type is unknown.
+    pub fn infer(&self, name: &str, type_info: Option<&TypeInfo>) -> Option<InferredDefault> {
+        let wanted = normalize(name);
+
+        if let Some(expr) = self.config_fields.iter().find(|expr| {
+            let field = expr.rsplit(['.', ':']).next().unwrap_or(expr);
+            normalize(field) == wanted
+        }) {
+            return Some(InferredDefault {
+                value: expr.clone(),
+                source: DefaultSource::ConfigField { expr: expr.clone() },
+            });
+        }
+
+        if let Some((constant, _)) = self.constants.iter().find(|(constant, ty)| {
+            constant.to_lowercase().contains("default")
+                && normalize(constant) == wanted
+                && types_match(ty.as_ref(), type_info)
+        }) {
+            return Some(InferredDefault {
+                value: self.qualify(constant),
+                source: DefaultSource::Constant {
+                    name: constant.clone(),
+                },
+            });
+        }
+
+        let type_info = type_info?;
+        Some(InferredDefault {
+            value: self.zero_value(type_info),
+            source: DefaultSource::ZeroValue {
+                type_name: type_info.name.clone(),
+            },
+        })
+    }
+
+    fn qualify(&self, name: &str) -> String {
+        match &self.package {
+            Some(package) => {
+                let separator = if self.language == "rs" { "::" } else { "." };
+                format!("{}{}{}", package, separator, name)
+            }
+            None => name.to_string(),
+        }
+    }
+
+    fn zero_value(&self, type_info: &TypeInfo) -> String {
+        let name = type_info.name.trim();
+        match self.language.as_str() {
+            "go" => self.go_zero_value(name, type_info.is_reference),
+            "rs" if type_info.is_optional || name.starts_with("Option<") => "None".to_string(),
+            "rs" => "Default::default()".to_string(),
+            "py" => "None".to_string(),
+            "ts" | "tsx" | "js" => "undefined".to_string(),
+            "java" | "cs" => match name {
+                "boolean" | "bool" => "false".to_string(),
+                "int" | "long" | "short" | "byte" | "double" | "float" | "decimal" => {
+                    "0".to_string()
+                }
+                _ => "null".to_string(),
+            },
+            _ => "nil".to_string(),
+        }
+    }
+
+    fn go_zero_value(&self, name: &str, is_reference: bool) -> String {
+        const NUMERIC: &[&str] = &[
+            "int",
+            "int8",
+            "int16",
+            "int32",
+            "int64",
+            "uint",
+            "uint8",
+            "uint16",
+            "uint32",
+            "uint64",
+            "uintptr",
+            "float32",
+            "float64",
+            "complex64",
+            "complex128",
+            "byte",
+            "rune",
+            "time.Duration",
+        ];
+        let nil = ["*", "[]", "map[", "func", "chan", "<-chan", "interface"];
+        match name {
+            "string" => "\"\"".to_string(),
+            "bool" => "false".to_string(),
+            "error" | "any" => "nil".to_string(),
+            "context.Context" => "context.TODO()".to_string(),
+            _ if NUMERIC.contains(&name) => "0".to_string(),
+            _ if is_reference || nil.iter().any(|p| name.starts_with(p)) => "nil".to_string(),
+            _ if name.starts_with('[') => format!("{}{{}}", name),
+            _ if name.contains('.') || !name.starts_with(char::is_uppercase) => {
+                format!("{}{{}}", name)
+            }
+            _ => format!("{}{{}}", self.qualify(name)),
+        }
+    }
+}
+
+/// Lowercase `name` without underscores and without a `default` prefix or
+/// suffix, so `DefaultDialTimeout`, `DEFAULT_DIAL_TIMEOUT` and `dialTimeout`
+/// compare equal.
+fn normalize(name: &str) -> String {
+    let name = name.replace('_', "").to_lowercase();
+    let name = name.strip_prefix("default").unwrap_or(&name);
+    name.strip_suffix("default").unwrap_or(name).to_string()
+}
+
+/// Types match if either is unknown or their unqualified names are equal.
+fn types_match(a: Option<&TypeInfo>, b: Option<&TypeInfo>) -> bool {
+    let unqualified = |t: &TypeInfo| {
+        let name = t.name.trim().to_string();
+        name.rsplit(['.', ':'])
+            .next()
+            .map_or(name.clone(), str::to_string)
+    };
+    match (a, b) {
+        (Some(a), Some(b)) => unqualified(a) == unqualified(b),
+        _ => true,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_preference_order() {
+        let inference = DefaultInference::new("go")
+            .scan(
+                Path::new("pool/options.go"),
+                "package pool\n\nconst (\n\tDefaultTimeout time.Duration = 30 * time.Second\n\tDefaultPort = 8080\n)\n",
+            )
+            .with_config_field("cfg.Timeout");
+
+        let timeout = inference
+            .infer("timeout", Some(&TypeInfo::simple("time.Duration")))
+            .unwrap();
+        assert_eq!(timeout.value, "cfg.Timeout");
+        assert_eq!(timeout.source.to_string(), "config field `cfg.Timeout`");
+
+        let port = inference
+            .infer("port", Some(&TypeInfo::simple("int")))
+            .unwrap();
+        assert_eq!(port.value, "pool.DefaultPort");
+
+        let retries = inference
+            .infer("retries", Some(&TypeInfo::simple("int")))
+            .unwrap();
+        assert_eq!(retries.value, "0");
+        assert_eq!(retries.source.to_string(), "zero value of `int`");
+
+        assert!(inference.infer("retries", None).is_none());
+
+        assert_eq!(
+            inference.values().get("DefaultPort").map(String::as_str),
+            Some("pool.DefaultPort")
+        );
+    }
+
+    #[test]
+    fn test_go_zero_values() {
+        let inference = DefaultInference::new("go").with_package("pool");
+        let zero = |t: &str| {
+            inference
+                .infer("x", Some(&TypeInfo::simple(t)))
+                .unwrap()
+                .value
+        };
+        assert_eq!(zero("string"), "\"\"");
+        assert_eq!(zero("*Options"), "nil");
+        assert_eq!(zero("[]string"), "nil");
+        assert_eq!(zero("context.Context"), "context.TODO()");
+        assert_eq!(zero("Options"), "pool.Options{}");
+        assert_eq!(zero("tls.Config"), "tls.Config{}");
+    }
+
+    #[test]
+    fn test_constant_type_must_match() {
+        let inference = DefaultInference::new("rs").with_package("mylib").scan(
+            Path::new("src/lib.rs"),
+            "pub const DEFAULT_PORT: &str = \"8080\";\n",
+        );
+        let port = inference
+            .infer("port", Some(&TypeInfo::simple("u16")))
+            .unwrap();
+        assert_eq!(port.value, "Default::default()");
+        let port = inference
+            .infer("port", Some(&TypeInfo::simple("&str")))
+            .unwrap();
+        assert_eq!(port.value, "mylib::DEFAULT_PORT");
+    }
+}
@@ -0,0 +1,524 @@
+//! Migration rules from the deprecation notices of a library's source.
+//!
+//! Go libraries mark deprecated APIs with a `Deprecated:` paragraph in the
+//! doc comment, usually naming the replacement:
+//!
+//! ```go
+//! // GetUser returns the user with the given id.
+//! //
+//! // Deprecated: Use FetchUser instead.
+//! func GetUser(id string) (*User, error)
+//! ```
+//!
+//! [`DeprecationExtractor`] collects these notices and turns each into a
+//! rule: a rename when the replacement is a plain name the scanned package
+//! declares, and a suggest-only rule carrying the notice otherwise, since
+//! prose such as "use this instead" names no API. Constants are matched
+//! qualified by their package (`users.Retries`). Library authors can state
+//! the rename explicitly with a directive, which wins over the notice's
+//! wording:
+//!
+//! ```go
+//! //refactor:rename GetUser FetchUser
+//! ```
+//!
+//! A directive in a doc comment applies to the declaration it documents; one
+//! on its own renames a function.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::analyzer::DeprecationExtractor;
+//!
+//! let extractor = DeprecationExtractor::new().scan(
+//!     "user.go",
+//!     "package users\n\n// Deprecated: Use FetchUser instead.\nfunc GetUser(id string) {}\n",
+//! );
+//! let deprecation = &extractor.deprecations()[0];
+//! assert_eq!(deprecation.name, "GetUser");
+//! assert_eq!(deprecation.replacement.as_deref(), Some("FetchUser"));
+//! ```
+
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeSet;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use super::change::ApiType;
+use super::config::{TransformRule, TransformSpec, UpgradeConfig};
+use super::signature::SourceLocation;
+use crate::error::Result;
+use crate::matcher::FileMatcher;
+
+static REPLACEMENT: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?i)\buse\s+(?:the\s+)?\[?\*?([A-Za-z_][\w.]*)(?:\(\))?\]?")
+        .expect("invalid replacement regex")
+});
+
+static DIRECTIVE: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"^//refactor:rename\s+([A-Za-z_][\w.]*)\s+([A-Za-z_]\w*)\s*$")
+        .expect("invalid directive regex")
+});
+
+static DECLARATION: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r"^(?:func\s*(?:\(\s*(?:\w+\s+)?\*?\s*(\w+)[^)]*\)\s*)?(\w+)|(type|const|var)\s+(\w+)(.*))",
+    )
+    .expect("invalid declaration regex")
+});
+
+/// A deprecated API of a library.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Deprecation {
+    /// The API, qualified by its receiver type for methods (`Client.Get`).
+    pub name: String,
+    /// The kind of API.
+    pub api_type: ApiType,
+    /// The deprecation notice, without the `Deprecated:` prefix.
+    pub message: String,
+    /// The name replacing the API in the same package, if the notice or a
+    /// directive names one.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub replacement: Option<String>,
+    /// Whether a rename directive names the replacement, rather than the
+    /// notice's wording.
+    #[serde(default)]
+    pub directed: bool,
+    /// Name of the package declaring the API.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub package: Option<String>,
+    /// Where the API is declared.
+    pub location: SourceLocation,
+}
+
+impl Deprecation {
+    /// The unqualified name callers use (`Get` for `Client.Get`).
+    pub fn short_name(&self) -> &str {
+        self.name.rsplit('.').next().unwrap_or(&self.name)
+    }
+
+    /// The migration rule for this deprecation: a rename to the replacement,
+    /// or a suggest-only rule reporting uses with the notice.
+    pub fn to_rule(&self) -> TransformRule {
+        let old_name = self.short_name().to_string();
+        let id = format!("deprecated-{}", kebab_case(&self.name));
+        let qualifier = match (&self.api_type, &self.package) {
+            (ApiType::Constant, Some(package)) => format!(r"{}\s*\.\s*", regex::escape(package)),
+            _ => String::new(),
+        };
+        let rule = match &self.replacement {
+            Some(new_name) => TransformRule::new(match self.api_type {
+                ApiType::Function | ApiType::Method => TransformSpec::RenameFunction {
+                    old_name,
+                    new_name: new_name.clone(),
+                },
+                ApiType::Constant => TransformSpec::ReplacePattern {
+                    pattern: format!(r"\b(?P<qual>{}){}\b", qualifier, regex::escape(&old_name)),
+                    replacement: format!("${{qual}}{}", new_name),
+                },
+                _ => TransformSpec::RenameType {
+                    old_name,
+                    new_name: new_name.clone(),
+                },
+            }),
+            None => TransformRule::new(TransformSpec::ReplacePattern {
+                pattern: format!(r"\b{}{}\b", qualifier, regex::escape(&old_name)),
+                replacement: "$0".to_string(),
+            })
+            .suggest_only(),
+        };
+        rule.with_id(id)
+            .with_message(format!("{} is deprecated: {}", self.name, self.message))
+    }
+}
+
+/// Collects the deprecation notices and rename directives of Go source.
+#[derive(Debug, Clone, Default)]
+pub struct DeprecationExtractor {
+    deprecations: Vec<Deprecation>,
+    declared: BTreeSet<String>,
+}
+
+/// The comment lines and rename directives above a line.
+#[derive(Default)]
+struct DocComment {
+    lines: Vec<String>,
+    directives: Vec<(String, String, usize)>,
+}
+
+impl DeprecationExtractor {
+    /// Create an extractor with no deprecations.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Scan the non-test Go files under `root`, skipping vendored code.
+    pub fn scan_dir(self, root: impl AsRef<Path>) -> Result<Self> {
+        let files = FileMatcher::new()
+            .extension("go")
+            .exclude("**/vendor/**")
+            .exclude("**/*_test.go")
+            .collect(root.as_ref())?;
+        files.iter().try_fold(self, |extractor, path| {
+            let source = fs::read_to_string(path)?;
+            Ok(extractor.scan(path, &source))
+        })
+    }
+
+    /// Scan one Go file.
+    pub fn scan(mut self, path: impl Into<PathBuf>, source: &str) -> Self {
+        let path = path.into();
+        let first = self.deprecations.len();
+        let mut package = None;
+        let mut doc = DocComment::default();
+        let mut block: Option<&str> = None;
+        for (index, line) in source.lines().enumerate() {
+            let trimmed = line.trim();
+            if let Some(name) = trimmed.strip_prefix("package ") {
+                package = name.split_whitespace().next().map(str::to_string);
+            }
+            if let Some(caps) = DIRECTIVE.captures(trimmed) {
+                doc.directives
+                    .push((caps[1].to_string(), caps[2].to_string(), index + 1));
+                continue;
+            }
+            if let Some(comment) = trimmed.strip_prefix("//") {
+                doc.lines
+                    .push(comment.strip_prefix(' ').unwrap_or(comment).to_string());
+                continue;
+            }
+            let doc = std::mem::take(&mut doc);
+            let declaration = if trimmed == ")" {
+                block = None;
+                None
+            } else if let Some(kind) = ["const (", "var (", "type ("]
+                .iter()
+                .find(|opening| trimmed == **opening)
+            {
+                block = kind.split(' ').next();
+                None
+            } else if let Some(kind) = block.filter(|_| line.starts_with('\t')) {
+                declaration(&format!("{} {}", kind, trimmed))
+            } else if line.starts_with(char::is_alphabetic) {
+                declaration(trimmed)
+            } else {
+                None
+            };
+            self.add(&path, index + 1, doc, declaration);
+        }
+        self.add(&path, 0, doc, None);
+        for deprecation in &mut self.deprecations[first..] {
+            deprecation.package = package.clone();
+        }
+        self
+    }
+
+    /// Record what the doc comment `doc` says about `declaration`, declared
+    /// on `line`.
+    fn add(
+        &mut self,
+        path: &Path,
+        line: usize,
+        doc: DocComment,
+        declaration: Option<(String, ApiType)>,
+    ) {
+        let location = |line| SourceLocation {
+            file: path.to_path_buf(),
+            line,
+            column: 1,
+            byte_offset: 0,
+        };
+        let mut directives = doc.directives.into_iter();
+        if let Some((name, _)) = &declaration {
+            self.declared.insert(name.clone());
+        }
+        if let Some((name, api_type)) = declaration {
+            let notice = deprecation_notice(&doc.lines);
+            let short = name.rsplit('.').next().unwrap_or(&name).to_string();
+            let directive = directives
+                .by_ref()
+                .find(|(old, _, _)| *old == name || *old == short)
+                .map(|(_, new, _)| new);
+            if notice.is_some() || directive.is_some() {
+                let directed = directive.is_some();
+                let replacement = directive.or_else(|| {
+                    notice
+                        .as_deref()
+                        .and_then(|notice| replacement(notice, &name))
+                });
+                self.deprecations.push(Deprecation {
+                    message: notice.unwrap_or_else(|| match &replacement {
+                        Some(new) => format!("Use {} instead.", new),
+                        None => String::new(),
+                    }),
+                    name,
+                    api_type,
+                    replacement,
+                    directed,
+                    package: None,
+                    location: location(line),
+                });
+            }
+        }
+        for (old, new, line) in directives {
+            self.deprecations.push(Deprecation {
+                message: format!("Use {} instead.", new),
+                name: old,
+                api_type: ApiType::Function,
+                replacement: Some(new),
+                directed: true,
+                package: None,
+                location: location(line),
+            });
+        }
+    }
+
+    /// The deprecations found, in the order scanned.
+    pub fn deprecations(&self) -> &[Deprecation] {
+        &self.deprecations
+    }
+
+    /// Whether the replacement of `deprecation` is one to apply: named by a
+    /// directive, or declared by the scanned source.
+    fn confirmed(&self, deprecation: &Deprecation) -> bool {
+        let Some(new) = &deprecation.replacement else {
+            return false;
+        };
+        let declared = match deprecation.name.rsplit_once('.') {
+            Some((receiver, _)) => format!("{}.{}", receiver, new),
+            None => new.clone(),
+        };
+        deprecation.directed || self.declared.contains(&declared)
+    }
+
+    /// An upgrade config with a rule for each deprecation. Replacements
+    /// only named in a notice's prose and not declared in the scanned
+    /// source are reported for review rather than applied.
+    pub fn to_config(
+        &self,
+        name: impl Into<String>,
+        description: impl Into<String>,
+    ) -> UpgradeConfig {
+        let mut config =
+            UpgradeConfig::new(name, description).with_extensions(vec!["go".to_string()]);
+        for deprecation in &self.deprecations {
+            let rule = deprecation.to_rule();
+            config.add_transform(
+                if deprecation.replacement.is_none() || self.confirmed(deprecation) {
+                    rule
+                } else {
+                    rule.suggest_only()
+                },
+            );
+        }
+        config
+    }
+}
+
+/// The name and kind of the top-level declaration starting `line`.
+fn declaration(line: &str) -> Option<(String, ApiType)> {
+    let caps = DECLARATION.captures(line)?;
+    if let Some(name) = caps.get(2) {
+        return Some(match caps.get(1) {
+            Some(receiver) => (
+                format!("{}.{}", receiver.as_str(), name.as_str()),
+                ApiType::Method,
+            ),
+            None => (name.as_str().to_string(), ApiType::Function),
+        });
+    }
+    let name = caps.get(4)?.as_str().to_string();
+    let rest = caps.get(5).map_or("", |rest| rest.as_str()).trim_start();
+    let api_type = match &caps[3] {
+        "type" if rest.starts_with("struct") => ApiType::Struct,
+        "type" if rest.starts_with("interface") => ApiType::Interface,
+        "type" => ApiType::TypeAlias,
+        _ => ApiType::Constant,
+    };
+    Some((name, api_type))
+}
+
+/// `name` in kebab case: `Client.GetUser` becomes `client-get-user`.
+fn kebab_case(name: &str) -> String {
+    let mut kebab = String::new();
+    let mut previous: Option<char> = None;
+    for c in name.chars() {
+        if c == '.' || c == '_' {
+            kebab.push('-');
+        } else if c.is_uppercase() {
+            if previous.is_some_and(|p| p.is_lowercase() || p.is_ascii_digit()) {
+                kebab.push('-');
+            }
+            kebab.extend(c.to_lowercase());
+        } else {
+            kebab.push(c);
+        }
+        previous = Some(c);
+    }
+    kebab
+}
+
+/// The `Deprecated:` paragraph of a doc comment, joined into one line.
+fn deprecation_notice(lines: &[String]) -> Option<String> {
+    let start = lines
+        .iter()
+        .position(|line| line.starts_with("Deprecated:"))?;
+    let notice = lines[start..]
+        .iter()
+        .take_while(|line| !line.trim().is_empty())
+        .map(|line| line.trim())
+        .collect::<Vec<_>>()
+        .join(" ");
+    Some(
+        notice
+            .trim_start_matches("Deprecated:")
+            .trim_start()
+            .to_string(),
+    )
+}
+
+/// The replacement `notice` names for `name`, if it is a plain name in the
+/// same package (or a method of the same receiver).
+fn replacement(notice: &str, name: &str) -> Option<String> {
+    let used = REPLACEMENT.captures(notice)?[1]
+        .trim_end_matches('.')
+        .to_string();
+    let receiver = name.rsplit_once('.').map(|(receiver, _)| receiver);
+    match used.split_once('.') {
+        None => Some(used),
+        Some((qualifier, method)) if Some(qualifier) == receiver && !method.contains('.') => {
+            Some(method.to_string())
+        }
+        Some(_) => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::Transform;
+
+    const SOURCE: &str = "package users
+
+// GetUser returns the user with the given id.
+//
+// Deprecated: Use FetchUser instead.
+func GetUser(id string) (*User, error) {
+\treturn nil, nil
+}
+
+func FetchUser(id string) (*User, error) {
+\treturn nil, nil
+}
+
+// Deprecated: Use [Client.Fetch].
+func (c *Client) Get(id string) {}
+
+func (c *Client) Fetch(id string) {}
+
+// Deprecated: the session API is going away; use
+// auth.Login.
+func Session() {}
+
+// Deprecated: Use Account instead.
+type Profile struct {
+\t// Deprecated: no replacement.
+\tName string
+}
+
+const (
+\t// Deprecated: Use MaxRetries.
+\tRetries    = 3
+\tMaxRetries = 3
+)
+
+// Deprecated: use of a cache is discouraged.
+func Cached() {}
+
+// Legacy lookup.
+//
+//refactor:rename Lookup Find
+func Lookup() {}
+
+//refactor:rename Dial Connect
+";
+
+    #[test]
+    fn test_extract_deprecations() {
+        let extractor = DeprecationExtractor::new().scan("users.go", SOURCE);
+        let found: Vec<(&str, Option<&str>)> = extractor
+            .deprecations()
+            .iter()
+            .map(|d| (d.name.as_str(), d.replacement.as_deref()))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                ("GetUser", Some("FetchUser")),
+                ("Client.Get", Some("Fetch")),
+                ("Session", None),
+                ("Profile", Some("Account")),
+                ("Retries", Some("MaxRetries")),
+                ("Cached", Some("of")),
+                ("Lookup", Some("Find")),
+                ("Dial", Some("Connect")),
+            ]
+        );
+        let deprecations = extractor.deprecations();
+        assert_eq!(deprecations[0].location.line, 6);
+        assert_eq!(deprecations[1].api_type, ApiType::Method);
+        assert_eq!(
+            deprecations[2].message,
+            "the session API is going away; use auth.Login."
+        );
+        assert_eq!(deprecations[3].api_type, ApiType::Struct);
+        assert_eq!(deprecations[4].api_type, ApiType::Constant);
+        assert_eq!(deprecations[4].package.as_deref(), Some("users"));
+    }
+
+    #[test]
+    fn test_deprecations_to_config() {
+        let config = DeprecationExtractor::new()
+            .scan("users.go", SOURCE)
+            .to_config("users-deprecations", "Replace deprecated APIs");
+        assert_eq!(config.extensions, ["go"]);
+
+        let rules = &config.transforms;
+        assert!(matches!(
+            &rules[0].spec,
+            TransformSpec::RenameFunction { old_name, new_name }
+                if old_name == "GetUser" && new_name == "FetchUser"
+        ));
+        assert_eq!(rules[0].id.as_deref(), Some("deprecated-get-user"));
+        assert!(matches!(
+            &rules[1].spec,
+            TransformSpec::RenameFunction { old_name, .. } if old_name == "Get"
+        ));
+        assert_eq!(rules[1].id.as_deref(), Some("deprecated-client-get"));
+        assert!(rules[2].is_suggest_only());
+        assert!(
+            rules[2]
+                .message
+                .as_deref()
+                .unwrap()
+                .starts_with("Session is deprecated")
+        );
+        assert!(!rules[0].is_suggest_only() && !rules[1].is_suggest_only());
+        // Account and "of" are not declared: report, don't rename
+        assert!(matches!(&rules[3].spec, TransformSpec::RenameType { .. }));
+        assert!(rules[3].is_suggest_only());
+        assert!(rules[5].is_suggest_only());
+        assert!(!rules[6].is_suggest_only());
+
+        assert!(!rules[4].is_suggest_only());
+        let retries = rules[4].to_transform().unwrap();
+        assert_eq!(
+            retries
+                .apply("n := users.Retries + other.Retries\n", Path::new("main.go"))
+                .unwrap(),
+            "n := users.MaxRetries + other.Retries\n"
+        );
+    }
+}
@@ -6,6 +6,42 @@ use std::path::PathBuf;
 use super::change::{ApiChange, ApiType, ChangeKind, ChangeMetadata, Severity};
 use super::signature::{ApiSignature, Parameter};
 
+/// Method sets of the standard library interfaces commonly embedded.
+const STD_INTERFACES: &[(&str, &[&str])] = &[
+    ("error", &["Error() string"]),
+    ("fmt.Stringer", &["String() string"]),
+    ("io.Reader", &["Read(p []byte) (n int, err error)"]),
+    ("io.Writer", &["Write(p []byte) (n int, err error)"]),
+    ("io.Closer", &["Close() error"]),
+    (
+        "io.ReadWriter",
+        &[
+            "Read(p []byte) (n int, err error)",
+            "Write(p []byte) (n int, err error)",
+        ],
+    ),
+    (
+        "io.ReadCloser",
+        &["Read(p []byte) (n int, err error)", "Close() error"],
+    ),
+    (
+        "io.WriteCloser",
+        &["Write(p []byte) (n int, err error)", "Close() error"],
+    ),
+    (
+        "io.ReadWriteCloser",
+        &[
+            "Read(p []byte) (n int, err error)",
+            "Write(p []byte) (n int, err error)",
+            "Close() error",
+        ],
+    ),
+    (
+        "sort.Interface",
+        &["Len() int", "Less(i, j int) bool", "Swap(i, j int)"],
+    ),
+];
+
 /// Detects API changes between two versions of a codebase.
 pub struct ChangeDetector {
     /// Minimum similarity threshold for rename detection (0.0 - 1.0).
@@ -72,8 +108,10 @@ impl ChangeDetector {
                 matched_old.insert(name.clone());
                 matched_new.insert(name.clone());
 
-                // Check for signature changes
-                if let Some(change) = self.detect_signature_change(old_sig, new_sig) {
+                // Check for signature and method set changes
+                if let Some(change) = self.detect_signature_change(old_sig, new_sig).or_else(|| {
+                    self.detect_interface_change(old_sig, new_sig, &old_by_name, &new_by_name)
+                }) {
                     changes.push(change);
                 }
             }
@@ -90,17 +128,20 @@ impl ChangeDetector {
             .filter(|(name, _)| !matched_new.contains(*name))
             .collect();
 
-        let mut rename_pairs = Vec::new();
-
-        for (old_name, old_sig) in &unmatched_old {
-            let mut best_match: Option<(&String, &ApiSignature, f64)> = None;
-
-            for (new_name, new_sig) in &unmatched_new {
-                // Skip if already paired
-                if rename_pairs.iter().any(|(_, n, _)| n == *new_name) {
-                    continue;
-                }
-
+        // Score every candidate pairing, then pair the most similar first
+        // so an API is not taken by a weaker match met earlier
+        // Bodies are tokenized once per API rather than once per pairing
+        let old_bodies: Vec<_> = unmatched_old
+            .iter()
+            .map(|(_, sig)| body_tokens(sig))
+            .collect();
+        let new_bodies: Vec<_> = unmatched_new
+            .iter()
+            .map(|(_, sig)| body_tokens(sig))
+            .collect();
+        let mut candidates = Vec::new();
+        for ((old_name, old_sig), old_body) in unmatched_old.iter().zip(&old_bodies) {
+            for ((new_name, new_sig), new_body) in unmatched_new.iter().zip(&new_bodies) {
                 // Check if types match
                 if old_sig.kind != new_sig.kind {
                     continue;
@@ -111,22 +152,27 @@ impl ChangeDetector {
                     continue;
                 }
 
-                let similarity = self.calculate_similarity(old_sig, new_sig);
-                if similarity >= self.rename_threshold
-                    && (best_match.is_none() || similarity > best_match.unwrap().2)
-                {
-                    best_match = Some((new_name, new_sig, similarity));
+                let bodies = old_body.as_ref().zip(new_body.as_ref());
+                let similarity = self.calculate_similarity(old_sig, new_sig, bodies);
+                if similarity.score() >= self.rename_threshold {
+                    candidates.push((*old_name, *old_sig, *new_name, *new_sig, similarity));
                 }
             }
+        }
+        candidates.sort_by(|a, b| {
+            b.4.score()
+                .total_cmp(&a.4.score())
+                .then_with(|| a.0.cmp(b.0))
+                .then_with(|| a.2.cmp(b.2))
+        });
 
-            if let Some((new_name, new_sig, confidence)) = best_match {
-                rename_pairs.push((old_name.to_string(), new_name.to_string(), confidence));
-                matched_old.insert(old_name.to_string());
-                matched_new.insert(new_name.to_string());
-
-                let change = self.create_rename_change(old_sig, new_sig, confidence);
-                changes.push(change);
+        for (old_name, old_sig, new_name, new_sig, similarity) in candidates {
+            if matched_old.contains(old_name) || matched_new.contains(new_name) {
+                continue;
             }
+            matched_old.insert(old_name.clone());
+            matched_new.insert(new_name.clone());
+            changes.push(self.create_rename_change(old_sig, new_sig, &similarity));
         }
 
         // Third pass: detect removed APIs
@@ -233,6 +279,88 @@ impl ChangeDetector {
         )
     }
 
+    fn detect_interface_change(
+        &self,
+        old_sig: &ApiSignature,
+        new_sig: &ApiSignature,
+        old_apis: &HashMap<String, &ApiSignature>,
+        new_apis: &HashMap<String, &ApiSignature>,
+    ) -> Option<ApiChange> {
+        if old_sig.kind != ApiType::Interface || new_sig.kind != ApiType::Interface {
+            return None;
+        }
+
+        let method_name =
+            |method: &String| method.split('(').next().unwrap_or_default().to_string();
+        let old_set = method_set(old_sig, old_apis);
+        let new_set = method_set(new_sig, new_apis);
+        let old_methods: HashMap<String, &String> = old_set
+            .iter()
+            .map(|method| (method_name(method), method))
+            .collect();
+        let new_names: HashSet<String> = new_set.iter().map(method_name).collect();
+
+        let mut added = Vec::new();
+        let mut changed = Vec::new();
+        for method in &new_set {
+            match old_methods.get(&method_name(method)) {
+                None => added.push(method.clone()),
+                Some(old) if *old != method => changed.push(method.clone()),
+                Some(_) => {}
+            }
+        }
+        let removed: Vec<String> = old_set
+            .iter()
+            .filter(|method| !new_names.contains(&method_name(method)))
+            .cloned()
+            .collect();
+        if added.is_empty() && removed.is_empty() && changed.is_empty() {
+            return None;
+        }
+
+        let mut notes = Vec::new();
+        if !added.is_empty() || !changed.is_empty() {
+            notes.push(format!(
+                "types implementing '{}' must implement {}",
+                old_sig.name,
+                added
+                    .iter()
+                    .chain(&changed)
+                    .cloned()
+                    .collect::<Vec<_>>()
+                    .join(", ")
+            ));
+        }
+        if !removed.is_empty() {
+            notes.push(format!(
+                "callers can no longer call {} through it",
+                removed.join(", ")
+            ));
+        }
+        Some(
+            ApiChange::new(
+                ChangeKind::InterfaceChanged {
+                    name: old_sig.name.clone(),
+                    old_methods: old_set.clone(),
+                    added,
+                    removed,
+                    changed,
+                },
+                old_sig.location.file.clone(),
+            )
+            .with_metadata(ChangeMetadata {
+                old_line: Some(old_sig.location.line),
+                new_line: Some(new_sig.location.line),
+                severity: Severity::Breaking,
+                migration_notes: Some(format!(
+                    "Interface '{}' method set changed: {}",
+                    old_sig.name,
+                    notes.join("; ")
+                )),
+            }),
+        )
+    }
+
     fn detect_parameter_changes(
         &self,
         old_sig: &ApiSignature,
@@ -287,6 +415,7 @@ impl ChangeDetector {
                             param_type: param.type_info.clone(),
                             position: pos,
                             has_default: param.has_default || param.is_optional,
+                            old_param_count: old_params.len(),
                         },
                         old_sig.location.file.clone(),
                     )
@@ -340,15 +469,18 @@ impl ChangeDetector {
         false
     }
 
-    fn calculate_similarity(&self, old: &ApiSignature, new: &ApiSignature) -> f64 {
+    /// How alike `old` and `new` are; `bodies` are their [`body_tokens`], if
+    /// both have enough for body similarity to count.
+    fn calculate_similarity(
+        &self,
+        old: &ApiSignature,
+        new: &ApiSignature,
+        bodies: Option<(&Tokens, &Tokens)>,
+    ) -> Similarity {
+        // Signature shape: parameters and return type
         let mut score = 0.0;
         let mut weight_sum = 0.0;
 
-        // Name similarity (highest weight)
-        let name_sim = string_similarity(&old.name, &new.name);
-        score += name_sim * 0.5;
-        weight_sum += 0.5;
-
         // Parameter count similarity
         if matches!(old.kind, ApiType::Function | ApiType::Method) {
             let param_count_sim = if old.parameters.len() == new.parameters.len() {
@@ -374,6 +506,24 @@ impl ChangeDetector {
                 score += param_sim * 0.2;
                 weight_sum += 0.2;
             }
+
+            // Parameter types, position by position
+            if old
+                .parameters
+                .iter()
+                .chain(&new.parameters)
+                .any(|p| p.type_info.is_some())
+            {
+                let same = old
+                    .parameters
+                    .iter()
+                    .zip(&new.parameters)
+                    .filter(|(o, n)| o.type_info == n.type_info)
+                    .count();
+                let count = old.parameters.len().max(new.parameters.len());
+                score += same as f64 / count as f64 * 0.1;
+                weight_sum += 0.1;
+            }
         }
 
         // Return type similarity (if present)
@@ -392,10 +542,15 @@ impl ChangeDetector {
             }
         }
 
-        if weight_sum > 0.0 {
-            score / weight_sum
-        } else {
-            0.0
+        Similarity {
+            name: string_similarity(&old.name, &new.name),
+            signature: (score, weight_sum),
+            body: bodies.map(|(o, n)| dice(o, n)),
+            doc: old
+                .doc
+                .as_deref()
+                .zip(new.doc.as_deref())
+                .map(|(o, n)| dice(&doc_words(o, &old.name), &doc_words(n, &new.name))),
         }
     }
 
@@ -403,7 +558,7 @@ impl ChangeDetector {
         &self,
         old_sig: &ApiSignature,
         new_sig: &ApiSignature,
-        confidence: f64,
+        similarity: &Similarity,
     ) -> ApiChange {
         let kind = match old_sig.kind {
             ApiType::Function | ApiType::Method => ChangeKind::FunctionRenamed {
@@ -429,21 +584,141 @@ impl ChangeDetector {
         ApiChange::new(kind, old_sig.location.file.clone())
             .with_original(&old_sig.name)
             .with_replacement(&new_sig.name)
-            .with_confidence(confidence)
+            .with_confidence(similarity.score())
             .with_metadata(ChangeMetadata {
                 old_line: Some(old_sig.location.line),
                 new_line: Some(new_sig.location.line),
                 severity: Severity::Breaking,
                 migration_notes: Some(format!(
-                    "{} '{}' renamed to '{}'",
+                    "{} '{}' renamed to '{}' (inferred from {})",
                     old_sig.kind.name(),
                     old_sig.name,
-                    new_sig.name
+                    new_sig.name,
+                    similarity
                 )),
             })
     }
 }
 
+/// Weight of name similarity in a rename's confidence.
+const NAME_WEIGHT: f64 = 0.5;
+
+/// Weight of body similarity, when both APIs have a body.
+const BODY_WEIGHT: f64 = 0.4;
+
+/// Weight of doc comment similarity, when both APIs have one.
+const DOC_WEIGHT: f64 = 0.2;
+
+/// Tokens a body needs for body similarity to count: trivial bodies such
+/// as `{ return nil }` are alike in unrelated APIs.
+const MIN_BODY_TOKENS: usize = 8;
+
+/// Counts of the tokens of a body or doc comment.
+type Tokens = HashMap<String, usize>;
+
+/// How alike an old and a new API are, by aspect (each 0.0 - 1.0).
+#[derive(Debug, Clone, Copy)]
+struct Similarity {
+    name: f64,
+    /// Weighted score of the signature shape, and the sum of its weights.
+    signature: (f64, f64),
+    body: Option<f64>,
+    doc: Option<f64>,
+}
+
+impl Similarity {
+    /// The weighted similarity, used as the confidence of a rename.
+    fn score(&self) -> f64 {
+        let (mut score, mut weight_sum) = self.signature;
+        score += self.name * NAME_WEIGHT;
+        weight_sum += NAME_WEIGHT;
+        for (similarity, weight) in [(self.body, BODY_WEIGHT), (self.doc, DOC_WEIGHT)] {
+            if let Some(similarity) = similarity {
+                score += similarity * weight;
+                weight_sum += weight;
+            }
+        }
+        score / weight_sum
+    }
+}
+
+impl std::fmt::Display for Similarity {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let (signature, weight) = self.signature;
+        write!(
+            f,
+            "name {:.0}%, signature {:.0}%",
+            self.name * 100.0,
+            signature / weight * 100.0
+        )?;
+        if let Some(body) = self.body {
+            write!(f, ", body {:.0}%", body * 100.0)?;
+        }
+        if let Some(doc) = self.doc {
+            write!(f, ", doc {:.0}%", doc * 100.0)?;
+        }
+        Ok(())
+    }
+}
+
+/// The [`code_tokens`] of the body of `sig`, unless it has none or fewer
+/// than [`MIN_BODY_TOKENS`].
+fn body_tokens(sig: &ApiSignature) -> Option<Tokens> {
+    let tokens = code_tokens(sig.body.as_deref()?, &sig.name);
+    (tokens.values().sum::<usize>() >= MIN_BODY_TOKENS).then_some(tokens)
+}
+
+/// The identifier, number and punctuation tokens of `code`, with `name`,
+/// the API's own name in recursive calls, replaced by a placeholder.
+fn code_tokens(code: &str, name: &str) -> Tokens {
+    let mut tokens = HashMap::new();
+    let mut chars = code.char_indices().peekable();
+    while let Some((start, c)) = chars.next() {
+        if c.is_whitespace() {
+            continue;
+        }
+        let mut end = start + c.len_utf8();
+        if c.is_alphanumeric() || c == '_' {
+            while let Some((i, c)) = chars.next_if(|(_, c)| c.is_alphanumeric() || *c == '_') {
+                end = i + c.len_utf8();
+            }
+        }
+        let token = match &code[start..end] {
+            token if token == name => "$self",
+            token => token,
+        };
+        *tokens.entry(token.to_string()).or_insert(0) += 1;
+    }
+    tokens
+}
+
+/// The lowercased words of a doc comment, without `name`, which Go and
+/// Java docs start with.
+fn doc_words(doc: &str, name: &str) -> Tokens {
+    let mut words = HashMap::new();
+    for word in doc
+        .split(|c: char| !c.is_alphanumeric())
+        .filter(|word| !word.is_empty() && *word != name)
+    {
+        *words.entry(word.to_lowercase()).or_insert(0) += 1;
+    }
+    words
+}
+
+/// Dice coefficient of two multisets: twice the shared count over the
+/// total count.
+fn dice(a: &Tokens, b: &Tokens) -> f64 {
+    let total: usize = a.values().chain(b.values()).sum();
+    if total == 0 {
+        return 1.0;
+    }
+    let shared: usize = a
+        .iter()
+        .map(|(token, count)| (*count).min(b.get(token).copied().unwrap_or(0)))
+        .sum();
+    2.0 * shared as f64 / total as f64
+}
+
 /// Calculate string similarity using Levenshtein distance.
 fn string_similarity(a: &str, b: &str) -> f64 {
     if a == b {
@@ -516,10 +791,38 @@ fn format_signature(sig: &ApiSignature) -> String {
     format!("{}({}){}", sig.name, params_str, ret)
 }
 
+/// The method set of the interface `sig`: its methods and those of the
+/// interfaces it embeds, found among `apis` or the standard library's.
+/// Embeds found in neither are kept as declared (`mylib.Base`).
+fn method_set(sig: &ApiSignature, apis: &HashMap<String, &ApiSignature>) -> Vec<String> {
+    let mut methods = sig.methods.clone();
+    let mut seen = HashSet::from([sig.name.clone()]);
+    let mut embeds: Vec<&String> = sig.embeds.iter().rev().collect();
+    while let Some(embed) = embeds.pop() {
+        if !seen.insert(embed.clone()) {
+            continue;
+        }
+        if let Some((_, std)) = STD_INTERFACES.iter().find(|(name, _)| name == embed) {
+            methods.extend(std.iter().map(|method| method.to_string()));
+        } else if let Some(interface) = apis
+            .values()
+            .find(|api| api.kind == ApiType::Interface && &api.name == embed)
+        {
+            methods.extend(interface.methods.iter().cloned());
+            embeds.extend(interface.embeds.iter().rev());
+        } else {
+            methods.push(embed.clone());
+        }
+    }
+    let mut names = HashSet::new();
+    methods.retain(|method| names.insert(method.split('(').next().unwrap_or_default().to_string()));
+    methods
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
-    use crate::analyzer::signature::{SourceLocation, Visibility};
+    use crate::analyzer::signature::{SourceLocation, TypeInfo, Visibility};
 
     fn make_fn(name: &str, params: Vec<&str>) -> ApiSignature {
         let loc = SourceLocation::new("test.rs", 1, 1);
@@ -579,6 +882,166 @@ mod tests {
         ));
     }
 
+    #[test]
+    fn test_infer_modified_rename() {
+        let user = TypeInfo::simple("(*User, error)");
+        let get_user = make_fn("GetUser", vec!["id"])
+            .with_return_type(user.clone())
+            .with_doc("GetUser returns the user with the given id.")
+            .with_body("{\n\treturn c.get(\"/users/\" + id)\n}");
+        let fetch_user = make_fn("FetchUser", vec!["ctx", "id"])
+            .with_return_type(user)
+            .with_doc("FetchUser returns the user with the given id.")
+            .with_body("{\n\treturn c.get(ctx, \"/users/\" + id)\n}");
+        let list_users = make_fn("ListUsers", vec!["limit"])
+            .with_doc("ListUsers returns up to limit users.")
+            .with_body("{\n\treturn c.list(\"/users\", limit)\n}");
+
+        let old_apis = HashMap::from([(PathBuf::from("client.go"), vec![get_user.clone()])]);
+        let new_apis = HashMap::from([(
+            PathBuf::from("client.go"),
+            vec![list_users, fetch_user.clone()],
+        )]);
+        let changes = ChangeDetector::new().detect(&old_apis, &new_apis);
+        let rename = changes
+            .iter()
+            .find(|c| matches!(c.kind, ChangeKind::FunctionRenamed { .. }))
+            .unwrap();
+        assert!(matches!(
+            &rename.kind,
+            ChangeKind::FunctionRenamed { old_name, new_name, .. }
+            if old_name == "GetUser" && new_name == "FetchUser"
+        ));
+        assert!(rename.confidence < 0.9 && rename.requires_manual_review());
+        let notes = rename.metadata.migration_notes.as_deref().unwrap();
+        assert!(notes.contains("inferred from name 67%"), "{}", notes);
+        assert!(notes.contains("doc 100%"), "{}", notes);
+
+        // Without bodies and doc comments the names alone are too far apart
+        let strip = |mut sig: ApiSignature| {
+            sig.doc = None;
+            sig.body = None;
+            sig
+        };
+        let old_apis = HashMap::from([(PathBuf::from("client.go"), vec![strip(get_user)])]);
+        let new_apis = HashMap::from([(PathBuf::from("client.go"), vec![strip(fetch_user)])]);
+        let changes = ChangeDetector::new().detect(&old_apis, &new_apis);
+        assert!(
+            changes
+                .iter()
+                .all(|c| !matches!(c.kind, ChangeKind::FunctionRenamed { .. }))
+        );
+    }
+
+    #[test]
+    fn test_trivial_bodies_do_not_pair_apis() {
+        let error = TypeInfo::simple("error");
+        let api = |name: &str| {
+            make_fn(name, vec![])
+                .with_return_type(error.clone())
+                .with_body("{\n\treturn nil\n}")
+        };
+        let old_apis = HashMap::from([(PathBuf::from("conn.go"), vec![api("Close")])]);
+        let new_apis = HashMap::from([(PathBuf::from("conn.go"), vec![api("Flush")])]);
+        let changes = ChangeDetector::new().detect(&old_apis, &new_apis);
+        assert!(
+            changes
+                .iter()
+                .all(|c| !matches!(c.kind, ChangeKind::FunctionRenamed { .. })),
+            "{:?}",
+            changes
+        );
+    }
+
+    #[test]
+    fn test_detect_interface_change() {
+        let store = |methods: &[&str]| {
+            ApiSignature::type_def(
+                "Store",
+                ApiType::Interface,
+                SourceLocation::new("store.go", 3, 1),
+            )
+            .with_methods(methods.iter().map(|m| m.to_string()).collect())
+        };
+        let old_apis = HashMap::from([(
+            PathBuf::from("store.go"),
+            vec![store(&[
+                "Get(key string) ([]byte, error)",
+                "Keys() []string",
+            ])],
+        )]);
+        let new_apis = HashMap::from([(
+            PathBuf::from("store.go"),
+            vec![store(&[
+                "Get(ctx context.Context, key string) ([]byte, error)",
+                "Close() error",
+            ])],
+        )]);
+
+        let changes = ChangeDetector::new().detect(&old_apis, &new_apis);
+        assert_eq!(changes.len(), 1);
+        assert_eq!(
+            changes[0].kind,
+            ChangeKind::InterfaceChanged {
+                name: "Store".to_string(),
+                old_methods: vec![
+                    "Get(key string) ([]byte, error)".to_string(),
+                    "Keys() []string".to_string()
+                ],
+                added: vec!["Close() error".to_string()],
+                removed: vec!["Keys() []string".to_string()],
+                changed: vec!["Get(ctx context.Context, key string) ([]byte, error)".to_string()],
+            }
+        );
+        assert_eq!(
+            changes[0].metadata.migration_notes.as_deref(),
+            Some(
+                "Interface 'Store' method set changed: types implementing 'Store' must implement Close() error, Get(ctx context.Context, key string) ([]byte, error); callers can no longer call Keys() []string through it"
+            )
+        );
+        assert!(
+            ChangeDetector::new()
+                .detect(&old_apis, &old_apis)
+                .is_empty()
+        );
+
+        // Methods of embedded interfaces belong to the method set
+        let base = |methods: &[&str]| {
+            ApiSignature::type_def(
+                "Base",
+                ApiType::Interface,
+                SourceLocation::new("base.go", 1, 1),
+            )
+            .with_methods(methods.iter().map(|m| m.to_string()).collect())
+        };
+        let embedding = store(&["Keys() []string"])
+            .with_embeds(vec!["Base".to_string(), "io.Closer".to_string()]);
+        let old_apis = HashMap::from([(
+            PathBuf::from("store.go"),
+            vec![embedding.clone(), base(&["Len() int"])],
+        )]);
+        let new_apis = HashMap::from([(
+            PathBuf::from("store.go"),
+            vec![embedding, base(&["Len() int", "Cap() int"])],
+        )]);
+        let changes = ChangeDetector::new().detect(&old_apis, &new_apis);
+        let store_change = changes
+            .iter()
+            .find(|change| matches!(&change.kind, ChangeKind::InterfaceChanged { name, .. } if name == "Store"))
+            .unwrap();
+        let ChangeKind::InterfaceChanged {
+            old_methods, added, ..
+        } = &store_change.kind
+        else {
+            unreachable!()
+        };
+        assert_eq!(
+            old_methods,
+            &["Keys() []string", "Len() int", "Close() error"]
+        );
+        assert_eq!(added, &["Cap() int"]);
+    }
+
     #[test]
     fn test_detect_parameter_added() {
         let detector = ChangeDetector::new();
@@ -0,0 +1,174 @@
+//! Candidate rules drafted by a language model.
+//!
+//! Some API changes cannot be turned into rules mechanically: a function
+//! split in two, or one whose behavior changed under the same signature.
+//! The analyzer leaves these for manual review. [`RuleDrafter`] is an
+//! opt-in step that sends them to a language model (see [`ChatModel`]) and
+//! parses the rules it proposes.
+//!
+//! Drafted rules are never applied as drafted. Each is in `suggest` mode,
+//! its id starts with [`DRAFT_PREFIX`] and its message says it needs
+//! review, so it only reports matches until someone checks it and switches
+//! it to `apply`. Proposals that do not parse or compile, or that name
+//! plugins, are dropped.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::{LibraryAnalyzer, RuleDrafter};
+//! use refactor::llm::ChatModel;
+//!
+//! let mut config = LibraryAnalyzer::new("./my-library")?.analyze_to_config("v1.0.0", "v2.0.0")?;
+//! let model = ChatModel::new("http://localhost:11434/v1/chat/completions", "qwen2.5-coder");
+//! let drafted = RuleDrafter::new(model).draft_into(&mut config)?;
+//! println!("{} rule(s) drafted for review", drafted);
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde_json::Value;
+
+use super::{ApiChange, RuleMode, TransformRule, UpgradeConfig};
+use crate::error::Result;
+use crate::llm::{ChatModel, extract_json};
+
+/// Prefix of the ids of drafted rules.
+pub const DRAFT_PREFIX: &str = "draft-";
+
+/// Instructions sent with every request.
+const INSTRUCTIONS: &str = r#"You draft migration rules for refactor, a deterministic code rewriting engine. You are given API changes of a library that could not be paired with a rule mechanically. For each change you can migrate client code for, propose one or more rules. Answer with a JSON array of rule objects and nothing else. Each rule has an "id", a "message" explaining the migration, and a "type" with its fields:
+- {"type": "replace_pattern", "pattern": "<regex>", "replacement": "<text with $1 groups>"}
+- {"type": "replace_structural", "pattern": "<code template with $name holes>", "replacement": "<code template>"}
+- {"type": "rewrite_call", "function": "<pkg.Func>", "new_name": "<name>", "remove": ["<index>"], "order": [<old indices>], "add": [{"position": <index>, "value": "<code>"}]}
+- {"type": "rename_function" | "rename_type", "old_name": "<name>", "new_name": "<name>"}
+Rules may add "imports": ["<import path>"] the replacement needs. Propose nothing for changes whose migration you cannot express; answer [] if there are none."#;
+
+/// Drafts candidate rules for unmatched API changes with a language model.
+#[derive(Debug, Clone)]
+pub struct RuleDrafter {
+    model: ChatModel,
+}
+
+impl RuleDrafter {
+    /// A drafter asking `model`.
+    pub fn new(model: ChatModel) -> Self {
+        Self { model }
+    }
+
+    /// A drafter asking the model configured in the environment (see
+    /// [`ChatModel::from_env`]).
+    pub fn from_env() -> Result<Self> {
+        Ok(Self::new(ChatModel::from_env()?))
+    }
+
+    /// Draft rules for the changes of `config` that need manual review and
+    /// add them to it, returning how many were added.
+    pub fn draft_into(&self, config: &mut UpgradeConfig) -> Result<usize> {
+        let unmatched: Vec<&ApiChange> = config
+            .changes
+            .iter()
+            .filter(|change| change.requires_manual_review())
+            .collect();
+        if unmatched.is_empty() {
+            return Ok(0);
+        }
+        let rules = self.draft(&config.name, &unmatched)?;
+        let count = rules.len();
+        for rule in rules {
+            config.add_transform(rule);
+        }
+        Ok(count)
+    }
+
+    /// Draft rules for `changes` of the library upgrade `upgrade`, marked
+    /// for review.
+    pub fn draft(&self, upgrade: &str, changes: &[&ApiChange]) -> Result<Vec<TransformRule>> {
+        let answer = self
+            .model
+            .complete(INSTRUCTIONS, &prompt(upgrade, changes)?)?;
+        Ok(parse_rules(&answer, self.model.name()))
+    }
+}
+
+/// The request describing `changes` to the model.
+fn prompt(upgrade: &str, changes: &[&ApiChange]) -> Result<String> {
+    Ok(format!(
+        "Upgrade: {}\n\nAPI changes left for manual review:\n{}",
+        upgrade,
+        serde_json::to_string_pretty(changes)?
+    ))
+}
+
+/// The rules proposed in the model's answer `content`, marked as drafts by
+/// `model`. Proposals that are not valid rules are dropped.
+fn parse_rules(content: &str, model: &str) -> Vec<TransformRule> {
+    let proposals: Vec<Value> = extract_json(content, '[', ']').unwrap_or_default();
+
+    proposals
+        .into_iter()
+        .filter_map(|proposal| serde_json::from_value::<TransformRule>(proposal).ok())
+        .filter(|rule| rule.matcher.is_none() && rule.rewriter.is_none())
+        .filter(|rule| rule.to_transform().is_ok())
+        .enumerate()
+        .map(|(index, mut rule)| {
+            let id = rule.id.take().unwrap_or_else(|| index.to_string());
+            rule.id = Some(format!(
+                "{}{}",
+                DRAFT_PREFIX,
+                id.trim_start_matches(DRAFT_PREFIX)
+            ));
+            rule.mode = RuleMode::Suggest;
+            rule.message = Some(format!(
+                "Drafted by {}; review before applying: {}",
+                model,
+                rule.message.as_deref().unwrap_or("no explanation given")
+            ));
+            rule
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::ChangeKind;
+    use std::path::PathBuf;
+
+    #[test]
+    fn test_parse_drafted_rules() {
+        let content = r#"Here are the rules:
+```json
+[
+  {"id": "split-connect", "message": "Connect was split into Dial and Handshake",
+   "type": "replace_pattern", "pattern": "pool\\.Connect\\((\\w+)\\)",
+   "replacement": "pool.Handshake(pool.Dial($1))", "mode": "apply"},
+  {"type": "replace_pattern", "pattern": "(unclosed", "replacement": ""},
+  {"type": "replace_literal", "from": "x", "to": "y", "rewriter": "shell"},
+  {"type": "launch_missiles"},
+  {"type": "rename_function", "old_name": "Get", "new_name": "Fetch"}
+]
+```"#;
+        let rules = parse_rules(content, "local-model");
+        assert_eq!(rules.len(), 2);
+        assert_eq!(rules[0].id.as_deref(), Some("draft-split-connect"));
+        assert_eq!(rules[0].mode, RuleMode::Suggest);
+        assert_eq!(
+            rules[0].message.as_deref(),
+            Some(
+                "Drafted by local-model; review before applying: Connect was split into Dial and Handshake"
+            )
+        );
+        assert_eq!(rules[1].id.as_deref(), Some("draft-1"));
+        assert!(parse_rules("I cannot help with that.", "m").is_empty());
+
+        let change = ApiChange::new(
+            ChangeKind::ApiRemoved {
+                name: "Connect".to_string(),
+                api_type: crate::analyzer::ApiType::Function,
+            },
+            PathBuf::from("pool.go"),
+        );
+        let prompt = prompt("pool-v1-to-v2", &[&change]).unwrap();
+        assert!(prompt.starts_with("Upgrade: pool-v1-to-v2\n"));
+        assert!(prompt.contains("\"api_removed\""));
+    }
+}
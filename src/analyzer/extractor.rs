@@ -6,7 +6,7 @@ use git2::{DiffDelta, DiffOptions, Repository};
 use std::collections::HashMap;
 use std::path::{Path, PathBuf};
 use streaming_iterator::StreamingIterator;
-use tree_sitter::QueryCursor;
+use tree_sitter::{Node, QueryCursor};
 
 use super::change::ApiType;
 use super::signature::{ApiSignature, Parameter, SourceLocation, TypeInfo, Visibility};
@@ -389,7 +389,7 @@ impl ApiExtractor {
                     sig
                 };
 
-                signatures.push(sig);
+                signatures.push(with_source(sig, fn_n, source_bytes));
             }
         }
 
@@ -1066,6 +1066,7 @@ impl ApiExtractor {
             r#"
             (function_declaration
                 name: (identifier) @fn_name
+                type_parameters: (type_parameter_list)? @type_params
                 parameters: (parameter_list) @params
                 result: (_)? @return_type
             ) @function
@@ -1077,6 +1078,7 @@ impl ApiExtractor {
 
         while let Some(m) = matches.next() {
             let mut fn_name = None;
+            let mut type_params_node = None;
             let mut params_node = None;
             let mut return_node = None;
             let mut fn_node = None;
@@ -1087,6 +1089,9 @@ impl ApiExtractor {
                     "fn_name" => {
                         fn_name = capture.node.utf8_text(source_bytes).ok();
                     }
+                    "type_params" => {
+                        type_params_node = Some(capture.node);
+                    }
                     "params" => {
                         params_node = Some(capture.node);
                     }
@@ -1123,16 +1128,22 @@ impl ApiExtractor {
                     .and_then(|n| n.utf8_text(source_bytes).ok())
                     .map(|t| TypeInfo::simple(t.trim()));
 
+                // Type parameters of a generic function: `T any`, `K, V comparable`
+                let generic_params = type_params_node
+                    .map(|n| self.parse_go_type_params(n, source_bytes))
+                    .unwrap_or_default();
+
                 let mut sig = ApiSignature::function(name, location)
                     .with_visibility(visibility)
                     .with_params(parameters)
+                    .with_generic_params(generic_params)
                     .exported(is_exported);
 
                 if let Some(rt) = return_type {
                     sig = sig.with_return_type(rt);
                 }
 
-                signatures.push(sig);
+                signatures.push(with_source(sig, fn_n, source_bytes));
             }
         }
 
@@ -1207,7 +1218,7 @@ impl ApiExtractor {
                     sig = sig.with_return_type(rt);
                 }
 
-                signatures.push(sig);
+                signatures.push(with_source(sig, m_node, source_bytes));
             }
         }
 
@@ -1271,7 +1282,7 @@ impl ApiExtractor {
             (type_declaration
                 (type_spec
                     name: (type_identifier) @iface_name
-                    type: (interface_type)
+                    type: (interface_type) @iface_type
                 )
             ) @interface
             "#,
@@ -1283,6 +1294,7 @@ impl ApiExtractor {
         while let Some(m) = matches.next() {
             let mut iface_name = None;
             let mut iface_node = None;
+            let mut type_node = None;
 
             for capture in m.captures {
                 let name = iface_query.capture_names()[capture.index as usize];
@@ -1293,6 +1305,9 @@ impl ApiExtractor {
                     "interface" => {
                         iface_node = Some(capture.node);
                     }
+                    "iface_type" => {
+                        type_node = Some(capture.node);
+                    }
                     _ => {}
                 }
             }
@@ -1311,8 +1326,36 @@ impl ApiExtractor {
                     i_node.start_position().column + 1,
                 );
 
+                // Method elements, not embedded interfaces or type sets
+                let methods = type_node
+                    .map(|n| {
+                        (0..n.named_child_count())
+                            .filter_map(|i| n.named_child(i as u32))
+                            .filter(|elem| matches!(elem.kind(), "method_elem" | "method_spec"))
+                            .filter_map(|elem| elem.utf8_text(source_bytes).ok())
+                            .map(|text| text.split_whitespace().collect::<Vec<_>>().join(" "))
+                            .collect()
+                    })
+                    .unwrap_or_default();
+
+                // Embedded interfaces, not type sets (`~int | ~string`)
+                let embeds = type_node
+                    .map(|n| {
+                        (0..n.named_child_count())
+                            .filter_map(|i| n.named_child(i as u32))
+                            .filter(|elem| elem.kind() == "type_elem")
+                            .filter_map(|elem| elem.utf8_text(source_bytes).ok())
+                            .map(str::trim)
+                            .filter(|text| !text.contains(['|', '~']))
+                            .map(str::to_string)
+                            .collect()
+                    })
+                    .unwrap_or_default();
+
                 let sig = ApiSignature::type_def(name, ApiType::Interface, location)
                     .with_visibility(visibility)
+                    .with_methods(methods)
+                    .with_embeds(embeds)
                     .exported(is_exported);
 
                 signatures.push(sig);
@@ -1322,6 +1365,19 @@ impl ApiExtractor {
         Ok(signatures)
     }
 
+    fn parse_go_type_params(&self, params_node: tree_sitter::Node, source: &[u8]) -> Vec<String> {
+        let mut params = Vec::new();
+        for i in 0..params_node.child_count() {
+            if let Some(child) = params_node.child(i as u32)
+                && child.kind() == "type_parameter_declaration"
+                && let Ok(text) = child.utf8_text(source)
+            {
+                params.push(text.trim().to_string());
+            }
+        }
+        params
+    }
+
     fn parse_go_params(&self, params_node: tree_sitter::Node, source: &[u8]) -> Vec<Parameter> {
         let mut params = Vec::new();
 
@@ -2063,6 +2119,39 @@ impl ApiExtractor {
     }
 }
 
+/// `sig` with the doc comment and body of its declaration `node`.
+fn with_source(mut sig: ApiSignature, node: Node, source: &[u8]) -> ApiSignature {
+    sig.doc = doc_comment(node, source);
+    sig.body = node
+        .child_by_field_name("body")
+        .and_then(|body| body.utf8_text(source).ok())
+        .map(str::to_string);
+    sig
+}
+
+/// The comment lines directly above `node`, without their markers.
+fn doc_comment(node: Node, source: &[u8]) -> Option<String> {
+    let mut lines = Vec::new();
+    let mut row = node.start_position().row;
+    let mut sibling = node.prev_sibling();
+    while let Some(comment) = sibling
+        // Line comments may end at the start of the next line
+        .filter(|n| n.kind().contains("comment") && n.end_position().row + 1 >= row)
+    {
+        let text = comment.utf8_text(source).ok()?;
+        lines.push(
+            text.trim_start_matches(['/', '!', '*'])
+                .trim_end_matches("*/")
+                .trim()
+                .to_string(),
+        );
+        row = comment.start_position().row;
+        sibling = comment.prev_sibling();
+    }
+    lines.reverse();
+    (!lines.is_empty()).then(|| lines.join("\n"))
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -1,5 +1,6 @@
 //! Transform generation from detected API changes.
 
+use std::collections::BTreeMap;
 use std::fmt::Write;
 
 use proc_macro2::TokenStream;
@@ -7,9 +8,10 @@ use quote::{format_ident, quote};
 
 use crate::codemod::Upgrade;
 use crate::matcher::Matcher;
-use crate::transform::TransformBuilder;
+use crate::transform::{TransformBuilder, structural};
 
 use super::change::{ApiChange, ChangeKind, Severity};
+use super::defaults::{DefaultInference, InferredDefault};
 
 /// Generates transforms from detected API changes.
 pub struct UpgradeGenerator {
@@ -21,6 +23,8 @@ pub struct UpgradeGenerator {
     changes: Vec<ApiChange>,
     /// File extensions to target.
     extensions: Vec<String>,
+    /// Default value inference, one per language.
+    defaults: Vec<DefaultInference>,
 }
 
 impl UpgradeGenerator {
@@ -31,6 +35,7 @@ impl UpgradeGenerator {
             description: description.into(),
             changes: Vec::new(),
             extensions: vec!["rs".to_string(), "ts".to_string(), "py".to_string()],
+            defaults: Vec::new(),
         }
     }
 
@@ -46,6 +51,13 @@ impl UpgradeGenerator {
         self
     }
 
+    /// Infer arguments for new required parameters of functions in files
+    /// of the inference's language, instead of leaving them for review.
+    pub fn with_defaults(mut self, inference: DefaultInference) -> Self {
+        self.defaults.push(inference);
+        self
+    }
+
     /// Generate an upgrade that can be applied to dependent projects.
     pub fn generate(self) -> GeneratedUpgrade {
         let mut transforms = Vec::new();
@@ -56,7 +68,15 @@ impl UpgradeGenerator {
             }
         }
 
+        let mut values = BTreeMap::new();
+        for inference in &self.defaults {
+            for (name, value) in inference.values() {
+                values.entry(name).or_insert(value);
+            }
+        }
+
         GeneratedUpgrade {
+            values,
             name: self.name,
             description: self.description,
             changes: self.changes,
@@ -112,13 +132,37 @@ impl UpgradeGenerator {
                 }
             }
 
+            ChangeKind::ParameterAdded {
+                function_name,
+                param_name,
+                param_type,
+                position,
+                has_default: false,
+                old_param_count,
+            } => {
+                let ext = change.file_path.extension().and_then(|e| e.to_str())?;
+                let default = self
+                    .defaults
+                    .iter()
+                    .find(|d| d.language() == ext)?
+                    .infer(param_name, param_type.as_ref())?;
+                Some(Transform::ArgumentAdd {
+                    function_name: function_name.clone(),
+                    param_name: param_name.clone(),
+                    position: *position,
+                    old_param_count: *old_param_count,
+                    default,
+                })
+            }
+
             // These changes cannot be auto-transformed
             ChangeKind::SignatureChanged { .. }
             | ChangeKind::ParameterAdded { .. }
             | ChangeKind::ParameterRemoved { .. }
             | ChangeKind::ParameterReordered { .. }
             | ChangeKind::ApiRemoved { .. }
-            | ChangeKind::TypeChanged { .. } => None,
+            | ChangeKind::TypeChanged { .. }
+            | ChangeKind::InterfaceChanged { .. } => None,
         }
     }
 }
@@ -148,9 +192,52 @@ pub enum Transform {
         old_value: String,
         new_value: String,
     },
+    /// Pass an inferred value for a new parameter at every call.
+    ArgumentAdd {
+        function_name: String,
+        param_name: String,
+        position: usize,
+        old_param_count: usize,
+        default: InferredDefault,
+    },
 }
 
 impl Transform {
+    /// A one-line description for reports and rule messages.
+    pub fn describe(&self) -> String {
+        match self {
+            Transform::FunctionRename { old_name, new_name }
+            | Transform::TypeRename { old_name, new_name } => {
+                format!("`{}` -> `{}`", old_name, new_name)
+            }
+            Transform::ImportRename { old_path, new_path } => {
+                format!("`{}` -> `{}`", old_path, new_path)
+            }
+            Transform::MethodMove {
+                method_name,
+                old_location,
+                new_location,
+            } => format!(
+                "`{}`: `{}` -> `{}`",
+                method_name, old_location, new_location
+            ),
+            Transform::ConstantUpdate {
+                name,
+                old_value,
+                new_value,
+            } => format!("`{}`: `{}` -> `{}`", name, old_value, new_value),
+            Transform::ArgumentAdd {
+                function_name,
+                param_name,
+                default,
+                ..
+            } => format!(
+                "`{}`: pass `{}` for new parameter `{}` ({})",
+                function_name, default.value, param_name, default.source
+            ),
+        }
+    }
+
     /// Convert this transform to a regex pattern and replacement.
     pub fn to_pattern_replacement(&self) -> (String, String) {
         match self {
@@ -197,6 +284,40 @@ impl Transform {
                 // Literal replacement of values
                 (regex::escape(old_value), new_value.clone())
             }
+
+            Transform::ArgumentAdd {
+                function_name,
+                position,
+                old_param_count,
+                default,
+                ..
+            } => {
+                // Insert after the first `position` arguments of each call
+                // with the old number of arguments, so calls already passing
+                // the new one are left alone
+                let call = format!(r"\b{}\s*\(", regex::escape(function_name));
+                let value = default.value.replace('$', "$$");
+                let arg = structural::argument();
+                let list = |count: usize| vec![arg.as_str(); count].join(r"\s*,\s*");
+                let count = (*old_param_count).max(*position);
+                match (*position, count) {
+                    (0, 0) => (
+                        format!(r"{}\s*\)", call),
+                        format!("{}({})", function_name, value),
+                    ),
+                    (0, _) => (
+                        format!(r"{}(?P<args>\s*{}\s*\))", call, list(count)),
+                        format!("{}({}, ${{args}}", function_name, value),
+                    ),
+                    (n, _) => {
+                        let rest = format!(r"(?:\s*,\s*{})", arg).repeat(count - n);
+                        (
+                            format!(r"{}(?P<args>{})(?P<end>{}\s*\))", call, list(n), rest),
+                            format!("{}(${{args}}, {}${{end}}", function_name, value),
+                        )
+                    }
+                }
+            }
         }
     }
 }
@@ -214,6 +335,8 @@ pub struct GeneratedUpgrade {
     pub transforms: Vec<Transform>,
     /// File extensions to match.
     pub extensions: Vec<String>,
+    /// Library defaults discovered in the new version, by name.
+    pub values: BTreeMap<String, String>,
 }
 
 impl GeneratedUpgrade {
@@ -271,6 +394,31 @@ impl GeneratedUpgrade {
             writeln!(report).unwrap();
         }
 
+        // Library defaults available to rule templates
+        if !self.values.is_empty() {
+            writeln!(report, "## Library Defaults").unwrap();
+            writeln!(report).unwrap();
+            for (name, value) in &self.values {
+                writeln!(report, "- `{{{{{}}}}}` = `{}`", name, value).unwrap();
+            }
+            writeln!(report).unwrap();
+        }
+
+        // Arguments passed for new parameters
+        let inferred: Vec<&Transform> = self
+            .transforms
+            .iter()
+            .filter(|t| matches!(t, Transform::ArgumentAdd { .. }))
+            .collect();
+        if !inferred.is_empty() {
+            writeln!(report, "## Inferred Arguments").unwrap();
+            writeln!(report).unwrap();
+            for transform in inferred {
+                writeln!(report, "- {}", transform.describe()).unwrap();
+            }
+            writeln!(report).unwrap();
+        }
+
         // Manual review changes
         let manual_changes = self.manual_review_changes();
         if !manual_changes.is_empty() {
@@ -428,7 +576,7 @@ fn format_change(change: &ApiChange) -> String {
     )
 }
 
-fn format_change_detail(kind: &ChangeKind) -> String {
+pub(super) fn format_change_detail(kind: &ChangeKind) -> String {
     match kind {
         ChangeKind::FunctionRenamed {
             old_name, new_name, ..
@@ -486,6 +634,26 @@ fn format_change_detail(kind: &ChangeKind) -> String {
             let new = new_value.as_deref().unwrap_or("?");
             format!("`{}`: `{}` -> `{}`", name, old, new)
         }
+        ChangeKind::InterfaceChanged {
+            name,
+            added,
+            removed,
+            changed,
+            ..
+        } => {
+            let methods = |list: &[String]| {
+                list.iter()
+                    .map(|method| format!("`{}`", method.split('(').next().unwrap_or(method)))
+                    .collect::<Vec<_>>()
+                    .join(", ")
+            };
+            let parts: Vec<String> = [("added", added), ("removed", removed), ("changed", changed)]
+                .into_iter()
+                .filter(|(_, list)| !list.is_empty())
+                .map(|(label, list)| format!("{} {}", label, methods(list)))
+                .collect();
+            format!("`{}`: {}", name, parts.join("; "))
+        }
     }
 }
 
@@ -493,7 +661,7 @@ fn format_change_detail(kind: &ChangeKind) -> String {
 mod tests {
     use super::*;
     use crate::analyzer::ApiType;
-    use std::path::PathBuf;
+    use std::path::{Path, PathBuf};
 
     #[test]
     fn test_function_rename_transform() {
@@ -557,6 +725,61 @@ mod tests {
         assert_eq!(upgrade.manual_review_changes().len(), 1);
     }
 
+    #[test]
+    fn test_added_parameter_gets_inferred_argument() {
+        use crate::analyzer::{DefaultInference, TypeInfo};
+        use crate::transform::{TextTransform, Transform as _};
+
+        let added = |position, old_param_count| {
+            ApiChange::new(
+                ChangeKind::ParameterAdded {
+                    function_name: "Connect".into(),
+                    param_name: "timeout".into(),
+                    param_type: Some(TypeInfo::simple("time.Duration")),
+                    position,
+                    has_default: false,
+                    old_param_count,
+                },
+                PathBuf::from("pool/pool.go"),
+            )
+        };
+        let rewrite = |change: ApiChange, source: &str| {
+            let upgrade = UpgradeGenerator::new("test", "test upgrade")
+                .with_defaults(
+                    DefaultInference::new("go")
+                        .with_package("pool")
+                        .with_constant("DefaultTimeout", None),
+                )
+                .with_changes(vec![change])
+                .generate();
+            let (pattern, replacement) = upgrade.transforms[0].to_pattern_replacement();
+            let result = TextTransform::replace(&pattern, &replacement)
+                .apply(source, Path::new("main.go"))
+                .unwrap();
+            (upgrade.report(), result)
+        };
+
+        let (report, result) = rewrite(added(1, 2), "c.Connect(addr(1, 2), opts)\nConnect(a)\n");
+        assert_eq!(
+            result,
+            "c.Connect(addr(1, 2), pool.DefaultTimeout, opts)\nConnect(a)\n"
+        );
+        // Calls already passing the new argument are left alone
+        assert_eq!(rewrite(added(1, 2), &result).1, result);
+        let (_, result) = rewrite(added(2, 2), "Connect(a, b)\n");
+        assert_eq!(result, "Connect(a, b, pool.DefaultTimeout)\n");
+        assert_eq!(rewrite(added(2, 2), &result).1, result);
+        assert!(report.contains(
+            "- `Connect`: pass `pool.DefaultTimeout` for new parameter `timeout` (library constant `DefaultTimeout`)"
+        ));
+
+        let (_, result) = rewrite(added(0, 1), "Connect(a)\n");
+        assert_eq!(result, "Connect(pool.DefaultTimeout, a)\n");
+        assert_eq!(rewrite(added(0, 1), &result).1, result);
+        let (_, result) = rewrite(added(0, 0), "Connect( )\n");
+        assert_eq!(result, "Connect(pool.DefaultTimeout)\n");
+    }
+
     #[test]
     fn test_report_generation() {
         let changes = vec![
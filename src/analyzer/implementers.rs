@@ -0,0 +1,462 @@
+//! Client types broken by interface changes.
+//!
+//! Go types implement interfaces implicitly, so a method added to a
+//! library's interface breaks every client type that implemented it, and no
+//! call site points at them. [`find_implementers`] scans a client's Go
+//! sources for types whose methods cover an interface's old method set and
+//! lists, for each, the methods it now lacks, with stubs to paste in, and
+//! those it declares with an outdated signature, with the declaration to
+//! change.
+//!
+//! Methods are compared by name and by the types of their parameters and
+//! results, without type information: a type declaring every method of the
+//! old interface, with its old or new signature, is taken to implement it.
+//! Embedded interfaces the library or the standard library declares are
+//! part of the method set; others cannot be checked and are ignored.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::LibraryAnalyzer;
+//!
+//! let diff = LibraryAnalyzer::new("./my-library")?.api_diff("v1.0.0", "v2.0.0")?;
+//! for implementer in diff.implementers("./client")? {
+//!     println!("{}\n{}", implementer, implementer.stubs());
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use serde::Serialize;
+use std::collections::{BTreeMap, HashMap};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+use walkdir::WalkDir;
+
+use super::change::{ApiChange, ChangeKind};
+use crate::error::Result;
+use crate::runner::TODO_MARKER;
+use crate::transform::imports::code_only;
+
+/// A method declaration: receiver variable, pointer, type, method name and
+/// the signature on the first line.
+static METHOD: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r"(?m)^func[ \t]*(?P<recv>\([ \t]*(?:(?P<var>\w+)[ \t]+)?(?P<ptr>\*?)[ \t]*(?P<type>\w+)(?:\[[^\]]*\])?[ \t]*\))[ \t]*(?P<name>\w+)(?P<sig>\([^{\n]*)?",
+    )
+    .expect("invalid method regex")
+});
+
+/// A type declaration. Types declared in a `type ( ... )` group are
+/// located by their first method instead.
+static TYPE: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"(?m)^type[ \t]+(?P<name>\w+)").expect("invalid type regex"));
+
+/// A client type that implements the old method set of a changed interface.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Implementer {
+    /// The client type.
+    pub type_name: String,
+    /// File declaring the type (or its first method), relative to the
+    /// client root.
+    pub file: PathBuf,
+    /// Line of the declaration.
+    pub line: usize,
+    /// The interface it implements.
+    pub interface: String,
+    /// Receiver of the type's methods (`s *Store`).
+    pub receiver: String,
+    /// Signatures of the methods it lacks.
+    pub missing: Vec<String>,
+    /// New signatures of the methods it declares with another signature.
+    pub changed: Vec<String>,
+    /// The type's declarations of the changed methods, in the order of
+    /// `changed`.
+    pub current: Vec<MethodDecl>,
+}
+
+/// A method as a client type declares it.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct MethodDecl {
+    /// File declaring the method, relative to the client root.
+    pub file: PathBuf,
+    /// Line of the declaration.
+    pub line: usize,
+    /// Its receiver (`(m *MemStore)`).
+    pub receiver: String,
+    /// Its signature on the declaration's line
+    /// (`Get(key string) ([]byte, error)`).
+    pub signature: String,
+}
+
+impl Implementer {
+    /// Go stubs for the missing methods, each failing with a
+    /// [`TODO_MARKER`] until written, and for each changed method the
+    /// declaration to rewrite to its new signature.
+    pub fn stubs(&self) -> String {
+        let stubs = self.missing.iter().map(|method| {
+            let name = method.split('(').next().unwrap_or(method);
+            format!(
+                "func ({}) {} {{\n\tpanic(\"{}: implement {}.{}\")\n}}\n",
+                self.receiver, method, TODO_MARKER, self.type_name, name
+            )
+        });
+        let rewrites = self
+            .changed
+            .iter()
+            .zip(&self.current)
+            .map(|(method, decl)| {
+                format!(
+                    "{}:{}: change\n-func {} {}\n+func {} {}\n",
+                    decl.file.display(),
+                    decl.line,
+                    decl.receiver,
+                    decl.signature,
+                    decl.receiver,
+                    method
+                )
+            });
+        stubs.chain(rewrites).collect::<Vec<_>>().join("\n")
+    }
+}
+
+impl fmt::Display for Implementer {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}:{}: {} implements {}",
+            self.file.display(),
+            self.line,
+            self.type_name,
+            self.interface
+        )?;
+        if !self.missing.is_empty() {
+            write!(f, "; missing {}", self.missing.join(", "))?;
+        }
+        if !self.changed.is_empty() {
+            write!(f, "; changed {}", self.changed.join(", "))?;
+        }
+        Ok(())
+    }
+}
+
+/// A client type's methods by name, as found in the sources.
+#[derive(Debug, Default)]
+struct ClientType {
+    methods: HashMap<String, MethodDecl>,
+    receiver: Option<String>,
+    location: Option<(PathBuf, usize)>,
+    declared: Option<(PathBuf, usize)>,
+}
+
+/// The client types under `root` that implement an interface `changes`
+/// change and break with it, sorted by file and line.
+pub fn find_implementers(
+    root: impl AsRef<Path>,
+    changes: &[ApiChange],
+) -> Result<Vec<Implementer>> {
+    let interfaces: Vec<_> = changes
+        .iter()
+        .filter_map(|change| match &change.kind {
+            ChangeKind::InterfaceChanged {
+                name,
+                old_methods,
+                added,
+                changed,
+                ..
+            } if !old_methods.is_empty() && (!added.is_empty() || !changed.is_empty()) => {
+                Some((name, old_methods, added, changed))
+            }
+            _ => None,
+        })
+        .collect();
+    if interfaces.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let root = root.as_ref();
+    // Types by package directory and name
+    let mut types: BTreeMap<(PathBuf, String), ClientType> = BTreeMap::new();
+    let walker = WalkDir::new(root).into_iter().filter_entry(|entry| {
+        let name = entry.file_name().to_str().unwrap_or_default();
+        entry.depth() == 0 || !(name.starts_with(['.', '_']) || matches!(name, "vendor"))
+    });
+    for entry in walker.filter_map(|e| e.ok()) {
+        let path = entry.path();
+        if !entry.file_type().is_file() || path.extension().is_none_or(|e| e != "go") {
+            continue;
+        }
+        let code = code_only(&fs::read_to_string(path)?);
+        let rel = path.strip_prefix(root).unwrap_or(path);
+        let package = rel.parent().unwrap_or(Path::new("")).to_path_buf();
+        let line_of = |offset: usize| code[..offset].matches('\n').count() + 1;
+        for caps in METHOD.captures_iter(&code) {
+            let client = types
+                .entry((package.clone(), caps["type"].to_string()))
+                .or_default();
+            let signature = caps.name("sig").map_or("", |sig| sig.as_str());
+            client.methods.insert(
+                caps["name"].to_string(),
+                MethodDecl {
+                    file: rel.to_path_buf(),
+                    line: line_of(caps.get(0).unwrap().start()),
+                    receiver: caps["recv"].to_string(),
+                    signature: format!(
+                        "{}{}",
+                        &caps["name"],
+                        signature.trim_end().trim_end_matches('{').trim_end()
+                    ),
+                },
+            );
+            client.receiver.get_or_insert_with(|| {
+                let var = caps.name("var").map_or("_", |m| m.as_str());
+                format!("{} {}{}", var, &caps["ptr"], &caps["type"])
+            });
+            client
+                .location
+                .get_or_insert_with(|| (rel.to_path_buf(), line_of(caps.get(0).unwrap().start())));
+        }
+        for caps in TYPE.captures_iter(&code) {
+            if let Some(client) = types.get_mut(&(package.clone(), caps["name"].to_string())) {
+                let name = caps.name("name").unwrap();
+                client
+                    .declared
+                    .get_or_insert_with(|| (rel.to_path_buf(), line_of(name.start())));
+            }
+        }
+    }
+
+    let method_name = |method: &str| method.split('(').next().unwrap_or_default().to_string();
+    let mut implementers = Vec::new();
+    for ((_, type_name), client) in &types {
+        for (interface, old_methods, added, changed) in &interfaces {
+            let declares = |method: &str| client.methods.get(&method_name(method));
+            // Each old method, with its old or its new signature; embedded
+            // interfaces that could not be resolved are not checked
+            let implements = old_methods
+                .iter()
+                .filter(|method| method.contains('('))
+                .all(|method| {
+                    declares(method).is_some_and(|decl| {
+                        same_shape(&decl.signature, method)
+                            || changed.iter().any(|new| {
+                                method_name(new) == method_name(method)
+                                    && same_shape(&decl.signature, new)
+                            })
+                    })
+                });
+            let (true, Some((file, line)), Some(receiver)) = (
+                implements,
+                client.declared.as_ref().or(client.location.as_ref()),
+                &client.receiver,
+            ) else {
+                continue;
+            };
+            let missing: Vec<String> = added
+                .iter()
+                .filter(|method| method.contains('(') && declares(method).is_none())
+                .cloned()
+                .collect();
+            let (changed, current): (Vec<String>, Vec<MethodDecl>) = changed
+                .iter()
+                .chain(added.iter())
+                .filter_map(|method| {
+                    let decl = declares(method)?;
+                    (!same_shape(&decl.signature, method)).then(|| (method.clone(), decl.clone()))
+                })
+                .unzip();
+            if missing.is_empty() && changed.is_empty() {
+                continue;
+            }
+            implementers.push(Implementer {
+                type_name: type_name.clone(),
+                file: file.clone(),
+                line: *line,
+                interface: (*interface).clone(),
+                receiver: receiver.clone(),
+                missing,
+                changed,
+                current,
+            });
+        }
+    }
+    implementers.sort_by(|a, b| (&a.file, a.line).cmp(&(&b.file, b.line)));
+    Ok(implementers)
+}
+
+/// Whether the method signatures `a` and `b` have the same name and
+/// parameter and result types, whatever their parameters are named. A
+/// signature that cannot be read (split over lines) matches by name.
+fn same_shape(a: &str, b: &str) -> bool {
+    let name = |sig: &str| sig.split('(').next().unwrap_or_default().trim().to_string();
+    name(a) == name(b)
+        && match (shape(a), shape(b)) {
+            (Some(a), Some(b)) => a == b,
+            _ => true,
+        }
+}
+
+/// The parameter and result types of the method signature `signature`,
+/// without names or spaces: `Get(key string) ([]byte, error)` is
+/// `(string)([]byte,error)`.
+fn shape(signature: &str) -> Option<String> {
+    let (params, rest) = group(&signature[signature.find('(')?..])?;
+    let rest = rest.trim();
+    let results = match rest.strip_prefix('(') {
+        Some(_) => {
+            let (results, after) = group(rest)?;
+            if !after.trim().is_empty() {
+                return None;
+            }
+            types(results)
+        }
+        None => vec![rest.split_whitespace().collect()],
+    };
+    Some(format!(
+        "({})({})",
+        types(params).join(","),
+        results.join(",")
+    ))
+}
+
+/// The type of the named parameter `part` (`key string`), or `None` if it
+/// is a bare name or type.
+fn param_type(part: &str) -> Option<&str> {
+    let (name, rest) = part.split_once(char::is_whitespace)?;
+    let keyword = matches!(name, "chan" | "func" | "map" | "struct" | "interface");
+    (!keyword && name.chars().all(|c| c.is_alphanumeric() || c == '_')).then(|| rest.trim())
+}
+
+/// The contents of the parenthesized group `text` starts with, and the
+/// text after it.
+fn group(text: &str) -> Option<(&str, &str)> {
+    let mut depth = 0;
+    for (i, c) in text.char_indices() {
+        match c {
+            '(' | '[' | '{' => depth += 1,
+            ')' | ']' | '}' => {
+                depth -= 1;
+                if depth == 0 {
+                    return Some((&text[1..i], &text[i + 1..]));
+                }
+            }
+            _ => {}
+        }
+    }
+    None
+}
+
+/// The types of the parameter list `list`, named (`a, b int`) or not.
+fn types(list: &str) -> Vec<String> {
+    let mut parts = Vec::new();
+    let (mut depth, mut start) = (0, 0);
+    for (i, c) in list.char_indices() {
+        match c {
+            '(' | '[' | '{' => depth += 1,
+            ')' | ']' | '}' => depth -= 1,
+            ',' if depth == 0 => {
+                parts.push(list[start..i].trim());
+                start = i + 1;
+            }
+            _ => {}
+        }
+    }
+    parts.push(list[start..].trim());
+    parts.retain(|part| !part.is_empty());
+
+    let named = parts.iter().any(|part| param_type(part).is_some());
+    let mut types: Vec<String> = Vec::new();
+    let mut next = String::new();
+    for part in parts.iter().rev() {
+        let spelled = if named { param_type(part) } else { Some(*part) };
+        if let Some(spelled) = spelled {
+            next = spelled.split_whitespace().collect();
+        }
+        types.push(next.clone());
+    }
+    types.reverse();
+    types
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_find_implementers() {
+        let dir = TempDir::new().unwrap();
+        fs::write(
+            dir.path().join("cache.go"),
+            r#"package client
+
+// MemStore keeps items in memory.
+type MemStore struct {
+	items map[string][]byte
+}
+
+func (m *MemStore) Get(key string) ([]byte, error) { return m.items[key], nil }
+
+func (m *MemStore) Put(key string, value []byte) error {
+	m.items[key] = value
+	return nil
+}
+
+type ReadOnly struct{}
+
+func (ReadOnly) Get(key string) ([]byte, error) { return nil, nil }
+
+// Migrated already implements the new Store.
+type Migrated struct{}
+
+func (Migrated) Get(c context.Context, k string) ([]byte, error) { return nil, nil }
+func (Migrated) Put(k string, v []byte) error                    { return nil }
+func (Migrated) Close(ctx context.Context) error                 { return nil }
+
+// Counter has methods named like Store's, with other types.
+type Counter struct{}
+
+func (Counter) Get(id int) int        { return 0 }
+func (Counter) Put(id int, n int) int { return 0 }
+"#,
+        )
+        .unwrap();
+        let change = ApiChange::new(
+            ChangeKind::InterfaceChanged {
+                name: "Store".to_string(),
+                old_methods: vec![
+                    "Get(key string) ([]byte, error)".to_string(),
+                    "Put(key string, value []byte) error".to_string(),
+                ],
+                added: vec!["Close(ctx context.Context) error".to_string()],
+                removed: Vec::new(),
+                changed: vec!["Get(ctx context.Context, key string) ([]byte, error)".to_string()],
+            },
+            PathBuf::from("store.go"),
+        );
+
+        let implementers = find_implementers(dir.path(), &[change]).unwrap();
+        assert_eq!(implementers.len(), 1);
+        let store = &implementers[0];
+        assert_eq!(store.type_name, "MemStore");
+        assert_eq!(
+            (store.file.as_path(), store.line),
+            (Path::new("cache.go"), 4)
+        );
+        assert_eq!(
+            store.to_string(),
+            "cache.go:4: MemStore implements Store; missing Close(ctx context.Context) error; changed Get(ctx context.Context, key string) ([]byte, error)"
+        );
+        assert_eq!(
+            store.stubs(),
+            "func (m *MemStore) Close(ctx context.Context) error {\n\tpanic(\"TODO(refactor): implement MemStore.Close\")\n}\n\n\
+             cache.go:8: change\n-func (m *MemStore) Get(key string) ([]byte, error)\n+func (m *MemStore) Get(ctx context.Context, key string) ([]byte, error)\n"
+        );
+        assert_eq!(
+            shape("Put(a, b string, f func(int) error) (n int, err error)").as_deref(),
+            Some("(string,string,func(int)error)(int,error)")
+        );
+    }
+}
@@ -0,0 +1,424 @@
+//! Inverse rule packs for downgrades.
+//!
+//! When an upgrade has to be rolled back across many services, the clients
+//! need the opposite migration: from v2 back to v1. Renames, moves,
+//! parameter reorders and one-to-one value mappings can be undone
+//! mechanically, so [`Inversion::of`] derives the inverse pack from the
+//! upgrade's own rules. Rules that lose information (pattern replacements,
+//! removed or added arguments) cannot be inverted and are listed with the
+//! reason, for the author to handle by hand.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::{Inversion, UpgradeConfig};
+//!
+//! let upgrade = UpgradeConfig::from_file("pool-v2.yaml")?;
+//! let inversion = Inversion::of(&upgrade);
+//! for (rule, reason) in &inversion.skipped {
+//!     eprintln!("{} cannot be inverted: {}", rule, reason);
+//! }
+//! inversion.config.to_yaml("pool-v2-revert.yaml")?;
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use std::collections::BTreeMap;
+
+use super::config::{RuleCondition, TransformRule, TransformSpec, UpgradeConfig};
+
+/// The inverse of an upgrade pack.
+#[derive(Debug, Clone)]
+pub struct Inversion {
+    /// The pack migrating back, its rules in reverse order.
+    pub config: UpgradeConfig,
+    /// Rules that could not be inverted, with the reason.
+    pub skipped: Vec<(String, String)>,
+}
+
+impl Inversion {
+    /// Invert every rule of `config` that can be inverted.
+    pub fn of(config: &UpgradeConfig) -> Self {
+        let mut inverse = UpgradeConfig::new(
+            format!("{}-revert", config.name),
+            format!("Revert: {}", config.description),
+        )
+        .with_extensions(config.extensions.clone())
+        .with_exclude_patterns(config.exclude_patterns.clone());
+        inverse.values = config.values.clone();
+        inverse.module = config.module.clone();
+        inverse.from_version = config.to_version.clone();
+        inverse.to_version = config.from_version.clone();
+        inverse.engine = config.engine;
+
+        let mut skipped = Vec::new();
+        for rule in config.transforms.iter().rev() {
+            match rule.inverse() {
+                Ok(rule) => inverse.add_transform(rule),
+                Err(reason) => skipped.push((rule.name(), reason)),
+            }
+        }
+        Self {
+            config: inverse,
+            skipped,
+        }
+    }
+}
+
+impl TransformRule {
+    /// The rule undoing this one, or why there is none. Path and Go version
+    /// conditions are kept; conditions on the matched code are not, as they
+    /// describe the code before the rule ran.
+    pub fn inverse(&self) -> Result<TransformRule, String> {
+        if self.matcher.is_some() || self.rewriter.is_some() {
+            return Err("it uses plugins".to_string());
+        }
+        let spec = self.spec.inverse().ok_or_else(|| match &self.spec {
+            TransformSpec::RewriteCall { .. } => {
+                "it removes or adds arguments, which cannot be restored".to_string()
+            }
+            TransformSpec::MapValues { .. } => {
+                "it maps several values to the same new value".to_string()
+            }
+            TransformSpec::RewriteLiteral { .. } => {
+                "it adds fields or keys positional literals, which cannot be undone".to_string()
+            }
+            TransformSpec::RemoveCall { .. } => {
+                "it handles calls of a removed function".to_string()
+            }
+            _ => "it is not a rename, move or reorder".to_string(),
+        })?;
+        let keep = |condition: &Option<RuleCondition>| -> Result<Option<RuleCondition>, String> {
+            match condition {
+                Some(condition) if !is_location_only(condition) => {
+                    Err("its conditions depend on the code before the rule ran".to_string())
+                }
+                condition => Ok(condition.clone()),
+            }
+        };
+        let mut inverse = TransformRule::new(spec);
+        inverse.id = self.id.as_ref().map(|id| format!("revert-{}", id));
+        inverse.mode = self.mode;
+        inverse.when = keep(&self.when)?;
+        inverse.unless = keep(&self.unless)?;
+        Ok(inverse)
+    }
+}
+
+impl TransformSpec {
+    /// The spec undoing this one, for renames (including field renames in
+    /// literals and tags), moves, reorders, string rewrites and one-to-one
+    /// value mappings.
+    pub fn inverse(&self) -> Option<TransformSpec> {
+        let swap = |old: &String, new: &String| (new.clone(), old.clone());
+        Some(match self {
+            TransformSpec::RenameFunction { old_name, new_name } => {
+                let (old_name, new_name) = swap(old_name, new_name);
+                TransformSpec::RenameFunction { old_name, new_name }
+            }
+            TransformSpec::RenameType { old_name, new_name } => {
+                let (old_name, new_name) = swap(old_name, new_name);
+                TransformSpec::RenameType { old_name, new_name }
+            }
+            TransformSpec::RenameClass { old_name, new_name } => {
+                let (old_name, new_name) = swap(old_name, new_name);
+                TransformSpec::RenameClass { old_name, new_name }
+            }
+            TransformSpec::RenameImport { old_path, new_path } => {
+                let (old_path, new_path) = swap(old_path, new_path);
+                TransformSpec::RenameImport { old_path, new_path }
+            }
+            TransformSpec::RenameModule { old_path, new_path } => {
+                let (old_path, new_path) = swap(old_path, new_path);
+                TransformSpec::RenameModule { old_path, new_path }
+            }
+            TransformSpec::RenameSpecifier { old_path, new_path } => {
+                let (old_path, new_path) = swap(old_path, new_path);
+                TransformSpec::RenameSpecifier { old_path, new_path }
+            }
+            TransformSpec::RenamePath { old_path, new_path } => {
+                let (old_path, new_path) = swap(old_path, new_path);
+                TransformSpec::RenamePath { old_path, new_path }
+            }
+            TransformSpec::RenameExport {
+                module,
+                old_name,
+                new_name,
+            } => {
+                let (old_name, new_name) = swap(old_name, new_name);
+                TransformSpec::RenameExport {
+                    module: module.clone(),
+                    old_name,
+                    new_name,
+                }
+            }
+            TransformSpec::RenameSymbol {
+                package,
+                old_name,
+                new_name,
+            } => {
+                let (old_name, new_name) = swap(old_name, new_name);
+                TransformSpec::RenameSymbol {
+                    package: package.clone(),
+                    old_name,
+                    new_name,
+                }
+            }
+            TransformSpec::RenameMethod {
+                class,
+                old_name,
+                new_name,
+            } => {
+                let (old_name, new_name) = swap(old_name, new_name);
+                TransformSpec::RenameMethod {
+                    class: class.clone(),
+                    old_name,
+                    new_name,
+                }
+            }
+            TransformSpec::RenameVariant {
+                enum_name,
+                old_name,
+                new_name,
+            } => {
+                let (old_name, new_name) = swap(old_name, new_name);
+                TransformSpec::RenameVariant {
+                    enum_name: enum_name.clone(),
+                    old_name,
+                    new_name,
+                }
+            }
+            TransformSpec::RenameGoType {
+                package,
+                old_name,
+                new_name,
+                transitive,
+            } => {
+                let (old_name, new_name) = swap(old_name, new_name);
+                TransformSpec::RenameGoType {
+                    package: package.clone(),
+                    old_name,
+                    new_name,
+                    transitive: *transitive,
+                }
+            }
+            TransformSpec::MoveExport {
+                name,
+                from_module,
+                to_module,
+            } => TransformSpec::MoveExport {
+                name: name.clone(),
+                from_module: to_module.clone(),
+                to_module: from_module.clone(),
+            },
+            TransformSpec::RewriteCall {
+                function,
+                new_name,
+                arity,
+                remove,
+                order,
+                keywords,
+                add,
+                ..
+            } => {
+                if !remove.is_empty() || !add.is_empty() {
+                    return None;
+                }
+                TransformSpec::RewriteCall {
+                    function: new_name.clone().unwrap_or_else(|| function.clone()),
+                    new_name: new_name.as_ref().map(|_| function.clone()),
+                    arity: *arity,
+                    remove: Vec::new(),
+                    order: inverse_order(order),
+                    keywords: keywords
+                        .iter()
+                        .map(|(from, to)| (to.clone(), from.clone()))
+                        .collect(),
+                    add: Vec::new(),
+                    signature: None,
+                }
+            }
+            TransformSpec::MapValues {
+                function,
+                argument,
+                compared,
+                values,
+            } => {
+                let inverse: BTreeMap<String, String> = values
+                    .iter()
+                    .map(|(old, new)| (new.clone(), old.clone()))
+                    .collect();
+                if inverse.len() != values.len() {
+                    return None;
+                }
+                TransformSpec::MapValues {
+                    function: function.clone(),
+                    argument: argument.clone(),
+                    compared: compared.clone(),
+                    values: inverse,
+                }
+            }
+            TransformSpec::RewriteLiteral {
+                type_name,
+                fields,
+                rename,
+                add,
+            } => {
+                if !fields.is_empty() || !add.is_empty() {
+                    return None;
+                }
+                TransformSpec::RewriteLiteral {
+                    type_name: type_name.clone(),
+                    fields: Vec::new(),
+                    rename: rename
+                        .iter()
+                        .map(|(from, to)| (to.clone(), from.clone()))
+                        .collect(),
+                    add: Vec::new(),
+                }
+            }
+            TransformSpec::RewriteString {
+                from,
+                to,
+                prefix,
+                function,
+                argument,
+            } => TransformSpec::RewriteString {
+                from: to.clone(),
+                to: from.clone(),
+                prefix: *prefix,
+                function: function.clone(),
+                argument: argument.clone(),
+            },
+            TransformSpec::RenameKey { key, new_name } => {
+                let (table, old_name) = match key.rsplit_once('.') {
+                    Some((table, old_name)) => (format!("{}.", table), old_name),
+                    None => (String::new(), key.as_str()),
+                };
+                TransformSpec::RenameKey {
+                    key: format!("{}{}", table, new_name),
+                    new_name: old_name.to_string(),
+                }
+            }
+            TransformSpec::RewriteTag {
+                type_name,
+                field,
+                rename,
+                add,
+                remove,
+            } => {
+                if !add.is_empty() || !remove.is_empty() {
+                    return None;
+                }
+                let mut inverse = BTreeMap::new();
+                for (key, names) in rename {
+                    let inverted: BTreeMap<String, String> = names
+                        .iter()
+                        .map(|(from, to)| (to.clone(), from.clone()))
+                        .collect();
+                    if inverted.len() != names.len() {
+                        return None;
+                    }
+                    inverse.insert(key.clone(), inverted);
+                }
+                TransformSpec::RewriteTag {
+                    type_name: type_name.clone(),
+                    field: field.clone(),
+                    rename: inverse,
+                    add: BTreeMap::new(),
+                    remove: Vec::new(),
+                }
+            }
+            TransformSpec::ReplaceLiteral { .. }
+            | TransformSpec::RemoveCall { .. }
+            | TransformSpec::InjectContext { .. }
+            | TransformSpec::ReplacePattern { .. }
+            | TransformSpec::ReplaceStructural { .. } => return None,
+        })
+    }
+}
+
+/// The argument order undoing `order`, which lists original indices in
+/// their new order (arguments not listed follow in their original order).
+fn inverse_order(order: &[usize]) -> Vec<usize> {
+    let Some(count) = order.iter().max().map(|max| max + 1) else {
+        return Vec::new();
+    };
+    let new: Vec<usize> = order
+        .iter()
+        .copied()
+        .chain((0..count).filter(|index| !order.contains(index)))
+        .collect();
+    (0..count)
+        .map(|original| new.iter().position(|&index| index == original).unwrap())
+        .collect()
+}
+
+/// Returns true if `condition` only restricts where a rule applies, not
+/// what the code looks like.
+fn is_location_only(condition: &RuleCondition) -> bool {
+    condition.file_contains.is_none()
+        && condition.matched.is_none()
+        && condition.captures.is_empty()
+        && condition.literal.is_empty()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::Transform;
+    use std::path::Path;
+
+    #[test]
+    fn test_inverse_order() {
+        assert_eq!(inverse_order(&[1, 0]), vec![1, 0]);
+        assert_eq!(inverse_order(&[2, 0, 1]), vec![1, 2, 0]);
+        assert_eq!(inverse_order(&[2]), vec![1, 2, 0]);
+        assert!(inverse_order(&[]).is_empty());
+    }
+
+    #[test]
+    fn test_inversion_round_trip() {
+        let config: UpgradeConfig = serde_json::from_str(
+            r#"{"name": "pool-v2", "description": "Upgrade pool",
+                "extensions": ["py"], "from_version": "1.0", "to_version": "2.0",
+                "transforms": [
+                    {"type": "rename_function", "id": "dial", "old_name": "dial", "new_name": "connect",
+                     "when": {"paths": ["src/**"]}},
+                    {"type": "rewrite_call", "function": "connect", "order": [2, 0, 1],
+                     "keywords": {"timeout": "deadline"}},
+                    {"type": "replace_pattern", "id": "pattern", "pattern": "x", "replacement": "y"},
+                    {"type": "rewrite_call", "id": "ctx", "function": "open",
+                     "add": [{"position": 0, "value": "ctx"}]}
+                ]}"#,
+        )
+        .unwrap();
+        let inversion = Inversion::of(&config);
+        assert_eq!(inversion.config.name, "pool-v2-revert");
+        assert_eq!(inversion.config.from_version.as_deref(), Some("2.0"));
+        assert_eq!(inversion.config.to_version.as_deref(), Some("1.0"));
+        let skipped: Vec<&str> = inversion.skipped.iter().map(|(r, _)| r.as_str()).collect();
+        assert_eq!(skipped, ["ctx", "pattern"]);
+        assert_eq!(inversion.config.transforms.len(), 2);
+        assert_eq!(
+            inversion.config.transforms[1].id.as_deref(),
+            Some("revert-dial")
+        );
+        assert!(inversion.config.transforms[1].when.is_some());
+
+        let apply = |config: &UpgradeConfig, source: &str| {
+            config
+                .transforms
+                .iter()
+                .fold(source.to_string(), |source, rule| {
+                    rule.to_transform()
+                        .unwrap()
+                        .apply(&source, Path::new("src/app.py"))
+                        .unwrap()
+                })
+        };
+        let v1 = "c = dial(host, port, 5, timeout=3)\n";
+        let v2 = apply(&config, v1);
+        assert_eq!(v2, "c = connect(5, host, port, deadline=3)\n");
+        assert_eq!(apply(&inversion.config, &v2), v1);
+    }
+}
@@ -7,8 +7,12 @@
 //!
 //! The analyzer works in three phases:
 //!
-//! 1. **Extraction**: Parse source files at two git refs and extract API signatures
-//! 2. **Detection**: Compare signatures to detect renames, removals, signature changes
+//! 1. **Extraction**: Parse source files at two git refs, or two versions of
+//!    a Go module fetched from the module proxy, and extract API signatures
+//! 2. **Detection**: Compare signatures to detect renames, removals, signature changes.
+//!    A removed and an added API are paired as a rename by the similarity
+//!    of their names, signatures, bodies and doc comments, with a confidence
+//!    score; pairings below 90% are listed for review
 //! 3. **Generation**: Convert detected changes to transforms for dependent projects
 //!
 //! # Example
@@ -31,6 +35,21 @@
 //! # Ok::<(), refactor::error::RefactorError>(())
 //! ```
 //!
+//! A Go library needs no local copy: [`LibraryAnalyzer::from_module`]
+//! downloads both versions by module path (see [`ModuleSource`]).
+//!
+//! Changes left for manual review can be sent to a language model with
+//! [`RuleDrafter`], which drafts candidate rules marked for review.
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::LibraryAnalyzer;
+//!
+//! let config = LibraryAnalyzer::from_module("example.com/mylib")
+//!     .analyze_to_config("v1.4.0", "v2.0.0")?;
+//! config.to_yaml("mylib-v2.yaml")?;
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+//!
 //! # Configuration Files
 //!
 //! You can also save and load upgrade configurations:
@@ -49,22 +68,42 @@
 //! # Ok::<(), refactor::error::RefactorError>(())
 //! ```
 
+mod apidiff;
 mod change;
 mod config;
+mod defaults;
+mod deprecations;
 mod detector;
+mod draft;
 mod extractor;
 mod generator;
+mod implementers;
+mod inverse;
+mod proxy;
 mod signature;
+mod symbols;
 
+pub use apidiff::{ApiDiff, ApiDiffEntry, Compatibility, release_level};
 pub use change::{ApiChange, ApiType, ChangeKind, ChangeMetadata, Severity};
-pub use config::{ConfigBasedUpgrade, TransformSpec, UpgradeConfig};
+pub use config::{
+    ConfigBasedUpgrade, RuleCondition, RuleMode, RuleSeverity, TransformRule, TransformSpec,
+    UpgradeConfig,
+};
+pub use defaults::{DefaultInference, DefaultSource, InferredDefault};
+pub use deprecations::{Deprecation, DeprecationExtractor};
 pub use detector::ChangeDetector;
+pub use draft::{DRAFT_PREFIX, RuleDrafter};
 pub use extractor::{ApiExtractor, FileChange, FileChangeType, FileContent, GitDiffReader};
 pub use generator::{GeneratedUpgrade, Transform, UpgradeGenerator};
+pub use implementers::{Implementer, MethodDecl, find_implementers};
+pub use inverse::Inversion;
+pub use proxy::{ModuleSource, module_path, vendored_files};
 pub use signature::{ApiSignature, Parameter, SourceLocation, TypeInfo, Visibility};
+pub use symbols::{SymbolKind, SymbolMap, SymbolMapping};
 
 use crate::error::{RefactorError, Result};
-use crate::lang::LanguageRegistry;
+use crate::lang::{GoVendor, LanguageRegistry};
+use crate::transform::go::package_name;
 use git2::Repository;
 use std::path::{Path, PathBuf};
 
@@ -107,7 +146,9 @@ impl AnalysisResult {
 /// Analyzes API changes between library versions and generates upgrade codemods.
 ///
 /// The `LibraryAnalyzer` opens a git repository and compares API signatures
-/// between two refs (tags, branches, or commits) to detect changes.
+/// between two refs (tags, branches, or commits) to detect changes. An
+/// analyzer made with [`from_module`](Self::from_module) compares two
+/// versions of a Go module instead.
 ///
 /// # Example
 ///
@@ -127,12 +168,22 @@ impl AnalysisResult {
 /// ```
 pub struct LibraryAnalyzer {
     repo_path: PathBuf,
-    repo: Repository,
+    source: Source,
     extensions: Vec<String>,
     #[allow(dead_code)]
     registry: LanguageRegistry,
     rename_threshold: f64,
     include_private: bool,
+    internal: bool,
+    vendor: Option<GoVendor>,
+}
+
+/// Where the versions of the library come from.
+enum Source {
+    /// Refs of a git repository.
+    Git(Repository),
+    /// Versions of a Go module, from the module proxy.
+    Module(String),
 }
 
 impl LibraryAnalyzer {
@@ -148,7 +199,7 @@ impl LibraryAnalyzer {
 
         Ok(Self {
             repo_path,
-            repo,
+            source: Source::Git(repo),
             extensions: vec![
                 "rs".to_string(),
                 "ts".to_string(),
@@ -158,9 +209,29 @@ impl LibraryAnalyzer {
             registry: LanguageRegistry::new(),
             rename_threshold: 0.7,
             include_private: false,
+            internal: false,
+            vendor: None,
         })
     }
 
+    /// Create an analyzer for the Go module `module` (`example.com/mylib`),
+    /// whose refs are versions downloaded from the module proxy. Only Go
+    /// files are analyzed unless [`for_extensions`](Self::for_extensions)
+    /// says otherwise.
+    pub fn from_module(module: impl Into<String>) -> Self {
+        let module = module.into();
+        Self {
+            repo_path: PathBuf::from(&module),
+            source: Source::Module(module),
+            extensions: vec!["go".to_string()],
+            registry: LanguageRegistry::new(),
+            rename_threshold: 0.7,
+            include_private: false,
+            internal: false,
+            vendor: None,
+        }
+    }
+
     /// Filter analysis to specific file extensions.
     pub fn for_extensions(mut self, extensions: Vec<&str>) -> Self {
         self.extensions = extensions.into_iter().map(String::from).collect();
@@ -182,18 +253,38 @@ impl LibraryAnalyzer {
         self
     }
 
+    /// Analyze the repository's own internal API rather than a library's
+    /// public one. Private APIs are included, and renames become
+    /// `rename_symbol` rules that update the renamed symbol's package and
+    /// its callers within the same module, instead of rules for external
+    /// clients only.
+    pub fn internal(mut self, internal: bool) -> Self {
+        self.internal = internal;
+        self
+    }
+
+    /// Read the versions of the module vendored in `vendor` from there
+    /// instead of the module proxy, for an analyzer made with
+    /// [`from_module`](Self::from_module).
+    pub fn vendor(mut self, vendor: GoVendor) -> Self {
+        self.vendor = Some(vendor);
+        self
+    }
+
     /// Analyze API changes between two git refs.
     ///
     /// The refs can be tags (e.g., "v1.0.0"), branches, or commit hashes.
     pub fn analyze(&self, from_ref: &str, to_ref: &str) -> Result<AnalysisResult> {
-        // Read files at both refs
-        let diff_reader = GitDiffReader::new(&self.repo).filter_extensions(self.extensions.clone());
-
-        let changed_files = diff_reader.changed_files(from_ref, to_ref)?;
-
         // Get all files at each ref
-        let old_files = diff_reader.files_at_ref(from_ref)?;
-        let new_files = diff_reader.files_at_ref(to_ref)?;
+        let old_files = self.files_at(from_ref)?;
+        let new_files = self.files_at(to_ref)?;
+
+        let changed_files = match &self.source {
+            Source::Git(repo) => GitDiffReader::new(repo)
+                .filter_extensions(self.extensions.clone())
+                .changed_files(from_ref, to_ref)?,
+            Source::Module(_) => proxy::changed_files(&old_files, &new_files),
+        };
 
         // Extract API signatures
         let extractor = ApiExtractor::with_registry(LanguageRegistry::new());
@@ -203,7 +294,7 @@ impl LibraryAnalyzer {
         // Detect changes
         let detector = ChangeDetector::new()
             .rename_threshold(self.rename_threshold)
-            .include_private(self.include_private);
+            .include_private(self.include_private || self.internal);
 
         let changes = detector.detect(&old_apis, &new_apis);
 
@@ -215,31 +306,56 @@ impl LibraryAnalyzer {
         })
     }
 
+    /// Classify the API changes between two git refs by the release they
+    /// need: breaking, compatible or patch-level.
+    pub fn api_diff(&self, from_ref: &str, to_ref: &str) -> Result<ApiDiff> {
+        let extractor = ApiExtractor::with_registry(LanguageRegistry::new());
+        let old_apis = extractor.extract_all(&self.files_at(from_ref)?)?;
+        let new_apis = extractor.extract_all(&self.files_at(to_ref)?)?;
+
+        let detector = ChangeDetector::new()
+            .rename_threshold(self.rename_threshold)
+            .include_private(self.include_private || self.internal);
+
+        Ok(ApiDiff::between(
+            from_ref, to_ref, &old_apis, &new_apis, &detector,
+        ))
+    }
+
     /// Analyze and generate an upgrade that can be applied to dependent projects.
     pub fn generate_upgrade(&self, from_ref: &str, to_ref: &str) -> Result<GeneratedUpgrade> {
         let analysis = self.analyze(from_ref, to_ref)?;
 
         let name = format!(
             "{}-{}-to-{}",
-            self.repo_path
-                .file_name()
-                .and_then(|n| n.to_str())
-                .unwrap_or("library"),
+            self.library_name(),
             sanitize_version(from_ref),
             sanitize_version(to_ref)
         );
 
         let description = format!(
             "Upgrade {} from {} to {}",
-            self.repo_path
-                .file_name()
-                .and_then(|n| n.to_str())
-                .unwrap_or("library"),
+            self.library_name(),
             from_ref,
             to_ref
         );
 
-        Ok(UpgradeGenerator::new(name, description)
+        // Library constants for default values of new parameters
+        let new_files = self.files_at(to_ref)?;
+        let generator = self.extensions.iter().fold(
+            UpgradeGenerator::new(name, description),
+            |generator, ext| {
+                let inference = new_files
+                    .iter()
+                    .filter(|f| f.path.extension().and_then(|e| e.to_str()) == Some(ext))
+                    .fold(DefaultInference::new(ext), |inference, file| {
+                        inference.scan(&file.path, &file.content)
+                    });
+                generator.with_defaults(inference)
+            },
+        );
+
+        Ok(generator
             .with_changes(analysis.changes)
             .for_extensions(self.extensions.clone())
             .generate())
@@ -252,9 +368,18 @@ impl LibraryAnalyzer {
         let mut config = UpgradeConfig::new(&upgrade.name, &upgrade.description)
             .with_extensions(self.extensions.clone())
             .with_versions(from_ref, to_ref);
+        if let Source::Module(module) = &self.source {
+            config = config.with_module(module_path(module, to_ref));
+        }
 
-        // Convert transforms to specs
+        // Convert transforms to rules
         for transform in &upgrade.transforms {
+            if self.internal
+                && let Some(spec) = internal_rename(transform, &upgrade.changes)
+            {
+                config.add_transform(spec);
+                continue;
+            }
             let spec = match transform {
                 Transform::FunctionRename { old_name, new_name } => TransformSpec::RenameFunction {
                     old_name: old_name.clone(),
@@ -268,7 +393,9 @@ impl LibraryAnalyzer {
                     old_path: old_path.clone(),
                     new_path: new_path.clone(),
                 },
-                Transform::MethodMove { .. } | Transform::ConstantUpdate { .. } => {
+                Transform::MethodMove { .. }
+                | Transform::ConstantUpdate { .. }
+                | Transform::ArgumentAdd { .. } => {
                     let (pattern, replacement) = transform.to_pattern_replacement();
                     TransformSpec::ReplacePattern {
                         pattern,
@@ -276,19 +403,84 @@ impl LibraryAnalyzer {
                     }
                 }
             };
-            config.add_transform(spec);
+            let rule = match transform {
+                Transform::ArgumentAdd { .. } => {
+                    TransformRule::new(spec).with_message(transform.describe())
+                }
+                _ => TransformRule::new(spec),
+            };
+            config.add_transform(rule);
         }
 
         // Include original changes for reference
         config.changes = upgrade.changes;
+        config.values = upgrade.values;
 
         Ok(config)
     }
 
-    /// Get the repository path.
+    /// Get the repository path, or the module path of an analyzer made with
+    /// [`from_module`](Self::from_module).
     pub fn repo_path(&self) -> &Path {
         &self.repo_path
     }
+
+    /// The files of the library at `version`, with the analyzed extensions.
+    fn files_at(&self, version: &str) -> Result<Vec<FileContent>> {
+        match &self.source {
+            Source::Git(repo) => GitDiffReader::new(repo)
+                .filter_extensions(self.extensions.clone())
+                .files_at_ref(version),
+            Source::Module(module) => {
+                if let Some(vendor) = &self.vendor
+                    && let Some(files) = vendored_files(vendor, module, version, &self.extensions)?
+                {
+                    return Ok(files);
+                }
+                ModuleSource::download(module, version)?.files(&self.extensions)
+            }
+        }
+    }
+
+    /// The name of the library: its directory, or the package name of its
+    /// module.
+    pub fn library_name(&self) -> &str {
+        match &self.source {
+            Source::Git(_) => self
+                .repo_path
+                .file_name()
+                .and_then(|n| n.to_str())
+                .unwrap_or("library"),
+            Source::Module(module) => package_name(module),
+        }
+    }
+}
+
+/// The `rename_symbol` spec for a rename of a symbol in a package
+/// directory, if `transform` is such a rename.
+fn internal_rename(transform: &Transform, changes: &[ApiChange]) -> Option<TransformSpec> {
+    let (old, new) = match transform {
+        Transform::FunctionRename { old_name, new_name }
+        | Transform::TypeRename { old_name, new_name } => (old_name, new_name),
+        _ => return None,
+    };
+    let change = changes.iter().find(|change| match &change.kind {
+        ChangeKind::FunctionRenamed {
+            old_name, new_name, ..
+        }
+        | ChangeKind::TypeRenamed { old_name, new_name } => old_name == old && new_name == new,
+        _ => false,
+    })?;
+    // Symbols at the module root have no package directory to scope to
+    let package = change
+        .file_path
+        .parent()
+        .filter(|dir| !dir.as_os_str().is_empty())?;
+    Some(TransformSpec::RenameSymbol {
+        package: package.to_string_lossy().replace('\\', "/"),
+        old_name: old.clone(),
+        new_name: new.clone(),
+    })
 }
 
 /// Sanitize a version string for use in names.
@@ -307,6 +499,31 @@ mod tests {
         assert_eq!(sanitize_version("feature/test"), "feature-test");
     }
 
+    #[test]
+    fn test_internal_rename() {
+        let changes = vec![ApiChange::new(
+            ChangeKind::FunctionRenamed {
+                old_name: "load".into(),
+                new_name: "fetch".into(),
+                module_path: None,
+            },
+            PathBuf::from("internal/store/store.go"),
+        )];
+        let rename = Transform::FunctionRename {
+            old_name: "load".into(),
+            new_name: "fetch".into(),
+        };
+        let spec = internal_rename(&rename, &changes).unwrap();
+        assert_eq!(
+            spec.describe(),
+            "rename_symbol internal/store: load -> fetch"
+        );
+
+        let mut root = changes.clone();
+        root[0].file_path = PathBuf::from("main.go");
+        assert!(internal_rename(&rename, &root).is_none());
+    }
+
     #[test]
     fn test_analysis_result_filters() {
         let changes = vec![
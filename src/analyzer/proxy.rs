@@ -0,0 +1,310 @@
+//! Library sources fetched from the Go module proxy.
+//!
+//! Analyzing a Go library needs no clone of its repository: each released
+//! version is in the module proxy, by module path and version.
+//! [`ModuleSource`] downloads one with `go mod download`, which honors
+//! `GOPROXY`, `GOPRIVATE` and `GOFLAGS` and reuses the module cache, so a
+//! version already downloaded is not fetched again. A version a client
+//! vendors is read from its `vendor/` directory instead (see
+//! [`vendored_files`]), which is the code the client compiles against.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::ModuleSource;
+//!
+//! let source = ModuleSource::download("example.com/mylib", "v2.0.0")?;
+//! assert_eq!(source.module, "example.com/mylib/v2");
+//! let files = source.files(&["go".to_string()])?;
+//! println!("{} Go files in {}", files.len(), source.dir.display());
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use super::extractor::{FileChange, FileChangeType, FileContent};
+use crate::error::{RefactorError, Result};
+use crate::lang::GoVendor;
+
+/// A version of a Go module, downloaded into the module cache.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ModuleSource {
+    /// Module path, with the major version suffix of the version
+    /// (`example.com/mylib/v2`).
+    pub module: String,
+    /// The version `go mod download` resolved.
+    pub version: String,
+    /// Directory of the module's source in the module cache.
+    pub dir: PathBuf,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct Download {
+    version: Option<String>,
+    dir: Option<PathBuf>,
+    error: Option<String>,
+}
+
+impl ModuleSource {
+    /// Download `version` (a version or a query such as `latest`) of
+    /// `module`, any major version of which may be given.
+    pub fn download(module: &str, version: &str) -> Result<Self> {
+        Self::download_in(&std::env::temp_dir(), module, version)
+    }
+
+    /// Download `version` of `module` from the directory `dir`, so the
+    /// go.mod of the project there applies.
+    pub fn download_in(dir: &Path, module: &str, version: &str) -> Result<Self> {
+        let module = module_path(module, version);
+        let spec = format!("{}@{}", module, version);
+        let output = Command::new("go")
+            .args(["mod", "download", "-json", &spec])
+            .current_dir(dir)
+            .output()
+            .map_err(|e| RefactorError::Registry {
+                message: format!("could not run go mod download: {}", e),
+            })?;
+        let download: Download =
+            serde_json::from_slice(&output.stdout).map_err(|_| RefactorError::Registry {
+                message: format!(
+                    "go mod download {} failed: {}",
+                    spec,
+                    String::from_utf8_lossy(&output.stderr).trim()
+                ),
+            })?;
+        match (download.version, download.dir) {
+            (Some(version), Some(dir)) => Ok(Self {
+                module,
+                version,
+                dir,
+            }),
+            _ => Err(RefactorError::Registry {
+                message: format!(
+                    "go mod download {} failed: {}",
+                    spec,
+                    download.error.unwrap_or_default()
+                ),
+            }),
+        }
+    }
+
+    /// The files of the module with one of `extensions`, by path relative
+    /// to the module root.
+    pub fn files(&self, extensions: &[String]) -> Result<Vec<FileContent>> {
+        let mut files = Vec::new();
+        collect(&self.dir, &self.dir, extensions, &mut files)?;
+        files.sort_by(|a, b| a.path.cmp(&b.path));
+        Ok(files)
+    }
+}
+
+/// The files with one of `extensions` of `version` of `module`, by path
+/// relative to the module root, if that is the version vendored in
+/// `vendor`. Only the packages the client imports are vendored; those of
+/// modules nested in the module's path are not part of it.
+pub fn vendored_files(
+    vendor: &GoVendor,
+    module: &str,
+    version: &str,
+    extensions: &[String],
+) -> Result<Option<Vec<FileContent>>> {
+    let module = module_path(module, version);
+    let dir = match vendor.version(&module) {
+        Some(vendored) if vendored == version => vendor.package_dir(&module),
+        _ => None,
+    };
+    let Some(dir) = dir else {
+        return Ok(None);
+    };
+    let nested: Vec<PathBuf> = vendor
+        .modules()
+        .filter_map(|(other, _)| other.strip_prefix(&module)?.strip_prefix('/'))
+        .map(PathBuf::from)
+        .collect();
+    let mut files = Vec::new();
+    collect(&dir, &dir, extensions, &mut files)?;
+    files.retain(|file| !nested.iter().any(|prefix| file.path.starts_with(prefix)));
+    files.sort_by(|a, b| a.path.cmp(&b.path));
+    Ok(Some(files))
+}
+
+fn collect(
+    root: &Path,
+    dir: &Path,
+    extensions: &[String],
+    files: &mut Vec<FileContent>,
+) -> Result<()> {
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.is_dir() {
+            collect(root, &path, extensions, files)?;
+            continue;
+        }
+        let selected = path
+            .extension()
+            .and_then(|ext| ext.to_str())
+            .is_some_and(|ext| extensions.iter().any(|e| e.eq_ignore_ascii_case(ext)));
+        if !selected {
+            continue;
+        }
+        if let Ok(content) = fs::read_to_string(&path) {
+            files.push(FileContent {
+                path: path.strip_prefix(root).unwrap_or(&path).to_path_buf(),
+                content,
+            });
+        }
+    }
+    Ok(())
+}
+
+/// The path of `module` at `version`: Go requires the `/vN` suffix from
+/// major version 2 on, and none before. Version queries leave the path
+/// alone.
+pub fn module_path(module: &str, version: &str) -> String {
+    let Some(major) = version
+        .strip_prefix('v')
+        .and_then(|v| v.split(['.', '-', '+']).next())
+        .and_then(|major| major.parse::<u64>().ok())
+    else {
+        return module.to_string();
+    };
+    if module.starts_with("gopkg.in/") {
+        return module.to_string();
+    }
+    let base = match module.rsplit_once("/v") {
+        Some((base, suffix))
+            if !suffix.is_empty() && suffix.bytes().all(|b| b.is_ascii_digit()) =>
+        {
+            base
+        }
+        _ => module,
+    };
+    if major >= 2 {
+        format!("{}/v{}", base, major)
+    } else {
+        base.to_string()
+    }
+}
+
+/// The changes between the files of two versions, by path.
+pub(crate) fn changed_files(old: &[FileContent], new: &[FileContent]) -> Vec<FileChange> {
+    let mut paths: BTreeMap<&Path, (Option<&str>, Option<&str>)> = BTreeMap::new();
+    for file in old {
+        paths.entry(&file.path).or_default().0 = Some(&file.content);
+    }
+    for file in new {
+        paths.entry(&file.path).or_default().1 = Some(&file.content);
+    }
+    paths
+        .into_iter()
+        .filter_map(|(path, contents)| {
+            let change_type = match contents {
+                (Some(old), Some(new)) if old == new => return None,
+                (Some(_), Some(_)) => FileChangeType::Modified,
+                (Some(_), None) => FileChangeType::Deleted,
+                (None, _) => FileChangeType::Added,
+            };
+            let (old, new) = contents;
+            Some(FileChange {
+                change_type,
+                old_path: old.map(|_| path.to_path_buf()),
+                new_path: new.map(|_| path.to_path_buf()),
+                old_content: old.map(str::to_string),
+                new_content: new.map(str::to_string),
+            })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_module_path_and_changes() {
+        assert_eq!(
+            module_path("example.com/mylib", "v2.0.0"),
+            "example.com/mylib/v2"
+        );
+        assert_eq!(
+            module_path("example.com/mylib/v2", "v1.4.0"),
+            "example.com/mylib"
+        );
+        assert_eq!(
+            module_path("example.com/mylib/v2", "v3.1.0"),
+            "example.com/mylib/v3"
+        );
+        assert_eq!(
+            module_path("example.com/mylib/v2", "latest"),
+            "example.com/mylib/v2"
+        );
+        assert_eq!(
+            module_path("gopkg.in/yaml.v3", "v3.0.1"),
+            "gopkg.in/yaml.v3"
+        );
+
+        let file = |path: &str, content: &str| FileContent {
+            path: PathBuf::from(path),
+            content: content.to_string(),
+        };
+        let old = [
+            file("a.go", "package a"),
+            file("b.go", "package a"),
+            file("c.go", "x"),
+        ];
+        let new = [
+            file("a.go", "package a"),
+            file("b.go", "package b"),
+            file("d.go", "y"),
+        ];
+        let changes: Vec<(FileChangeType, PathBuf)> = changed_files(&old, &new)
+            .into_iter()
+            .map(|change| (change.change_type, change.path().to_path_buf()))
+            .collect();
+        assert_eq!(
+            changes,
+            [
+                (FileChangeType::Modified, PathBuf::from("b.go")),
+                (FileChangeType::Deleted, PathBuf::from("c.go")),
+                (FileChangeType::Added, PathBuf::from("d.go")),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_vendored_files() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let vendor = dir.path().join("vendor");
+        for (path, content) in [
+            ("example.com/mylib/v2/client.go", "package mylib"),
+            ("example.com/mylib/v2/store/store.go", "package store"),
+            ("example.com/mylib/v2/contrib/x.go", "package contrib"),
+        ] {
+            let path = vendor.join(path);
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(path, content).unwrap();
+        }
+        let vendor = GoVendor::new(
+            vendor,
+            "# example.com/mylib/v2 v2.1.0\n## explicit\nexample.com/mylib/v2\n# example.com/mylib/v2/contrib v0.3.0\n",
+        );
+
+        let go = ["go".to_string()];
+        let files = vendored_files(&vendor, "example.com/mylib", "v2.1.0", &go)
+            .unwrap()
+            .unwrap();
+        let paths: Vec<&Path> = files.iter().map(|file| file.path.as_path()).collect();
+        assert_eq!(paths, [Path::new("client.go"), Path::new("store/store.go")]);
+        // Other versions come from the proxy
+        assert!(
+            vendored_files(&vendor, "example.com/mylib", "v2.2.0", &go)
+                .unwrap()
+                .is_none()
+        );
+    }
+}
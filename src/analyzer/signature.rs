@@ -30,6 +30,20 @@ pub struct ApiSignature {
     /// Whether this is exported/public API.
     #[serde(default)]
     pub is_exported: bool,
+    /// Method signatures of an interface, as declared
+    /// (`Get(ctx context.Context, key string) ([]byte, error)`).
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub methods: Vec<String>,
+    /// Interfaces an interface embeds, as declared (`io.Closer`).
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub embeds: Vec<String>,
+    /// Doc comment, without comment markers. Not serialized; used to pair
+    /// renamed APIs.
+    #[serde(skip)]
+    pub doc: Option<String>,
+    /// Source of the body. Not serialized; used to pair renamed APIs.
+    #[serde(skip)]
+    pub body: Option<String>,
 }
 
 impl ApiSignature {
@@ -45,6 +59,10 @@ impl ApiSignature {
             location,
             module_path: None,
             is_exported: true,
+            methods: Vec::new(),
+            embeds: Vec::new(),
+            doc: None,
+            body: None,
         }
     }
 
@@ -60,6 +78,10 @@ impl ApiSignature {
             location,
             module_path: None,
             is_exported: true,
+            methods: Vec::new(),
+            embeds: Vec::new(),
+            doc: None,
+            body: None,
         }
     }
 
@@ -75,6 +97,10 @@ impl ApiSignature {
             location,
             module_path: None,
             is_exported: true,
+            methods: Vec::new(),
+            embeds: Vec::new(),
+            doc: None,
+            body: None,
         }
     }
 
@@ -84,6 +110,12 @@ impl ApiSignature {
         self
     }
 
+    /// Set generic type parameters.
+    pub fn with_generic_params(mut self, generic_params: Vec<String>) -> Self {
+        self.generic_params = generic_params;
+        self
+    }
+
     /// Set return type.
     pub fn with_return_type(mut self, return_type: TypeInfo) -> Self {
         self.return_type = Some(return_type);
@@ -102,6 +134,30 @@ impl ApiSignature {
         self
     }
 
+    /// Set the method signatures of an interface.
+    pub fn with_methods(mut self, methods: Vec<String>) -> Self {
+        self.methods = methods;
+        self
+    }
+
+    /// Set the interfaces an interface embeds.
+    pub fn with_embeds(mut self, embeds: Vec<String>) -> Self {
+        self.embeds = embeds;
+        self
+    }
+
+    /// Set the doc comment.
+    pub fn with_doc(mut self, doc: impl Into<String>) -> Self {
+        self.doc = Some(doc.into());
+        self
+    }
+
+    /// Set the source of the body.
+    pub fn with_body(mut self, body: impl Into<String>) -> Self {
+        self.body = Some(body.into());
+        self
+    }
+
     /// Set exported flag.
     pub fn exported(mut self, is_exported: bool) -> Self {
         self.is_exported = is_exported;
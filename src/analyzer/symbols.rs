@@ -0,0 +1,434 @@
+//! The old-to-new symbol mapping of an upgrade, for other tools.
+
+use serde::{Deserialize, Serialize};
+use std::fmt::Write;
+
+use super::change::{ApiChange, ChangeKind};
+use super::config::{TransformSpec, UpgradeConfig};
+use crate::error::Result;
+
+/// Kind of a renamed symbol.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SymbolKind {
+    Function,
+    Method,
+    Type,
+    Constant,
+    Variant,
+    Module,
+    /// A name whose kind the rule does not say.
+    Symbol,
+}
+
+impl SymbolKind {
+    /// Get the kind's name, as it is serialized.
+    pub fn name(&self) -> &'static str {
+        match self {
+            SymbolKind::Function => "function",
+            SymbolKind::Method => "method",
+            SymbolKind::Type => "type",
+            SymbolKind::Constant => "constant",
+            SymbolKind::Variant => "variant",
+            SymbolKind::Module => "module",
+            SymbolKind::Symbol => "symbol",
+        }
+    }
+
+    /// Kind of a name from its spelling: `UPPER_CASE` names are constants.
+    fn of_name(name: &str, otherwise: SymbolKind) -> SymbolKind {
+        let last = name.rsplit(['.', ':']).next().unwrap_or(name);
+        let upper = last.chars().any(|c| c.is_ascii_uppercase())
+            && last
+                .chars()
+                .all(|c| c.is_ascii_uppercase() || c.is_ascii_digit() || c == '_');
+        if upper {
+            SymbolKind::Constant
+        } else {
+            otherwise
+        }
+    }
+}
+
+/// One old name and the name that replaces it.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SymbolMapping {
+    /// Kind of symbol.
+    pub kind: SymbolKind,
+    /// Old name, qualified as the upgrade names it.
+    pub old: String,
+    /// New name.
+    pub new: String,
+    /// Module, package, class or enum the old name belongs to.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub scope: Option<String>,
+    /// Where the symbol lives now, if it moved out of `scope`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub new_scope: Option<String>,
+}
+
+impl SymbolMapping {
+    /// Map `old` to `new`.
+    pub fn new(kind: SymbolKind, old: impl Into<String>, new: impl Into<String>) -> Self {
+        Self {
+            kind,
+            old: old.into(),
+            new: new.into(),
+            scope: None,
+            new_scope: None,
+        }
+    }
+
+    /// Set the scope of the old name.
+    pub fn scope(mut self, scope: impl Into<String>) -> Self {
+        self.scope = Some(scope.into());
+        self
+    }
+
+    /// Set the scope the symbol moved to.
+    pub fn new_scope(mut self, scope: impl Into<String>) -> Self {
+        self.new_scope = Some(scope.into());
+        self
+    }
+
+    /// Scope of the new name.
+    fn target_scope(&self) -> Option<&str> {
+        self.new_scope.as_deref().or(self.scope.as_deref())
+    }
+}
+
+/// The final old-to-new mapping of every symbol an upgrade renames or moves.
+///
+/// Renames are chained: if one rule renames `Dial` to `Connect` and a later
+/// one `Connect` to `Open`, the map holds `Dial -> Open`. The map can be
+/// exported as JSON or CSV for doc generators, search indexes and other
+/// tools that redirect references.
+///
+/// # Example
+///
+/// ```rust,no_run
+/// use refactor::analyzer::{SymbolMap, UpgradeConfig};
+///
+/// let config = UpgradeConfig::from_file("upgrade.yaml")?;
+/// let map = SymbolMap::from_config(&config);
+/// std::fs::write("symbols.json", map.to_json()?)?;
+/// # Ok::<(), refactor::error::RefactorError>(())
+/// ```
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SymbolMap {
+    /// The mappings, in the order their rules appear.
+    pub symbols: Vec<SymbolMapping>,
+}
+
+impl SymbolMap {
+    /// Create an empty map.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// The mapping of an upgrade config's rules, in order.
+    pub fn from_config(config: &UpgradeConfig) -> Self {
+        let mut map = Self::new();
+        for rule in &config.transforms {
+            if let Some(mapping) = mapping_of_spec(&rule.spec) {
+                map.insert(mapping);
+            }
+        }
+        map
+    }
+
+    /// The mapping of detected API changes. Only renames and moves are
+    /// included.
+    pub fn from_changes(changes: &[ApiChange]) -> Self {
+        let mut map = Self::new();
+        for change in changes {
+            if let Some(mapping) = mapping_of_change(&change.kind) {
+                map.insert(mapping);
+            }
+        }
+        map
+    }
+
+    /// Add a mapping, chaining it onto an earlier mapping whose new name it
+    /// renames again. A chain that ends where it started is dropped.
+    pub fn insert(&mut self, mapping: SymbolMapping) {
+        let earlier = self.symbols.iter().position(|existing| {
+            existing.new == mapping.old && existing.target_scope() == mapping.scope.as_deref()
+        });
+        let Some(index) = earlier else {
+            let changed =
+                mapping.old != mapping.new || mapping.target_scope() != mapping.scope.as_deref();
+            if changed && !self.symbols.contains(&mapping) {
+                self.symbols.push(mapping);
+            }
+            return;
+        };
+
+        let existing = &mut self.symbols[index];
+        existing.new = mapping.new.clone();
+        existing.new_scope = mapping
+            .target_scope()
+            .filter(|scope| Some(*scope) != existing.scope.as_deref())
+            .map(str::to_string);
+        if existing.old == existing.new && existing.new_scope.is_none() {
+            self.symbols.remove(index);
+        }
+    }
+
+    /// The new name of `old`, in any scope.
+    pub fn get(&self, old: &str) -> Option<&str> {
+        self.symbols
+            .iter()
+            .find(|mapping| mapping.old == old)
+            .map(|mapping| mapping.new.as_str())
+    }
+
+    /// Returns true if the map is empty.
+    pub fn is_empty(&self) -> bool {
+        self.symbols.is_empty()
+    }
+
+    /// Number of mappings.
+    pub fn len(&self) -> usize {
+        self.symbols.len()
+    }
+
+    /// Serialize as JSON.
+    pub fn to_json(&self) -> Result<String> {
+        Ok(serde_json::to_string_pretty(self)?)
+    }
+
+    /// Serialize as CSV with a header row.
+    pub fn to_csv(&self) -> String {
+        let mut out = String::from("kind,old,new,scope,new_scope\n");
+        for mapping in &self.symbols {
+            writeln!(
+                out,
+                "{},{},{},{},{}",
+                mapping.kind.name(),
+                csv_field(&mapping.old),
+                csv_field(&mapping.new),
+                csv_field(mapping.scope.as_deref().unwrap_or("")),
+                csv_field(mapping.new_scope.as_deref().unwrap_or(""))
+            )
+            .unwrap();
+        }
+        out
+    }
+}
+
+fn csv_field(value: &str) -> String {
+    if value.contains([',', '"', '\n']) {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+/// Returns true if `text` is a plain or qualified identifier.
+fn is_name(text: &str) -> bool {
+    !text.is_empty()
+        && text
+            .split(['.', ':'])
+            .filter(|part| !part.is_empty())
+            .all(|part| {
+                part.chars().all(|c| c.is_alphanumeric() || c == '_')
+                    && !part.starts_with(|c: char| c.is_ascii_digit())
+            })
+}
+
+fn mapping_of_spec(spec: &TransformSpec) -> Option<SymbolMapping> {
+    let mapping = match spec {
+        // Literal replacements of one name by another, such as constants
+        TransformSpec::ReplaceLiteral { from, to } if is_name(from) && is_name(to) => {
+            SymbolMapping::new(SymbolKind::of_name(from, SymbolKind::Symbol), from, to)
+        }
+        TransformSpec::RenameFunction { old_name, new_name } => {
+            SymbolMapping::new(SymbolKind::Function, old_name, new_name)
+        }
+        TransformSpec::RenameType { old_name, new_name }
+        | TransformSpec::RenameClass { old_name, new_name }
+        | TransformSpec::RenameGoType {
+            old_name, new_name, ..
+        } => SymbolMapping::new(
+            SymbolKind::of_name(old_name, SymbolKind::Type),
+            old_name,
+            new_name,
+        ),
+        TransformSpec::RenameImport { old_path, new_path }
+        | TransformSpec::RenameModule { old_path, new_path }
+        | TransformSpec::RenameSpecifier { old_path, new_path } => {
+            SymbolMapping::new(SymbolKind::Module, old_path, new_path)
+        }
+        TransformSpec::RenamePath { old_path, new_path } => SymbolMapping::new(
+            SymbolKind::of_name(old_path, SymbolKind::Symbol),
+            old_path,
+            new_path,
+        ),
+        TransformSpec::RewriteCall {
+            function,
+            new_name: Some(new_name),
+            ..
+        } => SymbolMapping::new(SymbolKind::Function, function, new_name),
+        TransformSpec::RenameExport {
+            module,
+            old_name,
+            new_name,
+        } => SymbolMapping::new(
+            SymbolKind::of_name(old_name, SymbolKind::Symbol),
+            old_name,
+            new_name,
+        )
+        .scope(module),
+        TransformSpec::MoveExport {
+            name,
+            from_module,
+            to_module,
+        } => SymbolMapping::new(SymbolKind::of_name(name, SymbolKind::Symbol), name, name)
+            .scope(from_module)
+            .new_scope(to_module),
+        TransformSpec::RenameSymbol {
+            package,
+            old_name,
+            new_name,
+        } => SymbolMapping::new(
+            SymbolKind::of_name(old_name, SymbolKind::Symbol),
+            old_name,
+            new_name,
+        )
+        .scope(package),
+        TransformSpec::RenameMethod {
+            class,
+            old_name,
+            new_name,
+        } => SymbolMapping::new(SymbolKind::Method, old_name, new_name).scope(class),
+        TransformSpec::RenameVariant {
+            enum_name,
+            old_name,
+            new_name,
+        } => SymbolMapping::new(SymbolKind::Variant, old_name, new_name).scope(enum_name),
+        _ => return None,
+    };
+    Some(mapping)
+}
+
+fn mapping_of_change(kind: &ChangeKind) -> Option<SymbolMapping> {
+    let mapping = match kind {
+        ChangeKind::FunctionRenamed {
+            old_name,
+            new_name,
+            module_path,
+        } => {
+            let mapping = SymbolMapping::new(
+                SymbolKind::of_name(old_name, SymbolKind::Function),
+                old_name,
+                new_name,
+            );
+            match module_path {
+                Some(module) => mapping.scope(module),
+                None => mapping,
+            }
+        }
+        ChangeKind::TypeRenamed { old_name, new_name } => SymbolMapping::new(
+            SymbolKind::of_name(old_name, SymbolKind::Type),
+            old_name,
+            new_name,
+        ),
+        ChangeKind::ImportRenamed { old_path, new_path } => {
+            SymbolMapping::new(SymbolKind::Module, old_path, new_path)
+        }
+        ChangeKind::MethodMoved {
+            method_name,
+            old_location,
+            new_location,
+        } => SymbolMapping::new(SymbolKind::Method, method_name, method_name)
+            .scope(old_location)
+            .new_scope(new_location),
+        _ => return None,
+    };
+    Some(mapping)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    #[test]
+    fn test_from_config_chains_renames() {
+        let mut config = UpgradeConfig::new("v3", "v3");
+        config.add_transform(TransformSpec::RenameFunction {
+            old_name: "Dial".to_string(),
+            new_name: "Connect".to_string(),
+        });
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "pool.MAX_CONNS".to_string(),
+            to: "pool.MAX_CONNECTIONS".to_string(),
+        });
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "Dial(a)".to_string(),
+            to: "Dial(a, nil)".to_string(),
+        });
+        config.add_transform(TransformSpec::RenameFunction {
+            old_name: "Connect".to_string(),
+            new_name: "Open".to_string(),
+        });
+        config.add_transform(TransformSpec::MoveExport {
+            name: "retry".to_string(),
+            from_module: "@acme/sdk".to_string(),
+            to_module: "@acme/sdk/retry".to_string(),
+        });
+
+        let map = SymbolMap::from_config(&config);
+        assert_eq!(map.len(), 3);
+        assert_eq!(map.get("Dial"), Some("Open"));
+        assert_eq!(map.symbols[1].kind, SymbolKind::Constant);
+        assert_eq!(map.symbols[2].new_scope.as_deref(), Some("@acme/sdk/retry"));
+
+        assert_eq!(
+            map.to_csv(),
+            "kind,old,new,scope,new_scope\nfunction,Dial,Open,,\nconstant,pool.MAX_CONNS,pool.MAX_CONNECTIONS,,\nsymbol,retry,retry,@acme/sdk,@acme/sdk/retry\n"
+        );
+        let parsed: SymbolMap = serde_json::from_str(&map.to_json().unwrap()).unwrap();
+        assert_eq!(parsed, map);
+    }
+
+    #[test]
+    fn test_renamed_back_is_dropped() {
+        let mut map = SymbolMap::new();
+        map.insert(SymbolMapping::new(SymbolKind::Type, "Conn", "Connection"));
+        map.insert(SymbolMapping::new(SymbolKind::Type, "Connection", "Conn"));
+        assert!(map.is_empty());
+    }
+
+    #[test]
+    fn test_from_changes() {
+        let changes = vec![
+            ApiChange::new(
+                ChangeKind::MethodMoved {
+                    method_name: "close".to_string(),
+                    old_location: "Pool".to_string(),
+                    new_location: "Conn".to_string(),
+                },
+                PathBuf::from("pool.py"),
+            ),
+            ApiChange::new(
+                ChangeKind::ConstantChanged {
+                    name: "TIMEOUT".to_string(),
+                    old_value: Some("5".to_string()),
+                    new_value: Some("10".to_string()),
+                },
+                PathBuf::from("pool.py"),
+            ),
+        ];
+        let map = SymbolMap::from_changes(&changes);
+        assert_eq!(
+            map.symbols,
+            vec![
+                SymbolMapping::new(SymbolKind::Method, "close", "close")
+                    .scope("Pool")
+                    .new_scope("Conn")
+            ]
+        );
+    }
+}
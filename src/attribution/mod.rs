@@ -0,0 +1,355 @@
+//! Attribution of post-migration changes to the engine or to humans.
+//!
+//! When an upgrade is applied, an [`ApplyPlan`] records a fingerprint of
+//! every line the engine produced and which of those lines it changed. Later
+//! (typically when the migration PR is reviewed) the plan is compared with
+//! the files on disk: lines that still match the engine's output are
+//! attributed to the engine, and anything added, changed or removed since is
+//! attributed to a human. Reviews and audits can then focus on the
+//! human-modified hunks.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::attribution::ApplyPlan;
+//!
+//! let plan = ApplyPlan::load("migration-plan.json")?;
+//! for file in plan.attribute("./project")?.files {
+//!     for hunk in file.human_hunks() {
+//!         println!("{}:{}", file.path.display(), hunk);
+//!     }
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use similar::{ChangeTag, TextDiff};
+use std::collections::BTreeSet;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::diff::fnv1a;
+use crate::error::Result;
+use crate::runner::RunReport;
+use crate::semantics::SemanticsVersion;
+
+/// Who produced a hunk of the final code.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Origin {
+    /// Written by the rewrite engine and left untouched since.
+    Engine,
+    /// Added, changed or removed by a human after the engine ran.
+    Human,
+}
+
+impl fmt::Display for Origin {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Origin::Engine => write!(f, "engine"),
+            Origin::Human => write!(f, "human"),
+        }
+    }
+}
+
+/// Engine fingerprints for one rewritten file.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PlanFile {
+    /// Path relative to the project root.
+    pub path: PathBuf,
+    /// Fingerprint of each line of the engine's output.
+    pub lines: Vec<String>,
+    /// 0-based indices of output lines the engine changed or inserted.
+    pub changed: BTreeSet<usize>,
+}
+
+impl PlanFile {
+    /// Fingerprint the engine's rewrite of a file from `original` to `transformed`.
+    pub fn new(path: impl Into<PathBuf>, original: &str, transformed: &str) -> Self {
+        let changed = TextDiff::from_lines(original, transformed)
+            .iter_all_changes()
+            .filter(|c| c.tag() == ChangeTag::Insert)
+            .filter_map(|c| c.new_index())
+            .collect();
+
+        Self {
+            path: path.into(),
+            lines: fingerprint_lines(transformed),
+            changed,
+        }
+    }
+
+    /// Attribute the current contents of the file.
+    pub fn attribute(&self, current: &str) -> FileAttribution {
+        let engine = as_text(&self.lines);
+        let current = as_text(&fingerprint_lines(current));
+        let diff = TextDiff::from_lines(&engine, &current);
+
+        let mut hunks: Vec<Hunk> = Vec::new();
+        let mut line = 1;
+        for change in diff.iter_all_changes() {
+            let (origin, removed) = match change.tag() {
+                ChangeTag::Equal
+                    if change
+                        .old_index()
+                        .is_some_and(|i| self.changed.contains(&i)) =>
+                {
+                    (Origin::Engine, false)
+                }
+                ChangeTag::Equal => {
+                    line += 1;
+                    continue;
+                }
+                ChangeTag::Insert => (Origin::Human, false),
+                ChangeTag::Delete => (Origin::Human, true),
+            };
+
+            match hunks.last_mut() {
+                Some(last) if last.origin == origin && last.end + 1 == line => {
+                    if removed {
+                        last.removed += 1;
+                    } else {
+                        last.end = line;
+                    }
+                }
+                _ => hunks.push(Hunk {
+                    origin,
+                    start: line,
+                    end: if removed { line - 1 } else { line },
+                    removed: usize::from(removed),
+                }),
+            }
+            if !removed {
+                line += 1;
+            }
+        }
+
+        FileAttribution {
+            path: self.path.clone(),
+            hunks,
+        }
+    }
+}
+
+/// The fingerprints recorded when an upgrade was applied.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ApplyPlan {
+    /// Name of the upgrade that was applied.
+    pub upgrade: String,
+    /// Engine semantics the changes were made with.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub semantics: Option<SemanticsVersion>,
+    /// Rewritten files.
+    pub files: Vec<PlanFile>,
+}
+
+impl ApplyPlan {
+    /// Record the engine's changes from a run against `root`.
+    pub fn from_report(upgrade: impl Into<String>, root: &Path, report: &RunReport) -> Self {
+        Self {
+            upgrade: upgrade.into(),
+            semantics: Some(report.semantics),
+            files: report
+                .changes
+                .iter()
+                .map(|change| {
+                    let path = change.path.strip_prefix(root).unwrap_or(&change.path);
+                    PlanFile::new(path, &change.original, &change.transformed)
+                })
+                .collect(),
+        }
+    }
+
+    /// Load a plan from a JSON file.
+    pub fn load(path: impl AsRef<Path>) -> Result<Self> {
+        Ok(serde_json::from_str(&fs::read_to_string(path)?)?)
+    }
+
+    /// Save the plan as JSON.
+    pub fn save(&self, path: impl AsRef<Path>) -> Result<()> {
+        let path = path.as_ref();
+        if let Some(parent) = path.parent().filter(|p| !p.as_os_str().is_empty()) {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(path, serde_json::to_string_pretty(self)?)?;
+        Ok(())
+    }
+
+    /// Attribute the current files under `root`. Files deleted since the
+    /// plan was recorded are attributed entirely to humans.
+    pub fn attribute(&self, root: impl AsRef<Path>) -> Result<AttributionReport> {
+        let root = root.as_ref();
+        let files = self
+            .files
+            .iter()
+            .map(|file| {
+                let current = match fs::read_to_string(root.join(&file.path)) {
+                    Ok(text) => text,
+                    Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+                    Err(e) => return Err(e.into()),
+                };
+                Ok(file.attribute(&current))
+            })
+            .collect::<Result<_>>()?;
+        Ok(AttributionReport { files })
+    }
+}
+
+/// A run of lines in the current file with a single origin.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Hunk {
+    /// Who produced these lines.
+    pub origin: Origin,
+    /// First 1-based line in the current file.
+    pub start: usize,
+    /// Last 1-based line (`start - 1` for a pure removal).
+    pub end: usize,
+    /// Number of engine output lines removed here.
+    pub removed: usize,
+}
+
+impl Hunk {
+    /// Number of current lines in the hunk.
+    pub fn len(&self) -> usize {
+        self.end + 1 - self.start
+    }
+
+    /// Returns true if the hunk only removes lines.
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+}
+
+impl fmt::Display for Hunk {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.end <= self.start {
+            write!(f, "{}", self.start)?;
+        } else {
+            write!(f, "{}-{}", self.start, self.end)?;
+        }
+        write!(f, " {}", self.origin)?;
+        if self.removed > 0 {
+            write!(f, " ({} line(s) removed)", self.removed)?;
+        }
+        Ok(())
+    }
+}
+
+/// Attributed hunks for one file.
+#[derive(Debug, Clone, Serialize)]
+pub struct FileAttribution {
+    /// Path relative to the project root.
+    pub path: PathBuf,
+    /// Hunks in file order.
+    pub hunks: Vec<Hunk>,
+}
+
+impl FileAttribution {
+    /// Hunks changed by a human after the engine ran.
+    pub fn human_hunks(&self) -> impl Iterator<Item = &Hunk> {
+        self.hunks.iter().filter(|h| h.origin == Origin::Human)
+    }
+
+    /// Returns true if a human changed this file after the engine ran.
+    pub fn has_human_edits(&self) -> bool {
+        self.human_hunks().next().is_some()
+    }
+}
+
+/// Attribution for every file in a plan.
+#[derive(Debug, Clone, Serialize)]
+pub struct AttributionReport {
+    /// Per-file attribution, in plan order.
+    pub files: Vec<FileAttribution>,
+}
+
+impl AttributionReport {
+    /// Files a human changed after the engine ran.
+    pub fn human_edited(&self) -> impl Iterator<Item = &FileAttribution> {
+        self.files.iter().filter(|f| f.has_human_edits())
+    }
+}
+
+impl fmt::Display for AttributionReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for file in &self.files {
+            for hunk in &file.hunks {
+                writeln!(f, "{}:{}", file.path.display(), hunk)?;
+            }
+        }
+        write!(
+            f,
+            "{} of {} file(s) edited by hand after the engine ran",
+            self.human_edited().count(),
+            self.files.len()
+        )
+    }
+}
+
+/// One fingerprint per line, so fingerprints can be diffed like text.
+fn as_text(fingerprints: &[String]) -> String {
+    fingerprints.iter().map(|f| format!("{}\n", f)).collect()
+}
+
+fn fingerprint_lines(text: &str) -> Vec<String> {
+    text.lines()
+        .map(|line| format!("{:016x}", fnv1a(line.as_bytes())))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const ORIGINAL: &str = "package main\n\nfunc main() {\n\tclient.Connect(addr)\n\trun()\n}\n";
+    const ENGINE: &str =
+        "package main\n\nfunc main() {\n\tclient.Connect(addr, 30*time.Second)\n\trun()\n}\n";
+
+    #[test]
+    fn test_untouched_engine_output() {
+        let plan = PlanFile::new("main.go", ORIGINAL, ENGINE);
+        let attribution = plan.attribute(ENGINE);
+
+        assert!(!attribution.has_human_edits());
+        assert_eq!(attribution.hunks.len(), 1);
+        assert_eq!(attribution.hunks[0].to_string(), "4 engine");
+    }
+
+    #[test]
+    fn test_human_edits_are_separated() {
+        let plan = PlanFile::new("main.go", ORIGINAL, ENGINE);
+        let current = "package main\n\nfunc main() {\n\tclient.Connect(addr, 30*time.Second)\n\tlog.Println(\"connected\")\n}\n";
+        let attribution = plan.attribute(current);
+
+        let human: Vec<String> = attribution.human_hunks().map(|h| h.to_string()).collect();
+        assert_eq!(human, vec!["5 human (1 line(s) removed)"]);
+        assert_eq!(attribution.hunks[0].origin, Origin::Engine);
+    }
+
+    #[test]
+    fn test_plan_round_trip_and_missing_file() {
+        let dir = tempfile::TempDir::new().unwrap();
+        fs::write(dir.path().join("main.go"), ENGINE).unwrap();
+
+        let plan = ApplyPlan {
+            upgrade: "client-v2".to_string(),
+            semantics: Some(SemanticsVersion::new(0, 3)),
+            files: vec![
+                PlanFile::new("main.go", ORIGINAL, ENGINE),
+                PlanFile::new("gone.go", ORIGINAL, ENGINE),
+            ],
+        };
+        let path = dir.path().join(".refactor/plan.json");
+        plan.save(&path).unwrap();
+        assert_eq!(ApplyPlan::load(&path).unwrap(), plan);
+
+        let report = plan.attribute(dir.path()).unwrap();
+        assert_eq!(report.human_edited().count(), 1);
+        assert!(
+            report
+                .to_string()
+                .ends_with("1 of 2 file(s) edited by hand after the engine ran")
+        );
+    }
+}
@@ -1,18 +1,74 @@
 //! CLI for the refactor-dsl tool.
 
 use anyhow::{Context, Result};
-use clap::{Parser, Subcommand};
+use clap::{Parser, Subcommand, ValueEnum};
+use refactor::advisor::{Advisor, HINTS_FILE};
+use refactor::analyzer::{
+    Compatibility, DRAFT_PREFIX, DeprecationExtractor, Inversion, LibraryAnalyzer, RuleDrafter,
+    SymbolMap, release_level,
+};
+use refactor::lint;
+use refactor::minimize::{Fixture, Minimizer};
+use refactor::pack::{ModuleUpgrade, PackRegistry, PackSource, ShippedPacks};
 use refactor::prelude::*;
-use std::path::PathBuf;
+use refactor::preview::RenamePreview;
+use refactor::recipe;
+use refactor::replay::{BugReport, Failure, ReplayBundle};
+use refactor::report::MigrationReport;
+use refactor::rollout::{CodeOwners, RolloutOptions, RolloutPlan};
+use refactor::runner::{MatchStats, SecondPassChange, StepReport, scan_todos};
+use refactor::security::SecurityPlan;
+use refactor::semantics;
+use refactor::verify::AuxiliaryProgram;
+use std::path::{Path, PathBuf};
 
 #[derive(Parser)]
 #[command(name = "refactor")]
 #[command(author, version, about = "Multi-language code refactoring tool", long_about = None)]
 struct Cli {
+    /// Let upgrade configs start the external plugins they declare. Plugins
+    /// run commands named by the config, so only allow them for configs you
+    /// trust
+    #[arg(long, global = true)]
+    allow_plugins: bool,
+
+    /// Load Go packages through the packages driver the project config
+    /// names, or GOPACKAGESDRIVER. The driver is a program, so it only runs
+    /// when asked
+    #[arg(long, global = true)]
+    packages_driver: bool,
+
     #[command(subcommand)]
     command: Commands,
 }
 
+/// The global flags that let configs run the programs they name.
+#[derive(Debug, Clone, Copy, Default)]
+struct Trust {
+    /// `--allow-plugins`: upgrade configs may start their plugins.
+    plugins: bool,
+    /// `--packages-driver`: project configs may run their packages driver.
+    packages_driver: bool,
+}
+
+/// Options of `upgrade` that need the upgrade applied to the working tree
+/// or a report on stdout, which patch output does not have.
+const PATCH_CONFLICTS: [&str; 11] = [
+    "canary",
+    "commit_per_rule",
+    "llm_fallback",
+    "verify",
+    "run_tests",
+    "verify_idempotent",
+    "stats",
+    "replay_bundle",
+    "format",
+    "record",
+    "plan",
+];
+
+// Parsed once per process, so the size of the largest variant is no concern
+#[allow(clippy::large_enum_variant)]
 #[derive(Subcommand)]
 enum Commands {
     /// Replace text patterns in files
@@ -75,6 +131,12 @@ enum Commands {
         #[arg(short, long)]
         extension: Option<String>,
 
+        /// Rename a symbol of the package in this directory (relative to
+        /// PATH, e.g. internal/store), updating the package and its callers
+        /// in the rest of the module
+        #[arg(long, value_name = "DIR")]
+        package: Option<String>,
+
         /// Path to the repository
         #[arg(default_value = ".")]
         path: PathBuf,
@@ -84,170 +146,4624 @@ enum Commands {
         dry_run: bool,
     },
 
-    /// Show supported languages
-    Languages,
-}
+    /// List every occurrence of the name a rename rule renames, grouped by
+    /// kind, marking the ones the rule would rewrite
+    Preview {
+        /// Name to rename
+        #[arg(
+            short,
+            long,
+            required_unless_present = "config",
+            conflicts_with = "config"
+        )]
+        from: Option<String>,
 
-fn main() -> Result<()> {
-    let cli = Cli::parse();
+        /// New name
+        #[arg(short, long, requires = "from", default_value = "")]
+        to: String,
 
-    match cli.command {
-        Commands::Replace {
-            pattern,
-            replacement,
-            extension,
-            include,
-            exclude,
-            path,
-            dry_run,
-        } => cmd_replace(
-            pattern,
-            replacement,
-            extension,
-            include,
-            exclude,
-            path,
-            dry_run,
-        ),
-        Commands::Find {
-            query,
-            extension,
-            path,
-        } => cmd_find(query, extension, path),
-        Commands::Rename {
-            from,
-            to,
-            extension,
-            path,
-            dry_run,
-        } => cmd_rename(from, to, extension, path, dry_run),
-        Commands::Languages => cmd_languages(),
-    }
-}
+        /// Kind of rename rule to preview for --from
+        #[arg(long = "as", value_enum, default_value = "text")]
+        rule_kind: RenameKind,
 
-fn cmd_replace(
-    pattern: String,
-    replacement: String,
-    extension: Option<String>,
-    include: Option<String>,
-    exclude: Option<String>,
-    path: PathBuf,
-    dry_run: bool,
-) -> Result<()> {
-    let mut refactor = Refactor::in_repo(&path).matching(|m| {
-        let mut fm = FileMatcher::new();
-        if let Some(ref ext) = extension {
-            fm = fm.extension(ext);
-        }
-        if let Some(ref inc) = include {
-            fm = fm.include(inc);
-        }
-        if let Some(ref exc) = exclude {
-            fm = fm.exclude(exc);
-        }
-        m.files(|_| fm)
-    });
+        /// Upgrade configuration file (YAML or JSON) with the rule to preview
+        #[arg(short, long, requires = "rule")]
+        config: Option<PathBuf>,
 
-    refactor = refactor.transform(|t| t.replace_pattern(&pattern, &replacement));
+        /// Id or name of the rule in --config
+        #[arg(long)]
+        rule: Option<String>,
 
-    if dry_run {
-        refactor = refactor.dry_run();
-    }
+        /// File extension to index (repeatable; default: the config's, or all files)
+        #[arg(short, long = "extension")]
+        extensions: Vec<String>,
 
-    let result = refactor.apply().context("Refactoring failed")?;
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
 
-    if dry_run {
-        println!("{}", result.colorized_diff());
-        println!("\n{}", result.summary);
-    } else {
-        println!(
-            "Modified {} file(s)",
-            result.changes.iter().filter(|c| c.is_modified()).count()
-        );
-    }
+        /// Output format
+        #[arg(long, value_enum, default_value = "text")]
+        format: ReportFormat,
+    },
 
-    Ok(())
-}
+    /// Apply an upgrade configuration file
+    Upgrade {
+        /// Upgrade configuration file (YAML or JSON), URL or oci:// reference;
+        /// defaults to the rule_files of .refactor-dsl.yaml
+        #[arg(short, long, visible_alias = "rules")]
+        config: Option<PathBuf>,
 
-fn cmd_find(query: String, extension: Option<String>, path: PathBuf) -> Result<()> {
-    let registry = LanguageRegistry::new();
-    let matcher = AstMatcher::new().query(&query);
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
 
-    let file_matcher = if let Some(ref ext) = extension {
-        FileMatcher::new().extension(ext)
-    } else {
-        FileMatcher::new()
-    };
+        /// Preview changes without applying
+        #[arg(long)]
+        dry_run: bool,
 
-    let files = file_matcher
-        .collect(&path)
-        .context("Failed to collect files")?;
+        /// Write the changes to the files (default), or print them as one
+        /// patch `git apply` accepts, leaving the working tree untouched
+        #[arg(long, value_enum, default_value = "write", conflicts_with_all = PATCH_CONFLICTS)]
+        output: UpgradeOutput,
 
-    for file in files {
-        if let Ok(matches) = matcher.find_matches_in_file(&file, &registry) {
-            for m in matches {
-                println!(
-                    "{}:{}:{}: {} ({})",
-                    file.display(),
-                    m.start_row + 1,
-                    m.start_col + 1,
-                    m.text,
-                    m.capture_name
-                );
-            }
-        }
-    }
+        /// Write one patch per rule into DIR, a new or empty directory,
+        /// instead, numbered in the order they apply (implies --output patch)
+        #[arg(long, value_name = "DIR", conflicts_with_all = PATCH_CONFLICTS)]
+        patch_dir: Option<PathBuf>,
 
-    Ok(())
-}
+        /// Build or type-check the project after rewriting
+        #[arg(long)]
+        verify: bool,
 
-fn cmd_rename(
-    from: String,
-    to: String,
-    extension: Option<String>,
-    path: PathBuf,
-    dry_run: bool,
-) -> Result<()> {
-    let mut refactor = Refactor::in_repo(&path).matching(|m| {
-        if let Some(ref ext) = extension {
-            m.files(|f| f.extension(ext))
-        } else {
-            m
-        }
-    });
+        /// Command used for verification (detected from the project by default)
+        #[arg(long, requires = "verify")]
+        verify_command: Option<String>,
 
-    refactor = refactor.transform(|t| t.replace_literal(&from, &to));
+        /// Exit with a non-zero code if verification fails
+        #[arg(long, requires = "verify")]
+        fail_on_verify: bool,
 
-    if dry_run {
-        refactor = refactor.dry_run();
-    }
+        /// Run the project's tests after rewriting; failing tests fail the run
+        #[arg(long)]
+        run_tests: bool,
 
-    let result = refactor.apply().context("Rename failed")?;
+        /// Packages or tests to run (e.g. ./client/... for Go; defaults to all)
+        #[arg(long, requires = "run_tests")]
+        test_pattern: Option<String>,
 
-    if dry_run {
-        println!("{}", result.colorized_diff());
-        println!("\n{}", result.summary);
-    } else {
-        println!(
-            "Renamed '{}' to '{}' in {} file(s)",
-            from,
-            to,
-            result.changes.iter().filter(|c| c.is_modified()).count()
-        );
-    }
+        /// Record a summary of this run in the history store
+        #[arg(long)]
+        record: bool,
 
-    Ok(())
-}
+        /// Save line fingerprints of the rewrite for later attribution
+        #[arg(long)]
+        plan: Option<PathBuf>,
 
-fn cmd_languages() -> Result<()> {
-    let registry = LanguageRegistry::new();
-    println!("Supported languages:");
-    for lang in registry.all() {
-        println!(
-            "  {} (extensions: {})",
-            lang.name(),
-            lang.extensions().join(", ")
-        );
-    }
-    Ok(())
+        /// Save the rules, inputs and outputs of this run as a replay bundle
+        /// (see the replay command)
+        #[arg(long, value_name = "FILE")]
+        replay_bundle: Option<PathBuf>,
+
+        /// Upgrade and verify the files matching this glob first; only
+        /// upgrade the rest of the project if the canary passes
+        #[arg(long, conflicts_with = "dry_run")]
+        canary: Option<String>,
+
+        /// Apply the rules one at a time and commit after each, with a
+        /// message naming the rule (needs a clean working tree)
+        #[arg(long, conflicts_with_all = ["dry_run", "canary"])]
+        commit_per_rule: bool,
+
+        /// Number of files to process in parallel (default: one per CPU)
+        #[arg(short, long)]
+        jobs: Option<usize>,
+
+        /// Output format (defaults to the project config, then text);
+        /// markdown and html show each change before and after
+        #[arg(long, value_enum)]
+        format: Option<UpgradeFormat>,
+
+        /// Only process files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "include", value_name = "GLOB")]
+        includes: Vec<String>,
+
+        /// Skip files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "exclude", value_name = "GLOB")]
+        excludes: Vec<String>,
+
+        /// Only apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        only: Vec<String>,
+
+        /// Do not apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        skip: Vec<String>,
+
+        /// Also rewrite generated files ("// Code generated ... DO NOT EDIT.")
+        #[arg(long)]
+        include_generated: bool,
+
+        /// Only process files changed since this git ref (e.g. origin/main),
+        /// including uncommitted and untracked files
+        #[arg(long, value_name = "REF")]
+        since: Option<String>,
+
+        /// Only process the files listed in FILE, one path per line relative
+        /// to PATH or absolute, such as source files a Bazel or Please query
+        /// reports (`-` reads standard input)
+        #[arg(long, value_name = "FILE")]
+        files_from: Option<PathBuf>,
+
+        /// Skip files unchanged since the last run with the same rules,
+        /// caching results in DIR (default: .refactor-dsl/cache)
+        #[arg(long, value_name = "DIR", num_args = 0..=1, default_missing_value = refactor::runner::DEFAULT_CACHE_DIR)]
+        cache: Option<PathBuf>,
+
+        /// Also update references to renamed symbols in Markdown docs and
+        /// ADRs (code spans, code blocks and links)
+        #[arg(long)]
+        docs: bool,
+
+        /// Move a rename whose new name is already declared or imported in a
+        /// Go package to a free name with a numeric suffix, instead of failing
+        #[arg(long)]
+        resolve_collisions: bool,
+
+        /// Remove Go local variables the upgrade left unused (or assign them
+        /// to _ if their value has side effects) and prune their imports
+        #[arg(long)]
+        cleanup: bool,
+
+        /// Report how often each rule matched, and which rules matched
+        /// nothing
+        #[arg(long)]
+        stats: bool,
+
+        /// Run the rules again over their own output and fail if that
+        /// second run would change anything; files are only written once
+        /// the check passes
+        #[arg(long, conflicts_with_all = ["canary", "commit_per_rule"])]
+        verify_idempotent: bool,
+
+        /// Only apply the packs that resolve known vulnerabilities of the
+        /// project's dependencies (found with govulncheck by default)
+        #[arg(long)]
+        security: bool,
+
+        /// Read advisories from govulncheck -json or osv-scanner JSON output
+        /// instead of running govulncheck
+        #[arg(long, value_name = "FILE", requires = "security")]
+        advisories: Option<PathBuf>,
+
+        /// Apply the packs a dependency ships for an upgrade to this version
+        /// (e.g. example.com/mylib@v2)
+        #[arg(long, value_name = "MODULE@VERSION", conflicts_with_all = ["config", "security"])]
+        module: Option<String>,
+
+        /// With --module, require the new version in go.mod after the
+        /// migration (go get), re-vendoring if the project vendors its
+        /// dependencies (go mod vendor)
+        #[arg(long, requires = "module", conflicts_with = "dry_run")]
+        require: bool,
+
+        /// Apply the inverse of the rules, downgrading from the release the
+        /// pack migrates to back to the one it migrates from
+        #[arg(long, conflicts_with_all = ["security", "module"])]
+        reverse: bool,
+
+        /// Ask the language model configured by REFACTOR_LLM_ENDPOINT and
+        /// REFACTOR_LLM_MODEL to propose edits for the sites left with a
+        /// TODO(refactor) marker; each is shown as a diff and only applied
+        /// once approved at the prompt
+        #[arg(long)]
+        llm_fallback: bool,
+    },
+
+    /// Apply the migrations of .refactor-dsl.yaml (e.g. a library's own
+    /// changes and its clients' migrations) as one change set, verified once
+    /// and reverted entirely if verification fails
+    Migrate {
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Preview changes without applying
+        #[arg(long)]
+        dry_run: bool,
+
+        /// Command used for verification (detected from the project by default)
+        #[arg(long, conflicts_with = "no_verify")]
+        verify_command: Option<String>,
+
+        /// Skip the build check
+        #[arg(long)]
+        no_verify: bool,
+
+        /// Also run the project's tests; failing tests revert the change set
+        #[arg(long)]
+        run_tests: bool,
+
+        /// Packages or tests to run (e.g. ./client/... for Go; defaults to all)
+        #[arg(long, requires = "run_tests")]
+        test_pattern: Option<String>,
+
+        /// Apply the stages of .refactor-dsl.yaml (one per release) one after
+        /// another, verifying each before the next
+        #[arg(long)]
+        stages: bool,
+
+        /// Release the project already uses; earlier stages are skipped
+        #[arg(long, value_name = "VERSION", requires = "stages")]
+        from: Option<String>,
+
+        /// Output format (defaults to the project config, then text)
+        #[arg(long, value_enum)]
+        format: Option<ReportFormat>,
+    },
+
+    /// Restore the files an upgrade or migration changed, from the journal
+    Undo {
+        /// Path to the project
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Journal entry to undo (defaults to the latest)
+        #[arg(long)]
+        id: Option<u64>,
+
+        /// List the journal entries instead of undoing one
+        #[arg(long, conflicts_with_all = ["id", "force"])]
+        list: bool,
+
+        /// Restore files even if they changed since the upgrade
+        #[arg(long)]
+        force: bool,
+    },
+
+    /// Estimate the engineer-hours an upgrade takes, from a dry run
+    Estimate {
+        /// Upgrade configuration file (YAML or JSON; defaults to the
+        /// rule_files of .refactor-dsl.yaml)
+        #[arg(short, long)]
+        config: Option<PathBuf>,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Weights file (YAML or JSON; defaults to the estimate section of
+        /// .refactor-dsl.yaml)
+        #[arg(long, value_name = "FILE")]
+        weights: Option<PathBuf>,
+
+        /// Output format (defaults to the project config, then text)
+        #[arg(long, value_enum)]
+        format: Option<ReportFormat>,
+
+        /// Only process files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "include", value_name = "GLOB")]
+        includes: Vec<String>,
+
+        /// Skip files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "exclude", value_name = "GLOB")]
+        excludes: Vec<String>,
+
+        /// Only apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        only: Vec<String>,
+
+        /// Do not apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        skip: Vec<String>,
+
+        /// Also count generated files ("// Code generated ... DO NOT EDIT.")
+        #[arg(long)]
+        include_generated: bool,
+
+        /// Only process files changed since this git ref (e.g. origin/main),
+        /// including uncommitted and untracked files
+        #[arg(long, value_name = "REF")]
+        since: Option<String>,
+
+        /// Only process the files listed in FILE, one path per line relative
+        /// to PATH or absolute, such as source files a Bazel or Please query
+        /// reports (`-` reads standard input)
+        #[arg(long, value_name = "FILE")]
+        files_from: Option<PathBuf>,
+    },
+
+    /// Report the code an upgrade's rules match, without changing it, and
+    /// fail when a rule of at least the --fail-on severity matches
+    Check {
+        /// Upgrade configuration file (YAML or JSON; defaults to the
+        /// rule_files of .refactor-dsl.yaml)
+        #[arg(short, long)]
+        config: Option<PathBuf>,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Lowest rule severity that fails the check
+        #[arg(long, value_enum, default_value = "error")]
+        fail_on: FailOn,
+
+        /// Output format (defaults to the project config, then text)
+        #[arg(long, value_enum)]
+        format: Option<ReportFormat>,
+
+        /// Only process files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "include", value_name = "GLOB")]
+        includes: Vec<String>,
+
+        /// Skip files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "exclude", value_name = "GLOB")]
+        excludes: Vec<String>,
+
+        /// Only apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        only: Vec<String>,
+
+        /// Do not apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        skip: Vec<String>,
+
+        /// Also check generated files ("// Code generated ... DO NOT EDIT.")
+        #[arg(long)]
+        include_generated: bool,
+
+        /// Only process files changed since this git ref (e.g. origin/main),
+        /// including uncommitted and untracked files
+        #[arg(long, value_name = "REF")]
+        since: Option<String>,
+
+        /// Only process the files listed in FILE, one path per line relative
+        /// to PATH or absolute, such as source files a Bazel or Please query
+        /// reports (`-` reads standard input)
+        #[arg(long, value_name = "FILE")]
+        files_from: Option<PathBuf>,
+    },
+
+    /// List the TODO(refactor) markers left for manual work, failing with
+    /// --check while any remain
+    Todos {
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Only list the markers left by this rule (repeatable)
+        #[arg(long = "rule", value_name = "ID")]
+        rules: Vec<String>,
+
+        /// Exit with status 1 if any marker is listed
+        #[arg(long)]
+        check: bool,
+
+        /// Output format
+        #[arg(long, value_enum, default_value = "text")]
+        format: ReportFormat,
+    },
+
+    /// List the Go functions an upgrade reaches directly or through their
+    /// callees, by fan-in, from a dry run
+    Impact {
+        /// Upgrade configuration file (YAML or JSON; defaults to the
+        /// rule_files of .refactor-dsl.yaml)
+        #[arg(short, long)]
+        config: Option<PathBuf>,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Output format (defaults to the project config, then text)
+        #[arg(long, value_enum)]
+        format: Option<ReportFormat>,
+
+        /// Only process files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "include", value_name = "GLOB")]
+        includes: Vec<String>,
+
+        /// Skip files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "exclude", value_name = "GLOB")]
+        excludes: Vec<String>,
+
+        /// Only apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        only: Vec<String>,
+
+        /// Do not apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        skip: Vec<String>,
+
+        /// Also count generated files ("// Code generated ... DO NOT EDIT.")
+        #[arg(long)]
+        include_generated: bool,
+
+        /// Only process files changed since this git ref (e.g. origin/main),
+        /// including uncommitted and untracked files
+        #[arg(long, value_name = "REF")]
+        since: Option<String>,
+
+        /// Only process the files listed in FILE, one path per line relative
+        /// to PATH or absolute, such as source files a Bazel or Please query
+        /// reports (`-` reads standard input)
+        #[arg(long, value_name = "FILE")]
+        files_from: Option<PathBuf>,
+    },
+
+    /// Record the sites an upgrade would change as editor hints, without
+    /// changing any code
+    Advise {
+        /// Upgrade configuration file (YAML or JSON; defaults to the
+        /// rule_files of .refactor-dsl.yaml)
+        #[arg(short, long)]
+        config: Option<PathBuf>,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Hints file to write (default: PATH/.refactor-hints.json)
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+    },
+
+    /// Apply a one-off structural rewrite without a rule file
+    Run {
+        /// Rewrite of the form 'pattern => replacement' (e.g. 'GetUser($x) => FetchUser($x)')
+        #[arg(short = 'e', long = "expr", required = true)]
+        exprs: Vec<String>,
+
+        /// Path to the repository (a trailing /... is accepted, as in ./...)
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// File extensions to rewrite (default: all supported languages)
+        #[arg(short = 'x', long = "extension")]
+        extensions: Vec<String>,
+
+        /// Preview changes without applying
+        #[arg(long)]
+        dry_run: bool,
+
+        /// Number of files to process in parallel (default: one per CPU)
+        #[arg(short, long)]
+        jobs: Option<usize>,
+
+        /// Only process files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "include", value_name = "GLOB")]
+        includes: Vec<String>,
+
+        /// Skip files matching this glob (relative to PATH; repeatable)
+        #[arg(long = "exclude", value_name = "GLOB")]
+        excludes: Vec<String>,
+
+        /// Also rewrite generated files ("// Code generated ... DO NOT EDIT.")
+        #[arg(long)]
+        include_generated: bool,
+
+        /// Only process files changed since this git ref (e.g. origin/main),
+        /// including uncommitted and untracked files
+        #[arg(long, value_name = "REF")]
+        since: Option<String>,
+
+        /// Only process the files listed in FILE, one path per line relative
+        /// to PATH or absolute, such as source files a Bazel or Please query
+        /// reports (`-` reads standard input)
+        #[arg(long, value_name = "FILE")]
+        files_from: Option<PathBuf>,
+    },
+
+    /// Rewrite one file read from stdin to stdout (findings go to stderr)
+    #[command(visible_alias = "apply")]
+    Filter {
+        /// Upgrade configuration file (YAML or JSON; defaults to the
+        /// rule_files of .refactor-dsl.yaml)
+        #[arg(short, long, visible_alias = "rules")]
+        config: Option<PathBuf>,
+
+        /// Path the input is treated as, for path guards and language detection
+        #[arg(long, conflicts_with = "lang")]
+        filename: Option<PathBuf>,
+
+        /// Language of the input (e.g. go), when there is no file name
+        #[arg(long)]
+        lang: Option<String>,
+
+        /// Does nothing: the file is always read from stdin (accepted for
+        /// editor hooks that pass it)
+        #[arg(long)]
+        stdin: bool,
+    },
+
+    /// Re-run an upgrade in dry-run mode whenever the rules or code change
+    Watch {
+        /// Upgrade configuration file (YAML or JSON)
+        #[arg(short, long)]
+        config: PathBuf,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Polling interval in milliseconds
+        #[arg(long, default_value_t = 500)]
+        interval: u64,
+    },
+
+    /// Serve quick fixes to editors over stdin/stdout (one JSON request per line)
+    Quickfix {
+        /// Upgrade configuration file (YAML or JSON)
+        #[arg(short, long)]
+        config: PathBuf,
+    },
+
+    /// Serve upgrade rules to editors as LSP diagnostics and quick fixes
+    Lsp {
+        /// Upgrade configuration file (YAML or JSON; defaults to the
+        /// rule_files of .refactor-dsl.yaml)
+        #[arg(short, long)]
+        config: Option<PathBuf>,
+    },
+
+    /// Run as a daemon answering analyze, preview and apply requests over
+    /// JSON-RPC, keeping rules and results warm between requests
+    Serve {
+        /// Listen for TCP connections on ADDR (e.g. 127.0.0.1:7070) instead
+        /// of serving stdin and stdout; only loopback addresses are accepted
+        #[arg(long, value_name = "ADDR")]
+        listen: Option<String>,
+    },
+
+    /// Serve the engine to AI coding assistants as Model Context Protocol
+    /// tools over stdin and stdout
+    Mcp,
+
+    /// Re-run a replay bundle and show what each rule matched
+    Replay {
+        /// Bundle saved by `upgrade --replay-bundle`
+        bundle: PathBuf,
+
+        /// Only replay this file (as recorded, relative to the project root)
+        #[arg(long)]
+        file: Option<PathBuf>,
+    },
+
+    /// Package a minimized reproduction of a wrong rewrite or failed run
+    Bugreport {
+        /// File the rules misbehave on
+        file: PathBuf,
+
+        /// Upgrade configuration file (YAML or JSON; defaults to the
+        /// rule_files of .refactor-dsl.yaml)
+        #[arg(short, long)]
+        config: Option<PathBuf>,
+
+        /// Text the rewrite wrongly introduces (default: the run's error,
+        /// or any rewrite of the file)
+        #[arg(long)]
+        introduces: Option<String>,
+
+        /// Where to write the report
+        #[arg(short, long, default_value = "refactor-bugreport.json")]
+        output: PathBuf,
+
+        /// Keep the whole file and all rules
+        #[arg(long)]
+        no_minimize: bool,
+    },
+
+    /// Reduce a file to the smallest snippet on which the rules still
+    /// behave the same
+    Minimize {
+        /// File to reduce
+        file: PathBuf,
+
+        /// Upgrade configuration file (YAML or JSON; defaults to the
+        /// rule_files of .refactor-dsl.yaml)
+        #[arg(short, long)]
+        config: Option<PathBuf>,
+
+        /// Only run the rule with this id (repeatable)
+        #[arg(long = "rule", value_name = "ID")]
+        rules: Vec<String>,
+
+        /// Text the rewrite must keep introducing (default: the run's
+        /// error, or any rewrite of the file)
+        #[arg(long)]
+        introduces: Option<String>,
+
+        /// Only remove whole lines
+        #[arg(long)]
+        lines_only: bool,
+
+        /// Blank out string literals and comments where possible
+        #[arg(long)]
+        redact: bool,
+
+        /// Write the snippet and the rules' output to DIR as
+        /// <name>.input.<ext> and <name>.expected.<ext>
+        #[arg(long, value_name = "DIR")]
+        fixture: Option<PathBuf>,
+    },
+
+    /// Show which changed lines came from the engine and which from humans
+    Attribution {
+        /// Plan saved by `upgrade --plan`
+        #[arg(short, long)]
+        plan: PathBuf,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Only show hunks edited by hand
+        #[arg(long)]
+        human_only: bool,
+    },
+
+    /// Export recorded run history
+    History {
+        /// History store file (defaults to the user data directory)
+        #[arg(long)]
+        store: Option<PathBuf>,
+
+        /// Only show runs for this repository
+        #[arg(long)]
+        repo: Option<String>,
+
+        /// Only show runs of this upgrade
+        #[arg(long)]
+        upgrade: Option<String>,
+
+        /// Only show the latest run per repository
+        #[arg(long)]
+        latest: bool,
+
+        /// Output format
+        #[arg(long, value_enum, default_value_t = HistoryFormat::Table)]
+        format: HistoryFormat,
+    },
+
+    /// Check or fix organization conventions
+    Conventions {
+        /// Convention pack file (YAML or JSON)
+        #[arg(short, long)]
+        pack: PathBuf,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Fix violations instead of only reporting them
+        #[arg(long)]
+        fix: bool,
+
+        /// Preview fixes without applying
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// File, update and close issues for findings that need manual review
+    Issues {
+        /// Upgrade configuration file (YAML or JSON)
+        #[arg(short, long)]
+        config: PathBuf,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// GitHub repository to file issues in (owner/repo)
+        #[arg(
+            long,
+            required_unless_present = "jira_url",
+            conflicts_with = "jira_url"
+        )]
+        github: Option<String>,
+
+        /// Jira site URL (credentials from JIRA_EMAIL and JIRA_API_TOKEN)
+        #[arg(long, requires = "jira_project")]
+        jira_url: Option<String>,
+
+        /// Jira project key
+        #[arg(long)]
+        jira_project: Option<String>,
+
+        /// Label identifying issues managed by this command
+        #[arg(long, default_value = refactor::tracker::DEFAULT_LABEL)]
+        label: String,
+
+        /// Base URL for code links (defaults to the GitHub blob URL for HEAD)
+        #[arg(long)]
+        link_base: Option<String>,
+    },
+
+    /// Apply an upgrade on a new branch, push it and open a pull request
+    /// describing the applied rules and the remaining manual work
+    Pr {
+        /// Upgrade configuration file (YAML or JSON; defaults to the
+        /// rule_files of .refactor-dsl.yaml)
+        #[arg(short, long)]
+        config: Option<PathBuf>,
+
+        /// Path to the checked-out repository (with --clone, the directory
+        /// to clone into)
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// GitHub repository (owner/repo; defaults to GITHUB_REPOSITORY,
+        /// then the origin remote)
+        #[arg(long)]
+        repo: Option<String>,
+
+        /// Clone the repository into PATH instead of using a checkout
+        #[arg(long)]
+        clone: bool,
+
+        /// Branch to create (default: refactor/<upgrade name>)
+        #[arg(long)]
+        branch: Option<String>,
+
+        /// Branch the pull request merges into (default: the checked-out branch)
+        #[arg(long)]
+        base: Option<String>,
+
+        /// Pull request title (default: "Apply <upgrade name> upgrade")
+        #[arg(long)]
+        title: Option<String>,
+
+        /// Open the pull request as a draft
+        #[arg(long)]
+        draft: bool,
+
+        /// Print the pull request without changing files, committing,
+        /// pushing or opening it
+        #[arg(long)]
+        dry_run: bool,
+
+        /// Command used for verification (detected from the project by default)
+        #[arg(long, conflicts_with = "no_verify")]
+        verify_command: Option<String>,
+
+        /// Skip the build check
+        #[arg(long)]
+        no_verify: bool,
+
+        /// Also run the project's tests; failing tests revert the change
+        /// and open no pull request
+        #[arg(long)]
+        run_tests: bool,
+
+        /// Packages or tests to run (e.g. ./client/... for Go; defaults to all)
+        #[arg(long, requires = "run_tests")]
+        test_pattern: Option<String>,
+
+        /// Only apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        only: Vec<String>,
+
+        /// Do not apply these rules, by id (comma-separated or repeatable)
+        #[arg(long, value_name = "RULE", value_delimiter = ',')]
+        skip: Vec<String>,
+    },
+
+    /// Apply an upgrade to many repositories and report on each
+    Fleet {
+        /// Upgrade configuration file (YAML or JSON)
+        #[arg(short, long)]
+        config: PathBuf,
+
+        /// Repositories: local checkouts, or GitHub repositories as owner/repo
+        repos: Vec<String>,
+
+        /// File listing repositories, one per line (# starts a comment)
+        #[arg(long)]
+        repos_file: Option<PathBuf>,
+
+        /// Every active, non-fork repository of a GitHub organization
+        #[arg(long)]
+        org: Option<String>,
+
+        /// The repositories matching a GitHub search (e.g. "org:acme topic:payments")
+        #[arg(long)]
+        search: Option<String>,
+
+        /// Directory GitHub repositories are cloned into
+        #[arg(long)]
+        workspace: Option<PathBuf>,
+
+        /// Preview changes without applying
+        #[arg(long)]
+        dry_run: bool,
+
+        /// Number of files to process in parallel within a repository
+        #[arg(short, long)]
+        jobs: Option<usize>,
+
+        /// Output format
+        #[arg(long, value_enum, default_value = "text")]
+        format: ReportFormat,
+    },
+
+    /// Work with rule packs
+    Pack {
+        #[command(subcommand)]
+        command: PackCommand,
+    },
+
+    /// Plan a migration as staged phases and run it one phase at a time
+    Rollout {
+        #[command(subcommand)]
+        command: RolloutCommand,
+    },
+
+    /// Generate a pack from a Go library's API changes between two
+    /// versions, fetched from the module proxy
+    Analyze {
+        /// Module path (e.g. example.com/mylib), or with --internal the
+        /// path of the module's repository
+        module: String,
+
+        /// Old version (e.g. v1.4.0)
+        from: String,
+
+        /// New version (e.g. v2.0.0)
+        to: String,
+
+        /// Write the pack to this file instead of stdout
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+
+        /// Ask the language model configured by REFACTOR_LLM_ENDPOINT and
+        /// REFACTOR_LLM_MODEL to draft rules for the changes left for
+        /// manual review; drafts only suggest until reviewed
+        #[arg(long)]
+        draft_rules: bool,
+
+        /// Analyze the module's own internal API from its git repository
+        /// instead of the module proxy: private symbols are included and
+        /// renames become rename_symbol rules scoped to their package
+        #[arg(long)]
+        internal: bool,
+    },
+
+    /// Classify a library's API changes between two versions as breaking,
+    /// compatible or patch-level, failing if the release is too small
+    Apidiff {
+        /// Old version (tag, branch or commit)
+        from: String,
+
+        /// New version (tag, branch or commit)
+        to: String,
+
+        /// Path to the library's repository
+        #[arg(long, default_value = ".")]
+        path: PathBuf,
+
+        /// Fetch the versions of this Go module from the module proxy
+        /// instead of reading the repository
+        #[arg(long, conflicts_with = "path")]
+        module: Option<String>,
+
+        /// File extensions to analyze (default: rs, ts, tsx, py; go with
+        /// --module)
+        #[arg(short, long = "extension")]
+        extensions: Vec<String>,
+
+        /// Release the new version is (default: inferred from the versions)
+        #[arg(long, value_enum)]
+        release: Option<ReleaseLevel>,
+
+        /// Write a Markdown migration guide for the library's users
+        #[arg(long)]
+        guide: Option<PathBuf>,
+
+        /// List the types of this Go client that implement a changed
+        /// interface and break, with stubs for the methods they need
+        #[arg(long, value_name = "DIR")]
+        client: Option<PathBuf>,
+
+        /// Output format
+        #[arg(long, value_enum, default_value = "text")]
+        format: ReportFormat,
+    },
+
+    /// Check rule files for schema errors, unknown fields, patterns that
+    /// do not compile or parse, undefined captures and rules that never match
+    LintRules {
+        /// Rule files to check (default: the rule_files of .refactor-dsl.yaml)
+        files: Vec<PathBuf>,
+
+        /// Output format
+        #[arg(long, value_enum, default_value = "text")]
+        format: ReportFormat,
+    },
+
+    /// Show supported languages
+    Languages,
+
+    /// Show the changelog of the engine's rewrite semantics
+    Semantics {
+        /// Only show changes after this version (e.g. a pack's `engine:` pin)
+        #[arg(long)]
+        since: Option<SemanticsVersion>,
+
+        /// Output format
+        #[arg(long, value_enum, default_value = "text")]
+        format: ReportFormat,
+    },
+}
+
+#[derive(Subcommand)]
+enum PackCommand {
+    /// Show rules added, removed or changed between two pack versions
+    Diff {
+        /// Old pack (upgrade config or convention pack)
+        old: PathBuf,
+
+        /// New pack (upgrade config or convention pack)
+        new: PathBuf,
+
+        /// Also count the sites each change rewrites in this project
+        #[arg(long)]
+        path: Option<PathBuf>,
+    },
+
+    /// Export the old-to-new symbol mapping of a pack for other tools
+    Symbols {
+        /// Pack (upgrade config or convention pack)
+        pack: PathBuf,
+
+        /// Output format
+        #[arg(long, value_enum, default_value = "json")]
+        format: SymbolFormat,
+    },
+
+    /// Show the order packs are applied in, from the packs they require
+    Order {
+        /// Packs (upgrade configs or convention packs)
+        #[arg(required = true)]
+        packs: Vec<PathBuf>,
+    },
+
+    /// Generate a pack from the deprecation notices and rename directives
+    /// of a Go library's source
+    Extract {
+        /// Library source directory
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Pack name (defaults to <directory>-deprecations)
+        #[arg(long)]
+        name: Option<String>,
+
+        /// Release the pack migrates to
+        #[arg(long)]
+        to_version: Option<String>,
+
+        /// Write the pack to this file instead of stdout
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+    },
+
+    /// Generate the pack undoing a pack's renames, moves and reorders, to
+    /// downgrade clients back to the release it migrates from
+    Invert {
+        /// Pack (upgrade config or convention pack)
+        pack: PathBuf,
+
+        /// Write the pack to this file instead of stdout
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+    },
+
+    /// Generate a pack from a built-in recipe, or list the recipes
+    Recipe {
+        /// Recipe name (lists the recipes if omitted)
+        name: Option<String>,
+
+        /// Recipe parameter (repeatable)
+        #[arg(short, long = "param", value_name = "NAME=VALUE")]
+        params: Vec<String>,
+
+        /// Write the pack to this file instead of stdout
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+    },
+}
+
+#[derive(Subcommand)]
+enum RolloutCommand {
+    /// Draft a rollout plan from a dry run of a pack
+    Plan {
+        /// Upgrade configuration file (YAML or JSON) the phases apply
+        #[arg(short, long)]
+        config: PathBuf,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Number of phases to split the rules that rewrite code into
+        #[arg(long, default_value_t = 3)]
+        phases: usize,
+
+        /// Weeks planned for each phase
+        #[arg(long, default_value_t = 1)]
+        weeks: u32,
+
+        /// First day of the rollout (YYYY-MM-DD; defaults to today)
+        #[arg(long, value_name = "DATE")]
+        start: Option<String>,
+
+        /// Write the plan to this file (YAML, or JSON for .json) instead of
+        /// stdout
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+    },
+
+    /// Render a rollout plan
+    Show {
+        /// Rollout plan file
+        plan: PathBuf,
+
+        /// Output format
+        #[arg(long, value_enum, default_value = "markdown")]
+        format: PlanFormat,
+    },
+
+    /// Apply the next pending phase of a rollout plan (or the one named) and
+    /// mark it done once its gate passes
+    Run {
+        /// Rollout plan file
+        plan: PathBuf,
+
+        /// Path to the repository
+        #[arg(default_value = ".")]
+        path: PathBuf,
+
+        /// Run this phase instead of the next pending one
+        #[arg(long)]
+        phase: Option<String>,
+
+        /// Preview the phase's changes without applying them
+        #[arg(long)]
+        dry_run: bool,
+    },
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum PlanFormat {
+    Markdown,
+    Mermaid,
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum SymbolFormat {
+    Json,
+    Csv,
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum HistoryFormat {
+    Table,
+    Csv,
+    Json,
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum RenameKind {
+    /// Every occurrence of the name, as the rename command rewrites
+    Text,
+    /// rename_function: calls and declarations
+    Function,
+    /// rename_type: whole-word uses
+    Type,
+}
+
+impl RenameKind {
+    fn spec(self, from: String, to: String) -> TransformSpec {
+        match self {
+            RenameKind::Text => TransformSpec::ReplaceLiteral { from, to },
+            RenameKind::Function => TransformSpec::RenameFunction {
+                old_name: from,
+                new_name: to,
+            },
+            RenameKind::Type => TransformSpec::RenameType {
+                old_name: from,
+                new_name: to,
+            },
+        }
+    }
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum ReleaseLevel {
+    Major,
+    Minor,
+    Patch,
+}
+
+impl From<ReleaseLevel> for Compatibility {
+    fn from(level: ReleaseLevel) -> Self {
+        match level {
+            ReleaseLevel::Major => Compatibility::Breaking,
+            ReleaseLevel::Minor => Compatibility::Compatible,
+            ReleaseLevel::Patch => Compatibility::Patch,
+        }
+    }
+}
+
+#[derive(Clone, Copy, PartialEq, Eq, ValueEnum)]
+enum UpgradeOutput {
+    Write,
+    Patch,
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum ReportFormat {
+    Text,
+    Json,
+}
+
+impl From<OutputFormat> for ReportFormat {
+    fn from(format: OutputFormat) -> Self {
+        match format {
+            OutputFormat::Text => ReportFormat::Text,
+            OutputFormat::Json => ReportFormat::Json,
+        }
+    }
+}
+
+/// Severities that fail `check`.
+#[derive(Clone, Copy, ValueEnum)]
+enum FailOn {
+    Info,
+    Warn,
+    Error,
+}
+
+impl From<FailOn> for RuleSeverity {
+    fn from(fail_on: FailOn) -> Self {
+        match fail_on {
+            FailOn::Info => RuleSeverity::Info,
+            FailOn::Warn => RuleSeverity::Warn,
+            FailOn::Error => RuleSeverity::Error,
+        }
+    }
+}
+
+/// Output formats of the upgrade report: those of the other reports, plus
+/// documents with before and after snippets.
+#[derive(Clone, Copy, PartialEq, Eq, ValueEnum)]
+enum UpgradeFormat {
+    Text,
+    Json,
+    Markdown,
+    Html,
+}
+
+impl From<OutputFormat> for UpgradeFormat {
+    fn from(format: OutputFormat) -> Self {
+        match format {
+            OutputFormat::Text => UpgradeFormat::Text,
+            OutputFormat::Json => UpgradeFormat::Json,
+        }
+    }
+}
+
+fn main() -> Result<()> {
+    // `go vet -vettool` runs the binary with the unitchecker protocol
+    let args: Vec<String> = std::env::args().skip(1).collect();
+    if is_vettool(&args) {
+        return cmd_vettool(&args);
+    }
+    let cli = Cli::parse();
+    let trust = Trust {
+        plugins: cli.allow_plugins,
+        packages_driver: cli.packages_driver,
+    };
+
+    match cli.command {
+        Commands::Replace {
+            pattern,
+            replacement,
+            extension,
+            include,
+            exclude,
+            path,
+            dry_run,
+        } => cmd_replace(
+            pattern,
+            replacement,
+            extension,
+            include,
+            exclude,
+            path,
+            dry_run,
+        ),
+        Commands::Find {
+            query,
+            extension,
+            path,
+        } => cmd_find(query, extension, path),
+        Commands::Rename {
+            from,
+            to,
+            extension,
+            package,
+            path,
+            dry_run,
+        } => match package {
+            Some(package) => cmd_rename_symbol(package, from, to, extension, path, dry_run),
+            None => cmd_rename(from, to, extension, path, dry_run),
+        },
+        Commands::Preview {
+            from,
+            to,
+            rule_kind,
+            config,
+            rule,
+            extensions,
+            path,
+            format,
+        } => cmd_preview(
+            from.map(|from| rule_kind.spec(from, to)),
+            config.zip(rule),
+            extensions,
+            path,
+            format,
+            trust,
+        ),
+        Commands::Upgrade {
+            config,
+            path,
+            dry_run,
+            output,
+            patch_dir,
+            verify,
+            verify_command,
+            fail_on_verify,
+            run_tests,
+            test_pattern,
+            record,
+            plan,
+            replay_bundle,
+            canary,
+            commit_per_rule,
+            jobs,
+            cache,
+            format,
+            includes,
+            excludes,
+            only,
+            skip,
+            include_generated,
+            since,
+            files_from,
+            docs,
+            resolve_collisions,
+            cleanup,
+            stats,
+            verify_idempotent,
+            security,
+            advisories,
+            module,
+            require,
+            reverse,
+            llm_fallback,
+        } => cmd_upgrade(
+            config,
+            path,
+            UpgradeOptions {
+                dry_run,
+                patch: (output == UpgradeOutput::Patch || patch_dir.is_some()).then_some(patch_dir),
+                docs,
+                resolve_collisions,
+                cleanup,
+                stats,
+                verify_idempotent,
+                rules: RuleSelection { only, skip },
+                security: security.then_some(advisories),
+                module,
+                require,
+                reverse,
+                llm_fallback,
+                verify: verify.then_some(VerifyOptions {
+                    command: verify_command,
+                    fail: fail_on_verify,
+                }),
+                tests: run_tests.then_some(test_pattern),
+                record,
+                plan,
+                replay_bundle,
+                canary,
+                commit_per_rule,
+                jobs,
+                cache,
+                format,
+                filter: PathFilter {
+                    includes,
+                    excludes,
+                    include_generated,
+                    since,
+                    files_from,
+                },
+            },
+            trust,
+        ),
+        Commands::Advise {
+            config,
+            path,
+            output,
+        } => cmd_advise(config, path, output, trust),
+        Commands::Run {
+            exprs,
+            path,
+            extensions,
+            dry_run,
+            jobs,
+            includes,
+            excludes,
+            include_generated,
+            since,
+            files_from,
+        } => cmd_run(
+            exprs,
+            path,
+            extensions,
+            dry_run,
+            jobs,
+            PathFilter {
+                includes,
+                excludes,
+                include_generated,
+                since,
+                files_from,
+            },
+        ),
+        Commands::Filter {
+            config,
+            filename,
+            lang,
+            stdin: _,
+        } => cmd_filter(config, filename, lang, trust),
+        Commands::Watch {
+            config,
+            path,
+            interval,
+        } => cmd_watch(config, path, interval, trust),
+        Commands::Quickfix { config } => cmd_quickfix(config, trust),
+        Commands::Lsp { config } => cmd_lsp(config, trust),
+        Commands::Serve { listen } => cmd_serve(listen),
+        Commands::Mcp => cmd_mcp(),
+        Commands::Undo {
+            path,
+            id,
+            list,
+            force,
+        } => cmd_undo(path, id, list, force),
+        Commands::Estimate {
+            config,
+            path,
+            weights,
+            format,
+            includes,
+            excludes,
+            only,
+            skip,
+            include_generated,
+            since,
+            files_from,
+        } => cmd_estimate(
+            config,
+            path,
+            weights,
+            format,
+            RuleSelection { only, skip },
+            PathFilter {
+                includes,
+                excludes,
+                include_generated,
+                since,
+                files_from,
+            },
+            trust,
+        ),
+        Commands::Check {
+            config,
+            path,
+            fail_on,
+            format,
+            includes,
+            excludes,
+            only,
+            skip,
+            include_generated,
+            since,
+            files_from,
+        } => cmd_check(
+            config,
+            path,
+            fail_on.into(),
+            format,
+            RuleSelection { only, skip },
+            PathFilter {
+                includes,
+                excludes,
+                include_generated,
+                since,
+                files_from,
+            },
+            trust,
+        ),
+        Commands::Todos {
+            path,
+            rules,
+            check,
+            format,
+        } => cmd_todos(path, rules, check, format),
+        Commands::Impact {
+            config,
+            path,
+            format,
+            includes,
+            excludes,
+            only,
+            skip,
+            include_generated,
+            since,
+            files_from,
+        } => cmd_impact(
+            config,
+            path,
+            format,
+            RuleSelection { only, skip },
+            PathFilter {
+                includes,
+                excludes,
+                include_generated,
+                since,
+                files_from,
+            },
+            trust,
+        ),
+        Commands::Migrate {
+            path,
+            dry_run,
+            verify_command,
+            no_verify,
+            run_tests,
+            test_pattern,
+            stages,
+            from,
+            format,
+        } => cmd_migrate(
+            path,
+            stages.then_some(from),
+            MigrateOptions {
+                dry_run,
+                verify: (!no_verify).then_some(VerifyOptions {
+                    command: verify_command,
+                    fail: true,
+                }),
+                tests: run_tests.then_some(test_pattern),
+                format,
+            },
+            trust,
+        ),
+        Commands::Replay { bundle, file } => cmd_replay(bundle, file),
+        Commands::Bugreport {
+            file,
+            config,
+            introduces,
+            output,
+            no_minimize,
+        } => cmd_bugreport(file, config, introduces, output, no_minimize, trust),
+        Commands::Minimize {
+            file,
+            config,
+            rules,
+            introduces,
+            lines_only,
+            redact,
+            fixture,
+        } => cmd_minimize(
+            file,
+            config,
+            rules,
+            introduces,
+            MinimizeOptions {
+                lines_only,
+                redact,
+                fixture,
+            },
+            trust,
+        ),
+        Commands::Attribution {
+            plan,
+            path,
+            human_only,
+        } => cmd_attribution(plan, path, human_only),
+        Commands::History {
+            store,
+            repo,
+            upgrade,
+            latest,
+            format,
+        } => cmd_history(store, repo, upgrade, latest, format),
+        Commands::Conventions {
+            pack,
+            path,
+            fix,
+            dry_run,
+        } => cmd_conventions(pack, path, fix, dry_run),
+        Commands::Issues {
+            config,
+            path,
+            github,
+            jira_url,
+            jira_project,
+            label,
+            link_base,
+        } => cmd_issues(
+            config,
+            path,
+            github,
+            jira_url.zip(jira_project),
+            label,
+            link_base,
+            trust,
+        ),
+        Commands::Pr {
+            config,
+            path,
+            repo,
+            clone,
+            branch,
+            base,
+            title,
+            draft,
+            dry_run,
+            verify_command,
+            no_verify,
+            run_tests,
+            test_pattern,
+            only,
+            skip,
+        } => cmd_pr(
+            config,
+            path,
+            PrOptions {
+                repo,
+                clone,
+                branch,
+                base,
+                title,
+                draft,
+                dry_run,
+                verify: (!no_verify).then_some(VerifyOptions {
+                    command: verify_command,
+                    fail: true,
+                }),
+                tests: run_tests.then_some(test_pattern),
+                rules: RuleSelection { only, skip },
+            },
+            trust,
+        ),
+        Commands::Fleet {
+            config,
+            repos,
+            repos_file,
+            org,
+            search,
+            workspace,
+            dry_run,
+            jobs,
+            format,
+        } => cmd_fleet(
+            config,
+            FleetOptions {
+                repos,
+                repos_file,
+                org,
+                search,
+                workspace,
+                dry_run,
+                jobs,
+                format,
+            },
+            trust,
+        ),
+        Commands::Pack {
+            command: PackCommand::Diff { old, new, path },
+        } => cmd_pack_diff(old, new, path, trust),
+        Commands::Pack {
+            command: PackCommand::Symbols { pack, format },
+        } => cmd_pack_symbols(pack, format, trust),
+        Commands::Pack {
+            command: PackCommand::Order { packs },
+        } => cmd_pack_order(packs, trust),
+        Commands::Pack {
+            command:
+                PackCommand::Extract {
+                    path,
+                    name,
+                    to_version,
+                    output,
+                },
+        } => cmd_pack_extract(path, name, to_version, output),
+        Commands::Pack {
+            command: PackCommand::Invert { pack, output },
+        } => cmd_pack_invert(pack, output, trust),
+        Commands::Pack {
+            command:
+                PackCommand::Recipe {
+                    name,
+                    params,
+                    output,
+                },
+        } => cmd_pack_recipe(name, params, output),
+        Commands::Rollout {
+            command:
+                RolloutCommand::Plan {
+                    config,
+                    path,
+                    phases,
+                    weeks,
+                    start,
+                    output,
+                },
+        } => cmd_rollout_plan(
+            config,
+            path,
+            RolloutOptions {
+                phases,
+                weeks,
+                start,
+                ..Default::default()
+            },
+            output,
+            trust,
+        ),
+        Commands::Rollout {
+            command: RolloutCommand::Show { plan, format },
+        } => cmd_rollout_show(plan, format),
+        Commands::Rollout {
+            command:
+                RolloutCommand::Run {
+                    plan,
+                    path,
+                    phase,
+                    dry_run,
+                },
+        } => cmd_rollout_run(plan, path, phase, dry_run, trust),
+        Commands::Analyze {
+            module,
+            from,
+            to,
+            output,
+            draft_rules,
+            internal,
+        } => cmd_analyze(module, from, to, output, draft_rules, internal),
+        Commands::Apidiff {
+            from,
+            to,
+            path,
+            module,
+            extensions,
+            release,
+            guide,
+            client,
+            format,
+        } => cmd_apidiff(
+            from,
+            to,
+            ApidiffSource { path, module },
+            extensions,
+            release,
+            ApidiffOutputs { guide, client },
+            format,
+        ),
+        Commands::Languages => cmd_languages(),
+        Commands::Semantics { since, format } => cmd_semantics(since, format),
+        Commands::LintRules { files, format } => cmd_lint_rules(files, format, trust),
+    }
+}
+
+fn cmd_replace(
+    pattern: String,
+    replacement: String,
+    extension: Option<String>,
+    include: Option<String>,
+    exclude: Option<String>,
+    path: PathBuf,
+    dry_run: bool,
+) -> Result<()> {
+    let mut refactor = Refactor::in_repo(&path).matching(|m| {
+        let mut fm = FileMatcher::new();
+        if let Some(ref ext) = extension {
+            fm = fm.extension(ext);
+        }
+        if let Some(ref inc) = include {
+            fm = fm.include(inc);
+        }
+        if let Some(ref exc) = exclude {
+            fm = fm.exclude(exc);
+        }
+        m.files(|_| fm)
+    });
+
+    refactor = refactor.transform(|t| t.replace_pattern(&pattern, &replacement));
+
+    if dry_run {
+        refactor = refactor.dry_run();
+    }
+
+    let result = refactor.apply().context("Refactoring failed")?;
+
+    if dry_run {
+        println!("{}", result.colorized_diff());
+        println!("\n{}", result.summary);
+    } else {
+        println!(
+            "Modified {} file(s)",
+            result.changes.iter().filter(|c| c.is_modified()).count()
+        );
+    }
+
+    Ok(())
+}
+
+fn cmd_find(query: String, extension: Option<String>, path: PathBuf) -> Result<()> {
+    let registry = LanguageRegistry::new();
+    let matcher = AstMatcher::new().query(&query);
+
+    let file_matcher = if let Some(ref ext) = extension {
+        FileMatcher::new().extension(ext)
+    } else {
+        FileMatcher::new()
+    };
+
+    let files = file_matcher
+        .collect(&path)
+        .context("Failed to collect files")?;
+
+    for file in files {
+        if let Ok(matches) = matcher.find_matches_in_file(&file, &registry) {
+            for m in matches {
+                println!(
+                    "{}:{}:{}: {} ({})",
+                    file.display(),
+                    m.start_row + 1,
+                    m.start_col + 1,
+                    m.text,
+                    m.capture_name
+                );
+            }
+        }
+    }
+
+    Ok(())
+}
+
+fn cmd_rename(
+    from: String,
+    to: String,
+    extension: Option<String>,
+    path: PathBuf,
+    dry_run: bool,
+) -> Result<()> {
+    let mut refactor = Refactor::in_repo(&path).matching(|m| {
+        if let Some(ref ext) = extension {
+            m.files(|f| f.extension(ext))
+        } else {
+            m
+        }
+    });
+
+    refactor = refactor.transform(|t| t.replace_literal(&from, &to));
+
+    if dry_run {
+        refactor = refactor.dry_run();
+    }
+
+    let result = refactor.apply().context("Rename failed")?;
+
+    if dry_run {
+        println!("{}", result.colorized_diff());
+        println!("\n{}", result.summary);
+    } else {
+        println!(
+            "Renamed '{}' to '{}' in {} file(s)",
+            from,
+            to,
+            result.changes.iter().filter(|c| c.is_modified()).count()
+        );
+    }
+
+    Ok(())
+}
+
+fn cmd_preview(
+    spec: Option<TransformSpec>,
+    pack: Option<(PathBuf, String)>,
+    mut extensions: Vec<String>,
+    path: PathBuf,
+    format: ReportFormat,
+    trust: Trust,
+) -> Result<()> {
+    let rule = match (spec, pack) {
+        (Some(spec), _) => TransformRule::new(spec),
+        (None, Some((config, name))) => {
+            let config = load_config(&config, trust).context("Failed to load upgrade config")?;
+            if extensions.is_empty() {
+                extensions = config.extensions.clone();
+            }
+            config
+                .transforms
+                .into_iter()
+                .find(|rule| rule.name() == name)
+                .with_context(|| format!("No rule '{}' in {}", name, config.name))?
+        }
+        (None, None) => anyhow::bail!("Give --from or --config and --rule"),
+    };
+    let index = RenamePreview::new(rule, extensions)?
+        .index(&path)
+        .context("Failed to index occurrences")?;
+    match format {
+        ReportFormat::Json => println!("{}", serde_json::to_string_pretty(&index)?),
+        ReportFormat::Text => println!("{}", index),
+    }
+    Ok(())
+}
+
+fn cmd_rename_symbol(
+    package: String,
+    from: String,
+    to: String,
+    extension: Option<String>,
+    path: PathBuf,
+    dry_run: bool,
+) -> Result<()> {
+    let mut config = UpgradeConfig::new("rename-symbol", format!("Rename {}", from))
+        .with_extensions(vec![extension.unwrap_or_else(|| "go".to_string())]);
+    config.add_transform(TransformSpec::RenameSymbol {
+        package,
+        old_name: from.clone(),
+        new_name: to.clone(),
+    });
+    let mut runner = UpgradeRunner::new(config);
+    if dry_run {
+        runner = runner.dry_run();
+    }
+    let report = runner.run(&path).context("Rename failed")?;
+
+    if dry_run {
+        print_report(true, false, &report);
+    } else {
+        println!(
+            "Renamed '{}' to '{}' in {} file(s)",
+            from,
+            to,
+            report.files_modified()
+        );
+    }
+    Ok(())
+}
+
+/// Options for verifying the project after an upgrade.
+struct VerifyOptions {
+    command: Option<String>,
+    fail: bool,
+}
+
+/// Options for the `upgrade` command.
+struct UpgradeOptions {
+    dry_run: bool,
+    docs: bool,
+    resolve_collisions: bool,
+    cleanup: bool,
+    stats: bool,
+    verify_idempotent: bool,
+    rules: RuleSelection,
+    security: Option<Option<PathBuf>>,
+    module: Option<String>,
+    require: bool,
+    reverse: bool,
+    llm_fallback: bool,
+    /// Print the changes as a patch instead of writing them, or with a
+    /// directory, write one patch per rule there.
+    patch: Option<Option<PathBuf>>,
+    verify: Option<VerifyOptions>,
+    tests: Option<Option<String>>,
+    record: bool,
+    plan: Option<PathBuf>,
+    replay_bundle: Option<PathBuf>,
+    canary: Option<String>,
+    commit_per_rule: bool,
+    jobs: Option<usize>,
+    cache: Option<PathBuf>,
+    format: Option<UpgradeFormat>,
+    filter: PathFilter,
+}
+
+/// Rule selection flags (`--only` and `--skip`) shared by commands that
+/// run an upgrade.
+struct RuleSelection {
+    only: Vec<String>,
+    skip: Vec<String>,
+}
+
+impl RuleSelection {
+    fn select(&self, config: &mut UpgradeConfig) -> Result<()> {
+        config
+            .select_rules(&self.only, &self.skip)
+            .context("Invalid rule selection")
+    }
+}
+
+/// File selection flags shared by commands that run rules over a tree.
+struct PathFilter {
+    includes: Vec<String>,
+    excludes: Vec<String>,
+    include_generated: bool,
+    since: Option<String>,
+    files_from: Option<PathBuf>,
+}
+
+impl PathFilter {
+    fn configure(&self, runner: UpgradeRunner, root: &Path) -> Result<UpgradeRunner> {
+        let mut runner = self
+            .includes
+            .iter()
+            .fold(runner, |runner, glob| runner.include(glob));
+        runner = self
+            .excludes
+            .iter()
+            .fold(runner, |runner, glob| runner.exclude(glob));
+        if self.include_generated {
+            runner = runner.include_generated();
+        }
+        let changed = match &self.since {
+            Some(base) => Some(changed_since(root, base)?),
+            None => None,
+        };
+        let listed = match &self.files_from {
+            Some(list) => Some(listed_files(root, list)?),
+            None => None,
+        };
+        let only = match (changed, listed) {
+            (Some(changed), Some(listed)) => Some(
+                changed
+                    .into_iter()
+                    .filter(|path| listed.contains(path))
+                    .collect(),
+            ),
+            (changed, listed) => changed.or(listed),
+        };
+        if let Some(only) = only {
+            runner = runner.only_files(only);
+        }
+        Ok(runner)
+    }
+}
+
+/// The files listed in `list` (`-` for standard input), one per line,
+/// relative to `root`.
+fn listed_files(root: &Path, list: &Path) -> Result<Vec<PathBuf>> {
+    let text = if list == Path::new("-") {
+        std::io::read_to_string(std::io::stdin()).context("Failed to read file list")?
+    } else {
+        std::fs::read_to_string(list)
+            .with_context(|| format!("Failed to read file list {}", list.display()))?
+    };
+    let base = root.canonicalize()?;
+    Ok(text
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty())
+        .filter_map(|line| {
+            let path = Path::new(line);
+            if path.is_absolute() {
+                let path = path.canonicalize().unwrap_or_else(|_| path.to_path_buf());
+                path.strip_prefix(&base).ok().map(Path::to_path_buf)
+            } else {
+                Some(path.strip_prefix(".").unwrap_or(path).to_path_buf())
+            }
+        })
+        .collect())
+}
+
+/// The files under `root` changed since the git ref `base`, relative to
+/// `root`.
+fn changed_since(root: &Path, base: &str) -> Result<Vec<PathBuf>> {
+    let git = GitOps::discover(root).context("Failed to open git repository")?;
+    let workdir = git
+        .workdir()
+        .context("Repository has no working directory")?
+        .canonicalize()?;
+    let root = root.canonicalize()?;
+    let changed = git
+        .changed_since(base)
+        .with_context(|| format!("Failed to list files changed since {}", base))?;
+    Ok(changed
+        .into_iter()
+        .filter_map(|path| {
+            let path = workdir.join(path);
+            path.strip_prefix(&root).ok().map(Path::to_path_buf)
+        })
+        .collect())
+}
+
+/// Outcome of the build and test checks (`None` when a check was not run).
+struct CheckResults {
+    build_passed: Option<bool>,
+    tests_passed: Option<bool>,
+}
+
+impl CheckResults {
+    fn passed(&self) -> bool {
+        self.build_passed != Some(false) && self.tests_passed != Some(false)
+    }
+}
+
+fn cmd_upgrade(
+    config: Option<PathBuf>,
+    path: PathBuf,
+    options: UpgradeOptions,
+    trust: Trust,
+) -> Result<()> {
+    let project = discover_project(&path, trust)?;
+    let format = options
+        .format
+        .or(project.as_ref().map(|p| p.output.into()))
+        .unwrap_or(UpgradeFormat::Text);
+    let mut required = None;
+    let config = match (&options.module, &options.security) {
+        (Some(module), _) => {
+            let shipped = discover_shipped_packs(module, project.as_ref(), &path)?;
+            let plan = shipped_plan(&shipped, !options.require);
+            match format {
+                UpgradeFormat::Text if options.patch.is_none() => println!("{}\n", plan),
+                _ => eprintln!("{}", plan),
+            }
+            let config = shipped.upgrade_config();
+            if options.require {
+                required = Some(shipped);
+            }
+            match config {
+                Some(config) => config,
+                None => return require_module(required.as_ref(), &path),
+            }
+        }
+        (None, Some(advisories)) => {
+            let plan = plan_security_upgrade(
+                config.as_deref(),
+                project.as_ref(),
+                &path,
+                advisories.as_deref(),
+                trust,
+            )?;
+            // Keep stdout a single document
+            match format {
+                UpgradeFormat::Text if options.patch.is_none() => println!("{}\n", plan),
+                _ => eprintln!("{}", plan),
+            }
+            match plan.upgrade_config() {
+                Some(config) => config,
+                None => {
+                    println!("No pack resolves a known advisory");
+                    return Ok(());
+                }
+            }
+        }
+        (None, None) => load_upgrade_config(config.as_deref(), project.as_ref(), trust)?,
+    };
+    let mut config = config;
+    options.rules.select(&mut config)?;
+    let config = if options.reverse {
+        invert(&config)
+    } else {
+        config
+    };
+    if let Some(pinned) = config.engine {
+        warn_unreproducible(
+            &format!("'{}' is pinned to engine semantics {}", config.name, pinned),
+            semantics::unreproducible_since(pinned, &config.extensions),
+        );
+    }
+    let upgrade_name = config.name.clone();
+    let dry_run = options.dry_run || options.patch.is_some();
+    let gopath = project.as_ref().and_then(ProjectConfig::go_path);
+
+    let mut runner = UpgradeRunner::new(config);
+    if let Some(project) = &project {
+        runner = project.configure(runner);
+    }
+    runner = options.filter.configure(runner, &path)?;
+    if dry_run {
+        runner = runner.dry_run();
+    }
+    if options.docs {
+        runner = runner.docs();
+    }
+    if options.resolve_collisions {
+        runner = runner.resolve_collisions();
+    }
+    if options.cleanup {
+        runner = runner.cleanup();
+    }
+    if let Some(jobs) = options.jobs {
+        runner = runner.jobs(jobs);
+    }
+    if let Some(dir) = &options.cache {
+        runner = runner.cache(dir);
+    }
+    // Nothing is written until the idempotence check passes
+    let write_after_check = options.verify_idempotent && !dry_run;
+    if write_after_check {
+        runner = runner.dry_run();
+    }
+    let report = match &options.canary {
+        Some(canary) => {
+            // The canary is always build-checked, even without --verify.
+            let canary_verify = VerifyOptions {
+                command: options.verify.as_ref().and_then(|v| v.command.clone()),
+                fail: true,
+            };
+            // A check that cannot run fails the canary, so its changes are
+            // reverted before the error is reported.
+            let mut check_error = None;
+            let outcome = runner
+                .run_canary(&path, canary, |report| {
+                    println!(
+                        "Canary: modified {} file(s) matching {}",
+                        report.files_modified(),
+                        canary
+                    );
+                    match run_checks(
+                        &path,
+                        &report.edits,
+                        Some(&canary_verify),
+                        options.tests.as_ref(),
+                        gopath.as_ref(),
+                    ) {
+                        Ok(results) => Ok(results.passed()),
+                        Err(e) => {
+                            check_error = Some(e);
+                            Ok(false)
+                        }
+                    }
+                })
+                .context("Upgrade failed")?;
+            if let Some(e) = check_error {
+                return Err(e.context("Canary check failed to run; its changes were reverted"));
+            }
+            match outcome {
+                CanaryOutcome::Passed { mut canary, rest } => {
+                    println!("Canary passed; upgrading the rest of the project");
+                    canary.merge(*rest);
+                    canary
+                }
+                CanaryOutcome::Failed { .. } => {
+                    eprintln!(
+                        "Canary failed; its changes were reverted and the rest of the project was left untouched"
+                    );
+                    std::process::exit(1);
+                }
+            }
+        }
+        None if options.commit_per_rule => commit_each_rule(&runner, &path)?,
+        None => match &options.patch {
+            Some(Some(dir)) => patch_each_rule(&runner, &path, dir)?,
+            _ => runner.run(&path).context("Upgrade failed")?,
+        },
+    };
+    if let Some(dir) = &options.patch {
+        if dir.is_none() {
+            print!("{}", report.patch(&path));
+        }
+        // Keep stdout the patch
+        eprintln!("{}", report.summary);
+        for diagnostic in &report.diagnostics {
+            eprintln!("{}", diagnostic);
+        }
+        return Ok(());
+    }
+
+    let repeated = if write_after_check {
+        write_if_idempotent(&runner, &report)?
+    } else if options.verify_idempotent {
+        runner
+            .verify_idempotent(&report)
+            .context("Idempotence check failed")?
+    } else {
+        Vec::new()
+    };
+    if options.verify_idempotent {
+        if repeated.is_empty() {
+            eprintln!("Idempotent: a second run changes nothing");
+        } else {
+            eprintln!(
+                "Not idempotent: a second run changes {} file(s) again:",
+                repeated.len()
+            );
+            for change in &repeated {
+                eprintln!("  {}", change);
+            }
+        }
+    }
+    if write_after_check && !repeated.is_empty() {
+        eprintln!("No file was written");
+        std::process::exit(1);
+    }
+
+    let stats = options
+        .stats
+        .then(|| MatchStats::new(runner.config(), &report));
+    match format {
+        UpgradeFormat::Json => print_report_json(&upgrade_name, dry_run, &report, stats.as_ref())?,
+        UpgradeFormat::Text => print_report(dry_run, options.cache.is_some(), &report),
+        UpgradeFormat::Markdown => {
+            print!(
+                "{}",
+                MigrationReport::new(&upgrade_name, &path, &report).to_markdown()
+            )
+        }
+        UpgradeFormat::Html => {
+            print!(
+                "{}",
+                MigrationReport::new(&upgrade_name, &path, &report).to_html()
+            )
+        }
+    }
+    if let Some(stats) = &stats {
+        match format {
+            UpgradeFormat::Json => {}
+            UpgradeFormat::Text => println!("\nRule matches:\n{}", stats),
+            // Keep stdout a single document
+            _ => eprintln!("Rule matches:\n{}", stats),
+        }
+    }
+
+    if !dry_run {
+        Journal::open(&path)
+            .record(&upgrade_name, &report)
+            .context("Failed to journal the upgrade")?;
+    }
+
+    if let Some(plan) = options.plan.filter(|_| !dry_run) {
+        ApplyPlan::from_report(&upgrade_name, &path, &report)
+            .save(&plan)
+            .context("Failed to save plan")?;
+    }
+
+    if let Some(bundle) = &options.replay_bundle {
+        ReplayBundle::record(runner.config(), &path, &report)
+            .and_then(|b| b.save(bundle))
+            .context("Failed to save replay bundle")?;
+    }
+
+    if options.llm_fallback {
+        propose_manual_edits(&report, dry_run, format)?;
+    }
+
+    if dry_run {
+        if options.verify.is_some() || options.tests.is_some() {
+            eprintln!("Skipping verification in dry-run mode");
+        }
+        if !repeated.is_empty() {
+            std::process::exit(1);
+        }
+        return Ok(());
+    }
+
+    require_module(required.as_ref(), &path)?;
+    let results = run_checks(
+        &path,
+        &report.edits,
+        options.verify.as_ref(),
+        options.tests.as_ref(),
+        gopath.as_ref(),
+    )?;
+    // A failing build only fails the run with --verify; failing tests always do
+    let build_failed =
+        options.verify.as_ref().is_some_and(|v| v.fail) && results.build_passed == Some(false);
+    let failed = build_failed || results.tests_passed == Some(false);
+
+    if options.record {
+        let mut run = RunRecord::from_report(&upgrade_name, &path, &report);
+        if let Some(passed) = results.tests_passed {
+            run = run.with_tests(passed);
+        }
+        HistoryStore::open_default()?
+            .record(&run)
+            .context("Failed to record run history")?;
+    }
+
+    if failed {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+/// Run the rules of `runner`, a dry run, one at a time over the project at
+/// `path`, writing the changes of each rule that changed files as a patch
+/// into `dir`.
+/// Run `runner` a second time over `report`, a dry run of it, and write
+/// the report's changes only if that changes nothing. Returns the files the
+/// second run changes again; if there are any, no file is written.
+fn write_if_idempotent(
+    runner: &UpgradeRunner,
+    report: &RunReport,
+) -> Result<Vec<SecondPassChange>> {
+    let repeated = runner
+        .verify_idempotent(report)
+        .context("Idempotence check failed")?;
+    if repeated.is_empty()
+        && let Err(e) = report.changes.iter().try_for_each(|change| change.apply())
+    {
+        let _ = report.revert();
+        return Err(e).context("Failed to write the upgrade");
+    }
+    Ok(repeated)
+}
+
+fn patch_each_rule(runner: &UpgradeRunner, path: &Path, dir: &Path) -> Result<RunReport> {
+    // Patches of an earlier run would be applied along with this run's
+    if std::fs::read_dir(dir).is_ok_and(|mut entries| entries.next().is_some()) {
+        anyhow::bail!(
+            "{} is not empty; write the patches to a new or empty directory",
+            dir.display()
+        );
+    }
+    std::fs::create_dir_all(dir).with_context(|| format!("Failed to create {}", dir.display()))?;
+    let mut count = 0;
+    runner
+        .run_each_rule(path, |rule, run| {
+            count += 1;
+            let name: String = rule
+                .rule_id()
+                .chars()
+                .map(|c| {
+                    if c.is_ascii_alphanumeric() || matches!(c, '.' | '_' | '-') {
+                        c
+                    } else {
+                        '-'
+                    }
+                })
+                .collect();
+            let file = dir.join(format!("{:03}-{}.patch", count, name));
+            std::fs::write(&file, run.patch(path))?;
+            eprintln!(
+                "Wrote {} ({} file(s))",
+                file.display(),
+                run.files_modified()
+            );
+            Ok(())
+        })
+        .context("Upgrade failed")
+}
+
+/// Show the edits a language model proposes for the manual sites of the
+/// files `report` changed, applying the ones approved at the prompt. Nothing
+/// is applied in dry-run mode or without a terminal to ask on.
+fn propose_manual_edits(report: &RunReport, dry_run: bool, format: UpgradeFormat) -> Result<()> {
+    use refactor::fallback::{ManualFallback, manual_sites};
+    use std::io::{BufRead, IsTerminal, Write};
+
+    let sites: usize = report
+        .changes
+        .iter()
+        .map(|change| manual_sites(&change.path, &change.transformed).len())
+        .sum();
+    if sites == 0 {
+        return Ok(());
+    }
+    let fallback = ManualFallback::from_env().context("Language model fallback")?;
+    let ask = !dry_run && std::io::stdin().is_terminal();
+    // Keep stdout a single document
+    let mut out: Box<dyn Write> = match format {
+        UpgradeFormat::Text => Box::new(std::io::stdout()),
+        _ => Box::new(std::io::stderr()),
+    };
+    writeln!(
+        out,
+        "\nAsking {} about {} manual site(s)",
+        fallback.model(),
+        sites
+    )?;
+
+    let (mut proposed, mut applied) = (0, 0);
+    'files: for change in &report.changes {
+        for proposal in fallback.propose(&change.path, &change.transformed)? {
+            proposed += 1;
+            let Some(edited) = proposal.apply(&change.transformed) else {
+                continue;
+            };
+            writeln!(
+                out,
+                "\n{}:{}: {}\n{}",
+                change.path.display(),
+                proposal.site.line,
+                proposal.explanation,
+                refactor::diff::colorized_diff(&change.transformed, &edited, &change.path)
+            )?;
+            if !ask {
+                continue;
+            }
+            write!(out, "Apply this edit? [y/N/q] ")?;
+            out.flush()?;
+            let mut answer = String::new();
+            std::io::stdin().lock().read_line(&mut answer)?;
+            match answer.trim() {
+                "y" | "Y" | "yes" => {
+                    let current = std::fs::read_to_string(&change.path)?;
+                    match proposal.apply(&current) {
+                        Some(text) => {
+                            std::fs::write(&change.path, text)?;
+                            applied += 1;
+                        }
+                        None => eprintln!("The site changed since; edit not applied"),
+                    }
+                }
+                "q" | "Q" => break 'files,
+                _ => {}
+            }
+        }
+    }
+    if ask {
+        writeln!(
+            out,
+            "\nApplied {} of {} proposed edit(s)",
+            applied, proposed
+        )?;
+    } else {
+        writeln!(
+            out,
+            "\n{} edit(s) proposed; none applied (approve them at the prompt by running without --dry-run in a terminal)",
+            proposed
+        )?;
+    }
+    Ok(())
+}
+
+/// Apply the rules of `runner` one at a time, committing the files each
+/// rule changed on their own.
+fn commit_each_rule(runner: &UpgradeRunner, path: &Path) -> Result<RunReport> {
+    let git = GitOps::discover(path).context("Failed to open git repository")?;
+    if !git.is_clean()? {
+        anyhow::bail!("--commit-per-rule needs a clean working tree; commit or stash your changes");
+    }
+    runner
+        .run_each_rule(path, |rule, run| {
+            let files = run
+                .changes
+                .iter()
+                .map(|change| change.path.canonicalize())
+                .collect::<std::io::Result<Vec<_>>>()?;
+            git.stage_files(&files.iter().map(PathBuf::as_path).collect::<Vec<_>>())?;
+            let message = rule.commit_message();
+            git.commit(&message)?;
+            println!("Committed {} file(s): {}", files.len(), message);
+            Ok(())
+        })
+        .context("Upgrade failed")
+}
+
+/// Options for the `migrate` command.
+struct MigrateOptions {
+    dry_run: bool,
+    verify: Option<VerifyOptions>,
+    tests: Option<Option<String>>,
+    format: Option<ReportFormat>,
+}
+
+fn cmd_migrate(
+    path: PathBuf,
+    stages: Option<Option<String>>,
+    options: MigrateOptions,
+    trust: Trust,
+) -> Result<()> {
+    let project = discover_project(&path, trust)?
+        .with_context(|| format!("No {} found", refactor::project::PROJECT_CONFIG_FILE))?;
+    if let Some(from) = stages {
+        return cmd_migrate_stages(&path, &project, from, options);
+    }
+    let migration = project
+        .migration()
+        .context("Failed to load the project's migrations")?;
+    let plan = migration.plan(&path).context("Migration failed")?;
+
+    let format = options.format.unwrap_or(project.output.into());
+    match format {
+        ReportFormat::Json => print_report_json("migration", options.dry_run, &plan.report, None)?,
+        ReportFormat::Text => {
+            for step in &plan.steps {
+                println!("{}: {} file(s)", step.name, step.report.files_modified());
+            }
+            print_report(options.dry_run, false, &plan.report);
+        }
+    }
+
+    if options.dry_run {
+        return Ok(());
+    }
+    plan.apply().context("Failed to write the change set")?;
+
+    // A single check of the whole change set; any failure reverts all of it
+    let results = match run_checks(
+        &path,
+        &plan.report.edits,
+        options.verify.as_ref(),
+        options.tests.as_ref(),
+        project.go_path().as_ref(),
+    ) {
+        Ok(results) => results,
+        Err(e) => {
+            plan.report.revert()?;
+            return Err(e.context("Verification failed to run; the change set was reverted"));
+        }
+    };
+    if !results.passed() {
+        plan.report.revert()?;
+        eprintln!(
+            "Verification failed; reverted {} file(s)",
+            plan.report.files_modified()
+        );
+        std::process::exit(1);
+    }
+    Journal::open(&path)
+        .record("migration", &plan.report)
+        .context("Failed to journal the migration")?;
+    Ok(())
+}
+
+fn cmd_migrate_stages(
+    path: &Path,
+    project: &ProjectConfig,
+    from: Option<String>,
+    options: MigrateOptions,
+) -> Result<()> {
+    let mut chain = project
+        .chain()
+        .context("Failed to load the project's stages")?;
+    if let Some(from) = from {
+        chain = chain.from_version(from);
+    }
+    let format = options.format.unwrap_or(project.output.into());
+    let stage_json = |step: &StepReport| {
+        serde_json::json!({
+            "stage": step.name,
+            "files_modified": step.report.files_modified(),
+            "edits": step.report.edits,
+            "diagnostics": step.report.diagnostics,
+        })
+    };
+
+    if options.dry_run {
+        let plan = chain.plan(path).context("Migration failed")?;
+        match format {
+            ReportFormat::Json => {
+                let stages: Vec<_> = plan.steps.iter().map(stage_json).collect();
+                println!(
+                    "{}",
+                    serde_json::to_string_pretty(&serde_json::json!({"stages": stages}))?
+                );
+            }
+            ReportFormat::Text => {
+                for step in &plan.steps {
+                    println!("{}: {} file(s)", step.name, step.report.files_modified());
+                }
+                print_report(true, false, &plan.report);
+            }
+        }
+        return Ok(());
+    }
+
+    // Each stage is checked on its own, so a failure names the release
+    let report = chain
+        .run(path, |step| {
+            if matches!(format, ReportFormat::Text) {
+                println!("{}: {} file(s)", step.name, step.report.files_modified());
+            }
+            let results = run_checks(
+                path,
+                &step.report.edits,
+                options.verify.as_ref(),
+                options.tests.as_ref(),
+                project.go_path().as_ref(),
+            )
+            .map_err(|e| RefactorError::TransformFailed {
+                message: format!(
+                    "verification of stage '{}' failed to run: {:#}",
+                    step.name, e
+                ),
+            })?;
+            if results.passed() {
+                Journal::open(path).record(&step.name, &step.report)?;
+            }
+            Ok(results.passed())
+        })
+        .context("Migration failed")?;
+
+    match format {
+        ReportFormat::Json => {
+            let stages: Vec<_> = report.stages.iter().map(stage_json).collect();
+            let json = serde_json::json!({
+                "stages": stages,
+                "skipped": report.skipped,
+                "failed": report.failed.as_ref().map(|step| step.name.clone()),
+            });
+            println!("{}", serde_json::to_string_pretty(&json)?);
+        }
+        ReportFormat::Text => {
+            for name in &report.skipped {
+                println!("{}: skipped (already applied)", name);
+            }
+        }
+    }
+    if let Some(failed) = &report.failed {
+        eprintln!(
+            "Verification of stage '{}' failed; reverted its {} file(s). Earlier stages stay applied.",
+            failed.name,
+            failed.report.files_modified()
+        );
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+fn cmd_undo(path: PathBuf, id: Option<u64>, list: bool, force: bool) -> Result<()> {
+    let journal = Journal::open(&path);
+    if list {
+        let entries = journal.entries().context("Failed to read the journal")?;
+        if entries.is_empty() {
+            println!("The journal is empty");
+        }
+        for entry in entries.iter().rev() {
+            println!("{}", entry);
+        }
+        return Ok(());
+    }
+
+    let entry = match id {
+        Some(id) => journal.get(id)?,
+        None => journal
+            .latest()
+            .context("Failed to read the journal")?
+            .context("The journal is empty; nothing to undo")?,
+    };
+    let report = journal
+        .undo(&entry, force)
+        .with_context(|| format!("Failed to undo {}", entry))?;
+    println!("{}", report);
+    if !report.undone() {
+        eprintln!(
+            "Nothing restored: files changed since {}; use --force to restore them anyway",
+            entry
+        );
+        std::process::exit(1);
+    }
+    println!("Undid {}", entry);
+    Ok(())
+}
+
+fn cmd_estimate(
+    config: Option<PathBuf>,
+    path: PathBuf,
+    weights: Option<PathBuf>,
+    format: Option<ReportFormat>,
+    rules: RuleSelection,
+    filter: PathFilter,
+    trust: Trust,
+) -> Result<()> {
+    let project = discover_project(&path, trust)?;
+    let mut config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+    rules.select(&mut config)?;
+    let weights = match (&weights, &project) {
+        (Some(file), _) => EffortWeights::from_file(file).context("Failed to load weights")?,
+        (None, Some(project)) => project.estimate.clone(),
+        (None, None) => EffortWeights::default(),
+    };
+
+    let mut runner = UpgradeRunner::new(config).dry_run();
+    if let Some(project) = &project {
+        runner = project.configure(runner);
+    }
+    runner = filter.configure(runner, &path)?;
+    let report = runner.run(&path).context("Dry run failed")?;
+    let estimate = EffortEstimate::new(&report, &weights).root(&path);
+
+    match format
+        .or(project.as_ref().map(|p| p.output.into()))
+        .unwrap_or(ReportFormat::Text)
+    {
+        ReportFormat::Json => println!("{}", serde_json::to_string_pretty(&estimate)?),
+        ReportFormat::Text => println!("{}", estimate),
+    }
+    Ok(())
+}
+
+fn cmd_check(
+    config: Option<PathBuf>,
+    path: PathBuf,
+    fail_on: RuleSeverity,
+    format: Option<ReportFormat>,
+    rules: RuleSelection,
+    filter: PathFilter,
+    trust: Trust,
+) -> Result<()> {
+    let project = discover_project(&path, trust)?;
+    let mut config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+    rules.select(&mut config)?;
+
+    let mut runner = UpgradeRunner::new(config.clone()).dry_run();
+    if let Some(project) = &project {
+        runner = project.configure(runner);
+    }
+    runner = filter.configure(runner, &path)?;
+    let report = runner.run(&path).context("Dry run failed")?;
+    let check = CheckReport::new(&config, &report);
+
+    match format
+        .or(project.as_ref().map(|p| p.output.into()))
+        .unwrap_or(ReportFormat::Text)
+    {
+        ReportFormat::Json => println!("{}", serde_json::to_string_pretty(&check)?),
+        ReportFormat::Text => println!("{}", check),
+    }
+    if check.fails(fail_on) {
+        let code = match check.highest() {
+            Some(RuleSeverity::Error) => 2,
+            _ => 1,
+        };
+        std::process::exit(code);
+    }
+    Ok(())
+}
+
+fn cmd_todos(path: PathBuf, rules: Vec<String>, check: bool, format: ReportFormat) -> Result<()> {
+    let todos: Vec<_> = scan_todos(&path)
+        .context("Failed to scan for markers")?
+        .into_iter()
+        .filter(|todo| {
+            rules.is_empty() || todo.rule.as_ref().is_some_and(|rule| rules.contains(rule))
+        })
+        .collect();
+
+    match format {
+        ReportFormat::Json => println!("{}", serde_json::to_string_pretty(&todos)?),
+        ReportFormat::Text => {
+            for todo in &todos {
+                println!("{}", todo);
+            }
+            println!("{} marker(s) left for manual work", todos.len());
+        }
+    }
+    if check && !todos.is_empty() {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+fn cmd_impact(
+    config: Option<PathBuf>,
+    path: PathBuf,
+    format: Option<ReportFormat>,
+    rules: RuleSelection,
+    filter: PathFilter,
+    trust: Trust,
+) -> Result<()> {
+    let project = discover_project(&path, trust)?;
+    let mut config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+    rules.select(&mut config)?;
+
+    let mut runner = UpgradeRunner::new(config).dry_run();
+    if let Some(project) = &project {
+        runner = project.configure(runner);
+    }
+    runner = filter.configure(runner, &path)?;
+    let report = runner.run(&path).context("Dry run failed")?;
+    let impact = ImpactReport::new(&path, &report).context("Failed to build the call graph")?;
+
+    match format
+        .or(project.as_ref().map(|p| p.output.into()))
+        .unwrap_or(ReportFormat::Text)
+    {
+        ReportFormat::Json => println!("{}", serde_json::to_string_pretty(&impact)?),
+        ReportFormat::Text => println!("{}", impact),
+    }
+    Ok(())
+}
+
+/// Select the packs (`--config`, or the project config's rule files) that
+/// resolve known advisories of the project at `path`.
+fn plan_security_upgrade(
+    config: Option<&Path>,
+    project: Option<&ProjectConfig>,
+    path: &Path,
+    advisories: Option<&Path>,
+    trust: Trust,
+) -> Result<SecurityPlan> {
+    let packs = match (config, project) {
+        (Some(config), project) => {
+            let config = load_pack(config, trust).context("Failed to load upgrade config")?;
+            vec![match project {
+                Some(project) => project.filter_rules(config),
+                None => config,
+            }]
+        }
+        (None, Some(project)) => project
+            .packs()
+            .context("Failed to load the project's rule files")?
+            .into_iter()
+            .map(|config| config.allow_plugins(trust.plugins))
+            .collect(),
+        (None, None) => anyhow::bail!(
+            "No --config given and no {} found",
+            refactor::project::PROJECT_CONFIG_FILE
+        ),
+    };
+    let advisories = match advisories {
+        Some(file) => refactor::security::load(file).context("Failed to load advisories")?,
+        None => refactor::security::scan(path).context("Failed to scan for advisories")?,
+    };
+    SecurityPlan::new(packs, &advisories).context("Failed to order packs")
+}
+
+/// Find the packs the dependency upgrade `module` (`module@version`) ships
+/// for the project at `path`, without the rules the project disables.
+fn discover_shipped_packs(
+    module: &str,
+    project: Option<&ProjectConfig>,
+    path: &Path,
+) -> Result<ShippedPacks> {
+    let upgrade = ModuleUpgrade::parse(module)?;
+    let mut shipped = refactor::pack::discover(path, &upgrade)
+        .with_context(|| format!("Failed to find the packs {} ships", module))?;
+    if let Some(project) = project {
+        shipped.packs = shipped
+            .packs
+            .into_iter()
+            .map(|pack| project.filter_rules(pack))
+            .collect();
+    }
+    Ok(shipped)
+}
+
+/// Require the version of a dependency upgrade in the project at `path`,
+/// after its packs were applied, if `--require` was given.
+fn require_module(shipped: Option<&ShippedPacks>, path: &Path) -> Result<()> {
+    let Some(shipped) = shipped else {
+        return Ok(());
+    };
+    let commands = shipped
+        .require(path)
+        .with_context(|| format!("Failed to require {}@{}", shipped.module, shipped.version))?;
+    println!(
+        "Required {}@{}: {}",
+        shipped.module,
+        shipped.version,
+        commands.join(", ")
+    );
+    Ok(())
+}
+
+/// Describe the packs selected for a dependency upgrade, with the command
+/// requiring the new version if `hint`.
+fn shipped_plan(shipped: &ShippedPacks, hint: bool) -> String {
+    let from = shipped.current.as_deref().unwrap_or("(not required)");
+    if shipped.packs.is_empty() {
+        return format!(
+            "{} {} -> {}: no shipped pack applies (looked in {}/)",
+            shipped.module,
+            from,
+            shipped.version,
+            refactor::pack::SHIPPED_PACK_DIR
+        );
+    }
+    let mut lines = vec![format!(
+        "{} {} -> {}: {} shipped pack(s)",
+        shipped.module,
+        from,
+        shipped.version,
+        shipped.packs.len()
+    )];
+    for (index, pack) in shipped.packs.iter().enumerate() {
+        match &pack.to_version {
+            Some(to) => lines.push(format!("{}. {} (to {})", index + 1, pack.name, to)),
+            None => lines.push(format!("{}. {}", index + 1, pack.name)),
+        }
+    }
+    if hint {
+        lines.push(format!(
+            "Then require the new version with: go get {}@{}",
+            shipped.module, shipped.version
+        ));
+    }
+    lines.join("\n")
+}
+
+/// Load the pack at `source`: a local file, whose plugins `trust` may allow,
+/// or a pinned pack fetched from a URL or OCI registry, which never runs
+/// plugins.
+fn load_pack(source: &Path, trust: Trust) -> refactor::error::Result<UpgradeConfig> {
+    let source = PackSource::from_path(source)?;
+    match &source {
+        PackSource::File(path) => Ok(refactor::pack::load(path)?.allow_plugins(trust.plugins)),
+        _ => PackRegistry::new()?.load(&source),
+    }
+}
+
+/// Load the upgrade config at `path`, letting it start its plugins if
+/// `trust` allows plugins.
+fn load_config(path: impl AsRef<Path>, trust: Trust) -> refactor::error::Result<UpgradeConfig> {
+    Ok(UpgradeConfig::from_file(path)?.allow_plugins(trust.plugins))
+}
+
+/// The nearest project config of `path`, running its packages driver if
+/// `trust` allows it.
+fn discover_project(path: impl AsRef<Path>, trust: Trust) -> Result<Option<ProjectConfig>> {
+    let project = ProjectConfig::discover(path).context("Failed to load project config")?;
+    Ok(project.map(|project| project.allow_packages_driver(trust.packages_driver)))
+}
+
+/// Load the upgrade from `--config`, or from the project config's rule files,
+/// letting it start its plugins if `trust` allows plugins.
+fn load_upgrade_config(
+    config: Option<&Path>,
+    project: Option<&ProjectConfig>,
+    trust: Trust,
+) -> Result<UpgradeConfig> {
+    Ok(match (config, project) {
+        (Some(config), project) => {
+            let config = load_pack(config, trust).context("Failed to load upgrade config")?;
+            match project {
+                Some(project) => project.filter_rules(config),
+                None => config,
+            }
+        }
+        (None, Some(project)) => project
+            .upgrade_config()
+            .context("Failed to load the project's rule files")?
+            .allow_plugins(trust.plugins),
+        (None, None) => anyhow::bail!(
+            "No --config given and no {} found",
+            refactor::project::PROJECT_CONFIG_FILE
+        ),
+    })
+}
+
+fn print_report(dry_run: bool, cached: bool, report: &RunReport) {
+    if dry_run {
+        for change in &report.changes {
+            println!(
+                "{}",
+                refactor::diff::colorized_diff(&change.original, &change.transformed, &change.path)
+            );
+        }
+        println!("\n{}", report.summary);
+    } else {
+        println!("Modified {} file(s)", report.files_modified());
+    }
+    if cached {
+        println!(
+            "{} of {} file(s) unchanged since the last run (cached)",
+            report.cache_hits, report.files_scanned
+        );
+    }
+    if report.generated_skipped > 0 {
+        println!(
+            "Skipped {} generated file(s) (use --include-generated to rewrite them)",
+            report.generated_skipped
+        );
+    }
+
+    for partial in &report.partial_variants {
+        eprintln!("Warning: {}", partial);
+    }
+    for collision in &report.collisions {
+        eprintln!("Warning: {}", collision);
+    }
+    for overlap in report.overlaps.iter().filter(|o| o.conflict) {
+        eprintln!("Warning: {}", overlap);
+    }
+    if !report.cleanups.is_empty() {
+        println!(
+            "Cleaned up {} unused declaration(s):",
+            report.cleanups.len()
+        );
+        for cleanup in &report.cleanups {
+            println!("  {}", cleanup);
+        }
+    }
+
+    let tagged: Vec<_> = report.todos.iter().filter(|t| t.rule.is_some()).collect();
+    if !tagged.is_empty() {
+        println!("Left {} TODO marker(s) for manual work:", tagged.len());
+        for todo in tagged {
+            println!("  {}", todo);
+        }
+    }
+
+    for diagnostic in &report.diagnostics {
+        eprintln!("{}", diagnostic);
+    }
+    if !report.diagnostics.is_empty() {
+        eprintln!("{} suggestion(s)", report.diagnostics.len());
+    }
+}
+
+fn print_report_json(
+    upgrade: &str,
+    dry_run: bool,
+    report: &RunReport,
+    stats: Option<&MatchStats>,
+) -> Result<()> {
+    let files: Vec<&Path> = report.changes.iter().map(|c| c.path.as_path()).collect();
+    let mut json = serde_json::json!({
+        "upgrade": upgrade,
+        "dry_run": dry_run,
+        "files_scanned": report.files_scanned,
+        "files_modified": files,
+        "insertions": report.summary.insertions,
+        "deletions": report.summary.deletions,
+        "edits": report.edits,
+        "diagnostics": report.diagnostics,
+        "manual_todos": report.manual_todos,
+        "todos": report.todos,
+        "cache_hits": report.cache_hits,
+        "generated_skipped": report.generated_skipped,
+        "engine_semantics": report.semantics,
+        "partial_variants": report.partial_variants,
+        "collisions": report.collisions,
+        "cleanups": report.cleanups,
+        "overlaps": report.overlaps,
+    });
+    if let Some(stats) = stats {
+        json["stats"] = serde_json::to_value(stats)?;
+    }
+    println!("{}", serde_json::to_string_pretty(&json)?);
+    Ok(())
+}
+
+/// Run the requested build verification and tests, printing their results.
+/// A GOPATH-mode project is checked with the go command in GOPATH mode.
+fn run_checks(
+    path: &Path,
+    edits: &[RuleEdit],
+    verify: Option<&VerifyOptions>,
+    tests: Option<&Option<String>>,
+    gopath: Option<&GoPath>,
+) -> Result<CheckResults> {
+    let mut results = CheckResults {
+        build_passed: None,
+        tests_passed: None,
+    };
+
+    if let Some(verify) = verify {
+        let check = match (&verify.command, gopath) {
+            (Some(command), Some(gopath)) => BuildCheck::from_command_line(command).map(|check| {
+                gopath
+                    .env()
+                    .into_iter()
+                    .fold(check, |check, (key, value)| check.env(key, value))
+            }),
+            (Some(command), None) => BuildCheck::from_command_line(command),
+            (None, _) => BuildCheck::detect(path).or_else(|| gopath.map(BuildCheck::gopath)),
+        };
+        // Example and tooling programs the root build skips are built on
+        // their own, unless a custom command was given
+        let programs = match &verify.command {
+            Some(_) => Vec::new(),
+            None => skipped_programs(path)?,
+        };
+        if check.is_none() && programs.is_empty() {
+            anyhow::bail!("No verification command given and none could be detected");
+        }
+
+        let mut passed = true;
+        if let Some(check) = check {
+            let mut verification = check.run(path).context("Verification failed to run")?;
+            verification.implicate(edits);
+            println!("{}", verification);
+            passed &= verification.passed();
+        }
+        for program in programs {
+            let mut verification = program
+                .check()
+                .run(path.join(&program.module))
+                .with_context(|| format!("Verification of {} failed to run", program))?;
+            verification.implicate(edits);
+            println!("{}: {}", program, verification);
+            passed &= verification.passed();
+        }
+        results.build_passed = Some(passed);
+    }
+
+    if let Some(pattern) = tests {
+        let suite = TestSuite::detect(path, pattern.as_deref())
+            .or_else(|| gopath.map(|gopath| TestSuite::gopath(gopath, pattern.as_deref())))
+            .context("Could not detect how to run tests for this project")?;
+        let result = suite.run(path).context("Tests failed to run")?;
+        println!("{}", result);
+        results.tests_passed = Some(result.passed());
+    }
+
+    Ok(results)
+}
+
+/// The example and tooling programs under `path` that `go build ./...`
+/// does not build, without those the project config skips.
+fn skipped_programs(path: &Path) -> Result<Vec<AuxiliaryProgram>> {
+    let project = ProjectConfig::discover(path).context("Failed to load project config")?;
+    let skip = project.map(|p| p.skip_programs).unwrap_or_default();
+    Ok(AuxiliaryProgram::discover(path, &skip)
+        .context("Failed to find example and tooling programs")?
+        .into_iter()
+        .filter(|program| program.exclusion.is_some())
+        .collect())
+}
+
+fn cmd_run(
+    exprs: Vec<String>,
+    path: PathBuf,
+    extensions: Vec<String>,
+    dry_run: bool,
+    jobs: Option<usize>,
+    filter: PathFilter,
+) -> Result<()> {
+    // Accept Go-style package patterns such as ./... for the whole tree.
+    let path = match path.to_str().and_then(|p| p.strip_suffix("...")) {
+        Some(dir) if dir.is_empty() || dir.ends_with('/') => {
+            PathBuf::from(if dir.is_empty() { "." } else { dir })
+        }
+        _ => path,
+    };
+    let extensions = if extensions.is_empty() {
+        LanguageRegistry::new()
+            .all()
+            .iter()
+            .flat_map(|lang| lang.extensions())
+            .map(|ext| ext.to_string())
+            .collect()
+    } else {
+        extensions
+    };
+
+    let mut config = UpgradeConfig::new("run", "Ad-hoc rewrite").with_extensions(extensions);
+    for expr in &exprs {
+        config.add_transform(refactor::transform::structural::parse_rewrite(expr)?);
+    }
+
+    let mut runner = filter.configure(UpgradeRunner::new(config), &path)?;
+    if dry_run {
+        runner = runner.dry_run();
+    }
+    if let Some(jobs) = jobs {
+        runner = runner.jobs(jobs);
+    }
+    let report = runner.run(&path).context("Rewrite failed")?;
+
+    if dry_run {
+        for change in &report.changes {
+            println!(
+                "{}",
+                refactor::diff::colorized_diff(&change.original, &change.transformed, &change.path)
+            );
+        }
+        println!("\n{}", report.summary);
+    } else {
+        println!(
+            "Rewrote {} site(s) in {} file(s)",
+            report.edits.len(),
+            report.files_modified()
+        );
+    }
+    Ok(())
+}
+
+fn cmd_filter(
+    config: Option<PathBuf>,
+    filename: Option<PathBuf>,
+    lang: Option<String>,
+    trust: Trust,
+) -> Result<()> {
+    use std::io::{Read, Write};
+
+    let filename = filter_filename(filename, lang.as_deref())?;
+    let project = discover_project(".", trust)?;
+    let config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+
+    let mut source = String::new();
+    std::io::stdin()
+        .read_to_string(&mut source)
+        .context("Failed to read stdin")?;
+    let report = UpgradeRunner::new(config)
+        .run_source(&filename, &source)
+        .context("Rewrite failed")?;
+
+    let output = report
+        .changes
+        .first()
+        .map_or(source.as_str(), |change| change.transformed.as_str());
+    std::io::stdout().write_all(output.as_bytes())?;
+
+    for diagnostic in &report.diagnostics {
+        eprintln!("{}", diagnostic);
+    }
+    Ok(())
+}
+
+/// The path `filter` treats its input as: `filename`, or `stdin` with the
+/// first extension of `lang`, or `stdin.go`.
+fn filter_filename(filename: Option<PathBuf>, lang: Option<&str>) -> Result<PathBuf> {
+    Ok(match (filename, lang) {
+        (Some(filename), _) => filename,
+        (None, Some(lang)) => {
+            let registry = LanguageRegistry::new();
+            let language = registry.by_name(lang).with_context(|| {
+                let names: Vec<&str> = registry.all().iter().map(|l| l.name()).collect();
+                format!(
+                    "Unknown language '{}' (supported: {})",
+                    lang,
+                    names.join(", ")
+                )
+            })?;
+            PathBuf::from(format!("stdin.{}", language.extensions()[0]))
+        }
+        (None, None) => PathBuf::from("stdin.go"),
+    })
+}
+
+fn cmd_watch(config: PathBuf, path: PathBuf, interval: u64, trust: Trust) -> Result<()> {
+    let mut watcher =
+        refactor::watch::FileWatcher::new([&config, &path]).context("Failed to watch files")?;
+    println!(
+        "Watching {} and {} (Ctrl-C to stop)",
+        config.display(),
+        path.display()
+    );
+
+    loop {
+        // Rule files are often mid-edit, so report errors and keep watching.
+        if let Err(e) = preview_upgrade(&config, &path, trust) {
+            eprintln!("error: {:#}", e);
+        }
+        let changed = watcher.wait(std::time::Duration::from_millis(interval))?;
+        println!("\n--- {} file(s) changed, re-running ---\n", changed.len());
+    }
+}
+
+fn preview_upgrade(config: &Path, path: &Path, trust: Trust) -> Result<()> {
+    let config = load_config(config, trust).context("Failed to load upgrade config")?;
+    let report = UpgradeRunner::new(config)
+        .dry_run()
+        .run(path)
+        .context("Upgrade failed")?;
+
+    for change in &report.changes {
+        println!(
+            "{}",
+            refactor::diff::colorized_diff(&change.original, &change.transformed, &change.path)
+        );
+    }
+    for diagnostic in &report.diagnostics {
+        println!("{}", diagnostic);
+    }
+    println!(
+        "{} ({} suggestion(s))",
+        report.summary,
+        report.diagnostics.len()
+    );
+    Ok(())
+}
+
+fn cmd_advise(
+    config: Option<PathBuf>,
+    path: PathBuf,
+    output: Option<PathBuf>,
+    trust: Trust,
+) -> Result<()> {
+    let project = discover_project(&path, trust)?;
+    let config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+    let mut runner = UpgradeRunner::new(config);
+    if let Some(project) = &project {
+        runner = project.configure(runner);
+    }
+    let advisor = Advisor::with_runner(runner).context("Failed to compile rules")?;
+    let hints = advisor.advise(&path).context("Failed to collect hints")?;
+    let output = output.unwrap_or_else(|| path.join(HINTS_FILE));
+    hints
+        .save(&output)
+        .with_context(|| format!("Failed to write {}", output.display()))?;
+
+    let automatic = hints.hints.iter().filter(|hint| hint.automatic).count();
+    println!(
+        "Wrote {} hint(s) in {} file(s) to {} ({} automatic, {} manual)",
+        hints.hints.len(),
+        hints.files(),
+        output.display(),
+        automatic,
+        hints.hints.len() - automatic
+    );
+    Ok(())
+}
+
+fn cmd_quickfix(config: PathBuf, trust: Trust) -> Result<()> {
+    let config = load_config(&config, trust).context("Failed to load upgrade config")?;
+    let fixer = QuickFixer::new(config).context("Failed to compile rules")?;
+    fixer
+        .serve(std::io::stdin().lock(), std::io::stdout().lock())
+        .context("Quick-fix session failed")?;
+    Ok(())
+}
+
+fn is_vettool(args: &[String]) -> bool {
+    match args {
+        [flag] if flag.starts_with("-V=") || flag == "-flags" => true,
+        [flags @ .., cfg] => cfg.ends_with(".cfg") && flags.iter().all(|f| f.starts_with('-')),
+        [] => false,
+    }
+}
+
+fn cmd_vettool(args: &[String]) -> Result<()> {
+    use refactor::vet::{self, VetAnalyzer, VetConfig};
+
+    match args[0].as_str() {
+        flag if flag.starts_with("-V=") => {
+            println!("refactor version {}", env!("CARGO_PKG_VERSION"));
+            return Ok(());
+        }
+        "-flags" => {
+            println!("{}", vet::FLAGS);
+            return Ok(());
+        }
+        _ => {}
+    }
+    let (cfg, flags) = args.split_last().unwrap();
+    let enabled = |name: &str| {
+        flags.iter().any(|flag| {
+            let flag = flag.trim_start_matches('-');
+            flag == name || flag == format!("{}=true", name)
+        })
+    };
+    let trust = Trust {
+        plugins: enabled("allow_plugins"),
+        packages_driver: false,
+    };
+    let package =
+        VetConfig::from_file(cfg).with_context(|| format!("Failed to read vet config {}", cfg))?;
+    let project = discover_project(&package.dir, trust)?;
+    let config = std::env::var_os(vet::CONFIG_VAR).map(PathBuf::from);
+    let config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+    let mut runner = UpgradeRunner::new(config);
+    if let Some(project) = &project {
+        runner = project.configure(runner);
+    }
+    let root = project.map_or_else(|| package.dir.clone(), |project| project.root);
+    let analyzer = VetAnalyzer::with_runner(runner)
+        .context("Failed to compile rules")?
+        .root(root);
+    let diagnostics = analyzer
+        .run(&package)
+        .with_context(|| format!("Failed to vet {}", package.import_path))?;
+
+    if enabled("fix") {
+        vet::apply_fixes(&diagnostics).context("Failed to apply fixes")?;
+    } else if enabled("json") {
+        if !diagnostics.is_empty() {
+            println!("{}", vet::json_tree(&package.id, &diagnostics)?);
+        }
+    } else if !diagnostics.is_empty() {
+        for diagnostic in &diagnostics {
+            eprintln!("{}", diagnostic);
+        }
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+fn cmd_lsp(config: Option<PathBuf>, trust: Trust) -> Result<()> {
+    let project = discover_project(".", trust)?;
+    let config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+    let fixer = QuickFixer::new(config).context("Failed to compile rules")?;
+    refactor::lsp::LspServer::new(fixer)
+        .serve(std::io::stdin().lock(), std::io::stdout().lock())
+        .context("Language server session failed")?;
+    Ok(())
+}
+
+fn cmd_serve(listen: Option<String>) -> Result<()> {
+    let daemon = refactor::daemon::Daemon::new();
+    match listen {
+        Some(addr) => {
+            eprintln!("Listening on {}", addr);
+            daemon
+                .listen(&addr)
+                .with_context(|| format!("Failed to serve on {}", addr))?;
+        }
+        None => daemon
+            .serve(std::io::stdin().lock(), std::io::stdout().lock())
+            .context("Daemon session failed")?,
+    }
+    Ok(())
+}
+
+fn cmd_mcp() -> Result<()> {
+    refactor::daemon::McpServer::new()
+        .serve(std::io::stdin().lock(), std::io::stdout().lock())
+        .context("MCP session failed")?;
+    Ok(())
+}
+
+fn cmd_replay(bundle: PathBuf, file: Option<PathBuf>) -> Result<()> {
+    let bundle = ReplayBundle::load(&bundle).context("Failed to load replay bundle")?;
+    if bundle.version_differs() {
+        eprintln!(
+            "Warning: bundle was recorded with refactor {}, replaying with {}",
+            bundle.engine_version,
+            env!("CARGO_PKG_VERSION")
+        );
+    }
+    if let Some(recorded) = bundle.semantics {
+        warn_unreproducible(
+            &format!("bundle was recorded with engine semantics {}", recorded),
+            bundle.semantics_changes(),
+        );
+    }
+    if let Some(file) = &file
+        && !bundle.files.iter().any(|f| &f.path == file)
+    {
+        anyhow::bail!("{} is not in the replay bundle", file.display());
+    }
+
+    let replays = bundle.replay().context("Replay failed")?;
+    let mut diverged = 0;
+    for replay in replays
+        .iter()
+        .filter(|r| file.as_ref().is_none_or(|f| &r.path == f))
+    {
+        print!("{}", replay);
+        if replay.diverged() {
+            diverged += 1;
+            print!(
+                "{}",
+                refactor::diff::colorized_diff(&replay.expected, &replay.output, &replay.path)
+            );
+        }
+    }
+    if diverged > 0 {
+        eprintln!("{} file(s) no longer match the recorded output", diverged);
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+fn cmd_bugreport(
+    file: PathBuf,
+    config: Option<PathBuf>,
+    introduces: Option<String>,
+    output: PathBuf,
+    no_minimize: bool,
+    trust: Trust,
+) -> Result<()> {
+    let project = discover_project(".", trust)?;
+    let config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+    let source = std::fs::read_to_string(&file)
+        .with_context(|| format!("Failed to read {}", file.display()))?;
+
+    let failure = match introduces {
+        Some(text) => Failure::Introduces(text),
+        None => Failure::detect(&config, &file, &source),
+    };
+    let report = if no_minimize {
+        BugReport::new(&config, &file, &source, failure)
+    } else {
+        BugReport::minimize(&config, &file, &source, failure)
+    }
+    .context("Failed to build bug report")?;
+    report.save(&output).context("Failed to save bug report")?;
+
+    println!("{}", report);
+    println!(
+        "Saved {}; review it for anything private before attaching it to an issue",
+        output.display()
+    );
+    Ok(())
+}
+
+/// How `minimize` reduces a file and where the result goes.
+struct MinimizeOptions {
+    lines_only: bool,
+    redact: bool,
+    fixture: Option<PathBuf>,
+}
+
+fn cmd_minimize(
+    file: PathBuf,
+    config: Option<PathBuf>,
+    rules: Vec<String>,
+    introduces: Option<String>,
+    options: MinimizeOptions,
+    trust: Trust,
+) -> Result<()> {
+    let project = discover_project(".", trust)?;
+    let mut config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+    if !rules.is_empty() {
+        config
+            .transforms
+            .retain(|rule| rule.id.as_ref().is_some_and(|id| rules.contains(id)));
+        if config.transforms.is_empty() {
+            anyhow::bail!("No rule has id {}", rules.join(" or "));
+        }
+    }
+    let source = std::fs::read_to_string(&file)
+        .with_context(|| format!("Failed to read {}", file.display()))?;
+
+    let failure = match introduces {
+        Some(text) => Failure::Introduces(text),
+        None => Failure::detect(&config, &file, &source),
+    };
+    let mut minimizer =
+        Minimizer::new(|candidate: &str| failure.reproduces(&config, &file, candidate));
+    if options.lines_only {
+        minimizer = minimizer.lines_only();
+    }
+    if options.redact {
+        minimizer = minimizer.redact();
+    }
+    let snippet = minimizer
+        .minimize(&source)
+        .with_context(|| format!("Cannot minimize {} ({})", file.display(), failure))?;
+    eprintln!(
+        "Reduced {} from {} to {} line(s) in {} check(s)",
+        file.display(),
+        source.lines().count(),
+        snippet.lines().count(),
+        minimizer.checks()
+    );
+
+    let Some(dir) = options.fixture else {
+        print!("{}", snippet);
+        return Ok(());
+    };
+    let expected = UpgradeRunner::new(config)
+        .include_generated()
+        .run_source(&file, &snippet)?
+        .changes
+        .into_iter()
+        .next()
+        .map_or_else(|| snippet.clone(), |change| change.transformed);
+    let name = file
+        .file_stem()
+        .and_then(|s| s.to_str())
+        .unwrap_or("fixture");
+    let ext = file.extension().and_then(|e| e.to_str()).unwrap_or("txt");
+    let (input, expected) = Fixture {
+        input: snippet,
+        expected,
+    }
+    .write(&dir, name, ext)
+    .context("Failed to write fixture")?;
+    println!("Wrote {} and {}", input.display(), expected.display());
+    Ok(())
+}
+
+fn cmd_attribution(plan: PathBuf, path: PathBuf, human_only: bool) -> Result<()> {
+    let plan = ApplyPlan::load(&plan).context("Failed to load plan")?;
+    let report = plan.attribute(&path).context("Attribution failed")?;
+
+    if human_only {
+        for file in report.human_edited() {
+            for hunk in file.human_hunks() {
+                println!("{}:{}", file.path.display(), hunk);
+            }
+        }
+    } else {
+        println!("{}", report);
+    }
+    Ok(())
+}
+
+fn cmd_history(
+    store: Option<PathBuf>,
+    repo: Option<String>,
+    upgrade: Option<String>,
+    latest: bool,
+    format: HistoryFormat,
+) -> Result<()> {
+    let store = match store {
+        Some(path) => HistoryStore::open(path),
+        None => HistoryStore::open_default()?,
+    };
+
+    let mut query = HistoryQuery::new();
+    if let Some(repo) = repo {
+        query = query.repo(repo);
+    }
+    if let Some(upgrade) = upgrade {
+        query = query.upgrade(upgrade);
+    }
+    let mut records = store.query(&query).context("Failed to read history")?;
+    if latest {
+        let mut seen = std::collections::HashSet::new();
+        records.reverse();
+        records.retain(|r| seen.insert(r.repo.clone()));
+        records.reverse();
+    }
+
+    match format {
+        HistoryFormat::Csv => print!("{}", refactor::history::to_csv(&records)),
+        HistoryFormat::Json => println!("{}", serde_json::to_string_pretty(&records)?),
+        HistoryFormat::Table => {
+            println!(
+                "{:<10}  {:<20}  {:<20}  {:>6}  {:>6}  {:>6}",
+                "DATE", "REPO", "UPGRADE", "FIXED", "OPEN", "TODOS"
+            );
+            for r in &records {
+                println!(
+                    "{:<10}  {:<20}  {:<20}  {:>6}  {:>6}  {:>6}",
+                    r.date(),
+                    r.repo,
+                    r.upgrade,
+                    r.fixed,
+                    r.findings_open,
+                    r.manual_todos
+                );
+            }
+        }
+    }
+
+    Ok(())
+}
+
+fn cmd_conventions(pack: PathBuf, path: PathBuf, fix: bool, dry_run: bool) -> Result<()> {
+    let pack = ConventionPack::from_file(&pack).context("Failed to load convention pack")?;
+
+    let report = if fix {
+        pack.fix(&path, dry_run)
+    } else {
+        pack.check(&path)
+    }
+    .context("Convention check failed")?;
+
+    if dry_run {
+        for change in &report.changes {
+            println!(
+                "{}",
+                refactor::diff::colorized_diff(&change.original, &change.transformed, &change.path)
+            );
+        }
+    }
+    println!("{}", report);
+
+    // Unlike upgrades, remaining convention violations fail the run.
+    if !report.is_clean() {
+        std::process::exit(report.exit_code());
+    }
+    Ok(())
+}
+
+fn cmd_issues(
+    config: PathBuf,
+    path: PathBuf,
+    github: Option<String>,
+    jira: Option<(String, String)>,
+    label: String,
+    link_base: Option<String>,
+    trust: Trust,
+) -> Result<()> {
+    let config = load_config(&config, trust).context("Failed to load upgrade config")?;
+    let rules: Vec<String> = config.transforms.iter().map(|rule| rule.name()).collect();
+    let report = UpgradeRunner::new(config)
+        .dry_run()
+        .run(&path)
+        .context("Upgrade failed")?;
+
+    // Issues of rules from other configs sharing the label stay open.
+    let mut sync = IssueSync::new(&path).rules(rules);
+    let tracker: Box<dyn IssueTracker> = if let Some(github) = github {
+        let (owner, repo) = github
+            .split_once('/')
+            .context("--github must be in owner/repo form")?;
+        sync = sync.link_base(
+            link_base.unwrap_or_else(|| format!("https://github.com/{}/{}/blob/HEAD", owner, repo)),
+        );
+        let client = GitHubClient::from_env().context("Failed to create GitHub client")?;
+        Box::new(GitHubTracker::new(client, owner, repo).label(label))
+    } else if let Some((url, project)) = jira {
+        if let Some(base) = link_base {
+            sync = sync.link_base(base);
+        }
+        Box::new(JiraTracker::from_env(url, project)?.label(label))
+    } else {
+        anyhow::bail!("Either --github or --jira-url is required");
+    };
+
+    let result = sync
+        .sync(tracker.as_ref(), &report.diagnostics)
+        .context("Issue sync failed")?;
+    println!("{}", result);
+    Ok(())
+}
+
+/// Options of the pr command.
+struct PrOptions {
+    repo: Option<String>,
+    clone: bool,
+    branch: Option<String>,
+    base: Option<String>,
+    title: Option<String>,
+    draft: bool,
+    dry_run: bool,
+    verify: Option<VerifyOptions>,
+    tests: Option<Option<String>>,
+    rules: RuleSelection,
+}
+
+fn cmd_pr(config: Option<PathBuf>, path: PathBuf, options: PrOptions, trust: Trust) -> Result<()> {
+    let full_name = match options
+        .repo
+        .or_else(|| std::env::var("GITHUB_REPOSITORY").ok())
+    {
+        Some(name) => name,
+        None => GitOps::discover(&path)
+            .and_then(|git| git.remote_url("origin"))
+            .ok()
+            .and_then(|url| repo_from_url(&url))
+            .context("No repository given; pass --repo owner/repo")?,
+    };
+    let (owner, name) = full_name
+        .split_once('/')
+        .context("--repo must be in owner/repo form")?;
+
+    let client = if options.dry_run && !options.clone {
+        None
+    } else {
+        Some(GitHubClient::from_env().context("Failed to create GitHub client")?)
+    };
+    let path = match &client {
+        Some(client) if options.clone => {
+            std::fs::create_dir_all(&path)?;
+            client
+                .clone_by_name(owner, name, &path)
+                .with_context(|| format!("Failed to clone {}", full_name))?
+        }
+        _ => path,
+    };
+    let base = match options.base {
+        Some(base) => base,
+        None => GitOps::open(&path)
+            .and_then(|git| git.current_branch())
+            .context("Cannot tell the base branch; pass --base")?,
+    };
+
+    let project = discover_project(&path, trust)?;
+    let mut config = load_upgrade_config(config.as_deref(), project.as_ref(), trust)?;
+    options.rules.select(&mut config)?;
+    let upgrade_name = config.name.clone();
+    let mut runner = UpgradeRunner::new(config);
+    if let Some(project) = &project {
+        runner = project.configure(runner);
+    }
+    if options.dry_run {
+        runner = runner.dry_run();
+    }
+    let report = runner.run(&path).context("Upgrade failed")?;
+
+    let description = UpgradeDescription::new(&upgrade_name, &path, &report);
+    let title = options.title.unwrap_or_else(|| description.title());
+    let body = description.to_string();
+    let branch = options
+        .branch
+        .unwrap_or_else(|| format!("refactor/{}", branch_slug(&upgrade_name)));
+
+    if report.changes.is_empty() {
+        println!("No changes; no pull request opened");
+        return Ok(());
+    }
+    if options.dry_run {
+        println!("Would open {} <- {} on {}\n", base, branch, full_name);
+        println!("# {}\n\n{}", title, body);
+        return Ok(());
+    }
+
+    // A change that does not build is reverted rather than proposed
+    let checks = run_checks(
+        &path,
+        &report.edits,
+        options.verify.as_ref(),
+        options.tests.as_ref(),
+        None,
+    );
+    if !checks.as_ref().is_ok_and(CheckResults::passed) {
+        report.revert().context("Failed to revert the upgrade")?;
+        checks?;
+        anyhow::bail!("Verification failed; the upgrade was reverted and no pull request opened");
+    }
+
+    let git = GitOps::open(&path)
+        .context("Failed to open git repository")?
+        .with_auth(GitAuth::github_token()?);
+    git.create_and_checkout(&branch)
+        .with_context(|| format!("Failed to create branch {}", branch))?;
+    // Only the upgraded files: other changes in the checkout stay out
+    let workdir = git
+        .workdir()
+        .context("Repository has no working directory")?
+        .to_path_buf();
+    let root = workdir.canonicalize()?;
+    let mut changed = Vec::new();
+    for change in &report.changes {
+        let file = change.path.canonicalize()?;
+        changed.push(workdir.join(file.strip_prefix(&root).unwrap_or(&file)));
+    }
+    git.stage_files(&changed.iter().map(PathBuf::as_path).collect::<Vec<_>>())?;
+    git.commit(&title).context("Failed to commit")?;
+    git.push_with_upstream("origin", &branch)
+        .with_context(|| format!("Failed to push {}", branch))?;
+
+    let mut request = CreatePullRequest::new(&title, &body, &branch, &base);
+    if options.draft {
+        request = request.draft();
+    }
+    let pr = client
+        .expect("client is created unless dry-running")
+        .create_pull_request(owner, name, request)
+        .context("Failed to open pull request")?;
+    println!(
+        "Opened {} ({} file(s) changed)",
+        pr.html_url,
+        report.files_modified()
+    );
+    Ok(())
+}
+
+/// The owner/repo of a GitHub remote URL (HTTPS or SSH).
+fn repo_from_url(url: &str) -> Option<String> {
+    let path = url.trim_end_matches('/').trim_end_matches(".git");
+    let mut segments = path.rsplit(['/', ':']);
+    let name = segments.next().filter(|s| !s.is_empty())?;
+    let owner = segments.next().filter(|s| !s.is_empty())?;
+    Some(format!("{}/{}", owner, name))
+}
+
+/// A branch-name-safe form of an upgrade name.
+fn branch_slug(name: &str) -> String {
+    name.split(|c: char| !c.is_ascii_alphanumeric() && c != '.' && c != '_')
+        .filter(|part| !part.is_empty())
+        .collect::<Vec<_>>()
+        .join("-")
+        .to_lowercase()
+}
+
+/// Options of the fleet command.
+struct FleetOptions {
+    repos: Vec<String>,
+    repos_file: Option<PathBuf>,
+    org: Option<String>,
+    search: Option<String>,
+    workspace: Option<PathBuf>,
+    dry_run: bool,
+    jobs: Option<usize>,
+    format: ReportFormat,
+}
+
+fn cmd_fleet(config: PathBuf, options: FleetOptions, trust: Trust) -> Result<()> {
+    let config = load_config(&config, trust).context("Failed to load upgrade config")?;
+    let mut runner = UpgradeRunner::new(config);
+    if options.dry_run {
+        runner = runner.dry_run();
+    }
+    if let Some(jobs) = options.jobs {
+        runner = runner.jobs(jobs);
+    }
+
+    let mut entries = options.repos;
+    if let Some(file) = &options.repos_file {
+        let list = std::fs::read_to_string(file)
+            .with_context(|| format!("Failed to read {}", file.display()))?;
+        entries.extend(
+            list.lines()
+                .map(|line| line.split('#').next().unwrap_or_default().trim())
+                .filter(|line| !line.is_empty())
+                .map(String::from),
+        );
+    }
+
+    // Existing directories are local checkouts; anything else is owner/repo
+    let (local, remote): (Vec<String>, Vec<String>) = entries
+        .into_iter()
+        .partition(|entry| Path::new(entry).is_dir() || !entry.contains('/'));
+    let mut fleet = local.into_iter().fold(Fleet::new(runner), Fleet::path);
+    if !remote.is_empty() || options.org.is_some() || options.search.is_some() {
+        let client = GitHubClient::from_env().context("Failed to create GitHub client")?;
+        let mut repos = Vec::new();
+        for full_name in &remote {
+            let (owner, name) = full_name
+                .split_once('/')
+                .context("Repositories must be paths or owner/repo")?;
+            // One missing or inaccessible repository fails only itself
+            match client.get_repo(owner, name) {
+                Ok(repo) => repos.push(repo),
+                Err(e) => fleet = fleet.failed(full_name.as_str(), e),
+            }
+        }
+        if let Some(org) = &options.org {
+            repos.extend(
+                client
+                    .list_org_repos(org)?
+                    .into_iter()
+                    .filter(|repo| !repo.archived && !repo.fork),
+            );
+        }
+        if let Some(query) = &options.search {
+            repos.extend(client.search_repos(query)?);
+        }
+        fleet = fleet.github(client, repos);
+    }
+    if let Some(workspace) = options.workspace {
+        fleet = fleet.workspace(workspace);
+    }
+    if fleet.is_empty() {
+        anyhow::bail!("No repositories given");
+    }
+
+    let report = fleet.run().context("Fleet upgrade failed")?;
+    match options.format {
+        ReportFormat::Json => println!("{}", report.to_json()?),
+        ReportFormat::Text => println!("{}", report),
+    }
+    if !report.passed() {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+fn cmd_pack_diff(old: PathBuf, new: PathBuf, path: Option<PathBuf>, trust: Trust) -> Result<()> {
+    let old = load_pack(&old, trust).context("Failed to load old pack")?;
+    let new = load_pack(&new, trust).context("Failed to load new pack")?;
+
+    let diff = refactor::pack::PackDiff::between(&old, &new);
+    println!("{}", diff);
+
+    if let Some(path) = path {
+        println!();
+        for impact in diff.impact(&old, &new, &path)? {
+            println!("{}", impact);
+        }
+    }
+    Ok(())
+}
+
+fn cmd_pack_symbols(pack: PathBuf, format: SymbolFormat, trust: Trust) -> Result<()> {
+    let config = load_pack(&pack, trust).context("Failed to load pack")?;
+    let map = SymbolMap::from_config(&config);
+    match format {
+        SymbolFormat::Json => println!("{}", map.to_json()?),
+        SymbolFormat::Csv => print!("{}", map.to_csv()),
+    }
+    Ok(())
+}
+
+fn cmd_pack_order(paths: Vec<PathBuf>, trust: Trust) -> Result<()> {
+    let packs = paths
+        .iter()
+        .map(|path| {
+            load_pack(path, trust)
+                .with_context(|| format!("Failed to load pack {}", path.display()))
+        })
+        .collect::<Result<Vec<_>>>()?;
+    let ordered = refactor::pack::application_order(packs).context("Failed to order packs")?;
+    for (index, pack) in ordered.iter().enumerate() {
+        if pack.requires.is_empty() {
+            println!("{}. {}", index + 1, pack.name);
+        } else {
+            println!(
+                "{}. {} (requires {})",
+                index + 1,
+                pack.name,
+                pack.requires.join(", ")
+            );
+        }
+    }
+    Ok(())
+}
+
+fn cmd_pack_extract(
+    path: PathBuf,
+    name: Option<String>,
+    to_version: Option<String>,
+    output: Option<PathBuf>,
+) -> Result<()> {
+    let extractor = DeprecationExtractor::new()
+        .scan_dir(&path)
+        .context("Failed to scan library source")?;
+    let name = name.unwrap_or_else(|| {
+        let dir = path.canonicalize().unwrap_or_else(|_| path.clone());
+        format!(
+            "{}-deprecations",
+            dir.file_name()
+                .and_then(|n| n.to_str())
+                .unwrap_or("library")
+        )
+    });
+    let mut config = extractor.to_config(&name, "Replace deprecated APIs");
+    config.to_version = to_version;
+
+    let renames = extractor
+        .deprecations()
+        .iter()
+        .filter(|d| d.replacement.is_some())
+        .count();
+    eprintln!(
+        "Extracted {} rule(s): {} rename(s), {} to review",
+        config.transforms.len(),
+        renames,
+        config.transforms.len() - renames
+    );
+    match output {
+        Some(output) => {
+            config.to_yaml(&output)?;
+            eprintln!("Wrote {}", output.display());
+        }
+        None => print!("{}", serde_yaml::to_string(&config)?),
+    }
+    Ok(())
+}
+
+fn cmd_pack_invert(pack: PathBuf, output: Option<PathBuf>, trust: Trust) -> Result<()> {
+    let config = load_upgrade_config(Some(&pack), None, trust)?;
+    let inverse = invert(&config);
+    eprintln!(
+        "Inverted {} of {} rule(s)",
+        inverse.transforms.len(),
+        config.transforms.len()
+    );
+    match output {
+        Some(output) => {
+            inverse.to_yaml(&output)?;
+            eprintln!("Wrote {}", output.display());
+        }
+        None => print!("{}", serde_yaml::to_string(&inverse)?),
+    }
+    Ok(())
+}
+
+fn cmd_pack_recipe(
+    name: Option<String>,
+    params: Vec<String>,
+    output: Option<PathBuf>,
+) -> Result<()> {
+    let Some(name) = name else {
+        for recipe in recipe::recipes() {
+            println!("{}\n", recipe);
+        }
+        return Ok(());
+    };
+    let values = params
+        .iter()
+        .map(|param| {
+            param
+                .split_once('=')
+                .with_context(|| format!("Expected NAME=VALUE, got '{}'", param))
+        })
+        .collect::<Result<Vec<_>>>()?;
+    let config = recipe::find(&name)?.config(values)?;
+    match output {
+        Some(output) => {
+            config.to_yaml(&output)?;
+            eprintln!("Wrote {}", output.display());
+        }
+        None => print!("{}", serde_yaml::to_string(&config)?),
+    }
+    Ok(())
+}
+
+/// The inverse of `config`, warning about the rules left out.
+fn invert(config: &UpgradeConfig) -> UpgradeConfig {
+    let inversion = Inversion::of(config);
+    for (rule, reason) in &inversion.skipped {
+        eprintln!("Warning: rule '{}' cannot be inverted: {}", rule, reason);
+    }
+    inversion.config
+}
+
+fn cmd_rollout_plan(
+    pack: PathBuf,
+    path: PathBuf,
+    mut options: RolloutOptions,
+    output: Option<PathBuf>,
+    trust: Trust,
+) -> Result<()> {
+    let project = discover_project(&path, trust)?;
+    let config = load_upgrade_config(Some(&pack), project.as_ref(), trust)?;
+    let mut runner = UpgradeRunner::new(config.clone()).dry_run();
+    if let Some(project) = &project {
+        runner = project.configure(runner);
+    }
+    let report = runner.run(&path).context("Dry run failed")?;
+
+    options.owners = CodeOwners::discover(&path).context("Failed to read CODEOWNERS")?;
+    options.root = path;
+    let plan = RolloutPlan::generate(pack, &config, &report, &options);
+    match output {
+        Some(output) => {
+            plan.save(&output).context("Failed to save rollout plan")?;
+            println!(
+                "Wrote {} phase(s) to {}",
+                plan.phases.len(),
+                output.display()
+            );
+        }
+        None => print!("{}", serde_yaml::to_string(&plan)?),
+    }
+    Ok(())
+}
+
+fn cmd_rollout_show(plan: PathBuf, format: PlanFormat) -> Result<()> {
+    let plan = RolloutPlan::load(&plan).context("Failed to load rollout plan")?;
+    match format {
+        PlanFormat::Markdown => print!("{}", plan.to_markdown()),
+        PlanFormat::Mermaid => print!("{}", plan.to_mermaid()),
+    }
+    Ok(())
+}
+
+fn cmd_rollout_run(
+    plan_path: PathBuf,
+    path: PathBuf,
+    phase: Option<String>,
+    dry_run: bool,
+    trust: Trust,
+) -> Result<()> {
+    let mut plan = RolloutPlan::load(&plan_path).context("Failed to load rollout plan")?;
+    let phase = match &phase {
+        Some(name) => plan
+            .phase(name)
+            .with_context(|| format!("No phase named '{}'", name))?,
+        None => match plan.next_phase() {
+            Some(phase) => phase,
+            None => {
+                println!("All phases of {} are done", plan.name);
+                return Ok(());
+            }
+        },
+    }
+    .clone();
+
+    let project = discover_project(&path, trust)?;
+    let config = load_upgrade_config(Some(&plan.pack), project.as_ref(), trust)?;
+    let config = plan.phase_config(&phase, &config)?;
+    let gopath = project.as_ref().and_then(ProjectConfig::go_path);
+    let mut runner = UpgradeRunner::new(config);
+    if let Some(project) = &project {
+        runner = project.configure(runner);
+    }
+    runner = phase
+        .include
+        .iter()
+        .fold(runner, |runner, glob| runner.include(glob));
+    runner = phase
+        .exclude
+        .iter()
+        .fold(runner, |runner, glob| runner.exclude(glob));
+    if dry_run {
+        runner = runner.dry_run();
+    }
+
+    println!("{}: {} rule(s)", phase.name, phase.rules.len());
+    let report = runner.run(&path).context("Phase failed")?;
+    print_report(dry_run, false, &report);
+    if dry_run {
+        return Ok(());
+    }
+
+    let verify = phase.gate.build.then(|| VerifyOptions {
+        command: phase.gate.command.clone(),
+        fail: true,
+    });
+    let tests = phase.gate.tests.then_some(None);
+    // A gate that cannot run fails the phase too
+    let results = match run_checks(
+        &path,
+        &report.edits,
+        verify.as_ref(),
+        tests.as_ref(),
+        gopath.as_ref(),
+    ) {
+        Ok(results) => results,
+        Err(e) => {
+            report.revert().context("Failed to revert the phase")?;
+            return Err(e.context(format!(
+                "{} gate failed to run; its changes were reverted",
+                phase.name
+            )));
+        }
+    };
+    if !results.passed() {
+        report.revert().context("Failed to revert the phase")?;
+        eprintln!(
+            "{} did not pass its gate; its changes were reverted",
+            phase.name
+        );
+        std::process::exit(1);
+    }
+
+    // Only a phase that passed its gate is applied, and can be undone
+    let upgrade_name = format!("{} ({})", plan.name, phase.name);
+    Journal::open(&path)
+        .record(&upgrade_name, &report)
+        .context("Failed to journal the phase")?;
+    plan.complete(&phase.name)?;
+    plan.save(&plan_path)
+        .context("Failed to save rollout plan")?;
+    match plan.next_phase() {
+        Some(next) => println!("{} done; next: {}", phase.name, next.name),
+        None => println!("{} done; the rollout is complete", phase.name),
+    }
+    Ok(())
+}
+
+/// Warn that the engine can no longer follow older semantics for `changes`.
+fn warn_unreproducible(context: &str, changes: Vec<&SemanticsChange>) {
+    if changes.is_empty() {
+        return;
+    }
+    eprintln!("Warning: {}; these later changes still apply:", context);
+    for change in changes {
+        eprintln!("  {}", change);
+    }
+}
+
+fn cmd_lint_rules(files: Vec<PathBuf>, format: ReportFormat, trust: Trust) -> Result<()> {
+    let files = if files.is_empty() {
+        let project = discover_project(".", trust)?.with_context(|| {
+            format!(
+                "No rule files given and no {} found",
+                refactor::project::PROJECT_CONFIG_FILE
+            )
+        })?;
+        // Remote packs are checked by their publishers
+        project
+            .rule_files
+            .iter()
+            .filter_map(|file| match PackSource::from_path(file) {
+                Ok(PackSource::File(path)) => Some(project.root.join(path)),
+                _ => None,
+            })
+            .collect()
+    } else {
+        files
+    };
+
+    let mut findings = Vec::new();
+    for file in &files {
+        findings.extend(
+            lint::lint_file(file).with_context(|| format!("Failed to read {}", file.display()))?,
+        );
+    }
+    let errors = findings
+        .iter()
+        .filter(|finding| finding.level == LintLevel::Error)
+        .count();
+    match format {
+        ReportFormat::Json => println!("{}", serde_json::to_string_pretty(&findings)?),
+        ReportFormat::Text => {
+            for finding in &findings {
+                println!("{}", finding);
+            }
+            println!(
+                "{} error(s), {} warning(s) in {} rule file(s)",
+                errors,
+                findings.len() - errors,
+                files.len()
+            );
+        }
+    }
+    if errors > 0 {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+fn cmd_semantics(since: Option<SemanticsVersion>, format: ReportFormat) -> Result<()> {
+    let changes: Vec<&SemanticsChange> = match since {
+        Some(version) => semantics::changes_since(version).collect(),
+        None => semantics::CHANGELOG.iter().collect(),
+    };
+    match format {
+        ReportFormat::Json => {
+            let json = serde_json::json!({
+                "current": semantics::CURRENT,
+                "changes": changes,
+            });
+            println!("{}", serde_json::to_string_pretty(&json)?);
+        }
+        ReportFormat::Text => {
+            println!("Engine semantics {}", semantics::CURRENT);
+            for change in changes {
+                let note = if change.reproducible {
+                    ""
+                } else {
+                    " (applies to packs pinned to older versions too)"
+                };
+                println!("  {}{}", change, note);
+            }
+        }
+    }
+    Ok(())
+}
+
+fn cmd_analyze(
+    module: String,
+    from: String,
+    to: String,
+    output: Option<PathBuf>,
+    draft_rules: bool,
+    internal: bool,
+) -> Result<()> {
+    let analyzer = if internal {
+        LibraryAnalyzer::new(&module)?
+            .for_extensions(vec!["go"])
+            .internal(true)
+    } else {
+        with_vendor(
+            LibraryAnalyzer::from_module(&module),
+            &std::env::current_dir()?,
+        )
+    };
+    let mut config = analyzer
+        .analyze_to_config(&from, &to)
+        .with_context(|| format!("Failed to analyze {} {} -> {}", module, from, to))?;
+    eprintln!(
+        "Generated {} rule(s) from {} API change(s)",
+        config.transforms.len(),
+        config.changes.len()
+    );
+    if draft_rules {
+        let drafted = RuleDrafter::from_env()?
+            .draft_into(&mut config)
+            .context("Failed to draft rules")?;
+        eprintln!(
+            "Drafted {} rule(s) for review (ids starting with {}); they only suggest until switched to mode: apply",
+            drafted, DRAFT_PREFIX
+        );
+    }
+    match output {
+        Some(output) => {
+            config.to_yaml(&output)?;
+            eprintln!("Wrote {}", output.display());
+        }
+        None => print!("{}", serde_yaml::to_string(&config)?),
+    }
+    Ok(())
+}
+
+/// `analyzer`, reading the versions of its module that the Go module
+/// containing `client` vendors from its `vendor/` directory.
+fn with_vendor(analyzer: LibraryAnalyzer, client: &Path) -> LibraryAnalyzer {
+    match GoVendor::discover(client) {
+        Some(vendor) => {
+            eprintln!(
+                "Using the module versions vendored in {}",
+                vendor.dir().display()
+            );
+            analyzer.vendor(vendor)
+        }
+        None => analyzer,
+    }
+}
+
+/// Where `apidiff` reads the library's versions: the repository at `path`,
+/// or the Go module `module` from the module proxy.
+struct ApidiffSource {
+    path: PathBuf,
+    module: Option<String>,
+}
+
+/// What `apidiff` reports besides the changes: a migration guide written to
+/// `guide`, and the broken implementers of the client at `client`.
+struct ApidiffOutputs {
+    guide: Option<PathBuf>,
+    client: Option<PathBuf>,
+}
+
+fn cmd_apidiff(
+    from: String,
+    to: String,
+    source: ApidiffSource,
+    extensions: Vec<String>,
+    release: Option<ReleaseLevel>,
+    outputs: ApidiffOutputs,
+    format: ReportFormat,
+) -> Result<()> {
+    let path = source.path;
+    let mut analyzer = match &source.module {
+        Some(module) => {
+            let client = match &outputs.client {
+                Some(client) => client.clone(),
+                None => std::env::current_dir()?,
+            };
+            with_vendor(LibraryAnalyzer::from_module(module), &client)
+        }
+        None => LibraryAnalyzer::new(&path)?,
+    };
+    if !extensions.is_empty() {
+        analyzer = analyzer.for_extensions(extensions.iter().map(String::as_str).collect());
+    }
+    let diff = analyzer.api_diff(&from, &to)?;
+    let release = release
+        .map(Compatibility::from)
+        .or_else(|| release_level(&from, &to));
+    let violations = release.map_or_else(Vec::new, |release| diff.violations(release));
+    let implementers = match &outputs.client {
+        Some(client) => diff
+            .implementers(client)
+            .context("Failed to scan the client")?,
+        None => Vec::new(),
+    };
+
+    if let Some(guide) = outputs.guide {
+        let library = match &source.module {
+            Some(_) => analyzer.library_name().to_string(),
+            None => path
+                .canonicalize()
+                .ok()
+                .and_then(|path| {
+                    path.file_name()
+                        .map(|name| name.to_string_lossy().into_owned())
+                })
+                .unwrap_or_else(|| "the library".to_string()),
+        };
+        std::fs::write(&guide, diff.migration_guide(&library))
+            .with_context(|| format!("Failed to write {}", guide.display()))?;
+        eprintln!("Wrote migration guide to {}", guide.display());
+    }
+
+    match format {
+        ReportFormat::Json => {
+            let json = serde_json::json!({
+                "from": diff.from,
+                "to": diff.to,
+                "required": diff.required().bump(),
+                "release": release.map(|release| release.bump()),
+                "changes": diff.entries,
+                "violations": violations.len(),
+                "implementers": outputs.client.as_ref().map(|_| &implementers),
+            });
+            println!("{}", serde_json::to_string_pretty(&json)?);
+        }
+        ReportFormat::Text => {
+            println!("{}", diff);
+            if let Some(client) = &outputs.client {
+                println!(
+                    "\n{} type(s) of {} implement a changed interface and break",
+                    implementers.len(),
+                    client.display()
+                );
+                for implementer in &implementers {
+                    println!("\n{}\n\n{}", implementer, implementer.stubs());
+                }
+            }
+        }
+    }
+
+    if let Some(release) = release {
+        for entry in &violations {
+            eprintln!("Error: {}", entry.violation(release));
+        }
+    } else {
+        eprintln!(
+            "Warning: cannot tell the release level of {} -> {}; use --release to check it",
+            from, to
+        );
+    }
+    if !violations.is_empty() {
+        std::process::exit(1);
+    }
+    Ok(())
+}
+
+fn cmd_languages() -> Result<()> {
+    let registry = LanguageRegistry::new();
+    println!("Supported languages:");
+    for lang in registry.all() {
+        println!(
+            "  {} (extensions: {})",
+            lang.name(),
+            lang.extensions().join(", ")
+        );
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_filter_filename() {
+        let path = filter_filename(Some(PathBuf::from("src/main.py")), None).unwrap();
+        assert_eq!(path, Path::new("src/main.py"));
+        assert_eq!(filter_filename(None, None).unwrap(), Path::new("stdin.go"));
+        assert_eq!(
+            filter_filename(None, Some("go")).unwrap(),
+            Path::new("stdin.go")
+        );
+        assert_eq!(
+            filter_filename(None, Some("python")).unwrap(),
+            Path::new("stdin.py")
+        );
+
+        let error = filter_filename(None, Some("cobol")).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Unknown language 'cobol' (supported: rust, typescript, python, go, java, csharp, ruby)"
+        );
+    }
+
+    #[test]
+    fn test_write_if_idempotent() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let file = dir.path().join("main.go");
+        let source = "c := Client(addr)\ndefer c.Close()\n";
+        std::fs::write(&file, source).unwrap();
+        let replace = |pattern: &str, replacement: &str| TransformSpec::ReplacePattern {
+            pattern: pattern.to_string(),
+            replacement: replacement.to_string(),
+        };
+
+        // A second run would rename NewClient( again, so nothing is written
+        let mut config = UpgradeConfig::new("test", "").with_extensions(vec!["go".to_string()]);
+        config.add_transform(replace(r"Client\(", "NewClient("));
+        config.add_transform(replace(r"\bClose\(", "Shutdown("));
+        let runner = UpgradeRunner::new(config).dry_run();
+        let report = runner.run(dir.path()).unwrap();
+        assert_eq!(report.changes.len(), 1);
+        let repeated = write_if_idempotent(&runner, &report).unwrap();
+        assert_eq!(repeated.len(), 1);
+        assert_eq!(std::fs::read_to_string(&file).unwrap(), source);
+
+        let mut config = UpgradeConfig::new("test", "").with_extensions(vec!["go".to_string()]);
+        config.add_transform(replace(r"\bClose\(", "Shutdown("));
+        let runner = UpgradeRunner::new(config).dry_run();
+        let report = runner.run(dir.path()).unwrap();
+        assert!(write_if_idempotent(&runner, &report).unwrap().is_empty());
+        assert_eq!(
+            std::fs::read_to_string(&file).unwrap(),
+            "c := Client(addr)\ndefer c.Shutdown()\n"
+        );
+    }
+
+    #[test]
+    fn test_filter_aliases() {
+        let cli = Cli::try_parse_from([
+            "refactor",
+            "apply",
+            "--stdin",
+            "--lang=go",
+            "--rules=upgrade.yaml",
+        ])
+        .unwrap();
+        let Commands::Filter {
+            config,
+            filename,
+            lang,
+            stdin,
+        } = cli.command
+        else {
+            panic!("apply is not filter");
+        };
+        assert_eq!(config, Some(PathBuf::from("upgrade.yaml")));
+        assert_eq!(filename, None);
+        assert_eq!(lang.as_deref(), Some("go"));
+        assert!(stdin);
+    }
 }
@@ -0,0 +1,230 @@
+//! Gating CI on the matches of an upgrade left in the code.
+//!
+//! Each rule declares a [`RuleSeverity`]: `info`, `warn` (the default) or
+//! `error`. [`CheckReport`] turns a dry run into findings, one per site a
+//! rule matches, whether the upgrade would rewrite it or only reports it,
+//! each with the severity of its rule. A CI job fails when the highest
+//! severity reaches its threshold, so uses of a deprecated API can be
+//! warned about first and blocked once the API is removed.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::{RuleSeverity, UpgradeConfig};
+//! use refactor::check::CheckReport;
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let config = UpgradeConfig::from_file("upgrade.yaml")?;
+//! let report = UpgradeRunner::new(config.clone()).dry_run().run("./project")?;
+//! let check = CheckReport::new(&config, &report);
+//! println!("{}", check);
+//! if check.fails(RuleSeverity::Error) {
+//!     std::process::exit(2);
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::Serialize;
+use std::collections::{HashMap, HashSet};
+use std::fmt;
+use std::path::{Path, PathBuf};
+
+use crate::analyzer::{RuleSeverity, TransformRule, UpgradeConfig};
+use crate::runner::RunReport;
+
+/// A site a rule matches.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct CheckFinding {
+    /// File containing the match.
+    pub path: PathBuf,
+    /// 1-based line of the match.
+    pub line: usize,
+    /// 1-based column of the match, if known.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub column: Option<usize>,
+    /// Name of the rule.
+    pub rule: String,
+    /// Severity of the rule.
+    pub severity: RuleSeverity,
+    /// The rule's message, or what it does.
+    pub message: String,
+    /// Whether `upgrade` rewrites the match.
+    pub fixable: bool,
+}
+
+impl fmt::Display for CheckFinding {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}:{}", self.path.display(), self.line)?;
+        if let Some(column) = self.column {
+            write!(f, ":{}", column)?;
+        }
+        write!(f, ": {}: [{}] {}", self.severity, self.rule, self.message)?;
+        if self.fixable {
+            write!(f, " (fixed by upgrade)")?;
+        }
+        Ok(())
+    }
+}
+
+/// The findings of a dry run, in file order.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct CheckReport {
+    /// Every site a rule matches.
+    pub findings: Vec<CheckFinding>,
+}
+
+impl CheckReport {
+    /// The findings of `report`, a dry run of `config`.
+    pub fn new(config: &UpgradeConfig, report: &RunReport) -> Self {
+        let rules: HashMap<String, &TransformRule> = config
+            .transforms
+            .iter()
+            .map(|rule| (rule.name(), rule))
+            .collect();
+        let finding = |rule: &str, path: &Path, line, column, fixable| {
+            let found = rules.get(rule);
+            CheckFinding {
+                path: path.to_path_buf(),
+                line,
+                column,
+                rule: rule.to_string(),
+                severity: found.map_or(RuleSeverity::default(), |r| r.severity),
+                message: found
+                    .and_then(|r| r.message.clone())
+                    .or_else(|| found.map(|r| r.spec.summary()))
+                    .unwrap_or_default(),
+                fixable,
+            }
+        };
+
+        // A rule that both rewrites and reports a site is one finding
+        let edited: HashSet<(&str, &Path, usize)> = report
+            .edits
+            .iter()
+            .map(|e| (e.rule.as_str(), e.path.as_path(), e.line))
+            .collect();
+        let mut reported = HashSet::new();
+        let mut findings: Vec<CheckFinding> = report
+            .diagnostics
+            .iter()
+            .map(|d| {
+                let key = (d.rule.as_str(), d.path.as_path(), d.line);
+                reported.insert(key);
+                let mut found = finding(
+                    &d.rule,
+                    &d.path,
+                    d.line,
+                    Some(d.column),
+                    edited.contains(&key),
+                );
+                if !d.message.is_empty() {
+                    found.message = d.message.clone();
+                }
+                found
+            })
+            .collect();
+        findings.extend(
+            report
+                .edits
+                .iter()
+                .filter(|e| !reported.contains(&(e.rule.as_str(), e.path.as_path(), e.line)))
+                .map(|e| finding(&e.rule, &e.path, e.line, None, true)),
+        );
+        findings.sort_by(|a, b| (&a.path, a.line).cmp(&(&b.path, b.line)));
+        Self { findings }
+    }
+
+    /// The highest severity found, if anything was.
+    pub fn highest(&self) -> Option<RuleSeverity> {
+        self.findings.iter().map(|f| f.severity).max()
+    }
+
+    /// Returns true if a finding is at least as serious as `threshold`.
+    pub fn fails(&self, threshold: RuleSeverity) -> bool {
+        self.highest().is_some_and(|highest| highest >= threshold)
+    }
+
+    /// The number of findings of `severity`.
+    pub fn count(&self, severity: RuleSeverity) -> usize {
+        self.findings
+            .iter()
+            .filter(|f| f.severity == severity)
+            .count()
+    }
+}
+
+impl fmt::Display for CheckReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for finding in &self.findings {
+            writeln!(f, "{}", finding)?;
+        }
+        write!(
+            f,
+            "{} error(s), {} warning(s), {} info",
+            self.count(RuleSeverity::Error),
+            self.count(RuleSeverity::Warn),
+            self.count(RuleSeverity::Info)
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::TransformSpec;
+    use crate::runner::{Diagnostic, RuleEdit};
+
+    #[test]
+    fn test_findings_carry_rule_severity() {
+        let mut config = UpgradeConfig::new("v2", "");
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "Dial".to_string(),
+                new_name: "Connect".to_string(),
+            })
+            .with_id("dial-removed")
+            .with_severity(RuleSeverity::Error),
+        );
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "Get".to_string(),
+                new_name: "Fetch".to_string(),
+            })
+            .with_id("get-deprecated")
+            .with_message("Get is deprecated")
+            .with_severity(RuleSeverity::Info)
+            .suggest_only(),
+        );
+        let report = RunReport {
+            edits: vec![RuleEdit {
+                rule: "dial-removed".to_string(),
+                path: "b.go".into(),
+                line: 4,
+                todo: false,
+            }],
+            diagnostics: vec![Diagnostic {
+                rule: "get-deprecated".to_string(),
+                message: "Get is deprecated".to_string(),
+                path: "a.go".into(),
+                line: 2,
+                column: 7,
+                text: "Get(".to_string(),
+                suggestion: "Fetch(".to_string(),
+            }],
+            ..Default::default()
+        };
+
+        let check = CheckReport::new(&config, &report);
+        assert_eq!(check.highest(), Some(RuleSeverity::Error));
+        assert!(check.fails(RuleSeverity::Warn));
+        assert_eq!(
+            check.to_string(),
+            "a.go:2:7: info: [get-deprecated] Get is deprecated\n\
+             b.go:4: error: [dial-removed] rename Dial -> Connect (fixed by upgrade)\n\
+             1 error(s), 0 warning(s), 1 info"
+        );
+
+        let check = CheckReport::new(&config, &RunReport::default());
+        assert!(!check.fails(RuleSeverity::Info));
+    }
+}
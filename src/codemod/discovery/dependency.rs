@@ -53,6 +53,10 @@ pub enum VersionConstraint {
     AtLeast(String),
     /// Maximum version (<=).
     AtMost(String),
+    /// Versions after this one (>).
+    Above(String),
+    /// Versions before this one (<).
+    Below(String),
     /// Version range.
     Range { min: String, max: String },
     /// Semantic version compatible (~).
@@ -76,6 +80,12 @@ impl VersionConstraint {
         if let Some(rest) = s.strip_prefix("<=") {
             return Self::AtMost(rest.trim().to_string());
         }
+        if let Some(rest) = s.strip_prefix('>') {
+            return Self::Above(rest.trim().to_string());
+        }
+        if let Some(rest) = s.strip_prefix('<') {
+            return Self::Below(rest.trim().to_string());
+        }
         if let Some(rest) = s.strip_prefix('~') {
             return Self::Compatible(rest.trim().to_string());
         }
@@ -103,6 +113,8 @@ impl VersionConstraint {
             Self::Exact(v) => self.versions_equal(version, v),
             Self::AtLeast(min) => self.compare_versions(version, min) >= 0,
             Self::AtMost(max) => self.compare_versions(version, max) <= 0,
+            Self::Above(min) => self.compare_versions(version, min) > 0,
+            Self::Below(max) => self.compare_versions(version, max) < 0,
             Self::Range { min, max } => {
                 self.compare_versions(version, min) >= 0 && self.compare_versions(version, max) <= 0
             }
@@ -792,6 +804,11 @@ mod tests {
         assert!(VersionConstraint::AtLeast("1.0.0".to_string()).matches("1.0.1"));
         assert!(!VersionConstraint::AtLeast("1.0.0".to_string()).matches("0.9.0"));
 
+        assert!(VersionConstraint::parse("<1.22").matches("1.21"));
+        assert!(!VersionConstraint::parse("<1.22").matches("1.22"));
+        assert!(VersionConstraint::parse("> 1.21").matches("1.22"));
+        assert!(!VersionConstraint::parse(">1.21").matches("1.21"));
+
         assert!(VersionConstraint::Caret("1.0.0".to_string()).matches("1.5.0"));
         assert!(!VersionConstraint::Caret("1.0.0".to_string()).matches("2.0.0"));
     }
@@ -286,14 +286,18 @@ impl CodemodExecutor {
 }
 
 /// Get current date in YYYY-MM-DD format without pulling in chrono.
-fn chrono_lite_date() -> String {
+pub(crate) fn chrono_lite_date() -> String {
     use std::time::{SystemTime, UNIX_EPOCH};
 
     let duration = SystemTime::now()
         .duration_since(UNIX_EPOCH)
         .unwrap_or_default();
 
-    let secs = duration.as_secs();
+    date_from_unix(duration.as_secs())
+}
+
+/// Format a Unix timestamp as a YYYY-MM-DD date.
+pub(crate) fn date_from_unix(secs: u64) -> String {
     let days = secs / 86400;
 
     // Approximate calculation (not accounting for leap seconds, but close enough)
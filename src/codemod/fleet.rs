@@ -0,0 +1,403 @@
+//! Running one upgrade across a fleet of repositories.
+//!
+//! [`Fleet`] applies an [`UpgradeRunner`] to each repository in turn, local
+//! checkouts or GitHub repositories cloned into a workspace, and collects a
+//! [`FleetReport`]: for each repository whether it was upgraded, how many
+//! files changed, and how much manual work is left (findings of
+//! `suggest`-mode rules and `TODO(refactor)` markers). A repository that
+//! fails to clone or upgrade is reported as failed; the rest of the fleet
+//! still runs.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::codemod::Fleet;
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let config = UpgradeConfig::from_file("pool-v2.yaml")?;
+//! let report = Fleet::new(UpgradeRunner::new(config).dry_run())
+//!     .path("../api")
+//!     .path("../worker")
+//!     .run()?;
+//!
+//! println!("{}", report);
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::Serialize;
+use std::fmt;
+use std::path::{Path, PathBuf};
+
+use crate::error::{RefactorError, Result};
+use crate::github::{CloneOps, GitHubClient, GitHubRepo};
+use crate::runner::UpgradeRunner;
+
+/// A repository of a fleet.
+enum Member {
+    /// A local checkout.
+    Local(PathBuf),
+    /// A GitHub repository, cloned (or updated) in the workspace.
+    GitHub(Box<GitHubRepo>),
+    /// A repository that could not be resolved, reported as failed.
+    Failed { name: String, error: String },
+}
+
+/// Applies one upgrade to many repositories.
+pub struct Fleet {
+    runner: UpgradeRunner,
+    members: Vec<Member>,
+    client: Option<GitHubClient>,
+    workspace: PathBuf,
+}
+
+impl Fleet {
+    /// Create a fleet upgraded by `runner`.
+    pub fn new(runner: UpgradeRunner) -> Self {
+        Self {
+            runner,
+            members: Vec::new(),
+            client: None,
+            workspace: std::env::temp_dir().join("codemod-workspace"),
+        }
+    }
+
+    /// Add a local checkout.
+    pub fn path(mut self, path: impl Into<PathBuf>) -> Self {
+        self.members.push(Member::Local(path.into()));
+        self
+    }
+
+    /// Add GitHub repositories, cloned with `client`.
+    pub fn github(
+        mut self,
+        client: GitHubClient,
+        repos: impl IntoIterator<Item = GitHubRepo>,
+    ) -> Self {
+        self.members
+            .extend(repos.into_iter().map(|repo| Member::GitHub(Box::new(repo))));
+        self.client = Some(client);
+        self
+    }
+
+    /// Add a repository that failed before it could be upgraded, such as one
+    /// that could not be looked up, so it is reported alongside the others.
+    pub fn failed(mut self, name: impl Into<String>, error: impl fmt::Display) -> Self {
+        self.members.push(Member::Failed {
+            name: name.into(),
+            error: error.to_string(),
+        });
+        self
+    }
+
+    /// Set the directory GitHub repositories are cloned into.
+    pub fn workspace(mut self, path: impl Into<PathBuf>) -> Self {
+        self.workspace = path.into();
+        self
+    }
+
+    /// Returns the number of repositories in the fleet.
+    pub fn len(&self) -> usize {
+        self.members.len()
+    }
+
+    /// Returns true if the fleet has no repositories.
+    pub fn is_empty(&self) -> bool {
+        self.members.is_empty()
+    }
+
+    /// Upgrade every repository, in the order they were added.
+    pub fn run(&self) -> Result<FleetReport> {
+        if self.client.is_some() {
+            std::fs::create_dir_all(&self.workspace)?;
+        }
+        let repos = self
+            .members
+            .iter()
+            .map(|member| {
+                let (name, path) = match member {
+                    Member::Local(path) => (path.display().to_string(), Ok(path.clone())),
+                    Member::GitHub(repo) => (repo.full_name.clone(), self.clone_repo(repo)),
+                    Member::Failed { name, error } => {
+                        return FleetRepo::failed(name.clone(), error.clone());
+                    }
+                };
+                FleetRepo::new(name, path.and_then(|path| self.upgrade(&path)))
+            })
+            .collect();
+        Ok(FleetReport { repos })
+    }
+
+    fn clone_repo(&self, repo: &GitHubRepo) -> Result<PathBuf> {
+        let client = self
+            .client
+            .as_ref()
+            .expect("GitHub repositories are added with a client");
+        client.clone_or_update(repo, &self.workspace)
+    }
+
+    fn upgrade(&self, path: &Path) -> Result<Upgraded> {
+        if !path.is_dir() {
+            return Err(RefactorError::RepoNotFound(path.to_path_buf()));
+        }
+        let report = self.runner.run(path)?;
+        Ok(Upgraded {
+            files_modified: report.files_modified(),
+            edits: report.edits.len(),
+            manual: report.diagnostics.len() + report.manual_todos,
+        })
+    }
+}
+
+/// Counts from a successful run.
+struct Upgraded {
+    files_modified: usize,
+    edits: usize,
+    manual: usize,
+}
+
+/// What happened to a repository.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum FleetStatus {
+    /// The upgrade changed files.
+    Upgraded,
+    /// The upgrade ran but changed nothing.
+    Unchanged,
+    /// The repository could not be cloned or upgraded.
+    Failed,
+}
+
+impl fmt::Display for FleetStatus {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.pad(match self {
+            FleetStatus::Upgraded => "upgraded",
+            FleetStatus::Unchanged => "unchanged",
+            FleetStatus::Failed => "failed",
+        })
+    }
+}
+
+/// The result for one repository of a fleet.
+#[derive(Debug, Clone, Serialize)]
+pub struct FleetRepo {
+    /// Path or `owner/name` of the repository.
+    pub name: String,
+    pub status: FleetStatus,
+    /// Number of files modified.
+    pub files_modified: usize,
+    /// Number of locations rewritten.
+    pub edits: usize,
+    /// Findings and `TODO(refactor)` markers needing manual intervention.
+    pub manual: usize,
+    /// Why the repository failed.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+impl FleetRepo {
+    fn new(name: String, result: Result<Upgraded>) -> Self {
+        match result {
+            Ok(upgraded) => Self {
+                name,
+                status: if upgraded.files_modified > 0 {
+                    FleetStatus::Upgraded
+                } else {
+                    FleetStatus::Unchanged
+                },
+                files_modified: upgraded.files_modified,
+                edits: upgraded.edits,
+                manual: upgraded.manual,
+                error: None,
+            },
+            Err(e) => Self::failed(name, e.to_string()),
+        }
+    }
+
+    fn failed(name: String, error: String) -> Self {
+        Self {
+            name,
+            status: FleetStatus::Failed,
+            files_modified: 0,
+            edits: 0,
+            manual: 0,
+            error: Some(error),
+        }
+    }
+}
+
+/// Aggregate counts of a fleet run.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct FleetSummary {
+    pub repos: usize,
+    pub upgraded: usize,
+    pub unchanged: usize,
+    pub failed: usize,
+    pub files_modified: usize,
+    pub manual: usize,
+}
+
+/// The results of a fleet run.
+#[derive(Debug, Clone, Serialize)]
+pub struct FleetReport {
+    pub repos: Vec<FleetRepo>,
+}
+
+impl FleetReport {
+    /// Totals across the fleet.
+    pub fn summary(&self) -> FleetSummary {
+        self.repos
+            .iter()
+            .fold(FleetSummary::default(), |mut summary, repo| {
+                summary.repos += 1;
+                match repo.status {
+                    FleetStatus::Upgraded => summary.upgraded += 1,
+                    FleetStatus::Unchanged => summary.unchanged += 1,
+                    FleetStatus::Failed => summary.failed += 1,
+                }
+                summary.files_modified += repo.files_modified;
+                summary.manual += repo.manual;
+                summary
+            })
+    }
+
+    /// Returns true if no repository failed.
+    pub fn passed(&self) -> bool {
+        self.repos
+            .iter()
+            .all(|repo| repo.status != FleetStatus::Failed)
+    }
+
+    /// The report and its summary as JSON.
+    pub fn to_json(&self) -> Result<String> {
+        Ok(serde_json::to_string_pretty(&serde_json::json!({
+            "repos": self.repos,
+            "summary": self.summary(),
+        }))?)
+    }
+}
+
+impl fmt::Display for FleetReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let width = self
+            .repos
+            .iter()
+            .map(|repo| repo.name.len())
+            .chain(["REPOSITORY".len()])
+            .max()
+            .unwrap_or_default();
+        writeln!(
+            f,
+            "{:width$}  {:9}  {:>5}  {:>6}",
+            "REPOSITORY", "STATUS", "FILES", "MANUAL"
+        )?;
+        for repo in &self.repos {
+            match &repo.error {
+                Some(error) => writeln!(
+                    f,
+                    "{:width$}  {:9}  {:>5}  {:>6}  {}",
+                    repo.name, repo.status, "-", "-", error
+                )?,
+                None => writeln!(
+                    f,
+                    "{:width$}  {:9}  {:>5}  {:>6}",
+                    repo.name, repo.status, repo.files_modified, repo.manual
+                )?,
+            }
+        }
+        let summary = self.summary();
+        write!(
+            f,
+            "{} repositories: {} upgraded, {} unchanged, {} failed; {} file(s) modified, {} manual intervention(s)",
+            summary.repos,
+            summary.upgraded,
+            summary.unchanged,
+            summary.failed,
+            summary.files_modified,
+            summary.manual
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformRule, TransformSpec, UpgradeConfig};
+    use std::fs;
+    use tempfile::TempDir;
+
+    fn runner() -> UpgradeRunner {
+        let mut config =
+            UpgradeConfig::new("pool-v2", "Pool v2").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "pool.Dial".to_string(),
+            to: "pool.Connect".to_string(),
+        });
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "Sleep".to_string(),
+                new_name: "Tick".to_string(),
+            })
+            .with_id("sleep")
+            .suggest_only(),
+        );
+        UpgradeRunner::new(config)
+    }
+
+    #[test]
+    fn test_run_reports_each_repo() {
+        let dir = TempDir::new().unwrap();
+        let api = dir.path().join("api");
+        let web = dir.path().join("web");
+        fs::create_dir_all(&api).unwrap();
+        fs::create_dir_all(&web).unwrap();
+        fs::write(api.join("main.go"), "pool.Dial()\nSleep(1)\n").unwrap();
+        fs::write(web.join("main.go"), "fmt.Println()\n").unwrap();
+
+        let fleet = Fleet::new(runner())
+            .path(&api)
+            .path(&web)
+            .path(dir.path().join("missing"))
+            .failed("acme/gone", "Not Found");
+        assert_eq!(fleet.len(), 4);
+        let report = fleet.run().unwrap();
+
+        let statuses: Vec<_> = report.repos.iter().map(|r| r.status).collect();
+        assert_eq!(
+            statuses,
+            [
+                FleetStatus::Upgraded,
+                FleetStatus::Unchanged,
+                FleetStatus::Failed,
+                FleetStatus::Failed
+            ]
+        );
+        assert_eq!(report.repos[3].name, "acme/gone");
+        assert_eq!(report.repos[3].error.as_deref(), Some("Not Found"));
+        assert_eq!(report.repos[0].files_modified, 1);
+        assert_eq!(report.repos[0].manual, 1);
+        assert!(report.repos[2].error.is_some());
+        assert!(!report.passed());
+        assert_eq!(
+            fs::read_to_string(api.join("main.go")).unwrap(),
+            "pool.Connect()\nSleep(1)\n"
+        );
+
+        let summary = report.summary();
+        assert_eq!(
+            summary,
+            FleetSummary {
+                repos: 4,
+                upgraded: 1,
+                unchanged: 1,
+                failed: 2,
+                files_modified: 1,
+                manual: 1,
+            }
+        );
+        assert!(report.to_string().ends_with(
+            "4 repositories: 1 upgraded, 1 unchanged, 2 failed; 1 file(s) modified, 1 manual intervention(s)"
+        ));
+        assert!(report.to_json().unwrap().contains("\"status\": \"failed\""));
+    }
+}
@@ -8,6 +8,8 @@
 //! - Applying transformations using the existing DSL
 //! - Creating branches, committing changes, and pushing
 //! - Creating pull requests automatically
+//! - Upgrading a fleet of repositories with one rule set and reporting on
+//!   each (see [`Fleet`])
 //!
 //! # Example
 //!
@@ -33,6 +35,7 @@
 pub mod discovery;
 mod executor;
 mod filter;
+mod fleet;
 mod upgrade;
 
 pub use discovery::{
@@ -42,7 +45,9 @@ pub use discovery::{
     RepositoryMetrics, VersionConstraint,
 };
 pub use executor::{CodemodExecutor, CodemodResult, CodemodSummary, RepoResult, RepoStatus};
+pub(crate) use executor::{chrono_lite_date, date_from_unix};
 pub use filter::RepoFilter;
+pub use fleet::{Fleet, FleetRepo, FleetReport, FleetStatus, FleetSummary};
 pub use upgrade::{
     AngularV4V5Upgrade, ClosureUpgrade, RxJS5To6Upgrade, Upgrade, angular_v4v5_upgrade,
     rxjs_5_to_6_upgrade,
@@ -0,0 +1,458 @@
+//! Organization convention packs.
+//!
+//! A convention pack encodes house style — naming, constructor patterns,
+//! logging APIs — as rules that are checked continuously rather than applied
+//! once. Unlike upgrade packs, which migrate code and succeed whenever they
+//! run, any remaining convention violation is reported as a failure.
+//!
+//! # Example YAML
+//!
+//! ```yaml
+//! name: acme-go
+//! description: ACME Go conventions
+//! extensions: [go]
+//! conventions:
+//!   - id: structured-logging
+//!     category: logging
+//!     message: Use the structured logger instead of the log package
+//!     type: replace_pattern
+//!     pattern: 'log\.Printf\('
+//!     replacement: 'logger.Infof('
+//!   - id: constructor-prefix
+//!     category: constructor
+//!     message: Constructors are named New<Type>
+//!     type: replace_pattern
+//!     pattern: 'func Make(\w+)\('
+//!     replacement: 'func New$1('
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::analyzer::{TransformRule, UpgradeConfig};
+use crate::error::{RefactorError, Result};
+use crate::matcher::Matcher;
+use crate::transform::{FileChange, GuardedTransform, Transform};
+
+/// The area of house style a convention covers.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ConventionCategory {
+    /// Identifier naming.
+    Naming,
+    /// Constructor and factory patterns.
+    Constructor,
+    /// Logging API usage.
+    Logging,
+    /// Anything else.
+    #[default]
+    Other,
+}
+
+impl ConventionCategory {
+    /// Get a human-readable name.
+    pub fn name(&self) -> &'static str {
+        match self {
+            ConventionCategory::Naming => "naming",
+            ConventionCategory::Constructor => "constructor",
+            ConventionCategory::Logging => "logging",
+            ConventionCategory::Other => "other",
+        }
+    }
+}
+
+/// A single organization convention with its fix.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Convention {
+    /// The area of style this convention covers.
+    #[serde(default)]
+    pub category: ConventionCategory,
+
+    /// The rule that detects and fixes violations; its `id` and `message`
+    /// identify the convention in reports.
+    #[serde(flatten)]
+    pub rule: TransformRule,
+}
+
+impl Convention {
+    /// Create a new convention.
+    pub fn new(
+        id: impl Into<String>,
+        category: ConventionCategory,
+        message: impl Into<String>,
+        rule: impl Into<TransformRule>,
+    ) -> Self {
+        Self {
+            category,
+            rule: rule.into().with_id(id).with_message(message),
+        }
+    }
+
+    /// The convention identifier.
+    pub fn id(&self) -> String {
+        self.rule.name()
+    }
+
+    /// Message shown for each violation.
+    pub fn message(&self) -> &str {
+        self.rule
+            .message
+            .as_deref()
+            .unwrap_or("Convention violated")
+    }
+}
+
+/// A serializable pack of organization conventions.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ConventionPack {
+    /// Unique name for this pack.
+    pub name: String,
+
+    /// Human-readable description.
+    #[serde(default)]
+    pub description: String,
+
+    /// File extensions to check (e.g., ["go"]).
+    #[serde(default)]
+    pub extensions: Vec<String>,
+
+    /// Glob patterns to exclude.
+    #[serde(default)]
+    pub exclude_patterns: Vec<String>,
+
+    /// The conventions in this pack.
+    #[serde(default)]
+    pub conventions: Vec<Convention>,
+}
+
+impl ConventionPack {
+    /// Create a new, empty convention pack.
+    pub fn new(name: impl Into<String>, description: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            description: description.into(),
+            extensions: Vec::new(),
+            exclude_patterns: Vec::new(),
+            conventions: Vec::new(),
+        }
+    }
+
+    /// Add a convention.
+    pub fn add_convention(&mut self, convention: Convention) {
+        self.conventions.push(convention);
+    }
+
+    /// Set target extensions.
+    pub fn with_extensions(mut self, extensions: Vec<String>) -> Self {
+        self.extensions = extensions;
+        self
+    }
+
+    /// Load a pack from a YAML or JSON file, based on its extension.
+    pub fn from_file(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref();
+        let content = fs::read_to_string(path).map_err(|e| {
+            RefactorError::Io(std::io::Error::new(
+                e.kind(),
+                format!("Failed to read convention pack: {}", e),
+            ))
+        })?;
+
+        if path.extension().is_some_and(|e| e == "json") {
+            serde_json::from_str(&content).map_err(|e| {
+                RefactorError::InvalidConfig(format!("Failed to parse JSON convention pack: {}", e))
+            })
+        } else {
+            serde_yaml::from_str(&content).map_err(|e| {
+                RefactorError::InvalidConfig(format!("Failed to parse YAML convention pack: {}", e))
+            })
+        }
+    }
+
+    /// The pack's rules as an upgrade configuration, keyed by convention id.
+    pub fn to_upgrade_config(&self) -> UpgradeConfig {
+        let mut config = UpgradeConfig::new(&self.name, &self.description)
+            .with_extensions(self.extensions.clone());
+        config.exclude_patterns = self.exclude_patterns.clone();
+        for convention in &self.conventions {
+            config.add_transform(convention.rule.clone().with_id(convention.id()));
+        }
+        config
+    }
+
+    /// The matcher for files this pack applies to.
+    pub fn matcher(&self) -> Matcher {
+        let extensions = self.extensions.clone();
+        let exclude_patterns = self.exclude_patterns.clone();
+        Matcher::new().files(move |mut f| {
+            f = f.extensions(extensions);
+            for pattern in exclude_patterns {
+                f = f.exclude(pattern);
+            }
+            f
+        })
+    }
+
+    /// Report convention violations under `root` without modifying files.
+    pub fn check(&self, root: impl AsRef<Path>) -> Result<ConventionReport> {
+        let root = root.as_ref();
+        let compiled = self.compile()?;
+        let files = self.matcher().collect_files(root)?;
+
+        let mut report = ConventionReport {
+            files_checked: files.len(),
+            ..Default::default()
+        };
+        for path in files {
+            let source = fs::read_to_string(&path)?;
+            report
+                .violations
+                .extend(find_violations(&compiled, &source, &path));
+        }
+        Ok(report)
+    }
+
+    /// Fix convention violations under `root`.
+    ///
+    /// Violations that remain after fixing are reported. When `dry_run` is
+    /// set, fixes are computed but not written.
+    pub fn fix(&self, root: impl AsRef<Path>, dry_run: bool) -> Result<ConventionReport> {
+        let root = root.as_ref();
+        let compiled = self.compile()?;
+        let files = self.matcher().collect_files(root)?;
+
+        let mut report = ConventionReport {
+            files_checked: files.len(),
+            ..Default::default()
+        };
+        for path in files {
+            let original = fs::read_to_string(&path)?;
+            let before = find_violations(&compiled, &original, &path).len();
+
+            let mut transformed = original.clone();
+            for (convention, transform) in &compiled {
+                if !convention.rule.is_suggest_only() {
+                    transformed = transform.apply(&transformed, &path)?;
+                }
+            }
+
+            let remaining = find_violations(&compiled, &transformed, &path);
+            report.fixed += before.saturating_sub(remaining.len());
+            report.violations.extend(remaining);
+
+            let change = FileChange {
+                path,
+                original,
+                transformed,
+            };
+            if change.is_modified() {
+                if !dry_run {
+                    change.apply()?;
+                }
+                report.changes.push(change);
+            }
+        }
+        Ok(report)
+    }
+
+    fn compile(&self) -> Result<Vec<(&Convention, GuardedTransform)>> {
+        self.conventions
+            .iter()
+            .map(|c| Ok((c, c.rule.to_transform()?)))
+            .collect()
+    }
+}
+
+fn find_violations(
+    compiled: &[(&Convention, GuardedTransform)],
+    source: &str,
+    path: &Path,
+) -> Vec<Violation> {
+    let mut violations = Vec::new();
+    for (convention, transform) in compiled {
+        for site in transform.sites(source, path) {
+            let (line, column) = site.position(source);
+            violations.push(Violation {
+                convention: convention.id(),
+                category: convention.category,
+                message: convention.message().to_string(),
+                path: path.to_path_buf(),
+                line,
+                column,
+                text: site.text,
+                suggestion: site.replacement,
+            });
+        }
+    }
+    violations.sort_by_key(|v| (v.line, v.column));
+    violations
+}
+
+/// A single convention violation.
+#[derive(Debug, Clone, Serialize)]
+pub struct Violation {
+    /// The violated convention's id.
+    pub convention: String,
+    /// The violated convention's category.
+    pub category: ConventionCategory,
+    /// The convention's message.
+    pub message: String,
+    /// File containing the violation.
+    pub path: PathBuf,
+    /// 1-based line number.
+    pub line: usize,
+    /// 1-based column number.
+    pub column: usize,
+    /// The offending text.
+    pub text: String,
+    /// The suggested replacement.
+    pub suggestion: String,
+}
+
+impl fmt::Display for Violation {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}:{}:{}: [{}/{}] {}",
+            self.path.display(),
+            self.line,
+            self.column,
+            self.category.name(),
+            self.convention,
+            self.message
+        )
+    }
+}
+
+/// The result of checking or fixing a convention pack.
+#[derive(Debug, Default)]
+pub struct ConventionReport {
+    /// Number of files checked.
+    pub files_checked: usize,
+    /// Violations found (remaining violations, after a fix).
+    pub violations: Vec<Violation>,
+    /// Number of violations fixed.
+    pub fixed: usize,
+    /// Files changed by fixing.
+    pub changes: Vec<FileChange>,
+}
+
+impl ConventionReport {
+    /// Returns true if no violations remain.
+    pub fn is_clean(&self) -> bool {
+        self.violations.is_empty()
+    }
+
+    /// Process exit code: convention packs fail while violations remain.
+    pub fn exit_code(&self) -> i32 {
+        if self.is_clean() { 0 } else { 1 }
+    }
+
+    /// Count violations per convention id.
+    pub fn counts_by_convention(&self) -> Vec<(String, usize)> {
+        let mut counts: Vec<(String, usize)> = Vec::new();
+        for violation in &self.violations {
+            match counts
+                .iter_mut()
+                .find(|(id, _)| *id == violation.convention)
+            {
+                Some((_, count)) => *count += 1,
+                None => counts.push((violation.convention.clone(), 1)),
+            }
+        }
+        counts
+    }
+}
+
+impl fmt::Display for ConventionReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for violation in &self.violations {
+            writeln!(f, "{}", violation)?;
+        }
+        if self.fixed > 0 {
+            writeln!(
+                f,
+                "Fixed {} violation(s) in {} file(s)",
+                self.fixed,
+                self.changes.len()
+            )?;
+        }
+        write!(
+            f,
+            "{} violation(s) in {} file(s) checked",
+            self.violations.len(),
+            self.files_checked
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::TransformSpec;
+    use tempfile::TempDir;
+
+    fn logging_pack() -> ConventionPack {
+        let mut pack =
+            ConventionPack::new("acme", "ACME conventions").with_extensions(vec!["go".to_string()]);
+        pack.add_convention(Convention::new(
+            "structured-logging",
+            ConventionCategory::Logging,
+            "Use the structured logger",
+            TransformSpec::ReplacePattern {
+                pattern: r"log\.Printf\(".to_string(),
+                replacement: "logger.Infof(".to_string(),
+            },
+        ));
+        pack
+    }
+
+    #[test]
+    fn test_check_reports_violations() {
+        let dir = TempDir::new().unwrap();
+        fs::write(
+            dir.path().join("main.go"),
+            "package main\n\nfunc main() {\n\tlog.Printf(\"hi\")\n}\n",
+        )
+        .unwrap();
+
+        let report = logging_pack().check(dir.path()).unwrap();
+        assert_eq!(report.files_checked, 1);
+        assert_eq!(report.violations.len(), 1);
+        assert_eq!(report.violations[0].line, 4);
+        assert_eq!(report.violations[0].column, 2);
+        assert_eq!(report.violations[0].suggestion, "logger.Infof(");
+        assert_eq!(report.exit_code(), 1);
+        assert!(report.to_string().contains("[logging/structured-logging]"));
+    }
+
+    #[test]
+    fn test_fix_applies_and_cleans() {
+        let dir = TempDir::new().unwrap();
+        let file = dir.path().join("main.go");
+        fs::write(&file, "log.Printf(\"a\")\nlog.Printf(\"b\")\n").unwrap();
+
+        let report = logging_pack().fix(dir.path(), false).unwrap();
+        assert_eq!(report.fixed, 2);
+        assert!(report.is_clean());
+        assert_eq!(report.exit_code(), 0);
+        assert_eq!(
+            fs::read_to_string(&file).unwrap(),
+            "logger.Infof(\"a\")\nlogger.Infof(\"b\")\n"
+        );
+    }
+
+    #[test]
+    fn test_pack_json_round_trip() {
+        let pack = logging_pack();
+        let json = serde_json::to_string(&pack).unwrap();
+        assert!(json.contains("\"category\":\"logging\""));
+        assert!(json.contains("\"type\":\"replace_pattern\""));
+
+        let parsed: ConventionPack = serde_json::from_str(&json).unwrap();
+        assert_eq!(parsed.conventions.len(), 1);
+        assert_eq!(parsed.conventions[0].id(), "structured-logging");
+    }
+}
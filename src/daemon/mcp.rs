@@ -0,0 +1,284 @@
+//! The engine as a Model Context Protocol server.
+//!
+//! AI coding assistants that speak MCP can call the engine as tools rather
+//! than edit code themselves: the edits come from rules, so they are the
+//! same on every run and reviewable before they are written.
+//!
+//! | Tool                    | Does                                              |
+//! |-------------------------|---------------------------------------------------|
+//! | `diff_library_versions` | API changes between two versions, and the rules generated from them |
+//! | `preview_migration`     | The diffs an upgrade would make, without writing  |
+//! | `apply_rules`           | Applies an upgrade and summarizes the changes     |
+//!
+//! Messages are JSON-RPC 2.0, one per line, as in the MCP stdio transport.
+//!
+//! Tool arguments come from a model that may have read untrusted input, so
+//! they get no more power than the edits rules make: upgrades declaring
+//! plugins, inline or in a file, are refused, and `path` must be inside the
+//! server's working directory (see [`McpServer::root`]).
+
+use serde::Deserialize;
+use serde_json::{Value, json};
+use std::io::{BufRead, Write};
+use std::path::PathBuf;
+
+use super::{Daemon, INVALID_PARAMS, METHOD_NOT_FOUND, RequestError, serve_lines};
+use crate::analyzer::LibraryAnalyzer;
+use crate::error::Result;
+
+/// Protocol versions the server speaks, latest first.
+const PROTOCOL_VERSIONS: &[&str] = &["2025-06-18", "2025-03-26", "2024-11-05"];
+
+/// Serves the engine's tools to an MCP client.
+#[derive(Debug, Default)]
+pub struct McpServer {
+    daemon: Daemon,
+}
+
+/// Arguments of `diff_library_versions`.
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct DiffArguments {
+    #[serde(default)]
+    path: Option<PathBuf>,
+    #[serde(default)]
+    module: Option<String>,
+    from: String,
+    to: String,
+}
+
+impl McpServer {
+    /// Create a server with nothing loaded yet, running in the working
+    /// directory.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Only run in `root` and the directories below it.
+    pub fn root(mut self, root: impl Into<PathBuf>) -> Self {
+        self.daemon = self.daemon.root(root);
+        self
+    }
+
+    /// Handle messages from `input` until the client closes the stream.
+    pub fn serve(&self, input: impl BufRead, output: impl Write) -> Result<()> {
+        serve_lines(input, output, |method, params| self.request(method, params))
+    }
+
+    /// The result of a request.
+    fn request(&self, method: &str, params: &Value) -> std::result::Result<Value, RequestError> {
+        match method {
+            "initialize" => {
+                let requested = params["protocolVersion"].as_str().unwrap_or_default();
+                let version = PROTOCOL_VERSIONS
+                    .iter()
+                    .find(|version| **version == requested)
+                    .unwrap_or(&PROTOCOL_VERSIONS[0]);
+                Ok(json!({
+                    "protocolVersion": version,
+                    "capabilities": {"tools": {}},
+                    "serverInfo": {"name": "refactor", "version": env!("CARGO_PKG_VERSION")},
+                }))
+            }
+            "ping" => Ok(json!({})),
+            "tools/list" => Ok(json!({"tools": tools()})),
+            "tools/call" => {
+                let name = params["name"].as_str().unwrap_or_default();
+                let arguments = match &params["arguments"] {
+                    Value::Null => json!({}),
+                    arguments => arguments.clone(),
+                };
+                let result = match name {
+                    "diff_library_versions" => diff_library_versions(arguments),
+                    "preview_migration" => self.daemon.request("preview", &arguments),
+                    "apply_rules" => self.daemon.request("apply", &arguments),
+                    _ => {
+                        return Err(RequestError(
+                            INVALID_PARAMS,
+                            format!("Unknown tool '{}'", name),
+                        ));
+                    }
+                };
+                // Failures are reported to the model as tool errors
+                Ok(match result {
+                    Ok(result) => tool_result(&result, false),
+                    Err(RequestError(_, message)) => tool_result(&Value::String(message), true),
+                })
+            }
+            _ if method.starts_with("notifications/") => Ok(Value::Null),
+            _ => Err(RequestError(
+                METHOD_NOT_FOUND,
+                format!("Unsupported method '{}'", method),
+            )),
+        }
+    }
+}
+
+/// The API changes between two versions of a library, with the upgrade
+/// configuration generated from them.
+fn diff_library_versions(arguments: Value) -> std::result::Result<Value, RequestError> {
+    let arguments: DiffArguments = serde_json::from_value(arguments)
+        .map_err(|e| RequestError(INVALID_PARAMS, e.to_string()))?;
+    let analyzer = match (&arguments.module, &arguments.path) {
+        (Some(module), _) => LibraryAnalyzer::from_module(module),
+        (None, Some(path)) => LibraryAnalyzer::new(path)?,
+        (None, None) => {
+            return Err(RequestError(
+                INVALID_PARAMS,
+                "give the library's repository in path or its Go module in module".to_string(),
+            ));
+        }
+    };
+    let diff = analyzer.api_diff(&arguments.from, &arguments.to)?;
+    let upgrade = analyzer.analyze_to_config(&arguments.from, &arguments.to)?;
+    Ok(json!({
+        "from": diff.from,
+        "to": diff.to,
+        "required": diff.required().bump(),
+        "changes": diff.entries,
+        "upgrade": upgrade,
+    }))
+}
+
+/// A `tools/call` result holding `value` as text.
+fn tool_result(value: &Value, is_error: bool) -> Value {
+    let text = match value {
+        Value::String(text) => text.clone(),
+        value => serde_json::to_string_pretty(value).unwrap_or_default(),
+    };
+    json!({
+        "content": [{"type": "text", "text": text}],
+        "isError": is_error,
+    })
+}
+
+/// The tools offered, with the JSON schemas of their arguments.
+fn tools() -> Value {
+    let run = json!({
+        "type": "object",
+        "properties": {
+            "config": {"type": "string", "description": "Upgrade configuration file (YAML or JSON)"},
+            "upgrade": {"type": "object", "description": "Upgrade configuration given inline, such as the one diff_library_versions generates; plugins are refused"},
+            "path": {"type": "string", "description": "Directory of the project to migrate, inside the working directory (default: the working directory)"},
+            "include": {"type": "array", "items": {"type": "string"}, "description": "Only process files matching these globs"},
+            "exclude": {"type": "array", "items": {"type": "string"}, "description": "Skip files matching these globs"},
+            "files": {"type": "array", "items": {"type": "string"}, "description": "Only process these files, relative to path"},
+        },
+    });
+    json!([
+        {
+            "name": "diff_library_versions",
+            "description": "List the API changes between two versions of a library, classified by the release they need, and generate the upgrade rules that migrate its clients",
+            "inputSchema": {
+                "type": "object",
+                "properties": {
+                    "path": {"type": "string", "description": "Git repository of the library"},
+                    "module": {"type": "string", "description": "Go module path, fetched from the module proxy instead of a repository"},
+                    "from": {"type": "string", "description": "Old version (git ref or module version)"},
+                    "to": {"type": "string", "description": "New version (git ref or module version)"},
+                },
+                "required": ["from", "to"],
+            },
+        },
+        {
+            "name": "preview_migration",
+            "description": "Show the unified diffs an upgrade configuration would make to a project, without writing them",
+            "inputSchema": run.clone(),
+        },
+        {
+            "name": "apply_rules",
+            "description": "Apply an upgrade configuration to a project and summarize the files changed and the sites left for manual review",
+            "inputSchema": run,
+        },
+    ])
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_tools() {
+        let dir = TempDir::new().unwrap();
+        fs::write(dir.path().join("main.go"), "oldpkg.Do()\n").unwrap();
+        let upgrade = json!({
+            "name": "test",
+            "description": "Test upgrade",
+            "extensions": ["go"],
+            "transforms": [{"type": "replace_literal", "from": "oldpkg", "to": "newpkg"}],
+        });
+        let plugins = json!({
+            "name": "injected",
+            "description": "Runs a command",
+            "transforms": [{"type": "replace_literal", "from": "a", "to": "b", "rewriter": "run"}],
+            "plugins": {"run": {"command": ["sh", "-c", "touch pwned"]}},
+        });
+        let call = |id: u32, name: &str, arguments: Value| {
+            json!({"jsonrpc": "2.0", "id": id, "method": "tools/call",
+                "params": {"name": name, "arguments": arguments}})
+        };
+        let input = [
+            json!({"jsonrpc": "2.0", "id": 1, "method": "initialize",
+                "params": {"protocolVersion": "2024-11-05"}}),
+            json!({"jsonrpc": "2.0", "method": "notifications/initialized"}),
+            json!({"jsonrpc": "2.0", "id": 2, "method": "tools/list"}),
+            call(
+                3,
+                "preview_migration",
+                json!({"upgrade": upgrade, "path": dir.path()}),
+            ),
+            call(
+                4,
+                "apply_rules",
+                json!({"upgrade": upgrade, "path": dir.path()}),
+            ),
+            call(5, "diff_library_versions", json!({"from": "v1"})),
+            call(6, "rename_everything", json!({})),
+            call(
+                7,
+                "apply_rules",
+                json!({"upgrade": plugins, "path": dir.path()}),
+            ),
+            call(
+                8,
+                "apply_rules",
+                json!({"upgrade": upgrade, "path": dir.path().parent().unwrap()}),
+            ),
+        ]
+        .map(|message| message.to_string() + "\n")
+        .concat();
+        let mut output = Vec::new();
+        McpServer::new()
+            .root(dir.path())
+            .serve(input.as_bytes(), &mut output)
+            .unwrap();
+
+        let messages: Vec<Value> = output
+            .split(|b| *b == b'\n')
+            .filter(|line| !line.is_empty())
+            .map(|line| serde_json::from_slice(line).unwrap())
+            .collect();
+        assert_eq!(messages.len(), 8);
+        assert_eq!(messages[0]["result"]["protocolVersion"], "2024-11-05");
+        assert_eq!(messages[1]["result"]["tools"].as_array().unwrap().len(), 3);
+
+        let preview = messages[2]["result"]["content"][0]["text"]
+            .as_str()
+            .unwrap();
+        assert!(preview.contains("+newpkg.Do()"));
+        assert_eq!(messages[3]["result"]["isError"], false);
+        assert_eq!(
+            fs::read_to_string(dir.path().join("main.go")).unwrap(),
+            "newpkg.Do()\n"
+        );
+
+        assert_eq!(messages[4]["result"]["isError"], true);
+        assert_eq!(messages[5]["error"]["code"], INVALID_PARAMS);
+        for refused in &messages[6..] {
+            assert_eq!(refused["result"]["isError"], true);
+        }
+        assert!(!dir.path().join("pwned").exists());
+    }
+}
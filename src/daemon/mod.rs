@@ -0,0 +1,465 @@
+//! Long-running engine serving requests over JSON-RPC.
+//!
+//! Running the CLI once per request loads and compiles the rules and
+//! analyzes every file again each time. [`Daemon`] stays up instead: it
+//! keeps the upgrade configurations it loaded, until their file changes,
+//! and the results of files no rule rewrites (see [`MemoryCache`]), so a
+//! request only analyzes the files changed since the previous one. Editor
+//! plugins and services talk to it in JSON-RPC 2.0, one message per line,
+//! over stdin and stdout ([`Daemon::serve`]) or TCP ([`Daemon::listen`]).
+//! [`McpServer`] serves the same engine to AI coding assistants as Model
+//! Context Protocol tools.
+//!
+//! | Method     | Result                                               |
+//! |------------|------------------------------------------------------|
+//! | `analyze`  | What the rules would change, without diffs           |
+//! | `preview`  | The same, with a unified diff per changed file       |
+//! | `apply`    | The same, with the changes written                   |
+//! | `reload`   | Forgets loaded configurations and cached results     |
+//! | `shutdown` | Ends the session                                     |
+//!
+//! The run methods take the upgrade configuration (a file in `config`, or
+//! inline in `upgrade`, defaulting to the `rule_files` of the project
+//! config), the directory to run in
+//! (`path`), `include` and `exclude` globs and `files` to restrict the run
+//! to. `preview` and `analyze` also take `sources`, the contents of files by
+//! path, to run against unsaved editor buffers instead of the disk.
+//!
+//! Clients are not trusted: `path` must be inside the daemon's root (the
+//! working directory unless [`Daemon::root`] sets another), configurations
+//! declaring plugins are refused, and [`Daemon::listen`] only accepts
+//! connections on loopback addresses.
+//!
+//! ```text
+//! → {"jsonrpc":"2.0","id":1,"method":"preview","params":{"config":"client-v2.yaml","path":"."}}
+//! ← {"jsonrpc":"2.0","id":1,"result":{"files_scanned":12,"files_modified":["./main.go"],...}}
+//! ```
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::daemon::Daemon;
+//!
+//! Daemon::new().listen("127.0.0.1:7070")?;
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::Deserialize;
+use serde_json::{Value, json};
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::io::{BufRead, BufReader, Write};
+use std::net::{SocketAddr, TcpListener, ToSocketAddrs};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::SystemTime;
+
+use crate::analyzer::UpgradeConfig;
+use crate::diff::unified_diff;
+use crate::error::{RefactorError, Result};
+use crate::project::ProjectConfig;
+use crate::runner::{MemoryCache, RunReport, UpgradeRunner};
+
+mod mcp;
+
+pub use mcp::McpServer;
+
+/// JSON-RPC error code for messages that are not JSON.
+const PARSE_ERROR: i64 = -32700;
+
+/// JSON-RPC error code for unknown methods.
+const METHOD_NOT_FOUND: i64 = -32601;
+
+/// JSON-RPC error code for malformed parameters.
+const INVALID_PARAMS: i64 = -32602;
+
+/// JSON-RPC error code for requests the engine failed to run.
+const RUN_FAILED: i64 = -32000;
+
+/// Serves the engine to clients, keeping rules and results between requests.
+#[derive(Debug)]
+pub struct Daemon {
+    root: PathBuf,
+    configs: Mutex<HashMap<PathBuf, (SystemTime, UpgradeConfig)>>,
+    cache: MemoryCache,
+}
+
+impl Default for Daemon {
+    fn default() -> Self {
+        Self {
+            root: PathBuf::from("."),
+            configs: Mutex::default(),
+            cache: MemoryCache::default(),
+        }
+    }
+}
+
+/// Parameters of the run methods.
+#[derive(Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+struct RunParams {
+    config: Option<PathBuf>,
+    upgrade: Option<UpgradeConfig>,
+    path: Option<PathBuf>,
+    include: Vec<String>,
+    exclude: Vec<String>,
+    files: Option<Vec<PathBuf>>,
+    sources: Option<BTreeMap<PathBuf, String>>,
+}
+
+/// A failed request, as a JSON-RPC error code and message.
+struct RequestError(i64, String);
+
+impl From<RefactorError> for RequestError {
+    fn from(error: RefactorError) -> Self {
+        RequestError(RUN_FAILED, error.to_string())
+    }
+}
+
+impl Daemon {
+    /// Create a daemon with nothing loaded yet, running in the working
+    /// directory.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Only run in `root` and the directories below it.
+    pub fn root(mut self, root: impl Into<PathBuf>) -> Self {
+        self.root = root.into();
+        self
+    }
+
+    /// Handle requests from `input`, one per line, until the client sends
+    /// `shutdown` or closes the stream.
+    pub fn serve(&self, input: impl BufRead, output: impl Write) -> Result<()> {
+        serve_lines(input, output, |method, params| self.request(method, params))
+    }
+
+    /// Accept TCP connections on `addr`, serving each on its own thread,
+    /// until the process is stopped. Connections share loaded rules and
+    /// cached results. Clients are not authenticated, so `addr` must be a
+    /// loopback address.
+    pub fn listen(&self, addr: impl ToSocketAddrs) -> Result<()> {
+        let addrs: Vec<SocketAddr> = addr.to_socket_addrs()?.collect();
+        if let Some(public) = addrs.iter().find(|addr| !addr.ip().is_loopback()) {
+            return Err(RefactorError::InvalidConfig(format!(
+                "Refusing to listen on {}: the daemon only serves loopback addresses",
+                public
+            )));
+        }
+        let listener = TcpListener::bind(&addrs[..])?;
+        std::thread::scope(|scope| {
+            for stream in listener.incoming() {
+                // A failed connection does not end the daemon
+                let stream = match stream {
+                    Ok(stream) => stream,
+                    Err(e) => {
+                        eprintln!("Warning: failed to accept a connection: {}", e);
+                        continue;
+                    }
+                };
+                scope.spawn(move || -> Result<()> {
+                    let input = BufReader::new(stream.try_clone()?);
+                    self.serve(input, stream)
+                });
+            }
+        });
+        Ok(())
+    }
+
+    /// The result of a request.
+    fn request(&self, method: &str, params: &Value) -> std::result::Result<Value, RequestError> {
+        match method {
+            "analyze" | "preview" | "apply" => {
+                let params: RunParams = match params {
+                    Value::Null => RunParams::default(),
+                    params => serde_json::from_value(params.clone())
+                        .map_err(|e| RequestError(INVALID_PARAMS, e.to_string()))?,
+                };
+                self.run(method, params)
+            }
+            "reload" => {
+                self.configs.lock().expect("config lock poisoned").clear();
+                self.cache.clear();
+                Ok(Value::Null)
+            }
+            "shutdown" => Ok(Value::Null),
+            _ => Err(RequestError(
+                METHOD_NOT_FOUND,
+                format!("Unsupported method '{}'", method),
+            )),
+        }
+    }
+
+    /// Run the rules for `analyze`, `preview` or `apply`.
+    fn run(&self, method: &str, params: RunParams) -> std::result::Result<Value, RequestError> {
+        let root = params.path.unwrap_or_else(|| self.root.clone());
+        self.check_root(&root)?;
+        let project = ProjectConfig::discover(&root)?;
+        let given = match (params.upgrade, &params.config) {
+            (Some(config), _) => Some(config),
+            (None, Some(path)) => Some(self.load(path)?),
+            (None, None) => None,
+        };
+        let config = match (given, &project) {
+            (Some(config), Some(project)) => project.filter_rules(config),
+            (Some(config), None) => config,
+            (None, Some(project)) => project.upgrade_config()?,
+            (None, None) => {
+                return Err(RequestError(
+                    INVALID_PARAMS,
+                    format!(
+                        "No config given and no {} found",
+                        crate::project::PROJECT_CONFIG_FILE
+                    ),
+                ));
+            }
+        };
+        if let Some(name) = config.plugins.keys().next() {
+            return Err(RequestError(
+                INVALID_PARAMS,
+                format!(
+                    "Plugin '{}' refused: the daemon does not run commands from configurations",
+                    name
+                ),
+            ));
+        }
+
+        let mut runner = UpgradeRunner::new(config).memory_cache(self.cache.clone());
+        if let Some(project) = &project {
+            runner = project.configure(runner);
+        }
+        runner = params
+            .include
+            .iter()
+            .fold(runner, |runner, glob| runner.include(glob));
+        runner = params
+            .exclude
+            .iter()
+            .fold(runner, |runner, glob| runner.exclude(glob));
+        if let Some(files) = params.files {
+            runner = runner.only_files(files);
+        }
+        if method != "apply" {
+            runner = runner.dry_run();
+        }
+
+        let report = match params.sources {
+            Some(_) if method == "apply" => {
+                return Err(RequestError(
+                    INVALID_PARAMS,
+                    "sources cannot be applied; write them first".to_string(),
+                ));
+            }
+            Some(sources) => runner.root(&root).run_files(sources)?,
+            None => runner.run(&root)?,
+        };
+        Ok(report_json(&report, method == "preview"))
+    }
+
+    /// Fail unless `path` is the daemon's root or below it.
+    fn check_root(&self, path: &Path) -> std::result::Result<(), RequestError> {
+        let root = self.root.canonicalize().map_err(RefactorError::from)?;
+        let outside = || {
+            RequestError(
+                INVALID_PARAMS,
+                format!("{} is outside {}", path.display(), root.display()),
+            )
+        };
+        let path = path.canonicalize().map_err(|_| outside())?;
+        if path.starts_with(&root) {
+            Ok(())
+        } else {
+            Err(outside())
+        }
+    }
+
+    /// The configuration at `path`, loaded again only if the file changed.
+    fn load(&self, path: &Path) -> Result<UpgradeConfig> {
+        let modified = fs::metadata(path)?.modified()?;
+        let mut configs = self.configs.lock().expect("config lock poisoned");
+        if let Some((loaded, config)) = configs.get(path)
+            && *loaded == modified
+        {
+            return Ok(config.clone());
+        }
+        let config = UpgradeConfig::from_file(path)?;
+        configs.insert(path.to_path_buf(), (modified, config.clone()));
+        Ok(config)
+    }
+}
+
+/// The result of a run, with a diff per changed file if `diffs` is set.
+fn report_json(report: &RunReport, diffs: bool) -> Value {
+    let files: Vec<&Path> = report.changes.iter().map(|c| c.path.as_path()).collect();
+    let mut json = json!({
+        "files_scanned": report.files_scanned,
+        "files_modified": files,
+        "insertions": report.summary.insertions,
+        "deletions": report.summary.deletions,
+        "edits": report.edits,
+        "diagnostics": report.diagnostics,
+        "manual_todos": report.manual_todos,
+        "cache_hits": report.cache_hits,
+        "engine_semantics": report.semantics,
+    });
+    if diffs {
+        json["diffs"] = report
+            .changes
+            .iter()
+            .map(|change| {
+                json!({
+                    "path": change.path,
+                    "diff": unified_diff(&change.original, &change.transformed, &change.path),
+                })
+            })
+            .collect();
+    }
+    json
+}
+
+/// Answer JSON-RPC requests from `input`, one per line, with `handle`,
+/// until the client sends `shutdown` or closes the stream.
+fn serve_lines(
+    input: impl BufRead,
+    mut output: impl Write,
+    handle: impl Fn(&str, &Value) -> std::result::Result<Value, RequestError>,
+) -> Result<()> {
+    for line in input.lines() {
+        let line = line?;
+        if line.trim().is_empty() {
+            continue;
+        }
+        let message: Value = match serde_json::from_str(&line) {
+            Ok(message) => message,
+            Err(e) => {
+                let error = RequestError(PARSE_ERROR, format!("Invalid message: {}", e));
+                write_message(&mut output, &response(&Value::Null, Err(error)))?;
+                continue;
+            }
+        };
+        let method = message["method"].as_str().unwrap_or_default();
+        let result = handle(method, &message["params"]);
+        // Notifications get no response
+        if let Some(id) = message.get("id") {
+            write_message(&mut output, &response(id, result))?;
+        }
+        if method == "shutdown" {
+            break;
+        }
+    }
+    Ok(())
+}
+
+fn response(id: &Value, result: std::result::Result<Value, RequestError>) -> Value {
+    match result {
+        Ok(result) => json!({"jsonrpc": "2.0", "id": id, "result": result}),
+        Err(RequestError(code, message)) => json!({
+            "jsonrpc": "2.0",
+            "id": id,
+            "error": {"code": code, "message": message},
+        }),
+    }
+}
+
+fn write_message(output: &mut impl Write, message: &Value) -> Result<()> {
+    writeln!(output, "{}", serde_json::to_string(message)?)?;
+    output.flush()?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_requests_reuse_rules_and_results() {
+        let dir = TempDir::new().unwrap();
+        let config = dir.path().join("upgrade.yaml");
+        fs::write(
+            &config,
+            r#"{"name": "test", "description": "Test upgrade", "extensions": ["go"],
+                "transforms": [{"type": "replace_literal", "from": "oldpkg", "to": "newpkg"}]}"#,
+        )
+        .unwrap();
+        fs::write(dir.path().join("main.go"), "oldpkg.Do()\n").unwrap();
+        fs::write(dir.path().join("util.go"), "other.Do()\n").unwrap();
+
+        let params = json!({"config": config, "path": dir.path()});
+        let input = [
+            json!({"jsonrpc": "2.0", "id": 1, "method": "preview", "params": params}),
+            json!({"jsonrpc": "2.0", "id": 2, "method": "analyze", "params": {
+                "config": config, "sources": {"edited.go": "oldpkg.Run()\n"},
+            }}),
+            json!({"jsonrpc": "2.0", "id": 3, "method": "apply", "params": params}),
+            json!({"jsonrpc": "2.0", "id": 4, "method": "analyze", "params": {"path": dir.path()}}),
+            json!({"jsonrpc": "2.0", "id": 5, "method": "rename"}),
+            json!({"jsonrpc": "2.0", "id": 8, "method": "apply", "params": {
+                "config": config, "path": dir.path().parent().unwrap(),
+            }}),
+            json!({"jsonrpc": "2.0", "id": 9, "method": "apply", "params": {
+                "path": dir.path(), "upgrade": {
+                    "name": "evil", "description": "Runs a command", "transforms": [],
+                    "plugins": {"run": {"command": ["sh", "-c", "touch pwned"]}},
+                },
+            }}),
+            json!({"jsonrpc": "2.0", "id": 6, "method": "shutdown"}),
+            json!({"jsonrpc": "2.0", "id": 7, "method": "analyze", "params": params}),
+        ]
+        .map(|message| message.to_string() + "\n")
+        .concat()
+            + "not json\n";
+        let mut output = Vec::new();
+        Daemon::new()
+            .root(dir.path())
+            .serve(input.as_bytes(), &mut output)
+            .unwrap();
+
+        let messages: Vec<Value> = output
+            .split(|b| *b == b'\n')
+            .filter(|line| !line.is_empty())
+            .map(|line| serde_json::from_slice(line).unwrap())
+            .collect();
+        assert_eq!(messages.len(), 8);
+
+        let preview = &messages[0]["result"];
+        assert_eq!(preview["files_scanned"], 2);
+        assert_eq!(preview["cache_hits"], 0);
+        assert!(
+            preview["diffs"][0]["diff"]
+                .as_str()
+                .unwrap()
+                .contains("+newpkg.Do()")
+        );
+        assert_eq!(
+            messages[1]["result"]["files_modified"],
+            json!(["edited.go"])
+        );
+
+        // util.go was analyzed by the preview and is not analyzed again
+        let applied = &messages[2]["result"];
+        assert_eq!(applied["cache_hits"], 1);
+        assert!(applied.get("diffs").is_none());
+        assert_eq!(
+            fs::read_to_string(dir.path().join("main.go")).unwrap(),
+            "newpkg.Do()\n"
+        );
+
+        assert_eq!(messages[3]["error"]["code"], INVALID_PARAMS);
+        assert_eq!(messages[4]["error"]["code"], METHOD_NOT_FOUND);
+        assert!(
+            messages[5]["error"]["message"]
+                .as_str()
+                .unwrap()
+                .contains("is outside")
+        );
+        assert!(
+            messages[6]["error"]["message"]
+                .as_str()
+                .unwrap()
+                .starts_with("Plugin 'run' refused")
+        );
+        assert_eq!(messages[7]["result"], Value::Null);
+    }
+}
@@ -33,6 +33,24 @@ pub fn unified_diff(original: &str, modified: &str, path: &Path) -> String {
     output
 }
 
+/// A patch turning `original` into `modified` for the file at `path`,
+/// relative to the repository root, as `git diff` writes it: `git apply`
+/// and `patch -p1` accept it. Empty if the contents are equal.
+pub fn git_diff(original: &str, modified: &str, path: &Path) -> String {
+    if original == modified {
+        return String::new();
+    }
+    let path = path.to_string_lossy().replace('\\', "/");
+    format!(
+        "diff --git a/{0} b/{0}\n{1}",
+        path,
+        TextDiff::from_lines(original, modified)
+            .unified_diff()
+            .context_radius(3)
+            .header(&format!("a/{}", path), &format!("b/{}", path))
+    )
+}
+
 /// Represents a summary of changes.
 #[derive(Debug, Default)]
 pub struct DiffSummary {
@@ -85,6 +103,14 @@ impl std::fmt::Display for DiffSummary {
     }
 }
 
+/// 64-bit FNV-1a hash; stable across platforms and Rust versions, so it is
+/// safe to persist as a content fingerprint.
+pub(crate) fn fnv1a(bytes: &[u8]) -> u64 {
+    bytes.iter().fold(0xcbf29ce484222325, |hash, byte| {
+        (hash ^ u64::from(*byte)).wrapping_mul(0x100000001b3)
+    })
+}
+
 /// Colorized diff output for terminal display.
 pub fn colorized_diff(original: &str, modified: &str, path: &Path) -> String {
     let diff = TextDiff::from_lines(original, modified);
@@ -138,6 +164,17 @@ mod tests {
         assert!(diff.contains("+modified"));
     }
 
+    #[test]
+    fn test_git_diff() {
+        let path = Path::new("pkg/client.go");
+        let diff = git_diff("a()\nold()\n", "a()\nnew()\n", path);
+        assert!(diff.starts_with(
+            "diff --git a/pkg/client.go b/pkg/client.go\n--- a/pkg/client.go\n+++ b/pkg/client.go\n"
+        ));
+        assert!(diff.contains("\n-old()\n") && diff.contains("\n+new()\n"));
+        assert!(git_diff("same\n", "same\n", path).is_empty());
+    }
+
     #[test]
     fn test_unified_diff_addition() {
         let original = "line1\nline2\n";
@@ -248,6 +285,12 @@ mod tests {
         assert!(diff.contains("\x1b[0m")); // RESET
     }
 
+    #[test]
+    fn test_fnv1a_is_stable() {
+        assert_eq!(fnv1a(b""), 0xcbf29ce484222325);
+        assert_eq!(fnv1a(b"a"), 0xaf63dc4c8601ec8c);
+    }
+
     #[test]
     fn test_diff_empty_original() {
         let original = "";
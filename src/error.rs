@@ -65,6 +65,24 @@ pub enum RefactorError {
 
     #[error("Pull request creation failed: {message}")]
     PullRequestError { message: String },
+
+    #[error("Issue tracker error: {message}")]
+    IssueTracker { message: String },
+
+    #[error("Journal error: {message}")]
+    Journal { message: String },
+
+    #[error("Vulnerability scan failed: {message}")]
+    VulnScan { message: String },
+
+    #[error("Pack registry error: {message}")]
+    Registry { message: String },
+
+    #[error("Name collision: {message}")]
+    NameCollision { message: String },
+
+    #[error("Language model request failed: {message}")]
+    LanguageModel { message: String },
 }
 
 /// A specialized Result type for refactoring operations.
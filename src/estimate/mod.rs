@@ -0,0 +1,424 @@
+//! Effort estimates for migrations.
+//!
+//! Engineering managers want to know how much engineer time a migration
+//! takes before approving it. [`EffortEstimate`] turns a dry run into
+//! engineer-hours from what the run found:
+//!
+//! - every call site a rule rewrites still has to be reviewed,
+//! - every finding of a `suggest`-mode rule has to be changed by hand,
+//! - every [`TODO_MARKER`](crate::runner::TODO_MARKER) left in the code is follow-up work,
+//! - every affected file has to be built, tested and landed, and the
+//!   migration as a whole has a fixed cost.
+//!
+//! The cost of each is an [`EffortWeights`] value. The defaults are a
+//! starting point; calibrate them against migrations the team has done.
+//!
+//! Every call site is classified as fully automatic, automatic with TODO
+//! (rewritten, but with a [`TODO_MARKER`](crate::runner::TODO_MARKER) left for the author) or manual,
+//! and the counts are summarized per rule and per package (the directory
+//! of the file).
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::estimate::{EffortEstimate, EffortWeights};
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let config = UpgradeConfig::from_file("upgrade.yaml")?;
+//! let report = UpgradeRunner::new(config).dry_run().run("./project")?;
+//! let estimate = EffortEstimate::new(&report, &EffortWeights::default());
+//! println!("{}", estimate);
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::error::{RefactorError, Result};
+use crate::runner::{RunReport, has_marker};
+
+/// The cost of each kind of work, in minutes unless stated otherwise.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct EffortWeights {
+    /// Reviewing one rewritten call site.
+    pub review_minutes: f64,
+    /// Changing one `suggest`-mode finding by hand.
+    pub manual_minutes: f64,
+    /// Resolving one TODO marker.
+    pub todo_minutes: f64,
+    /// Building, testing and landing the changes to one file.
+    pub file_minutes: f64,
+    /// Fixed cost of the migration, in hours: planning, coordination and
+    /// rollout.
+    pub fixed_hours: f64,
+}
+
+impl Default for EffortWeights {
+    fn default() -> Self {
+        Self {
+            review_minutes: 1.0,
+            manual_minutes: 15.0,
+            todo_minutes: 30.0,
+            file_minutes: 5.0,
+            fixed_hours: 4.0,
+        }
+    }
+}
+
+impl EffortWeights {
+    /// Load weights from a YAML or JSON file. Weights it leaves out keep
+    /// their defaults.
+    pub fn from_file(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref();
+        serde_yaml::from_str(&fs::read_to_string(path)?).map_err(|e| {
+            RefactorError::InvalidConfig(format!("Failed to parse {}: {}", path.display(), e))
+        })
+    }
+}
+
+/// The work left by one rule.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct RuleEffort {
+    /// Name of the rule.
+    pub rule: String,
+    /// Call sites the rule rewrites, including those left with a TODO
+    /// marker.
+    pub automated: usize,
+    /// Call sites the rule rewrites but leaves a TODO marker at.
+    pub with_todo: usize,
+    /// Call sites the rule reports for a manual change.
+    pub manual: usize,
+    /// Files with a call site of the rule.
+    pub files: usize,
+    /// Hours to review and change the call sites.
+    pub hours: f64,
+}
+
+/// The call sites in one package.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct PackageEffort {
+    /// Directory of the package.
+    pub package: PathBuf,
+    /// Call sites rewritten, including those left with a TODO marker.
+    pub automated: usize,
+    /// Call sites rewritten but left with a TODO marker.
+    pub with_todo: usize,
+    /// Call sites to change by hand.
+    pub manual: usize,
+    /// Files with a call site.
+    pub files: usize,
+}
+
+/// An estimate of the engineer time a migration takes.
+#[derive(Debug, Clone, Serialize)]
+pub struct EffortEstimate {
+    /// Work per rule, busiest first.
+    pub rules: Vec<RuleEffort>,
+    /// Call sites per package, most first.
+    pub packages: Vec<PackageEffort>,
+    /// Call sites rewritten automatically.
+    pub automated: usize,
+    /// Call sites rewritten but left with a TODO marker.
+    pub with_todo: usize,
+    /// Call sites to change by hand.
+    pub manual: usize,
+    /// TODO markers to resolve.
+    pub todos: usize,
+    /// Files with a call site or TODO marker.
+    pub files: usize,
+    /// Estimated engineer-hours, overhead included.
+    pub hours: f64,
+    /// The weights the estimate is based on.
+    pub weights: EffortWeights,
+}
+
+impl EffortEstimate {
+    /// Estimate the migration `report`, a dry run of its rules.
+    pub fn new(report: &RunReport, weights: &EffortWeights) -> Self {
+        let mut rules: BTreeMap<&str, Sites> = BTreeMap::new();
+        let mut packages: BTreeMap<&Path, Sites> = BTreeMap::new();
+        for edit in &report.edits {
+            for sites in [
+                rules.entry(edit.rule.as_str()).or_default(),
+                packages.entry(package_of(&edit.path)).or_default(),
+            ] {
+                sites.automated += 1;
+                sites.with_todo += usize::from(edit.todo);
+                sites.files.insert(&edit.path);
+            }
+        }
+        for diagnostic in &report.diagnostics {
+            for sites in [
+                rules.entry(diagnostic.rule.as_str()).or_default(),
+                packages.entry(package_of(&diagnostic.path)).or_default(),
+            ] {
+                sites.manual += 1;
+                sites.files.insert(&diagnostic.path);
+            }
+        }
+
+        let mut files: BTreeSet<PathBuf> = rules
+            .values()
+            .flat_map(|sites| sites.files.iter().map(|path| path.to_path_buf()))
+            .collect();
+        files.extend(
+            report
+                .changes
+                .iter()
+                .filter(|change| has_marker(&change.transformed))
+                .map(|change| change.path.clone()),
+        );
+
+        let mut rules: Vec<RuleEffort> = rules
+            .into_iter()
+            .map(|(rule, sites)| RuleEffort {
+                rule: rule.to_string(),
+                automated: sites.automated,
+                with_todo: sites.with_todo,
+                manual: sites.manual,
+                files: sites.files.len(),
+                hours: (sites.automated as f64 * weights.review_minutes
+                    + sites.manual as f64 * weights.manual_minutes)
+                    / 60.0,
+            })
+            .collect();
+        rules.sort_by(|a, b| b.hours.total_cmp(&a.hours));
+        let mut packages: Vec<PackageEffort> = packages
+            .into_iter()
+            .map(|(package, sites)| PackageEffort {
+                package: package.to_path_buf(),
+                automated: sites.automated,
+                with_todo: sites.with_todo,
+                manual: sites.manual,
+                files: sites.files.len(),
+            })
+            .collect();
+        packages.sort_by_key(|p| std::cmp::Reverse(p.automated + p.manual));
+
+        let todos = report.manual_todos;
+        let mut hours = rules.iter().map(|rule| rule.hours).sum::<f64>()
+            + (todos as f64 * weights.todo_minutes + files.len() as f64 * weights.file_minutes)
+                / 60.0;
+        if hours > 0.0 {
+            hours += weights.fixed_hours;
+        }
+        Self {
+            automated: rules.iter().map(|rule| rule.automated).sum(),
+            with_todo: rules.iter().map(|rule| rule.with_todo).sum(),
+            manual: rules.iter().map(|rule| rule.manual).sum(),
+            rules,
+            packages,
+            todos,
+            files: files.len(),
+            hours,
+            weights: weights.clone(),
+        }
+    }
+
+    /// Name packages relative to the project root `root`.
+    pub fn root(mut self, root: impl AsRef<Path>) -> Self {
+        for package in &mut self.packages {
+            if let Ok(relative) = package.package.strip_prefix(root.as_ref()) {
+                package.package = relative.to_path_buf();
+            }
+        }
+        self
+    }
+
+    /// Returns true if the migration leaves nothing to do.
+    pub fn is_empty(&self) -> bool {
+        self.hours == 0.0
+    }
+
+    /// Share of the work items (call sites and TODO markers) that are
+    /// rewritten automatically, from 0 to 1.
+    pub fn automated_share(&self) -> f64 {
+        let total = self.automated + self.manual + self.todos;
+        if total == 0 {
+            return 1.0;
+        }
+        self.automated as f64 / total as f64
+    }
+}
+
+impl fmt::Display for EffortEstimate {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.is_empty() {
+            return write!(f, "Nothing to migrate: 0 engineer-hours");
+        }
+        for rule in &self.rules {
+            writeln!(
+                f,
+                "{}: {} in {} file(s) - {:.1} h",
+                rule.rule,
+                classes(rule.automated, rule.with_todo, rule.manual),
+                rule.files,
+                rule.hours
+            )?;
+        }
+        for package in &self.packages {
+            let name = if package.package.as_os_str().is_empty() {
+                Path::new(".")
+            } else {
+                package.package.as_path()
+            };
+            writeln!(
+                f,
+                "package {}: {} in {} file(s)",
+                name.display(),
+                classes(package.automated, package.with_todo, package.manual),
+                package.files
+            )?;
+        }
+        let w = &self.weights;
+        if self.todos > 0 {
+            writeln!(
+                f,
+                "{} TODO marker(s) - {:.1} h",
+                self.todos,
+                self.todos as f64 * w.todo_minutes / 60.0
+            )?;
+        }
+        writeln!(
+            f,
+            "{} file(s) to build, test and land - {:.1} h",
+            self.files,
+            self.files as f64 * w.file_minutes / 60.0
+        )?;
+        writeln!(f, "fixed overhead - {:.1} h", w.fixed_hours)?;
+        write!(
+            f,
+            "Estimated effort: {:.1} engineer-hours ({:.0}% of {} work item(s) automated)",
+            self.hours,
+            self.automated_share() * 100.0,
+            self.automated + self.manual + self.todos
+        )
+    }
+}
+
+/// Call sites counted for a rule or package.
+#[derive(Default)]
+struct Sites<'a> {
+    automated: usize,
+    with_todo: usize,
+    manual: usize,
+    files: BTreeSet<&'a Path>,
+}
+
+/// The package of the file at `path`: its directory.
+fn package_of(path: &Path) -> &Path {
+    path.parent().unwrap_or(Path::new(""))
+}
+
+/// The call sites of each class, as in `3 fully automatic, 1 automatic with
+/// TODO, 0 manual`.
+fn classes(automated: usize, with_todo: usize, manual: usize) -> String {
+    format!(
+        "{} fully automatic, {} automatic with TODO, {} manual",
+        automated - with_todo,
+        with_todo,
+        manual
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::runner::{Diagnostic, RuleEdit};
+    use crate::transform::FileChange;
+
+    fn edit(rule: &str, path: &str) -> RuleEdit {
+        RuleEdit {
+            rule: rule.into(),
+            path: path.into(),
+            line: 1,
+            todo: false,
+        }
+    }
+
+    #[test]
+    fn test_estimate() {
+        let report = RunReport {
+            edits: vec![
+                edit("rename-get-user", "a.go"),
+                edit("rename-get-user", "a.go"),
+                RuleEdit {
+                    todo: true,
+                    ..edit("rename-get-user", "svc/b.go")
+                },
+            ],
+            diagnostics: vec![Diagnostic {
+                rule: "flag-dial".into(),
+                message: "Dial is going away".into(),
+                path: "c.go".into(),
+                line: 3,
+                column: 1,
+                text: "Dial(".into(),
+                suggestion: "Connect(".into(),
+            }],
+            changes: vec![FileChange {
+                path: "d.go".into(),
+                original: "x()\n".into(),
+                transformed: "// TODO(refactor): check x\nx()\n".into(),
+            }],
+            manual_todos: 1,
+            ..Default::default()
+        };
+        let weights = EffortWeights {
+            review_minutes: 2.0,
+            manual_minutes: 30.0,
+            todo_minutes: 60.0,
+            file_minutes: 6.0,
+            fixed_hours: 1.0,
+        };
+
+        let estimate = EffortEstimate::new(&report, &weights);
+
+        assert_eq!(estimate.rules[0].rule, "flag-dial");
+        assert_eq!(estimate.rules[1].automated, 3);
+        assert_eq!(estimate.rules[1].files, 2);
+        assert_eq!(
+            (estimate.automated, estimate.manual, estimate.todos),
+            (3, 1, 1)
+        );
+        assert_eq!(estimate.files, 4);
+        let packages: Vec<(&Path, usize, usize, usize)> = estimate
+            .packages
+            .iter()
+            .map(|p| (p.package.as_path(), p.automated, p.with_todo, p.manual))
+            .collect();
+        assert_eq!(
+            packages,
+            [(Path::new(""), 2, 0, 1), (Path::new("svc"), 1, 1, 0)]
+        );
+        let text = estimate.to_string();
+        assert!(text.contains(
+            "rename-get-user: 2 fully automatic, 1 automatic with TODO, 0 manual in 2 file(s)"
+        ));
+        assert!(text.contains("package .: 2 fully automatic, 0 automatic with TODO, 1 manual"));
+        // 6 + 30 + 60 + 24 minutes, plus 1 hour
+        assert!((estimate.hours - 3.0).abs() < 1e-9);
+        assert!((estimate.automated_share() - 0.6).abs() < 1e-9);
+        assert!(
+            estimate.to_string().ends_with(
+                "Estimated effort: 3.0 engineer-hours (60% of 5 work item(s) automated)"
+            )
+        );
+
+        let nothing = EffortEstimate::new(&RunReport::default(), &weights);
+        assert!(nothing.is_empty());
+    }
+
+    #[test]
+    fn test_weights_default_missing_fields() {
+        let weights: EffortWeights = serde_json::from_str(r#"{"manual_minutes": 20}"#).unwrap();
+        assert_eq!(weights.manual_minutes, 20.0);
+        assert_eq!(weights.fixed_hours, EffortWeights::default().fixed_hours);
+        assert!(serde_json::from_str::<EffortWeights>(r#"{"minutes": 1}"#).is_err());
+    }
+}
@@ -0,0 +1,272 @@
+//! Language model proposals for sites left for manual work.
+//!
+//! Where a rule cannot rewrite a site it leaves a [`TODO_MARKER`](crate::runner::TODO_MARKER) comment
+//! saying what the author has to do. [`ManualFallback`] is an opt-in step
+//! that sends each marked site, with the code around it, to a language
+//! model (see [`ChatModel`]) and parses the edit it proposes.
+//!
+//! Proposals are never applied by the fallback. The caller shows each one
+//! as a diff and applies the ones a human approves with
+//! [`Proposal::apply`], which refuses if the site changed since.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::fallback::ManualFallback;
+//! use std::path::Path;
+//!
+//! let path = Path::new("client/pool.go");
+//! let text = std::fs::read_to_string(path)?;
+//! for proposal in ManualFallback::from_env()?.propose(path, &text)? {
+//!     println!("{}", proposal.diff(&text).unwrap_or_default());
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::Deserialize;
+use std::path::{Path, PathBuf};
+
+use crate::diff::unified_diff;
+use crate::error::Result;
+use crate::llm::{ChatModel, extract_json};
+use crate::runner::{find_todos, has_marker};
+
+/// Lines of code sent on each side of a site by default.
+const CONTEXT_LINES: usize = 20;
+
+/// Instructions sent with every request.
+const INSTRUCTIONS: &str = r#"You finish migrations a deterministic code rewriting engine could not complete. You are given a file excerpt and a site in it: a TODO(refactor) comment, possibly tagged with a rule and tracking id as TODO(refactor-dsl:rule:id), explaining what is left to do and the code it refers to. Propose the code that replaces the site, with the comment resolved and removed, keeping the indentation and style of the file. Answer with a JSON object and nothing else: {"replacement": "<the site's new lines>", "explanation": "<one sentence>"}. If you cannot complete the migration with confidence, answer {"replacement": null, "explanation": "<why>"}."#;
+
+/// A site marked for manual work.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ManualSite {
+    /// File containing the site.
+    pub path: PathBuf,
+    /// Line of the site's first line (1-based).
+    pub line: usize,
+    /// The lines of the site: the marker, and the code line after it when
+    /// the marker is a comment on its own line.
+    pub text: String,
+    /// What the marker says is left to do.
+    pub note: String,
+}
+
+/// An edit proposed by the model for a [`ManualSite`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Proposal {
+    /// The site the edit replaces.
+    pub site: ManualSite,
+    /// The lines replacing the site.
+    pub replacement: String,
+    /// The model's explanation of the edit.
+    pub explanation: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct Answer {
+    replacement: Option<String>,
+    #[serde(default)]
+    explanation: String,
+}
+
+/// Proposes edits for manual sites with a language model.
+#[derive(Debug, Clone)]
+pub struct ManualFallback {
+    model: ChatModel,
+    context: usize,
+}
+
+impl ManualFallback {
+    /// A fallback asking `model`.
+    pub fn new(model: ChatModel) -> Self {
+        Self {
+            model,
+            context: CONTEXT_LINES,
+        }
+    }
+
+    /// A fallback asking the model configured in the environment (see
+    /// [`ChatModel::from_env`]).
+    pub fn from_env() -> Result<Self> {
+        Ok(Self::new(ChatModel::from_env()?))
+    }
+
+    /// Send `lines` of code on each side of a site (20 by default).
+    pub fn context(mut self, lines: usize) -> Self {
+        self.context = lines;
+        self
+    }
+
+    /// The model's name.
+    pub fn model(&self) -> &str {
+        self.model.name()
+    }
+
+    /// Proposals for the manual sites of `text`, the content of `path`.
+    /// Sites the model declines are left out.
+    pub fn propose(&self, path: &Path, text: &str) -> Result<Vec<Proposal>> {
+        let mut proposals = Vec::new();
+        for site in manual_sites(path, text) {
+            let answer = self
+                .model
+                .complete(INSTRUCTIONS, &prompt(&site, text, self.context))?;
+            proposals.extend(parse_proposal(&answer, site));
+        }
+        Ok(proposals)
+    }
+}
+
+/// The sites of `text`, the content of `path`, marked for manual work.
+pub fn manual_sites(path: &Path, text: &str) -> Vec<ManualSite> {
+    let lines: Vec<&str> = text.split_inclusive('\n').collect();
+    let mut sites = Vec::new();
+    // First line not covered by a site yet
+    let mut next = 0;
+    for todo in find_todos(path, text) {
+        let index = todo.line - 1;
+        if index < next {
+            continue;
+        }
+        // A marker on its own line is about the code line below it
+        let own_line = is_comment(lines[index].trim_start());
+        let end = if own_line && index + 1 < lines.len() && !has_marker(lines[index + 1]) {
+            index + 2
+        } else {
+            index + 1
+        };
+        sites.push(ManualSite {
+            path: path.to_path_buf(),
+            line: todo.line,
+            text: lines[index..end].concat(),
+            note: todo.note,
+        });
+        next = end;
+    }
+    sites
+}
+
+fn is_comment(line: &str) -> bool {
+    ["//", "#", "/*", "--"]
+        .iter()
+        .any(|prefix| line.starts_with(prefix))
+}
+
+impl ManualSite {
+    /// Byte range of the site in `text`, if the site is still there: the
+    /// lines with its text nearest its line, which edits above it may have
+    /// moved.
+    fn span(&self, text: &str) -> Option<std::ops::Range<usize>> {
+        let mut start = 0;
+        let mut nearest: Option<(usize, usize)> = None;
+        for (index, line) in text.split_inclusive('\n').enumerate() {
+            if text[start..].starts_with(&self.text) {
+                let distance = (index + 1).abs_diff(self.line);
+                if nearest.is_none_or(|(best, _)| distance < best) {
+                    nearest = Some((distance, start));
+                }
+            }
+            start += line.len();
+        }
+        nearest.map(|(_, start)| start..start + self.text.len())
+    }
+}
+
+impl Proposal {
+    /// `text` with the edit applied, or `None` if the site is no longer in
+    /// `text` as it was when the edit was proposed. Other edits to the file
+    /// may have moved the site to another line.
+    pub fn apply(&self, text: &str) -> Option<String> {
+        let span = self.site.span(text)?;
+        Some(format!(
+            "{}{}{}",
+            &text[..span.start],
+            self.replacement,
+            &text[span.end..]
+        ))
+    }
+
+    /// The edit as a unified diff against `text`.
+    pub fn diff(&self, text: &str) -> Option<String> {
+        Some(unified_diff(text, &self.apply(text)?, &self.site.path))
+    }
+}
+
+/// The request describing `site` of `text` to the model, with `context`
+/// lines on each side.
+fn prompt(site: &ManualSite, text: &str, context: usize) -> String {
+    let lines: Vec<&str> = text.split_inclusive('\n').collect();
+    let first = site.line.saturating_sub(context + 1);
+    let last = (site.line + site.text.lines().count() - 1 + context).min(lines.len());
+    format!(
+        "File: {}\nLeft to do: {}\n\nExcerpt (lines {}-{}):\n{}\nSite (line {}):\n{}",
+        site.path.display(),
+        site.note,
+        first + 1,
+        last,
+        lines[first..last].concat(),
+        site.line,
+        site.text
+    )
+}
+
+/// The edit proposed for `site` in the model's answer `content`, unless the
+/// model declined or left the marker in.
+fn parse_proposal(content: &str, site: ManualSite) -> Option<Proposal> {
+    let answer: Answer = extract_json(content, '{', '}')?;
+    let mut replacement = answer.replacement?;
+    if has_marker(&replacement) {
+        return None;
+    }
+    if site.text.ends_with('\n') && !replacement.is_empty() && !replacement.ends_with('\n') {
+        replacement.push('\n');
+    }
+    Some(Proposal {
+        site,
+        replacement,
+        explanation: answer.explanation,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_propose_and_apply() {
+        let path = Path::new("pool.go");
+        let text = "func main() {\n\t// TODO(refactor): Connect was removed; use Dial\n\tpool.Connect(addr)\n\tcfg := Config{Timeout: 1 /* TODO(refactor): set field Retries */}\n}\n";
+        let sites = manual_sites(path, text);
+        assert_eq!(sites.len(), 2);
+        assert_eq!(sites[0].line, 2);
+        assert_eq!(sites[0].note, "Connect was removed; use Dial");
+        assert!(sites[0].text.ends_with("\tpool.Connect(addr)\n"));
+        assert_eq!(sites[1].line, 4);
+        assert_eq!(sites[1].note, "set field Retries");
+
+        let prompt = prompt(&sites[0], text, 1);
+        assert!(prompt.contains("Excerpt (lines 1-4)"));
+
+        let answer = "```json\n{\"replacement\": \"\\tpool.Dial(addr)\", \"explanation\": \"Dial replaces Connect\"}\n```";
+        let proposal = parse_proposal(answer, sites[0].clone()).unwrap();
+        assert_eq!(
+            proposal.apply(text).unwrap(),
+            "func main() {\n\tpool.Dial(addr)\n\tcfg := Config{Timeout: 1 /* TODO(refactor): set field Retries */}\n}\n"
+        );
+        assert!(proposal.diff(text).unwrap().contains("+\tpool.Dial(addr)"));
+        assert!(proposal.apply("func main() {\n}\n").is_none());
+
+        // The first edit moved the second site up a line
+        let edited = proposal.apply(text).unwrap();
+        let answer = r#"{"replacement": "\tcfg := Config{Timeout: 1, Retries: 3}\n"}"#;
+        let second = parse_proposal(answer, sites[1].clone()).unwrap();
+        assert_eq!(
+            second.apply(&edited).unwrap(),
+            "func main() {\n\tpool.Dial(addr)\n\tcfg := Config{Timeout: 1, Retries: 3}\n}\n"
+        );
+
+        let declined = r#"{"replacement": null, "explanation": "Dial needs a context"}"#;
+        assert!(parse_proposal(declined, sites[0].clone()).is_none());
+        let unresolved = r#"{"replacement": "// TODO(refactor): still to do\n"}"#;
+        assert!(parse_proposal(unresolved, sites[1].clone()).is_none());
+    }
+}
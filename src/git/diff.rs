@@ -0,0 +1,45 @@
+//! Files changed relative to a base ref.
+
+use crate::error::{RefactorError, Result};
+use crate::git::GitOps;
+use git2::{Delta, DiffOptions};
+use std::path::PathBuf;
+
+/// Diff operations for GitOps.
+pub trait DiffOps {
+    /// Files changed on this branch since it forked from `base` (a branch,
+    /// tag or commit), like `git diff base...`, plus uncommitted and
+    /// untracked files. Deleted files are left out. Paths are relative to
+    /// the working directory.
+    fn changed_since(&self, base: &str) -> Result<Vec<PathBuf>>;
+}
+
+impl DiffOps for GitOps {
+    fn changed_since(&self, base: &str) -> Result<Vec<PathBuf>> {
+        let base_commit = self
+            .repo
+            .revparse_single(base)
+            .and_then(|obj| obj.peel_to_commit())
+            .map_err(|e| {
+                RefactorError::InvalidConfig(format!("Invalid git ref '{}': {}", base, e))
+            })?;
+        let head = self.repo.head()?.peel_to_commit()?;
+        let fork_point = self.repo.merge_base(base_commit.id(), head.id())?;
+        let tree = self.repo.find_commit(fork_point)?.tree()?;
+
+        let mut opts = DiffOptions::new();
+        opts.include_untracked(true).recurse_untracked_dirs(true);
+        let diff = self
+            .repo
+            .diff_tree_to_workdir_with_index(Some(&tree), Some(&mut opts))?;
+
+        let mut files: Vec<PathBuf> = diff
+            .deltas()
+            .filter(|delta| delta.status() != Delta::Deleted)
+            .filter_map(|delta| delta.new_file().path().map(PathBuf::from))
+            .collect();
+        files.sort();
+        files.dedup();
+        Ok(files)
+    }
+}
@@ -6,11 +6,13 @@
 mod auth;
 mod branch;
 mod commit;
+mod diff;
 mod push;
 
 pub use auth::GitAuth;
 pub use branch::BranchOps;
 pub use commit::CommitOps;
+pub use diff::DiffOps;
 pub use push::PushOps;
 
 use crate::error::Result;
@@ -22,6 +24,7 @@ use std::path::Path;
 /// Provides a unified interface for git operations needed by the codemod system:
 /// - Branch creation and checkout
 /// - Staging and committing changes
+/// - Listing the files changed since a base ref
 /// - Pushing to remotes with authentication
 ///
 /// # Example
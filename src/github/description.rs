@@ -0,0 +1,233 @@
+//! Pull request descriptions for upgrade runs.
+//!
+//! [`UpgradeDescription`] renders a [`RunReport`] as the Markdown body of a
+//! pull request: the rules applied and how often, the size of the change,
+//! and the manual follow-up left for reviewers (findings of `suggest`-mode
+//! rules and [`TODO_MARKER`]s in the changed files).
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::github::UpgradeDescription;
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let config = UpgradeConfig::from_file("upgrade.yaml")?;
+//! let report = UpgradeRunner::new(config.clone()).run("./project")?;
+//! let body = UpgradeDescription::new(&config.name, "./project", &report).to_string();
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use std::collections::BTreeMap;
+use std::fmt;
+use std::path::{Path, PathBuf};
+
+use crate::runner::{RunReport, TODO_MARKER, has_marker};
+
+/// Maximum number of follow-up items listed before the rest are summarized.
+const MAX_ITEMS: usize = 50;
+
+/// The description of a pull request applying an upgrade.
+#[derive(Debug)]
+pub struct UpgradeDescription<'a> {
+    name: &'a str,
+    root: PathBuf,
+    report: &'a RunReport,
+}
+
+impl<'a> UpgradeDescription<'a> {
+    /// Describe `report`, a run of upgrade `name` against `root`. Paths are
+    /// shown relative to `root`.
+    pub fn new(name: &'a str, root: impl Into<PathBuf>, report: &'a RunReport) -> Self {
+        Self {
+            name,
+            root: root.into(),
+            report,
+        }
+    }
+
+    /// The default pull request title.
+    pub fn title(&self) -> String {
+        format!("Apply {} upgrade", self.name)
+    }
+
+    fn relative<'p>(&self, path: &'p Path) -> &'p Path {
+        path.strip_prefix(&self.root).unwrap_or(path)
+    }
+
+    /// Manual follow-up items: `suggest`-mode findings, then markers left in
+    /// the changed files.
+    fn todos(&self) -> Vec<String> {
+        let findings = self.report.diagnostics.iter().map(|d| {
+            format!(
+                "`{}:{}` [{}] {} (suggested: `{}`)",
+                self.relative(&d.path).display(),
+                d.line,
+                d.rule,
+                d.message,
+                d.suggestion
+            )
+        });
+        let markers = self.report.changes.iter().flat_map(|change| {
+            change
+                .transformed
+                .lines()
+                .enumerate()
+                .filter(|(_, line)| has_marker(line))
+                .map(|(i, line)| {
+                    format!(
+                        "`{}:{}` {}",
+                        self.relative(&change.path).display(),
+                        i + 1,
+                        line.trim()
+                    )
+                })
+        });
+        findings.chain(markers).collect()
+    }
+}
+
+impl fmt::Display for UpgradeDescription<'_> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let report = self.report;
+        writeln!(
+            f,
+            "This pull request applies the **{}** upgrade.",
+            self.name
+        )?;
+
+        let mut rules: BTreeMap<&str, (usize, Vec<&Path>)> = BTreeMap::new();
+        for edit in &report.edits {
+            let (count, files) = rules.entry(edit.rule.as_str()).or_default();
+            *count += 1;
+            if !files.contains(&edit.path.as_path()) {
+                files.push(&edit.path);
+            }
+        }
+        if !rules.is_empty() {
+            writeln!(f, "\n### Applied rules\n")?;
+            writeln!(f, "| Rule | Edits | Files |")?;
+            writeln!(f, "| --- | ---: | ---: |")?;
+            for (rule, (count, files)) in &rules {
+                writeln!(f, "| `{}` | {} | {} |", rule, count, files.len())?;
+            }
+        }
+
+        writeln!(f, "\n### Changes\n")?;
+        writeln!(
+            f,
+            "{} file(s) changed, {} insertion(s), {} deletion(s).",
+            report.files_modified(),
+            report.summary.insertions,
+            report.summary.deletions
+        )?;
+
+        writeln!(f, "\n### Remaining manual work\n")?;
+        let todos = self.todos();
+        let listed_markers = todos.len() - report.diagnostics.len();
+        if todos.is_empty() && report.manual_todos == 0 {
+            writeln!(f, "None: the upgrade was applied completely.")?;
+        }
+        for todo in todos.iter().take(MAX_ITEMS) {
+            writeln!(f, "- [ ] {}", todo)?;
+        }
+        if todos.len() > MAX_ITEMS {
+            writeln!(f, "- and {} more", todos.len() - MAX_ITEMS)?;
+        }
+        if report.manual_todos > listed_markers {
+            writeln!(
+                f,
+                "\n{} `{}` marker(s) remain in files this pull request does not change.",
+                report.manual_todos - listed_markers,
+                TODO_MARKER
+            )?;
+        }
+
+        write!(f, "\n<sub>Generated by refactor-dsl.</sub>")
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::diff::DiffSummary;
+    use crate::runner::{Diagnostic, RuleEdit};
+    use crate::transform::FileChange;
+
+    fn edit(rule: &str, path: &str, line: usize) -> RuleEdit {
+        RuleEdit {
+            rule: rule.into(),
+            path: PathBuf::from(path),
+            line,
+            todo: false,
+        }
+    }
+
+    #[test]
+    fn test_describes_rules_and_manual_work() {
+        let report = RunReport {
+            files_scanned: 4,
+            changes: vec![FileChange {
+                path: PathBuf::from("/repo/client.go"),
+                original: "Dial()\nold()\n".into(),
+                transformed: "Connect()\n// TODO(refactor): check the timeout\nold()\n".into(),
+            }],
+            diagnostics: vec![Diagnostic {
+                rule: "no-sleep".into(),
+                message: "Use a ticker".into(),
+                path: PathBuf::from("/repo/worker.go"),
+                line: 7,
+                column: 2,
+                text: "Sleep(1)".into(),
+                suggestion: "NewTicker(1)".into(),
+            }],
+            edits: vec![
+                edit("dial-to-connect", "/repo/client.go", 1),
+                edit("dial-to-connect", "/repo/client.go", 9),
+                edit("add-timeout", "/repo/client.go", 2),
+            ],
+            manual_todos: 3,
+            summary: DiffSummary {
+                files_changed: 1,
+                insertions: 2,
+                deletions: 1,
+            },
+            ..Default::default()
+        };
+        let description = UpgradeDescription::new("pool-v2", "/repo", &report);
+
+        assert_eq!(description.title(), "Apply pool-v2 upgrade");
+        assert_eq!(
+            description.to_string(),
+            "This pull request applies the **pool-v2** upgrade.
+
+### Applied rules
+
+| Rule | Edits | Files |
+| --- | ---: | ---: |
+| `add-timeout` | 1 | 1 |
+| `dial-to-connect` | 2 | 1 |
+
+### Changes
+
+1 file(s) changed, 2 insertion(s), 1 deletion(s).
+
+### Remaining manual work
+
+- [ ] `worker.go:7` [no-sleep] Use a ticker (suggested: `NewTicker(1)`)
+- [ ] `client.go:2` // TODO(refactor): check the timeout
+
+2 `TODO(refactor)` marker(s) remain in files this pull request does not change.
+
+<sub>Generated by refactor-dsl.</sub>"
+        );
+    }
+
+    #[test]
+    fn test_complete_upgrade() {
+        let report = RunReport::default();
+        let description = UpgradeDescription::new("noop", "/repo", &report).to_string();
+        assert!(description.contains("None: the upgrade was applied completely."));
+        assert!(!description.contains("Applied rules"));
+    }
+}
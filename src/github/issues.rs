@@ -0,0 +1,166 @@
+//! Issue operations using octocrab.
+
+use crate::error::{RefactorError, Result};
+use crate::github::GitHubClient;
+use octocrab::models::issues::Issue as OctocrabIssue;
+
+/// An issue on GitHub.
+#[derive(Debug, Clone)]
+pub struct Issue {
+    pub number: u64,
+    pub html_url: String,
+    pub title: String,
+    pub body: Option<String>,
+}
+
+impl From<OctocrabIssue> for Issue {
+    fn from(issue: OctocrabIssue) -> Self {
+        Self {
+            number: issue.number,
+            html_url: issue.html_url.to_string(),
+            title: issue.title,
+            body: issue.body,
+        }
+    }
+}
+
+/// Issue operations.
+pub trait IssueOps {
+    /// Create a new issue with the given labels.
+    fn create_issue(
+        &self,
+        owner: &str,
+        repo: &str,
+        title: &str,
+        body: &str,
+        labels: &[String],
+    ) -> Result<Issue>;
+
+    /// List open issues carrying all of the given labels, every page.
+    fn list_open_issues(&self, owner: &str, repo: &str, labels: &[String]) -> Result<Vec<Issue>>;
+
+    /// Replace the body of an issue.
+    fn update_issue_body(&self, owner: &str, repo: &str, number: u64, body: &str) -> Result<()>;
+
+    /// Close an issue, leaving a comment explaining why.
+    fn close_issue(&self, owner: &str, repo: &str, number: u64, comment: &str) -> Result<()>;
+}
+
+impl IssueOps for GitHubClient {
+    fn create_issue(
+        &self,
+        owner: &str,
+        repo: &str,
+        title: &str,
+        body: &str,
+        labels: &[String],
+    ) -> Result<Issue> {
+        let octocrab = self.octocrab.clone();
+        let owner = owner.to_string();
+        let repo = repo.to_string();
+        let title = title.to_string();
+        let body = body.to_string();
+        let labels = labels.to_vec();
+
+        self.block_on(async move {
+            let issue = octocrab
+                .issues(&owner, &repo)
+                .create(title)
+                .body(body)
+                .labels(labels)
+                .send()
+                .await
+                .map_err(|e| RefactorError::GitHub {
+                    message: format!("Failed to create issue: {}", e),
+                })?;
+
+            Ok(Issue::from(issue))
+        })
+    }
+
+    fn list_open_issues(&self, owner: &str, repo: &str, labels: &[String]) -> Result<Vec<Issue>> {
+        let octocrab = self.octocrab.clone();
+        let owner = owner.to_string();
+        let repo = repo.to_string();
+        let labels = labels.to_vec();
+
+        self.block_on(async move {
+            let mut all_issues = Vec::new();
+            let mut page = 1u32;
+
+            loop {
+                let issues = octocrab
+                    .issues(&owner, &repo)
+                    .list()
+                    .state(octocrab::params::State::Open)
+                    .labels(&labels)
+                    .per_page(100)
+                    .page(page)
+                    .send()
+                    .await
+                    .map_err(|e| RefactorError::GitHub {
+                        message: format!("Failed to list issues: {}", e),
+                    })?;
+
+                if issues.items.is_empty() {
+                    break;
+                }
+
+                all_issues.extend(issues.items.into_iter().map(Issue::from));
+                page += 1;
+
+                if page > 100 {
+                    break;
+                }
+            }
+
+            Ok(all_issues)
+        })
+    }
+
+    fn update_issue_body(&self, owner: &str, repo: &str, number: u64, body: &str) -> Result<()> {
+        let octocrab = self.octocrab.clone();
+        let owner = owner.to_string();
+        let repo = repo.to_string();
+        let body = body.to_string();
+
+        self.block_on(async move {
+            octocrab
+                .issues(&owner, &repo)
+                .update(number)
+                .body(&body)
+                .send()
+                .await
+                .map_err(|e| RefactorError::GitHub {
+                    message: format!("Failed to update issue #{}: {}", number, e),
+                })?;
+            Ok(())
+        })
+    }
+
+    fn close_issue(&self, owner: &str, repo: &str, number: u64, comment: &str) -> Result<()> {
+        let octocrab = self.octocrab.clone();
+        let owner = owner.to_string();
+        let repo = repo.to_string();
+        let comment = comment.to_string();
+
+        self.block_on(async move {
+            let issues = octocrab.issues(&owner, &repo);
+            issues
+                .create_comment(number, &comment)
+                .await
+                .map_err(|e| RefactorError::GitHub {
+                    message: format!("Failed to comment on issue #{}: {}", number, e),
+                })?;
+            issues
+                .update(number)
+                .state(octocrab::models::IssueState::Closed)
+                .send()
+                .await
+                .map_err(|e| RefactorError::GitHub {
+                    message: format!("Failed to close issue #{}: {}", number, e),
+                })?;
+            Ok(())
+        })
+    }
+}
@@ -3,7 +3,8 @@
 //! This module provides a client for interacting with the GitHub API to:
 //! - List repositories from organizations or users
 //! - Clone repositories
-//! - Create pull requests
+//! - Create pull requests, described from an upgrade's [`RunReport`](crate::runner::RunReport)
+//! - File, update and close issues
 //!
 //! # Example
 //!
@@ -23,10 +24,14 @@
 
 mod client;
 mod clone;
+mod description;
+mod issues;
 mod pr;
 mod repos;
 
 pub use client::GitHubClient;
 pub use clone::CloneOps;
+pub use description::UpgradeDescription;
+pub use issues::{Issue, IssueOps};
 pub use pr::{CreatePullRequest, PullRequest, PullRequestOps};
 pub use repos::{GitHubRepo, RepoOps};
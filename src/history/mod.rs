@@ -0,0 +1,299 @@
+//! Persistent run history for tracking migration progress.
+//!
+//! Each upgrade run can be summarized as a [`RunRecord`] and appended to a
+//! [`HistoryStore`], a JSON Lines file shared by every repository on the
+//! machine. Platform teams can query the store or export it as CSV/JSON to
+//! chart findings, fixes and manual TODOs over time across a fleet.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::history::HistoryStore;
+//!
+//! let store = HistoryStore::open_default()?;
+//! for record in store.latest_per_repo()? {
+//!     println!("{}: {} open, {} TODOs", record.repo, record.findings_open, record.manual_todos);
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fmt::Write as _;
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use crate::codemod::date_from_unix;
+use crate::error::{RefactorError, Result};
+use crate::runner::RunReport;
+
+/// A summary of one upgrade run against one repository.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RunRecord {
+    /// Unix timestamp (seconds) of the run.
+    pub timestamp: u64,
+    /// Repository name.
+    pub repo: String,
+    /// Repository path.
+    pub path: PathBuf,
+    /// Name of the upgrade that was run.
+    pub upgrade: String,
+    /// Number of files scanned.
+    pub files_scanned: usize,
+    /// Number of files modified.
+    pub files_modified: usize,
+    /// Number of rewrites applied.
+    pub fixed: usize,
+    /// Number of findings left for humans (suggest-only matches).
+    pub findings_open: usize,
+    /// Number of manual TODO markers remaining.
+    pub manual_todos: usize,
+    /// Whether the post-migration tests passed, if they were run.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tests_passed: Option<bool>,
+}
+
+impl RunRecord {
+    /// Summarize a run report for the repository at `path`.
+    pub fn from_report(upgrade: impl Into<String>, path: &Path, report: &RunReport) -> Self {
+        let path = path.canonicalize().unwrap_or_else(|_| path.to_path_buf());
+        let repo = path
+            .file_name()
+            .and_then(|n| n.to_str())
+            .unwrap_or("unknown")
+            .to_string();
+
+        Self {
+            timestamp: SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .unwrap_or_default()
+                .as_secs(),
+            repo,
+            path,
+            upgrade: upgrade.into(),
+            files_scanned: report.files_scanned,
+            files_modified: report.files_modified(),
+            fixed: report.edits.len(),
+            findings_open: report.diagnostics.len(),
+            manual_todos: report.manual_todos,
+            tests_passed: None,
+        }
+    }
+
+    /// Record the outcome of the post-migration test run.
+    pub fn with_tests(mut self, passed: bool) -> Self {
+        self.tests_passed = Some(passed);
+        self
+    }
+
+    /// The run date in YYYY-MM-DD format.
+    pub fn date(&self) -> String {
+        date_from_unix(self.timestamp)
+    }
+}
+
+/// Filters for querying the history store.
+#[derive(Debug, Clone, Default)]
+pub struct HistoryQuery {
+    repo: Option<String>,
+    upgrade: Option<String>,
+    since: Option<u64>,
+}
+
+impl HistoryQuery {
+    /// Creates a query matching every record.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Only match records for the named repository.
+    pub fn repo(mut self, repo: impl Into<String>) -> Self {
+        self.repo = Some(repo.into());
+        self
+    }
+
+    /// Only match records for the named upgrade.
+    pub fn upgrade(mut self, upgrade: impl Into<String>) -> Self {
+        self.upgrade = Some(upgrade.into());
+        self
+    }
+
+    /// Only match records at or after the Unix timestamp.
+    pub fn since(mut self, timestamp: u64) -> Self {
+        self.since = Some(timestamp);
+        self
+    }
+
+    fn matches(&self, record: &RunRecord) -> bool {
+        self.repo.as_ref().is_none_or(|r| *r == record.repo)
+            && self.upgrade.as_ref().is_none_or(|u| *u == record.upgrade)
+            && self.since.is_none_or(|t| record.timestamp >= t)
+    }
+}
+
+/// An append-only store of run records.
+#[derive(Debug, Clone)]
+pub struct HistoryStore {
+    path: PathBuf,
+}
+
+impl HistoryStore {
+    /// Open (or lazily create) the store at the given file path.
+    pub fn open(path: impl Into<PathBuf>) -> Self {
+        Self { path: path.into() }
+    }
+
+    /// Open the store in the user's local data directory.
+    pub fn open_default() -> Result<Self> {
+        let data_dir = dirs::data_local_dir().ok_or_else(|| {
+            RefactorError::InvalidConfig("Could not determine local data directory".into())
+        })?;
+        Ok(Self::open(data_dir.join("refactor").join("history.jsonl")))
+    }
+
+    /// The file backing this store.
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Append a record.
+    pub fn record(&self, record: &RunRecord) -> Result<()> {
+        if let Some(parent) = self.path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        let mut file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&self.path)?;
+        writeln!(file, "{}", serde_json::to_string(record)?)?;
+        Ok(())
+    }
+
+    /// All records, oldest first.
+    pub fn records(&self) -> Result<Vec<RunRecord>> {
+        if !self.path.exists() {
+            return Ok(Vec::new());
+        }
+        fs::read_to_string(&self.path)?
+            .lines()
+            .filter(|line| !line.trim().is_empty())
+            .map(|line| Ok(serde_json::from_str(line)?))
+            .collect()
+    }
+
+    /// Records matching the query, oldest first.
+    pub fn query(&self, query: &HistoryQuery) -> Result<Vec<RunRecord>> {
+        Ok(self
+            .records()?
+            .into_iter()
+            .filter(|r| query.matches(r))
+            .collect())
+    }
+
+    /// The most recent record for each repository, ordered by repository.
+    pub fn latest_per_repo(&self) -> Result<Vec<RunRecord>> {
+        let mut latest: BTreeMap<String, RunRecord> = BTreeMap::new();
+        for record in self.records()? {
+            latest.insert(record.repo.clone(), record);
+        }
+        Ok(latest.into_values().collect())
+    }
+}
+
+/// Export records as CSV with a header row.
+pub fn to_csv(records: &[RunRecord]) -> String {
+    let mut out = String::from(
+        "date,timestamp,repo,upgrade,files_scanned,files_modified,fixed,findings_open,manual_todos,tests\n",
+    );
+    for r in records {
+        writeln!(
+            out,
+            "{},{},{},{},{},{},{},{},{},{}",
+            r.date(),
+            r.timestamp,
+            csv_field(&r.repo),
+            csv_field(&r.upgrade),
+            r.files_scanned,
+            r.files_modified,
+            r.fixed,
+            r.findings_open,
+            r.manual_todos,
+            match r.tests_passed {
+                Some(true) => "pass",
+                Some(false) => "fail",
+                None => "",
+            }
+        )
+        .unwrap();
+    }
+    out
+}
+
+fn csv_field(value: &str) -> String {
+    if value.contains([',', '"', '\n']) {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn record(repo: &str, timestamp: u64, open: usize) -> RunRecord {
+        RunRecord {
+            timestamp,
+            repo: repo.to_string(),
+            path: PathBuf::from("/repos").join(repo),
+            upgrade: "lib-v2".to_string(),
+            files_scanned: 10,
+            files_modified: 2,
+            fixed: 5,
+            findings_open: open,
+            manual_todos: 1,
+            tests_passed: None,
+        }
+    }
+
+    #[test]
+    fn test_store_round_trip_and_query() {
+        let dir = TempDir::new().unwrap();
+        let store = HistoryStore::open(dir.path().join("nested/history.jsonl"));
+        assert!(store.records().unwrap().is_empty());
+
+        store.record(&record("api", 100, 4)).unwrap();
+        store.record(&record("web", 200, 3)).unwrap();
+        store.record(&record("api", 300, 1)).unwrap();
+
+        assert_eq!(store.records().unwrap().len(), 3);
+        assert_eq!(
+            store.query(&HistoryQuery::new().repo("api")).unwrap().len(),
+            2
+        );
+        assert_eq!(
+            store.query(&HistoryQuery::new().since(200)).unwrap().len(),
+            2
+        );
+
+        let latest = store.latest_per_repo().unwrap();
+        assert_eq!(latest.len(), 2);
+        assert_eq!(latest[0].repo, "api");
+        assert_eq!(latest[0].findings_open, 1);
+    }
+
+    #[test]
+    fn test_to_csv() {
+        let csv = to_csv(&[record("my,repo", 86400, 2).with_tests(true)]);
+        let lines: Vec<&str> = csv.lines().collect();
+        assert_eq!(lines.len(), 2);
+        assert!(lines[0].starts_with("date,timestamp,repo"));
+        assert_eq!(
+            lines[1],
+            "1970-01-02,86400,\"my,repo\",lib-v2,10,2,5,2,1,pass"
+        );
+    }
+}
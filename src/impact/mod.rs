@@ -0,0 +1,436 @@
+//! Call-graph impact of an upgrade.
+//!
+//! A rule touching a handful of call sites can still ripple through a
+//! client: every function calling a rewritten one has to be re-reviewed and
+//! re-tested. [`ImpactReport`] builds a call graph of the Go functions of a
+//! project and, from a dry run, lists each function that calls an affected
+//! API directly (a rule matched in its body) or indirectly (it calls such a
+//! function), with its fan-in: the number of functions calling it. Functions
+//! with the highest fan-in come first, since a change there reaches the most
+//! code; teams use the list to estimate review effort and to sequence the
+//! migration.
+//!
+//! Calls are resolved by name, without type information: `Name(...)` is a
+//! call of a function of the same package, and `x.Name(...)` of any method
+//! called `Name` or of function `Name` in a package named `x`. The graph may
+//! therefore hold a few calls that never happen, but misses none made by
+//! name.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::impact::ImpactReport;
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let config = UpgradeConfig::from_file("upgrade.yaml")?;
+//! let report = UpgradeRunner::new(config).dry_run().run("./project")?;
+//! let impact = ImpactReport::new("./project", &report)?;
+//! println!("{}", impact);
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use serde::Serialize;
+use std::collections::{BTreeSet, HashMap, VecDeque};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+use walkdir::WalkDir;
+
+use crate::error::Result;
+use crate::runner::RunReport;
+use crate::transform::imports::code_only;
+
+/// A function declaration, with its receiver type captured as `receiver`.
+static FUNC: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r"(?m)^func[ \t]*(?:\([ \t]*(?:\w+[ \t]+)?\*?[ \t]*(?P<receiver>\w+)[^)]*\)[ \t]*)?(?P<name>\w+)",
+    )
+    .expect("invalid func regex")
+});
+
+/// A call, optionally qualified by a package or value (`x.Name(`), with
+/// any type arguments.
+static CALL: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r"(?:\b(?P<qual>[A-Za-z_]\w*)\s*\.\s*)?\b(?P<name>[A-Za-z_]\w*)\s*(?:\[[^\]\n]*\]\s*)?\(",
+    )
+    .expect("invalid call regex")
+});
+
+/// A function reached by an upgrade.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct ImpactedFunction {
+    /// The function, qualified by its receiver type
+    /// (`UserService.GetUserByID`).
+    pub function: String,
+    /// File defining the function, relative to the project root.
+    pub path: PathBuf,
+    /// 1-based line of its declaration.
+    pub line: usize,
+    /// Calls between the function and an affected API: 0 if a rule matched
+    /// in its body, 1 if it calls such a function, and so on.
+    pub depth: usize,
+    /// Number of functions calling the function.
+    pub fan_in: usize,
+    /// Rules whose matches the function reaches.
+    pub rules: Vec<String>,
+}
+
+impl ImpactedFunction {
+    /// Returns true if a rule matched in the function's body.
+    pub fn is_direct(&self) -> bool {
+        self.depth == 0
+    }
+}
+
+impl fmt::Display for ImpactedFunction {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{} ({}:{}): fan-in {}, ",
+            self.function,
+            self.path.display(),
+            self.line,
+            self.fan_in
+        )?;
+        match self.depth {
+            0 => write!(f, "direct")?,
+            depth => write!(f, "{} call(s) away", depth)?,
+        }
+        write!(f, " ({})", self.rules.join(", "))
+    }
+}
+
+/// The functions an upgrade reaches, by decreasing fan-in.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct ImpactReport {
+    /// Functions reached, with the highest fan-in first.
+    pub functions: Vec<ImpactedFunction>,
+}
+
+impl ImpactReport {
+    /// Trace the sites `report` found in the Go files of the project at
+    /// `root` through the project's call graph.
+    pub fn new(root: impl AsRef<Path>, report: &RunReport) -> Result<Self> {
+        let root = root.as_ref();
+        let sites = report
+            .edits
+            .iter()
+            .map(|edit| (&edit.path, edit.line, &edit.rule))
+            .chain(
+                report
+                    .diagnostics
+                    .iter()
+                    .map(|d| (&d.path, d.line, &d.rule)),
+            )
+            .map(|(path, line, rule)| {
+                let path = path.strip_prefix(root).unwrap_or(path);
+                (path.to_path_buf(), line, rule.clone())
+            });
+        let graph = CallGraph::build(root)?;
+        Ok(graph.impact(sites))
+    }
+
+    /// Functions a rule matched in.
+    pub fn direct(&self) -> impl Iterator<Item = &ImpactedFunction> {
+        self.functions.iter().filter(|f| f.is_direct())
+    }
+}
+
+impl fmt::Display for ImpactReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for function in &self.functions {
+            writeln!(f, "{}", function)?;
+        }
+        let direct = self.direct().count();
+        write!(
+            f,
+            "{} function(s) impacted: {} directly, {} indirectly",
+            self.functions.len(),
+            direct,
+            self.functions.len() - direct
+        )
+    }
+}
+
+/// A Go function and the lines of its declaration.
+#[derive(Debug)]
+struct Function {
+    name: String,
+    receiver: Option<String>,
+    path: PathBuf,
+    start: usize,
+    end: usize,
+}
+
+impl Function {
+    fn qualified(&self) -> String {
+        match &self.receiver {
+            Some(receiver) => format!("{}.{}", receiver, self.name),
+            None => self.name.clone(),
+        }
+    }
+
+    fn dir(&self) -> &Path {
+        self.path.parent().unwrap_or(Path::new(""))
+    }
+}
+
+/// The Go functions of a project and who calls whom.
+#[derive(Debug, Default)]
+struct CallGraph {
+    functions: Vec<Function>,
+    /// Indices of the callers of each function.
+    callers: Vec<BTreeSet<usize>>,
+}
+
+impl CallGraph {
+    /// Parse the Go files under `root`, leaving out vendored code, test
+    /// data and directories the go command ignores.
+    fn build(root: &Path) -> Result<Self> {
+        let mut graph = Self::default();
+        let mut bodies = Vec::new();
+        let walker = WalkDir::new(root).into_iter().filter_entry(|entry| {
+            let name = entry.file_name().to_str().unwrap_or_default();
+            entry.depth() == 0
+                || !(name.starts_with(['.', '_']) || matches!(name, "vendor" | "testdata"))
+        });
+        for entry in walker.filter_map(|e| e.ok()) {
+            let path = entry.path();
+            if !entry.file_type().is_file() || path.extension().is_none_or(|e| e != "go") {
+                continue;
+            }
+            let code = code_only(&fs::read_to_string(path)?);
+            let rel = path.strip_prefix(root).unwrap_or(path);
+            for (function, body) in functions(&code, rel) {
+                graph.functions.push(function);
+                bodies.push(body);
+            }
+        }
+
+        let mut by_name: HashMap<&str, Vec<usize>> = HashMap::new();
+        for (index, function) in graph.functions.iter().enumerate() {
+            by_name.entry(&function.name).or_default().push(index);
+        }
+        let mut callers = vec![BTreeSet::new(); graph.functions.len()];
+        for (caller, body) in bodies.iter().enumerate() {
+            let dir = graph.functions[caller].dir();
+            for caps in CALL.captures_iter(body) {
+                let Some(candidates) = by_name.get(&caps["name"]) else {
+                    continue;
+                };
+                let qual = caps.name("qual").map(|m| m.as_str());
+                for &callee in candidates {
+                    let function = &graph.functions[callee];
+                    let called = match (qual, &function.receiver) {
+                        (None, None) => function.dir() == dir,
+                        (Some(_), Some(_)) => true,
+                        (Some(qual), None) => function.dir().file_name().is_some_and(|n| n == qual),
+                        (None, Some(_)) => false,
+                    };
+                    if called && callee != caller {
+                        callers[callee].insert(caller);
+                    }
+                }
+            }
+        }
+        graph.callers = callers;
+        Ok(graph)
+    }
+
+    /// The functions reached from the `sites` (path relative to the root,
+    /// line, rule) through their callers.
+    fn impact(&self, sites: impl IntoIterator<Item = (PathBuf, usize, String)>) -> ImpactReport {
+        let mut depths: Vec<Option<usize>> = vec![None; self.functions.len()];
+        let mut rules: Vec<BTreeSet<String>> = vec![BTreeSet::new(); self.functions.len()];
+        let mut direct: HashMap<usize, BTreeSet<String>> = HashMap::new();
+        for (path, line, rule) in sites {
+            let containing = self
+                .functions
+                .iter()
+                .position(|f| f.path == path && (f.start..=f.end).contains(&line));
+            if let Some(index) = containing {
+                direct.entry(index).or_default().insert(rule);
+            }
+        }
+
+        // Each rule reaches the callers of the functions it matched in,
+        // however far up
+        for (&start, matched) in &direct {
+            let mut queue = VecDeque::from([(start, 0)]);
+            let mut seen = BTreeSet::from([start]);
+            while let Some((index, depth)) = queue.pop_front() {
+                rules[index].extend(matched.iter().cloned());
+                if depths[index].is_none_or(|d| depth < d) {
+                    depths[index] = Some(depth);
+                }
+                for &caller in &self.callers[index] {
+                    if seen.insert(caller) {
+                        queue.push_back((caller, depth + 1));
+                    }
+                }
+            }
+        }
+
+        let mut functions: Vec<ImpactedFunction> = depths
+            .iter()
+            .enumerate()
+            .filter_map(|(index, depth)| {
+                let function = &self.functions[index];
+                Some(ImpactedFunction {
+                    function: function.qualified(),
+                    path: function.path.clone(),
+                    line: function.start,
+                    depth: (*depth)?,
+                    fan_in: self.callers[index].len(),
+                    rules: rules[index].iter().cloned().collect(),
+                })
+            })
+            .collect();
+        functions.sort_by(|a, b| {
+            b.fan_in
+                .cmp(&a.fan_in)
+                .then(a.depth.cmp(&b.depth))
+                .then_with(|| a.function.cmp(&b.function))
+                .then_with(|| a.path.cmp(&b.path))
+        });
+        ImpactReport { functions }
+    }
+}
+
+/// The functions declared in `code` (source with comments and strings
+/// blanked), each with its body.
+fn functions(code: &str, path: &Path) -> Vec<(Function, String)> {
+    let line_of = |offset: usize| code[..offset].matches('\n').count() + 1;
+    FUNC.captures_iter(code)
+        .filter_map(|caps| {
+            let declaration = caps.get(0)?;
+            let (open, close) = body(code, declaration.end())?;
+            let function = Function {
+                name: caps["name"].to_string(),
+                receiver: caps.name("receiver").map(|m| m.as_str().to_string()),
+                path: path.to_path_buf(),
+                start: line_of(declaration.start()),
+                end: line_of(close),
+            };
+            Some((function, code[open..close].to_string()))
+        })
+        .collect()
+}
+
+/// The offsets of the braces of the body of the function whose signature
+/// starts at `from`, or `None` if it has no body. Braces of `struct{...}`
+/// and `interface{...}` types in the signature are skipped.
+fn body(code: &str, from: usize) -> Option<(usize, usize)> {
+    let bytes = code.as_bytes();
+    let mut parens = 0usize;
+    let mut index = from;
+    while index < bytes.len() {
+        match bytes[index] {
+            b'(' | b'[' => parens += 1,
+            b')' | b']' => parens = parens.saturating_sub(1),
+            b'\n' if parens == 0 => return None,
+            b'{' => {
+                let close = closing_brace(bytes, index)?;
+                let before = code[..index].trim_end();
+                if parens == 0 && !before.ends_with("struct") && !before.ends_with("interface") {
+                    return Some((index, close));
+                }
+                index = close;
+            }
+            _ => {}
+        }
+        index += 1;
+    }
+    None
+}
+
+/// The offset of the brace closing the one at `open`.
+fn closing_brace(bytes: &[u8], open: usize) -> Option<usize> {
+    let mut depth = 0usize;
+    for (index, &byte) in bytes.iter().enumerate().skip(open) {
+        match byte {
+            b'{' => depth += 1,
+            b'}' => {
+                depth -= 1;
+                if depth == 0 {
+                    return Some(index);
+                }
+            }
+            _ => {}
+        }
+    }
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::runner::RuleEdit;
+    use tempfile::TempDir;
+
+    fn write(root: &Path, path: &str, content: &str) {
+        let path = root.join(path);
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, content).unwrap();
+    }
+
+    #[test]
+    fn test_impact_through_callers() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path();
+        write(
+            root,
+            "service/user.go",
+            "package service\n\ntype UserService struct{ c *mylib.Client }\n\nfunc (s *UserService) GetUserByID(id int) (*User, error) {\n\treturn s.c.GetUser(id) // GetUser is gone in v2\n}\n\nfunc (s *UserService) Name(id int) string {\n\tu, _ := s.GetUserByID(id)\n\treturn u.Name\n}\n\nfunc Unrelated(opts struct{ N int }) {\n\tfmt.Println(\"GetUserByID(\")\n}\n",
+        );
+        write(
+            root,
+            "api/handler.go",
+            "package api\n\nfunc Show(s *service.UserService) {\n\ts.GetUserByID(1)\n\tlog(s.Name(1))\n}\n\nfunc List(s *service.UserService) {\n\ts.GetUserByID(2)\n}\n",
+        );
+        write(
+            root,
+            "main.go",
+            "package main\n\nfunc main() {\n\tapi.Show(nil)\n\tservice.Unrelated(struct{ N int }{})\n}\n",
+        );
+
+        let report = RunReport {
+            edits: vec![RuleEdit {
+                rule: "rename-get-user".to_string(),
+                path: root.join("service/user.go"),
+                line: 6,
+                todo: false,
+            }],
+            ..Default::default()
+        };
+        let impact = ImpactReport::new(root, &report).unwrap();
+        let found: Vec<(&str, usize, usize)> = impact
+            .functions
+            .iter()
+            .map(|f| (f.function.as_str(), f.depth, f.fan_in))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                ("UserService.GetUserByID", 0, 3),
+                ("Show", 1, 1),
+                ("UserService.Name", 1, 1),
+                ("List", 1, 0),
+                ("main", 2, 0),
+            ]
+        );
+        assert_eq!(
+            impact.functions[0].to_string(),
+            "UserService.GetUserByID (service/user.go:5): fan-in 3, direct (rename-get-user)"
+        );
+        assert!(
+            impact
+                .to_string()
+                .ends_with("5 function(s) impacted: 1 directly, 4 indirectly")
+        );
+    }
+}
@@ -0,0 +1,304 @@
+//! A journal of applied upgrades, for undoing them without git.
+//!
+//! Reverting a migration with git only works on a clean working tree: on a
+//! dirty one, `git checkout` throws away the developer's own edits along
+//! with the migration's. Each time an upgrade writes files, the [`Journal`]
+//! in the project records a [`JournalEntry`] with the original content of
+//! every file it changed and a hash of what it wrote.
+//! [`Journal::undo`] restores those originals. A file edited since the
+//! upgrade no longer matches the hash and is reported as a conflict instead
+//! of being overwritten, unless the undo is forced.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::journal::Journal;
+//!
+//! let journal = Journal::open("./project");
+//! if let Some(entry) = journal.latest()? {
+//!     let report = journal.undo(&entry, false)?;
+//!     println!("{}", report);
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::fs;
+use std::path::PathBuf;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use crate::codemod::date_from_unix;
+use crate::diff::fnv1a;
+use crate::error::{RefactorError, Result};
+use crate::runner::RunReport;
+
+/// Default journal location, relative to the project root.
+pub const DEFAULT_JOURNAL_DIR: &str = ".refactor-dsl/journal";
+
+/// A file changed by a journaled upgrade.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct JournalFile {
+    /// Path relative to the project root.
+    pub path: PathBuf,
+    /// Content before the upgrade.
+    pub original: String,
+    /// Hash of the content the upgrade wrote.
+    pub applied: String,
+}
+
+/// The files one upgrade run changed.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct JournalEntry {
+    /// Sequence number, increasing with each entry.
+    pub id: u64,
+    /// Name of the upgrade that was applied.
+    pub upgrade: String,
+    /// Unix timestamp (seconds) of the run.
+    pub timestamp: u64,
+    /// Changed files, in report order.
+    pub files: Vec<JournalFile>,
+}
+
+impl fmt::Display for JournalEntry {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "#{} {} {}: {} file(s)",
+            self.id,
+            date_from_unix(self.timestamp),
+            self.upgrade,
+            self.files.len()
+        )
+    }
+}
+
+/// What an undo restored.
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct UndoReport {
+    /// Files restored to their content before the upgrade.
+    pub restored: Vec<PathBuf>,
+    /// Files changed or deleted since the upgrade. Unless the undo was
+    /// forced, nothing is restored when there are conflicts.
+    pub conflicts: Vec<PathBuf>,
+}
+
+impl UndoReport {
+    /// Returns true if the entry was undone.
+    pub fn undone(&self) -> bool {
+        self.conflicts.is_empty() || !self.restored.is_empty()
+    }
+}
+
+impl fmt::Display for UndoReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for path in &self.conflicts {
+            writeln!(f, "changed since the upgrade: {}", path.display())?;
+        }
+        write!(
+            f,
+            "{} file(s) restored, {} conflict(s)",
+            self.restored.len(),
+            self.conflicts.len()
+        )
+    }
+}
+
+/// The journal of a project.
+#[derive(Debug, Clone)]
+pub struct Journal {
+    root: PathBuf,
+    dir: PathBuf,
+}
+
+impl Journal {
+    /// Open the journal of the project at `root`, in [`DEFAULT_JOURNAL_DIR`].
+    pub fn open(root: impl Into<PathBuf>) -> Self {
+        let root = root.into();
+        Self {
+            dir: root.join(DEFAULT_JOURNAL_DIR),
+            root,
+        }
+    }
+
+    /// Record the changes of `report`, a run of `upgrade` against the
+    /// project that has been written. Returns `None` if nothing changed.
+    pub fn record(
+        &self,
+        upgrade: impl Into<String>,
+        report: &RunReport,
+    ) -> Result<Option<JournalEntry>> {
+        if report.changes.is_empty() {
+            return Ok(None);
+        }
+        let entry = JournalEntry {
+            id: self.entries()?.last().map_or(1, |last| last.id + 1),
+            upgrade: upgrade.into(),
+            timestamp: SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map_or(0, |d| d.as_secs()),
+            files: report
+                .changes
+                .iter()
+                .map(|change| JournalFile {
+                    path: change
+                        .path
+                        .strip_prefix(&self.root)
+                        .unwrap_or(&change.path)
+                        .to_path_buf(),
+                    original: change.original.clone(),
+                    applied: hash(&change.transformed),
+                })
+                .collect(),
+        };
+        fs::create_dir_all(&self.dir)?;
+        fs::write(self.entry_path(entry.id), serde_json::to_string(&entry)?)?;
+        Ok(Some(entry))
+    }
+
+    /// All entries, oldest first.
+    pub fn entries(&self) -> Result<Vec<JournalEntry>> {
+        let dir = match fs::read_dir(&self.dir) {
+            Ok(dir) => dir,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(e) => return Err(e.into()),
+        };
+        let mut entries = Vec::new();
+        for file in dir {
+            let path = file?.path();
+            if path.extension().is_some_and(|e| e == "json") {
+                entries.push(serde_json::from_str::<JournalEntry>(&fs::read_to_string(
+                    &path,
+                )?)?);
+            }
+        }
+        entries.sort_by_key(|entry| entry.id);
+        Ok(entries)
+    }
+
+    /// The most recent entry, if any.
+    pub fn latest(&self) -> Result<Option<JournalEntry>> {
+        Ok(self.entries()?.pop())
+    }
+
+    /// The entry with sequence number `id`.
+    pub fn get(&self, id: u64) -> Result<JournalEntry> {
+        self.entries()?
+            .into_iter()
+            .find(|entry| entry.id == id)
+            .ok_or_else(|| RefactorError::Journal {
+                message: format!("no entry #{} in {}", id, self.dir.display()),
+            })
+    }
+
+    /// Restore the files of `entry` to their content before the upgrade and
+    /// drop the entry. If a file changed since, nothing is restored and the
+    /// entry is kept, unless `force` is set.
+    pub fn undo(&self, entry: &JournalEntry, force: bool) -> Result<UndoReport> {
+        let mut report = UndoReport::default();
+        for file in &entry.files {
+            let current = fs::read_to_string(self.root.join(&file.path)).ok();
+            if current.is_none_or(|current| hash(&current) != file.applied) {
+                report.conflicts.push(file.path.clone());
+            }
+        }
+        if !report.conflicts.is_empty() && !force {
+            return Ok(report);
+        }
+
+        for file in &entry.files {
+            let path = self.root.join(&file.path);
+            if let Some(parent) = path.parent() {
+                fs::create_dir_all(parent)?;
+            }
+            fs::write(&path, &file.original)?;
+            report.restored.push(file.path.clone());
+        }
+        fs::remove_file(self.entry_path(entry.id))?;
+        Ok(report)
+    }
+
+    fn entry_path(&self, id: u64) -> PathBuf {
+        self.dir.join(format!("{:06}.json", id))
+    }
+}
+
+fn hash(content: &str) -> String {
+    format!("{:016x}", fnv1a(content.as_bytes()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::FileChange;
+    use std::path::Path;
+    use tempfile::TempDir;
+
+    fn apply(root: &Path, name: &str, from: &str, to: &str) -> RunReport {
+        let path = root.join(name);
+        fs::write(&path, to).unwrap();
+        RunReport {
+            changes: vec![FileChange {
+                path,
+                original: from.into(),
+                transformed: to.into(),
+            }],
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_record_and_undo() {
+        let dir = TempDir::new().unwrap();
+        let journal = Journal::open(dir.path());
+        assert!(journal.latest().unwrap().is_none());
+        assert!(
+            journal
+                .record("noop", &RunReport::default())
+                .unwrap()
+                .is_none()
+        );
+
+        let first = apply(dir.path(), "a.go", "Dial()\n", "Connect()\n");
+        journal.record("pool-v2", &first).unwrap();
+        let second = apply(dir.path(), "b.go", "Sleep(1)\n", "Tick(1)\n");
+        let entry = journal.record("ticker", &second).unwrap().unwrap();
+        assert_eq!(entry.id, 2);
+        assert_eq!(entry.files[0].path, PathBuf::from("b.go"));
+
+        let report = journal.undo(&entry, false).unwrap();
+        assert!(report.undone());
+        assert_eq!(
+            fs::read_to_string(dir.path().join("b.go")).unwrap(),
+            "Sleep(1)\n"
+        );
+        assert_eq!(journal.latest().unwrap().unwrap().upgrade, "pool-v2");
+        assert!(journal.get(2).is_err());
+    }
+
+    #[test]
+    fn test_conflicts_block_undo_unless_forced() {
+        let dir = TempDir::new().unwrap();
+        let journal = Journal::open(dir.path());
+        let report = apply(dir.path(), "a.go", "Dial()\n", "Connect()\n");
+        let entry = journal.record("pool-v2", &report).unwrap().unwrap();
+        fs::write(dir.path().join("a.go"), "Connect() // edited\n").unwrap();
+
+        let blocked = journal.undo(&entry, false).unwrap();
+        assert!(!blocked.undone());
+        assert_eq!(blocked.conflicts, [PathBuf::from("a.go")]);
+        assert_eq!(
+            fs::read_to_string(dir.path().join("a.go")).unwrap(),
+            "Connect() // edited\n"
+        );
+        assert!(journal.get(1).is_ok());
+
+        let forced = journal.undo(&entry, true).unwrap();
+        assert!(forced.undone());
+        assert_eq!(
+            fs::read_to_string(dir.path().join("a.go")).unwrap(),
+            "Dial()\n"
+        );
+        assert!(journal.entries().unwrap().is_empty());
+    }
+}
@@ -0,0 +1,188 @@
+//! Pluggable language frontends for the upgrade engine.
+//!
+//! The engine itself is language-neutral: rules compile to
+//! [`GuardedTransform`]s that find and rewrite sites in text. A
+//! [`LanguageAdapter`] is where a language hooks into that pipeline. For each
+//! file, [`UpgradeRunner`](crate::runner::UpgradeRunner) asks the adapter
+//! registered for the file's extension to:
+//!
+//! 1. **match**: find the sites of each rule ([`LanguageAdapter::find`]),
+//!    reported as edits;
+//! 2. **rewrite**: apply each rule in turn at the sites found for it
+//!    ([`LanguageAdapter::rewrite`]);
+//! 3. **print**: produce the final text from the original and the rewritten
+//!    content ([`LanguageAdapter::print`]), e.g. fixing imports or
+//!    formatting.
+//!
+//! **parse** ([`LanguageAdapter::parse`]) gives adapters and tools a syntax
+//! tree of the file; the engine does not require one. Every step has a
+//! default that treats the file as text, so an adapter only overrides what
+//! its language needs. Files without an adapter get the defaults.
+//!
+//! [`GoAdapter`] is the reference implementation: it matches and rewrites
+//! with the defaults and prints by fixing the file's imports with
+//! [`GoImports`].
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::lang::{Language, LanguageAdapter, Python};
+//! use refactor::error::Result;
+//!
+//! /// Python adapter that keeps a trailing newline on rewritten files.
+//! struct PythonAdapter;
+//!
+//! impl LanguageAdapter for PythonAdapter {
+//!     fn language(&self) -> &dyn Language {
+//!         &Python
+//!     }
+//!
+//!     fn print(&self, _original: &str, rewritten: &str) -> Result<String> {
+//!         let mut text = rewritten.trim_end().to_string();
+//!         text.push('\n');
+//!         Ok(text)
+//!     }
+//! }
+//!
+//! assert_eq!(PythonAdapter.print("", "x = 1\n\n").unwrap(), "x = 1\n");
+//! ```
+
+use std::path::Path;
+use std::sync::Arc;
+use tree_sitter::Tree;
+
+use super::{Go, Language};
+use crate::error::Result;
+use crate::transform::{GoImports, GuardedTransform, Site, splice};
+
+/// A language frontend: how the engine parses, matches, rewrites and prints
+/// files of one language.
+pub trait LanguageAdapter: Send + Sync {
+    /// The language handled; its extensions select the files.
+    fn language(&self) -> &dyn Language;
+
+    /// Parse source into a syntax tree.
+    fn parse(&self, source: &str) -> Result<Tree> {
+        self.language().parse(source)
+    }
+
+    /// Find the sites `transform` rewrites in `source`. Fails if a plugin
+    /// of the rule fails.
+    fn find(&self, transform: &GuardedTransform, source: &str, path: &Path) -> Result<Vec<Site>> {
+        transform.try_sites(source, path)
+    }
+
+    /// Rewrite `source` at `sites`, the sites [`find`](Self::find) found in
+    /// it for one rule.
+    fn rewrite(&self, source: &str, sites: &[Site]) -> Result<String> {
+        Ok(splice(source, sites))
+    }
+
+    /// The final text of a file whose `original` content every rule has
+    /// rewritten to `rewritten`. Only called if some rule changed the file.
+    fn print(&self, original: &str, rewritten: &str) -> Result<String> {
+        let _ = original;
+        Ok(rewritten.to_string())
+    }
+}
+
+/// Go frontend: adds and removes the imports a rewrite needs (see
+/// [`GoImports`]).
+#[derive(Debug, Clone, Default)]
+pub struct GoAdapter {
+    imports: GoImports,
+}
+
+impl GoAdapter {
+    /// Create a Go adapter fixing imports with `imports`.
+    pub fn new(imports: GoImports) -> Self {
+        Self { imports }
+    }
+}
+
+impl LanguageAdapter for GoAdapter {
+    fn language(&self) -> &dyn Language {
+        &Go
+    }
+
+    fn print(&self, original: &str, rewritten: &str) -> Result<String> {
+        Ok(self.imports.fix(original, rewritten))
+    }
+}
+
+/// Language adapters by file extension.
+#[derive(Clone, Default)]
+pub struct AdapterRegistry {
+    adapters: Vec<Arc<dyn LanguageAdapter>>,
+}
+
+impl AdapterRegistry {
+    /// Create an empty registry.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Register an adapter. Adapters registered earlier take precedence for
+    /// an extension.
+    pub fn register(mut self, adapter: Arc<dyn LanguageAdapter>) -> Self {
+        self.adapters.push(adapter);
+        self
+    }
+
+    /// The adapter for `path`, if one handles its extension.
+    pub fn get(&self, path: &Path) -> Option<&dyn LanguageAdapter> {
+        let ext = path.extension()?.to_str()?;
+        self.adapters
+            .iter()
+            .find(|adapter| adapter.language().matches_extension(ext))
+            .map(|adapter| adapter.as_ref())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::lang::Python;
+
+    struct Uppercase;
+
+    impl LanguageAdapter for Uppercase {
+        fn language(&self) -> &dyn Language {
+            &Python
+        }
+
+        fn print(&self, _original: &str, rewritten: &str) -> Result<String> {
+            Ok(rewritten.to_uppercase())
+        }
+    }
+
+    #[test]
+    fn test_registry_selects_by_extension() {
+        let registry = AdapterRegistry::new()
+            .register(Arc::new(Uppercase))
+            .register(Arc::new(GoAdapter::default()));
+        let python = registry.get(Path::new("app/main.py")).unwrap();
+        assert_eq!(python.print("", "x").unwrap(), "X");
+        assert_eq!(python.language().name(), "python");
+        assert!(registry.get(Path::new("main.go")).is_some());
+        assert!(registry.get(Path::new("main.rb")).is_none());
+        assert!(registry.get(Path::new("README")).is_none());
+    }
+
+    #[test]
+    fn test_go_adapter_fixes_imports() {
+        let adapter = GoAdapter::new(GoImports::new());
+        let transform = GuardedTransform::new(r"Sleep\(1\)", "Sleep(time.Second)").unwrap();
+        let original = "package main\n\nfunc main() {\n\tSleep(1)\n}\n";
+
+        let sites = adapter
+            .find(&transform, original, Path::new("main.go"))
+            .unwrap();
+        assert_eq!(sites.len(), 1);
+        let rewritten = adapter.rewrite(original, &sites).unwrap();
+        assert_eq!(
+            adapter.print(original, &rewritten).unwrap(),
+            "package main\n\nimport \"time\"\n\nfunc main() {\n\tSleep(time.Second)\n}\n"
+        );
+    }
+}
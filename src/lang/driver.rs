@@ -0,0 +1,218 @@
+//! Go packages from the build system of a monorepo.
+//!
+//! Monorepos built with Bazel or Please have no go.mod the go command could
+//! load packages from: which files make up a package, and which package an
+//! import path names, is known to the build system only. Go tools ask it
+//! through a packages driver, an executable named by `GOPACKAGESDRIVER`
+//! (rules_go ships one as `@io_bazel_rules_go//go/tools/gopackagesdriver`).
+//! [`GoPackagesDriver`] speaks the same protocol: the driver is run with the
+//! package patterns as arguments and a JSON request on stdin, and answers
+//! with the packages it loaded.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::lang::GoPackagesDriver;
+//!
+//! let driver = GoPackagesDriver::new("tools/gopackagesdriver.sh");
+//! for package in driver.load("./monorepo", &["./services/..."])? {
+//!     println!("{}: {} file(s)", package.pkg_path, package.go_files.len());
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+
+use crate::error::{RefactorError, Result};
+
+/// Environment variable naming the packages driver of Go tools.
+pub const GOPACKAGESDRIVER: &str = "GOPACKAGESDRIVER";
+
+/// `NeedName | NeedFiles | NeedCompiledGoFiles` of `go/packages`.
+const LOAD_MODE: u32 = 1 | 2 | 4;
+
+/// A packages driver executable.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct GoPackagesDriver {
+    program: PathBuf,
+    args: Vec<String>,
+}
+
+/// A package loaded by a packages driver.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct DriverPackage {
+    /// Identifier of the package in the build (a Bazel label).
+    #[serde(rename = "ID")]
+    pub id: String,
+    /// Package name.
+    #[serde(default)]
+    pub name: String,
+    /// Import path.
+    #[serde(default)]
+    pub pkg_path: String,
+    /// Absolute paths of the package's Go source files.
+    #[serde(default)]
+    pub go_files: Vec<PathBuf>,
+    /// Absolute paths of the files compiled, including generated ones.
+    #[serde(default)]
+    pub compiled_go_files: Vec<PathBuf>,
+}
+
+#[derive(Debug, Serialize)]
+struct DriverRequest {
+    mode: u32,
+    env: Vec<String>,
+    build_flags: Vec<String>,
+    tests: bool,
+    overlay: serde_json::Map<String, serde_json::Value>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct DriverResponse {
+    #[serde(default)]
+    not_handled: bool,
+    #[serde(default)]
+    roots: Vec<String>,
+    #[serde(default)]
+    packages: Vec<DriverPackage>,
+}
+
+impl GoPackagesDriver {
+    /// A driver run as `program`.
+    pub fn new(program: impl Into<PathBuf>) -> Self {
+        Self {
+            program: program.into(),
+            args: Vec::new(),
+        }
+    }
+
+    /// Pass `args` to the driver before the package patterns.
+    pub fn args(mut self, args: impl IntoIterator<Item = impl Into<String>>) -> Self {
+        self.args = args.into_iter().map(Into::into).collect();
+        self
+    }
+
+    /// The driver named by `GOPACKAGESDRIVER`, unless it is unset or `off`.
+    pub fn from_env() -> Option<Self> {
+        let program = std::env::var_os(GOPACKAGESDRIVER)?;
+        (!program.is_empty() && program != "off").then(|| Self::new(program))
+    }
+
+    /// The packages matching `patterns` (`./...`, `//services/...`), loaded
+    /// from `root`, test packages included. Only the packages the patterns
+    /// name are returned, not their dependencies.
+    pub fn load(&self, root: impl AsRef<Path>, patterns: &[&str]) -> Result<Vec<DriverPackage>> {
+        let request = DriverRequest {
+            mode: LOAD_MODE,
+            env: Vec::new(),
+            build_flags: Vec::new(),
+            tests: true,
+            overlay: serde_json::Map::new(),
+        };
+        let mut child = Command::new(&self.program)
+            .args(&self.args)
+            .args(patterns)
+            .current_dir(root.as_ref())
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .map_err(|e| self.error(e))?;
+        let mut stdin = child.stdin.take().expect("stdin is piped");
+        serde_json::to_writer(&mut stdin, &request)?;
+        stdin.flush().map_err(|e| self.error(e))?;
+        drop(stdin);
+        let output = child.wait_with_output().map_err(|e| self.error(e))?;
+        if !output.status.success() {
+            return Err(self.error(String::from_utf8_lossy(&output.stderr).trim()));
+        }
+
+        let response: DriverResponse = serde_json::from_slice(&output.stdout)
+            .map_err(|e| self.error(format!("invalid response: {}", e)))?;
+        if response.not_handled {
+            return Err(self.error("the driver does not handle this workspace"));
+        }
+        let roots: HashSet<&str> = response.roots.iter().map(String::as_str).collect();
+        Ok(response
+            .packages
+            .into_iter()
+            .filter(|package| roots.contains(package.id.as_str()))
+            .collect())
+    }
+
+    /// The Go source files of the packages matching `patterns`, relative to
+    /// `root` (see [`source_files`]).
+    pub fn files(&self, root: impl AsRef<Path>, patterns: &[&str]) -> Result<Vec<PathBuf>> {
+        let root = root.as_ref();
+        source_files(root, &self.load(root, patterns)?)
+    }
+
+    fn error(&self, message: impl std::fmt::Display) -> RefactorError {
+        RefactorError::InvalidConfig(format!(
+            "Packages driver {}: {}",
+            self.program.display(),
+            message
+        ))
+    }
+}
+
+/// The Go source files of `packages`, relative to `root`. Files outside
+/// `root`, such as generated files in the build output, are left out.
+pub fn source_files(root: &Path, packages: &[DriverPackage]) -> Result<Vec<PathBuf>> {
+    let base = root.canonicalize()?;
+    let mut files: Vec<PathBuf> = packages
+        .iter()
+        .flat_map(|package| &package.go_files)
+        .filter_map(|file| {
+            let file = file.canonicalize().unwrap_or_else(|_| file.clone());
+            file.strip_prefix(&base).ok().map(Path::to_path_buf)
+        })
+        .collect();
+    files.sort();
+    files.dedup();
+    Ok(files)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use tempfile::TempDir;
+
+    #[cfg(unix)]
+    #[test]
+    fn test_load_from_driver() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path().canonicalize().unwrap();
+        fs::create_dir_all(root.join("services/api")).unwrap();
+        fs::write(root.join("services/api/api.go"), "package api\n").unwrap();
+        // Answers with a root package, one of its dependencies and a
+        // generated file of the build output
+        let response = format!(
+            r#"{{"Roots":["//services/api"],"Packages":[{{"ID":"//services/api","Name":"api","PkgPath":"example.com/mono/services/api","GoFiles":["{0}/services/api/api.go","/bazel-out/api.pb.go"]}},{{"ID":"@org_golang_x_net//http2","Name":"http2","PkgPath":"golang.org/x/net/http2"}}]}}"#,
+            root.display()
+        );
+        let script = format!(
+            r#"read -r request; case "$request" in *'"tests":true'*) echo '{}' ;; esac"#,
+            response
+        );
+        let driver = GoPackagesDriver::new("sh").args(["-c", &script, "driver"]);
+
+        let packages = driver.load(&root, &["./..."]).unwrap();
+        assert_eq!(packages.len(), 1);
+        assert_eq!(packages[0].pkg_path, "example.com/mono/services/api");
+        assert_eq!(
+            driver.files(&root, &["./..."]).unwrap(),
+            [PathBuf::from("services/api/api.go")]
+        );
+
+        let unhandled = GoPackagesDriver::new("sh").args(["-c", r#"echo '{"NotHandled":true}'"#]);
+        assert!(unhandled.load(&root, &["./..."]).is_err());
+    }
+}
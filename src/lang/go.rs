@@ -1,6 +1,21 @@
 //! Go language support.
+//!
+//! Go's semantics depend on the language version a module declares with the
+//! `go` directive of its go.mod: generics need 1.18, and since 1.22 each loop
+//! iteration has its own loop variables. [`GoVersion`] reads that directive
+//! so analysis of a module follows the version it is built with rather than
+//! the newest one.
+//!
+//! Repositories from before modules have no go.mod: their packages live in
+//! the `src/` directory of a [`GoPath`] entry, named by their path below it.
+//! Modules vendoring their dependencies build from the copy in their
+//! [`GoVendor`] directory instead of the module cache.
 
 use super::Language;
+use std::collections::BTreeMap;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
 use tree_sitter::Language as TsLanguage;
 
 /// Go programming language.
@@ -19,3 +34,422 @@ impl Language for Go {
         tree_sitter_go::LANGUAGE.into()
     }
 }
+
+/// Identifiers predeclared in every Go version.
+const PREDECLARED: &[&str] = &[
+    "bool",
+    "byte",
+    "complex64",
+    "complex128",
+    "error",
+    "float32",
+    "float64",
+    "int",
+    "int8",
+    "int16",
+    "int32",
+    "int64",
+    "rune",
+    "string",
+    "uint",
+    "uint8",
+    "uint16",
+    "uint32",
+    "uint64",
+    "uintptr",
+    "true",
+    "false",
+    "iota",
+    "nil",
+    "append",
+    "cap",
+    "close",
+    "complex",
+    "copy",
+    "delete",
+    "imag",
+    "len",
+    "make",
+    "new",
+    "panic",
+    "print",
+    "println",
+    "real",
+    "recover",
+];
+
+/// A Go language version (`1.21`), as declared by the `go` directive of a
+/// go.mod. Patch releases and pre-release suffixes are ignored: they do not
+/// change the language.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub struct GoVersion {
+    pub major: u32,
+    pub minor: u32,
+}
+
+impl GoVersion {
+    /// The version the go command assumes for a go.mod without a `go`
+    /// directive.
+    pub const DEFAULT: GoVersion = GoVersion::new(1, 16);
+
+    /// The features [`GoVersion::supports`] knows by name.
+    pub const FEATURES: &[&str] = &["generics", "loopvar", "range-over-int", "range-over-func"];
+
+    /// Create a version.
+    pub const fn new(major: u32, minor: u32) -> Self {
+        Self { major, minor }
+    }
+
+    /// Parse a version such as `1.21`, `1.21.3`, `1.22rc1` or `go1.20`.
+    pub fn parse(version: &str) -> Option<Self> {
+        let version = version.trim();
+        let version = version.strip_prefix("go").unwrap_or(version);
+        let mut parts = version.split('.');
+        let major = parts.next()?.parse().ok()?;
+        let minor = parts.next().map_or("0", |minor| {
+            let end = minor
+                .find(|c: char| !c.is_ascii_digit())
+                .unwrap_or(minor.len());
+            &minor[..end]
+        });
+        Some(Self::new(major, minor.parse().ok()?))
+    }
+
+    /// The version declared by go.mod `content`, or [`GoVersion::DEFAULT`]
+    /// if it has no valid `go` directive.
+    pub fn from_go_mod(content: &str) -> Self {
+        content
+            .lines()
+            .map(|line| line.split("//").next().unwrap_or_default().trim())
+            .find_map(|line| line.strip_prefix("go ").and_then(Self::parse))
+            .unwrap_or(Self::DEFAULT)
+    }
+
+    /// The version of the module containing `path`, read from the nearest
+    /// go.mod in `path` or one of its ancestors. `None` if there is no
+    /// go.mod.
+    pub fn discover(path: &Path) -> Option<Self> {
+        path.ancestors()
+            .find_map(|dir| fs::read_to_string(dir.join("go.mod")).ok())
+            .map(|content| Self::from_go_mod(&content))
+    }
+
+    /// Type parameters, and the `any` and `comparable` identifiers (1.18).
+    pub fn has_generics(self) -> bool {
+        self >= Self::new(1, 18)
+    }
+
+    /// Each loop iteration declares fresh loop variables (1.22), so closures
+    /// capturing them no longer share one variable and copies such as
+    /// `v := v` are redundant.
+    pub fn has_per_iteration_loop_vars(self) -> bool {
+        self >= Self::new(1, 22)
+    }
+
+    /// `for i := range n` over an integer (1.22).
+    pub fn has_range_over_int(self) -> bool {
+        self >= Self::new(1, 22)
+    }
+
+    /// `for x := range f` over an iterator function (1.23).
+    pub fn has_range_over_func(self) -> bool {
+        self >= Self::new(1, 23)
+    }
+
+    /// Whether this version has `feature`, one of [`GoVersion::FEATURES`] or
+    /// a predeclared identifier such as `min`. `None` for an unknown feature.
+    pub fn supports(self, feature: &str) -> Option<bool> {
+        match feature {
+            "generics" => Some(self.has_generics()),
+            "loopvar" => Some(self.has_per_iteration_loop_vars()),
+            "range-over-int" => Some(self.has_range_over_int()),
+            "range-over-func" => Some(self.has_range_over_func()),
+            name if Self::new(u32::MAX, u32::MAX).is_predeclared(name) => {
+                Some(self.is_predeclared(name))
+            }
+            _ => None,
+        }
+    }
+
+    /// Returns true if `name` is predeclared in this version. Newer builtins
+    /// such as `min` or `any` are ordinary identifiers in older modules,
+    /// which may declare their own.
+    pub fn is_predeclared(self, name: &str) -> bool {
+        match name {
+            "any" | "comparable" => self.has_generics(),
+            "clear" | "min" | "max" => self >= Self::new(1, 21),
+            _ => PREDECLARED.contains(&name),
+        }
+    }
+}
+
+impl Default for GoVersion {
+    fn default() -> Self {
+        Self::DEFAULT
+    }
+}
+
+impl fmt::Display for GoVersion {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}.{}", self.major, self.minor)
+    }
+}
+
+/// The source roots of a pre-modules (GOPATH mode) code base.
+///
+/// Each entry is a directory whose `src/` subdirectory holds packages by
+/// import path: `$ENTRY/src/acme/billing/store` is the package
+/// `acme/billing/store`. Import paths of such code bases often have no
+/// domain, so they cannot be told apart from the standard library by their
+/// first element alone.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct GoPath {
+    entries: Vec<PathBuf>,
+}
+
+impl GoPath {
+    /// Create a GOPATH from its entries.
+    pub fn new(entries: impl IntoIterator<Item = impl Into<PathBuf>>) -> Self {
+        Self {
+            entries: entries.into_iter().map(Into::into).collect(),
+        }
+    }
+
+    /// The GOPATH of the environment, if `GOPATH` is set.
+    pub fn from_env() -> Option<Self> {
+        let value = std::env::var_os("GOPATH")?;
+        let gopath = Self::new(std::env::split_paths(&value));
+        (!gopath.entries.is_empty()).then_some(gopath)
+    }
+
+    /// The entries, in lookup order.
+    pub fn entries(&self) -> &[PathBuf] {
+        &self.entries
+    }
+
+    /// The import path of the package in `dir`, if `dir` is inside the
+    /// `src/` directory of an entry.
+    pub fn import_path(&self, dir: &Path) -> Option<String> {
+        self.entries.iter().find_map(|entry| {
+            let rel = dir.strip_prefix(entry.join("src")).ok()?;
+            let segments: Vec<_> = rel.iter().map(|s| s.to_string_lossy()).collect();
+            (!segments.is_empty()).then(|| segments.join("/"))
+        })
+    }
+
+    /// The directory of the package `import_path`, from the first entry
+    /// that has it.
+    pub fn package_dir(&self, import_path: &str) -> Option<PathBuf> {
+        self.entries
+            .iter()
+            .map(|entry| entry.join("src").join(import_path))
+            .find(|dir| dir.is_dir())
+    }
+
+    /// The environment the go command needs to build in GOPATH mode.
+    pub fn env(&self) -> Vec<(String, String)> {
+        let joined = std::env::join_paths(&self.entries)
+            .map(|p| p.to_string_lossy().into_owned())
+            .unwrap_or_default();
+        vec![
+            ("GOPATH".to_string(), joined),
+            ("GO111MODULE".to_string(), "off".to_string()),
+        ]
+    }
+}
+
+/// The vendor directory of a module vendoring its dependencies.
+///
+/// `go mod vendor` copies the packages a module imports to `vendor/`, named
+/// by import path, and lists the module versions they come from in
+/// `vendor/modules.txt`. The go command then builds from that copy
+/// (`-mod=vendor`, the default since Go 1.14 when the file exists), so the
+/// vendored version of a dependency is the one the code compiles against.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct GoVendor {
+    dir: PathBuf,
+    modules: BTreeMap<String, String>,
+}
+
+impl GoVendor {
+    /// The vendor directory `dir`, with the module versions listed by
+    /// `modules_txt` (the content of its modules.txt).
+    pub fn new(dir: impl Into<PathBuf>, modules_txt: &str) -> Self {
+        let modules = modules_txt
+            .lines()
+            .filter_map(|line| line.strip_prefix("# "))
+            .filter_map(|line| {
+                let mut fields = line.split_whitespace();
+                let module = fields.next()?;
+                let version = fields.next().filter(|v| *v != "=>")?;
+                Some((module.to_string(), version.to_string()))
+            })
+            .collect();
+        Self {
+            dir: dir.into(),
+            modules,
+        }
+    }
+
+    /// The vendor directory of the module containing `path`, found next to
+    /// the nearest go.mod in `path` or one of its ancestors. `None` if that
+    /// module does not vendor its dependencies.
+    pub fn discover(path: &Path) -> Option<Self> {
+        let root = path.ancestors().find(|dir| dir.join("go.mod").is_file())?;
+        let dir = root.join("vendor");
+        let modules_txt = fs::read_to_string(dir.join("modules.txt")).ok()?;
+        Some(Self::new(dir, &modules_txt))
+    }
+
+    /// Returns true if `path` is inside the vendor directory of a module.
+    pub fn is_vendored(path: &Path) -> bool {
+        path.ancestors()
+            .skip(1)
+            .any(|dir| dir.ends_with("vendor") && dir.join("modules.txt").is_file())
+    }
+
+    /// The vendor directory.
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    /// The vendored version of `module`.
+    pub fn version(&self, module: &str) -> Option<&str> {
+        self.modules.get(module).map(String::as_str)
+    }
+
+    /// The vendored modules with their versions, by module path.
+    pub fn modules(&self) -> impl Iterator<Item = (&str, &str)> {
+        self.modules
+            .iter()
+            .map(|(module, version)| (module.as_str(), version.as_str()))
+    }
+
+    /// The directory of the vendored package `import_path`.
+    pub fn package_dir(&self, import_path: &str) -> Option<PathBuf> {
+        Some(self.dir.join(import_path)).filter(|dir| dir.is_dir())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_parse() {
+        assert_eq!(GoVersion::parse("1.21"), Some(GoVersion::new(1, 21)));
+        assert_eq!(GoVersion::parse("1.21.3"), Some(GoVersion::new(1, 21)));
+        assert_eq!(GoVersion::parse("1.22rc1"), Some(GoVersion::new(1, 22)));
+        assert_eq!(GoVersion::parse("go1.20"), Some(GoVersion::new(1, 20)));
+        assert_eq!(GoVersion::parse("1"), Some(GoVersion::new(1, 0)));
+        assert_eq!(GoVersion::parse("latest"), None);
+        assert_eq!(GoVersion::new(1, 9).to_string(), "1.9");
+        assert!(GoVersion::new(1, 9) < GoVersion::new(1, 10));
+    }
+
+    #[test]
+    fn test_from_go_mod() {
+        let go_mod = "module example.com/app\n\ngo 1.21.0 // pinned\n\ntoolchain go1.23.1\n";
+        assert_eq!(GoVersion::from_go_mod(go_mod), GoVersion::new(1, 21));
+        assert_eq!(
+            GoVersion::from_go_mod("module example.com/app\n"),
+            GoVersion::DEFAULT
+        );
+    }
+
+    #[test]
+    fn test_discover_nearest_go_mod() {
+        let dir = TempDir::new().unwrap();
+        fs::write(dir.path().join("go.mod"), "module a\n\ngo 1.22\n").unwrap();
+        fs::create_dir_all(dir.path().join("tools/gen")).unwrap();
+        fs::write(
+            dir.path().join("tools/go.mod"),
+            "module a/tools\n\ngo 1.17\n",
+        )
+        .unwrap();
+
+        assert_eq!(
+            GoVersion::discover(&dir.path().join("main.go")),
+            Some(GoVersion::new(1, 22))
+        );
+        assert_eq!(
+            GoVersion::discover(&dir.path().join("tools/gen/main.go")),
+            Some(GoVersion::new(1, 17))
+        );
+    }
+
+    #[test]
+    fn test_gopath() {
+        let dir = TempDir::new().unwrap();
+        let vendor = dir.path().join("_vendor");
+        fs::create_dir_all(dir.path().join("src/acme/billing/store")).unwrap();
+        fs::create_dir_all(vendor.join("src/acme/billing/store")).unwrap();
+        fs::create_dir_all(vendor.join("src/metrics")).unwrap();
+        let gopath = GoPath::new([dir.path().to_path_buf(), vendor.clone()]);
+
+        assert_eq!(
+            gopath.import_path(&dir.path().join("src/acme/billing/store")),
+            Some("acme/billing/store".to_string())
+        );
+        assert_eq!(gopath.import_path(&dir.path().join("src")), None);
+        assert_eq!(gopath.import_path(Path::new("/elsewhere/x")), None);
+        assert_eq!(
+            gopath.package_dir("acme/billing/store"),
+            Some(dir.path().join("src/acme/billing/store"))
+        );
+        assert_eq!(
+            gopath.package_dir("metrics"),
+            Some(vendor.join("src/metrics"))
+        );
+        assert_eq!(gopath.package_dir("fmt"), None);
+        assert!(
+            gopath
+                .env()
+                .contains(&("GO111MODULE".to_string(), "off".to_string()))
+        );
+    }
+
+    #[test]
+    fn test_vendor() {
+        let dir = TempDir::new().unwrap();
+        fs::write(dir.path().join("go.mod"), "module example.com/app\n").unwrap();
+        fs::create_dir_all(dir.path().join("vendor/example.com/mylib/store")).unwrap();
+        fs::write(
+            dir.path().join("vendor/modules.txt"),
+            "# example.com/mylib v1.4.0\n## explicit; go 1.21\nexample.com/mylib\nexample.com/mylib/store\n# example.com/fork v1.0.0 => ../fork\n## explicit\n# example.com/local => ../local\n",
+        )
+        .unwrap();
+
+        let vendor = GoVendor::discover(&dir.path().join("cmd/main.go")).unwrap();
+        assert_eq!(vendor.dir(), dir.path().join("vendor"));
+        assert_eq!(vendor.version("example.com/mylib"), Some("v1.4.0"));
+        assert_eq!(vendor.version("example.com/fork"), Some("v1.0.0"));
+        assert_eq!(vendor.version("example.com/local"), None);
+        assert_eq!(
+            vendor.package_dir("example.com/mylib/store"),
+            Some(dir.path().join("vendor/example.com/mylib/store"))
+        );
+        assert_eq!(vendor.package_dir("example.com/other"), None);
+        assert!(GoVendor::is_vendored(
+            &dir.path().join("vendor/example.com/mylib/store/store.go")
+        ));
+        assert!(!GoVendor::is_vendored(&dir.path().join("main.go")));
+    }
+
+    #[test]
+    fn test_features() {
+        let go117 = GoVersion::new(1, 17);
+        let go122 = GoVersion::new(1, 22);
+        assert!(!go117.has_generics() && go122.has_generics());
+        assert!(!GoVersion::new(1, 21).has_per_iteration_loop_vars());
+        assert!(go122.has_per_iteration_loop_vars() && go122.has_range_over_int());
+        assert!(!go122.has_range_over_func());
+        assert!(!go117.is_predeclared("any") && go122.is_predeclared("any"));
+        assert!(!GoVersion::new(1, 20).is_predeclared("min"));
+        assert!(go117.is_predeclared("len") && !go122.is_predeclared("Dial"));
+        assert_eq!(go122.supports("loopvar"), Some(true));
+        assert_eq!(GoVersion::new(1, 20).supports("min"), Some(false));
+        assert_eq!(go122.supports("generic"), None);
+    }
+}
@@ -1,6 +1,11 @@
 //! Language abstraction for multi-language parsing and refactoring.
+//!
+//! [`Language`] describes a grammar; a [`LanguageAdapter`] plugs a language
+//! into the upgrade engine (see [`adapter`]).
 
+pub mod adapter;
 mod csharp;
+mod driver;
 mod go;
 mod java;
 mod python;
@@ -8,8 +13,10 @@ mod ruby;
 mod rust;
 mod typescript;
 
+pub use adapter::{AdapterRegistry, GoAdapter, LanguageAdapter};
 pub use csharp::CSharp;
-pub use go::Go;
+pub use driver::{DriverPackage, GOPACKAGESDRIVER, GoPackagesDriver, source_files};
+pub use go::{Go, GoPath, GoVendor, GoVersion};
 pub use java::Java;
 pub use python::Python;
 pub use ruby::Ruby;
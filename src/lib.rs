@@ -87,42 +87,88 @@
 //! # Ok::<(), refactor::error::RefactorError>(())
 //! ```
 
+pub mod advisor;
 pub mod analyzer;
+pub mod attribution;
+pub mod check;
 pub mod codemod;
+pub mod conventions;
+pub mod daemon;
 pub mod diff;
 pub mod error;
+pub mod estimate;
+pub mod fallback;
 pub mod git;
 pub mod github;
+pub mod history;
+pub mod impact;
+pub mod journal;
 pub mod lang;
+pub mod lint;
+pub mod llm;
 pub mod lsp;
 pub mod matcher;
+pub mod minimize;
+pub mod pack;
+pub mod plugin;
+pub mod preview;
+pub mod project;
+pub mod quickfix;
+pub mod recipe;
 pub mod refactor;
+pub mod replay;
+pub mod report;
+pub mod rollout;
+pub mod runner;
 pub mod scope;
+pub mod security;
+pub mod semantics;
+pub mod tracker;
 pub mod transform;
+pub mod verify;
+pub mod vet;
+pub mod watch;
 
 /// Prelude for convenient imports.
 pub mod prelude {
     pub use crate::analyzer::{
         AnalysisResult, ApiChange, ApiExtractor, ChangeDetector, ChangeKind, ConfigBasedUpgrade,
-        FileContent, GeneratedUpgrade, LibraryAnalyzer, Transform as AnalyzerTransform,
-        TransformSpec, UpgradeConfig, UpgradeGenerator,
+        FileContent, GeneratedUpgrade, LibraryAnalyzer, RuleCondition, RuleMode, RuleSeverity,
+        Transform as AnalyzerTransform, TransformRule, TransformSpec, UpgradeConfig,
+        UpgradeGenerator,
     };
+    pub use crate::attribution::{ApplyPlan, AttributionReport, Origin};
+    pub use crate::check::{CheckFinding, CheckReport};
     pub use crate::codemod::{
         AdvancedRepoFilter, AngularV4V5Upgrade, Codemod, CodemodResult, ComparisonOp,
-        DependencyFilter, DependencyInfo, FilterPresets, Framework, FrameworkCategory,
-        FrameworkFilter, FrameworkInfo, LanguageFilter, LanguageInfo, MatchMode, MetricCondition,
-        MetricFilter, PackageManager, ProgrammingLanguage, RepoFilter, RepositoryInfo,
-        RepositoryMetrics, RxJS5To6Upgrade, Upgrade, VersionConstraint, angular_v4v5_upgrade,
-        rxjs_5_to_6_upgrade,
+        DependencyFilter, DependencyInfo, FilterPresets, Fleet, FleetReport, Framework,
+        FrameworkCategory, FrameworkFilter, FrameworkInfo, LanguageFilter, LanguageInfo, MatchMode,
+        MetricCondition, MetricFilter, PackageManager, ProgrammingLanguage, RepoFilter,
+        RepositoryInfo, RepositoryMetrics, RxJS5To6Upgrade, Upgrade, VersionConstraint,
+        angular_v4v5_upgrade, rxjs_5_to_6_upgrade,
+    };
+    pub use crate::conventions::{
+        Convention, ConventionCategory, ConventionPack, ConventionReport, Violation,
     };
     pub use crate::error::{RefactorError, Result};
-    pub use crate::git::{BranchOps, CommitOps, GitAuth, GitOps, PushOps};
-    pub use crate::github::{GitHubClient, GitHubRepo, RepoOps};
+    pub use crate::estimate::{EffortEstimate, EffortWeights};
+    pub use crate::git::{BranchOps, CommitOps, DiffOps, GitAuth, GitOps, PushOps};
+    pub use crate::github::{
+        CloneOps, CreatePullRequest, GitHubClient, GitHubRepo, IssueOps, PullRequestOps, RepoOps,
+        UpgradeDescription,
+    };
+    pub use crate::history::{HistoryQuery, HistoryStore, RunRecord};
+    pub use crate::impact::{ImpactReport, ImpactedFunction};
+    pub use crate::journal::{Journal, JournalEntry};
     pub use crate::lang::{
-        CSharp, Go, Java, Language, LanguageRegistry, Python, Ruby, Rust, TypeScript,
+        CSharp, Go, GoPackagesDriver, GoPath, GoVendor, Java, Language, LanguageRegistry, Python,
+        Ruby, Rust, TypeScript,
     };
+    pub use crate::lint::{LintFinding, LintLevel};
     pub use crate::lsp::{LspClient, LspInstaller, LspRegistry, LspRename, LspServerConfig};
     pub use crate::matcher::{AstMatcher, FileMatcher, GitMatcher, Matcher};
+    pub use crate::project::{OutputFormat, ProjectConfig};
+    pub use crate::quickfix::QuickFixer;
     pub use crate::refactor::operations::{
         ChangeSignature, DeadCodeItem, DeadCodeReport, DeadCodeSummary, DeadCodeType, DeleteKind,
         ExtractConstant, ExtractFunction, ExtractVariable, FindDeadCode, InlineFunction,
@@ -132,13 +178,18 @@ pub mod prelude {
         TextEdit, UsageLocation, ValidationResult, Visibility,
     };
     pub use crate::refactor::{MultiRepoRefactor, Refactor, RefactorResult};
+    pub use crate::runner::{CanaryOutcome, Diagnostic, RuleEdit, RunReport, UpgradeRunner};
     pub use crate::scope::{
         Binding, BindingKind, DeadCodeInfo, Reference, ReferenceKind, SafeDeleteResult,
         ScopeAnalyzer, UsageAnalyzer, UsageInfo,
     };
+    pub use crate::semantics::{SemanticsChange, SemanticsVersion};
+    pub use crate::tracker::{GitHubTracker, IssueSync, IssueTracker, JiraTracker, SyncReport};
     pub use crate::transform::{
-        AstTransform, FileTransform, TextTransform, Transform, TransformBuilder,
+        AstTransform, FileTransform, Guard, GuardedTransform, TextTransform, Transform,
+        TransformBuilder,
     };
+    pub use crate::verify::{BuildCheck, BuildError, TestReport, TestSuite, VerifyReport};
 }
 
 pub use prelude::*;
@@ -0,0 +1,676 @@
+//! Linting of rule files.
+//!
+//! A mistake in a rule file rarely fails a run: a misspelled field is
+//! ignored, a rule another one shadows never matches, and a replacement
+//! naming a capture the pattern does not define silently inserts nothing.
+//! [`lint`] checks a rule file before it is used, reporting each problem
+//! with its line and column:
+//!
+//! - the file must parse and match the schema of an
+//!   [`UpgradeConfig`](crate::analyzer::UpgradeConfig);
+//! - fields the schema does not know are errors, since they are ignored;
+//! - rule ids must be unique, since `--only` and `--skip` select by id;
+//! - patterns must compile, and structural patterns must parse in the
+//!   languages of the upgrade's extensions;
+//! - replacements and conditions may only use captures the pattern
+//!   defines;
+//! - rules that can never match are warnings: those matching the same code
+//!   as an earlier unconditional rule, which rewrites it first, and those
+//!   whose paths select no file of the upgrade's extensions.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::lint::{self, LintLevel};
+//!
+//! let source = r#"{
+//!   "name": "v2",
+//!   "description": "",
+//!   "transforms": [
+//!     {"type": "replace_pattern", "pattern": "Get\\((\\w+)\\)", "replacement": "Fetch($2)"}
+//!   ]
+//! }"#;
+//! let findings = lint::lint("v2.json".as_ref(), source);
+//! assert_eq!(findings[0].level, LintLevel::Error);
+//! assert_eq!((findings[0].line, findings[0].column), (5, 63));
+//! assert_eq!(
+//!     findings[0].message,
+//!     "replacement uses capture '2', which the pattern does not define"
+//! );
+//! ```
+
+use regex::Regex;
+use serde::Serialize;
+use serde_json::Value;
+use std::collections::HashSet;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use crate::analyzer::{RuleCondition, TransformSpec, UpgradeConfig};
+use crate::error::Result;
+use crate::lang::LanguageRegistry;
+use crate::plugin::PluginRegistry;
+use crate::transform::position::{self, Step};
+use crate::transform::structural;
+
+/// A capture reference in a regex replacement: `$1`, `${1}`, `$name` or
+/// `${name}`; `$$` is a literal `$`.
+static CAPTURE_REF: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"\$(?:\$|\{(?P<braced>[^}]*)\}|(?P<bare>[0-9A-Za-z_]+))")
+        .expect("invalid capture reference regex")
+});
+
+/// The position a parser reports at the end of its messages.
+static AT_POSITION: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r" at line \d+ column \d+$").expect("invalid position regex"));
+
+/// The extension a path glob ends with (`**/*.py`).
+static GLOB_EXTENSION: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"\.(\w+)$").expect("invalid glob extension regex"));
+
+/// A metavariable of a structural template.
+static METAVARIABLE: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"\$([A-Za-z_]\w*)").expect("invalid metavariable regex"));
+
+/// Fields of an upgrade configuration.
+const CONFIG_FIELDS: &[&str] = &[
+    "name",
+    "description",
+    "extensions",
+    "exclude_patterns",
+    "transforms",
+    "changes",
+    "values",
+    "plugins",
+    "module",
+    "from_version",
+    "to_version",
+    "requires",
+    "engine",
+];
+
+/// Fields every rule may have, whatever its type.
+const RULE_FIELDS: &[&str] = &[
+    "type", "id", "message", "mode", "severity", "when", "unless", "imports", "matcher",
+    "rewriter", "files",
+];
+
+/// Fields of a `when` or `unless` condition.
+const CONDITION_FIELDS: &[&str] = &[
+    "paths",
+    "file_contains",
+    "matched",
+    "captures",
+    "literal",
+    "go_version",
+    "go_feature",
+];
+
+/// Fields of a plugin declaration.
+const PLUGIN_FIELDS: &[&str] = &["command"];
+
+/// The fields of a rule of type `kind`, besides [`RULE_FIELDS`], or `None`
+/// for an unknown type.
+fn spec_fields(kind: &str) -> Option<&'static [&'static str]> {
+    Some(match kind {
+        "replace_literal" => &["from", "to"],
+        "replace_pattern" | "replace_structural" => &["pattern", "replacement"],
+        "rename_function" | "rename_type" | "rename_class" => &["old_name", "new_name"],
+        "rename_import" | "rename_module" | "rename_specifier" | "rename_path" => {
+            &["old_path", "new_path"]
+        }
+        "rewrite_call" => &[
+            "function",
+            "new_name",
+            "arity",
+            "remove",
+            "order",
+            "keywords",
+            "add",
+            "signature",
+        ],
+        "map_values" => &["function", "argument", "compared", "values"],
+        "rewrite_string" => &["from", "to", "prefix", "function", "argument"],
+        "rewrite_tag" => &["type_name", "field", "rename", "add", "remove"],
+        "rename_key" => &["key", "new_name"],
+        "inject_context" => &["function", "package", "parameter", "fallback", "signature"],
+        "remove_call" => &["function", "strategy", "replacement"],
+        "rewrite_literal" => &["type_name", "fields", "rename", "add"],
+        "rename_export" => &["module", "old_name", "new_name"],
+        "move_export" => &["name", "from_module", "to_module"],
+        "rename_symbol" => &["package", "old_name", "new_name"],
+        "rename_go_type" => &["package", "old_name", "new_name", "transitive"],
+        "rename_method" => &["class", "old_name", "new_name"],
+        "rename_variant" => &["enum_name", "old_name", "new_name"],
+        _ => return None,
+    })
+}
+
+/// The fields of the items of a rule's `add` list.
+fn added_fields(kind: &str) -> &'static [&'static str] {
+    match kind {
+        "rewrite_call" => &["position", "keyword", "value"],
+        _ => &["name", "value"],
+    }
+}
+
+/// How serious a finding is.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum LintLevel {
+    /// The file cannot be used, or does something other than it says.
+    Error,
+    /// A rule is likely wrong, but the file can be used.
+    Warning,
+}
+
+impl fmt::Display for LintLevel {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            LintLevel::Error => write!(f, "error"),
+            LintLevel::Warning => write!(f, "warning"),
+        }
+    }
+}
+
+/// A problem found in a rule file.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct LintFinding {
+    /// The rule file.
+    pub path: PathBuf,
+    /// 1-based line of the problem.
+    pub line: usize,
+    /// 1-based column of the problem.
+    pub column: usize,
+    /// How serious the problem is.
+    pub level: LintLevel,
+    /// Name of the rule with the problem, if it is in a rule.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub rule: Option<String>,
+    /// What is wrong.
+    pub message: String,
+}
+
+impl fmt::Display for LintFinding {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}:{}:{}: {}: ",
+            self.path.display(),
+            self.line,
+            self.column,
+            self.level
+        )?;
+        if let Some(rule) = &self.rule {
+            write!(f, "rule {}: ", rule)?;
+        }
+        write!(f, "{}", self.message)
+    }
+}
+
+/// Lint the rule file at `path`.
+pub fn lint_file(path: impl AsRef<Path>) -> Result<Vec<LintFinding>> {
+    let path = path.as_ref();
+    Ok(lint(path, &fs::read_to_string(path)?))
+}
+
+/// Lint `source`, the content of the rule file at `path` (YAML, or JSON).
+/// Findings are in the order of the file.
+pub fn lint(path: &Path, source: &str) -> Vec<LintFinding> {
+    let mut lint = Lint {
+        path,
+        source,
+        findings: Vec::new(),
+    };
+    lint.run();
+    lint.findings
+        .sort_by_key(|finding| (finding.line, finding.column));
+    lint.findings
+}
+
+/// The findings of one file as they are collected.
+struct Lint<'a> {
+    path: &'a Path,
+    source: &'a str,
+    findings: Vec<LintFinding>,
+}
+
+impl Lint<'_> {
+    fn run(&mut self) {
+        let json = self.source.trim_start().starts_with('{');
+        let value = if json {
+            serde_json::from_str::<Value>(self.source).map_err(|e| parse_error(&e, json))
+        } else {
+            serde_yaml::from_str::<Value>(self.source).map_err(|e| parse_error(&e, json))
+        };
+        let value = match value {
+            Ok(value) => value,
+            Err((line, column, message)) => {
+                self.at(line, column, LintLevel::Error, None, message);
+                return;
+            }
+        };
+        let config = if json {
+            serde_json::from_str::<UpgradeConfig>(self.source).map_err(|e| parse_error(&e, json))
+        } else {
+            serde_yaml::from_str::<UpgradeConfig>(self.source).map_err(|e| parse_error(&e, json))
+        };
+        let names: Vec<String> = match &config {
+            Ok(config) => config.transforms.iter().map(|rule| rule.name()).collect(),
+            Err(_) => Vec::new(),
+        };
+        self.unknown_fields(&value, &names);
+        match config {
+            Ok(config) => self.rules(&config),
+            Err((line, column, message)) => self.at(line, column, LintLevel::Error, None, message),
+        }
+    }
+
+    /// Report unknown fields in `config`, whose rules are called `names`
+    /// if it matches the schema.
+    fn unknown_fields(&mut self, config: &Value, names: &[String]) {
+        self.check_fields(config, &[], CONFIG_FIELDS, None);
+        if let Some(Value::Object(plugins)) = config.get("plugins") {
+            for (name, plugin) in plugins {
+                let path = [Step::Key("plugins"), Step::Key(name)];
+                self.check_fields(plugin, &path, PLUGIN_FIELDS, None);
+            }
+        }
+        let Some(Value::Array(rules)) = config.get("transforms") else {
+            return;
+        };
+        for (index, rule) in rules.iter().enumerate() {
+            let path = [Step::Key("transforms"), Step::Index(index)];
+            let kind = rule.get("type").and_then(Value::as_str).unwrap_or("");
+            let Some(fields) = spec_fields(kind) else {
+                continue;
+            };
+            let name = names.get(index).cloned().unwrap_or_else(|| {
+                rule.get("id")
+                    .and_then(Value::as_str)
+                    .map_or_else(|| format!("#{}", index + 1), str::to_string)
+            });
+            let known: Vec<&str> = RULE_FIELDS.iter().chain(fields).copied().collect();
+            self.check_fields(rule, &path, &known, Some(&name));
+
+            for condition in ["when", "unless"] {
+                if let Some(value) = rule.get(condition) {
+                    let path = [path[0], path[1], Step::Key(condition)];
+                    self.check_fields(value, &path, CONDITION_FIELDS, Some(&name));
+                }
+            }
+            if let Some(Value::Array(added)) = rule.get("add") {
+                for (item, value) in added.iter().enumerate() {
+                    let path = [path[0], path[1], Step::Key("add"), Step::Index(item)];
+                    self.check_fields(value, &path, added_fields(kind), Some(&name));
+                }
+            }
+        }
+    }
+
+    /// Report the keys of `value`, at `path`, that are not in `known`.
+    fn check_fields(
+        &mut self,
+        value: &Value,
+        path: &[Step<'_>],
+        known: &[&str],
+        rule: Option<&str>,
+    ) {
+        let Value::Object(fields) = value else {
+            return;
+        };
+        for field in fields
+            .keys()
+            .filter(|field| !known.contains(&field.as_str()))
+        {
+            let mut path = path.to_vec();
+            path.push(Step::Key(field));
+            self.error(
+                &path,
+                rule,
+                format!(
+                    "unknown field '{}' is ignored; expected one of: {}",
+                    field,
+                    known.join(", ")
+                ),
+            );
+        }
+    }
+
+    fn rules(&mut self, config: &UpgradeConfig) {
+        // Compiling a rule does not start its plugins
+        let plugins = PluginRegistry::from_specs(&config.plugins);
+        let languages = LanguageRegistry::new();
+        let mut unconditional: Vec<(usize, String)> = Vec::new();
+
+        for (index, rule) in config.transforms.iter().enumerate() {
+            let at = |field: &'static str| {
+                [
+                    Step::Key("transforms"),
+                    Step::Index(index),
+                    Step::Key(field),
+                ]
+            };
+            let start = [Step::Key("transforms"), Step::Index(index)];
+            let name = rule.name();
+            let name = Some(name.as_str());
+
+            let id = rule.rule_id();
+            if let Some(first) = config.transforms[..index]
+                .iter()
+                .position(|other| other.rule_id() == id)
+            {
+                self.error(
+                    &at("id"),
+                    name,
+                    format!(
+                        "id '{}' is also the id of rule {}; give each rule its own id",
+                        id,
+                        first + 1
+                    ),
+                );
+            }
+
+            let mut resolved = UpgradeConfig::new(&config.name, "");
+            resolved.values = config.values.clone();
+            resolved.transforms.push(rule.clone());
+            if let Err(e) = resolved.resolve_values() {
+                self.error(&start, name, e.to_string());
+                continue;
+            }
+            let rule = &resolved.transforms[0];
+
+            let (pattern, replacement) = rule.spec.to_pattern_replacement();
+            let regex = match Regex::new(&pattern) {
+                Ok(regex) => regex,
+                Err(e) => {
+                    // The last line of a syntax error says what is wrong
+                    let error = e.to_string();
+                    let reason = error.lines().last().unwrap_or_default();
+                    self.error(
+                        &at("pattern"),
+                        name,
+                        format!(
+                            "pattern does not compile: {}",
+                            reason.trim_start_matches("error: ")
+                        ),
+                    );
+                    continue;
+                }
+            };
+            if let Err(e) = rule.to_transform_with(&plugins) {
+                self.error(&start, name, e.to_string());
+                continue;
+            }
+
+            if let TransformSpec::ReplaceStructural {
+                pattern,
+                replacement,
+            } = &rule.spec
+            {
+                for (field, template) in [("pattern", pattern), ("replacement", replacement)] {
+                    if let Some(message) = unparsable(template, &config.extensions, &languages) {
+                        self.error(&at(field), name, format!("{} {}", field, message));
+                    }
+                }
+            }
+            if matches!(
+                rule.spec,
+                TransformSpec::ReplacePattern { .. } | TransformSpec::ReplaceStructural { .. }
+            ) {
+                for capture in undefined(&regex, captures(&replacement)) {
+                    self.error(
+                        &at("replacement"),
+                        name,
+                        format!(
+                            "replacement uses capture '{}', which the pattern does not define",
+                            capture
+                        ),
+                    );
+                }
+            }
+            for (field, condition) in [("when", &rule.when), ("unless", &rule.unless)] {
+                let Some(condition) = condition else {
+                    continue;
+                };
+                let used = condition
+                    .captures
+                    .keys()
+                    .chain(&condition.literal)
+                    .map(String::as_str);
+                for capture in undefined(&regex, used) {
+                    self.error(
+                        &at(field),
+                        name,
+                        format!(
+                            "{} uses capture '{}', which the pattern does not define",
+                            field, capture
+                        ),
+                    );
+                }
+            }
+
+            if rule.is_suggest_only() {
+                continue;
+            }
+            if let Some((earlier, _)) = unconditional.iter().find(|(_, p)| *p == pattern) {
+                self.warning(
+                    &start,
+                    name,
+                    format!(
+                        "never matches: rule {} matches the same code and rewrites it first",
+                        config.transforms[*earlier].name()
+                    ),
+                );
+            } else if let Some(message) = unselected(rule.when.as_ref(), &config.extensions)
+                && rule.files.is_empty()
+            {
+                self.warning(&at("when"), name, message);
+            }
+            if !rule.is_guarded() && rule.matcher.is_none() {
+                unconditional.push((index, pattern));
+            }
+        }
+    }
+
+    fn error(&mut self, path: &[Step<'_>], rule: Option<&str>, message: String) {
+        let (line, column) = position::locate(self.source, path);
+        self.at(line, column, LintLevel::Error, rule, message);
+    }
+
+    fn warning(&mut self, path: &[Step<'_>], rule: Option<&str>, message: String) {
+        let (line, column) = position::locate(self.source, path);
+        self.at(line, column, LintLevel::Warning, rule, message);
+    }
+
+    fn at(
+        &mut self,
+        line: usize,
+        column: usize,
+        level: LintLevel,
+        rule: Option<&str>,
+        message: String,
+    ) {
+        self.findings.push(LintFinding {
+            path: self.path.to_path_buf(),
+            line,
+            column,
+            level,
+            rule: rule.map(str::to_string),
+            message,
+        });
+    }
+}
+
+/// A parser error as a position and a message without it.
+trait ParseError: fmt::Display {
+    fn position(&self) -> Option<(usize, usize)>;
+}
+
+impl ParseError for serde_json::Error {
+    fn position(&self) -> Option<(usize, usize)> {
+        (self.line() > 0).then(|| (self.line(), self.column().max(1)))
+    }
+}
+
+impl ParseError for serde_yaml::Error {
+    fn position(&self) -> Option<(usize, usize)> {
+        self.location()
+            .map(|location| (location.line(), location.column()))
+    }
+}
+
+fn parse_error(error: &impl ParseError, json: bool) -> (usize, usize, String) {
+    let (line, column) = error.position().unwrap_or((1, 1));
+    let format = if json { "JSON" } else { "YAML" };
+    let message = AT_POSITION.replace(&error.to_string(), "").into_owned();
+    (line, column, format!("invalid {}: {}", format, message))
+}
+
+/// The capture references of a regex replacement.
+fn captures(replacement: &str) -> impl Iterator<Item = &str> {
+    CAPTURE_REF.captures_iter(replacement).filter_map(|caps| {
+        caps.name("braced")
+            .or_else(|| caps.name("bare"))
+            .map(|m| m.as_str())
+    })
+}
+
+/// The captures of `used` that `regex` does not define, by index or name.
+fn undefined<'a>(regex: &Regex, used: impl Iterator<Item = &'a str>) -> Vec<&'a str> {
+    let names: HashSet<&str> = regex.capture_names().flatten().collect();
+    let mut seen = HashSet::new();
+    used.filter(|capture| match capture.parse::<usize>() {
+        Ok(index) => index >= regex.captures_len(),
+        Err(_) => !names.contains(capture),
+    })
+    .filter(|capture| seen.insert(*capture))
+    .collect()
+}
+
+/// Why `template`, a structural pattern or replacement, cannot be code of
+/// the languages of `extensions`, if it cannot.
+fn unparsable(
+    template: &str,
+    extensions: &[String],
+    languages: &LanguageRegistry,
+) -> Option<String> {
+    let mut open = Vec::new();
+    for c in template.chars() {
+        match c {
+            '(' | '[' | '{' => open.push(c),
+            ')' | ']' | '}' => {
+                let expected = match open.pop() {
+                    Some('(') => ')',
+                    Some('[') => ']',
+                    Some(_) => '}',
+                    None => return Some(format!("closes '{}', which was never opened", c)),
+                };
+                if c != expected {
+                    return Some(format!("closes '{}' where '{}' was expected", c, expected));
+                }
+            }
+            _ => {}
+        }
+    }
+    if let Some(c) = open.pop() {
+        return Some(format!("never closes '{}'", c));
+    }
+
+    // Metavariables stand for expressions, such as identifiers
+    let code = structural::without_ellipses(template);
+    let code = METAVARIABLE.replace_all(&code, "$1");
+    let mut seen = HashSet::new();
+    extensions
+        .iter()
+        .filter_map(|ext| languages.by_extension(ext))
+        .filter(|language| seen.insert(language.name()))
+        .find(|language| {
+            language
+                .parse(&code)
+                .is_ok_and(|tree| tree.root_node().has_error())
+        })
+        .map(|language| format!("does not parse as {}", language.name()))
+}
+
+/// Why the paths of `when` select no file of `extensions`, if they do not.
+fn unselected(when: Option<&RuleCondition>, extensions: &[String]) -> Option<String> {
+    let paths = &when?.paths;
+    if paths.is_empty() || extensions.is_empty() {
+        return None;
+    }
+    let mut other = Vec::new();
+    for path in paths {
+        let ext = GLOB_EXTENSION.captures(path)?.get(1)?.as_str();
+        if extensions.iter().any(|e| e.eq_ignore_ascii_case(ext)) {
+            return None;
+        }
+        other.push(format!(".{}", ext));
+    }
+    Some(format!(
+        "never matches: its paths only select {} files, and the upgrade processes {}",
+        other.join(", "),
+        extensions
+            .iter()
+            .map(|ext| format!(".{}", ext))
+            .collect::<Vec<_>>()
+            .join(", ")
+    ))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn lint_json(source: &str) -> Vec<(usize, LintLevel, String)> {
+        lint(Path::new("rules.json"), source)
+            .into_iter()
+            .map(|f| (f.line, f.level, f.to_string()))
+            .collect()
+    }
+
+    #[test]
+    fn test_lint_reports_rule_problems() {
+        let source = r#"{
+  "name": "v2",
+  "description": "",
+  "extensions": ["go"],
+  "transforms": [
+    {"id": "get", "type": "rename_function", "old_name": "GetUser", "new_name": "FetchUser"},
+    {"id": "get-again", "type": "rename_function", "old_name": "GetUser", "new_name": "LoadUser"},
+    {"id": "typo", "type": "rename_type", "old_nme": "Client", "new_name": "Conn", "old_name": "Client"},
+    {"id": "bad-regex", "type": "replace_pattern", "pattern": "Save(", "replacement": "Store("},
+    {"id": "captures", "type": "replace_pattern", "pattern": "Open\\((?P<addr>\\w+)\\)",
+     "replacement": "Dial(${adr}, $1)", "when": {"literal": ["2"]}},
+    {"id": "python-only", "type": "rename_function", "old_name": "close", "new_name": "shutdown",
+     "when": {"paths": ["**/*.py"]}},
+    {"id": "get", "type": "rename_type", "old_name": "User", "new_name": "Account"}
+  ]
+}"#;
+        let findings = lint_json(source);
+        let messages: Vec<&str> = findings.iter().map(|(_, _, m)| m.as_str()).collect();
+        assert_eq!(
+            messages,
+            [
+                "rules.json:7:5: warning: rule get-again: never matches: rule get matches the same code and rewrites it first",
+                "rules.json:8:43: error: rule typo: unknown field 'old_nme' is ignored; expected one of: type, id, message, mode, severity, when, unless, imports, matcher, rewriter, files, old_name, new_name",
+                "rules.json:9:52: error: rule bad-regex: pattern does not compile: unclosed group",
+                "rules.json:11:6: error: rule captures: replacement uses capture 'adr', which the pattern does not define",
+                "rules.json:11:41: error: rule captures: when uses capture '2', which the pattern does not define",
+                "rules.json:13:6: warning: rule python-only: never matches: its paths only select .py files, and the upgrade processes .go",
+                "rules.json:14:6: error: rule get: id 'get' is also the id of rule 1; give each rule its own id",
+            ]
+        );
+        assert_eq!(findings[0].1, LintLevel::Warning);
+
+        let findings = lint_json("{\n  \"name\": \"v2\",\n  \"transforms\": [}\n");
+        assert_eq!(findings.len(), 1);
+        assert!(
+            findings[0]
+                .2
+                .starts_with("rules.json:3:18: error: invalid JSON: ")
+        );
+    }
+}
@@ -0,0 +1,157 @@
+//! Language model endpoints for the opt-in assisted steps.
+//!
+//! The engine itself is deterministic. A few opt-in steps ask a language
+//! model for proposals a human then reviews: candidate rules for API
+//! changes the analyzer cannot pair ([`RuleDrafter`](crate::analyzer::RuleDrafter))
+//! and edits for the sites rules leave for manual work
+//! ([`ManualFallback`](crate::fallback::ManualFallback)). [`ChatModel`]
+//! talks to any server implementing the chat completions API, hosted or
+//! local, configured by `REFACTOR_LLM_ENDPOINT`, `REFACTOR_LLM_MODEL` and
+//! `REFACTOR_LLM_API_KEY`.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::llm::ChatModel;
+//!
+//! let model = ChatModel::new("http://localhost:11434/v1/chat/completions", "qwen2.5-coder");
+//! let answer = model.complete("Answer in one word.", "Which language uses go.mod?")?;
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use reqwest::blocking::Client;
+use serde::Deserialize;
+use serde::de::DeserializeOwned;
+use serde_json::json;
+
+use crate::error::{RefactorError, Result};
+
+/// Environment variable holding the chat completions URL.
+pub const ENDPOINT_VAR: &str = "REFACTOR_LLM_ENDPOINT";
+
+/// Environment variable holding the model name.
+pub const MODEL_VAR: &str = "REFACTOR_LLM_MODEL";
+
+/// Environment variable holding the bearer token, if the endpoint needs one.
+pub const API_KEY_VAR: &str = "REFACTOR_LLM_API_KEY";
+
+/// A model behind a chat completions endpoint.
+#[derive(Debug, Clone)]
+pub struct ChatModel {
+    endpoint: String,
+    model: String,
+    api_key: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Completion {
+    choices: Vec<Choice>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Choice {
+    message: Message,
+}
+
+#[derive(Debug, Deserialize)]
+struct Message {
+    content: String,
+}
+
+impl ChatModel {
+    /// `model` at the chat completions `endpoint`
+    /// (`https://host/v1/chat/completions`).
+    pub fn new(endpoint: impl Into<String>, model: impl Into<String>) -> Self {
+        Self {
+            endpoint: endpoint.into(),
+            model: model.into(),
+            api_key: None,
+        }
+    }
+
+    /// Authenticate with a bearer token.
+    pub fn api_key(mut self, key: impl Into<String>) -> Self {
+        self.api_key = Some(key.into());
+        self
+    }
+
+    /// The model configured by `REFACTOR_LLM_ENDPOINT` and
+    /// `REFACTOR_LLM_MODEL`, authenticating with `REFACTOR_LLM_API_KEY` if
+    /// it is set.
+    pub fn from_env() -> Result<Self> {
+        let var = |name: &str| {
+            std::env::var(name).map_err(|_| RefactorError::LanguageModel {
+                message: format!("{} environment variable not set", name),
+            })
+        };
+        let model = Self::new(var(ENDPOINT_VAR)?, var(MODEL_VAR)?);
+        Ok(match std::env::var(API_KEY_VAR) {
+            Ok(key) if !key.is_empty() => model.api_key(key),
+            _ => model,
+        })
+    }
+
+    /// The model's name.
+    pub fn name(&self) -> &str {
+        &self.model
+    }
+
+    /// The model's answer to `prompt`, following `instructions`.
+    pub fn complete(&self, instructions: &str, prompt: &str) -> Result<String> {
+        let request = json!({
+            "model": self.model,
+            "temperature": 0,
+            "messages": [
+                {"role": "system", "content": instructions},
+                {"role": "user", "content": prompt},
+            ],
+        });
+        let mut builder = Client::new().post(&self.endpoint).json(&request);
+        if let Some(key) = &self.api_key {
+            builder = builder.bearer_auth(key);
+        }
+        let completion: Completion = builder
+            .send()?
+            .error_for_status()
+            .map_err(|e| RefactorError::LanguageModel {
+                message: format!("{} failed: {}", self.endpoint, e),
+            })?
+            .json()?;
+        Ok(completion
+            .choices
+            .into_iter()
+            .next()
+            .map(|choice| choice.message.content)
+            .unwrap_or_default())
+    }
+}
+
+/// The JSON value between the first `open` and the last `close` delimiter
+/// of a model's answer, which models often wrap in prose or a Markdown code
+/// block.
+pub(crate) fn extract_json<T: DeserializeOwned>(
+    answer: &str,
+    open: char,
+    close: char,
+) -> Option<T> {
+    let start = answer.find(open)?;
+    let end = answer.rfind(close)?;
+    if start >= end {
+        return None;
+    }
+    serde_json::from_str(&answer[start..=end]).ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_extract_json() {
+        let answer = "Sure:\n```json\n{\"replacement\": \"x := 1\"}\n```\n";
+        let value: Option<serde_json::Value> = extract_json(answer, '{', '}');
+        assert_eq!(value.unwrap()["replacement"], "x := 1");
+        assert!(extract_json::<Vec<i32>>("no rules", '[', ']').is_none());
+        assert!(extract_json::<Vec<i32>>("] before [", '[', ']').is_none());
+    }
+}
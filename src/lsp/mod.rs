@@ -2,7 +2,8 @@
 //!
 //! This module provides LSP client functionality to enable refactoring
 //! operations (rename, find references, etc.) for any language with an
-//! LSP server implementation.
+//! LSP server implementation. [`LspServer`] goes the other way, serving
+//! upgrade rules to editors as diagnostics and quick fixes.
 //!
 //! ## Auto-installing LSP Servers
 //!
@@ -23,12 +24,14 @@ mod client;
 mod config;
 pub mod installer;
 mod rename;
+mod server;
 mod types;
 
 pub use client::LspClient;
 pub use config::{LspConfig, LspServerConfig};
 pub use installer::LspInstaller;
 pub use rename::{LspRename, RenameResult};
+pub use server::LspServer;
 pub use types::{Location, Position, Range, TextEdit, WorkspaceEdit};
 
 use std::path::Path;
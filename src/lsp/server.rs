@@ -0,0 +1,327 @@
+//! Language server that offers upgrade rules as diagnostics and quick fixes.
+//!
+//! `refactor lsp` speaks LSP over stdin/stdout. Every open document is
+//! checked against the rules on open and on each change; each match is
+//! published as a diagnostic, and `textDocument/codeAction` offers the
+//! rule's rewrite as a quick fix, so a migration can be applied one site at a
+//! time from the editor.
+
+use serde_json::{Value, json};
+use std::collections::HashMap;
+use std::io::{BufRead, Write};
+use std::path::PathBuf;
+
+use crate::error::{RefactorError, Result};
+use crate::lsp::types::{Position, Range};
+use crate::quickfix::{QuickFix, QuickFixer};
+
+/// JSON-RPC error code for unknown methods.
+const METHOD_NOT_FOUND: i64 = -32601;
+
+/// LSP diagnostic severity for hints shown as information.
+const SEVERITY_INFORMATION: u8 = 3;
+
+/// Serves upgrade rules to an editor over the Language Server Protocol.
+pub struct LspServer {
+    fixer: QuickFixer,
+    documents: HashMap<String, String>,
+}
+
+impl LspServer {
+    /// Create a server offering the fixes of `fixer`.
+    pub fn new(fixer: QuickFixer) -> Self {
+        Self {
+            fixer,
+            documents: HashMap::new(),
+        }
+    }
+
+    /// Handle messages from `input` until the client sends `exit` or closes
+    /// the stream.
+    pub fn serve(&mut self, mut input: impl BufRead, mut output: impl Write) -> Result<()> {
+        while let Some(message) = read_message(&mut input)? {
+            let method = message["method"].as_str().unwrap_or_default().to_string();
+            if method == "exit" {
+                break;
+            }
+            let params = &message["params"];
+
+            match message.get("id") {
+                Some(id) => {
+                    let response = match self.request(&method, params) {
+                        Some(result) => json!({"jsonrpc": "2.0", "id": id, "result": result}),
+                        None => json!({
+                            "jsonrpc": "2.0",
+                            "id": id,
+                            "error": {
+                                "code": METHOD_NOT_FOUND,
+                                "message": format!("Unsupported method '{}'", method),
+                            },
+                        }),
+                    };
+                    write_message(&mut output, &response)?;
+                }
+                None => {
+                    for notification in self.notify(&method, params) {
+                        write_message(&mut output, &notification)?;
+                    }
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// The result of a request, or `None` if the method is not supported.
+    fn request(&self, method: &str, params: &Value) -> Option<Value> {
+        match method {
+            "initialize" => Some(json!({
+                "capabilities": {
+                    "textDocumentSync": 1,
+                    "codeActionProvider": {"codeActionKinds": ["quickfix"]},
+                },
+                "serverInfo": {"name": "refactor", "version": env!("CARGO_PKG_VERSION")},
+            })),
+            "shutdown" => Some(Value::Null),
+            "textDocument/codeAction" => Some(self.code_actions(params)),
+            _ => None,
+        }
+    }
+
+    /// Update documents for a notification and return the notifications to
+    /// send back.
+    fn notify(&mut self, method: &str, params: &Value) -> Vec<Value> {
+        let uri = params["textDocument"]["uri"]
+            .as_str()
+            .unwrap_or_default()
+            .to_string();
+        match method {
+            "textDocument/didOpen" => {
+                let text = params["textDocument"]["text"].as_str().unwrap_or_default();
+                self.documents.insert(uri.clone(), text.to_string());
+            }
+            "textDocument/didChange" => {
+                // Full sync: the last change holds the whole document
+                let changes = params["contentChanges"].as_array();
+                if let Some(text) = changes
+                    .and_then(|c| c.last())
+                    .and_then(|c| c["text"].as_str())
+                {
+                    self.documents.insert(uri.clone(), text.to_string());
+                }
+            }
+            "textDocument/didClose" => {
+                self.documents.remove(&uri);
+            }
+            _ => return Vec::new(),
+        }
+        vec![self.diagnostics(&uri)]
+    }
+
+    /// A `publishDiagnostics` notification for the document at `uri`.
+    fn diagnostics(&self, uri: &str) -> Value {
+        let diagnostics: Vec<Value> = self
+            .fixes(uri)
+            .into_iter()
+            .map(|(source, fix)| {
+                json!({
+                    "range": fix_range(source, &fix),
+                    "severity": SEVERITY_INFORMATION,
+                    "source": "refactor",
+                    "code": fix.rule,
+                    "message": fix.title,
+                })
+            })
+            .collect();
+        json!({
+            "jsonrpc": "2.0",
+            "method": "textDocument/publishDiagnostics",
+            "params": {"uri": uri, "diagnostics": diagnostics},
+        })
+    }
+
+    /// Quick fixes overlapping the requested range.
+    fn code_actions(&self, params: &Value) -> Value {
+        let uri = params["textDocument"]["uri"].as_str().unwrap_or_default();
+        let Ok(requested) = serde_json::from_value::<Range>(params["range"].clone()) else {
+            return json!([]);
+        };
+
+        let actions: Vec<Value> = self
+            .fixes(uri)
+            .into_iter()
+            .filter_map(|(source, fix)| {
+                let range = fix_range(source, &fix);
+                if range.end < requested.start || requested.end < range.start {
+                    return None;
+                }
+                let edits: Vec<Value> = fix
+                    .edits
+                    .iter()
+                    .map(|edit| {
+                        json!({
+                            "range": Range::new(
+                                position_at(source, edit.start),
+                                position_at(source, edit.end),
+                            ),
+                            "newText": edit.text,
+                        })
+                    })
+                    .collect();
+                Some(json!({
+                    "title": fix.title,
+                    "kind": "quickfix",
+                    "diagnostics": [{
+                        "range": range,
+                        "source": "refactor",
+                        "code": fix.rule,
+                        "message": fix.title,
+                    }],
+                    "edit": {"changes": {uri: edits}},
+                }))
+            })
+            .collect();
+        Value::Array(actions)
+    }
+
+    fn fixes(&self, uri: &str) -> Vec<(&str, QuickFix)> {
+        let Some(source) = self.documents.get(uri) else {
+            return Vec::new();
+        };
+        self.fixer
+            .all_fixes(&uri_to_path(uri), source)
+            .into_iter()
+            .map(|fix| (source.as_str(), fix))
+            .collect()
+    }
+}
+
+/// The range covered by all edits of a fix.
+fn fix_range(source: &str, fix: &QuickFix) -> Range {
+    let start = fix.edits.iter().map(|e| e.start).min().unwrap_or(0);
+    let end = fix.edits.iter().map(|e| e.end).max().unwrap_or(0);
+    Range::new(position_at(source, start), position_at(source, end))
+}
+
+/// The LSP position (0-based line, UTF-16 column) of a byte offset.
+fn position_at(source: &str, offset: usize) -> Position {
+    let before = &source[..offset];
+    let line_start = before.rfind('\n').map_or(0, |i| i + 1);
+    Position::new(
+        before.matches('\n').count() as u32,
+        before[line_start..].encode_utf16().count() as u32,
+    )
+}
+
+/// The file path of a `file://` URI, or the URI itself for other schemes.
+fn uri_to_path(uri: &str) -> PathBuf {
+    url::Url::parse(uri)
+        .ok()
+        .and_then(|url| url.to_file_path().ok())
+        .unwrap_or_else(|| PathBuf::from(uri))
+}
+
+/// Read one `Content-Length` framed message, or `None` at end of input.
+fn read_message(input: &mut impl BufRead) -> Result<Option<Value>> {
+    let mut content_length = None;
+    loop {
+        let mut header = String::new();
+        if input.read_line(&mut header)? == 0 {
+            return Ok(None);
+        }
+        let header = header.trim_end();
+        if header.is_empty() {
+            if content_length.is_some() {
+                break;
+            }
+            continue;
+        }
+        if let Some(len) = header.strip_prefix("Content-Length:") {
+            content_length = len.trim().parse::<usize>().ok();
+        }
+    }
+
+    let mut content = vec![0u8; content_length.unwrap_or(0)];
+    input.read_exact(&mut content)?;
+    serde_json::from_slice(&content)
+        .map(Some)
+        .map_err(|e| RefactorError::InvalidConfig(format!("Invalid LSP message: {}", e)))
+}
+
+fn write_message(output: &mut impl Write, message: &Value) -> Result<()> {
+    let content = serde_json::to_string(message)?;
+    write!(
+        output,
+        "Content-Length: {}\r\n\r\n{}",
+        content.len(),
+        content
+    )?;
+    output.flush()?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformRule, TransformSpec, UpgradeConfig};
+
+    fn frame(message: Value) -> String {
+        let content = message.to_string();
+        format!("Content-Length: {}\r\n\r\n{}", content.len(), content)
+    }
+
+    fn parse(mut output: &[u8]) -> Vec<Value> {
+        let mut messages = Vec::new();
+        while let Some(message) = read_message(&mut output).unwrap() {
+            messages.push(message);
+        }
+        messages
+    }
+
+    #[test]
+    fn test_diagnostics_and_code_actions() {
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "GetUser".to_string(),
+                new_name: "FetchUser".to_string(),
+            })
+            .with_id("rename-get-user"),
+        );
+        let mut server = LspServer::new(QuickFixer::new(config).unwrap());
+
+        let uri = "file:///src/main.go";
+        let input = [
+            frame(json!({"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {}})),
+            frame(json!({"jsonrpc": "2.0", "method": "textDocument/didOpen", "params": {
+                "textDocument": {"uri": uri, "text": "// é\nu := GetUser(id)\n"},
+            }})),
+            frame(json!({"jsonrpc": "2.0", "id": 2, "method": "textDocument/codeAction", "params": {
+                "textDocument": {"uri": uri},
+                "range": {"start": {"line": 1, "character": 7}, "end": {"line": 1, "character": 7}},
+            }})),
+            frame(json!({"jsonrpc": "2.0", "id": 3, "method": "textDocument/hover", "params": {}})),
+            frame(json!({"jsonrpc": "2.0", "method": "exit"})),
+        ]
+        .concat();
+        let mut output = Vec::new();
+        server.serve(input.as_bytes(), &mut output).unwrap();
+
+        let messages = parse(&output);
+        assert_eq!(messages.len(), 4);
+        assert_eq!(messages[0]["result"]["capabilities"]["textDocumentSync"], 1);
+
+        let diagnostic = &messages[1]["params"]["diagnostics"][0];
+        assert_eq!(diagnostic["code"], "rename-get-user");
+        assert_eq!(
+            diagnostic["range"],
+            json!({"start": {"line": 1, "character": 5}, "end": {"line": 1, "character": 13}})
+        );
+
+        let action = &messages[2]["result"][0];
+        assert_eq!(action["kind"], "quickfix");
+        assert_eq!(action["edit"]["changes"][uri][0]["newText"], "FetchUser(");
+
+        assert_eq!(messages[3]["error"]["code"], METHOD_NOT_FOUND);
+    }
+}
@@ -0,0 +1,282 @@
+//! Reducing inputs to the smallest snippet that still shows a behavior.
+//!
+//! A [`Minimizer`] takes a source file and a predicate that says whether a
+//! candidate still exhibits the behavior of interest (a rule misfiring, a
+//! run failing, a match being found) and removes everything it can: first
+//! whole lines, then words within the remaining lines, both by delta
+//! debugging. With [`Minimizer::redact`], string literal contents and
+//! comments are blanked out where the predicate allows.
+//!
+//! The result is a focused fixture for a test, or a shareable snippet for a
+//! bug report (see [`crate::replay::BugReport`]).
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::minimize::Minimizer;
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let runner = UpgradeRunner::new(UpgradeConfig::from_file("upgrade.yaml")?);
+//! let source = std::fs::read_to_string("client/conn.go")?;
+//! let snippet = Minimizer::new(|candidate: &str| {
+//!     runner
+//!         .run_source("conn.go", candidate)
+//!         .is_ok_and(|report| report.files_modified() > 0)
+//! })
+//! .minimize(&source)?;
+//! println!("{}", snippet);
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use crate::error::{RefactorError, Result};
+
+/// String literals and line comments, the parts of a file most likely to
+/// carry private details.
+static REDACTABLE: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r#""(?:[^"\\\n]|\\.)*"|`[^`]*`|//[^\n]*"#).expect("invalid redactable regex")
+});
+
+/// Shrinks a source file while a predicate keeps holding.
+pub struct Minimizer<F> {
+    keep: F,
+    words: bool,
+    redact: bool,
+    checks: usize,
+}
+
+impl<F: FnMut(&str) -> bool> Minimizer<F> {
+    /// Create a minimizer that keeps candidates for which `keep` holds.
+    pub fn new(keep: F) -> Self {
+        Self {
+            keep,
+            words: true,
+            redact: false,
+            checks: 0,
+        }
+    }
+
+    /// Only remove whole lines, leaving the kept lines intact.
+    pub fn lines_only(mut self) -> Self {
+        self.words = false;
+        self
+    }
+
+    /// Also blank out string literal contents and comments (keeping their
+    /// length, so columns still line up).
+    pub fn redact(mut self) -> Self {
+        self.redact = true;
+        self
+    }
+
+    /// Number of candidates checked so far.
+    pub fn checks(&self) -> usize {
+        self.checks
+    }
+
+    /// Reduce `source`. Fails if the predicate does not hold for `source`
+    /// itself.
+    pub fn minimize(&mut self, source: &str) -> Result<String> {
+        if !self.check(source) {
+            return Err(RefactorError::InvalidConfig(
+                "The behavior to preserve does not occur in the input".to_string(),
+            ));
+        }
+
+        let lines: Vec<&str> = source.lines().collect();
+        let lines = shrink(lines, |lines| self.check(&join_lines(lines)));
+        let mut lines: Vec<String> = lines.into_iter().map(str::to_string).collect();
+
+        if self.words {
+            for index in 0..lines.len() {
+                let line = lines[index].clone();
+                let indent = &line[..line.len() - line.trim_start().len()];
+                let words: Vec<&str> = line.trim_start().split_inclusive(' ').collect();
+                let kept = shrink(words, |words| {
+                    let mut candidate = lines.clone();
+                    candidate[index] = format!("{}{}", indent, words.concat().trim_end());
+                    self.check(&join_lines(&candidate))
+                });
+                lines[index] = format!("{}{}", indent, kept.concat().trim_end());
+            }
+            // Lines emptied of words are dropped unless the behavior needs them
+            let nonblank: Vec<String> = lines
+                .iter()
+                .filter(|line| !line.trim().is_empty())
+                .cloned()
+                .collect();
+            if nonblank.len() < lines.len() && self.check(&join_lines(&nonblank)) {
+                lines = nonblank;
+            }
+        }
+
+        let mut result = join_lines(&lines);
+        if self.redact {
+            result = redact(&result, |candidate| self.check(candidate));
+        }
+        Ok(result)
+    }
+
+    fn check(&mut self, candidate: &str) -> bool {
+        self.checks += 1;
+        (self.keep)(candidate)
+    }
+}
+
+/// An input and the output a rule produces from it, written as a pair of
+/// files for a golden test.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Fixture {
+    /// The input snippet.
+    pub input: String,
+    /// The expected output.
+    pub expected: String,
+}
+
+impl Fixture {
+    /// Write `<name>.input.<ext>` and `<name>.expected.<ext>` to `dir`,
+    /// returning their paths.
+    pub fn write(&self, dir: &Path, name: &str, ext: &str) -> Result<(PathBuf, PathBuf)> {
+        fs::create_dir_all(dir)?;
+        let input = dir.join(format!("{}.input.{}", name, ext));
+        let expected = dir.join(format!("{}.expected.{}", name, ext));
+        fs::write(&input, &self.input)?;
+        fs::write(&expected, &self.expected)?;
+        Ok((input, expected))
+    }
+}
+
+fn join_lines<S: AsRef<str>>(lines: &[S]) -> String {
+    lines
+        .iter()
+        .map(|line| format!("{}\n", line.as_ref()))
+        .collect()
+}
+
+/// Remove chunks of `items` while `keep` holds, halving the chunk size
+/// whenever no chunk can be removed (delta debugging).
+fn shrink<T: Clone>(mut items: Vec<T>, mut keep: impl FnMut(&[T]) -> bool) -> Vec<T> {
+    let mut chunks = 2;
+    while items.len() >= 2 {
+        let size = items.len().div_ceil(chunks);
+        let removed = (0..items.len()).step_by(size).find_map(|start| {
+            let mut candidate = items[..start].to_vec();
+            candidate.extend_from_slice(&items[(start + size).min(items.len())..]);
+            keep(&candidate).then_some(candidate)
+        });
+        match removed {
+            Some(candidate) => {
+                items = candidate;
+                chunks = (chunks - 1).max(2);
+            }
+            None if chunks >= items.len() => break,
+            None => chunks = (chunks * 2).min(items.len()),
+        }
+    }
+    if items.len() == 1 && keep(&[]) {
+        items.clear();
+    }
+    items
+}
+
+/// Blank out string literal contents and comments, all at once if `keep`
+/// allows and otherwise one at a time.
+fn redact(source: &str, mut keep: impl FnMut(&str) -> bool) -> String {
+    let blank = |text: &str| -> String {
+        let (open, inner, close) = if let Some(comment) = text.strip_prefix("//") {
+            ("//", comment, "")
+        } else {
+            (
+                &text[..1],
+                &text[1..text.len() - 1],
+                &text[text.len() - 1..],
+            )
+        };
+        let inner: String = inner
+            .chars()
+            .map(|c| if c.is_whitespace() { c } else { 'x' })
+            .collect();
+        format!("{}{}{}", open, inner, close)
+    };
+
+    let all = REDACTABLE.replace_all(source, |caps: &regex::Captures<'_>| blank(&caps[0]));
+    if keep(&all) {
+        return all.into_owned();
+    }
+
+    let mut redacted = source.to_string();
+    let spans: Vec<(usize, usize)> = REDACTABLE
+        .find_iter(source)
+        .map(|m| (m.start(), m.end()))
+        .collect();
+    // Lengths are preserved, so earlier spans stay valid
+    for (start, end) in spans {
+        let mut candidate = redacted.clone();
+        candidate.replace_range(start..end, &blank(&source[start..end]));
+        if keep(&candidate) {
+            redacted = candidate;
+        }
+    }
+    redacted
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_minimize_lines_and_words() {
+        let source =
+            "package main\n\nfunc main() {\n\tc := Dial(addr, opts)\n\tdefer c.Close()\n}\n";
+        let mut minimizer = Minimizer::new(|candidate: &str| candidate.contains("Dial(addr,"));
+        assert_eq!(minimizer.minimize(source).unwrap(), "\tDial(addr,\n");
+        assert!(minimizer.checks() > 1);
+
+        let snippet = Minimizer::new(|candidate: &str| candidate.contains("Dial("))
+            .lines_only()
+            .minimize(source)
+            .unwrap();
+        assert_eq!(snippet, "\tc := Dial(addr, opts)\n");
+    }
+
+    #[test]
+    fn test_redact_keeps_what_the_behavior_needs() {
+        let source = "// internal host\nDial(\"db.internal\", \"tcp\")\n";
+        let snippet = Minimizer::new(|candidate: &str| candidate.contains("\"tcp\""))
+            .lines_only()
+            .redact()
+            .minimize(source)
+            .unwrap();
+        assert_eq!(snippet, "Dial(\"xxxxxxxxxxx\", \"tcp\")\n");
+    }
+
+    #[test]
+    fn test_behavior_must_occur() {
+        let mut minimizer = Minimizer::new(|candidate: &str| candidate.contains("Dial"));
+        assert!(minimizer.minimize("x := 1\n").is_err());
+    }
+
+    #[test]
+    fn test_shrink() {
+        let items: Vec<u32> = (0..20).collect();
+        let kept = shrink(items, |items| items.contains(&3) && items.contains(&17));
+        assert_eq!(kept, vec![3, 17]);
+    }
+
+    #[test]
+    fn test_fixture_write() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let fixture = Fixture {
+            input: "Dial(a)\n".to_string(),
+            expected: "Dial(a, nil)\n".to_string(),
+        };
+        let (input, expected) = fixture.write(dir.path(), "dial", "go").unwrap();
+        assert_eq!(input.file_name().unwrap(), "dial.input.go");
+        assert_eq!(fs::read_to_string(expected).unwrap(), "Dial(a, nil)\n");
+    }
+}
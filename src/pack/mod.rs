@@ -0,0 +1,367 @@
+//! Semantic comparison of rule packs.
+//!
+//! A rule pack is an upgrade configuration or a convention pack. [`PackDiff`]
+//! compares two versions of a pack rule by rule, keyed by rule id, and
+//! reports added, removed and changed rules together with the fields that
+//! changed. Formatting, key order and file format (YAML or JSON) do not
+//! matter. [`PackDiff::impact`] shows how many sites each change would
+//! rewrite in a project, so consumers can review a pack update before
+//! adopting it.
+//!
+//! A run can apply packs for several libraries at once, where one library's
+//! new version uses another's new types. Each pack names the packs it
+//! `requires`; [`application_order`] puts requirements first and rejects
+//! circular requirements before anything is applied.
+//!
+//! Published packs are fetched from a URL or OCI registry, pinned by
+//! checksum ([`PackRegistry`]). A library can also ship its packs in its own
+//! module, where [`discover`] finds the ones for a client's upgrade.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::pack::{self, PackDiff};
+//!
+//! let old = pack::load("rules-v1.yaml")?;
+//! let new = pack::load("rules-v2.yaml")?;
+//! let diff = PackDiff::between(&old, &new);
+//! println!("{}", diff);
+//! for impact in diff.impact(&old, &new, "./project")? {
+//!     println!("{}", impact);
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::Serialize;
+use serde_json::{Map, Value};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::analyzer::{TransformRule, UpgradeConfig};
+use crate::codemod::Upgrade;
+use crate::conventions::ConventionPack;
+use crate::error::Result;
+use crate::transform::GuardedTransform;
+
+mod order;
+mod registry;
+mod shipped;
+
+pub use order::application_order;
+pub use registry::{FetchedPack, OciReference, PackRegistry, PackSource, load_source};
+pub use shipped::{ModuleUpgrade, SHIPPED_PACK_DIR, ShippedPacks, discover, shipped_packs};
+
+/// Load a rule pack from an upgrade configuration or convention pack file.
+pub fn load(path: impl AsRef<Path>) -> Result<UpgradeConfig> {
+    let path = path.as_ref();
+    UpgradeConfig::from_file(path).or_else(|err| match ConventionPack::from_file(path) {
+        Ok(pack) => Ok(pack.to_upgrade_config()),
+        Err(_) => Err(err),
+    })
+}
+
+/// A field of a rule that differs between two pack versions.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct FieldChange {
+    /// Field name (e.g. `pattern`, `mode`, `when`).
+    pub field: String,
+    /// Old value, if the field was set.
+    pub old: Option<Value>,
+    /// New value, if the field is set.
+    pub new: Option<Value>,
+}
+
+impl fmt::Display for FieldChange {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let show = |v: &Option<Value>| v.as_ref().map_or("(unset)".to_string(), Value::to_string);
+        write!(
+            f,
+            "{}: {} -> {}",
+            self.field,
+            show(&self.old),
+            show(&self.new)
+        )
+    }
+}
+
+/// A difference between two versions of a pack.
+#[derive(Debug, Clone, Serialize)]
+#[serde(tag = "change", rename_all = "lowercase")]
+pub enum RuleChange {
+    /// A rule only in the new pack.
+    Added { rule: String },
+    /// A rule only in the old pack.
+    Removed { rule: String },
+    /// A rule in both packs whose definition changed.
+    Changed {
+        rule: String,
+        fields: Vec<FieldChange>,
+    },
+}
+
+impl RuleChange {
+    /// The id of the rule that changed.
+    pub fn rule(&self) -> &str {
+        match self {
+            RuleChange::Added { rule }
+            | RuleChange::Removed { rule }
+            | RuleChange::Changed { rule, .. } => rule,
+        }
+    }
+}
+
+impl fmt::Display for RuleChange {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            RuleChange::Added { rule } => write!(f, "+ {}", rule),
+            RuleChange::Removed { rule } => write!(f, "- {}", rule),
+            RuleChange::Changed { rule, fields } => {
+                write!(f, "~ {}", rule)?;
+                for field in fields {
+                    write!(f, "\n    {}", field)?;
+                }
+                Ok(())
+            }
+        }
+    }
+}
+
+/// How many sites a changed rule rewrites before and after a pack update.
+#[derive(Debug, Clone, Serialize)]
+pub struct RuleImpact {
+    /// The rule id.
+    pub rule: String,
+    /// Sites the old rule rewrites (0 if the rule was added).
+    pub sites_before: usize,
+    /// Sites the new rule rewrites (0 if the rule was removed).
+    pub sites_after: usize,
+    /// Files where the rule's rewrites differ.
+    pub files: Vec<PathBuf>,
+}
+
+impl fmt::Display for RuleImpact {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}: {} -> {} site(s) in {} file(s)",
+            self.rule,
+            self.sites_before,
+            self.sites_after,
+            self.files.len()
+        )
+    }
+}
+
+/// The rule-by-rule difference between two packs.
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct PackDiff {
+    /// Changes in new-pack order, followed by removed rules.
+    pub changes: Vec<RuleChange>,
+}
+
+impl PackDiff {
+    /// Compare two packs rule by rule.
+    pub fn between(old: &UpgradeConfig, new: &UpgradeConfig) -> Self {
+        let mut changes = Vec::new();
+
+        for rule in &new.transforms {
+            let name = rule.name();
+            match find(old, &name) {
+                None => changes.push(RuleChange::Added { rule: name }),
+                Some(previous) => {
+                    let fields = field_changes(previous, rule);
+                    if !fields.is_empty() {
+                        changes.push(RuleChange::Changed { rule: name, fields });
+                    }
+                }
+            }
+        }
+        for rule in &old.transforms {
+            let name = rule.name();
+            if find(new, &name).is_none() {
+                changes.push(RuleChange::Removed { rule: name });
+            }
+        }
+
+        Self { changes }
+    }
+
+    /// Returns true if the packs define the same rules.
+    pub fn is_empty(&self) -> bool {
+        self.changes.is_empty()
+    }
+
+    /// Count the sites each added, removed or changed rule rewrites under
+    /// `root`, using the new pack's file selection.
+    pub fn impact(
+        &self,
+        old: &UpgradeConfig,
+        new: &UpgradeConfig,
+        root: impl AsRef<Path>,
+    ) -> Result<Vec<RuleImpact>> {
+        let files = new.to_upgrade().matcher().collect_files(root.as_ref())?;
+        let sources = files
+            .into_iter()
+            .map(|path| Ok((fs::read_to_string(&path)?, path)))
+            .collect::<Result<Vec<_>>>()?;
+
+        let mut impacts = Vec::new();
+        for change in &self.changes {
+            let before = rewriter(find(old, change.rule()))?;
+            let after = rewriter(find(new, change.rule()))?;
+
+            let mut impact = RuleImpact {
+                rule: change.rule().to_string(),
+                sites_before: 0,
+                sites_after: 0,
+                files: Vec::new(),
+            };
+            for (source, path) in &sources {
+                let old_sites = rewrites(before.as_ref(), source, path);
+                let new_sites = rewrites(after.as_ref(), source, path);
+                impact.sites_before += old_sites.len();
+                impact.sites_after += new_sites.len();
+                if old_sites != new_sites {
+                    impact.files.push(path.clone());
+                }
+            }
+            impacts.push(impact);
+        }
+        Ok(impacts)
+    }
+}
+
+impl fmt::Display for PackDiff {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for change in &self.changes {
+            writeln!(f, "{}", change)?;
+        }
+        let count = |pred: fn(&RuleChange) -> bool| self.changes.iter().filter(|c| pred(c)).count();
+        write!(
+            f,
+            "{} added, {} removed, {} changed",
+            count(|c| matches!(c, RuleChange::Added { .. })),
+            count(|c| matches!(c, RuleChange::Removed { .. })),
+            count(|c| matches!(c, RuleChange::Changed { .. }))
+        )
+    }
+}
+
+fn find<'a>(config: &'a UpgradeConfig, name: &str) -> Option<&'a TransformRule> {
+    config.transforms.iter().find(|rule| rule.name() == name)
+}
+
+/// The transform a rule rewrites with; suggest-only rules never rewrite.
+fn rewriter(rule: Option<&TransformRule>) -> Result<Option<GuardedTransform>> {
+    rule.filter(|r| !r.is_suggest_only())
+        .map(TransformRule::to_transform)
+        .transpose()
+}
+
+fn rewrites(
+    transform: Option<&GuardedTransform>,
+    source: &str,
+    path: &Path,
+) -> Vec<(usize, String)> {
+    transform.map_or(Vec::new(), |t| {
+        t.sites(source, path)
+            .into_iter()
+            .map(|site| (site.start, site.replacement))
+            .collect()
+    })
+}
+
+/// Compare two rules field by field through their serialized form, so only
+/// semantic differences are reported.
+fn field_changes(old: &TransformRule, new: &TransformRule) -> Vec<FieldChange> {
+    let as_map = |rule: &TransformRule| match serde_json::to_value(rule) {
+        Ok(Value::Object(map)) => map,
+        _ => Map::new(),
+    };
+    let (old, new) = (as_map(old), as_map(new));
+
+    let mut fields: Vec<&String> = old.keys().chain(new.keys()).collect();
+    fields.sort();
+    fields.dedup();
+    fields
+        .into_iter()
+        .filter(|field| old.get(*field) != new.get(*field))
+        .map(|field| FieldChange {
+            field: field.clone(),
+            old: old.get(field).cloned(),
+            new: new.get(field).cloned(),
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::TransformSpec;
+    use tempfile::TempDir;
+
+    fn pack(rules: Vec<TransformRule>) -> UpgradeConfig {
+        let mut config =
+            UpgradeConfig::new("rules", "Rules").with_extensions(vec!["go".to_string()]);
+        for rule in rules {
+            config.add_transform(rule);
+        }
+        config
+    }
+
+    fn rename(id: &str, from: &str, to: &str) -> TransformRule {
+        TransformRule::new(TransformSpec::RenameFunction {
+            old_name: from.to_string(),
+            new_name: to.to_string(),
+        })
+        .with_id(id)
+    }
+
+    #[test]
+    fn test_between() {
+        let old = pack(vec![
+            rename("fetch", "GetUser", "FetchUser"),
+            rename("same", "A", "B"),
+            rename("dropped", "Old", "New"),
+        ]);
+        let new = pack(vec![
+            rename("fetch", "GetUser", "LoadUser"),
+            rename("same", "A", "B"),
+            rename("added", "X", "Y"),
+        ]);
+
+        let diff = PackDiff::between(&old, &new);
+        let rendered: Vec<String> = diff.changes.iter().map(|c| c.to_string()).collect();
+        assert_eq!(
+            rendered,
+            vec![
+                "~ fetch\n    new_name: \"FetchUser\" -> \"LoadUser\"",
+                "+ added",
+                "- dropped",
+            ]
+        );
+        assert!(PackDiff::between(&old, &old).is_empty());
+    }
+
+    #[test]
+    fn test_impact() {
+        let dir = TempDir::new().unwrap();
+        fs::write(
+            dir.path().join("main.go"),
+            "u := GetUser(1)\nv := GetUser(2)\nX()\n",
+        )
+        .unwrap();
+
+        let old = pack(vec![rename("fetch", "GetUser", "FetchUser")]);
+        let new = pack(vec![
+            rename("fetch", "GetUser", "LoadUser"),
+            rename("added", "X", "Y").suggest_only(),
+        ]);
+
+        let diff = PackDiff::between(&old, &new);
+        let impact = diff.impact(&old, &new, dir.path()).unwrap();
+        assert_eq!(impact[0].to_string(), "fetch: 2 -> 2 site(s) in 1 file(s)");
+        assert_eq!(impact[1].to_string(), "added: 0 -> 0 site(s) in 0 file(s)");
+    }
+}
@@ -0,0 +1,114 @@
+//! Application order of several packs.
+
+use std::collections::BTreeSet;
+
+use crate::analyzer::UpgradeConfig;
+use crate::error::{RefactorError, Result};
+
+/// Order `packs` so that each pack comes after the packs it `requires`.
+///
+/// Packs without a requirement between them keep their given order.
+/// Requirements on packs that are not part of the run are taken as already
+/// applied. Circular requirements are an error naming the cycle, reported
+/// before anything is applied.
+pub fn application_order(packs: Vec<UpgradeConfig>) -> Result<Vec<UpgradeConfig>> {
+    let mut names = BTreeSet::new();
+    if let Some(duplicate) = packs.iter().find(|pack| !names.insert(pack.name.as_str())) {
+        return Err(RefactorError::InvalidConfig(format!(
+            "Pack '{}' is listed more than once",
+            duplicate.name
+        )));
+    }
+    let requires = |pack: &UpgradeConfig| -> Vec<usize> {
+        pack.requires
+            .iter()
+            .filter_map(|name| packs.iter().position(|p| p.name == *name))
+            .collect()
+    };
+
+    let mut order = Vec::with_capacity(packs.len());
+    let mut placed = vec![false; packs.len()];
+    while order.len() < packs.len() {
+        let next = (0..packs.len())
+            .find(|&i| !placed[i] && requires(&packs[i]).iter().all(|&r| placed[r]));
+        match next {
+            Some(i) => {
+                placed[i] = true;
+                order.push(i);
+            }
+            None => {
+                // Every unplaced pack waits on another unplaced pack, so
+                // following requirements from any of them runs into a cycle
+                let mut path = vec![placed.iter().position(|p| !p).unwrap()];
+                loop {
+                    let last = *path.last().unwrap();
+                    let required = requires(&packs[last])
+                        .into_iter()
+                        .find(|&r| !placed[r])
+                        .unwrap();
+                    if let Some(start) = path.iter().position(|&i| i == required) {
+                        let cycle: Vec<&str> = path[start..]
+                            .iter()
+                            .chain([&required])
+                            .map(|&i| packs[i].name.as_str())
+                            .collect();
+                        return Err(RefactorError::InvalidConfig(format!(
+                            "Circular pack requirements: {}",
+                            cycle.join(" -> ")
+                        )));
+                    }
+                    path.push(required);
+                }
+            }
+        }
+    }
+
+    let mut packs: Vec<Option<UpgradeConfig>> = packs.into_iter().map(Some).collect();
+    Ok(order.into_iter().filter_map(|i| packs[i].take()).collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn pack(name: &str, requires: &[&str]) -> UpgradeConfig {
+        let mut config = UpgradeConfig::new(name, name);
+        config.requires = requires.iter().map(|r| r.to_string()).collect();
+        config
+    }
+
+    fn names(packs: &[UpgradeConfig]) -> Vec<&str> {
+        packs.iter().map(|p| p.name.as_str()).collect()
+    }
+
+    #[test]
+    fn test_requirements_come_first() {
+        let ordered = application_order(vec![
+            pack("grpc-v2", &["proto-v2", "pool-v2"]),
+            pack("logging-v3", &[]),
+            pack("pool-v2", &["proto-v2"]),
+            pack("proto-v2", &["codec-v1"]),
+        ])
+        .unwrap();
+        assert_eq!(
+            names(&ordered),
+            ["logging-v3", "proto-v2", "pool-v2", "grpc-v2"]
+        );
+    }
+
+    #[test]
+    fn test_cycles_and_duplicates_are_errors() {
+        let err = application_order(vec![
+            pack("logging-v3", &[]),
+            pack("grpc-v2", &["pool-v2"]),
+            pack("pool-v2", &["proto-v2"]),
+            pack("proto-v2", &["grpc-v2"]),
+        ])
+        .unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Invalid configuration: Circular pack requirements: grpc-v2 -> pool-v2 -> proto-v2 -> grpc-v2"
+        );
+        assert!(application_order(vec![pack("a", &[]), pack("a", &[])]).is_err());
+    }
+}
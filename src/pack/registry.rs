@@ -0,0 +1,645 @@
+//! Packs fetched from URLs and OCI registries.
+//!
+//! Library authors publish the canonical migration pack of a release at a
+//! URL or as an OCI artifact (`oras push ghcr.io/acme/pool-rules:v2
+//! client-v2.yaml`), and consumers fetch it instead of copying it. A source
+//! is pinned to the content it was reviewed with by its SHA-256 checksum:
+//! `https://.../client-v2.yaml#sha256=<hex>` for a URL and
+//! `oci://ghcr.io/acme/pool-rules@sha256:<hex>` for an artifact. Content
+//! that does not match its pin is rejected, and so are unpinned sources and
+//! plain `http://` URLs: a pack decides what is written to the code it
+//! runs on. Fetched packs are cached by checksum, so a pinned pack is only
+//! downloaded once.
+//!
+//! Fetched packs must not declare plugins, which would run the publisher's
+//! commands on the consumer's machine.
+
+use regex::Regex;
+use reqwest::StatusCode;
+use reqwest::blocking::{Client, Response};
+use reqwest::header::{ACCEPT, WWW_AUTHENTICATE};
+use serde::Deserialize;
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use crate::analyzer::UpgradeConfig;
+use crate::error::{RefactorError, Result};
+
+const OCI_MANIFEST: &str = "application/vnd.oci.image.manifest.v1+json";
+const OCI_TITLE: &str = "org.opencontainers.image.title";
+
+static CHALLENGE_PARAM: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r#"(\w+)="([^"]*)""#).expect("invalid challenge regex"));
+
+/// Where a pack comes from.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum PackSource {
+    /// A local file.
+    File(PathBuf),
+    /// An HTTPS URL, optionally pinned to the SHA-256 of its content.
+    Url { url: String, sha256: Option<String> },
+    /// An artifact in an OCI registry.
+    Oci(OciReference),
+}
+
+impl PackSource {
+    /// Parse a local path, a URL (`https://host/pack.yaml#sha256=<hex>`) or
+    /// an OCI reference (`oci://registry/repository:tag` or
+    /// `oci://registry/repository@sha256:<hex>`).
+    pub fn parse(source: &str) -> Result<Self> {
+        if source.starts_with("oci://") {
+            return Ok(Self::Oci(OciReference::parse(source)?));
+        }
+        if source.starts_with("http://") {
+            return Err(invalid(format!(
+                "Refusing {}: packs are only fetched over https",
+                source
+            )));
+        }
+        if !source.starts_with("https://") {
+            return Ok(Self::File(PathBuf::from(source)));
+        }
+        let (url, sha256) = match source.split_once('#') {
+            Some((url, fragment)) => {
+                let pin = fragment.strip_prefix("sha256=").ok_or_else(|| {
+                    invalid(format!(
+                        "Unsupported pin '#{}' in {}: expected #sha256=<hex>",
+                        fragment, url
+                    ))
+                })?;
+                (url, Some(parse_sha256(pin, source)?))
+            }
+            None => (source, None),
+        };
+        Ok(Self::Url {
+            url: url.to_string(),
+            sha256,
+        })
+    }
+
+    /// Parse a source given as a path, such as a `--config` argument or a
+    /// `rule_files` entry.
+    pub fn from_path(path: &Path) -> Result<Self> {
+        match path.to_str() {
+            Some(source) => Self::parse(source),
+            None => Ok(Self::File(path.to_path_buf())),
+        }
+    }
+
+    /// Returns true for URLs and OCI artifacts.
+    pub fn is_remote(&self) -> bool {
+        !matches!(self, Self::File(_))
+    }
+
+    /// Returns true if the content is pinned by checksum. Local files are
+    /// taken as they are.
+    pub fn is_pinned(&self) -> bool {
+        match self {
+            Self::File(_) => true,
+            Self::Url { sha256, .. } => sha256.is_some(),
+            Self::Oci(reference) => reference.digest.is_some(),
+        }
+    }
+}
+
+impl fmt::Display for PackSource {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::File(path) => write!(f, "{}", path.display()),
+            Self::Url { url, sha256: None } => write!(f, "{}", url),
+            Self::Url {
+                url,
+                sha256: Some(sha256),
+            } => write!(f, "{}#sha256={}", url, sha256),
+            Self::Oci(reference) => write!(f, "{}", reference),
+        }
+    }
+}
+
+/// An artifact in an OCI registry.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct OciReference {
+    /// Registry host (`ghcr.io`).
+    pub registry: String,
+    /// Repository within the registry (`acme/pool-rules`).
+    pub repository: String,
+    /// Tag, when not pinned by digest.
+    pub tag: Option<String>,
+    /// Hex SHA-256 digest of the artifact's manifest.
+    pub digest: Option<String>,
+}
+
+impl OciReference {
+    /// Parse `oci://registry/repository:tag` or
+    /// `oci://registry/repository@sha256:<hex>`. The tag defaults to
+    /// `latest`.
+    pub fn parse(reference: &str) -> Result<Self> {
+        let rest = reference.strip_prefix("oci://").unwrap_or(reference);
+        let (registry, path) = rest
+            .split_once('/')
+            .filter(|(registry, path)| !registry.is_empty() && !path.is_empty())
+            .ok_or_else(|| {
+                invalid(format!(
+                    "Invalid OCI reference '{}': expected oci://registry/repository:tag",
+                    reference
+                ))
+            })?;
+        let (repository, tag, digest) = match path.split_once('@') {
+            Some((repository, digest)) => {
+                let digest = digest.strip_prefix("sha256:").ok_or_else(|| {
+                    invalid(format!(
+                        "Unsupported digest in '{}': expected @sha256:<hex>",
+                        reference
+                    ))
+                })?;
+                (repository, None, Some(parse_sha256(digest, reference)?))
+            }
+            None => match path.rsplit_once(':').filter(|(_, tag)| !tag.contains('/')) {
+                Some((repository, tag)) => (repository, Some(tag.to_string()), None),
+                None => (path, Some("latest".to_string()), None),
+            },
+        };
+        Ok(Self {
+            registry: registry.to_string(),
+            repository: repository.to_string(),
+            tag,
+            digest,
+        })
+    }
+
+    /// Base URL of the repository in the registry's HTTP API.
+    fn endpoint(&self) -> String {
+        let host = match self.registry.as_str() {
+            "docker.io" => "registry-1.docker.io",
+            host => host,
+        };
+        format!("https://{}/v2/{}", host, self.repository)
+    }
+
+    /// The digest or tag the manifest is fetched by.
+    fn manifest_ref(&self) -> String {
+        match (&self.digest, &self.tag) {
+            (Some(digest), _) => format!("sha256:{}", digest),
+            (None, Some(tag)) => tag.clone(),
+            (None, None) => "latest".to_string(),
+        }
+    }
+}
+
+impl fmt::Display for OciReference {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "oci://{}/{}", self.registry, self.repository)?;
+        match (&self.digest, &self.tag) {
+            (Some(digest), _) => write!(f, "@sha256:{}", digest),
+            (None, Some(tag)) => write!(f, ":{}", tag),
+            (None, None) => Ok(()),
+        }
+    }
+}
+
+/// A pack fetched into the local cache.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FetchedPack {
+    /// Local copy of the pack.
+    pub path: PathBuf,
+    /// The source pinned to the fetched content.
+    pub pinned_source: String,
+}
+
+/// Fetches packs from URLs and OCI registries into a local cache.
+#[derive(Debug, Clone)]
+pub struct PackRegistry {
+    cache_dir: PathBuf,
+}
+
+impl PackRegistry {
+    /// Create a registry caching packs in the user's cache directory.
+    pub fn new() -> Result<Self> {
+        let cache_dir = dirs::cache_dir()
+            .ok_or_else(|| invalid("Cannot determine cache directory".to_string()))?;
+        Ok(Self {
+            cache_dir: cache_dir.join("refactor-dsl/packs"),
+        })
+    }
+
+    /// Sets a custom cache directory.
+    pub fn cache_dir(mut self, path: impl Into<PathBuf>) -> Self {
+        self.cache_dir = path.into();
+        self
+    }
+
+    /// Fetch `source` unless its pinned content is cached. Local files are
+    /// used in place. An unpinned source is fetched, to give the pinned
+    /// form in the error, but refused.
+    pub fn fetch(&self, source: &PackSource) -> Result<FetchedPack> {
+        let fetched = match source {
+            PackSource::File(path) => {
+                return Ok(FetchedPack {
+                    path: path.clone(),
+                    pinned_source: source.to_string(),
+                });
+            }
+            PackSource::Url { url, sha256 } => self.fetch_url(url, sha256.as_deref())?,
+            PackSource::Oci(reference) => self.fetch_oci(reference)?,
+        };
+        if !source.is_pinned() {
+            return Err(invalid(format!(
+                "Refusing unpinned pack {}; review it and pin it as {}",
+                source, fetched.pinned_source
+            )));
+        }
+        Ok(fetched)
+    }
+
+    /// Fetch and load the pack at `source`, refusing it if it declares
+    /// plugins.
+    pub fn load(&self, source: &PackSource) -> Result<UpgradeConfig> {
+        let config = super::load(self.fetch(source)?.path)?;
+        if let Some(name) = config.plugins.keys().next() {
+            return Err(invalid(format!(
+                "Refusing {}: fetched packs cannot declare plugins (found '{}')",
+                source, name
+            )));
+        }
+        Ok(config)
+    }
+
+    fn fetch_url(&self, url: &str, pin: Option<&str>) -> Result<FetchedPack> {
+        let extension = pack_extension(url.split(['?', '#']).next().unwrap_or(url));
+        let path = match pin.and_then(|pin| self.cached(pin, extension)) {
+            Some(path) => path,
+            None => {
+                let bytes = read_body(reqwest::blocking::get(url)?, url)?;
+                self.store(&bytes, pin, url, extension)?
+            }
+        };
+        Ok(FetchedPack {
+            pinned_source: format!("{}#sha256={}", url, file_stem(&path)),
+            path,
+        })
+    }
+
+    fn fetch_oci(&self, reference: &OciReference) -> Result<FetchedPack> {
+        let client = Client::new();
+        let mut token = None;
+        let manifest_path = match reference
+            .digest
+            .as_deref()
+            .and_then(|digest| self.cached(digest, "manifest"))
+        {
+            Some(path) => path,
+            None => {
+                let path = format!("manifests/{}", reference.manifest_ref());
+                let bytes = oci_get(&client, reference, &path, Some(OCI_MANIFEST), &mut token)?;
+                self.store(
+                    &bytes,
+                    reference.digest.as_deref(),
+                    &reference.to_string(),
+                    "manifest",
+                )?
+            }
+        };
+        let manifest: OciManifest = serde_json::from_slice(&fs::read(&manifest_path)?)?;
+        let layer = manifest.pack_layer().ok_or_else(|| {
+            registry_error(format!(
+                "{} holds no pack: expected a single layer or one titled *.yaml, *.yml or *.json",
+                reference
+            ))
+        })?;
+        let blob_digest = layer.digest.strip_prefix("sha256:").ok_or_else(|| {
+            registry_error(format!(
+                "Unsupported layer digest {} in {}",
+                layer.digest, reference
+            ))
+        })?;
+        let extension = pack_extension(layer.title().unwrap_or_default());
+        let path = match self.cached(blob_digest, extension) {
+            Some(path) => path,
+            None => {
+                let path = format!("blobs/{}", layer.digest);
+                let bytes = oci_get(&client, reference, &path, None, &mut token)?;
+                self.store(&bytes, Some(blob_digest), &layer.digest, extension)?
+            }
+        };
+
+        let pinned = OciReference {
+            tag: None,
+            digest: Some(file_stem(&manifest_path)),
+            ..reference.clone()
+        };
+        Ok(FetchedPack {
+            path,
+            pinned_source: pinned.to_string(),
+        })
+    }
+
+    /// The cached file with checksum `sha256`, if it is intact.
+    fn cached(&self, sha256: &str, extension: &str) -> Option<PathBuf> {
+        let path = self.cache_dir.join(format!("{}.{}", sha256, extension));
+        let bytes = fs::read(&path).ok()?;
+        (checksum(&bytes) == sha256).then_some(path)
+    }
+
+    /// Cache `bytes` fetched from `source` under their checksum, after
+    /// checking them against `pin`.
+    fn store(
+        &self,
+        bytes: &[u8],
+        pin: Option<&str>,
+        source: &str,
+        extension: &str,
+    ) -> Result<PathBuf> {
+        let sha256 = checksum(bytes);
+        if let Some(pin) = pin
+            && pin != sha256
+        {
+            return Err(registry_error(format!(
+                "Checksum mismatch for {}: pinned sha256 {}, fetched {}",
+                source, pin, sha256
+            )));
+        }
+        fs::create_dir_all(&self.cache_dir)?;
+        let path = self.cache_dir.join(format!("{}.{}", sha256, extension));
+        fs::write(&path, bytes)?;
+        Ok(path)
+    }
+}
+
+/// Load the pack at `path`: a local file, or a URL or OCI reference
+/// fetched through the default [`PackRegistry`].
+pub fn load_source(path: impl AsRef<Path>) -> Result<UpgradeConfig> {
+    match PackSource::from_path(path.as_ref())? {
+        PackSource::File(path) => super::load(path),
+        source => PackRegistry::new()?.load(&source),
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct OciManifest {
+    #[serde(default)]
+    layers: Vec<OciDescriptor>,
+}
+
+impl OciManifest {
+    /// The layer holding the pack: the one titled as a pack file, or the
+    /// only layer.
+    fn pack_layer(&self) -> Option<&OciDescriptor> {
+        self.layers
+            .iter()
+            .find(|layer| layer.title().is_some_and(is_pack_file))
+            .or(match self.layers.as_slice() {
+                [layer] => Some(layer),
+                _ => None,
+            })
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct OciDescriptor {
+    digest: String,
+    #[serde(default)]
+    annotations: BTreeMap<String, String>,
+}
+
+impl OciDescriptor {
+    fn title(&self) -> Option<&str> {
+        self.annotations.get(OCI_TITLE).map(String::as_str)
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct TokenResponse {
+    token: Option<String>,
+    access_token: Option<String>,
+}
+
+/// GET `path` of the repository, fetching an anonymous pull token if the
+/// registry asks for one.
+fn oci_get(
+    client: &Client,
+    reference: &OciReference,
+    path: &str,
+    accept: Option<&str>,
+    token: &mut Option<String>,
+) -> Result<Vec<u8>> {
+    let url = format!("{}/{}", reference.endpoint(), path);
+    let send = |token: &Option<String>| {
+        let mut request = client.get(&url);
+        if let Some(accept) = accept {
+            request = request.header(ACCEPT, accept);
+        }
+        if let Some(token) = token {
+            request = request.bearer_auth(token);
+        }
+        request.send()
+    };
+    let mut response = send(token)?;
+    if response.status() == StatusCode::UNAUTHORIZED && token.is_none() {
+        let challenge = response
+            .headers()
+            .get(WWW_AUTHENTICATE)
+            .and_then(|value| value.to_str().ok())
+            .unwrap_or_default()
+            .to_string();
+        *token = Some(pull_token(client, &challenge, reference)?);
+        response = send(token)?;
+    }
+    read_body(response, &url)
+}
+
+/// Request an anonymous pull token as the registry's `Bearer` challenge
+/// directs.
+fn pull_token(client: &Client, challenge: &str, reference: &OciReference) -> Result<String> {
+    let params = parse_challenge(challenge);
+    let realm = params
+        .get("realm")
+        .ok_or_else(|| registry_error(format!("{} requires authentication", reference.registry)))?;
+    let scope = params
+        .get("scope")
+        .cloned()
+        .unwrap_or_else(|| format!("repository:{}:pull", reference.repository));
+    let mut url = format!("{}?scope={}", realm, urlencoding::encode(&scope));
+    if let Some(service) = params.get("service") {
+        url.push_str(&format!("&service={}", urlencoding::encode(service)));
+    }
+    let body = read_body(client.get(&url).send()?, realm)?;
+    let response: TokenResponse = serde_json::from_slice(&body)?;
+    response
+        .token
+        .or(response.access_token)
+        .ok_or_else(|| registry_error(format!("{} returned no token", reference.registry)))
+}
+
+/// Parameters of a `WWW-Authenticate: Bearer realm="...",service="..."`
+/// challenge.
+fn parse_challenge(challenge: &str) -> BTreeMap<String, String> {
+    CHALLENGE_PARAM
+        .captures_iter(challenge)
+        .map(|caps| (caps[1].to_string(), caps[2].to_string()))
+        .collect()
+}
+
+fn read_body(response: Response, url: &str) -> Result<Vec<u8>> {
+    if !response.status().is_success() {
+        return Err(registry_error(format!(
+            "Failed to fetch {} (status: {})",
+            url,
+            response.status()
+        )));
+    }
+    Ok(response.bytes()?.to_vec())
+}
+
+fn is_pack_file(name: &str) -> bool {
+    [".yaml", ".yml", ".json"]
+        .iter()
+        .any(|extension| name.ends_with(extension))
+}
+
+/// Extension a pack named `name` is cached with.
+fn pack_extension(name: &str) -> &'static str {
+    if name.ends_with(".json") {
+        "json"
+    } else {
+        "yaml"
+    }
+}
+
+fn file_stem(path: &Path) -> String {
+    path.file_stem()
+        .map(|stem| stem.to_string_lossy().into_owned())
+        .unwrap_or_default()
+}
+
+/// Lowercase hex SHA-256 of `bytes`.
+fn checksum(bytes: &[u8]) -> String {
+    Sha256::digest(bytes)
+        .iter()
+        .map(|byte| format!("{:02x}", byte))
+        .collect()
+}
+
+fn parse_sha256(value: &str, source: &str) -> Result<String> {
+    let value = value.to_ascii_lowercase();
+    if value.len() == 64 && value.bytes().all(|b| b.is_ascii_hexdigit()) {
+        Ok(value)
+    } else {
+        Err(invalid(format!(
+            "Invalid sha256 pin in {}: expected 64 hex digits",
+            source
+        )))
+    }
+}
+
+fn invalid(message: String) -> RefactorError {
+    RefactorError::InvalidConfig(message)
+}
+
+fn registry_error(message: String) -> RefactorError {
+    RefactorError::Registry { message }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    const PIN: &str = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad";
+
+    #[test]
+    fn test_parse_sources() {
+        assert_eq!(
+            PackSource::parse("rules/v2.yaml").unwrap(),
+            PackSource::File("rules/v2.yaml".into())
+        );
+
+        let url = format!("https://example.com/client-v2.yaml#sha256={}", PIN);
+        let source = PackSource::parse(&url).unwrap();
+        assert!(source.is_remote() && source.is_pinned());
+        assert_eq!(source.to_string(), url);
+        assert!(
+            !PackSource::parse("https://example.com/v2.yaml")
+                .unwrap()
+                .is_pinned()
+        );
+        assert!(PackSource::parse("https://example.com/v2.yaml#md5=abc").is_err());
+        assert!(PackSource::parse("http://example.com/v2.yaml").is_err());
+        assert!(PackSource::parse("https://example.com/v2.yaml#sha256=abc").is_err());
+
+        let tagged = OciReference::parse("oci://ghcr.io/acme/pool-rules:v2").unwrap();
+        assert_eq!(tagged.registry, "ghcr.io");
+        assert_eq!(tagged.repository, "acme/pool-rules");
+        assert_eq!(tagged.tag.as_deref(), Some("v2"));
+        assert_eq!(
+            OciReference::parse("oci://localhost:5000/rules")
+                .unwrap()
+                .to_string(),
+            "oci://localhost:5000/rules:latest"
+        );
+        let pinned = format!("oci://ghcr.io/acme/pool-rules@sha256:{}", PIN);
+        let source = PackSource::parse(&pinned).unwrap();
+        assert!(source.is_pinned());
+        assert_eq!(source.to_string(), pinned);
+        assert!(OciReference::parse("oci://ghcr.io").is_err());
+    }
+
+    #[test]
+    fn test_checksum_and_challenge() {
+        assert_eq!(checksum(b"abc"), PIN);
+
+        let params = parse_challenge(
+            r#"Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:acme/rules:pull""#,
+        );
+        assert_eq!(params["realm"], "https://ghcr.io/token");
+        assert_eq!(params["scope"], "repository:acme/rules:pull");
+    }
+
+    #[test]
+    fn test_pinned_pack_is_served_from_cache() {
+        let dir = TempDir::new().unwrap();
+        let content = serde_json::to_string(&UpgradeConfig::new("client-v2", "Client v2")).unwrap();
+        let sha256 = checksum(content.as_bytes());
+        fs::write(dir.path().join(format!("{}.yaml", sha256)), &content).unwrap();
+        let registry = PackRegistry::new().unwrap().cache_dir(dir.path());
+
+        let source = PackSource::parse(&format!(
+            "https://example.com/client-v2.yaml#sha256={}",
+            sha256
+        ))
+        .unwrap();
+        let fetched = registry.fetch(&source).unwrap();
+        assert_eq!(fetched.pinned_source, source.to_string());
+        assert_eq!(registry.load(&source).unwrap().name, "client-v2");
+
+        // Packs declaring plugins are refused.
+        let mut config: serde_json::Value = serde_json::from_str(&content).unwrap();
+        config["plugins"] = serde_json::json!({"run": {"command": ["sh"]}});
+        let with_plugins = config.to_string();
+        let plugins_sha256 = checksum(with_plugins.as_bytes());
+        fs::write(
+            dir.path().join(format!("{}.json", plugins_sha256)),
+            &with_plugins,
+        )
+        .unwrap();
+        let plugins = PackSource::parse(&format!(
+            "https://example.com/client-v2.json#sha256={}",
+            plugins_sha256
+        ))
+        .unwrap();
+        let refused = registry.load(&plugins).unwrap_err().to_string();
+        assert!(refused.contains("cannot declare plugins"));
+
+        // A cached copy that no longer matches its checksum is not used.
+        fs::write(dir.path().join(format!("{}.yaml", sha256)), "tampered").unwrap();
+        assert_eq!(registry.cached(&sha256, "yaml"), None);
+        assert!(
+            registry
+                .store(b"tampered", Some(&sha256), "client-v2.yaml", "yaml")
+                .is_err()
+        );
+    }
+}
@@ -0,0 +1,352 @@
+//! Packs shipped inside a library's module.
+//!
+//! A Go library ships the migration packs of its releases in the
+//! [`SHIPPED_PACK_DIR`] directory of its module, each declaring the release
+//! it migrates to (`to_version`). Upgrading a client to a new version of the
+//! library then needs no wiring: [`discover`] downloads that version with
+//! `go mod download`, and selects the packs for the releases between the
+//! version the client requires and the new one.
+//!
+//! A client vendoring its dependencies compiles against the copy in its
+//! vendor directory, so the version it is upgraded from is the vendored one.
+//! After the migration, [`ShippedPacks::require`] bumps the go.mod and
+//! re-vendors.
+//!
+//! Shipped packs come from a downloaded module, so they cannot declare
+//! plugins: a pack doing so is refused rather than run.
+
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use super::application_order;
+use crate::analyzer::{ModuleSource, UpgradeConfig, module_path};
+use crate::error::{RefactorError, Result};
+use crate::lang::GoVendor;
+use crate::security::compare_versions;
+
+/// Directory of a library module holding the packs the library ships.
+pub const SHIPPED_PACK_DIR: &str = "refactor-migrations";
+
+/// A dependency to upgrade: `example.com/mylib@v2`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ModuleUpgrade {
+    /// Module path, with the major version suffix of the target version
+    /// (`example.com/mylib/v2`).
+    pub module: String,
+    /// Target version or version query (`v2`, `v2.1.0`, `latest`).
+    pub version: String,
+}
+
+impl ModuleUpgrade {
+    /// Parse `module@version`. The major version suffix Go requires for
+    /// v2 and later is added to the module path if it is missing.
+    pub fn parse(spec: &str) -> Result<Self> {
+        let (module, version) = spec
+            .split_once('@')
+            .filter(|(module, version)| !module.is_empty() && !version.is_empty())
+            .ok_or_else(|| {
+                RefactorError::InvalidConfig(format!(
+                    "Invalid module '{}': expected module@version",
+                    spec
+                ))
+            })?;
+        Ok(Self {
+            module: module_path(module, version),
+            version: version.to_string(),
+        })
+    }
+}
+
+/// The packs a library version ships for a project.
+#[derive(Debug, Clone)]
+pub struct ShippedPacks {
+    /// Module path of the library.
+    pub module: String,
+    /// The version `go mod download` resolved.
+    pub version: String,
+    /// The version of the library the project requires, any major version:
+    /// the vendored version if the project vendors its dependencies.
+    pub current: Option<String>,
+    /// Packs for the releases after `current` up to `version`, in
+    /// application order.
+    pub packs: Vec<UpgradeConfig>,
+}
+
+impl ShippedPacks {
+    /// The selected packs as a single upgrade, or `None` if there are none.
+    pub fn upgrade_config(&self) -> Option<UpgradeConfig> {
+        let mut packs = self.packs.iter().cloned();
+        let mut config = packs.next()?;
+        for pack in packs {
+            config.merge(pack);
+        }
+        Some(config)
+    }
+
+    /// Require the resolved version in the go.mod of the project at `root`
+    /// (`go get`), then re-vendor its dependencies (`go mod vendor`) if it
+    /// vendors them. Returns the commands run.
+    pub fn require(&self, root: impl AsRef<Path>) -> Result<Vec<String>> {
+        let root = root.as_ref();
+        let mut commands = vec![vec![
+            "get".to_string(),
+            format!("{}@{}", self.module, self.version),
+        ]];
+        if GoVendor::discover(root).is_some() {
+            commands.push(vec!["mod".to_string(), "vendor".to_string()]);
+        }
+        let mut run = Vec::new();
+        for args in commands {
+            let command = format!("go {}", args.join(" "));
+            let output = Command::new("go")
+                .args(&args)
+                .current_dir(root)
+                .output()
+                .map_err(|e| RefactorError::Registry {
+                    message: format!("could not run {}: {}", command, e),
+                })?;
+            if !output.status.success() {
+                return Err(RefactorError::Registry {
+                    message: format!(
+                        "{} failed: {}",
+                        command,
+                        String::from_utf8_lossy(&output.stderr).trim()
+                    ),
+                });
+            }
+            run.push(command);
+        }
+        Ok(run)
+    }
+}
+
+/// Download `upgrade` into the module cache from the project at `root` and
+/// select the packs it ships for the project.
+pub fn discover(root: impl AsRef<Path>, upgrade: &ModuleUpgrade) -> Result<ShippedPacks> {
+    let root = root.as_ref();
+    let ModuleSource { version, dir, .. } =
+        ModuleSource::download_in(root, &upgrade.module, &upgrade.version)?;
+
+    let current = current_version(root, &upgrade.module);
+    let packs = shipped_packs(&dir)?
+        .into_iter()
+        .map(|mut pack| {
+            pack.module.get_or_insert_with(|| upgrade.module.clone());
+            pack
+        })
+        .collect();
+    Ok(ShippedPacks {
+        module: upgrade.module.clone(),
+        packs: select(packs, current.as_deref(), &version)?,
+        version,
+        current,
+    })
+}
+
+/// Load the packs in the [`SHIPPED_PACK_DIR`] of the module at `dir`, in
+/// file name order. A pack declaring plugins is an error.
+pub fn shipped_packs(dir: &Path) -> Result<Vec<UpgradeConfig>> {
+    let dir = dir.join(SHIPPED_PACK_DIR);
+    if !dir.is_dir() {
+        return Ok(Vec::new());
+    }
+    let mut files: Vec<PathBuf> = fs::read_dir(&dir)?
+        .filter_map(|entry| entry.ok().map(|entry| entry.path()))
+        .filter(|path| {
+            path.extension()
+                .is_some_and(|ext| ext == "yaml" || ext == "yml" || ext == "json")
+        })
+        .collect();
+    files.sort();
+    files
+        .iter()
+        .map(|file| {
+            let pack = super::load(file)?;
+            match pack.plugins.keys().next() {
+                Some(name) => Err(RefactorError::Registry {
+                    message: format!(
+                        "Refusing {}: shipped packs cannot declare plugins (found '{}')",
+                        file.display(),
+                        name
+                    ),
+                }),
+                None => Ok(pack),
+            }
+        })
+        .collect()
+}
+
+/// The packs migrating past `current` to at most `target`, oldest release
+/// first and after the packs they require. Packs without a `to_version`
+/// apply to every upgrade.
+fn select(
+    packs: Vec<UpgradeConfig>,
+    current: Option<&str>,
+    target: &str,
+) -> Result<Vec<UpgradeConfig>> {
+    let mut packs: Vec<UpgradeConfig> = packs
+        .into_iter()
+        .filter(|pack| match &pack.to_version {
+            Some(to) => {
+                current.is_none_or(|current| compare_versions(to, current).is_gt())
+                    && compare_versions(to, target).is_le()
+            }
+            None => true,
+        })
+        .collect();
+    packs.sort_by(|a, b| match (&a.to_version, &b.to_version) {
+        (Some(a), Some(b)) => compare_versions(a, b),
+        (a, b) => a.is_some().cmp(&b.is_some()),
+    });
+    application_order(packs)
+}
+
+/// The version of `module` (any major version) the project at `root`
+/// compiles against: the vendored one, or the one its go.mod requires.
+fn current_version(root: &Path, module: &str) -> Option<String> {
+    let base = base_path(module);
+    let vendored = GoVendor::discover(root).and_then(|vendor| {
+        vendor
+            .modules()
+            .find(|(path, _)| base_path(path) == base)
+            .map(|(_, version)| version.to_string())
+    });
+    vendored.or_else(|| {
+        fs::read_to_string(root.join("go.mod"))
+            .ok()
+            .and_then(|go_mod| required_version(&go_mod, module))
+    })
+}
+
+/// The version of `module` (any major version) the go.mod requires.
+fn required_version(go_mod: &str, module: &str) -> Option<String> {
+    let base = base_path(module);
+    let mut in_require = false;
+    for line in go_mod.lines() {
+        let line = line.split("//").next().unwrap_or_default().trim();
+        if line == "require (" {
+            in_require = true;
+            continue;
+        }
+        if line == ")" {
+            in_require = false;
+            continue;
+        }
+        let entry = match line.strip_prefix("require ") {
+            Some(entry) => entry,
+            None if in_require => line,
+            None => continue,
+        };
+        if let [path, version] = entry.split_whitespace().collect::<Vec<_>>()[..]
+            && base_path(path) == base
+        {
+            return Some(version.to_string());
+        }
+    }
+    None
+}
+
+/// `module` without its major version suffix.
+fn base_path(module: &str) -> &str {
+    match module.rsplit_once("/v") {
+        Some((base, major)) if !major.is_empty() && major.bytes().all(|b| b.is_ascii_digit()) => {
+            base
+        }
+        _ => module,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_module_upgrade() {
+        let upgrade = ModuleUpgrade::parse("example.com/mylib@v2").unwrap();
+        assert_eq!(upgrade.module, "example.com/mylib/v2");
+        assert_eq!(upgrade.version, "v2");
+        assert_eq!(
+            ModuleUpgrade::parse("example.com/mylib/v3@v3.1.0")
+                .unwrap()
+                .module,
+            "example.com/mylib/v3"
+        );
+        assert_eq!(
+            ModuleUpgrade::parse("example.com/mylib@v1.4.0")
+                .unwrap()
+                .module,
+            "example.com/mylib"
+        );
+        assert!(ModuleUpgrade::parse("example.com/mylib").is_err());
+    }
+
+    #[test]
+    fn test_required_version() {
+        let go_mod = "module example.com/app\n\nrequire (\n\texample.com/mylib v1.4.0 // indirect\n\tgolang.org/x/net v0.17.0\n)\n";
+        assert_eq!(
+            required_version(go_mod, "example.com/mylib/v2").as_deref(),
+            Some("v1.4.0")
+        );
+        assert_eq!(required_version(go_mod, "example.com/other"), None);
+
+        // A vendoring project compiles against the vendored version
+        let dir = tempfile::TempDir::new().unwrap();
+        fs::write(dir.path().join("go.mod"), go_mod).unwrap();
+        assert_eq!(
+            current_version(dir.path(), "example.com/mylib/v2").as_deref(),
+            Some("v1.4.0")
+        );
+        fs::create_dir_all(dir.path().join("vendor")).unwrap();
+        fs::write(
+            dir.path().join("vendor/modules.txt"),
+            "# example.com/mylib v1.3.2\n## explicit\nexample.com/mylib\n",
+        )
+        .unwrap();
+        assert_eq!(
+            current_version(dir.path(), "example.com/mylib/v2").as_deref(),
+            Some("v1.3.2")
+        );
+    }
+
+    #[test]
+    fn test_shipped_packs_for_upgrade() {
+        let dir = tempfile::TempDir::new().unwrap();
+        fs::create_dir_all(dir.path().join(SHIPPED_PACK_DIR)).unwrap();
+        for (file, to) in [
+            ("v2.0.yaml", "v2.0.0"),
+            ("v1.5.yaml", "v1.5.0"),
+            ("v2.2.yaml", "v2.2.0"),
+        ] {
+            let mut pack = UpgradeConfig::new(format!("mylib-{}", to), "");
+            pack.to_version = Some(to.to_string());
+            pack.to_yaml(dir.path().join(SHIPPED_PACK_DIR).join(file))
+                .unwrap();
+        }
+        fs::write(dir.path().join(SHIPPED_PACK_DIR).join("README.md"), "").unwrap();
+
+        let packs = shipped_packs(dir.path()).unwrap();
+        assert_eq!(packs.len(), 3);
+        let names: Vec<String> = select(packs, Some("v1.4.0"), "v2.1.3")
+            .unwrap()
+            .into_iter()
+            .map(|pack| pack.name)
+            .collect();
+        assert_eq!(names, ["mylib-v1.5.0", "mylib-v2.0.0"]);
+        assert!(
+            shipped_packs(&dir.path().join("missing"))
+                .unwrap()
+                .is_empty()
+        );
+
+        let mut pack = serde_json::to_value(UpgradeConfig::new("mylib-v2.1.0", "")).unwrap();
+        pack["plugins"] = serde_json::json!({"run": {"command": ["sh"]}});
+        fs::write(
+            dir.path().join(SHIPPED_PACK_DIR).join("v2.1.json"),
+            pack.to_string(),
+        )
+        .unwrap();
+        let refused = shipped_packs(dir.path()).unwrap_err().to_string();
+        assert!(refused.contains("cannot declare plugins"));
+    }
+}
@@ -0,0 +1,423 @@
+//! Custom matchers and rewriters for upgrade rules.
+//!
+//! Some migrations need project-specific logic that patterns cannot express.
+//! A rule can name a *matcher*, which decides whether each match of its
+//! pattern fires, and a *rewriter*, which computes the replacement text. Both
+//! receive a [`Match`] with the matched text, its captures and the rule's
+//! default replacement.
+//!
+//! Implementations are registered by name in a [`PluginRegistry`], either in
+//! Rust ([`SiteMatcher`], [`Rewriter`]) or as external processes declared in
+//! the config's `plugins` section. An external plugin is started on first
+//! use and kept running, with one process per thread that needs it at the
+//! same time; it reads one JSON request per line on stdin and writes one
+//! JSON response per line on stdout:
+//!
+//! ```text
+//! > {"kind":"match","plugin":"is-db-call","path":"main.go","text":"Open(cfg)","captures":{"1":"cfg"},"replacement":"Open(ctx, cfg)"}
+//! < {"matches":true}
+//! > {"kind":"rewrite","plugin":"order-args","path":"main.go","text":"Open(cfg)","captures":{"1":"cfg"},"replacement":"Open(ctx, cfg)"}
+//! < {"replacement":"Open(ctx, cfg.Clone())"}
+//! ```
+//!
+//! A `null` replacement leaves the match unchanged; `{"error": "..."}` fails
+//! the run.
+//!
+//! External plugins run commands named by the config, so a config from a
+//! cloned repository or a fetched pack could run anything. They are only
+//! started for configs whose plugins were explicitly allowed (see
+//! [`UpgradeConfig::allow_plugins`](crate::analyzer::UpgradeConfig::allow_plugins));
+//! otherwise rules using them fail to compile.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::plugin::{Match, Rewriter};
+//! use refactor::runner::UpgradeRunner;
+//!
+//! struct Uppercase;
+//!
+//! impl Rewriter for Uppercase {
+//!     fn rewrite(&self, m: &Match) -> refactor::error::Result<Option<String>> {
+//!         Ok(Some(m.text.to_uppercase()))
+//!     }
+//! }
+//!
+//! let config = UpgradeConfig::from_file("upgrade.yaml")?;
+//! let report = UpgradeRunner::new(config)
+//!     .with_rewriter("uppercase", Uppercase)
+//!     .run("./project")?;
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use serde_json::{Value, json};
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::fs;
+use std::io::{BufRead, BufReader, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Child, ChildStdin, ChildStdout, Command, Stdio};
+use std::sync::{Arc, Mutex};
+
+use crate::error::{RefactorError, Result};
+
+/// A match of a rule's pattern, as passed to plugins.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Match {
+    /// File containing the match.
+    pub path: PathBuf,
+    /// The matched text.
+    pub text: String,
+    /// Captures by name and by index (`"1"`, `"2"`, ...).
+    pub captures: BTreeMap<String, String>,
+    /// The rule's replacement, expanded for this match.
+    pub replacement: String,
+    /// Source of the whole file, for rewriters that depend on the rest of
+    /// it, such as the names its imports give packages. Not sent to
+    /// external plugins.
+    #[serde(skip)]
+    pub source: Arc<str>,
+    /// Byte offset of the match in `source`.
+    #[serde(skip)]
+    pub start: usize,
+    /// Contents of the files the run has rewritten in memory but not on
+    /// disk, by path, for rewriters that read other files.
+    #[serde(skip)]
+    pub overlay: Option<Arc<HashMap<PathBuf, String>>>,
+}
+
+impl Match {
+    /// The content of the file at `path` as the run sees it: from the
+    /// overlay if it has it, or else from disk.
+    pub fn read(&self, path: &Path) -> Option<String> {
+        match self.overlay.as_ref().and_then(|overlay| overlay.get(path)) {
+            Some(content) => Some(content.clone()),
+            None => fs::read_to_string(path).ok(),
+        }
+    }
+}
+
+/// Decides whether a match of a rule fires.
+pub trait SiteMatcher: Send + Sync {
+    /// Returns true if the rule should fire at `m`.
+    fn matches(&self, m: &Match) -> Result<bool>;
+}
+
+/// Computes the replacement for a match of a rule.
+pub trait Rewriter: Send + Sync {
+    /// The replacement text, or `None` to leave the match unchanged.
+    fn rewrite(&self, m: &Match) -> Result<Option<String>>;
+}
+
+/// An external plugin declared in an upgrade config.
+///
+/// # Example YAML
+///
+/// ```yaml
+/// plugins:
+///   order-args:
+///     command: ["python3", "tools/order_args.py"]
+/// transforms:
+///   - type: replace_pattern
+///     pattern: 'Open\(([^)]*)\)'
+///     replacement: 'Open(ctx, $1)'
+///     rewriter: order-args
+/// ```
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct PluginSpec {
+    /// Program and arguments to start.
+    pub command: Vec<String>,
+}
+
+/// Named matchers and rewriters that rules can refer to.
+#[derive(Clone, Default)]
+pub struct PluginRegistry {
+    matchers: BTreeMap<String, Arc<dyn SiteMatcher>>,
+    rewriters: BTreeMap<String, Arc<dyn Rewriter>>,
+    denied: BTreeSet<String>,
+}
+
+impl PluginRegistry {
+    /// Create an empty registry.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Create a registry of the external plugins declared in `plugins`.
+    /// Each is registered as both a matcher and a rewriter; processes are
+    /// only started when a rule uses them.
+    pub fn from_specs(plugins: &BTreeMap<String, PluginSpec>) -> Self {
+        plugins.iter().fold(Self::new(), |registry, (name, spec)| {
+            let plugin = Arc::new(ExternalPlugin::new(name, spec.command.clone()));
+            registry
+                .with_shared_matcher(name, plugin.clone())
+                .with_shared_rewriter(name, plugin)
+        })
+    }
+
+    /// Create a registry that refuses the external plugins declared in
+    /// `plugins`: rules naming them fail to compile, and no process is
+    /// started.
+    pub fn denying(plugins: &BTreeMap<String, PluginSpec>) -> Self {
+        Self {
+            denied: plugins.keys().cloned().collect(),
+            ..Self::default()
+        }
+    }
+
+    /// Register a matcher under `name`, replacing any of the same name.
+    pub fn with_matcher(
+        self,
+        name: impl Into<String>,
+        matcher: impl SiteMatcher + 'static,
+    ) -> Self {
+        self.with_shared_matcher(name, Arc::new(matcher))
+    }
+
+    /// Register a rewriter under `name`, replacing any of the same name.
+    pub fn with_rewriter(self, name: impl Into<String>, rewriter: impl Rewriter + 'static) -> Self {
+        self.with_shared_rewriter(name, Arc::new(rewriter))
+    }
+
+    fn with_shared_matcher(
+        mut self,
+        name: impl Into<String>,
+        matcher: Arc<dyn SiteMatcher>,
+    ) -> Self {
+        self.matchers.insert(name.into(), matcher);
+        self
+    }
+
+    fn with_shared_rewriter(
+        mut self,
+        name: impl Into<String>,
+        rewriter: Arc<dyn Rewriter>,
+    ) -> Self {
+        self.rewriters.insert(name.into(), rewriter);
+        self
+    }
+
+    /// Look up a matcher by name.
+    pub fn matcher(&self, name: &str) -> Result<Arc<dyn SiteMatcher>> {
+        match self.matchers.get(name) {
+            Some(matcher) => Ok(matcher.clone()),
+            None => Err(self.unknown("matcher", name)),
+        }
+    }
+
+    /// Look up a rewriter by name.
+    pub fn rewriter(&self, name: &str) -> Result<Arc<dyn Rewriter>> {
+        match self.rewriters.get(name) {
+            Some(rewriter) => Ok(rewriter.clone()),
+            None => Err(self.unknown("rewriter", name)),
+        }
+    }
+
+    fn unknown(&self, kind: &str, name: &str) -> RefactorError {
+        if self.denied.contains(name) {
+            RefactorError::InvalidConfig(format!(
+                "Plugin '{}' runs a command from the config and was not allowed (--allow-plugins)",
+                name
+            ))
+        } else {
+            RefactorError::InvalidConfig(format!("Unknown {} '{}'", kind, name))
+        }
+    }
+}
+
+/// A plugin running as child processes (see the module docs for the
+/// protocol).
+pub struct ExternalPlugin {
+    name: String,
+    command: Vec<String>,
+    /// Processes not serving a request right now.
+    idle: Mutex<Vec<Process>>,
+}
+
+struct Process {
+    child: Child,
+    stdin: ChildStdin,
+    stdout: BufReader<ChildStdout>,
+}
+
+impl ExternalPlugin {
+    /// Create a plugin that runs `command` when first used.
+    pub fn new(name: impl Into<String>, command: Vec<String>) -> Self {
+        Self {
+            name: name.into(),
+            command,
+            idle: Mutex::new(Vec::new()),
+        }
+    }
+
+    /// Send one request and wait for its response, on an idle process or a
+    /// new one if all are busy.
+    fn call(&self, kind: &str, m: &Match) -> Result<Value> {
+        let idle = self.idle.lock().unwrap_or_else(|e| e.into_inner()).pop();
+        let mut running = match idle {
+            Some(process) => process,
+            None => self.spawn()?,
+        };
+
+        let mut request = serde_json::to_value(m)?;
+        request["kind"] = json!(kind);
+        request["plugin"] = json!(self.name);
+        writeln!(running.stdin, "{}", request).map_err(|e| self.error(e))?;
+        running.stdin.flush().map_err(|e| self.error(e))?;
+
+        let mut line = String::new();
+        if running.stdout.read_line(&mut line)? == 0 {
+            // The process is gone; the next call starts another
+            stop(running);
+            return Err(self.error("exited without responding"));
+        }
+        self.idle
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .push(running);
+        let response: Value = serde_json::from_str(&line)
+            .map_err(|e| self.error(format!("invalid response: {}", e)))?;
+        if let Some(error) = response.get("error") {
+            return Err(self.error(error.as_str().unwrap_or_default()));
+        }
+        Ok(response)
+    }
+
+    fn spawn(&self) -> Result<Process> {
+        let (program, args) = self
+            .command
+            .split_first()
+            .ok_or_else(|| self.error("no command configured"))?;
+        let mut child = Command::new(program)
+            .args(args)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .spawn()
+            .map_err(|e| self.error(format!("failed to start: {}", e)))?;
+        let stdin = child.stdin.take().expect("stdin is piped");
+        let stdout = BufReader::new(child.stdout.take().expect("stdout is piped"));
+        Ok(Process {
+            child,
+            stdin,
+            stdout,
+        })
+    }
+
+    fn error(&self, message: impl std::fmt::Display) -> RefactorError {
+        RefactorError::TransformFailed {
+            message: format!("Plugin '{}': {}", self.name, message),
+        }
+    }
+}
+
+impl SiteMatcher for ExternalPlugin {
+    fn matches(&self, m: &Match) -> Result<bool> {
+        self.call("match", m)?["matches"]
+            .as_bool()
+            .ok_or_else(|| self.error("response has no boolean 'matches'"))
+    }
+}
+
+impl Rewriter for ExternalPlugin {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        match &self.call("rewrite", m)?["replacement"] {
+            Value::String(replacement) => Ok(Some(replacement.clone())),
+            Value::Null => Ok(None),
+            _ => Err(self.error("response 'replacement' is not a string or null")),
+        }
+    }
+}
+
+impl Drop for ExternalPlugin {
+    fn drop(&mut self) {
+        let idle = self.idle.get_mut().unwrap_or_else(|e| e.into_inner());
+        for process in idle.drain(..) {
+            stop(process);
+        }
+    }
+}
+
+/// Wait for a plugin process to exit; closing its stdin tells it to.
+fn stop(process: Process) {
+    let Process {
+        mut child, stdin, ..
+    } = process;
+    drop(stdin);
+    let _ = child.wait();
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn sample() -> Match {
+        Match {
+            path: PathBuf::from("main.go"),
+            text: "Open(cfg)".to_string(),
+            captures: BTreeMap::from([("1".to_string(), "cfg".to_string())]),
+            replacement: "Open(ctx, cfg)".to_string(),
+            source: Arc::from("Open(cfg)\n"),
+            start: 0,
+            overlay: None,
+        }
+    }
+
+    #[test]
+    fn test_registry_lookup() {
+        struct Never;
+        impl SiteMatcher for Never {
+            fn matches(&self, _: &Match) -> Result<bool> {
+                Ok(false)
+            }
+        }
+
+        let registry = PluginRegistry::new().with_matcher("never", Never);
+        assert!(
+            !registry
+                .matcher("never")
+                .unwrap()
+                .matches(&sample())
+                .unwrap()
+        );
+        assert!(registry.matcher("missing").is_err());
+        assert!(registry.rewriter("never").is_err());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_external_plugin() {
+        // Answers every request with a fixed response line
+        let script = r#"while read -r line; do
+            case "$line" in
+                *'"kind":"match"'*) echo '{"matches":true}' ;;
+                *) echo '{"replacement":"Open(ctx, cfg.Clone())"}' ;;
+            esac
+        done"#;
+        let specs = BTreeMap::from([(
+            "custom".to_string(),
+            PluginSpec {
+                command: vec!["sh".to_string(), "-c".to_string(), script.to_string()],
+            },
+        )]);
+        let registry = PluginRegistry::from_specs(&specs);
+
+        assert!(
+            registry
+                .matcher("custom")
+                .unwrap()
+                .matches(&sample())
+                .unwrap()
+        );
+        let rewriter = registry.rewriter("custom").unwrap();
+        for _ in 0..2 {
+            assert_eq!(
+                rewriter.rewrite(&sample()).unwrap().as_deref(),
+                Some("Open(ctx, cfg.Clone())")
+            );
+        }
+
+        let broken = ExternalPlugin::new("broken", vec!["true".to_string()]);
+        assert!(broken.rewrite(&sample()).is_err());
+    }
+}
@@ -0,0 +1,453 @@
+//! Previews of the identifiers a rename rule touches.
+//!
+//! A rename rule's scoping is easiest to tune by looking at every place the
+//! name occurs before anything is rewritten. A [`RenamePreview`] indexes the
+//! occurrences of a rule's old name across a project, classifies each from
+//! the syntax tree (call, type use, other use in code, comment or string)
+//! and marks the ones the rule would rewrite. Files that do not mention the
+//! name are not parsed, so the index is quick to rebuild after each change
+//! to the rule.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::{TransformRule, TransformSpec};
+//! use refactor::preview::RenamePreview;
+//!
+//! let rule = TransformRule::new(TransformSpec::RenameFunction {
+//!     old_name: "Dial".to_string(),
+//!     new_name: "Connect".to_string(),
+//! });
+//! let index = RenamePreview::new(rule, vec!["go".to_string()])?.index("./my-project")?;
+//! println!("{}", index);
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use tree_sitter::Node;
+
+use crate::analyzer::{TransformRule, TransformSpec, UpgradeConfig};
+use crate::codemod::Upgrade;
+use crate::error::{RefactorError, Result};
+use crate::lang::LanguageRegistry;
+use crate::transform::GuardedTransform;
+
+/// How an occurrence of a name is used.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum OccurrenceKind {
+    /// The name of a declared function, type, method or field.
+    Declaration,
+    /// The function or method called.
+    Call,
+    /// A use as a type.
+    TypeUse,
+    /// Any other use in code: references, composite literals, imports.
+    Literal,
+    /// Inside a comment.
+    Comment,
+    /// Inside a string literal.
+    String,
+}
+
+impl OccurrenceKind {
+    fn heading(self) -> &'static str {
+        match self {
+            OccurrenceKind::Declaration => "Declarations",
+            OccurrenceKind::Call => "Calls",
+            OccurrenceKind::TypeUse => "Type uses",
+            OccurrenceKind::Literal => "Literals and other references",
+            OccurrenceKind::Comment => "Comments",
+            OccurrenceKind::String => "Strings",
+        }
+    }
+}
+
+/// One occurrence of the old name.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Occurrence {
+    /// File, relative to the project root.
+    pub path: PathBuf,
+    /// 1-based line.
+    pub line: usize,
+    /// 1-based column.
+    pub column: usize,
+    /// How the name is used.
+    pub kind: OccurrenceKind,
+    /// Whether the rule rewrites this occurrence.
+    pub touched: bool,
+    /// The line containing the occurrence, trimmed.
+    pub context: String,
+}
+
+/// The occurrences of a name across a project.
+#[derive(Debug, Clone, Serialize)]
+pub struct PreviewIndex {
+    /// The name the rule renames.
+    pub name: String,
+    /// Occurrences by file and position.
+    pub occurrences: Vec<Occurrence>,
+}
+
+impl PreviewIndex {
+    /// Occurrences grouped by kind, in kind order.
+    pub fn by_kind(&self) -> BTreeMap<OccurrenceKind, Vec<&Occurrence>> {
+        let mut groups: BTreeMap<OccurrenceKind, Vec<&Occurrence>> = BTreeMap::new();
+        for occurrence in &self.occurrences {
+            groups.entry(occurrence.kind).or_default().push(occurrence);
+        }
+        groups
+    }
+
+    /// Number of occurrences the rule rewrites.
+    pub fn touched(&self) -> usize {
+        self.occurrences.iter().filter(|o| o.touched).count()
+    }
+
+    /// Number of files with occurrences.
+    pub fn files(&self) -> usize {
+        let mut paths: Vec<&Path> = self.occurrences.iter().map(|o| o.path.as_path()).collect();
+        paths.dedup();
+        paths.len()
+    }
+}
+
+impl fmt::Display for PreviewIndex {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "'{}': {} occurrence(s) in {} file(s), {} rewritten by the rule",
+            self.name,
+            self.occurrences.len(),
+            self.files(),
+            self.touched()
+        )?;
+        for (kind, occurrences) in self.by_kind() {
+            let touched = occurrences.iter().filter(|o| o.touched).count();
+            write!(
+                f,
+                "\n\n{} ({}, {} rewritten)",
+                kind.heading(),
+                occurrences.len(),
+                touched
+            )?;
+            for o in occurrences {
+                write!(
+                    f,
+                    "\n  {} {}:{}:{}: {}",
+                    if o.touched { "*" } else { " " },
+                    o.path.display(),
+                    o.line,
+                    o.column,
+                    o.context
+                )?;
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Indexes the occurrences of the name a rename rule renames.
+pub struct RenamePreview {
+    name: String,
+    pattern: Regex,
+    config: UpgradeConfig,
+    transform: GuardedTransform,
+    languages: LanguageRegistry,
+}
+
+impl RenamePreview {
+    /// Preview `rule` over files with `extensions` (every file when empty).
+    /// The rule must rename an identifier.
+    pub fn new(rule: TransformRule, extensions: Vec<String>) -> Result<Self> {
+        let name = old_name(&rule.spec)
+            .ok_or_else(|| {
+                RefactorError::InvalidConfig(format!(
+                    "Rule '{}' does not rename an identifier",
+                    rule.name()
+                ))
+            })?
+            .to_string();
+        let pattern = Regex::new(&format!(r"\b{}\b", regex::escape(&name)))?;
+        let transform = rule.to_transform()?;
+        let mut config =
+            UpgradeConfig::new("preview", "Rename preview").with_extensions(extensions);
+        config.add_transform(rule);
+        Ok(Self {
+            name,
+            pattern,
+            config,
+            transform,
+            languages: LanguageRegistry::new(),
+        })
+    }
+
+    /// Index the occurrences in the project at `root`. No file is written.
+    pub fn index(&self, root: impl AsRef<Path>) -> Result<PreviewIndex> {
+        let root = root.as_ref();
+        let mut files = self.config.to_upgrade().matcher().collect_files(root)?;
+        files.sort();
+
+        let mut occurrences = Vec::new();
+        for path in files {
+            let Ok(source) = fs::read_to_string(&path) else {
+                continue;
+            };
+            if !source.contains(&self.name) {
+                continue;
+            }
+            let rel = path.strip_prefix(root).unwrap_or(&path);
+            occurrences.extend(self.occurrences(rel, &source));
+        }
+        Ok(PreviewIndex {
+            name: self.name.clone(),
+            occurrences,
+        })
+    }
+
+    /// The occurrences in one file's `source`, in order. Files in a language
+    /// without a grammar count every occurrence as a literal.
+    pub fn occurrences(&self, path: &Path, source: &str) -> Vec<Occurrence> {
+        let sites = self.transform.sites(source, path);
+        let tree = self
+            .languages
+            .detect(path)
+            .and_then(|language| language.parse(source).ok());
+
+        self.pattern
+            .find_iter(source)
+            .map(|m| {
+                let kind = tree.as_ref().map_or(OccurrenceKind::Literal, |tree| {
+                    classify(tree.root_node(), m.start(), m.end())
+                });
+                let line_start = source[..m.start()].rfind('\n').map_or(0, |i| i + 1);
+                let line_end = source[m.end()..]
+                    .find('\n')
+                    .map_or(source.len(), |i| m.end() + i);
+                Occurrence {
+                    path: path.to_path_buf(),
+                    line: source[..m.start()].matches('\n').count() + 1,
+                    column: m.start() - line_start + 1,
+                    kind,
+                    touched: sites
+                        .iter()
+                        .any(|site| site.start < m.end() && m.start() < site.end),
+                    context: source[line_start..line_end].trim().to_string(),
+                }
+            })
+            .collect()
+    }
+}
+
+/// The identifier a rename spec renames.
+fn old_name(spec: &TransformSpec) -> Option<&str> {
+    let name = match spec {
+        TransformSpec::RenameFunction { old_name, .. }
+        | TransformSpec::RenameType { old_name, .. }
+        | TransformSpec::RenameClass { old_name, .. }
+        | TransformSpec::RenameExport { old_name, .. }
+        | TransformSpec::RenameSymbol { old_name, .. }
+        | TransformSpec::RenameMethod { old_name, .. }
+        | TransformSpec::RenameVariant { old_name, .. }
+        | TransformSpec::RenameGoType { old_name, .. } => old_name,
+        TransformSpec::ReplaceLiteral { from, .. } => from,
+        _ => return None,
+    };
+    // Qualified names (`pool.Dial`) are indexed by their last part
+    let name = name.rsplit(['.', ':']).next().unwrap_or(name);
+    (!name.is_empty() && name.chars().all(|c| c.is_alphanumeric() || c == '_')).then_some(name)
+}
+
+/// Parents whose last part is the name a call or type refers to.
+const QUALIFIERS: &[&str] = &[
+    "selector_expression",
+    "field_expression",
+    "member_expression",
+    "member_access_expression",
+    "scoped_identifier",
+    "scoped_type_identifier",
+    "qualified_type",
+    "qualified_name",
+    "attribute",
+    "generic_function",
+    "generic_type",
+    "scope_resolution",
+];
+
+/// Classify the occurrence at `start..end` from the syntax tree.
+fn classify(root: Node, start: usize, end: usize) -> OccurrenceKind {
+    let Some(node) = root.descendant_for_byte_range(start, end) else {
+        return OccurrenceKind::Literal;
+    };
+
+    // Comments and strings contain the name as text, unless it is in an
+    // interpolation (`f"{name}"`, `${name}`)
+    let mut ancestor = Some(node);
+    while let Some(n) = ancestor {
+        let kind = n.kind();
+        if kind.contains("interpolation") || kind.contains("substitution") {
+            break;
+        }
+        if kind.contains("comment") {
+            return OccurrenceKind::Comment;
+        }
+        if kind.contains("string") || kind.contains("char_literal") {
+            return OccurrenceKind::String;
+        }
+        ancestor = n.parent();
+    }
+
+    if let Some(parent) = node.parent()
+        && is_field(parent, node, &["name"])
+        && is_declaration(parent.kind())
+    {
+        return OccurrenceKind::Declaration;
+    }
+
+    let mut name = node;
+    while let Some(parent) = name.parent()
+        && QUALIFIERS.contains(&parent.kind())
+        && parent.end_byte() == name.end_byte()
+    {
+        name = parent;
+    }
+    if let Some(parent) = name.parent() {
+        let kind = parent.kind();
+        if (kind.contains("call") || kind.contains("invocation"))
+            && is_field(parent, name, &["function", "name", "method", "macro"])
+        {
+            return OccurrenceKind::Call;
+        }
+        if kind == "type" || kind.ends_with("_type") || kind.contains("type_annotation") {
+            return OccurrenceKind::TypeUse;
+        }
+    }
+    if node.kind().contains("type") {
+        return OccurrenceKind::TypeUse;
+    }
+    OccurrenceKind::Literal
+}
+
+/// Returns true if `child` is `parent`'s child in one of `fields`.
+fn is_field(parent: Node, child: Node, fields: &[&str]) -> bool {
+    fields
+        .iter()
+        .any(|field| parent.child_by_field_name(field) == Some(child))
+}
+
+fn is_declaration(kind: &str) -> bool {
+    ["declaration", "definition", "_item", "_spec", "declarator"]
+        .iter()
+        .any(|suffix| kind.contains(suffix))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_preview_groups_occurrences() {
+        let dir = TempDir::new().unwrap();
+        fs::write(
+            dir.path().join("pool.go"),
+            "package pool\n\n// Dial opens a connection.\nfunc Dial(addr string) *Conn {\n\treturn nil\n}\n",
+        )
+        .unwrap();
+        fs::write(
+            dir.path().join("main.go"),
+            "package main\n\nfunc main() {\n\tc := pool.Dial(\"Dial\")\n\tf := pool.Dial\n\t_ = c\n}\n",
+        )
+        .unwrap();
+        fs::write(dir.path().join("other.go"), "package main\n").unwrap();
+
+        let rule = TransformRule::new(TransformSpec::RenameFunction {
+            old_name: "Dial".to_string(),
+            new_name: "Connect".to_string(),
+        });
+        let index = RenamePreview::new(rule, vec!["go".to_string()])
+            .unwrap()
+            .index(dir.path())
+            .unwrap();
+        assert_eq!(index.files(), 2);
+
+        let kinds: Vec<(OccurrenceKind, bool)> = index
+            .occurrences
+            .iter()
+            .map(|o| (o.kind, o.touched))
+            .collect();
+        assert_eq!(
+            kinds,
+            [
+                (OccurrenceKind::Call, true),
+                (OccurrenceKind::String, false),
+                (OccurrenceKind::Literal, false),
+                (OccurrenceKind::Comment, false),
+                (OccurrenceKind::Declaration, true),
+            ]
+        );
+        let call = &index.occurrences[0];
+        assert_eq!(call.path, PathBuf::from("main.go"));
+        assert_eq!((call.line, call.column), (4, 12));
+        assert_eq!(call.context, "c := pool.Dial(\"Dial\")");
+        assert_eq!(index.touched(), 2);
+        assert!(
+            index
+                .to_string()
+                .contains("\n\nCalls (1, 1 rewritten)\n  * main.go:4:12: ")
+        );
+    }
+
+    #[test]
+    fn test_classify_type_uses() {
+        let rule = TransformRule::new(TransformSpec::RenameType {
+            old_name: "Pool".to_string(),
+            new_name: "Client".to_string(),
+        });
+        let preview = RenamePreview::new(rule, Vec::new()).unwrap();
+        let kinds = |path: &str, source: &str| -> Vec<OccurrenceKind> {
+            preview
+                .occurrences(Path::new(path), source)
+                .into_iter()
+                .map(|o| o.kind)
+                .collect()
+        };
+        assert_eq!(
+            kinds(
+                "main.go",
+                "package main\n\nvar p *pool.Pool = pool.Pool{}\n"
+            ),
+            [OccurrenceKind::TypeUse, OccurrenceKind::TypeUse]
+        );
+        assert_eq!(
+            kinds(
+                "lib.rs",
+                "struct Pool;\nfn get(p: &Pool) -> Pool {\n    p\n}\n"
+            ),
+            [
+                OccurrenceKind::Declaration,
+                OccurrenceKind::TypeUse,
+                OccurrenceKind::TypeUse
+            ]
+        );
+        assert_eq!(
+            kinds("app.py", "p = Pool()\nprint(f\"{Pool}\")\n"),
+            [OccurrenceKind::Call, OccurrenceKind::Literal]
+        );
+        assert!(
+            RenamePreview::new(
+                TransformRule::new(TransformSpec::ReplacePattern {
+                    pattern: "x".to_string(),
+                    replacement: "y".to_string(),
+                }),
+                Vec::new()
+            )
+            .is_err()
+        );
+    }
+}
@@ -0,0 +1,634 @@
+//! Project-level settings shared by CI and developers.
+//!
+//! A `.refactor-dsl.yaml` file at the root of a project (or any parent of the
+//! directory being processed) declares which rule files to run, which paths
+//! to include or exclude, the default output format, and rules to turn off,
+//! so every run uses the same settings without long command lines.
+//!
+//! ```yaml
+//! rule_files:
+//!   - migrations/client-v2.yaml
+//!   - https://example.com/pool/client-v2.yaml#sha256=<hex>
+//! include: ["services/**"]
+//! exclude: ["**/testdata/**"]
+//! output: json
+//! rules:
+//!   legacy-init: false
+//! ```
+//!
+//! A monorepo holding a library and its clients can declare `migrations`:
+//! scoped steps that `refactor migrate` applies as one change set, verified
+//! once (see [`Migration`]).
+//!
+//! ```yaml
+//! migrations:
+//!   - name: pool-library
+//!     rule_files: [libs/pool/migrations/v2-internal.yaml]
+//!     include: ["libs/pool/**"]
+//!   - name: pool-clients
+//!     rule_files: [libs/pool/migrations/client-v2.yaml]
+//!     exclude: ["libs/pool/**"]
+//! ```
+//!
+//! A client several releases behind declares `stages`, one per release, that
+//! `refactor migrate --stages` applies and verifies one after another (see
+//! [`Chain`]):
+//!
+//! ```yaml
+//! stages:
+//!   - name: v2
+//!     rule_files: [migrations/pool-v2.yaml]
+//!   - name: v3
+//!     rule_files: [migrations/pool-v3.yaml]
+//! ```
+//!
+//! A Go code base from before modules declares its source roots in `gopath`
+//! (relative to the config file), so it is analyzed, built and tested in
+//! GOPATH mode:
+//!
+//! ```yaml
+//! gopath: [".", "third_party"]
+//! ```
+//!
+//! A monorepo built with Bazel or Please names its Go packages driver in
+//! `packages_driver` (relative to the config file), so only the Go files
+//! the build system compiles are migrated, without a go.mod; `packages`
+//! narrows the package patterns loaded (default `./...`). The driver named
+//! by `GOPACKAGESDRIVER` is used if none is declared (see
+//! [`GoPackagesDriver`]). The driver is a program, so it only runs once
+//! allowed ([`ProjectConfig::allow_packages_driver`]):
+//!
+//! ```yaml
+//! packages_driver: tools/gopackagesdriver.sh
+//! packages: ["//services/..."]
+//! ```
+//!
+//! Example and tooling programs under `examples/`, `cmd/` and `tools/` are
+//! migrated with the project, and `--verify` builds the ones the root build
+//! skips (see
+//! [`AuxiliaryProgram`](crate::verify::AuxiliaryProgram)). Programs to leave alone are listed in
+//! `skip_programs`:
+//!
+//! ```yaml
+//! skip_programs: [tools/legacy-gen]
+//! ```
+//!
+//! The weights `refactor estimate` prices work with are set under
+//! `estimate` (see [`EffortWeights`]):
+//!
+//! ```yaml
+//! estimate:
+//!   manual_minutes: 20
+//!   fixed_hours: 8
+//! ```
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::project::ProjectConfig;
+//! use refactor::runner::UpgradeRunner;
+//!
+//! if let Some(project) = ProjectConfig::discover("./project")? {
+//!     let runner = project.configure(UpgradeRunner::new(project.upgrade_config()?));
+//!     let report = runner.dry_run().run("./project")?;
+//!     println!("{}", report.summary);
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::analyzer::UpgradeConfig;
+use crate::error::{RefactorError, Result};
+use crate::estimate::EffortWeights;
+use crate::lang::{GoPackagesDriver, GoPath};
+use crate::pack::{PackRegistry, PackSource, application_order};
+use crate::runner::{Chain, Migration, UpgradeRunner};
+
+/// File name of the project configuration.
+pub const PROJECT_CONFIG_FILE: &str = ".refactor-dsl.yaml";
+
+/// Default output format for reports.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum OutputFormat {
+    /// Human-readable text.
+    #[default]
+    Text,
+    /// Machine-readable JSON.
+    Json,
+}
+
+/// Settings from a `.refactor-dsl.yaml` file.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ProjectConfig {
+    /// Upgrade configuration files, relative to the project config, or
+    /// pinned URLs and OCI references of published packs.
+    #[serde(default)]
+    pub rule_files: Vec<PathBuf>,
+    /// Only process files matching these globs (relative to the project
+    /// config, wherever the run starts).
+    #[serde(default)]
+    pub include: Vec<String>,
+    /// Skip files matching these globs (relative to the project config).
+    #[serde(default)]
+    pub exclude: Vec<String>,
+    /// Default output format.
+    #[serde(default)]
+    pub output: OutputFormat,
+    /// Rules enabled (`true`) or disabled (`false`) by id.
+    #[serde(default)]
+    pub rules: BTreeMap<String, bool>,
+    /// Steps of a coordinated migration, in order.
+    #[serde(default)]
+    pub migrations: Vec<MigrationStepConfig>,
+    /// Stages of a migration through several releases, oldest first.
+    #[serde(default)]
+    pub stages: Vec<MigrationStepConfig>,
+    /// GOPATH entries of a pre-modules Go code base, relative to the
+    /// project config. Each holds packages under its `src/` directory.
+    #[serde(default)]
+    pub gopath: Vec<PathBuf>,
+    /// Go packages driver of a monorepo build system, relative to the
+    /// project config.
+    #[serde(default)]
+    pub packages_driver: Option<PathBuf>,
+    /// Package patterns the packages driver loads.
+    #[serde(default)]
+    pub packages: Vec<String>,
+    /// Example and tooling programs (under `examples/`, `cmd/` or
+    /// `tools/`) to leave out of migrations and their verification, by
+    /// directory relative to the project config.
+    #[serde(default)]
+    pub skip_programs: Vec<String>,
+    /// Weights of the `estimate` command.
+    #[serde(default)]
+    pub estimate: EffortWeights,
+    /// Directory containing the config file.
+    #[serde(skip)]
+    pub root: PathBuf,
+    /// Whether the packages driver may run.
+    #[serde(skip)]
+    driver_allowed: bool,
+}
+
+/// One step of a project's coordinated migration.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct MigrationStepConfig {
+    /// Name shown in reports.
+    pub name: String,
+    /// Upgrade configuration files, relative to the project config.
+    pub rule_files: Vec<PathBuf>,
+    /// Only process files matching these globs (relative to the project
+    /// config).
+    #[serde(default)]
+    pub include: Vec<String>,
+    /// Skip files matching these globs, in addition to the project's.
+    #[serde(default)]
+    pub exclude: Vec<String>,
+}
+
+impl ProjectConfig {
+    /// Load a project config file.
+    pub fn load(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref();
+        let mut config: Self = serde_yaml::from_str(&fs::read_to_string(path)?).map_err(|e| {
+            RefactorError::InvalidConfig(format!("Failed to parse {}: {}", path.display(), e))
+        })?;
+        config.root = path
+            .parent()
+            .filter(|p| !p.as_os_str().is_empty())
+            .map_or_else(|| PathBuf::from("."), Path::to_path_buf);
+        Ok(config)
+    }
+
+    /// Find and load the nearest [`PROJECT_CONFIG_FILE`] in `start` or one of
+    /// its parents.
+    pub fn discover(start: impl AsRef<Path>) -> Result<Option<Self>> {
+        let start = start.as_ref();
+        let start = start.canonicalize().unwrap_or_else(|_| start.to_path_buf());
+        for dir in start.ancestors() {
+            let candidate = dir.join(PROJECT_CONFIG_FILE);
+            if candidate.is_file() {
+                return Self::load(candidate).map(Some);
+            }
+        }
+        Ok(None)
+    }
+
+    /// Returns false if the rule with this id is disabled.
+    pub fn is_enabled(&self, rule: &str) -> bool {
+        self.rules.get(rule).copied().unwrap_or(true)
+    }
+
+    /// Load the rule files as a single upgrade, without disabled rules.
+    pub fn upgrade_config(&self) -> Result<UpgradeConfig> {
+        self.load_rule_files(&self.rule_files, PROJECT_CONFIG_FILE)
+    }
+
+    /// Load each rule file as its own pack, without disabled rules.
+    pub fn packs(&self) -> Result<Vec<UpgradeConfig>> {
+        self.rule_files
+            .iter()
+            .map(|file| Ok(self.filter_rules(self.load_rule_file(file)?)))
+            .collect()
+    }
+
+    /// Build the coordinated migration declared in `migrations`. Each step
+    /// runs its own rule files on its own globs; the project's exclude
+    /// globs and disabled rules apply to every step.
+    pub fn migration(&self) -> Result<Migration> {
+        if self.migrations.is_empty() {
+            return Err(RefactorError::InvalidConfig(format!(
+                "{} declares no migrations",
+                PROJECT_CONFIG_FILE
+            )));
+        }
+        self.migrations
+            .iter()
+            .try_fold(Migration::new(), |migration, step| {
+                let runner = self.step_runner(step, &format!("Migration step '{}'", step.name))?;
+                Ok(migration.step(&step.name, runner))
+            })
+    }
+
+    /// Build the multi-version migration declared in `stages`. Each stage
+    /// runs its own rule files, after the stages before it.
+    pub fn chain(&self) -> Result<Chain> {
+        if self.stages.is_empty() {
+            return Err(RefactorError::InvalidConfig(format!(
+                "{} declares no stages",
+                PROJECT_CONFIG_FILE
+            )));
+        }
+        self.stages.iter().try_fold(Chain::new(), |chain, stage| {
+            let runner = self.step_runner(stage, &format!("Stage '{}'", stage.name))?;
+            Ok(chain.stage(&stage.name, runner))
+        })
+    }
+
+    /// A runner for one migration step or stage, scoped to its globs and
+    /// the project's.
+    fn step_runner(&self, step: &MigrationStepConfig, owner: &str) -> Result<UpgradeRunner> {
+        let config = self.load_rule_files(&step.rule_files, owner)?;
+        let runner = step
+            .include
+            .iter()
+            .fold(UpgradeRunner::new(config), |runner, glob| {
+                runner.include_in(&self.root, glob)
+            });
+        let runner = self.build(runner);
+        Ok(self
+            .excludes()
+            .chain(step.exclude.iter().cloned())
+            .fold(runner, |runner, glob| runner.exclude_in(&self.root, glob)))
+    }
+
+    /// Load `rule_files` as a single upgrade, without disabled rules. The
+    /// files' rules run in [`application_order`].
+    fn load_rule_files(&self, rule_files: &[PathBuf], owner: &str) -> Result<UpgradeConfig> {
+        let packs = rule_files
+            .iter()
+            .map(|file| self.load_rule_file(file))
+            .collect::<Result<Vec<_>>>()?;
+        let mut packs = application_order(packs)?.into_iter();
+        let mut config = packs.next().ok_or_else(|| {
+            RefactorError::InvalidConfig(format!("{} lists no rule_files", owner))
+        })?;
+
+        for other in packs {
+            config.merge(other);
+        }
+        Ok(self.filter_rules(config))
+    }
+
+    /// Load one rule file. Packs fetched from a URL or registry must be
+    /// pinned by checksum, so every run of the project uses the same rules.
+    fn load_rule_file(&self, file: &Path) -> Result<UpgradeConfig> {
+        match PackSource::from_path(file)? {
+            PackSource::File(path) => UpgradeConfig::from_file(self.root.join(path)),
+            source if !source.is_pinned() => Err(RefactorError::InvalidConfig(format!(
+                "rule_files entry {} is not pinned; add its sha256 checksum",
+                source
+            ))),
+            source => PackRegistry::new()?.load(&source),
+        }
+    }
+
+    /// Remove disabled rules from `config`.
+    pub fn filter_rules(&self, mut config: UpgradeConfig) -> UpgradeConfig {
+        config
+            .transforms
+            .retain(|rule| self.is_enabled(&rule.name()));
+        config
+    }
+
+    /// The GOPATH declared in `gopath`, if the project uses GOPATH mode.
+    pub fn go_path(&self) -> Option<GoPath> {
+        if self.gopath.is_empty() {
+            return None;
+        }
+        Some(GoPath::new(
+            self.gopath.iter().map(|entry| self.root.join(entry)),
+        ))
+    }
+
+    /// Let runners configured by this project run its packages driver.
+    /// Off by default: the driver is a program named by the repository or
+    /// the environment.
+    pub fn allow_packages_driver(mut self, allowed: bool) -> Self {
+        self.driver_allowed = allowed;
+        self
+    }
+
+    /// The packages driver declared in `packages_driver`, or else the one
+    /// named by `GOPACKAGESDRIVER`, if it is allowed to run.
+    pub fn packages_driver(&self) -> Option<GoPackagesDriver> {
+        if !self.driver_allowed {
+            return None;
+        }
+        match &self.packages_driver {
+            Some(program) => Some(GoPackagesDriver::new(self.root.join(program))),
+            None => GoPackagesDriver::from_env(),
+        }
+    }
+
+    /// Apply the GOPATH and the packages driver to a runner.
+    fn build(&self, runner: UpgradeRunner) -> UpgradeRunner {
+        let runner = match self.go_path() {
+            Some(gopath) => runner.gopath(gopath),
+            None => runner,
+        };
+        match self.packages_driver() {
+            Some(driver) => runner.packages_driver(driver, self.packages.iter()),
+            None => runner,
+        }
+    }
+
+    /// Apply the include and exclude globs, anchored at the config's
+    /// directory, the GOPATH and the packages driver to a runner.
+    pub fn configure(&self, runner: UpgradeRunner) -> UpgradeRunner {
+        let runner = self
+            .include
+            .iter()
+            .fold(runner, |runner, glob| runner.include_in(&self.root, glob));
+        let runner = self.build(runner);
+        self.excludes()
+            .fold(runner, |runner, glob| runner.exclude_in(&self.root, glob))
+    }
+
+    /// The exclude globs, with the skipped programs' directories.
+    fn excludes(&self) -> impl Iterator<Item = String> + '_ {
+        self.exclude.iter().cloned().chain(
+            self.skip_programs
+                .iter()
+                .map(|dir| format!("{}/**", dir.trim_end_matches('/'))),
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformRule, TransformSpec};
+
+    #[test]
+    fn test_discover_and_merge_rule_files() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let rules = dir.path().join("rules");
+        fs::create_dir_all(&rules).unwrap();
+        fs::create_dir_all(dir.path().join("services/api")).unwrap();
+
+        for (name, id) in [("a", "rename-a"), ("b", "rename-b")] {
+            let mut config = UpgradeConfig::new(name, name).with_extensions(vec![name.to_string()]);
+            config.add_transform(
+                TransformRule::new(TransformSpec::ReplaceLiteral {
+                    from: "x".to_string(),
+                    to: "y".to_string(),
+                })
+                .with_id(id),
+            );
+            config
+                .to_yaml(rules.join(format!("{}.yaml", name)))
+                .unwrap();
+        }
+        fs::write(
+            dir.path().join(PROJECT_CONFIG_FILE),
+            "rule_files: [rules/a.yaml, rules/b.yaml]\noutput: json\nrules:\n  rename-b: false\n",
+        )
+        .unwrap();
+
+        let project = ProjectConfig::discover(dir.path().join("services/api"))
+            .unwrap()
+            .unwrap();
+        assert_eq!(project.output, OutputFormat::Json);
+
+        let config = project.upgrade_config().unwrap();
+        assert_eq!(config.name, "a+b");
+        assert_eq!(config.extensions, vec!["a", "b"]);
+        let ids: Vec<String> = config.transforms.iter().map(|r| r.name()).collect();
+        assert_eq!(ids, vec!["rename-a"]);
+    }
+
+    #[test]
+    fn test_remote_rule_files_must_be_pinned() {
+        let project = ProjectConfig {
+            rule_files: vec!["https://example.com/pool/client-v2.yaml".into()],
+            ..Default::default()
+        };
+        let err = project.upgrade_config().unwrap_err();
+        assert!(err.to_string().contains("is not pinned"));
+    }
+
+    #[test]
+    fn test_rule_files_in_requirement_order() {
+        let dir = tempfile::TempDir::new().unwrap();
+        for (name, requires) in [("grpc-v2", Some("proto-v2")), ("proto-v2", None)] {
+            let mut config = UpgradeConfig::new(name, name);
+            if let Some(required) = requires {
+                config = config.requires(required);
+            }
+            config.add_transform(TransformSpec::ReplaceLiteral {
+                from: name.to_string(),
+                to: "x".to_string(),
+            });
+            config
+                .to_yaml(dir.path().join(format!("{}.yaml", name)))
+                .unwrap();
+        }
+        fs::write(
+            dir.path().join(PROJECT_CONFIG_FILE),
+            r#"{"rule_files": ["grpc-v2.yaml", "proto-v2.yaml"]}"#,
+        )
+        .unwrap();
+
+        let project = ProjectConfig::discover(dir.path()).unwrap().unwrap();
+        assert_eq!(project.upgrade_config().unwrap().name, "proto-v2+grpc-v2");
+    }
+
+    #[test]
+    fn test_migration_steps() {
+        let dir = tempfile::TempDir::new().unwrap();
+        for name in ["lib", "app"] {
+            fs::create_dir_all(dir.path().join(name)).unwrap();
+            fs::write(dir.path().join(name).join("main.go"), "x\n").unwrap();
+            let mut config = UpgradeConfig::new(name, name).with_extensions(vec!["go".to_string()]);
+            config.add_transform(TransformSpec::ReplaceLiteral {
+                from: "x".to_string(),
+                to: name.to_string(),
+            });
+            config
+                .to_yaml(dir.path().join(format!("{}.yaml", name)))
+                .unwrap();
+        }
+        fs::write(
+            dir.path().join(PROJECT_CONFIG_FILE),
+            r#"{"migrations": [
+                {"name": "library", "rule_files": ["lib.yaml"], "include": ["lib/**"]},
+                {"name": "clients", "rule_files": ["app.yaml"], "exclude": ["lib/**"]}
+            ]}"#,
+        )
+        .unwrap();
+
+        let project = ProjectConfig::discover(dir.path()).unwrap().unwrap();
+        let plan = project.migration().unwrap().plan(dir.path()).unwrap();
+        let names: Vec<&str> = plan.steps.iter().map(|s| s.name.as_str()).collect();
+        assert_eq!(names, vec!["library", "clients"]);
+        let outputs: Vec<&str> = plan
+            .report
+            .changes
+            .iter()
+            .map(|c| c.transformed.as_str())
+            .collect();
+        assert_eq!(outputs, vec!["app\n", "lib\n"]);
+
+        assert!(ProjectConfig::default().migration().is_err());
+        assert!(ProjectConfig::default().chain().is_err());
+    }
+
+    #[test]
+    fn test_gopath_project() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let service = dir.path().join("src/acme/billing");
+        fs::create_dir_all(dir.path().join("src/acme/pool")).unwrap();
+        fs::create_dir_all(&service).unwrap();
+        fs::write(
+            service.join("main.go"),
+            "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(dial()) }\n",
+        )
+        .unwrap();
+        fs::write(dir.path().join(PROJECT_CONFIG_FILE), r#"{"gopath": ["."]}"#).unwrap();
+
+        let project = ProjectConfig::discover(&service).unwrap().unwrap();
+        let gopath = project.go_path().unwrap();
+        assert_eq!(
+            gopath.import_path(&service).as_deref(),
+            Some("acme/billing")
+        );
+
+        let mut config = UpgradeConfig::new("pool", "pool").with_extensions(vec!["go".to_string()]);
+        config.add_transform(
+            TransformRule::new(TransformSpec::ReplaceLiteral {
+                from: "dial()".to_string(),
+                to: "pool.Dial()".to_string(),
+            })
+            .with_import("acme/pool"),
+        );
+        let report = project
+            .configure(UpgradeRunner::new(config).dry_run())
+            .run(&service)
+            .unwrap();
+        assert!(
+            report.changes[0]
+                .transformed
+                .contains("import (\n\t\"fmt\"\n\n\t\"acme/pool\"\n)\n")
+        );
+        assert!(ProjectConfig::default().go_path().is_none());
+
+        // The packages driver only runs once allowed.
+        let monorepo: ProjectConfig =
+            serde_json::from_str(r#"{"packages_driver": "tools/driver.sh"}"#).unwrap();
+        assert!(monorepo.packages_driver().is_none());
+        assert!(
+            monorepo
+                .allow_packages_driver(true)
+                .packages_driver()
+                .is_some()
+        );
+    }
+
+    #[test]
+    fn test_skip_programs() {
+        let dir = tempfile::TempDir::new().unwrap();
+        for program in ["cmd/poolctl", "tools/gen"] {
+            fs::create_dir_all(dir.path().join(program)).unwrap();
+            fs::write(
+                dir.path().join(program).join("main.go"),
+                "package main\n\nvar c = dial()\n",
+            )
+            .unwrap();
+        }
+        let project = ProjectConfig {
+            skip_programs: vec!["tools/gen/".to_string()],
+            root: dir.path().to_path_buf(),
+            ..Default::default()
+        };
+
+        let mut config = UpgradeConfig::new("pool", "pool").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "dial()".to_string(),
+            to: "pool.Dial()".to_string(),
+        });
+        let report = project
+            .configure(UpgradeRunner::new(config).dry_run())
+            .run(dir.path())
+            .unwrap();
+        assert_eq!(report.changes.len(), 1);
+        assert!(report.changes[0].path.ends_with("cmd/poolctl/main.go"));
+    }
+
+    #[test]
+    fn test_globs_are_relative_to_the_config() {
+        let dir = tempfile::TempDir::new().unwrap();
+        for service in ["api", "web"] {
+            let path = dir.path().join("services").join(service);
+            fs::create_dir_all(path.join("testdata")).unwrap();
+            fs::write(path.join("main.go"), "dial()\n").unwrap();
+            fs::write(path.join("testdata/x.go"), "dial()\n").unwrap();
+        }
+        fs::write(
+            dir.path().join(PROJECT_CONFIG_FILE),
+            r#"{"include": ["services/api/**"], "exclude": ["services/api/testdata/**"]}"#,
+        )
+        .unwrap();
+
+        let mut config = UpgradeConfig::new("pool", "pool").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "dial()".to_string(),
+            to: "pool.Dial()".to_string(),
+        });
+        let api = dir.path().join("services/api");
+        let project = ProjectConfig::discover(&api).unwrap().unwrap();
+        for start in [dir.path(), api.as_path()] {
+            let report = project
+                .configure(UpgradeRunner::new(config.clone()).dry_run())
+                .run(start)
+                .unwrap();
+            let changed: Vec<_> = report.changes.iter().map(|c| c.path.clone()).collect();
+            assert_eq!(changed, [api.join("main.go")], "run at {}", start.display());
+        }
+    }
+
+    #[test]
+    fn test_unknown_keys_are_rejected() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join(PROJECT_CONFIG_FILE);
+        fs::write(&path, "rule_file: [a.yaml]\n").unwrap();
+        assert!(ProjectConfig::load(&path).is_err());
+    }
+}
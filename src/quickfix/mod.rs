@@ -0,0 +1,234 @@
+//! A line-based quick-fix protocol for editors without LSP support.
+//!
+//! An editor plugin starts `refactor quickfix --config <FILE>` and writes one
+//! JSON request per line to its stdin, naming a file and a byte offset
+//! (optionally with the unsaved buffer contents). For each request one JSON
+//! line is written to stdout listing the fixes the upgrade rules offer at that
+//! offset, as plain byte-range text edits:
+//!
+//! ```text
+//! > {"file": "main.go", "offset": 42}
+//! < {"fixes":[{"rule":"rename-get-user","title":"Rename function 'GetUser' to 'FetchUser'","edits":[{"start":38,"end":46,"text":"FetchUser(","line":3,"column":7}]}]}
+//! ```
+//!
+//! Malformed requests get `{"error": "..."}` and the session continues.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::quickfix::QuickFixer;
+//!
+//! let fixer = QuickFixer::new(UpgradeConfig::from_file("upgrade.yaml")?)?;
+//! let source = "user := GetUser(id)\n";
+//! for fix in fixer.fixes("main.go".as_ref(), source, 10) {
+//!     println!("{}: {}", fix.rule, fix.title);
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io::{BufRead, Write};
+use std::path::{Path, PathBuf};
+
+use crate::analyzer::{TransformRule, UpgradeConfig};
+use crate::error::Result;
+use crate::transform::GuardedTransform;
+
+/// A request for the fixes available at a position.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+pub struct FixRequest {
+    /// Path of the file being edited.
+    pub file: PathBuf,
+    /// Byte offset of the cursor.
+    pub offset: usize,
+    /// Current buffer contents; read from `file` when omitted.
+    #[serde(default)]
+    pub content: Option<String>,
+}
+
+/// A text edit in byte offsets of the requested source.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct FixEdit {
+    /// Start byte offset (inclusive).
+    pub start: usize,
+    /// End byte offset (exclusive).
+    pub end: usize,
+    /// Replacement text.
+    pub text: String,
+    /// 1-based line of `start`.
+    pub line: usize,
+    /// 1-based column of `start`.
+    pub column: usize,
+}
+
+/// A fix offered by one rule.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct QuickFix {
+    /// Rule that offers the fix.
+    pub rule: String,
+    /// Short description for the editor's menu.
+    pub title: String,
+    /// Edits that apply the fix.
+    pub edits: Vec<FixEdit>,
+}
+
+/// A reply to one request.
+#[derive(Debug, Serialize)]
+#[serde(untagged)]
+enum FixResponse {
+    Fixes { fixes: Vec<QuickFix> },
+    Error { error: String },
+}
+
+/// Computes quick fixes from the rules of an upgrade configuration.
+pub struct QuickFixer {
+    rules: Vec<(TransformRule, GuardedTransform)>,
+    extensions: Vec<String>,
+}
+
+impl QuickFixer {
+    /// Compile the rules of `config`. Both apply and suggest rules offer fixes.
+    pub fn new(config: UpgradeConfig) -> Result<Self> {
+        let plugins = config.plugin_registry();
+        let rules = config
+            .transforms
+            .into_iter()
+            .map(|rule| {
+                let transform = rule.to_transform_with(&plugins)?;
+                Ok((rule, transform))
+            })
+            .collect::<Result<_>>()?;
+        Ok(Self {
+            rules,
+            extensions: config.extensions,
+        })
+    }
+
+    /// Fixes whose match covers `offset` in `source`.
+    pub fn fixes(&self, path: &Path, source: &str, offset: usize) -> Vec<QuickFix> {
+        self.all_fixes(path, source)
+            .into_iter()
+            .filter(|fix| {
+                fix.edits
+                    .iter()
+                    .any(|edit| edit.start <= offset && offset <= edit.end)
+            })
+            .collect()
+    }
+
+    /// Every fix the rules offer in `source`, in rule order.
+    pub fn all_fixes(&self, path: &Path, source: &str) -> Vec<QuickFix> {
+        let ext = path.extension().and_then(|e| e.to_str()).unwrap_or("");
+        if !self.extensions.is_empty()
+            && !self.extensions.iter().any(|e| e.eq_ignore_ascii_case(ext))
+        {
+            return Vec::new();
+        }
+
+        let mut fixes = Vec::new();
+        for (rule, transform) in &self.rules {
+            for site in transform.sites(source, path) {
+                let (line, column) = site.position(source);
+                fixes.push(QuickFix {
+                    rule: rule.name(),
+                    title: rule.message.clone().unwrap_or_else(|| rule.spec.describe()),
+                    edits: vec![FixEdit {
+                        start: site.start,
+                        end: site.end,
+                        text: site.replacement,
+                        line,
+                        column,
+                    }],
+                });
+            }
+        }
+        fixes
+    }
+
+    /// Answer one JSON request per input line until `input` is exhausted.
+    pub fn serve(&self, input: impl BufRead, mut output: impl Write) -> Result<()> {
+        for line in input.lines() {
+            let line = line?;
+            if line.trim().is_empty() {
+                continue;
+            }
+            let response = match self.handle(&line) {
+                Ok(fixes) => FixResponse::Fixes { fixes },
+                Err(error) => FixResponse::Error {
+                    error: error.to_string(),
+                },
+            };
+            writeln!(output, "{}", serde_json::to_string(&response)?)?;
+            output.flush()?;
+        }
+        Ok(())
+    }
+
+    fn handle(&self, line: &str) -> Result<Vec<QuickFix>> {
+        let request: FixRequest = serde_json::from_str(line)?;
+        let source = match request.content {
+            Some(content) => content,
+            None => fs::read_to_string(&request.file)?,
+        };
+        Ok(self.fixes(&request.file, &source, request.offset))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::TransformSpec;
+
+    fn fixer() -> QuickFixer {
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "GetUser".to_string(),
+                new_name: "FetchUser".to_string(),
+            })
+            .with_id("rename-get-user")
+            .with_message("GetUser is now FetchUser"),
+        );
+        QuickFixer::new(config).unwrap()
+    }
+
+    #[test]
+    fn test_fixes_at_offset() {
+        let source = "a := 1\nuser := GetUser(id)\n";
+        let fixer = fixer();
+
+        let fixes = fixer.fixes(Path::new("main.go"), source, 18);
+        assert_eq!(fixes.len(), 1);
+        assert_eq!(fixes[0].rule, "rename-get-user");
+        assert_eq!(fixes[0].title, "GetUser is now FetchUser");
+        let edit = &fixes[0].edits[0];
+        assert_eq!((edit.line, edit.column), (2, 9));
+        assert_eq!(&source[edit.start..edit.end], "GetUser(");
+        assert_eq!(edit.text, "FetchUser(");
+
+        assert!(fixer.fixes(Path::new("main.go"), source, 2).is_empty());
+        assert!(fixer.fixes(Path::new("main.rs"), source, 18).is_empty());
+    }
+
+    #[test]
+    fn test_serve_protocol() {
+        let input = concat!(
+            r#"{"file": "main.go", "offset": 9, "content": "x := GetUser(1)\n"}"#,
+            "\n\nnot json\n"
+        );
+        let mut output = Vec::new();
+        fixer().serve(input.as_bytes(), &mut output).unwrap();
+
+        let lines: Vec<serde_json::Value> = String::from_utf8(output)
+            .unwrap()
+            .lines()
+            .map(|l| serde_json::from_str(l).unwrap())
+            .collect();
+        assert_eq!(lines.len(), 2);
+        assert_eq!(lines[0]["fixes"][0]["edits"][0]["text"], "FetchUser(");
+        assert!(lines[1]["error"].is_string());
+    }
+}
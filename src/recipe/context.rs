@@ -0,0 +1,81 @@
+//! Threading a `context.Context` through a Go function.
+
+use super::{Recipe, RecipeArgs, RecipeParameter};
+use crate::analyzer::{RuleCondition, TransformRule, TransformSpec, UpgradeConfig};
+use crate::transform::go::package_name;
+
+/// Adds a `context.Context` first parameter to a function and passes one at
+/// its calls, in the package declaring it and in its clients.
+pub(super) const RECIPE: Recipe = Recipe {
+    name: "context-parameter",
+    description: "Add a context.Context first parameter to a Go function and pass a context at its calls",
+    parameters: &[
+        RecipeParameter {
+            name: "function",
+            description: "name of the function (GetUser)",
+            required: true,
+            default: None,
+        },
+        RecipeParameter {
+            name: "package",
+            description: "import path of its package, to also rewrite qualified calls in clients",
+            required: false,
+            default: None,
+        },
+        RecipeParameter {
+            name: "parameter",
+            description: "name of the added parameter",
+            required: false,
+            default: Some("ctx"),
+        },
+        RecipeParameter {
+            name: "fallback",
+            description: "context passed by callers without one in scope",
+            required: false,
+            default: Some("context.TODO()"),
+        },
+        RecipeParameter {
+            name: "signature",
+            description: "Go function type of the function before the change, to adapt it where it is used as a value (func(id int) *User)",
+            required: false,
+            default: None,
+        },
+    ],
+    build,
+};
+
+fn build(args: &RecipeArgs) -> UpgradeConfig {
+    let function = &args["function"];
+    let spec = |package: Option<&String>| TransformSpec::InjectContext {
+        function: function.clone(),
+        package: package.cloned(),
+        parameter: args.get("parameter").cloned(),
+        fallback: args.get("fallback").cloned(),
+        signature: args.get("signature").cloned(),
+    };
+    let mut config = UpgradeConfig::new(
+        RECIPE.name,
+        format!("Pass a context.Context to {}", function),
+    )
+    .with_extensions(vec!["go".to_string()]);
+
+    match args.get("package") {
+        Some(package) => {
+            // The declaration and calls inside the package, then its clients
+            let mut declaration = TransformRule::new(spec(None)).with_id("context-parameter");
+            declaration.when = Some(RuleCondition {
+                file_contains: Some(format!(
+                    r"(?m)^package\s+{}\b",
+                    regex::escape(package_name(package))
+                )),
+                ..Default::default()
+            });
+            config.add_transform(declaration);
+            config.add_transform(
+                TransformRule::new(spec(Some(package))).with_id("context-parameter-calls"),
+            );
+        }
+        None => config.add_transform(TransformRule::new(spec(None)).with_id("context-parameter")),
+    }
+    config
+}
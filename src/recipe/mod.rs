@@ -0,0 +1,153 @@
+//! Built-in recipes for common API evolutions.
+//!
+//! Most upgrades are written for one library's release. A recipe is an
+//! upgrade shipped with the engine for a change many code bases make, filled
+//! in with parameters such as the function to change. [`find`] looks a
+//! recipe up by name, and [`Recipe::config`] builds its upgrade, which runs
+//! like any other.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::recipe;
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let config = recipe::find("context-parameter")?
+//!     .config([("function", "GetUser"), ("package", "example.com/mylib")])?;
+//! let report = UpgradeRunner::new(config).dry_run().run("./project")?;
+//! println!("{} file(s) to change", report.files_modified());
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use std::collections::BTreeMap;
+use std::fmt;
+
+use crate::analyzer::UpgradeConfig;
+use crate::error::{RefactorError, Result};
+
+mod context;
+mod stdlib;
+
+/// A parameter of a recipe.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct RecipeParameter {
+    /// Name the value is given by.
+    pub name: &'static str,
+    /// What the parameter sets.
+    pub description: &'static str,
+    /// Whether the recipe needs a value.
+    pub required: bool,
+    /// Value used when none is given.
+    pub default: Option<&'static str>,
+}
+
+/// Parameter values of a recipe, defaults included.
+pub type RecipeArgs = BTreeMap<String, String>;
+
+/// An upgrade shipped with the engine, built from parameters.
+#[derive(Debug, Clone, Copy)]
+pub struct Recipe {
+    /// Name the recipe is found by.
+    pub name: &'static str,
+    /// What the recipe changes.
+    pub description: &'static str,
+    /// The parameters the recipe takes.
+    pub parameters: &'static [RecipeParameter],
+    build: fn(&RecipeArgs) -> UpgradeConfig,
+}
+
+impl Recipe {
+    /// The upgrade of this recipe with the parameter values `values`.
+    pub fn config<K, V>(&self, values: impl IntoIterator<Item = (K, V)>) -> Result<UpgradeConfig>
+    where
+        K: Into<String>,
+        V: Into<String>,
+    {
+        let mut args = RecipeArgs::new();
+        for (name, value) in values {
+            let name = name.into();
+            if !self.parameters.iter().any(|p| p.name == name) {
+                return Err(RefactorError::InvalidConfig(format!(
+                    "Recipe '{}' has no parameter '{}'; its parameters are: {}",
+                    self.name,
+                    name,
+                    self.parameter_names()
+                )));
+            }
+            args.insert(name, value.into());
+        }
+        for parameter in self.parameters {
+            if args.contains_key(parameter.name) {
+                continue;
+            }
+            if let Some(default) = parameter.default {
+                args.insert(parameter.name.to_string(), default.to_string());
+            } else if parameter.required {
+                return Err(RefactorError::InvalidConfig(format!(
+                    "Recipe '{}' needs a value for '{}': {}",
+                    self.name, parameter.name, parameter.description
+                )));
+            }
+        }
+        Ok((self.build)(&args))
+    }
+
+    fn parameter_names(&self) -> String {
+        let names: Vec<&str> = self.parameters.iter().map(|p| p.name).collect();
+        names.join(", ")
+    }
+}
+
+impl fmt::Display for Recipe {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}", self.name, self.description)?;
+        for parameter in self.parameters {
+            write!(f, "\n  {}", parameter.name)?;
+            if parameter.required {
+                write!(f, " (required)")?;
+            } else if let Some(default) = parameter.default {
+                write!(f, " (default {})", default)?;
+            }
+            write!(f, ": {}", parameter.description)?;
+        }
+        Ok(())
+    }
+}
+
+/// The built-in recipes.
+pub fn recipes() -> &'static [Recipe] {
+    &[context::RECIPE, stdlib::RECIPE]
+}
+
+/// The built-in recipe named `name`.
+pub fn find(name: &str) -> Result<&'static Recipe> {
+    recipes()
+        .iter()
+        .find(|recipe| recipe.name == name)
+        .ok_or_else(|| {
+            let names: Vec<&str> = recipes().iter().map(|r| r.name).collect();
+            RefactorError::InvalidConfig(format!(
+                "No recipe '{}'; the recipes are: {}",
+                name,
+                names.join(", ")
+            ))
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_recipe_parameters() {
+        let recipe = find("context-parameter").unwrap();
+        let config = recipe.config([("function", "GetUser")]).unwrap();
+        assert_eq!(config.transforms.len(), 1);
+
+        let err = recipe.config([("funtion", "GetUser")]).unwrap_err();
+        assert!(err.to_string().contains("has no parameter 'funtion'"));
+        let err = recipe.config(Vec::<(String, String)>::new()).unwrap_err();
+        assert!(err.to_string().contains("needs a value for 'function'"));
+        assert!(find("missing").is_err());
+    }
+}
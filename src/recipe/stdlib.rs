@@ -0,0 +1,273 @@
+//! Replacing deprecated Go standard library APIs.
+//!
+//! Each rule only applies to modules whose go.mod declares a Go version
+//! that has the replacement, so the recipe can run across services still on
+//! older releases.
+
+use super::{Recipe, RecipeArgs};
+use crate::analyzer::{RuleCondition, RuleSeverity, TransformRule, TransformSpec, UpgradeConfig};
+use crate::transform::Removal;
+use crate::transform::go::SKIPPED;
+
+/// Rewrites `io/ioutil`, `rand.Seed`, `os.SEEK_*`, `interface{}` and
+/// `github.com/pkg/errors` wrapping, and reports `strings.Title`.
+pub(super) const RECIPE: Recipe = Recipe {
+    name: "go-stdlib",
+    description: "Replace deprecated Go standard library APIs: io/ioutil, rand.Seed, os.SEEK_*, strings.Title, interface{} and github.com/pkg/errors wrapping",
+    parameters: &[],
+    build,
+};
+
+/// Files importing `github.com/pkg/errors`.
+const PKG_ERRORS: &str = r#""github\.com/pkg/errors""#;
+
+/// The start of `if err != nil { return ...,` up to the wrapped error, the
+/// only place `err` is known not to be nil.
+const RETURN_ERR: &str =
+    r"(?P<check>\bif\s+(?:[^{\n]*;\s*)?err\s*!=\s*nil\s*\{\s*return\s+(?:[^\n{}]*?,\s*)?)";
+
+/// Functions and variables of `io/ioutil`, with their replacements since
+/// Go 1.16.
+const IOUTIL: &[(&str, &str)] = &[
+    ("ReadAll", "io.ReadAll"),
+    ("ReadFile", "os.ReadFile"),
+    ("WriteFile", "os.WriteFile"),
+    ("TempFile", "os.CreateTemp"),
+    ("TempDir", "os.MkdirTemp"),
+    ("NopCloser", "io.NopCloser"),
+    ("Discard", "io.Discard"),
+];
+
+/// The `os.SEEK_*` constants, with their replacements since Go 1.7.
+const SEEK: &[(&str, &str)] = &[
+    ("SEEK_SET", "io.SeekStart"),
+    ("SEEK_CUR", "io.SeekCurrent"),
+    ("SEEK_END", "io.SeekEnd"),
+];
+
+fn build(_: &RecipeArgs) -> UpgradeConfig {
+    let mut config =
+        UpgradeConfig::new(RECIPE.name, RECIPE.description).with_extensions(vec!["go".to_string()]);
+
+    for (name, replacement) in IOUTIL {
+        config.add_transform(
+            since(
+                "1.16",
+                pattern(&format!(r"\bioutil\.{}\b", name), replacement),
+            )
+            .with_id(format!("ioutil-{}", name.to_lowercase()))
+            .with_message(format!(
+                "ioutil.{} is deprecated since Go 1.16; use {}",
+                name, replacement
+            )),
+        );
+    }
+    config.add_transform(
+        since(
+            "1.16",
+            pattern(r"\bioutil\.ReadDir\(", "os.ReadDir("),
+        )
+        .with_id("ioutil-readdir")
+        .with_message(
+            "ioutil.ReadDir is deprecated since Go 1.16; os.ReadDir returns fs.DirEntry values, call Info() for a FileInfo",
+        )
+        .suggest_only(),
+    );
+
+    for (name, replacement) in SEEK {
+        config.add_transform(
+            since("1.7", pattern(&format!(r"\bos\.{}\b", name), replacement))
+                .with_id(format!("os-{}", name.to_lowercase().replace('_', "-")))
+                .with_message(format!(
+                    "os.{} is deprecated since Go 1.7; use {}",
+                    name, replacement
+                )),
+        );
+    }
+
+    // Seeding from the clock is what Go 1.20 does by itself; a fixed seed
+    // asks for a generator of its own
+    let mut seed = since(
+        "1.20",
+        TransformSpec::RemoveCall {
+            function: "rand.Seed".to_string(),
+            strategy: Removal::Delete,
+            replacement: None,
+        },
+    )
+    .with_id("rand-seed")
+    .with_message("rand.Seed is deprecated since Go 1.20, which seeds the generator randomly");
+    condition(&mut seed).matched = Some(r"time\.Now\(\)".to_string());
+    config.add_transform(seed);
+    let mut fixed = since(
+        "1.20",
+        TransformSpec::RemoveCall {
+            function: "rand.Seed".to_string(),
+            strategy: Removal::Todo,
+            replacement: None,
+        },
+    )
+    .with_id("rand-seed-fixed")
+    .with_message(
+        "rand.Seed is deprecated since Go 1.20; use rand.New(rand.NewSource(seed)) for a reproducible sequence",
+    )
+    .suggest_only();
+    fixed.unless = Some(RuleCondition {
+        matched: Some(r"time\.Now\(\)".to_string()),
+        ..Default::default()
+    });
+    config.add_transform(fixed);
+
+    config.add_transform(
+        since(
+            "1.18",
+            TransformSpec::ReplaceStructural {
+                pattern: "strings.Title($s)".to_string(),
+                replacement: "cases.Title(language.Und).String($s)".to_string(),
+            },
+        )
+        .with_id("strings-title")
+        .with_message(
+            "strings.Title is deprecated since Go 1.18: it does not handle Unicode punctuation; use golang.org/x/text/cases",
+        )
+        .suggest_only(),
+    );
+
+    // Strings and comments are matched too, and left alone by the guard
+    let mut any = since(
+        "1.18",
+        pattern(&format!(r"{}|\binterface\{{\}}", SKIPPED), "any"),
+    )
+    .with_id("interface-any")
+    .with_message("any is an alias for interface{} since Go 1.18")
+    .with_severity(RuleSeverity::Info);
+    condition(&mut any).matched = Some(r"^interface\{\}$".to_string());
+    config.add_transform(any);
+
+    // github.com/pkg/errors returns nil when wrapping a nil error, and
+    // fmt.Errorf never does, so only the error just checked is rewritten
+    let mut wrap = since(
+        "1.13",
+        pattern(
+            &format!(
+                r#"{}errors\.Wrap\(\s*err\s*,\s*"(?P<msg>(?:[^"\\\n]|\\.)*)"\s*\)"#,
+                RETURN_ERR
+            ),
+            r#"${check}fmt.Errorf("${msg}: %w", err)"#,
+        ),
+    )
+    .with_id("pkg-errors-wrap")
+    .with_message("wrap errors with fmt.Errorf and %w instead of github.com/pkg/errors");
+    let when = condition(&mut wrap);
+    when.file_contains = Some(PKG_ERRORS.to_string());
+    when.captures
+        .insert("msg".to_string(), "^[^%]*$".to_string());
+    config.add_transform(wrap);
+
+    let mut wrapf = since(
+        "1.13",
+        pattern(
+            &format!(
+                r#"{}errors\.Wrapf\(\s*err\s*,\s*"(?P<format>(?:[^"\\\n]|\\.)*)"\s*,(?P<args>[^()\n]*(?:\([^()\n]*\)[^()\n]*)*)\)"#,
+                RETURN_ERR
+            ),
+            r#"${check}fmt.Errorf("${format}: %w",${args}, err)"#,
+        ),
+    )
+    .with_id("pkg-errors-wrapf")
+    .with_message("wrap errors with fmt.Errorf and %w instead of github.com/pkg/errors");
+    condition(&mut wrapf).file_contains = Some(PKG_ERRORS.to_string());
+    config.add_transform(wrapf);
+
+    // Wrapping anywhere else may wrap a nil error, which fmt.Errorf turns
+    // into a failure. Checked calls are matched too, and left to the guard.
+    let mut wrap_other = since(
+        "1.13",
+        pattern(
+            &format!(r"{}errors\.Wrapf?\(|\berrors\.Wrapf?\(", RETURN_ERR),
+            "fmt.Errorf(",
+        ),
+    )
+    .with_id("pkg-errors-wrap-unchecked")
+    .with_message(
+        "errors.Wrap returns nil for a nil error and fmt.Errorf does not; check the error before replacing it with fmt.Errorf and %w",
+    )
+    .suggest_only();
+    let when = condition(&mut wrap_other);
+    when.file_contains = Some(PKG_ERRORS.to_string());
+    when.matched = Some(r"^errors\.Wrapf?\($".to_string());
+    config.add_transform(wrap_other);
+
+    let mut errorf = since("1.13", pattern(r"\berrors\.Errorf\(", "fmt.Errorf("))
+        .with_id("pkg-errors-errorf")
+        .with_message("use fmt.Errorf instead of github.com/pkg/errors");
+    condition(&mut errorf).file_contains = Some(PKG_ERRORS.to_string());
+    config.add_transform(errorf);
+
+    config
+}
+
+/// A `replace_pattern` spec.
+fn pattern(pattern: &str, replacement: &str) -> TransformSpec {
+    TransformSpec::ReplacePattern {
+        pattern: pattern.to_string(),
+        replacement: replacement.to_string(),
+    }
+}
+
+/// A rule for modules on Go `version` or later.
+fn since(version: &str, spec: TransformSpec) -> TransformRule {
+    let mut rule = TransformRule::new(spec);
+    rule.when = Some(RuleCondition {
+        go_version: Some(format!(">={}", version)),
+        ..Default::default()
+    });
+    rule
+}
+
+/// The `when` condition of a rule made by [`since`].
+fn condition(rule: &mut TransformRule) -> &mut RuleCondition {
+    rule.when.get_or_insert_with(RuleCondition::default)
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::recipe;
+    use crate::runner::UpgradeRunner;
+    use std::fs;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_stdlib_recipe() {
+        let dir = TempDir::new().unwrap();
+        fs::write(
+            dir.path().join("go.mod"),
+            "module example.com/app\n\ngo 1.21\n",
+        )
+        .unwrap();
+        let file = dir.path().join("main.go");
+        fs::write(
+            &file,
+            "package main\n\nimport (\n\t\"io/ioutil\"\n\t\"math/rand\"\n\t\"time\"\n\n\t\"github.com/pkg/errors\"\n)\n\nfunc load(path string, id int) (interface{}, error) {\n\trand.Seed(time.Now().UnixNano())\n\tdata, err := ioutil.ReadFile(path)\n\tif err != nil {\n\t\treturn nil, errors.Wrapf(err, \"loading %d\", id)\n\t}\n\tif len(data) == 0 {\n\t\treturn nil, errors.Wrap(err, \"empty config\")\n\t}\n\t// Accepts interface{} values.\n\treturn data, nil\n}\n",
+        )
+        .unwrap();
+
+        let config = recipe::find("go-stdlib")
+            .unwrap()
+            .config(Vec::<(String, String)>::new())
+            .unwrap();
+        let report = UpgradeRunner::new(config).run(dir.path()).unwrap();
+        assert_eq!(
+            fs::read_to_string(&file).unwrap(),
+            "package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\n\t\"github.com/pkg/errors\"\n)\n\nfunc load(path string, id int) (any, error) {\n\tdata, err := os.ReadFile(path)\n\tif err != nil {\n\t\treturn nil, fmt.Errorf(\"loading %d: %w\", id, err)\n\t}\n\tif len(data) == 0 {\n\t\treturn nil, errors.Wrap(err, \"empty config\")\n\t}\n\t// Accepts interface{} values.\n\treturn data, nil\n}\n"
+        );
+        // Wrapping an error not known to be set is only reported.
+        let unchecked: Vec<usize> = report
+            .diagnostics
+            .iter()
+            .filter(|d| d.rule == "pkg-errors-wrap-unchecked")
+            .map(|d| d.line)
+            .collect();
+        assert_eq!(unchecked, [18]);
+    }
+}
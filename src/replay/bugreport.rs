@@ -0,0 +1,307 @@
+//! Minimized bug reports.
+//!
+//! A [`BugReport`] is a replay bundle of a single file, shrunk until nothing
+//! more can be removed without losing the failure: lines of the file and
+//! rules of the config are dropped, string literals and comments are blanked
+//! out, and the directory is stripped from the path, each only if the
+//! failure still reproduces. Environment details are added so the report can
+//! be attached to an issue as is.
+
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use super::{ENGINE_VERSION, RecordedFile, ReplayBundle};
+use crate::analyzer::UpgradeConfig;
+use crate::error::{RefactorError, Result};
+use crate::minimize::Minimizer;
+use crate::runner::UpgradeRunner;
+use crate::semantics;
+
+/// What is wrong with a run, checked after every minimization step.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case", tag = "kind", content = "detail")]
+pub enum Failure {
+    /// Running the rules fails with this error message.
+    Error(String),
+    /// The rewrite introduces this text.
+    Introduces(String),
+    /// The rules rewrite the file at all.
+    Rewrites,
+}
+
+impl Failure {
+    /// The error of running `config` on `source`, or [`Failure::Rewrites`]
+    /// if the run succeeds.
+    pub fn detect(config: &UpgradeConfig, path: &Path, source: &str) -> Self {
+        match run(config, path, source) {
+            Err(e) => Failure::Error(e.to_string()),
+            Ok(_) => Failure::Rewrites,
+        }
+    }
+
+    /// Returns true if running `config` on `source` still fails this way.
+    pub fn reproduces(&self, config: &UpgradeConfig, path: &Path, source: &str) -> bool {
+        match (self, run(config, path, source)) {
+            (Failure::Error(message), Err(e)) => e.to_string() == *message,
+            (Failure::Introduces(text), Ok(output)) => {
+                output.matches(text.as_str()).count() > source.matches(text.as_str()).count()
+            }
+            (Failure::Rewrites, Ok(output)) => output != source,
+            _ => false,
+        }
+    }
+}
+
+impl fmt::Display for Failure {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Failure::Error(message) => write!(f, "run fails: {}", message),
+            Failure::Introduces(text) => write!(f, "rewrite introduces `{}`", text),
+            Failure::Rewrites => write!(f, "file is rewritten"),
+        }
+    }
+}
+
+/// Where a report was made.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Environment {
+    /// Version of `refactor`.
+    pub engine_version: String,
+    /// Operating system.
+    pub os: String,
+    /// CPU architecture.
+    pub arch: String,
+}
+
+impl Environment {
+    /// The environment of this process.
+    pub fn current() -> Self {
+        Self {
+            engine_version: ENGINE_VERSION.to_string(),
+            os: std::env::consts::OS.to_string(),
+            arch: std::env::consts::ARCH.to_string(),
+        }
+    }
+}
+
+/// A minimized, redacted reproduction of a failure on one file.
+///
+/// The report is a [`ReplayBundle`] with extra fields, so it can be
+/// replayed with [`ReplayBundle::load`] and `refactor replay`.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BugReport {
+    /// Where the report was made.
+    pub environment: Environment,
+    /// The failure the reproduction preserves.
+    pub failure: Failure,
+    /// Lines in the file before minimization.
+    pub original_lines: usize,
+    /// Rules in the config before minimization.
+    pub original_rules: usize,
+    /// The reproduction.
+    #[serde(flatten)]
+    pub bundle: ReplayBundle,
+}
+
+impl BugReport {
+    /// Build a report of `failure` on `source` without minimizing it.
+    pub fn new(
+        config: &UpgradeConfig,
+        path: &Path,
+        source: &str,
+        failure: Failure,
+    ) -> Result<Self> {
+        if !failure.reproduces(config, path, source) {
+            return Err(RefactorError::InvalidConfig(format!(
+                "Failure does not reproduce on {}: {}",
+                path.display(),
+                failure
+            )));
+        }
+        Ok(Self {
+            environment: Environment::current(),
+            original_lines: source.lines().count(),
+            original_rules: config.transforms.len(),
+            bundle: bundle(config, path, source, &failure),
+            failure,
+        })
+    }
+
+    /// Build a report of `failure` on `source`, shrunk as far as the
+    /// failure allows.
+    pub fn minimize(
+        config: &UpgradeConfig,
+        path: &Path,
+        source: &str,
+        failure: Failure,
+    ) -> Result<Self> {
+        let mut report = Self::new(config, path, source, failure)?;
+        let failure = report.failure.clone();
+        let mut config = config.clone();
+        let mut path = path.to_path_buf();
+        let mut source = source.to_string();
+
+        // Drop rules not needed for the failure
+        let mut index = 0;
+        while index < config.transforms.len() {
+            let mut candidate = config.clone();
+            candidate.transforms.remove(index);
+            if failure.reproduces(&candidate, &path, &source) {
+                config = candidate;
+            } else {
+                index += 1;
+            }
+        }
+
+        source = Minimizer::new(|candidate: &str| failure.reproduces(&config, &path, candidate))
+            .redact()
+            .minimize(&source)?;
+
+        if let Some(name) = path.file_name().map(PathBuf::from)
+            && failure.reproduces(&config, &name, &source)
+        {
+            path = name;
+        }
+
+        report.bundle = bundle(&config, &path, &source, &failure);
+        Ok(report)
+    }
+
+    /// Load a report from a JSON file.
+    pub fn load(path: impl AsRef<Path>) -> Result<Self> {
+        Ok(serde_json::from_str(&fs::read_to_string(path)?)?)
+    }
+
+    /// Save the report as JSON.
+    pub fn save(&self, path: impl AsRef<Path>) -> Result<()> {
+        let path = path.as_ref();
+        if let Some(parent) = path.parent().filter(|p| !p.as_os_str().is_empty()) {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(path, serde_json::to_string_pretty(self)?)?;
+        Ok(())
+    }
+
+    /// The reproduction's file.
+    pub fn file(&self) -> &RecordedFile {
+        &self.bundle.files[0]
+    }
+}
+
+impl fmt::Display for BugReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let file = self.file();
+        writeln!(f, "Failure: {}", self.failure)?;
+        writeln!(
+            f,
+            "File: {} ({} of {} line(s) kept)",
+            file.path.display(),
+            file.input.lines().count(),
+            self.original_lines
+        )?;
+        writeln!(
+            f,
+            "Rules: {} of {} kept",
+            self.bundle.config.transforms.len(),
+            self.original_rules
+        )?;
+        write!(
+            f,
+            "Environment: refactor {} on {}/{}",
+            self.environment.engine_version, self.environment.os, self.environment.arch
+        )
+    }
+}
+
+/// The rewritten source, or the error of the run.
+fn run(config: &UpgradeConfig, path: &Path, source: &str) -> Result<String> {
+    let report = UpgradeRunner::new(config.clone())
+        .include_generated()
+        .run_source(path, source)?;
+    Ok(report
+        .changes
+        .into_iter()
+        .next()
+        .map_or_else(|| source.to_string(), |change| change.transformed))
+}
+
+fn bundle(config: &UpgradeConfig, path: &Path, source: &str, failure: &Failure) -> ReplayBundle {
+    // A failing run has no output; the replay then shows it as diverged
+    let output = match failure {
+        Failure::Error(_) => source.to_string(),
+        _ => run(config, path, source).unwrap_or_else(|_| source.to_string()),
+    };
+    ReplayBundle {
+        engine_version: ENGINE_VERSION.to_string(),
+        semantics: Some(config.engine.unwrap_or(semantics::CURRENT)),
+        config: config.clone(),
+        files: vec![RecordedFile {
+            path: path.to_path_buf(),
+            input: source.to_string(),
+            output,
+            edits: Vec::new(),
+            diagnostics: Vec::new(),
+        }],
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::TransformSpec;
+
+    fn config() -> UpgradeConfig {
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::RenameFunction {
+            old_name: "Unused".to_string(),
+            new_name: "StillUnused".to_string(),
+        });
+        config.add_transform(TransformSpec::ReplacePattern {
+            pattern: r"Dial\(([^)]*)\)".to_string(),
+            replacement: "Dial($1, nil)".to_string(),
+        });
+        config
+    }
+
+    #[test]
+    fn test_minimize_preserves_failure() {
+        let source = "package main\n\n// Secret internal notes\nfunc main() {\n\tlog(\"token=abc\")\n\tc := Dial(\"db.internal\")\n\tc.Close()\n}\n";
+        let failure = Failure::Introduces(", nil".to_string());
+        let report = BugReport::minimize(
+            &config(),
+            Path::new("services/db/main.go"),
+            source,
+            failure.clone(),
+        )
+        .unwrap();
+
+        let file = report.file();
+        assert_eq!(file.path, Path::new("main.go"));
+        assert_eq!(file.input, "\tDial(\"xxxxxxxxxxx\")\n");
+        assert_eq!(file.output, "\tDial(\"xxxxxxxxxxx\", nil)\n");
+        assert_eq!(report.bundle.config.transforms.len(), 1);
+        assert_eq!(report.original_lines, 8);
+        assert!(failure.reproduces(&report.bundle.config, &file.path, &file.input));
+
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("report.json");
+        report.save(&path).unwrap();
+        assert_eq!(BugReport::load(&path).unwrap().failure, failure);
+        let replays = ReplayBundle::load(&path).unwrap().replay().unwrap();
+        assert!(!replays[0].diverged());
+    }
+
+    #[test]
+    fn test_failure_must_reproduce() {
+        let failure = Failure::Introduces("nil".to_string());
+        let result = BugReport::new(&config(), Path::new("main.go"), "x := 1\n", failure);
+        assert!(result.is_err());
+        assert_eq!(
+            Failure::detect(&config(), Path::new("main.go"), "Dial(a)\n"),
+            Failure::Rewrites
+        );
+    }
+}
@@ -0,0 +1,368 @@
+//! Replay bundles for reproducing reported rewrites.
+//!
+//! A [`ReplayBundle`] records what a run saw and did: the engine version, the
+//! upgrade configuration, and for every file a rule touched, its input, its
+//! output and the rule edits and findings. A user who hits a bad rewrite can
+//! save a bundle with `refactor upgrade --replay-bundle <FILE>` and attach it
+//! to an issue; a maintainer then runs `refactor replay <FILE>` to re-run the
+//! rules on the recorded inputs without the user's checkout, stepping
+//! through each rule's matches and seeing whether the current engine still
+//! produces the recorded output.
+//!
+//! A [`BugReport`] is a bundle of one file shrunk to a minimal, redacted
+//! reproduction of a failure, as made by `refactor bugreport`.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::replay::ReplayBundle;
+//!
+//! let bundle = ReplayBundle::load("bug-1234.replay.json")?;
+//! for file in bundle.replay()? {
+//!     print!("{}", file);
+//!     if file.diverged() {
+//!         println!("{} no longer reproduces", file.path.display());
+//!     }
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::analyzer::UpgradeConfig;
+use crate::error::Result;
+use crate::runner::{Diagnostic, RuleEdit, RunReport, UpgradeRunner};
+use crate::semantics::{self, SemanticsChange, SemanticsVersion};
+use crate::transform::{GoImports, Transform};
+
+mod bugreport;
+
+pub use bugreport::{BugReport, Environment, Failure};
+
+/// Version of this engine, recorded in bundles.
+const ENGINE_VERSION: &str = env!("CARGO_PKG_VERSION");
+
+/// A file as seen and left by a recorded run.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RecordedFile {
+    /// Path relative to the project root.
+    pub path: PathBuf,
+    /// Content before the run.
+    pub input: String,
+    /// Content after the run (equal to `input` if only findings were made).
+    pub output: String,
+    /// Locations rewritten by rules.
+    #[serde(default)]
+    pub edits: Vec<RuleEdit>,
+    /// Findings of suggest-only rules.
+    #[serde(default)]
+    pub diagnostics: Vec<Diagnostic>,
+}
+
+/// Everything needed to re-run an upgrade on the files it touched.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ReplayBundle {
+    /// Version of the engine that made the recording.
+    pub engine_version: String,
+    /// Engine semantics the recorded run followed; replays follow them too.
+    /// Absent from bundles recorded before semantics were versioned.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub semantics: Option<SemanticsVersion>,
+    /// The upgrade that was run.
+    pub config: UpgradeConfig,
+    /// Files rewritten or reported on.
+    pub files: Vec<RecordedFile>,
+}
+
+impl ReplayBundle {
+    /// Record the files of `report` that a rule rewrote or reported on.
+    /// Files with findings only are read from disk under `root`.
+    pub fn record(config: &UpgradeConfig, root: &Path, report: &RunReport) -> Result<Self> {
+        let relative = |path: &Path| path.strip_prefix(root).unwrap_or(path).to_path_buf();
+
+        let mut files: Vec<RecordedFile> = report
+            .changes
+            .iter()
+            .map(|change| RecordedFile {
+                path: relative(&change.path),
+                input: change.original.clone(),
+                output: change.transformed.clone(),
+                edits: Vec::new(),
+                diagnostics: Vec::new(),
+            })
+            .collect();
+
+        for diagnostic in &report.diagnostics {
+            let path = relative(&diagnostic.path);
+            let index = match files.iter().position(|f| f.path == path) {
+                Some(index) => index,
+                None => {
+                    let input = fs::read_to_string(root.join(&path))?;
+                    files.push(RecordedFile {
+                        path,
+                        output: input.clone(),
+                        input,
+                        edits: Vec::new(),
+                        diagnostics: Vec::new(),
+                    });
+                    files.len() - 1
+                }
+            };
+            files[index].diagnostics.push(diagnostic.clone());
+        }
+        for edit in &report.edits {
+            let path = relative(&edit.path);
+            if let Some(file) = files.iter_mut().find(|f| f.path == path) {
+                file.edits.push(edit.clone());
+            }
+        }
+        files.sort_by(|a, b| a.path.cmp(&b.path));
+
+        Ok(Self {
+            engine_version: ENGINE_VERSION.to_string(),
+            semantics: Some(report.semantics),
+            config: config.clone(),
+            files,
+        })
+    }
+
+    /// Load a bundle from a JSON file.
+    pub fn load(path: impl AsRef<Path>) -> Result<Self> {
+        Ok(serde_json::from_str(&fs::read_to_string(path)?)?)
+    }
+
+    /// Save the bundle as JSON.
+    pub fn save(&self, path: impl AsRef<Path>) -> Result<()> {
+        let path = path.as_ref();
+        if let Some(parent) = path.parent().filter(|p| !p.as_os_str().is_empty()) {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(path, serde_json::to_string_pretty(self)?)?;
+        Ok(())
+    }
+
+    /// Returns true if the bundle was recorded by a different engine version.
+    pub fn version_differs(&self) -> bool {
+        self.engine_version != ENGINE_VERSION
+    }
+
+    /// Changes to the engine semantics since the recording that replays
+    /// cannot undo, so replayed output may differ from the recorded output.
+    pub fn semantics_changes(&self) -> Vec<&'static SemanticsChange> {
+        self.semantics.map_or_else(Vec::new, |recorded| {
+            semantics::unreproducible_since(recorded, &self.config.extensions)
+        })
+    }
+
+    /// Re-run the upgrade on every recorded input, in memory, following the
+    /// recorded engine semantics.
+    pub fn replay(&self) -> Result<Vec<FileReplay>> {
+        let mut runner = UpgradeRunner::new(self.config.clone()).include_generated();
+        if let Some(recorded) = self.semantics {
+            runner = runner.engine(recorded);
+        }
+        let fixes_imports = runner.semantics() >= semantics::GO_IMPORTS;
+        let plugins = self.config.plugin_registry();
+        let rules = self
+            .config
+            .transforms
+            .iter()
+            .map(|rule| Ok((rule, rule.to_transform_with(&plugins)?)))
+            .collect::<Result<Vec<_>>>()?;
+        let imports = self
+            .config
+            .transforms
+            .iter()
+            .flat_map(|rule| &rule.imports)
+            .fold(GoImports::new(), |imports, path| imports.with_import(path));
+
+        self.files
+            .iter()
+            .map(|file| {
+                // Step through the rules the way the runner applies them
+                let mut steps = Vec::new();
+                let mut current = file.input.clone();
+                for (rule, transform) in &rules {
+                    let source = if rule.is_suggest_only() {
+                        &file.input
+                    } else {
+                        &current
+                    };
+                    let matches = transform
+                        .sites(source, &file.path)
+                        .into_iter()
+                        .map(|site| {
+                            let (line, column) = site.position(source);
+                            StepMatch {
+                                line,
+                                column,
+                                text: site.text,
+                                replacement: site.replacement,
+                            }
+                        })
+                        .collect();
+                    if !rule.is_suggest_only() {
+                        current = transform.apply(&current, &file.path)?;
+                    }
+                    steps.push(Step {
+                        rule: rule.name(),
+                        suggest_only: rule.is_suggest_only(),
+                        matches,
+                    });
+                }
+                let imports_fixed = fixes_imports
+                    && current != file.input
+                    && file.path.extension().is_some_and(|e| e == "go")
+                    && imports.fix(&file.input, &current) != current;
+
+                let report = runner.run_source(&file.path, &file.input)?;
+                let output = report
+                    .changes
+                    .into_iter()
+                    .next()
+                    .map_or_else(|| file.input.clone(), |change| change.transformed);
+                Ok(FileReplay {
+                    path: file.path.clone(),
+                    steps,
+                    imports_fixed,
+                    expected: file.output.clone(),
+                    output,
+                })
+            })
+            .collect()
+    }
+}
+
+/// One match of a rule during replay.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct StepMatch {
+    /// 1-based line of the match.
+    pub line: usize,
+    /// 1-based column of the match.
+    pub column: usize,
+    /// The matched text.
+    pub text: String,
+    /// The text the match is replaced with (or suggested).
+    pub replacement: String,
+}
+
+/// What one rule did to a file during replay.
+#[derive(Debug, Clone)]
+pub struct Step {
+    /// Name of the rule.
+    pub rule: String,
+    /// Whether the rule only reports matches.
+    pub suggest_only: bool,
+    /// Matches, in the text as it was when the rule ran.
+    pub matches: Vec<StepMatch>,
+}
+
+/// The replay of one recorded file.
+#[derive(Debug, Clone)]
+pub struct FileReplay {
+    /// Path relative to the project root.
+    pub path: PathBuf,
+    /// Rules in the order they ran.
+    pub steps: Vec<Step>,
+    /// Whether Go imports were fixed after the rules ran.
+    pub imports_fixed: bool,
+    /// The recorded output.
+    pub expected: String,
+    /// The output of the current engine.
+    pub output: String,
+}
+
+impl FileReplay {
+    /// Returns true if the current engine's output differs from the
+    /// recorded output.
+    pub fn diverged(&self) -> bool {
+        self.output != self.expected
+    }
+}
+
+impl fmt::Display for FileReplay {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(f, "{}", self.path.display())?;
+        for step in &self.steps {
+            let mode = if step.suggest_only { " (suggest)" } else { "" };
+            writeln!(
+                f,
+                "  [{}]{}: {} match(es)",
+                step.rule,
+                mode,
+                step.matches.len()
+            )?;
+            for m in &step.matches {
+                writeln!(
+                    f,
+                    "    {}:{}: `{}` -> `{}`",
+                    m.line, m.column, m.text, m.replacement
+                )?;
+            }
+        }
+        if self.imports_fixed {
+            writeln!(f, "  [go-imports]: imports fixed")?;
+        }
+        let verdict = if self.diverged() {
+            "DIVERGED"
+        } else {
+            "reproduced"
+        };
+        writeln!(f, "  => {}", verdict)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformRule, TransformSpec};
+
+    #[test]
+    fn test_record_and_replay() {
+        let dir = tempfile::TempDir::new().unwrap();
+        fs::write(dir.path().join("main.go"), "x := oldpkg.Do()\n").unwrap();
+        fs::write(dir.path().join("util.go"), "y := Legacy()\n").unwrap();
+        fs::write(dir.path().join("other.go"), "z := 1\n").unwrap();
+
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "oldpkg".to_string(),
+            to: "newpkg".to_string(),
+        });
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "Legacy".to_string(),
+                new_name: "Modern".to_string(),
+            })
+            .with_id("legacy")
+            .suggest_only(),
+        );
+        let report = UpgradeRunner::new(config.clone())
+            .dry_run()
+            .run(dir.path())
+            .unwrap();
+
+        let path = dir.path().join("bundle.json");
+        ReplayBundle::record(&config, dir.path(), &report)
+            .unwrap()
+            .save(&path)
+            .unwrap();
+        let mut bundle = ReplayBundle::load(&path).unwrap();
+        assert!(!bundle.version_differs());
+        let paths: Vec<&Path> = bundle.files.iter().map(|f| f.path.as_path()).collect();
+        assert_eq!(paths, vec![Path::new("main.go"), Path::new("util.go")]);
+
+        let replays = bundle.replay().unwrap();
+        assert!(replays.iter().all(|r| !r.diverged()));
+        let trace = replays[0].to_string();
+        assert!(trace.contains("1:6: `oldpkg` -> `newpkg`"));
+        assert_eq!(replays[1].steps[1].matches.len(), 1);
+
+        bundle.files[0].output = "x := otherpkg.Do()\n".to_string();
+        assert!(bundle.replay().unwrap()[0].diverged());
+    }
+}
@@ -0,0 +1,500 @@
+//! Migration reports with before and after snippets.
+//!
+//! [`MigrationReport`] renders a [`RunReport`] as a document to paste into
+//! an upgrade pull request or an internal wiki: a summary table of the
+//! rules, then, per rule and per file, each changed region of code before
+//! and after the upgrade. Changes no rule made (import fixes, formatting)
+//! are listed at the end. The report renders as Markdown, with code in
+//! fenced blocks tagged with their language, or as an HTML page with a
+//! table of contents and syntax highlighting by highlight.js, loaded from a
+//! CDN.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::report::MigrationReport;
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let config = UpgradeConfig::from_file("upgrade.yaml")?;
+//! let report = UpgradeRunner::new(config.clone()).dry_run().run("./project")?;
+//! let html = MigrationReport::new(&config.name, "./project", &report).to_html();
+//! std::fs::write("migration.html", html)?;
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use similar::{ChangeTag, TextDiff};
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::path::{Path, PathBuf};
+
+use crate::runner::RunReport;
+
+/// Unchanged lines shown around each changed region.
+const CONTEXT: usize = 1;
+
+/// Heading of the changes no rule made.
+const OTHER: &str = "Other changes";
+
+/// A changed region of a file.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Snippet {
+    /// 1-based line of the region in the original file.
+    pub line: usize,
+    /// The region before the upgrade.
+    pub before: String,
+    /// The region after the upgrade.
+    pub after: String,
+    /// Rules with an edit in the region.
+    pub rules: Vec<String>,
+}
+
+/// A report of an upgrade run, for people to read.
+#[derive(Debug)]
+pub struct MigrationReport<'a> {
+    name: &'a str,
+    root: PathBuf,
+    report: &'a RunReport,
+}
+
+/// Snippets by section (a rule, or [`OTHER`]), then by file.
+type Sections<'r> = BTreeMap<String, BTreeMap<&'r Path, Vec<Snippet>>>;
+
+impl<'a> MigrationReport<'a> {
+    /// Report `report`, a run of upgrade `name` against `root`. Paths are
+    /// shown relative to `root`.
+    pub fn new(name: &'a str, root: impl Into<PathBuf>, report: &'a RunReport) -> Self {
+        Self {
+            name,
+            root: root.into(),
+            report,
+        }
+    }
+
+    fn relative<'p>(&self, path: &'p Path) -> &'p Path {
+        path.strip_prefix(&self.root).unwrap_or(path)
+    }
+
+    /// The changed regions of the file at `path`, with the rules that edited
+    /// them.
+    pub fn snippets(&self, path: &Path) -> Vec<Snippet> {
+        let Some(change) = self.report.changes.iter().find(|c| c.path == path) else {
+            return Vec::new();
+        };
+        let edits: Vec<_> = self
+            .report
+            .edits
+            .iter()
+            .filter(|e| e.path == path)
+            .collect();
+        // Edit lines point at the upgraded file, so match them on that side
+        snippets(&change.original, &change.transformed)
+            .into_iter()
+            .map(|(mut snippet, after_line)| {
+                let lines = after_line..after_line + snippet.after.lines().count().max(1);
+                for edit in edits.iter().filter(|e| lines.contains(&e.line)) {
+                    if !snippet.rules.contains(&edit.rule) {
+                        snippet.rules.push(edit.rule.clone());
+                    }
+                }
+                snippet
+            })
+            .collect()
+    }
+
+    /// The snippets of every changed file, by rule then file; a snippet
+    /// edited by several rules appears under each.
+    fn sections(&self) -> Sections<'a> {
+        let mut sections: Sections<'a> = BTreeMap::new();
+        for change in self.report.changes.iter().filter(|c| c.is_modified()) {
+            for snippet in self.snippets(&change.path) {
+                let rules = if snippet.rules.is_empty() {
+                    vec![OTHER.to_string()]
+                } else {
+                    snippet.rules.clone()
+                };
+                for rule in rules {
+                    sections
+                        .entry(rule)
+                        .or_default()
+                        .entry(change.path.as_path())
+                        .or_default()
+                        .push(snippet.clone());
+                }
+            }
+        }
+        sections
+    }
+
+    /// Summary rows: each rule with its edits, findings and files.
+    fn summary(&self) -> BTreeMap<&'a str, (usize, usize, Vec<&'a Path>)> {
+        let mut rules: BTreeMap<&str, (usize, usize, Vec<&Path>)> = BTreeMap::new();
+        let sites = self
+            .report
+            .edits
+            .iter()
+            .map(|e| (e.rule.as_str(), &e.path, true))
+            .chain(
+                self.report
+                    .diagnostics
+                    .iter()
+                    .map(|d| (d.rule.as_str(), &d.path, false)),
+            );
+        for (rule, path, edit) in sites {
+            let (edits, findings, files) = rules.entry(rule).or_default();
+            *if edit { edits } else { findings } += 1;
+            if !files.contains(&path.as_path()) {
+                files.push(path);
+            }
+        }
+        rules
+    }
+
+    /// One line of totals.
+    fn totals(&self) -> String {
+        format!(
+            "{} file(s) changed, {} insertion(s), {} deletion(s); {} finding(s) to change by hand.",
+            self.report.files_modified(),
+            self.report.summary.insertions,
+            self.report.summary.deletions,
+            self.report.diagnostics.len()
+        )
+    }
+
+    /// The report as Markdown.
+    pub fn to_markdown(&self) -> String {
+        let mut out = String::new();
+        let _ = writeln!(out, "# Migration report: {}\n", self.name);
+        let _ = writeln!(out, "{}\n", self.totals());
+        let summary = self.summary();
+        if !summary.is_empty() {
+            let _ = writeln!(out, "| Rule | Edits | Findings | Files |");
+            let _ = writeln!(out, "| --- | ---: | ---: | ---: |");
+            for (rule, (edits, findings, files)) in &summary {
+                let _ = writeln!(
+                    out,
+                    "| [`{}`](#{}) | {} | {} | {} |",
+                    rule,
+                    anchor(rule),
+                    edits,
+                    findings,
+                    files.len()
+                );
+            }
+        }
+
+        for (rule, files) in self.sections() {
+            if rule == OTHER {
+                let _ = writeln!(out, "\n## {}", OTHER);
+            } else {
+                let _ = writeln!(out, "\n## `{}`", rule);
+            }
+            for (path, snippets) in files {
+                let path = self.relative(path);
+                let language = language(path);
+                let _ = writeln!(out, "\n### `{}`", path.display());
+                for snippet in snippets {
+                    let _ = writeln!(
+                        out,
+                        "\nLine {}, before:\n\n```{}\n{}```\n\nAfter:\n\n```{}\n{}```",
+                        snippet.line,
+                        language,
+                        fenced(&snippet.before),
+                        language,
+                        fenced(&snippet.after)
+                    );
+                }
+            }
+        }
+        out
+    }
+
+    /// The report as an HTML page, highlighted by highlight.js from a CDN.
+    pub fn to_html(&self) -> String {
+        let sections = self.sections();
+        let mut out = String::new();
+        let title = escape(&format!("Migration report: {}", self.name));
+        let _ = writeln!(
+            out,
+            "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>{}</title>\n{}\n</head>\n<body>\n<h1>{}</h1>\n<p>{}</p>",
+            title,
+            HTML_HEAD,
+            title,
+            escape(&self.totals())
+        );
+
+        let summary = self.summary();
+        if !summary.is_empty() {
+            let _ = writeln!(
+                out,
+                "<table>\n<tr><th>Rule</th><th>Edits</th><th>Findings</th><th>Files</th></tr>"
+            );
+            for (rule, (edits, findings, files)) in &summary {
+                let _ = writeln!(
+                    out,
+                    "<tr><td><a href=\"#{}\"><code>{}</code></a></td><td>{}</td><td>{}</td><td>{}</td></tr>",
+                    anchor(rule),
+                    escape(rule),
+                    edits,
+                    findings,
+                    files.len()
+                );
+            }
+            let _ = writeln!(out, "</table>");
+        }
+
+        // Table of contents: each section and its files
+        let _ = writeln!(out, "<nav>\n<ul>");
+        for (rule, files) in &sections {
+            let _ = writeln!(
+                out,
+                "<li><a href=\"#{}\">{}</a>\n<ul>",
+                anchor(rule),
+                escape(rule)
+            );
+            for path in files.keys() {
+                let path = self.relative(path).display().to_string();
+                let _ = writeln!(
+                    out,
+                    "<li><a href=\"#{}\">{}</a></li>",
+                    anchor(&format!("{} {}", rule, path)),
+                    escape(&path)
+                );
+            }
+            let _ = writeln!(out, "</ul></li>");
+        }
+        let _ = writeln!(out, "</ul>\n</nav>");
+
+        for (rule, files) in &sections {
+            let _ = writeln!(
+                out,
+                "<section>\n<h2 id=\"{}\">{}</h2>",
+                anchor(rule),
+                escape(rule)
+            );
+            for (path, snippets) in files {
+                let path = self.relative(path);
+                let class = match language(path) {
+                    "" => String::new(),
+                    language => format!(" class=\"language-{}\"", language),
+                };
+                let display = path.display().to_string();
+                let _ = writeln!(
+                    out,
+                    "<h3 id=\"{}\">{}</h3>",
+                    anchor(&format!("{} {}", rule, display)),
+                    escape(&display)
+                );
+                for snippet in snippets {
+                    let _ = writeln!(
+                        out,
+                        "<table class=\"snippet\">\n<tr><th>Line {} before</th><th>After</th></tr>\n<tr><td><pre><code{}>{}</code></pre></td><td><pre><code{}>{}</code></pre></td></tr>\n</table>",
+                        snippet.line,
+                        class,
+                        escape(&snippet.before),
+                        class,
+                        escape(&snippet.after)
+                    );
+                }
+            }
+            let _ = writeln!(out, "</section>");
+        }
+        let _ = write!(
+            out,
+            "<script>hljs.highlightAll();</script>\n</body>\n</html>\n"
+        );
+        out
+    }
+}
+
+/// Styles and the highlighter of the HTML report. Without network access
+/// the page still renders, without colors.
+const HTML_HEAD: &str = r#"<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/styles/github.min.css">
+<script src="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/highlight.min.js"></script>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 80em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ddd; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+table.snippet { width: 100%; table-layout: fixed; margin-bottom: 1em; }
+pre { margin: 0; overflow-x: auto; }
+</style>"#;
+
+/// The changed regions between `original` and `transformed`, with
+/// [`CONTEXT`] unchanged lines around each, and the 1-based line where
+/// each starts in `transformed`.
+fn snippets(original: &str, transformed: &str) -> Vec<(Snippet, usize)> {
+    let diff = TextDiff::from_lines(original, transformed);
+    let changes: Vec<_> = diff.iter_all_changes().collect();
+
+    // Ranges of changes, widened by the context and merged when they overlap
+    let mut ranges: Vec<(usize, usize)> = Vec::new();
+    for (index, change) in changes.iter().enumerate() {
+        if change.tag() == ChangeTag::Equal {
+            continue;
+        }
+        let start = index.saturating_sub(CONTEXT);
+        let end = (index + CONTEXT + 1).min(changes.len());
+        match ranges.last_mut() {
+            Some(last) if start < last.1 => last.1 = end,
+            _ => ranges.push((start, end)),
+        }
+    }
+
+    ranges
+        .into_iter()
+        .map(|(start, end)| {
+            let region = &changes[start..end];
+            // The first line of the region in the original or transformed text
+            let first = |original: bool| {
+                let index = |i: usize| {
+                    if original {
+                        changes[i].old_index()
+                    } else {
+                        changes[i].new_index()
+                    }
+                };
+                (start..end)
+                    .find_map(index)
+                    .or_else(|| (0..start).rev().find_map(index))
+                    .map_or(1, |index| index + 1)
+            };
+            let side = |skipped: ChangeTag| -> String {
+                region
+                    .iter()
+                    .filter(|c| c.tag() != skipped)
+                    .map(|c| c.value())
+                    .collect()
+            };
+            let snippet = Snippet {
+                line: first(true),
+                before: side(ChangeTag::Insert),
+                after: side(ChangeTag::Delete),
+                rules: Vec::new(),
+            };
+            (snippet, first(false))
+        })
+        .collect()
+}
+
+/// The highlighter's name for the language of `path`, or `""` if unknown.
+fn language(path: &Path) -> &'static str {
+    match path
+        .extension()
+        .and_then(|e| e.to_str())
+        .unwrap_or_default()
+    {
+        "go" => "go",
+        "rs" => "rust",
+        "py" | "pyi" => "python",
+        "ts" | "tsx" => "typescript",
+        "js" | "jsx" | "mjs" | "cjs" => "javascript",
+        "java" => "java",
+        "cs" => "csharp",
+        "rb" => "ruby",
+        "md" => "markdown",
+        "yaml" | "yml" => "yaml",
+        _ => "",
+    }
+}
+
+/// The anchor Markdown renderers give a heading: lowercase letters, digits,
+/// `-` and `_`, with spaces as `-`.
+fn anchor(heading: &str) -> String {
+    heading
+        .to_lowercase()
+        .chars()
+        .filter_map(|c| match c {
+            ' ' => Some('-'),
+            c if c.is_alphanumeric() || c == '-' || c == '_' => Some(c),
+            _ => None,
+        })
+        .collect()
+}
+
+/// Code for a fenced block: ending with a newline, with any fence in it
+/// broken up.
+fn fenced(code: &str) -> String {
+    let mut code = code.replace("```", "`\u{200b}``");
+    if !code.ends_with('\n') {
+        code.push('\n');
+    }
+    code
+}
+
+fn escape(text: &str) -> String {
+    text.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::runner::RuleEdit;
+    use crate::transform::FileChange;
+
+    fn report() -> RunReport {
+        RunReport {
+            changes: vec![FileChange {
+                path: "/repo/main.go".into(),
+                original: "package main\n\nimport \"lib\"\n\nfunc main() {\n\tlib.GetUser(1)\n\tx := 1\n\ty := 2\n\tlib.GetUser(x < y)\n}\n".into(),
+                transformed: "package main\n\nimport (\n\tlib \"lib/v2\"\n)\n\nfunc main() {\n\tlib.FetchUser(1)\n\tx := 1\n\ty := 2\n\tlib.FetchUser(x < y)\n}\n".into(),
+            }],
+            // Lines of the upgraded file, two below the original ones
+            edits: [8, 11]
+                .into_iter()
+                .map(|line| RuleEdit {
+                    rule: "rename-get-user".to_string(),
+                    path: "/repo/main.go".into(),
+                    line,
+                    todo: false,
+                })
+                .collect(),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_snippets_by_rule() {
+        let report = report();
+        let migration = MigrationReport::new("mylib-v2", "/repo", &report);
+        let snippets = migration.snippets(Path::new("/repo/main.go"));
+        let found: Vec<(usize, &str, &[String])> = snippets
+            .iter()
+            .map(|s| (s.line, s.after.as_str(), s.rules.as_slice()))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                (2, "\nimport (\n\tlib \"lib/v2\"\n)\n\n", &[][..]),
+                (
+                    5,
+                    "func main() {\n\tlib.FetchUser(1)\n\tx := 1\n",
+                    &["rename-get-user".to_string()][..]
+                ),
+                (
+                    8,
+                    "\ty := 2\n\tlib.FetchUser(x < y)\n}\n",
+                    &["rename-get-user".to_string()][..]
+                ),
+            ]
+        );
+
+        let markdown = migration.to_markdown();
+        assert!(markdown.contains("| [`rename-get-user`](#rename-get-user) | 2 | 0 | 1 |"));
+        assert!(markdown.contains(
+            "## `rename-get-user`\n\n### `main.go`\n\nLine 5, before:\n\n```go\nfunc main() {\n\tlib.GetUser(1)\n"
+        ));
+        assert!(markdown.contains("\n## Other changes\n"));
+
+        let html = migration.to_html();
+        assert!(html.contains("<h2 id=\"rename-get-user\">rename-get-user</h2>"));
+        assert!(html.contains("<a href=\"#rename-get-user-maingo\">main.go</a>"));
+        assert!(
+            html.contains(
+                "<code class=\"language-go\">\ty := 2\n\tlib.GetUser(x &lt; y)\n}\n</code>"
+            )
+        );
+    }
+}
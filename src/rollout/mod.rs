@@ -0,0 +1,572 @@
+//! Staged rollout plans for large migrations.
+//!
+//! Applying every rule of a big pack in one change is hard to review and
+//! hard to land. A [`RolloutPlan`] splits the migration into phases, each
+//! with the rules it applies, the part of the tree it touches, the
+//! verification gate it has to pass, the people who own the code it
+//! changes and how many weeks it is planned to take. The plan is a YAML
+//! file teams can edit and check in, rendered as Markdown
+//! ([`RolloutPlan::to_markdown`]) or a Mermaid Gantt chart
+//! ([`RolloutPlan::to_mermaid`]) for the migration's tracking issue, and the
+//! CLI runs it one phase at a time, marking each phase done once its gate
+//! passes.
+//!
+//! [`RolloutPlan::generate`] drafts a plan from a dry run of the pack: the
+//! rules are split, in pack order, into phases of about the same number of
+//! rewritten sites, suggest-only rules get a final phase for the manual
+//! follow-up, and owners come from the repository's CODEOWNERS file.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::rollout::{RolloutOptions, RolloutPlan};
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let config = UpgradeConfig::from_file("upgrade.yaml")?;
+//! let report = UpgradeRunner::new(config.clone()).dry_run().run("./project")?;
+//! let plan = RolloutPlan::generate("upgrade.yaml", &config, &report, &RolloutOptions::default());
+//! println!("{}", plan.to_mermaid());
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+mod owners;
+
+pub use owners::CodeOwners;
+
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt::Write as _;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::analyzer::UpgradeConfig;
+use crate::error::{RefactorError, Result};
+use crate::runner::RunReport;
+
+/// The checks a phase has to pass before it is done.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct Gate {
+    /// Build or type-check the project.
+    pub build: bool,
+    /// Run the project's tests.
+    pub tests: bool,
+    /// Command to build with, instead of the one detected from the project.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub command: Option<String>,
+}
+
+impl Default for Gate {
+    fn default() -> Self {
+        Self {
+            build: true,
+            tests: false,
+            command: None,
+        }
+    }
+}
+
+impl Gate {
+    fn describe(&self) -> String {
+        let mut checks = Vec::new();
+        if self.build {
+            checks.push(match &self.command {
+                Some(command) => format!("`{}`", command),
+                None => "build".to_string(),
+            });
+        }
+        if self.tests {
+            checks.push("tests".to_string());
+        }
+        if checks.is_empty() {
+            "none".to_string()
+        } else {
+            checks.join(" + ")
+        }
+    }
+}
+
+/// Progress of a phase.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum PhaseStatus {
+    /// Not run yet.
+    #[default]
+    Pending,
+    /// Applied and through its gate.
+    Done,
+}
+
+/// One phase of a rollout.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RolloutPhase {
+    /// Name of the phase.
+    pub name: String,
+    /// Rules the phase applies, by id (or description for rules without
+    /// one).
+    pub rules: Vec<String>,
+    /// Only touch files matching these globs.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub include: Vec<String>,
+    /// Leave files matching these globs alone.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub exclude: Vec<String>,
+    /// Checks the phase has to pass.
+    #[serde(default)]
+    pub gate: Gate,
+    /// Owners who review and land the phase.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub owners: Vec<String>,
+    /// Planned duration in weeks.
+    #[serde(default = "default_weeks")]
+    pub weeks: u32,
+    /// Sites the phase's rules rewrote or reported when the plan was made.
+    #[serde(default)]
+    pub sites: usize,
+    /// Progress of the phase.
+    #[serde(default)]
+    pub status: PhaseStatus,
+}
+
+fn default_weeks() -> u32 {
+    1
+}
+
+/// A migration split into phases run one after another.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RolloutPlan {
+    /// Name of the rollout.
+    pub name: String,
+    /// The pack the phases apply rules of.
+    pub pack: PathBuf,
+    /// First day of the first phase (`YYYY-MM-DD`).
+    pub start: String,
+    /// The phases, in the order they run.
+    pub phases: Vec<RolloutPhase>,
+}
+
+/// How [`RolloutPlan::generate`] drafts a plan.
+#[derive(Debug, Clone)]
+pub struct RolloutOptions {
+    /// Number of phases to split the rules that rewrite code into.
+    pub phases: usize,
+    /// Weeks planned for each phase.
+    pub weeks: u32,
+    /// First day of the rollout (`YYYY-MM-DD`); today if unset.
+    pub start: Option<String>,
+    /// Code owners of the repository, for the owners of each phase.
+    pub owners: Option<CodeOwners>,
+    /// Root of the project the dry run ran on, for matching owners.
+    pub root: PathBuf,
+}
+
+impl Default for RolloutOptions {
+    fn default() -> Self {
+        Self {
+            phases: 3,
+            weeks: 1,
+            start: None,
+            owners: None,
+            root: PathBuf::from("."),
+        }
+    }
+}
+
+impl RolloutPlan {
+    /// Draft a plan for applying `config`, read from `pack`, given a dry run
+    /// of it.
+    pub fn generate(
+        pack: impl Into<PathBuf>,
+        config: &UpgradeConfig,
+        report: &RunReport,
+        options: &RolloutOptions,
+    ) -> Self {
+        let mut sites: BTreeMap<String, usize> = BTreeMap::new();
+        let mut files: BTreeMap<String, BTreeSet<&Path>> = BTreeMap::new();
+        for edit in &report.edits {
+            *sites.entry(edit.rule.clone()).or_default() += 1;
+            files
+                .entry(edit.rule.clone())
+                .or_default()
+                .insert(&edit.path);
+        }
+        for diagnostic in &report.diagnostics {
+            *sites.entry(diagnostic.rule.clone()).or_default() += 1;
+            files
+                .entry(diagnostic.rule.clone())
+                .or_default()
+                .insert(&diagnostic.path);
+        }
+
+        let (manual, apply): (Vec<_>, Vec<_>) = config
+            .transforms
+            .iter()
+            .partition(|rule| rule.is_suggest_only());
+        let manual: Vec<String> = manual.into_iter().map(|rule| rule.name()).collect();
+        let apply: Vec<String> = apply.into_iter().map(|rule| rule.name()).collect();
+        let sites_of = |name: &String| sites.get(name).copied().unwrap_or(0);
+
+        let mut groups: Vec<Vec<String>> = Vec::new();
+        let total: usize = apply.iter().map(sites_of).sum();
+        let count = options.phases.clamp(1, apply.len().max(1));
+        let mut done = 0;
+        for name in apply {
+            // Start the next phase once this one has its share of the sites
+            let target = (groups.len() * total).div_ceil(count);
+            if groups.is_empty() || (done >= target && groups.len() < count) {
+                groups.push(Vec::new());
+            }
+            done += sites_of(&name);
+            if let Some(group) = groups.last_mut() {
+                group.push(name);
+            }
+        }
+
+        let mut phases: Vec<RolloutPhase> = groups
+            .into_iter()
+            .enumerate()
+            .map(|(index, rules)| RolloutPhase {
+                name: format!("Phase {}", index + 1),
+                rules,
+                include: Vec::new(),
+                exclude: Vec::new(),
+                gate: Gate::default(),
+                owners: Vec::new(),
+                weeks: options.weeks,
+                sites: 0,
+                status: PhaseStatus::Pending,
+            })
+            .collect();
+        if !manual.is_empty() {
+            phases.push(RolloutPhase {
+                name: "Manual follow-up".to_string(),
+                rules: manual,
+                include: Vec::new(),
+                exclude: Vec::new(),
+                gate: Gate::default(),
+                owners: Vec::new(),
+                weeks: options.weeks,
+                sites: 0,
+                status: PhaseStatus::Pending,
+            });
+        }
+        if let Some(last) = phases.last_mut() {
+            last.gate.tests = true;
+        }
+        for phase in &mut phases {
+            phase.sites = phase.rules.iter().map(sites_of).sum();
+            if let Some(owners) = &options.owners {
+                let touched: BTreeSet<&Path> = phase
+                    .rules
+                    .iter()
+                    .filter_map(|rule| files.get(rule))
+                    .flatten()
+                    .copied()
+                    .collect();
+                let found: BTreeSet<&String> = touched
+                    .into_iter()
+                    .flat_map(|path| {
+                        owners.owners(path.strip_prefix(&options.root).unwrap_or(path))
+                    })
+                    .collect();
+                phase.owners = found.into_iter().cloned().collect();
+            }
+        }
+
+        Self {
+            name: format!("{} rollout", config.name),
+            pack: pack.into(),
+            start: options
+                .start
+                .clone()
+                .unwrap_or_else(crate::codemod::chrono_lite_date),
+            phases,
+        }
+    }
+
+    /// Load a plan from a YAML or JSON file.
+    pub fn load(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref();
+        let content = fs::read_to_string(path)?;
+        if path.extension().is_some_and(|ext| ext == "json") {
+            Ok(serde_json::from_str(&content)?)
+        } else {
+            serde_yaml::from_str(&content).map_err(|e| {
+                RefactorError::InvalidConfig(format!(
+                    "Invalid rollout plan {}: {}",
+                    path.display(),
+                    e
+                ))
+            })
+        }
+    }
+
+    /// Save the plan as YAML, or JSON for a `.json` path.
+    pub fn save(&self, path: impl AsRef<Path>) -> Result<()> {
+        let path = path.as_ref();
+        let content = if path.extension().is_some_and(|ext| ext == "json") {
+            serde_json::to_string_pretty(self)?
+        } else {
+            serde_yaml::to_string(self).map_err(|e| {
+                RefactorError::InvalidConfig(format!("Failed to serialize plan: {}", e))
+            })?
+        };
+        fs::write(path, content)?;
+        Ok(())
+    }
+
+    /// The first phase not done yet.
+    pub fn next_phase(&self) -> Option<&RolloutPhase> {
+        self.phases
+            .iter()
+            .find(|phase| phase.status == PhaseStatus::Pending)
+    }
+
+    /// The phase called `name`.
+    pub fn phase(&self, name: &str) -> Option<&RolloutPhase> {
+        self.phases.iter().find(|phase| phase.name == name)
+    }
+
+    /// Mark the phase called `name` done.
+    pub fn complete(&mut self, name: &str) -> Result<()> {
+        let phase = self
+            .phases
+            .iter_mut()
+            .find(|phase| phase.name == name)
+            .ok_or_else(|| RefactorError::InvalidConfig(format!("No phase named '{}'", name)))?;
+        phase.status = PhaseStatus::Done;
+        Ok(())
+    }
+
+    /// `config` restricted to the rules of `phase`, in pack order. Rules the
+    /// phase names that the pack does not have are an error, so a renamed
+    /// rule is not silently skipped.
+    pub fn phase_config(
+        &self,
+        phase: &RolloutPhase,
+        config: &UpgradeConfig,
+    ) -> Result<UpgradeConfig> {
+        let missing: Vec<&str> = phase
+            .rules
+            .iter()
+            .filter(|name| !config.transforms.iter().any(|rule| rule.name() == **name))
+            .map(String::as_str)
+            .collect();
+        if !missing.is_empty() {
+            return Err(RefactorError::InvalidConfig(format!(
+                "Phase '{}' names rules '{}' does not have: {}",
+                phase.name,
+                config.name,
+                missing.join(", ")
+            )));
+        }
+        let mut config = config.clone();
+        config
+            .transforms
+            .retain(|rule| phase.rules.contains(&rule.name()));
+        Ok(config)
+    }
+
+    /// The plan as Markdown: a table of the phases followed by the rules of
+    /// each.
+    pub fn to_markdown(&self) -> String {
+        let mut out = format!("# {}\n\n", self.name);
+        let _ = writeln!(
+            out,
+            "Pack: `{}` · Start: {} · {} week(s)\n",
+            self.pack.display(),
+            self.start,
+            self.phases.iter().map(|phase| phase.weeks).sum::<u32>()
+        );
+        out.push_str("| Phase | Weeks | Rules | Sites | Gate | Owners | Status |\n");
+        out.push_str("|---|---|---|---|---|---|---|\n");
+        for phase in &self.phases {
+            let _ = writeln!(
+                out,
+                "| {} | {} | {} | {} | {} | {} | {} |",
+                phase.name,
+                phase.weeks,
+                phase.rules.len(),
+                phase.sites,
+                phase.gate.describe(),
+                if phase.owners.is_empty() {
+                    "-".to_string()
+                } else {
+                    phase.owners.join(", ")
+                },
+                match phase.status {
+                    PhaseStatus::Pending => "pending",
+                    PhaseStatus::Done => "done",
+                }
+            );
+        }
+        for phase in &self.phases {
+            let _ = write!(out, "\n## {}\n\n", phase.name);
+            if !phase.include.is_empty() {
+                let _ = writeln!(out, "Files: `{}`\n", phase.include.join("`, `"));
+            }
+            for rule in &phase.rules {
+                let _ = writeln!(out, "- `{}`", rule);
+            }
+        }
+        out
+    }
+
+    /// The plan as a Mermaid Gantt chart, each phase starting when the one
+    /// before it ends.
+    pub fn to_mermaid(&self) -> String {
+        let mut out = String::from("gantt\n");
+        let _ = writeln!(out, "    title {}", self.name);
+        out.push_str("    dateFormat YYYY-MM-DD\n");
+        out.push_str("    section Rollout\n");
+        for (index, phase) in self.phases.iter().enumerate() {
+            let status = match phase.status {
+                PhaseStatus::Done => "done, ",
+                PhaseStatus::Pending => "",
+            };
+            let start = if index == 0 {
+                self.start.clone()
+            } else {
+                format!("after p{}", index)
+            };
+            let _ = writeln!(
+                out,
+                "    {} ({} rules) :{}p{}, {}, {}d",
+                phase.name.replace(':', " "),
+                phase.rules.len(),
+                status,
+                index + 1,
+                start,
+                phase.weeks * 7
+            );
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformRule, TransformSpec};
+    use crate::runner::{Diagnostic, RuleEdit};
+
+    fn rename(old: &str, new: &str) -> TransformRule {
+        TransformRule::new(TransformSpec::RenameFunction {
+            old_name: old.to_string(),
+            new_name: new.to_string(),
+        })
+        .with_id(format!("rename-{}", old.to_lowercase()))
+    }
+
+    fn plan() -> RolloutPlan {
+        let mut config = UpgradeConfig::new("mylib-v2", "");
+        config.add_transform(rename("Dial", "Connect"));
+        config.add_transform(rename("Close", "Shutdown"));
+        config.add_transform(rename("Get", "Fetch"));
+        config.add_transform(rename("Legacy", "Legacy").suggest_only());
+
+        let edit = |rule: &str, path: &str| RuleEdit {
+            rule: rule.to_string(),
+            path: PathBuf::from(path),
+            line: 1,
+            todo: false,
+        };
+        let mut report = RunReport {
+            edits: vec![
+                edit("rename-dial", "billing/a.go"),
+                edit("rename-dial", "billing/b.go"),
+                edit("rename-close", "main.go"),
+                edit("rename-get", "main.go"),
+            ],
+            ..Default::default()
+        };
+        report.diagnostics.push(Diagnostic {
+            rule: "rename-legacy".to_string(),
+            message: String::new(),
+            path: PathBuf::from("main.go"),
+            line: 1,
+            column: 1,
+            text: String::new(),
+            suggestion: String::new(),
+        });
+
+        let options = RolloutOptions {
+            phases: 2,
+            start: Some("2026-11-02".to_string()),
+            owners: Some(CodeOwners::parse("* @acme/platform\n/billing/ @acme/billing\n").unwrap()),
+            ..Default::default()
+        };
+        RolloutPlan::generate("upgrade.yaml", &config, &report, &options)
+    }
+
+    #[test]
+    fn test_generate_plan() {
+        let plan = plan();
+        let phases: Vec<(&str, Vec<&str>, usize)> = plan
+            .phases
+            .iter()
+            .map(|p| {
+                (
+                    p.name.as_str(),
+                    p.rules.iter().map(String::as_str).collect(),
+                    p.sites,
+                )
+            })
+            .collect();
+        assert_eq!(
+            phases,
+            [
+                ("Phase 1", vec!["rename-dial"], 2),
+                ("Phase 2", vec!["rename-close", "rename-get"], 2),
+                ("Manual follow-up", vec!["rename-legacy"], 1),
+            ]
+        );
+        assert_eq!(plan.phases[0].owners, ["@acme/billing"]);
+        assert_eq!(plan.phases[1].owners, ["@acme/platform"]);
+        assert!(!plan.phases[1].gate.tests);
+        assert!(plan.phases[2].gate.tests);
+        assert_eq!(plan.name, "mylib-v2 rollout");
+    }
+
+    #[test]
+    fn test_run_phases_in_order() {
+        let mut plan = plan();
+        let mut config = UpgradeConfig::new("mylib-v2", "");
+        config.add_transform(rename("Dial", "Connect"));
+        config.add_transform(rename("Close", "Shutdown"));
+        config.add_transform(rename("Get", "Fetch"));
+
+        let first = plan.next_phase().unwrap().clone();
+        assert_eq!(
+            plan.phase_config(&first, &config).unwrap().transforms.len(),
+            1
+        );
+        plan.complete(&first.name).unwrap();
+        assert_eq!(plan.next_phase().unwrap().name, "Phase 2");
+        assert!(plan.complete("Phase 9").is_err());
+
+        let manual = plan.phase("Manual follow-up").unwrap();
+        assert!(plan.phase_config(manual, &config).is_err());
+
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("rollout.yaml");
+        plan.save(&path).unwrap();
+        assert_eq!(RolloutPlan::load(&path).unwrap(), plan);
+    }
+
+    #[test]
+    fn test_render_plan() {
+        let mut plan = plan();
+        plan.complete("Phase 1").unwrap();
+        let markdown = plan.to_markdown();
+        assert!(markdown.starts_with("# mylib-v2 rollout\n"));
+        assert!(markdown.contains("| Phase 1 | 1 | 1 | 2 | build | @acme/billing | done |"));
+        assert!(markdown.contains("| Manual follow-up | 1 | 1 | 1 | build + tests |"));
+        assert!(markdown.contains("## Phase 2\n\n- `rename-close`\n- `rename-get`\n"));
+
+        let mermaid = plan.to_mermaid();
+        assert!(mermaid.contains("Phase 1 (1 rules) :done, p1, 2026-11-02, 7d\n"));
+        assert!(mermaid.contains("Phase 2 (2 rules) :p2, after p1, 7d\n"));
+    }
+}
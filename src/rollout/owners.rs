@@ -0,0 +1,103 @@
+//! Code owners of the files a phase touches.
+
+use globset::{Glob, GlobSet, GlobSetBuilder};
+use std::fs;
+use std::path::Path;
+
+use crate::error::Result;
+
+/// Where a CODEOWNERS file may live, in the order GitHub looks.
+const LOCATIONS: &[&str] = &[".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"];
+
+/// The rules of a CODEOWNERS file. The last rule matching a path wins.
+#[derive(Debug, Clone, Default)]
+pub struct CodeOwners {
+    rules: Vec<(GlobSet, Vec<String>)>,
+}
+
+impl CodeOwners {
+    /// Parse the content of a CODEOWNERS file.
+    pub fn parse(content: &str) -> Result<Self> {
+        let mut rules = Vec::new();
+        for line in content.lines() {
+            let line = line.split('#').next().unwrap_or_default().trim();
+            let mut fields = line.split_whitespace();
+            let Some(pattern) = fields.next() else {
+                continue;
+            };
+            let owners = fields.map(str::to_string).collect();
+            let mut set = GlobSetBuilder::new();
+            for glob in globs(pattern) {
+                set.add(Glob::new(&glob)?);
+            }
+            rules.push((set.build()?, owners));
+        }
+        Ok(Self { rules })
+    }
+
+    /// Load the CODEOWNERS file of the repository at `root`, if it has one.
+    pub fn discover(root: impl AsRef<Path>) -> Result<Option<Self>> {
+        let root = root.as_ref();
+        for location in LOCATIONS {
+            let path = root.join(location);
+            if path.is_file() {
+                return Self::parse(&fs::read_to_string(path)?).map(Some);
+            }
+        }
+        Ok(None)
+    }
+
+    /// The owners of `path`, relative to the repository root.
+    pub fn owners(&self, path: &Path) -> &[String] {
+        self.rules
+            .iter()
+            .rev()
+            .find(|(matcher, _)| matcher.is_match(path))
+            .map_or(&[], |(_, owners)| owners.as_slice())
+    }
+}
+
+/// Globs for a CODEOWNERS pattern, which follows gitignore rules: a
+/// pattern without a slash matches at any depth, a leading slash anchors it
+/// to the root, and a directory matches everything under it.
+fn globs(pattern: &str) -> Vec<String> {
+    let anchored = pattern.starts_with('/') || pattern.trim_end_matches('/').contains('/');
+    let mut glob = pattern.trim_start_matches('/').to_string();
+    if !anchored && !glob.starts_with("**/") {
+        glob = format!("**/{}", glob);
+    }
+    if glob.ends_with('/') {
+        glob.push_str("**");
+        vec![glob]
+    } else if glob.contains('*') {
+        vec![glob]
+    } else {
+        vec![format!("{}/**", glob), glob]
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_code_owners() {
+        let owners = CodeOwners::parse(
+            "# Default owners\n* @acme/platform\n\n/billing/ @acme/billing @alice\n*.md @acme/docs\ninternal/store @acme/storage\n",
+        )
+        .unwrap();
+        assert_eq!(owners.owners(Path::new("main.go")), ["@acme/platform"]);
+        assert_eq!(
+            owners.owners(Path::new("billing/invoice/pdf.go")),
+            ["@acme/billing", "@alice"]
+        );
+        assert_eq!(
+            owners.owners(Path::new("billing/README.md")),
+            ["@acme/docs"]
+        );
+        assert_eq!(
+            owners.owners(Path::new("internal/store/user.go")),
+            ["@acme/storage"]
+        );
+    }
+}
@@ -0,0 +1,206 @@
+//! Content-hash cache of per-file analysis results.
+//!
+//! Files that no rule rewrote are recorded with a hash of their content,
+//! along with any suggest-rule findings, rule overlaps and `TODO(refactor)`
+//! count. On the
+//! next run with the same rules, files whose content hash still matches are
+//! not re-analyzed. Each rule set gets its own cache file, so changing a rule
+//! (or the engine version) starts from an empty cache. A long-running
+//! process keeps the cache in a [`MemoryCache`] instead of on disk.
+
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+
+use super::{Diagnostic, RuleOverlap};
+use crate::analyzer::UpgradeConfig;
+use crate::diff::fnv1a;
+use crate::error::Result;
+
+/// Default cache location, relative to the project root.
+pub const DEFAULT_CACHE_DIR: &str = ".refactor-dsl/cache";
+
+/// Cached result for a file that no rule rewrote.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub(crate) struct CacheEntry {
+    pub hash: String,
+    pub diagnostics: Vec<Diagnostic>,
+    #[serde(default)]
+    pub overlaps: Vec<RuleOverlap>,
+    pub manual_todos: usize,
+}
+
+/// Cached results of the files of one project root and rule set.
+type Entries = HashMap<PathBuf, CacheEntry>;
+
+/// Analysis results kept in memory across the runs of a process, by
+/// project root and rule set. Clones share the same results.
+#[derive(Debug, Clone, Default)]
+pub struct MemoryCache {
+    rulesets: Arc<Mutex<HashMap<(PathBuf, String), Entries>>>,
+}
+
+impl MemoryCache {
+    /// Create an empty cache.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Drop all cached results.
+    pub fn clear(&self) {
+        self.rulesets.lock().expect("cache lock poisoned").clear();
+    }
+}
+
+/// Where an [`AnalysisCache`] is kept between runs.
+enum Store {
+    File(PathBuf),
+    Memory(MemoryCache, (PathBuf, String)),
+}
+
+/// Analysis results keyed by path relative to the project root.
+pub(crate) struct AnalysisCache {
+    store: Store,
+    files: HashMap<PathBuf, CacheEntry>,
+}
+
+impl AnalysisCache {
+    /// Open the cache for `config`'s rules in `dir`. A missing or unreadable
+    /// cache file starts empty.
+    pub fn open(dir: &Path, config: &UpgradeConfig) -> Result<Self> {
+        let path = dir.join(format!("{}.json", ruleset_hash(config)?));
+        let files = fs::read_to_string(&path)
+            .ok()
+            .and_then(|text| serde_json::from_str(&text).ok())
+            .unwrap_or_default();
+        Ok(Self {
+            store: Store::File(path),
+            files,
+        })
+    }
+
+    /// Open the cache for `config`'s rules run under `root` in `memory`.
+    pub fn in_memory(memory: &MemoryCache, root: &Path, config: &UpgradeConfig) -> Result<Self> {
+        let key = (root.to_path_buf(), ruleset_hash(config)?);
+        let files = memory
+            .rulesets
+            .lock()
+            .expect("cache lock poisoned")
+            .get(&key)
+            .cloned()
+            .unwrap_or_default();
+        Ok(Self {
+            store: Store::Memory(memory.clone(), key),
+            files,
+        })
+    }
+
+    /// The cached entry for `rel`, if its content hash still matches.
+    pub fn get(&self, rel: &Path, hash: &str) -> Option<&CacheEntry> {
+        self.files.get(rel).filter(|entry| entry.hash == hash)
+    }
+
+    /// Record the entries of the latest run and drop entries for files that
+    /// no longer exist under `root`.
+    pub fn save(&mut self, root: &Path, entries: HashMap<PathBuf, CacheEntry>) -> Result<()> {
+        self.files.retain(|rel, _| root.join(rel).is_file());
+        self.files.extend(entries);
+        match &self.store {
+            Store::File(path) => {
+                if let Some(parent) = path.parent() {
+                    fs::create_dir_all(parent)?;
+                }
+                fs::write(path, serde_json::to_string(&self.files)?)?;
+            }
+            Store::Memory(memory, key) => {
+                memory
+                    .rulesets
+                    .lock()
+                    .expect("cache lock poisoned")
+                    .insert(key.clone(), self.files.clone());
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Hash of a file's content.
+pub(crate) fn content_hash(content: &str) -> String {
+    format!("{:016x}", fnv1a(content.as_bytes()))
+}
+
+/// Identifies the rules (and engine version) a cache was built with.
+fn ruleset_hash(config: &UpgradeConfig) -> Result<String> {
+    let rules = serde_json::to_string(&(
+        env!("CARGO_PKG_VERSION"),
+        &config.transforms,
+        &config.extensions,
+        &config.exclude_patterns,
+        &config.engine,
+    ))?;
+    Ok(content_hash(&rules))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::TransformSpec;
+
+    #[test]
+    fn test_cache_is_keyed_by_rules_and_content() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let mut config = UpgradeConfig::new("test", "Test upgrade");
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "a".to_string(),
+            to: "b".to_string(),
+        });
+
+        fs::write(dir.path().join("main.go"), "x\n").unwrap();
+        let mut cache = AnalysisCache::open(dir.path(), &config).unwrap();
+        let entry = CacheEntry {
+            hash: content_hash("x\n"),
+            diagnostics: Vec::new(),
+            overlaps: Vec::new(),
+            manual_todos: 2,
+        };
+        cache
+            .save(
+                dir.path(),
+                HashMap::from([(PathBuf::from("main.go"), entry)]),
+            )
+            .unwrap();
+
+        let cache = AnalysisCache::open(dir.path(), &config).unwrap();
+        let hit = cache.get(Path::new("main.go"), &content_hash("x\n"));
+        assert_eq!(hit.map(|e| e.manual_todos), Some(2));
+
+        let memory = MemoryCache::new();
+        let entries = cache.files.clone();
+        let mut cache = AnalysisCache::in_memory(&memory, dir.path(), &config).unwrap();
+        cache.save(dir.path(), entries).unwrap();
+        let cache = AnalysisCache::in_memory(&memory, dir.path(), &config).unwrap();
+        assert!(
+            cache
+                .get(Path::new("main.go"), &content_hash("x\n"))
+                .is_some()
+        );
+        assert!(
+            cache
+                .get(Path::new("main.go"), &content_hash("y\n"))
+                .is_none()
+        );
+
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "c".to_string(),
+            to: "d".to_string(),
+        });
+        let cache = AnalysisCache::open(dir.path(), &config).unwrap();
+        assert!(
+            cache
+                .get(Path::new("main.go"), &content_hash("x\n"))
+                .is_none()
+        );
+    }
+}
@@ -0,0 +1,261 @@
+//! Migrations through several releases, one stage at a time.
+//!
+//! A client several major versions behind a library cannot jump straight to
+//! the latest release: each release's pack is written against the code the
+//! previous one leaves. A [`Chain`] runs the packs of the intermediate
+//! releases as ordered stages (v1 → v2 → v3). Each stage is applied and
+//! verified before the next one starts, a failing stage is reverted and
+//! stops the chain, and the report attributes every change to the stage
+//! that made it. Stages the client is already past are skipped.
+
+use std::cmp::Ordering;
+use std::path::Path;
+
+use super::{Migration, MigrationPlan, StepReport, UpgradeRunner};
+use crate::error::{RefactorError, Result};
+use crate::security::compare_versions;
+
+/// Upgrades applied one after another, each verified before the next.
+#[derive(Clone, Default)]
+pub struct Chain {
+    stages: Vec<(String, UpgradeRunner)>,
+    from: Option<String>,
+}
+
+/// The stages a chain applied.
+#[derive(Debug, Default)]
+pub struct ChainReport {
+    /// Stages applied and verified, in order.
+    pub stages: Vec<StepReport>,
+    /// The stage that failed verification and was reverted; later stages
+    /// were not run.
+    pub failed: Option<StepReport>,
+    /// Stages skipped because the project is already past them.
+    pub skipped: Vec<String>,
+}
+
+impl ChainReport {
+    /// Returns true if every stage was applied.
+    pub fn completed(&self) -> bool {
+        self.failed.is_none()
+    }
+}
+
+impl Chain {
+    /// Create an empty chain.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Add a stage. Stages run in the order they are added, oldest release
+    /// first.
+    pub fn stage(mut self, name: impl Into<String>, runner: UpgradeRunner) -> Self {
+        self.stages.push((name.into(), runner));
+        self
+    }
+
+    /// Skip the stages migrating to `version` or an older release, which
+    /// the project already uses.
+    pub fn from_version(mut self, version: impl Into<String>) -> Self {
+        self.from = Some(version.into());
+        self
+    }
+
+    /// Names of the stages that will run, in order.
+    pub fn stages(&self) -> Vec<&str> {
+        self.pending().map(|(name, _)| name.as_str()).collect()
+    }
+
+    /// Check that consecutive stages meet: a stage declaring the release it
+    /// migrates from must follow the stage migrating to that release.
+    pub fn validate(&self) -> Result<()> {
+        if self.stages.is_empty() {
+            return Err(RefactorError::InvalidConfig(
+                "A migration chain needs at least one stage".to_string(),
+            ));
+        }
+        for pair in self.stages.windows(2) {
+            let ((previous, before), (name, after)) = (&pair[0], &pair[1]);
+            if let (Some(to), Some(from)) =
+                (&before.config().to_version, &after.config().from_version)
+                && compare_versions(to, from) != Ordering::Equal
+            {
+                return Err(RefactorError::InvalidConfig(format!(
+                    "Stage '{}' migrates from {} but stage '{}' before it migrates to {}",
+                    name, from, previous, to
+                )));
+            }
+        }
+        Ok(())
+    }
+
+    /// Compute every stage against the tree at `root` without writing
+    /// anything; each stage sees the files as earlier stages left them.
+    pub fn plan(&self, root: impl AsRef<Path>) -> Result<MigrationPlan> {
+        self.validate()?;
+        self.pending()
+            .fold(Migration::new(), |migration, (name, runner)| {
+                migration.step(name, runner.clone())
+            })
+            .plan(root)
+    }
+
+    /// Apply the stages in order, calling `verify` after each. A stage for
+    /// which `verify` returns false is reverted and ends the chain; earlier
+    /// stages stay applied. If `verify` fails to run, the stage is reverted
+    /// and the error returned; a stage that fails to apply leaves no files
+    /// written (see [`UpgradeRunner::run`]).
+    pub fn run(
+        &self,
+        root: impl AsRef<Path>,
+        mut verify: impl FnMut(&StepReport) -> Result<bool>,
+    ) -> Result<ChainReport> {
+        self.validate()?;
+        let root = root.as_ref();
+        let mut report = ChainReport {
+            skipped: self
+                .stages
+                .iter()
+                .filter(|(_, runner)| self.is_past(runner))
+                .map(|(name, _)| name.clone())
+                .collect(),
+            ..Default::default()
+        };
+        for (name, runner) in self.pending() {
+            let step = StepReport {
+                name: name.clone(),
+                report: runner.run(root)?,
+            };
+            match verify(&step) {
+                Ok(true) => report.stages.push(step),
+                Ok(false) => {
+                    step.report.revert()?;
+                    report.failed = Some(step);
+                    break;
+                }
+                Err(e) => {
+                    let _ = step.report.revert();
+                    return Err(e);
+                }
+            }
+        }
+        Ok(report)
+    }
+
+    fn pending(&self) -> impl Iterator<Item = &(String, UpgradeRunner)> {
+        self.stages
+            .iter()
+            .filter(|(_, runner)| !self.is_past(runner))
+    }
+
+    /// Returns true if the project already uses the release `runner`
+    /// migrates to.
+    fn is_past(&self, runner: &UpgradeRunner) -> bool {
+        match (&self.from, &runner.config().to_version) {
+            (Some(from), Some(to)) => compare_versions(to, from) != Ordering::Greater,
+            _ => false,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformSpec, UpgradeConfig};
+    use std::fs;
+
+    fn stage(from_version: &str, to_version: &str, from: &str, to: &str) -> UpgradeRunner {
+        let mut config = UpgradeConfig::new(format!("pool-{}", to_version), "Test upgrade")
+            .with_extensions(vec!["go".to_string()])
+            .with_versions(from_version, to_version);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: from.to_string(),
+            to: to.to_string(),
+        });
+        UpgradeRunner::new(config)
+    }
+
+    fn chain() -> Chain {
+        Chain::new()
+            .stage("v2", stage("v1", "v2", "pool.Dial(", "pool.Connect("))
+            .stage(
+                "v3",
+                stage("v2", "v3", "pool.Connect(", "pool.Connect(ctx, "),
+            )
+    }
+
+    #[test]
+    fn test_chain_runs_stages_in_sequence() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let main = dir.path().join("main.go");
+        fs::write(&main, "c := pool.Dial(addr)\n").unwrap();
+
+        let plan = chain().plan(dir.path()).unwrap();
+        assert_eq!(plan.steps.len(), 2);
+        assert_eq!(plan.steps[1].report.files_modified(), 1);
+        assert_eq!(fs::read_to_string(&main).unwrap(), "c := pool.Dial(addr)\n");
+
+        let mut verified = Vec::new();
+        let report = chain()
+            .run(dir.path(), |step| {
+                verified.push(step.name.clone());
+                Ok(true)
+            })
+            .unwrap();
+        assert!(report.completed());
+        assert_eq!(verified, ["v2", "v3"]);
+        assert_eq!(
+            report.stages[0].report.edits[0].rule,
+            "replace_literal pool.Dial( -> pool.Connect("
+        );
+        assert_eq!(
+            fs::read_to_string(&main).unwrap(),
+            "c := pool.Connect(ctx, addr)\n"
+        );
+    }
+
+    #[test]
+    fn test_chain_stops_at_failing_stage() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let main = dir.path().join("main.go");
+        fs::write(&main, "c := pool.Dial(addr)\n").unwrap();
+
+        let report = chain()
+            .run(dir.path(), |step| Ok(step.name != "v3"))
+            .unwrap();
+        assert!(!report.completed());
+        assert_eq!(report.stages.len(), 1);
+        assert_eq!(report.failed.unwrap().name, "v3");
+        assert_eq!(
+            fs::read_to_string(&main).unwrap(),
+            "c := pool.Connect(addr)\n"
+        );
+
+        // A check that fails to run reverts its stage
+        let error = chain().from_version("v2.1.0").run(dir.path(), |_| {
+            Err(RefactorError::TransformFailed {
+                message: "go build failed to start".to_string(),
+            })
+        });
+        assert!(error.is_err());
+        assert_eq!(
+            fs::read_to_string(&main).unwrap(),
+            "c := pool.Connect(addr)\n"
+        );
+
+        // Already on v2: only the v3 stage runs
+        let from_v2 = chain().from_version("v2.1.0");
+        assert_eq!(from_v2.stages(), ["v3"]);
+        let report = from_v2.run(dir.path(), |_| Ok(true)).unwrap();
+        assert_eq!(report.skipped, ["v2"]);
+        assert_eq!(
+            fs::read_to_string(&main).unwrap(),
+            "c := pool.Connect(ctx, addr)\n"
+        );
+
+        let gap = Chain::new()
+            .stage("v2", stage("v1", "v2", "a", "b"))
+            .stage("v4", stage("v3", "v4", "b", "c"));
+        assert!(gap.validate().is_err());
+    }
+}
@@ -0,0 +1,492 @@
+//! Names a run would declare twice in a Go package.
+//!
+//! A rename can land on a name the package already uses: `GetUser ->
+//! FetchUser` in a package that still declares `FetchUser`, or a chain of
+//! renames ending on an existing type. A new name can also clash with a
+//! package a file imports. Either way the code no longer compiles, and the
+//! build error points at the symptom rather than the rule. [`detect`] finds
+//! the collisions a run introduced before any file is written; the runner
+//! then either blocks the run or, with
+//! [`UpgradeRunner::resolve_collisions`](super::UpgradeRunner::resolve_collisions),
+//! moves the rename that caused a collision to a free name by adding a
+//! numeric suffix (`FetchUser2`).
+
+use regex::Regex;
+use serde::Serialize;
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::fmt;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use super::variants::is_build_variant;
+use crate::analyzer::{TransformSpec, UpgradeConfig};
+use crate::transform::FileChange;
+
+static DECLARATION: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r"^(?:func\s*(?:\(\s*(?:\w+\s+)?\*?\s*(\w+)[^)]*\)\s*)?(\w+)|(?:type|const|var)\s+(\w+))",
+    )
+    .expect("invalid declaration regex")
+});
+
+static BLOCK_ENTRY: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"^\t(\w+)").expect("invalid block entry regex"));
+
+static IMPORT: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r#"^(?:import\s+)?(?:([\w.]+)\s+)?"([^"]+)""#).expect("invalid import regex")
+});
+
+static PACKAGE: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"(?m)^package\s+(\w+)").expect("invalid package regex"));
+
+/// How a name collides.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum CollisionKind {
+    /// The name is declared more than once in the package.
+    Declaration,
+    /// The name is declared in the package and imported by a file of it.
+    Import,
+}
+
+/// A place a colliding name is declared or imported.
+#[derive(Debug, Clone, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+pub struct CollisionSite {
+    /// The file.
+    pub path: PathBuf,
+    /// 1-based line of the declaration or import.
+    pub line: usize,
+}
+
+/// A name that a run would declare twice in a Go package.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct NameCollision {
+    /// The colliding name, qualified by its receiver type for methods.
+    pub name: String,
+    /// Directory of the package.
+    pub package: PathBuf,
+    /// How the name collides.
+    pub kind: CollisionKind,
+    /// Where the name is declared or imported after the run.
+    pub sites: Vec<CollisionSite>,
+    /// The name the rename was moved to, if the collision was resolved.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub resolved_as: Option<String>,
+}
+
+impl fmt::Display for NameCollision {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let sites = self
+            .sites
+            .iter()
+            .map(|site| format!("{}:{}", site.path.display(), site.line))
+            .collect::<Vec<_>>()
+            .join(", ");
+        match self.kind {
+            CollisionKind::Declaration => write!(
+                f,
+                "{} would be declared {} times in package {} ({})",
+                self.name,
+                self.sites.len(),
+                self.package.display(),
+                sites
+            )?,
+            CollisionKind::Import => write!(
+                f,
+                "{} would be both declared and imported in package {} ({})",
+                self.name,
+                self.package.display(),
+                sites
+            )?,
+        }
+        if let Some(resolved) = &self.resolved_as {
+            write!(f, "; renamed to {} instead", resolved)?;
+        }
+        Ok(())
+    }
+}
+
+/// The top-level names `source` declares, with their lines. Methods are
+/// qualified by their receiver type; `init` and `_` may repeat and are left
+/// out.
+fn declarations(source: &str) -> Vec<(String, usize)> {
+    let mut names = Vec::new();
+    let mut in_block = false;
+    for (index, line) in source.lines().enumerate() {
+        let name = if in_block {
+            if line.starts_with(')') {
+                in_block = false;
+            }
+            BLOCK_ENTRY.captures(line).map(|caps| caps[1].to_string())
+        } else if ["const (", "var (", "type ("].contains(&line.trim_end()) {
+            in_block = true;
+            None
+        } else {
+            DECLARATION
+                .captures(line)
+                .map(|caps| match (caps.get(1), caps.get(2), caps.get(3)) {
+                    (Some(receiver), Some(name), _) => {
+                        format!("{}.{}", receiver.as_str(), name.as_str())
+                    }
+                    (None, Some(name), _) | (_, _, Some(name)) => name.as_str().to_string(),
+                    _ => String::new(),
+                })
+        };
+        if let Some(name) = name.filter(|name| !matches!(name.as_str(), "" | "_" | "init")) {
+            names.push((name, index + 1));
+        }
+    }
+    names
+}
+
+/// The names `source` imports packages under, with their lines. Package
+/// names are taken from the last element of the import path, without a
+/// major version suffix.
+fn imports(source: &str) -> Vec<(String, usize)> {
+    let mut names = Vec::new();
+    let mut in_block = false;
+    for (index, line) in source.lines().enumerate() {
+        let trimmed = line.trim();
+        if trimmed == "import (" {
+            in_block = true;
+            continue;
+        }
+        if in_block && trimmed == ")" {
+            in_block = false;
+            continue;
+        }
+        if !in_block && !trimmed.starts_with("import ") {
+            continue;
+        }
+        let Some(caps) = IMPORT.captures(trimmed) else {
+            continue;
+        };
+        let name = match caps.get(1) {
+            Some(alias) => alias.as_str().to_string(),
+            None => package_name(&caps[2]).to_string(),
+        };
+        if name != "_" && name != "." {
+            names.push((name, index + 1));
+        }
+    }
+    names
+}
+
+/// The package name an import path is likely to have: `example.com/lib/v2`
+/// and `gopkg.in/yaml.v3` give `lib` and `yaml`.
+fn package_name(path: &str) -> &str {
+    let mut segments = path.rsplit('/');
+    let last = segments.next().unwrap_or(path);
+    let is_major = |s: &str| s.len() > 1 && s.starts_with('v') && s[1..].parse::<u32>().is_ok();
+    let name = match segments.next() {
+        Some(parent) if is_major(last) => parent,
+        _ => last,
+    };
+    match name.rsplit_once(".v") {
+        Some((base, major)) if major.parse::<u32>().is_ok() => base,
+        _ => name,
+    }
+}
+
+/// A Go file of a package, before and after the run.
+struct PackageFile {
+    path: PathBuf,
+    before: String,
+    after: String,
+}
+
+/// Names declared more than once among `files`, read through `source`.
+/// Functions defined once per build-tag variant are not collisions.
+fn duplicate_declarations<'a>(
+    files: &'a [PackageFile],
+    source: impl Fn(&'a PackageFile) -> &'a str,
+) -> BTreeMap<String, Vec<CollisionSite>> {
+    let mut declared: BTreeMap<String, Vec<CollisionSite>> = BTreeMap::new();
+    let mut variant = HashMap::new();
+    for file in files {
+        variant.insert(&file.path, is_build_variant(&file.path, source(file)));
+        for (name, line) in declarations(source(file)) {
+            declared.entry(name).or_default().push(CollisionSite {
+                path: file.path.clone(),
+                line,
+            });
+        }
+    }
+    declared.retain(|_, sites| {
+        let files: BTreeSet<&PathBuf> = sites.iter().map(|site| &site.path).collect();
+        sites.len() > 1 && (files.len() < sites.len() || files.iter().any(|path| !variant[path]))
+    });
+    declared
+}
+
+/// Names a file of `files` imports that the package declares, read through
+/// `source`.
+fn imported_declarations<'a>(
+    files: &'a [PackageFile],
+    source: impl Fn(&'a PackageFile) -> &'a str,
+) -> BTreeMap<String, Vec<CollisionSite>> {
+    let mut declared: HashMap<String, Vec<CollisionSite>> = HashMap::new();
+    for file in files {
+        for (name, line) in declarations(source(file)) {
+            declared.entry(name).or_default().push(CollisionSite {
+                path: file.path.clone(),
+                line,
+            });
+        }
+    }
+    let mut colliding: BTreeMap<String, Vec<CollisionSite>> = BTreeMap::new();
+    for file in files {
+        for (name, line) in imports(source(file)) {
+            if let Some(sites) = declared.get(&name) {
+                let entry = colliding.entry(name).or_insert_with(|| sites.clone());
+                entry.push(CollisionSite {
+                    path: file.path.clone(),
+                    line,
+                });
+            }
+        }
+    }
+    colliding
+}
+
+/// The collisions `changes` introduce in the Go packages they touch. Files
+/// of those packages without a change are read with `read`; collisions
+/// that were there before the run are not reported.
+pub(super) fn detect(
+    changes: &[FileChange],
+    read: impl Fn(&Path) -> Option<String>,
+) -> Vec<NameCollision> {
+    let by_path: HashMap<&Path, &FileChange> = changes
+        .iter()
+        .map(|change| (change.path.as_path(), change))
+        .collect();
+    let dirs: BTreeSet<&Path> = changes
+        .iter()
+        .filter(|change| change.path.extension().is_some_and(|ext| ext == "go"))
+        .filter_map(|change| change.path.parent())
+        .collect();
+
+    let mut collisions = Vec::new();
+    for dir in dirs {
+        let mut packages: BTreeMap<String, Vec<PackageFile>> = BTreeMap::new();
+        for path in super::variants::go_files(dir, &by_path) {
+            let file = match by_path.get(path.as_path()) {
+                Some(change) => PackageFile {
+                    path,
+                    before: change.original.clone(),
+                    after: change.transformed.clone(),
+                },
+                None => {
+                    let Some(source) = read(&path) else {
+                        continue;
+                    };
+                    PackageFile {
+                        path,
+                        before: source.clone(),
+                        after: source,
+                    }
+                }
+            };
+            let Some(package) = PACKAGE
+                .captures(&file.after)
+                .map(|caps| caps[1].to_string())
+            else {
+                continue;
+            };
+            packages.entry(package).or_default().push(file);
+        }
+
+        for files in packages.values() {
+            for (kind, before, after) in [
+                (
+                    CollisionKind::Declaration,
+                    duplicate_declarations(files, |f| &f.before),
+                    duplicate_declarations(files, |f| &f.after),
+                ),
+                (
+                    CollisionKind::Import,
+                    imported_declarations(files, |f| &f.before),
+                    imported_declarations(files, |f| &f.after),
+                ),
+            ] {
+                for (name, sites) in after {
+                    if !before.contains_key(&name) {
+                        collisions.push(NameCollision {
+                            name,
+                            package: dir.to_path_buf(),
+                            kind,
+                            sites,
+                            resolved_as: None,
+                        });
+                    }
+                }
+            }
+        }
+    }
+    collisions
+}
+
+/// The new name of a rename rule, for the renames a collision can be
+/// resolved by.
+fn new_name(spec: &mut TransformSpec) -> Option<&mut String> {
+    match spec {
+        TransformSpec::RenameFunction { new_name, .. }
+        | TransformSpec::RenameType { new_name, .. }
+        | TransformSpec::RenameSymbol { new_name, .. }
+        | TransformSpec::RenameMethod { new_name, .. }
+        | TransformSpec::RenameExport { new_name, .. }
+        | TransformSpec::RenameVariant { new_name, .. }
+        | TransformSpec::RenameGoType { new_name, .. } => Some(new_name),
+        TransformSpec::RewriteCall { new_name, .. } => new_name.as_mut(),
+        _ => None,
+    }
+}
+
+/// Move the renames to each colliding name in `config` to a free name with
+/// a numeric suffix, recording it in the collision. Files without a change
+/// are read with `read`. Returns false if a
+/// collision was not caused by a rename rule and cannot be resolved.
+pub(super) fn resolve(
+    config: &mut UpgradeConfig,
+    collisions: &mut [NameCollision],
+    changes: &[FileChange],
+    read: impl Fn(&Path) -> Option<String>,
+) -> bool {
+    let by_path: HashMap<&Path, &FileChange> = changes
+        .iter()
+        .map(|change| (change.path.as_path(), change))
+        .collect();
+    let dirs: BTreeSet<&Path> = collisions
+        .iter()
+        .map(|collision| collision.package.as_path())
+        .collect();
+    let mut taken = BTreeSet::new();
+    for dir in dirs {
+        for path in super::variants::go_files(dir, &by_path) {
+            let source = match by_path.get(path.as_path()) {
+                Some(change) => change.transformed.clone(),
+                None => read(&path).unwrap_or_default(),
+            };
+            taken.extend(declarations(&source).into_iter().map(|(name, _)| name));
+        }
+    }
+
+    let mut renamed: HashMap<String, String> = HashMap::new();
+    let mut resolved = true;
+    for collision in collisions.iter_mut() {
+        let short = collision
+            .name
+            .rsplit('.')
+            .next()
+            .unwrap_or(&collision.name)
+            .to_string();
+        if let Some(free) = renamed.get(&short) {
+            collision.resolved_as = Some(free.clone());
+            continue;
+        }
+        let mut rules = config
+            .transforms
+            .iter_mut()
+            .filter_map(|rule| new_name(&mut rule.spec).filter(|name| **name == short))
+            .peekable();
+        if rules.peek().is_none() {
+            resolved = false;
+            continue;
+        }
+        let free = (2..)
+            .map(|n| format!("{}{}", short, n))
+            .find(|candidate| !taken.contains(candidate))
+            .unwrap_or_default();
+        for name in rules {
+            *name = free.clone();
+        }
+        taken.insert(free.clone());
+        renamed.insert(short, free.clone());
+        collision.resolved_as = Some(free);
+    }
+    resolved
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    fn disk(path: &Path) -> Option<String> {
+        fs::read_to_string(path).ok()
+    }
+
+    #[test]
+    fn test_declarations_and_imports() {
+        let source = "package store\n\nimport (\n\t\"fmt\"\n\tpg \"github.com/lib/pq\"\n\t\"example.com/mylib/v2\"\n\t_ \"embed\"\n)\n\nconst (\n\tA = iota\n\tB\n)\n\ntype User struct {\n\tName string\n}\n\nfunc (u *User) Save() {}\n\nfunc init() {}\n\nvar cache = map[string]int{}\n";
+        let names: Vec<String> = declarations(source).into_iter().map(|(n, _)| n).collect();
+        assert_eq!(names, ["A", "B", "User", "User.Save", "cache"]);
+        let imported: Vec<String> = imports(source).into_iter().map(|(n, _)| n).collect();
+        assert_eq!(imported, ["fmt", "pg", "mylib"]);
+        assert_eq!(package_name("gopkg.in/yaml.v3"), "yaml");
+    }
+
+    #[test]
+    fn test_detect_and_resolve_collisions() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let fetch = dir.path().join("fetch.go");
+        let users = dir.path().join("users.go");
+        fs::write(&fetch, "package users\n\nfunc FetchUser() {}\n").unwrap();
+        let change = FileChange {
+            path: users.clone(),
+            original: "package users\n\nimport \"strings\"\n\nfunc GetUser() {}\n".into(),
+            transformed:
+                "package users\n\nimport \"strings\"\n\nfunc FetchUser() {}\n\nfunc strings() {}\n"
+                    .into(),
+        };
+
+        let mut collisions = detect(std::slice::from_ref(&change), disk);
+        assert_eq!(collisions.len(), 2);
+        assert_eq!(collisions[0].name, "FetchUser");
+        assert_eq!(collisions[0].kind, CollisionKind::Declaration);
+        assert_eq!(
+            collisions[0].sites,
+            [
+                CollisionSite {
+                    path: fetch.clone(),
+                    line: 3
+                },
+                CollisionSite {
+                    path: users,
+                    line: 5
+                },
+            ]
+        );
+        assert_eq!(collisions[1].name, "strings");
+        assert_eq!(collisions[1].kind, CollisionKind::Import);
+
+        let mut config = UpgradeConfig::new("rename", "");
+        config.add_transform(TransformSpec::RenameFunction {
+            old_name: "GetUser".into(),
+            new_name: "FetchUser".into(),
+        });
+        assert!(!resolve(&mut config, &mut collisions, &[change], disk));
+        assert_eq!(collisions[0].resolved_as.as_deref(), Some("FetchUser2"));
+        assert!(
+            matches!(&config.transforms[0].spec, TransformSpec::RenameFunction { new_name, .. } if new_name == "FetchUser2")
+        );
+        assert!(
+            collisions[0]
+                .to_string()
+                .ends_with("renamed to FetchUser2 instead")
+        );
+
+        // Variants of one function in build-tagged files do not collide
+        let linux = FileChange {
+            path: dir.path().join("conn_linux.go"),
+            original: "package users\n".into(),
+            transformed: "package users\n\nfunc Dial() {}\n".into(),
+        };
+        fs::write(
+            dir.path().join("conn_windows.go"),
+            "package users\n\nfunc Dial() {}\n",
+        )
+        .unwrap();
+        assert!(detect(&[linux], disk).is_empty());
+    }
+}
@@ -0,0 +1,138 @@
+//! Include and exclude globs of a runner.
+//!
+//! Globs given on the command line match paths relative to the processed
+//! root. Globs from a project config are anchored at the config's
+//! directory, so `services/**` means the same files whether a run starts
+//! at the project root or in `services/api`.
+
+use globset::GlobSet;
+use std::path::{Path, PathBuf};
+
+use super::glob_set;
+use crate::error::Result;
+
+/// Globs, each relative to the processed root or anchored at a directory.
+#[derive(Debug, Clone, Default)]
+pub(super) struct Globs(Vec<(Option<PathBuf>, String)>);
+
+impl Globs {
+    /// Add a glob relative to the processed root.
+    pub(super) fn push(&mut self, pattern: String) {
+        self.0.push((None, pattern));
+    }
+
+    /// Add a glob relative to `dir`.
+    pub(super) fn push_in(&mut self, dir: PathBuf, pattern: String) {
+        self.0.push((Some(dir), pattern));
+    }
+
+    /// Compile the globs for a run at `root`.
+    pub(super) fn compile(&self, root: &Path) -> Result<CompiledGlobs> {
+        let relative: Vec<String> = self
+            .0
+            .iter()
+            .filter(|(dir, _)| dir.is_none())
+            .map(|(_, pattern)| pattern.clone())
+            .collect();
+        let root = absolute(root);
+        let mut anchored = Vec::new();
+        for (dir, pattern) in &self.0 {
+            let Some(dir) = dir else { continue };
+            let dir = absolute(dir);
+            let anchor = if let Ok(prefix) = root.strip_prefix(&dir) {
+                Anchor::Above(prefix.to_path_buf())
+            } else if let Ok(prefix) = dir.strip_prefix(&root) {
+                Anchor::Below(prefix.to_path_buf())
+            } else {
+                // Not related to the root, so it matches none of its files
+                Anchor::Elsewhere
+            };
+            anchored.push((anchor, glob_set(std::slice::from_ref(pattern))?));
+        }
+        Ok(CompiledGlobs {
+            relative: glob_set(&relative)?,
+            anchored,
+            empty: self.0.is_empty(),
+        })
+    }
+}
+
+/// Where the directory of an anchored glob is, from the processed root.
+enum Anchor {
+    /// The root is this far below the directory.
+    Above(PathBuf),
+    /// The directory is this far below the root.
+    Below(PathBuf),
+    Elsewhere,
+}
+
+/// [`Globs`] compiled for one root.
+pub(super) struct CompiledGlobs {
+    relative: GlobSet,
+    anchored: Vec<(Anchor, GlobSet)>,
+    empty: bool,
+}
+
+impl CompiledGlobs {
+    /// Returns true if there are no globs.
+    pub(super) fn is_empty(&self) -> bool {
+        self.empty
+    }
+
+    /// Returns true if a glob matches `path`, relative to the root.
+    pub(super) fn is_match(&self, path: &Path) -> bool {
+        self.relative.is_match(path)
+            || self.anchored.iter().any(|(anchor, set)| match anchor {
+                Anchor::Above(prefix) => set.is_match(prefix.join(path)),
+                Anchor::Below(prefix) => path
+                    .strip_prefix(prefix)
+                    .is_ok_and(|path| set.is_match(path)),
+                Anchor::Elsewhere => false,
+            })
+    }
+}
+
+/// `path` made absolute, resolving symlinks where it exists. An empty path
+/// is the working directory.
+fn absolute(path: &Path) -> PathBuf {
+    let path = if path.as_os_str().is_empty() {
+        Path::new(".")
+    } else {
+        path
+    };
+    path.canonicalize()
+        .or_else(|_| std::path::absolute(path))
+        .unwrap_or_else(|_| path.to_path_buf())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_anchored_globs() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let api = dir.path().join("services/api");
+        std::fs::create_dir_all(&api).unwrap();
+
+        let mut globs = Globs::default();
+        globs.push_in(dir.path().to_path_buf(), "services/api/**".to_string());
+        globs.push("*.md".to_string());
+
+        // From the project root, and from below it
+        let at_root = globs.compile(dir.path()).unwrap();
+        assert!(at_root.is_match(Path::new("services/api/main.go")));
+        assert!(!at_root.is_match(Path::new("main.go")));
+        let in_api = globs.compile(&api).unwrap();
+        assert!(in_api.is_match(Path::new("main.go")));
+        assert!(in_api.is_match(Path::new("README.md")));
+
+        // A run above the project only matches inside it
+        let mut globs = Globs::default();
+        globs.push_in(api.clone(), "*.go".to_string());
+        let above = globs.compile(dir.path()).unwrap();
+        assert!(above.is_match(Path::new("services/api/main.go")));
+        assert!(!above.is_match(Path::new("main.go")));
+        assert!(!above.is_empty());
+    }
+}
@@ -0,0 +1,113 @@
+//! Checking that a ruleset is idempotent.
+//!
+//! Running an upgrade on its own output should change nothing. A rule that
+//! matches its own replacement breaks that: `Client\(` rewritten to
+//! `NewClient(` turns into `NewNewClient(` on the next run, and a rollout
+//! that runs the upgrade again on a partly migrated tree corrupts it.
+//! [`UpgradeRunner::verify_idempotent`](super::UpgradeRunner::verify_idempotent)
+//! runs the rules a second time over the output of a run and returns a
+//! [`SecondPassChange`] for every file the second pass changes.
+
+use serde::Serialize;
+use std::collections::BTreeSet;
+use std::fmt;
+use std::path::PathBuf;
+
+use super::RuleEdit;
+use crate::transform::FileChange;
+
+/// A file the rules change again when run over their own output.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct SecondPassChange {
+    /// File changed by the second pass.
+    pub path: PathBuf,
+    /// 1-based line of the first change of the second pass.
+    pub line: usize,
+    /// The rules that matched again, in configuration order; empty when
+    /// only formatting or import fix-ups changed the file.
+    pub rules: Vec<String>,
+}
+
+impl fmt::Display for SecondPassChange {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}:{}: a second run changes the file again",
+            self.path.display(),
+            self.line
+        )?;
+        if !self.rules.is_empty() {
+            write!(f, " (rules {})", self.rules.join(", "))?;
+        }
+        Ok(())
+    }
+}
+
+/// The change of `second`, the second pass over a file, if it changed
+/// anything; `edits` are the edits the second pass made.
+pub(super) fn check(second: &FileChange, edits: &[RuleEdit]) -> Option<SecondPassChange> {
+    if !second.is_modified() {
+        return None;
+    }
+    let line = match edits.iter().map(|edit| edit.line).min() {
+        Some(line) => line,
+        None => {
+            let mut after = second.transformed.lines();
+            second
+                .original
+                .lines()
+                .position(|line| after.next() != Some(line))
+                .unwrap_or(second.original.lines().count())
+                + 1
+        }
+    };
+    let mut seen = BTreeSet::new();
+    let rules = edits
+        .iter()
+        .filter(|edit| seen.insert(edit.rule.as_str()))
+        .map(|edit| edit.rule.clone())
+        .collect();
+    Some(SecondPassChange {
+        path: second.path.clone(),
+        line,
+        rules,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::analyzer::{TransformRule, TransformSpec, UpgradeConfig};
+    use crate::runner::UpgradeRunner;
+
+    fn replace(id: &str, pattern: &str, replacement: &str) -> TransformRule {
+        TransformRule::new(TransformSpec::ReplacePattern {
+            pattern: pattern.to_string(),
+            replacement: replacement.to_string(),
+        })
+        .with_id(id)
+    }
+
+    #[test]
+    fn test_verify_idempotent() {
+        let mut config = UpgradeConfig::new("test", "");
+        config.add_transform(replace("new-client", r"Client\(", "NewClient("));
+        config.add_transform(replace("close", r"\bClose\(", "Shutdown("));
+        let runner = UpgradeRunner::new(config);
+        let source = "c := Client(addr)\ndefer c.Close()\n";
+
+        let first = runner.run_source("main.go", source).unwrap();
+        let changes = runner.verify_idempotent(&first).unwrap();
+        assert_eq!(changes.len(), 1);
+        assert_eq!(changes[0].rules, ["new-client"]);
+        assert_eq!(
+            changes[0].to_string(),
+            "main.go:1: a second run changes the file again (rules new-client)"
+        );
+
+        let mut config = UpgradeConfig::new("test", "");
+        config.add_transform(replace("close", r"\bClose\(", "Shutdown("));
+        let runner = UpgradeRunner::new(config);
+        let first = runner.run_source("main.go", source).unwrap();
+        assert!(runner.verify_idempotent(&first).unwrap().is_empty());
+    }
+}
@@ -0,0 +1,245 @@
+//! Coordinated migrations across a monorepo.
+//!
+//! When a repository holds a library and its internal clients, the library's
+//! own changes and the client migrations have to land together: a tree where
+//! only one side is upgraded does not build. A [`Migration`] runs several
+//! scoped upgrades as one change set. Every step is computed in memory first,
+//! each seeing the files as earlier steps left them, and only then is the
+//! whole set written. A caller verifies the result once and, if it fails,
+//! reverts everything with [`RunReport::revert`].
+
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use super::{RunReport, UpgradeRunner};
+use crate::diff::DiffSummary;
+use crate::error::{RefactorError, Result};
+use crate::transform::FileChange;
+
+/// Scoped upgrades applied as a single change set.
+#[derive(Clone, Default)]
+pub struct Migration {
+    steps: Vec<(String, UpgradeRunner)>,
+}
+
+/// What one step of a migration changed.
+#[derive(Debug)]
+pub struct StepReport {
+    /// Name of the step.
+    pub name: String,
+    /// The step's run; changes go from the content earlier steps left to
+    /// the content this step leaves.
+    pub report: RunReport,
+}
+
+/// A computed migration, ready to be written.
+#[derive(Debug)]
+pub struct MigrationPlan {
+    /// Each step's run, in order.
+    pub steps: Vec<StepReport>,
+    /// All steps together; each change goes from the content on disk to the
+    /// content after the last step.
+    pub report: RunReport,
+}
+
+impl Migration {
+    /// Create an empty migration.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Add a step. Steps run in the order they are added; the runner's
+    /// include and exclude globs scope the step to part of the tree.
+    pub fn step(mut self, name: impl Into<String>, runner: UpgradeRunner) -> Self {
+        self.steps.push((name.into(), runner));
+        self
+    }
+
+    /// Returns true if the migration has no steps.
+    pub fn is_empty(&self) -> bool {
+        self.steps.is_empty()
+    }
+
+    /// Compute every step against the tree at `root` without writing
+    /// anything.
+    pub fn plan(&self, root: impl AsRef<Path>) -> Result<MigrationPlan> {
+        let root = root.as_ref();
+        // Pending content by path relative to `root`
+        let mut files: BTreeMap<PathBuf, FileChange> = BTreeMap::new();
+        let mut steps = Vec::new();
+        let mut report = RunReport::default();
+
+        for (name, runner) in &self.steps {
+            let runner = runner.clone().dry_run().root(root);
+            let relative = |path: &Path| path.strip_prefix(root).unwrap_or(path).to_path_buf();
+
+            // Files an earlier step changed are read from the pending set
+            let mut step = runner.run(root)?;
+            let pending = |path: &Path| files.contains_key(&relative(path));
+            step.changes.retain(|change| !pending(&change.path));
+            step.diagnostics.retain(|d| !pending(&d.path));
+            step.edits.retain(|edit| !pending(&edit.path));
+
+            let rerun = runner.run_files(
+                files
+                    .iter()
+                    .map(|(path, change)| (path.clone(), change.transformed.clone())),
+            )?;
+            step.diagnostics
+                .extend(rerun.diagnostics.into_iter().map(|mut d| {
+                    d.path = root.join(&d.path);
+                    d
+                }));
+            step.edits.extend(rerun.edits.into_iter().map(|mut edit| {
+                edit.path = root.join(&edit.path);
+                edit
+            }));
+            step.manual_todos += rerun.manual_todos;
+            step.changes
+                .extend(rerun.changes.into_iter().map(|mut change| {
+                    change.path = root.join(&change.path);
+                    change
+                }));
+            step.changes.sort_by(|a, b| a.path.cmp(&b.path));
+            step.summary = summarize(&step.changes);
+
+            for change in &step.changes {
+                files
+                    .entry(relative(&change.path))
+                    .and_modify(|pending| pending.transformed = change.transformed.clone())
+                    .or_insert_with(|| change.clone());
+            }
+            report.files_scanned += step.files_scanned;
+            report.generated_skipped += step.generated_skipped;
+            report.manual_todos += step.manual_todos;
+            report.diagnostics.extend(step.diagnostics.iter().cloned());
+            report.edits.extend(step.edits.iter().cloned());
+            steps.push(StepReport {
+                name: name.clone(),
+                report: step,
+            });
+        }
+
+        // A later step may undo an earlier one
+        report.changes = files
+            .into_values()
+            .filter(FileChange::is_modified)
+            .collect();
+        report.summary = summarize(&report.changes);
+        Ok(MigrationPlan { steps, report })
+    }
+}
+
+impl MigrationPlan {
+    /// Write every change. Nothing is written if a file changed on disk
+    /// since the plan was made, and files already written are restored if a
+    /// write fails.
+    pub fn apply(&self) -> Result<()> {
+        for change in &self.report.changes {
+            if fs::read_to_string(&change.path)? != change.original {
+                return Err(RefactorError::TransformFailed {
+                    message: format!(
+                        "{} changed on disk since the migration was planned",
+                        change.path.display()
+                    ),
+                });
+            }
+        }
+        for (index, change) in self.report.changes.iter().enumerate() {
+            if let Err(e) = change.apply() {
+                for written in &self.report.changes[..index] {
+                    let _ = fs::write(&written.path, &written.original);
+                }
+                return Err(e);
+            }
+        }
+        Ok(())
+    }
+}
+
+fn summarize(changes: &[FileChange]) -> DiffSummary {
+    changes
+        .iter()
+        .fold(DiffSummary::default(), |mut summary, change| {
+            summary.merge(&DiffSummary::from_diff(
+                &change.original,
+                &change.transformed,
+            ));
+            summary
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformSpec, UpgradeConfig};
+
+    fn runner(from: &str, to: &str, include: &str) -> UpgradeRunner {
+        let mut config =
+            UpgradeConfig::new(from, "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: from.to_string(),
+            to: to.to_string(),
+        });
+        UpgradeRunner::new(config).include(include)
+    }
+
+    #[test]
+    fn test_steps_see_earlier_changes_and_apply_together() {
+        let dir = tempfile::TempDir::new().unwrap();
+        fs::create_dir_all(dir.path().join("lib")).unwrap();
+        fs::create_dir_all(dir.path().join("app")).unwrap();
+        fs::write(dir.path().join("lib/pool.go"), "func Dial() {}\n").unwrap();
+        fs::write(dir.path().join("app/main.go"), "pool.Dial()\n").unwrap();
+
+        let migration = Migration::new()
+            .step("library", runner("Dial", "Connect", "lib/**"))
+            .step("clients", runner("pool.Dial", "pool.Connect", "app/**"))
+            .step("context", runner("Connect()", "Connect(ctx)", "**"));
+        let plan = migration.plan(dir.path()).unwrap();
+
+        // Nothing is written until the plan is applied
+        assert_eq!(
+            fs::read_to_string(dir.path().join("app/main.go")).unwrap(),
+            "pool.Dial()\n"
+        );
+        assert_eq!(plan.steps.len(), 3);
+        assert_eq!(plan.steps[2].report.files_modified(), 2);
+        assert_eq!(plan.report.files_modified(), 2);
+        assert_eq!(plan.report.summary.files_changed, 2);
+
+        plan.apply().unwrap();
+        assert_eq!(
+            fs::read_to_string(dir.path().join("lib/pool.go")).unwrap(),
+            "func Connect(ctx) {}\n"
+        );
+        assert_eq!(
+            fs::read_to_string(dir.path().join("app/main.go")).unwrap(),
+            "pool.Connect(ctx)\n"
+        );
+
+        plan.report.revert().unwrap();
+        assert_eq!(
+            fs::read_to_string(dir.path().join("lib/pool.go")).unwrap(),
+            "func Dial() {}\n"
+        );
+    }
+
+    #[test]
+    fn test_apply_refuses_stale_plan() {
+        let dir = tempfile::TempDir::new().unwrap();
+        fs::write(dir.path().join("main.go"), "Dial()\n").unwrap();
+        let plan = Migration::new()
+            .step("rename", runner("Dial", "Connect", "**"))
+            .plan(dir.path())
+            .unwrap();
+
+        fs::write(dir.path().join("main.go"), "Dial()\nDial()\n").unwrap();
+        assert!(plan.apply().is_err());
+        assert_eq!(
+            fs::read_to_string(dir.path().join("main.go")).unwrap(),
+            "Dial()\nDial()\n"
+        );
+    }
+}
@@ -0,0 +1,2174 @@
+//! Running upgrade configurations against a project.
+//!
+//! [`UpgradeRunner`] applies the rules of an [`UpgradeConfig`] to every
+//! matching file and reports what happened. Rules in `suggest` mode never
+//! modify code; each of their matches becomes a [`Diagnostic`] carrying the
+//! rule's message and the suggested replacement. Each file goes through the
+//! [`LanguageAdapter`] for its language, if there is one; imports of
+//! rewritten Go files are fixed up by [`GoAdapter`]. Generated files are
+//! skipped unless [`UpgradeRunner::include_generated`] is set.
+//!
+//! With [`UpgradeRunner::docs`], references to renamed symbols in the
+//! project's Markdown docs and ADRs are updated too (see [`DocReferences`]).
+//!
+//! Pre-modules code bases are run with [`UpgradeRunner::gopath`], so imports
+//! of their own packages are not mistaken for the standard library. Vendored
+//! Go dependencies (see [`GoVendor`]) are never rewritten. In monorepos
+//! built with Bazel or Please, [`UpgradeRunner::packages_driver`] takes the
+//! Go files to run from the build system's packages driver.
+//!
+//! [`UpgradeRunner::run_files`] runs the same rules against an in-memory file
+//! set, for tools that embed the engine rather than shell out to the CLI.
+//!
+//! [`UpgradeRunner::run_canary`] stages a rollout: the upgrade is applied to a
+//! canary subset first, checked, and only then applied to the rest of the
+//! project.
+//!
+//! [`UpgradeRunner::run_each_rule`] applies the rules one at a time, so the
+//! changes of each rule can be committed on their own.
+//!
+//! A Go function defined in several build-tag variants (`conn_linux.go`,
+//! `conn_windows.go`) is rewritten in all of them: the variants of every
+//! selected file are run too, and [`RunReport::partial_variants`] lists the
+//! definitions a run changed in some variants only.
+//!
+//! With [`UpgradeRunner::cleanup`], Go local variables a rewrite left
+//! unused are removed or blank-assigned, and the imports only they used
+//! pruned (see [`cleanup`](crate::transform::cleanup)); [`RunReport::cleanups`]
+//! lists what was cleaned.
+//!
+//! Renames that would declare a name twice in a Go package, or declare a
+//! name a file of the package imports, block the run before anything is
+//! written. With [`UpgradeRunner::resolve_collisions`], the renames are moved
+//! to a free name instead and [`RunReport::collisions`] lists them.
+//!
+//! [`UpgradeRunner::verify_idempotent`] runs the rules again over the output
+//! of a run, to catch rules that keep rewriting their own replacements.
+//!
+//! A [`Migration`] applies several scoped upgrades, such as a library's own
+//! changes and the migration of its clients, as one change set.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::runner::UpgradeRunner;
+//!
+//! let config = UpgradeConfig::from_file("upgrade.yaml")?;
+//! let report = UpgradeRunner::new(config).dry_run().run("./project")?;
+//!
+//! for diagnostic in &report.diagnostics {
+//!     println!("{}", diagnostic);
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+mod cache;
+mod chain;
+mod collisions;
+mod globs;
+mod idempotence;
+mod migration;
+mod overlaps;
+mod pool;
+mod stats;
+mod todos;
+mod variants;
+
+pub use cache::{DEFAULT_CACHE_DIR, MemoryCache};
+pub use chain::{Chain, ChainReport};
+pub use collisions::{CollisionKind, CollisionSite, NameCollision};
+pub use idempotence::SecondPassChange;
+pub use migration::{Migration, MigrationPlan, StepReport};
+pub use overlaps::RuleOverlap;
+pub use stats::{MatchStats, RuleMatches};
+pub(crate) use todos::{MARKER_PATTERN, has_marker};
+pub use todos::{TodoMarker, find_todos, scan_todos};
+pub use variants::PartialVariantChange;
+
+use cache::{AnalysisCache, CacheEntry, content_hash};
+use globs::Globs;
+use globset::{Glob, GlobSet, GlobSetBuilder};
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use similar::{ChangeTag, TextDiff};
+use std::collections::{HashMap, HashSet};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, LazyLock};
+
+use crate::analyzer::{SymbolMap, TransformRule, UpgradeConfig};
+use crate::codemod::Upgrade;
+use crate::diff::{DiffSummary, git_diff};
+use crate::error::{RefactorError, Result};
+use crate::lang::{
+    AdapterRegistry, DriverPackage, GoAdapter, GoPackagesDriver, GoPath, GoVendor, LanguageAdapter,
+    source_files,
+};
+use crate::matcher::FileMatcher;
+use crate::plugin::{PluginRegistry, Rewriter, SiteMatcher};
+use crate::semantics::{self, SemanticsVersion};
+use crate::transform::cleanup::{self, Cleanup, CleanupKind};
+use crate::transform::markdown::{self, DocReferences};
+use crate::transform::{FileChange, GoImports, Guard, GuardedTransform, Transform, splice};
+
+/// Marker left in code for follow-up work a rule could not do automatically.
+pub const TODO_MARKER: &str = "TODO(refactor)";
+
+static GENERATED: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"^(//|#) Code generated .* DO NOT EDIT\.$").expect("invalid generated regex")
+});
+
+/// Returns true if `source` carries a `// Code generated ... DO NOT EDIT.`
+/// header before its first line of code, following the Go convention (`#`
+/// comments are accepted too). Such files are overwritten by their
+/// generator, so rewriting them only causes churn.
+pub fn is_generated(source: &str) -> bool {
+    source
+        .lines()
+        .map(str::trim_end)
+        .take_while(|line| line.is_empty() || line.starts_with("//") || line.starts_with('#'))
+        .any(|line| GENERATED.is_match(line))
+}
+
+/// A finding reported by a rule without modifying code.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Diagnostic {
+    /// Name of the rule that produced this diagnostic.
+    pub rule: String,
+    /// Message explaining the finding.
+    pub message: String,
+    /// File containing the match.
+    pub path: PathBuf,
+    /// 1-based line number.
+    pub line: usize,
+    /// 1-based column number.
+    pub column: usize,
+    /// The matched text.
+    pub text: String,
+    /// The suggested replacement.
+    pub suggestion: String,
+}
+
+impl fmt::Display for Diagnostic {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}:{}:{}: [{}] {} (suggested: `{}`)",
+            self.path.display(),
+            self.line,
+            self.column,
+            self.rule,
+            self.message,
+            self.suggestion
+        )
+    }
+}
+
+/// A location rewritten by a rule.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RuleEdit {
+    /// Name of the rule that made the edit.
+    pub rule: String,
+    /// File that was edited.
+    pub path: PathBuf,
+    /// 1-based line of the edit in the upgraded file.
+    pub line: usize,
+    /// Whether the edit left a [`TODO_MARKER`] for the author to finish.
+    #[serde(default)]
+    pub todo: bool,
+}
+
+/// The result of running an upgrade configuration.
+#[derive(Debug, Default)]
+pub struct RunReport {
+    /// Number of files scanned.
+    pub files_scanned: usize,
+    /// Files modified by apply-mode rules.
+    pub changes: Vec<FileChange>,
+    /// Findings from suggest-only rules.
+    pub diagnostics: Vec<Diagnostic>,
+    /// Locations rewritten by apply-mode rules.
+    pub edits: Vec<RuleEdit>,
+    /// Number of [`TODO_MARKER`]s remaining in scanned files.
+    pub manual_todos: usize,
+    /// The markers remaining in scanned files, those the run left tagged
+    /// with the rule that left them (see [`TodoMarker`]).
+    pub todos: Vec<TodoMarker>,
+    /// Line-level summary of the changes.
+    pub summary: DiffSummary,
+    /// Number of files whose results came from the analysis cache.
+    pub cache_hits: usize,
+    /// Number of generated files skipped (see [`is_generated`]).
+    pub generated_skipped: usize,
+    /// Engine semantics the run followed.
+    pub semantics: SemanticsVersion,
+    /// Functions whose build-tag variants were only partly rewritten.
+    pub partial_variants: Vec<PartialVariantChange>,
+    /// Name collisions resolved by moving a rename to a free name.
+    pub collisions: Vec<NameCollision>,
+    /// Unused variables and imports removed by the cleanup pass.
+    pub cleanups: Vec<Cleanup>,
+    /// Code matched by several rules, in conflict if their order matters.
+    pub overlaps: Vec<RuleOverlap>,
+}
+
+impl RunReport {
+    /// Returns the number of files that were modified.
+    pub fn files_modified(&self) -> usize {
+        self.changes.len()
+    }
+
+    /// Fold the results of another run into this one.
+    pub fn merge(&mut self, other: RunReport) {
+        self.files_scanned += other.files_scanned;
+        self.changes.extend(other.changes);
+        self.diagnostics.extend(other.diagnostics);
+        self.edits.extend(other.edits);
+        self.manual_todos += other.manual_todos;
+        self.todos.extend(other.todos);
+        self.summary.merge(&other.summary);
+        self.cache_hits += other.cache_hits;
+        self.generated_skipped += other.generated_skipped;
+        self.partial_variants.extend(other.partial_variants);
+        self.collisions.extend(other.collisions);
+        self.cleanups.extend(other.cleanups);
+        self.overlaps.extend(other.overlaps);
+    }
+
+    /// The changes as one patch with paths relative to `root`, which
+    /// `git apply` applies (see [`git_diff`]).
+    pub fn patch(&self, root: &Path) -> String {
+        self.changes
+            .iter()
+            .map(|change| {
+                let rel = change.path.strip_prefix(root).unwrap_or(&change.path);
+                git_diff(&change.original, &change.transformed, rel)
+            })
+            .collect()
+    }
+
+    /// Write the original contents of every changed file back to disk.
+    pub fn revert(&self) -> Result<()> {
+        for change in &self.changes {
+            fs::write(&change.path, &change.original)?;
+        }
+        Ok(())
+    }
+}
+
+/// The result of a staged run (see [`UpgradeRunner::run_canary`]).
+#[derive(Debug)]
+pub enum CanaryOutcome {
+    /// The canary passed its check and the rest of the project was upgraded.
+    Passed {
+        /// Run against the canary files.
+        canary: RunReport,
+        /// Run against the remaining files.
+        rest: Box<RunReport>,
+    },
+    /// The canary failed its check; its changes were reverted.
+    Failed {
+        /// Run against the canary files.
+        canary: RunReport,
+    },
+}
+
+impl CanaryOutcome {
+    /// Returns true if the canary passed.
+    pub fn passed(&self) -> bool {
+        matches!(self, CanaryOutcome::Passed { .. })
+    }
+
+    /// The canary run.
+    pub fn canary(&self) -> &RunReport {
+        match self {
+            CanaryOutcome::Passed { canary, .. } | CanaryOutcome::Failed { canary } => canary,
+        }
+    }
+}
+
+/// Applies an upgrade configuration to a project.
+#[derive(Clone)]
+pub struct UpgradeRunner {
+    config: UpgradeConfig,
+    dry_run: bool,
+    include: Globs,
+    exclude: Globs,
+    only: Option<HashSet<PathBuf>>,
+    skip: HashSet<PathBuf>,
+    jobs: usize,
+    cache_dir: Option<PathBuf>,
+    memory_cache: Option<MemoryCache>,
+    include_generated: bool,
+    docs: bool,
+    resolve_collisions: bool,
+    cleanup: bool,
+    plugins: PluginRegistry,
+    adapters: AdapterRegistry,
+    gopath: Option<GoPath>,
+    packages: Option<(GoPackagesDriver, Vec<String>)>,
+    /// Contents read instead of the files on disk, by path.
+    overlay: Option<Arc<HashMap<PathBuf, String>>>,
+    /// Directory the paths of in-memory files are relative to.
+    root: Option<PathBuf>,
+}
+
+impl UpgradeRunner {
+    /// Create a runner for the given configuration.
+    pub fn new(config: UpgradeConfig) -> Self {
+        Self {
+            plugins: config.plugin_registry(),
+            config,
+            dry_run: false,
+            include: Globs::default(),
+            exclude: Globs::default(),
+            only: None,
+            skip: HashSet::new(),
+            jobs: pool::default_jobs(),
+            cache_dir: None,
+            memory_cache: None,
+            include_generated: false,
+            docs: false,
+            resolve_collisions: false,
+            cleanup: false,
+            adapters: AdapterRegistry::new(),
+            gopath: None,
+            packages: None,
+            overlay: None,
+            root: None,
+        }
+    }
+
+    /// Only run against files whose path relative to the root matches the glob.
+    pub fn include(mut self, pattern: impl Into<String>) -> Self {
+        self.include.push(pattern.into());
+        self
+    }
+
+    /// Skip files whose path relative to the root matches the glob.
+    pub fn exclude(mut self, pattern: impl Into<String>) -> Self {
+        self.exclude.push(pattern.into());
+        self
+    }
+
+    /// Only run against files whose path relative to `dir` matches the
+    /// glob, wherever the run starts, such as a glob of a project config in
+    /// `dir`.
+    pub fn include_in(mut self, dir: impl Into<PathBuf>, pattern: impl Into<String>) -> Self {
+        self.include.push_in(dir.into(), pattern.into());
+        self
+    }
+
+    /// Skip files whose path relative to `dir` matches the glob, wherever
+    /// the run starts.
+    pub fn exclude_in(mut self, dir: impl Into<PathBuf>, pattern: impl Into<String>) -> Self {
+        self.exclude.push_in(dir.into(), pattern.into());
+        self
+    }
+
+    /// Only run against these files, given relative to the root, such as
+    /// the files changed on a branch (see [`DiffOps`](crate::git::DiffOps)).
+    /// Include and exclude globs still apply.
+    pub fn only_files(mut self, paths: impl IntoIterator<Item = impl Into<PathBuf>>) -> Self {
+        self.only = Some(paths.into_iter().map(Into::into).collect());
+        self
+    }
+
+    /// Enable dry-run mode (compute changes without writing them).
+    pub fn dry_run(mut self) -> Self {
+        self.dry_run = true;
+        self
+    }
+
+    /// Get the configuration being run.
+    pub fn config(&self) -> &UpgradeConfig {
+        &self.config
+    }
+
+    /// Process files on `jobs` worker threads (default: one per CPU).
+    /// Reports are ordered by file path whatever the worker count.
+    pub fn jobs(mut self, jobs: usize) -> Self {
+        self.jobs = jobs.max(1);
+        self
+    }
+
+    /// Skip re-analyzing files whose content is unchanged since a previous
+    /// run with the same rules, using a cache in `dir` (relative to the
+    /// project root unless absolute; see [`DEFAULT_CACHE_DIR`]).
+    pub fn cache(mut self, dir: impl Into<PathBuf>) -> Self {
+        self.cache_dir = Some(dir.into());
+        self
+    }
+
+    /// Skip re-analyzing files whose content is unchanged since a previous
+    /// run with the same rules, keeping results in `cache` rather than on
+    /// disk, for processes that run many times (see [`crate::daemon`]).
+    pub fn memory_cache(mut self, cache: MemoryCache) -> Self {
+        self.memory_cache = Some(cache);
+        self
+    }
+
+    /// Also rewrite generated files, which are skipped by default.
+    pub fn include_generated(mut self) -> Self {
+        self.include_generated = true;
+        self
+    }
+
+    /// Also rewrite references to renamed symbols in Markdown docs, using
+    /// the config's [`SymbolMap`]. Only [`run`](Self::run) processes docs.
+    pub fn docs(mut self) -> Self {
+        self.docs = true;
+        self
+    }
+
+    /// Resolve name collisions by adding a numeric suffix to the new name of
+    /// the rename that caused them (`FetchUser2`), instead of failing the
+    /// run. Only [`run`](Self::run) checks for collisions.
+    pub fn resolve_collisions(mut self) -> Self {
+        self.resolve_collisions = true;
+        self
+    }
+
+    /// Clean up what rewrites leave unused in Go files: local variables
+    /// are removed or blank-assigned, and imports only they used pruned.
+    pub fn cleanup(mut self) -> Self {
+        self.cleanup = true;
+        self
+    }
+
+    /// Resolve the paths given to [`run_source`](Self::run_source) and
+    /// [`run_files`](Self::run_files) from `root`, the project directory,
+    /// when rules look at the files around them, such as the go.mod a
+    /// `go_version` condition reads. Defaults to the working directory.
+    pub fn root(mut self, root: impl Into<PathBuf>) -> Self {
+        self.root = Some(root.into());
+        self
+    }
+
+    /// Analyze a GOPATH-mode code base whose packages live in `gopath`.
+    pub fn gopath(mut self, gopath: GoPath) -> Self {
+        self.gopath = Some(gopath);
+        self
+    }
+
+    /// Only run against the Go files of the packages `driver` loads for
+    /// `patterns` (default `./...`), as the build system of a monorepo
+    /// defines them, and treat their import paths as the project's own
+    /// when fixing imports. Other files are selected as usual.
+    pub fn packages_driver(
+        mut self,
+        driver: GoPackagesDriver,
+        patterns: impl IntoIterator<Item = impl Into<String>>,
+    ) -> Self {
+        let mut patterns: Vec<String> = patterns.into_iter().map(Into::into).collect();
+        if patterns.is_empty() {
+            patterns.push("./...".to_string());
+        }
+        self.packages = Some((driver, patterns));
+        self
+    }
+
+    /// Follow the engine semantics of `version` (see [`crate::semantics`]),
+    /// instead of the version the config pins, if any.
+    pub fn engine(mut self, version: SemanticsVersion) -> Self {
+        self.config.engine = Some(version);
+        self
+    }
+
+    /// The engine semantics runs follow: the config's pin, or the engine's
+    /// current semantics.
+    pub fn semantics(&self) -> SemanticsVersion {
+        self.config.engine.unwrap_or(semantics::CURRENT)
+    }
+
+    /// Register a matcher plugin that rules can name in `matcher`.
+    pub fn with_matcher(
+        mut self,
+        name: impl Into<String>,
+        matcher: impl SiteMatcher + 'static,
+    ) -> Self {
+        self.plugins = self.plugins.with_matcher(name, matcher);
+        self
+    }
+
+    /// Register a rewriter plugin that rules can name in `rewriter`.
+    pub fn with_rewriter(
+        mut self,
+        name: impl Into<String>,
+        rewriter: impl Rewriter + 'static,
+    ) -> Self {
+        self.plugins = self.plugins.with_rewriter(name, rewriter);
+        self
+    }
+
+    /// Process files of the adapter's language with `adapter`, instead of
+    /// the built-in adapter for the language, if any.
+    pub fn with_adapter(mut self, adapter: impl LanguageAdapter + 'static) -> Self {
+        self.adapters = self.adapters.register(Arc::new(adapter));
+        self
+    }
+
+    /// Run the configuration against all matching files under `root`. If
+    /// writing fails, the files already written are restored.
+    pub fn run(&self, root: impl AsRef<Path>) -> Result<RunReport> {
+        let root = root.as_ref();
+        let rules = self.compile(None)?;
+        let packages = self.driver_packages(root)?;
+        let adapters = self.adapters(packages.as_deref());
+        let mut files = self.files(root, packages.as_deref())?;
+        files.sort();
+
+        let mut report = RunReport {
+            files_scanned: files.len(),
+            semantics: self.semantics(),
+            ..Default::default()
+        };
+
+        // Plugin behavior and go.mod files are not part of the rules, so
+        // rules depending on them cannot be cached
+        let uncacheable = self
+            .config
+            .transforms
+            .iter()
+            .any(|r| r.uses_plugins() || r.uses_go_version());
+        let mut cache = match (&self.memory_cache, &self.cache_dir) {
+            _ if uncacheable || self.overlay.is_some() => None,
+            (Some(memory), _) => Some(AnalysisCache::in_memory(memory, root, &self.config)?),
+            (None, Some(dir)) => Some(AnalysisCache::open(&root.join(dir), &self.config)?),
+            (None, None) => None,
+        };
+        let results = pool::map(&files, self.jobs, |path| {
+            let original = self.read(path)?;
+            if self.skips_generated() && is_generated(&original) {
+                return Ok(None);
+            }
+            let hash = content_hash(&original);
+            let cached = cache
+                .as_ref()
+                .and_then(|c| c.get(path.strip_prefix(root).unwrap_or(path), &hash));
+            match cached {
+                Some(entry) => Ok(Some(FileResult::cached(path, original, entry, hash))),
+                None => {
+                    process_file(&rules, &adapters, self.cleanup, path, original, hash).map(Some)
+                }
+            }
+        });
+
+        let mut entries = HashMap::new();
+        let mut modified = Vec::new();
+        for result in results {
+            let Some(file) = result? else {
+                report.files_scanned -= 1;
+                report.generated_skipped += 1;
+                continue;
+            };
+            if file.cached {
+                report.cache_hits += 1;
+            } else if !file.change.is_modified() {
+                let rel = file
+                    .change
+                    .path
+                    .strip_prefix(root)
+                    .unwrap_or(&file.change.path);
+                entries.insert(
+                    rel.to_path_buf(),
+                    CacheEntry {
+                        hash: file.hash.clone(),
+                        diagnostics: file.diagnostics.clone(),
+                        overlaps: file.overlaps.clone(),
+                        manual_todos: file.manual_todos,
+                    },
+                );
+            }
+            report.diagnostics.extend(file.diagnostics);
+            report.edits.extend(file.edits);
+            report.cleanups.extend(file.cleanups);
+            report.overlaps.extend(file.overlaps);
+            report.manual_todos += file.manual_todos;
+            report.todos.extend(file.todos);
+            if file.change.is_modified() {
+                modified.push(file.change);
+            }
+        }
+
+        if self.semantics() >= semantics::NAME_COLLISIONS {
+            let read = |path: &Path| self.read(path).ok();
+            let mut collisions = collisions::detect(&modified, read);
+            if !collisions.is_empty() {
+                let mut runner = self.clone();
+                if self.resolve_collisions
+                    && collisions::resolve(&mut runner.config, &mut collisions, &modified, read)
+                {
+                    runner.resolve_collisions = false;
+                    let mut report = runner.run(root)?;
+                    report.collisions.splice(0..0, collisions);
+                    return Ok(report);
+                }
+                let blocking: Vec<String> = collisions
+                    .iter()
+                    .filter(|collision| collision.resolved_as.is_none())
+                    .map(|collision| format!("  {}", collision))
+                    .collect();
+                return Err(RefactorError::NameCollision {
+                    message: format!(
+                        "{} collision(s); no file was written:\n{}",
+                        blocking.len(),
+                        blocking.join("\n")
+                    ),
+                });
+            }
+        }
+
+        if let Some(cache) = &mut cache {
+            cache.save(root, entries)?;
+        }
+
+        // A failed write restores the files already written, so a failing
+        // run leaves the tree as it found it
+        for change in modified {
+            report.summary.merge(&DiffSummary::from_diff(
+                &change.original,
+                &change.transformed,
+            ));
+            if !self.dry_run
+                && let Err(e) = change.apply()
+            {
+                let _ = report.revert();
+                return Err(e);
+            }
+            report.changes.push(change);
+        }
+
+        report.partial_variants = variants::partial_changes(&report.changes);
+        if self.docs
+            && let Err(e) = self.run_docs(root, &mut report)
+        {
+            if !self.dry_run {
+                let _ = report.revert();
+            }
+            return Err(e);
+        }
+        Ok(report)
+    }
+
+    /// Rewrite references to renamed symbols in the Markdown files under
+    /// `root`, adding their changes to `report`.
+    fn run_docs(&self, root: &Path, report: &mut RunReport) -> Result<()> {
+        let docs = DocReferences::new(&SymbolMap::from_config(&self.config))?;
+        if docs.is_empty() {
+            return Ok(());
+        }
+        let matcher = self.config.exclude_patterns.iter().fold(
+            FileMatcher::new().extensions(markdown::EXTENSIONS.iter().copied()),
+            |matcher, pattern| matcher.exclude(pattern.as_str()),
+        );
+        let include = self.include.compile(root)?;
+        let exclude = self.exclude.compile(root)?;
+
+        for path in matcher.collect(root)? {
+            let rel = path.strip_prefix(root).unwrap_or(&path);
+            if (!include.is_empty() && !include.is_match(rel))
+                || exclude.is_match(rel)
+                || self.only.as_ref().is_some_and(|only| !only.contains(rel))
+            {
+                continue;
+            }
+            report.files_scanned += 1;
+            let original = self.read(&path)?;
+            let change = FileChange {
+                transformed: docs.apply(&original, &path)?,
+                path,
+                original,
+            };
+            if change.is_modified() {
+                report.summary.merge(&DiffSummary::from_diff(
+                    &change.original,
+                    &change.transformed,
+                ));
+                if !self.dry_run {
+                    change.apply()?;
+                }
+                report.changes.push(change);
+            }
+        }
+        report.changes.sort_by(|a, b| a.path.cmp(&b.path));
+        Ok(())
+    }
+
+    /// Run the configuration against in-memory `source`, as if it were the
+    /// contents of `path`. Nothing is read from or written to disk; the
+    /// rewritten text is in the report's only change, if there is one.
+    pub fn run_source(&self, path: impl AsRef<Path>, source: &str) -> Result<RunReport> {
+        let path = path.as_ref();
+        let rules = self.compile(self.root.as_deref())?;
+        let file = process_file(
+            &rules,
+            &self.adapters(None),
+            self.cleanup,
+            path,
+            source.to_string(),
+            content_hash(source),
+        )?;
+
+        let mut report = RunReport {
+            files_scanned: 1,
+            diagnostics: file.diagnostics,
+            edits: file.edits,
+            cleanups: file.cleanups,
+            overlaps: file.overlaps,
+            manual_todos: file.manual_todos,
+            todos: file.todos,
+            semantics: self.semantics(),
+            ..Default::default()
+        };
+        if file.change.is_modified() {
+            report.summary =
+                DiffSummary::from_diff(&file.change.original, &file.change.transformed);
+            report.changes.push(file.change);
+        }
+        Ok(report)
+    }
+
+    /// Run the configuration against an in-memory file set, keyed by path
+    /// relative to the project root. Files are selected by the config's
+    /// extensions and exclude patterns and the runner's include and exclude
+    /// globs, as by [`run`](Self::run), but nothing is read from or written
+    /// to disk. Use [`FileChange::edits`] to turn the changes into edits.
+    pub fn run_files<P: Into<PathBuf>>(
+        &self,
+        files: impl IntoIterator<Item = (P, String)>,
+    ) -> Result<RunReport> {
+        let rules = self.compile(self.root.as_deref())?;
+        let adapters = self.adapters(None);
+        let selected = self.selector()?;
+        let mut files: Vec<(PathBuf, String)> = files
+            .into_iter()
+            .map(|(path, source)| (path.into(), source))
+            .filter(|(path, _)| selected(path))
+            .collect();
+        files.sort_by(|a, b| a.0.cmp(&b.0));
+
+        let mut report = RunReport {
+            semantics: self.semantics(),
+            ..Default::default()
+        };
+        let results = pool::map(&files, self.jobs, |(path, source)| {
+            if self.skips_generated() && is_generated(source) {
+                return Ok(None);
+            }
+            process_file(
+                &rules,
+                &adapters,
+                self.cleanup,
+                path,
+                source.clone(),
+                content_hash(source),
+            )
+            .map(Some)
+        });
+        for result in results {
+            let Some(file) = result? else {
+                report.generated_skipped += 1;
+                continue;
+            };
+            report.files_scanned += 1;
+            report.diagnostics.extend(file.diagnostics);
+            report.edits.extend(file.edits);
+            report.cleanups.extend(file.cleanups);
+            report.overlaps.extend(file.overlaps);
+            report.manual_todos += file.manual_todos;
+            report.todos.extend(file.todos);
+            if file.change.is_modified() {
+                report.summary.merge(&DiffSummary::from_diff(
+                    &file.change.original,
+                    &file.change.transformed,
+                ));
+                report.changes.push(file.change);
+            }
+        }
+        Ok(report)
+    }
+
+    /// Apply the upgrade to the files matching `canary` first and pass the
+    /// result to `check` (typically a build or test run). If the check
+    /// passes, the upgrade is applied to the remaining files; otherwise the
+    /// canary changes are reverted and nothing else is touched. They are
+    /// also reverted if the check or the rest of the run fails. In dry-run
+    /// mode nothing is written, so the check is skipped.
+    pub fn run_canary(
+        &self,
+        root: impl AsRef<Path>,
+        canary: &str,
+        mut check: impl FnMut(&RunReport) -> Result<bool>,
+    ) -> Result<CanaryOutcome> {
+        let root = root.as_ref();
+        let staged = self.clone().include(canary);
+        let packages = self.driver_packages(root)?;
+        let staged_files = staged.files(root, packages.as_deref())?;
+        if staged_files.is_empty() {
+            return Err(RefactorError::InvalidConfig(format!(
+                "Canary '{}' matches no files",
+                canary
+            )));
+        }
+
+        let canary_report = staged.run(root)?;
+        // The canary's writes are undone on every error from here on
+        let undo = |e: RefactorError| {
+            if !self.dry_run {
+                let _ = canary_report.revert();
+            }
+            e
+        };
+        if self.dry_run || check(&canary_report).map_err(undo)? {
+            // The canary may have taken build-tag variants outside its glob
+            let mut rest = self.clone().exclude(canary);
+            rest.skip = staged_files
+                .iter()
+                .map(|path| path.strip_prefix(root).unwrap_or(path).to_path_buf())
+                .collect();
+            let rest = Box::new(rest.run(root).map_err(undo)?);
+            Ok(CanaryOutcome::Passed {
+                canary: canary_report,
+                rest,
+            })
+        } else {
+            canary_report.revert()?;
+            Ok(CanaryOutcome::Failed {
+                canary: canary_report,
+            })
+        }
+    }
+
+    /// Apply the rules one at a time, in order, each to the files as the
+    /// previous rules left them. After each rule that changed files, `step`
+    /// is called with the rule and its run, e.g. to commit the rule's
+    /// changes on their own. Returns the combined run. In dry-run mode the
+    /// rules see each other's output in memory, and each run's changes start
+    /// from the previous rules' output, e.g. for one patch per rule.
+    pub fn run_each_rule(
+        &self,
+        root: impl AsRef<Path>,
+        mut step: impl FnMut(&TransformRule, &RunReport) -> Result<()>,
+    ) -> Result<RunReport> {
+        let root = root.as_ref();
+        let mut report = RunReport {
+            semantics: self.semantics(),
+            ..Default::default()
+        };
+        let mut changes: Vec<FileChange> = Vec::new();
+        for rule in &self.config.transforms {
+            let mut runner = self.clone();
+            runner.config.transforms = vec![rule.clone()];
+            if self.dry_run {
+                runner.overlay = Some(Arc::new(
+                    changes
+                        .iter()
+                        .map(|c| (c.path.clone(), c.transformed.clone()))
+                        .collect(),
+                ));
+            }
+            let run = runner.run(root)?;
+            if !run.changes.is_empty() {
+                step(rule, &run)?;
+            }
+
+            for change in &run.changes {
+                match changes.iter_mut().find(|c| c.path == change.path) {
+                    Some(pending) => pending.transformed = change.transformed.clone(),
+                    None => changes.push(change.clone()),
+                }
+            }
+            report.files_scanned = report.files_scanned.max(run.files_scanned);
+            report.generated_skipped = report.generated_skipped.max(run.generated_skipped);
+            report.cache_hits += run.cache_hits;
+            report.manual_todos = run.manual_todos;
+            report.todos = run.todos;
+            report.diagnostics.extend(run.diagnostics);
+            report.edits.extend(run.edits);
+            report.cleanups.extend(run.cleanups);
+            report.overlaps.extend(run.overlaps);
+            report.partial_variants.extend(run.partial_variants);
+            report.collisions.extend(run.collisions);
+        }
+
+        // A later rule may undo an earlier one
+        changes.retain(FileChange::is_modified);
+        changes.sort_by(|a, b| a.path.cmp(&b.path));
+        for change in &changes {
+            report.summary.merge(&DiffSummary::from_diff(
+                &change.original,
+                &change.transformed,
+            ));
+        }
+        report.changes = changes;
+        Ok(report)
+    }
+
+    /// Run the rules a second time over the output of `report`, a run of
+    /// this runner, without writing anything. Returns the files the second
+    /// pass changes again; an idempotent ruleset returns none.
+    pub fn verify_idempotent(&self, report: &RunReport) -> Result<Vec<SecondPassChange>> {
+        let rules = self.compile(self.root.as_deref())?;
+        let adapters = self.adapters(None);
+        // Doc references are rewritten by the docs pass, not the rules
+        let changes: Vec<&FileChange> = report
+            .changes
+            .iter()
+            .filter(|change| {
+                !self.docs
+                    || !change
+                        .path
+                        .extension()
+                        .and_then(|ext| ext.to_str())
+                        .is_some_and(|ext| markdown::EXTENSIONS.contains(&ext))
+            })
+            .collect();
+        pool::map(&changes, self.jobs, |change| {
+            let file = process_file(
+                &rules,
+                &adapters,
+                self.cleanup,
+                &change.path,
+                change.transformed.clone(),
+                content_hash(&change.transformed),
+            )?;
+            Ok(idempotence::check(&file.change, &file.edits))
+        })
+        .into_iter()
+        .filter_map(Result::transpose)
+        .collect()
+    }
+
+    /// The packages the packages driver loads, if there is one.
+    fn driver_packages(&self, root: &Path) -> Result<Option<Vec<DriverPackage>>> {
+        let Some((driver, patterns)) = &self.packages else {
+            return Ok(None);
+        };
+        let patterns: Vec<&str> = patterns.iter().map(String::as_str).collect();
+        driver.load(root, &patterns).map(Some)
+    }
+
+    /// The files a [`run`](Self::run) at `root` processes, in order, after
+    /// its include and exclude globs.
+    pub fn select_files(&self, root: impl AsRef<Path>) -> Result<Vec<PathBuf>> {
+        let root = root.as_ref();
+        let packages = self.driver_packages(root)?;
+        let mut files = self.files(root, packages.as_deref())?;
+        files.sort();
+        Ok(files)
+    }
+
+    fn files(&self, root: &Path, packages: Option<&[DriverPackage]>) -> Result<Vec<PathBuf>> {
+        let mut files = self.config.to_upgrade().matcher().collect_files(root)?;
+        let companions = self.config.companion_files();
+        if !companions.is_empty() {
+            let matcher = self
+                .config
+                .exclude_patterns
+                .iter()
+                .fold(FileMatcher::new(), |m, pattern| m.exclude(pattern.as_str()));
+            let matcher = companions
+                .iter()
+                .fold(matcher, |m, glob| m.include(glob.as_str()));
+            files.extend(
+                matcher
+                    .collect(root)?
+                    .into_iter()
+                    .filter(|path| !in_skipped_dir(path.strip_prefix(root).unwrap_or(path))),
+            );
+            files.sort();
+            files.dedup();
+        }
+        let include = self.include.compile(root)?;
+        let exclude = self.exclude.compile(root)?;
+        let cache_dir = self.cache_dir.as_ref().map(|dir| root.join(dir));
+        let rel = |path: &PathBuf| path.strip_prefix(root).unwrap_or(path).to_path_buf();
+        let skip_vendored = self.semantics() >= semantics::SKIP_VENDORED;
+        let vendored = |path: &Path| skip_vendored && GoVendor::is_vendored(path);
+        let built: Option<HashSet<PathBuf>> = match packages {
+            Some(packages) => Some(source_files(root, packages)?.into_iter().collect()),
+            None => None,
+        };
+        let in_build = |path: &PathBuf| {
+            path.extension().and_then(|e| e.to_str()) != Some("go")
+                || built
+                    .as_ref()
+                    .is_none_or(|built| built.contains(&rel(path)))
+        };
+        let candidates: Vec<PathBuf> = files
+            .into_iter()
+            .filter(|path| {
+                !exclude.is_match(&rel(path))
+                    && !self.skip.contains(&rel(path))
+                    && !cache_dir.as_ref().is_some_and(|dir| path.starts_with(dir))
+                    && !vendored(path)
+            })
+            .collect();
+        let mut selected: Vec<PathBuf> = candidates
+            .iter()
+            .filter(|path| {
+                (include.is_empty() || include.is_match(&rel(path)))
+                    && self
+                        .only
+                        .as_ref()
+                        .is_none_or(|only| only.contains(&rel(path)))
+                    && in_build(path)
+            })
+            .cloned()
+            .collect();
+        // Build-tag variants of a selected file are rewritten with it, even
+        // outside the include globs
+        if self.semantics() >= semantics::BUILD_VARIANTS && selected.len() < candidates.len() {
+            let siblings = variants::siblings(&selected, &candidates);
+            selected.extend(siblings);
+        }
+        Ok(selected)
+    }
+
+    /// The content of the file at `path`, from the overlay if it has it.
+    fn read(&self, path: &Path) -> Result<String> {
+        match self.overlay.as_ref().and_then(|overlay| overlay.get(path)) {
+            Some(content) => Ok(content.clone()),
+            None => Ok(fs::read_to_string(path)?),
+        }
+    }
+
+    /// Predicate selecting relative paths for [`run_files`](Self::run_files).
+    fn selector(&self) -> Result<impl Fn(&Path) -> bool + use<'_>> {
+        let root = self.root.as_deref().unwrap_or(Path::new("."));
+        let include = self.include.compile(root)?;
+        let exclude = self.exclude.compile(root)?;
+        let config_exclude = glob_set(&self.config.exclude_patterns)?;
+        let companions = glob_set(&self.config.companion_files())?;
+        Ok(move |path: &Path| {
+            let ext = path.extension().and_then(|e| e.to_str()).unwrap_or("");
+            (self.config.extensions.is_empty()
+                || self
+                    .config
+                    .extensions
+                    .iter()
+                    .any(|e| e.eq_ignore_ascii_case(ext))
+                || companions.is_match(path))
+                && !config_exclude.is_match(path)
+                && (include.is_empty() || include.is_match(path))
+                && !exclude.is_match(path)
+                && self.only.as_ref().is_none_or(|only| only.contains(path))
+        })
+    }
+
+    /// The registered adapters, then the built-in ones. Imports of the
+    /// `packages` of a packages driver are the project's own.
+    fn adapters(&self, packages: Option<&[DriverPackage]>) -> AdapterRegistry {
+        let imports = self
+            .config
+            .transforms
+            .iter()
+            .flat_map(|rule| &rule.imports)
+            .fold(GoImports::new(), |imports, path| imports.with_import(path));
+        let imports = match &self.gopath {
+            Some(gopath) if self.semantics() >= semantics::GOPATH_IMPORTS => {
+                imports.with_gopath(gopath.clone())
+            }
+            _ => imports,
+        };
+        let imports = imports.with_packages(
+            packages
+                .unwrap_or_default()
+                .iter()
+                .map(|package| package.pkg_path.clone()),
+        );
+        let adapters = self.adapters.clone();
+        if self.semantics() < semantics::GO_IMPORTS {
+            return adapters;
+        }
+        adapters.register(Arc::new(GoAdapter::new(imports)))
+    }
+
+    fn skips_generated(&self) -> bool {
+        !self.include_generated && self.semantics() >= semantics::SKIP_GENERATED
+    }
+
+    /// The compiled rules, resolving relative file paths from `root`.
+    fn compile(&self, root: Option<&Path>) -> Result<Vec<CompiledRule<'_>>> {
+        if self.semantics() > semantics::CURRENT {
+            return Err(RefactorError::InvalidConfig(format!(
+                "Upgrade '{}' needs engine semantics {}; this engine implements {}",
+                self.config.name,
+                self.semantics(),
+                semantics::CURRENT
+            )));
+        }
+        // With companion files collected, each rule keeps to its own files:
+        // those its globs match, or else those with the config's extensions
+        let companions = !self.config.companion_files().is_empty();
+        let extensions = self
+            .config
+            .extensions
+            .iter()
+            .fold(Guard::new(), |guard, ext| {
+                guard.path(format!("**/*.{}", ext))
+            });
+        self.config
+            .transforms
+            .iter()
+            .map(|rule| {
+                let transform = rule.to_transform_with(&self.plugins)?;
+                let transform = if !rule.files.is_empty() {
+                    let files = rule
+                        .files
+                        .iter()
+                        .fold(Guard::new(), |guard, glob| guard.path(glob.as_str()));
+                    transform.within(files)?
+                } else if companions && !extensions.is_empty() {
+                    transform.within(extensions.clone())?
+                } else {
+                    transform
+                };
+                let transform = match root {
+                    Some(root) => transform.root(root),
+                    None => transform,
+                };
+                // Plugins reading other files see the earlier rules' output
+                let transform = match &self.overlay {
+                    Some(overlay) => transform.overlay(Arc::clone(overlay)),
+                    None => transform,
+                };
+                Ok((rule, transform))
+            })
+            .collect()
+    }
+}
+
+type CompiledRule<'a> = (&'a TransformRule, GuardedTransform);
+
+/// What running the rules against one file produced.
+struct FileResult {
+    change: FileChange,
+    diagnostics: Vec<Diagnostic>,
+    edits: Vec<RuleEdit>,
+    cleanups: Vec<Cleanup>,
+    overlaps: Vec<RuleOverlap>,
+    manual_todos: usize,
+    todos: Vec<TodoMarker>,
+    hash: String,
+    cached: bool,
+}
+
+impl FileResult {
+    /// Rebuild the result of an unchanged file from the analysis cache.
+    fn cached(path: &Path, original: String, entry: &CacheEntry, hash: String) -> Self {
+        let diagnostics = entry
+            .diagnostics
+            .iter()
+            .cloned()
+            .map(|d| Diagnostic {
+                path: path.to_path_buf(),
+                ..d
+            })
+            .collect();
+        let overlaps = entry
+            .overlaps
+            .iter()
+            .cloned()
+            .map(|o| RuleOverlap {
+                path: path.to_path_buf(),
+                ..o
+            })
+            .collect();
+        let todos = find_todos(path, &original);
+        Self {
+            change: FileChange {
+                path: path.to_path_buf(),
+                transformed: original.clone(),
+                original,
+            },
+            diagnostics,
+            edits: Vec::new(),
+            cleanups: Vec::new(),
+            overlaps,
+            manual_todos: entry.manual_todos,
+            todos,
+            hash,
+            cached: true,
+        }
+    }
+}
+
+/// Run every rule against one file without writing anything.
+fn process_file(
+    rules: &[CompiledRule<'_>],
+    adapters: &AdapterRegistry,
+    cleanup: bool,
+    path: &Path,
+    original: String,
+    hash: String,
+) -> Result<FileResult> {
+    let adapter = adapters.get(path);
+    let mut transformed = original.clone();
+    let mut diagnostics = Vec::new();
+    let mut edits = Vec::new();
+    let overlaps = overlaps::detect(rules, adapter, path, &original)?;
+
+    for (rule, transform) in rules {
+        if rule.is_suggest_only() {
+            diagnostics.extend(diagnostics_for(rule, transform, &original, path));
+        } else {
+            if rule.spec.reports_sites() {
+                diagnostics.extend(diagnostics_for(rule, transform, &transformed, path));
+            }
+            let sites = match adapter {
+                Some(adapter) => adapter.find(transform, &transformed, path)?,
+                None => transform.try_sites(&transformed, path)?,
+            };
+            for site in &sites {
+                edits.push(RuleEdit {
+                    rule: rule.name(),
+                    path: path.to_path_buf(),
+                    line: site.position(&transformed).0,
+                    todo: site.replacement.contains(TODO_MARKER) && !has_marker(&site.text),
+                });
+            }
+            let rewritten = match adapter {
+                Some(adapter) => adapter.rewrite(&transformed, &sites)?,
+                None => splice(&transformed, &sites),
+            };
+            let rewritten = todos::tag(&transformed, &rewritten, &rule.rule_id(), path);
+            if !sites.is_empty() {
+                remap_edits(&mut edits, &transformed, &rewritten);
+            }
+            transformed = rewritten;
+        }
+    }
+
+    let mut cleanups = Vec::new();
+    let go = path.extension().is_some_and(|ext| ext == "go");
+    if cleanup && go && transformed != original {
+        let (cleaned, found) = cleanup::clean(&original, &transformed, path);
+        for removed in found
+            .iter()
+            .filter(|c| c.kind == CleanupKind::Removed)
+            .rev()
+        {
+            for edit in edits.iter_mut().filter(|e| e.line > removed.line) {
+                edit.line -= 1;
+            }
+        }
+        cleanups = found;
+        transformed = cleaned;
+    }
+
+    if let Some(adapter) = adapter
+        && transformed != original
+    {
+        let printed = adapter.print(&original, &transformed)?;
+        shift_edits(&mut edits, &transformed, &printed);
+        if cleanup && go {
+            cleanups.extend(cleanup::removed_imports(&transformed, &printed, path));
+        }
+        transformed = printed;
+    }
+
+    let todos = find_todos(path, &transformed);
+    Ok(FileResult {
+        manual_todos: todos.len(),
+        todos,
+        change: FileChange {
+            path: path.to_path_buf(),
+            original,
+            transformed,
+        },
+        diagnostics,
+        edits,
+        cleanups,
+        overlaps,
+        hash,
+        cached: false,
+    })
+}
+
+fn glob_set(patterns: &[String]) -> Result<GlobSet> {
+    let mut builder = GlobSetBuilder::new();
+    for pattern in patterns {
+        builder.add(Glob::new(pattern)?);
+    }
+    Ok(builder.build()?)
+}
+
+/// Move edit lines from `before` to the same code in `after`, so the edits
+/// of earlier rules still point at their code once a later rule changes the
+/// line count. A rewritten line moves to the first line of its replacement.
+fn remap_edits(edits: &mut [RuleEdit], before: &str, after: &str) {
+    let diff = TextDiff::from_lines(before, after);
+    let mut lines = vec![0; before.lines().count()];
+    let (mut block, mut next) = (None, 0);
+    for change in diff.iter_all_changes() {
+        match (change.tag(), change.old_index(), change.new_index()) {
+            (ChangeTag::Equal, Some(old), Some(new)) => {
+                lines[old] = new;
+                (block, next) = (None, new + 1);
+            }
+            (ChangeTag::Insert, _, Some(new)) => {
+                block.get_or_insert(new);
+                next = new + 1;
+            }
+            (ChangeTag::Delete, Some(old), _) => lines[old] = *block.get_or_insert(next),
+            _ => {}
+        }
+    }
+    for edit in edits.iter_mut() {
+        if let Some(line) = edit.line.checked_sub(1).and_then(|i| lines.get(i)) {
+            edit.line = line + 1;
+        }
+    }
+}
+
+/// Move edit lines past an inserted or removed import block so they still
+/// point at the rewritten code.
+fn shift_edits(edits: &mut [RuleEdit], before: &str, after: &str) {
+    let delta = after.lines().count() as isize - before.lines().count() as isize;
+    if delta == 0 {
+        return;
+    }
+    let changed_from = before
+        .lines()
+        .zip(after.lines())
+        .take_while(|(a, b)| a == b)
+        .count();
+    for edit in edits.iter_mut().filter(|e| e.line > changed_from) {
+        edit.line = edit.line.saturating_add_signed(delta);
+    }
+}
+
+/// Reports every site where a rule matches as a diagnostic.
+fn diagnostics_for(
+    rule: &TransformRule,
+    transform: &GuardedTransform,
+    source: &str,
+    path: &Path,
+) -> Vec<Diagnostic> {
+    transform
+        .sites(source, path)
+        .into_iter()
+        .map(|site| {
+            let (line, column) = site.position(source);
+            Diagnostic {
+                rule: rule.name(),
+                message: rule.message.clone().unwrap_or_else(|| rule.spec.describe()),
+                path: path.to_path_buf(),
+                line,
+                column,
+                text: site.text,
+                suggestion: site.replacement,
+            }
+        })
+        .collect()
+}
+
+/// Returns true if `rel` is in a hidden, vendor or dependency directory,
+/// which hold no companion files of the project.
+fn in_skipped_dir(rel: &Path) -> bool {
+    rel.parent().is_some_and(|dir| {
+        dir.components().any(|component| {
+            let name = component.as_os_str().to_str().unwrap_or_default();
+            (name.starts_with('.') && name != "." && name != "..")
+                || matches!(name, "vendor" | "node_modules" | "target")
+        })
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::TransformSpec;
+    use tempfile::TempDir;
+
+    fn config() -> UpgradeConfig {
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "oldpkg".to_string(),
+            to: "newpkg".to_string(),
+        });
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "DeprecatedFn".to_string(),
+                new_name: "ReplacementFn".to_string(),
+            })
+            .with_id("deprecated-fn")
+            .with_message("DeprecatedFn is going away")
+            .suggest_only(),
+        );
+        config
+    }
+
+    #[test]
+    fn test_run_applies_and_reports() {
+        let dir = TempDir::new().unwrap();
+        let file = dir.path().join("main.go");
+        fs::write(
+            &file,
+            "oldpkg.Do()\nx := DeprecatedFn(1)\n// TODO(refactor): check flags\n",
+        )
+        .unwrap();
+
+        let report = UpgradeRunner::new(config()).run(dir.path()).unwrap();
+
+        assert_eq!(report.files_scanned, 1);
+        assert_eq!(report.files_modified(), 1);
+        assert_eq!(
+            fs::read_to_string(&file).unwrap(),
+            "newpkg.Do()\nx := DeprecatedFn(1)\n// TODO(refactor): check flags\n"
+        );
+        assert_eq!(report.manual_todos, 1);
+
+        assert_eq!(report.edits.len(), 1);
+        assert_eq!(report.edits[0].line, 1);
+
+        assert_eq!(report.diagnostics.len(), 1);
+        let diagnostic = &report.diagnostics[0];
+        assert_eq!(diagnostic.rule, "deprecated-fn");
+        assert_eq!((diagnostic.line, diagnostic.column), (2, 6));
+        assert_eq!(diagnostic.suggestion, "ReplacementFn(");
+        assert!(
+            diagnostic
+                .to_string()
+                .contains("DeprecatedFn is going away")
+        );
+    }
+
+    #[test]
+    fn test_run_edits_companion_files() {
+        let dir = TempDir::new().unwrap();
+        fs::write(dir.path().join("main.go"), "port := cfg.Get(\"oldpkg\")\n").unwrap();
+        fs::create_dir(dir.path().join("deploy")).unwrap();
+        let yaml = dir.path().join("deploy/app.yaml");
+        fs::write(&yaml, "oldpkg:\n  port: 80\n").unwrap();
+        fs::write(dir.path().join("notes.txt"), "oldpkg\n").unwrap();
+        // Hidden and dependency directories are not the project's
+        let skipped = [".git", ".github", "vendor", "node_modules/lib"];
+        for skipped in skipped {
+            fs::create_dir_all(dir.path().join(skipped)).unwrap();
+            fs::write(
+                dir.path().join(skipped).join("app.yaml"),
+                "oldpkg:\n  port: 80\n",
+            )
+            .unwrap();
+        }
+
+        let mut config = config();
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameKey {
+                key: "oldpkg.port".to_string(),
+                new_name: "listen_port".to_string(),
+            })
+            .with_files(["**/*.yaml"]),
+        );
+        let report = UpgradeRunner::new(config).run(dir.path()).unwrap();
+
+        assert_eq!(report.files_scanned, 2);
+        assert_eq!(
+            fs::read_to_string(dir.path().join("main.go")).unwrap(),
+            "port := cfg.Get(\"newpkg\")\n"
+        );
+        // The Go rules keep to Go files
+        assert_eq!(
+            fs::read_to_string(&yaml).unwrap(),
+            "oldpkg:\n  listen_port: 80\n"
+        );
+        for skipped in skipped {
+            assert_eq!(
+                fs::read_to_string(dir.path().join(skipped).join("app.yaml")).unwrap(),
+                "oldpkg:\n  port: 80\n"
+            );
+        }
+    }
+
+    #[test]
+    fn test_run_reports_removed_calls() {
+        let dir = TempDir::new().unwrap();
+        let file = dir.path().join("main.go");
+        fs::write(
+            &file,
+            "func main() {\n\tDeprecatedFn()\n\tx := DeprecatedFn()\n}\n",
+        )
+        .unwrap();
+
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(
+            TransformRule::new(TransformSpec::RemoveCall {
+                function: "DeprecatedFn".to_string(),
+                strategy: crate::transform::Removal::Delete,
+                replacement: None,
+            })
+            .with_id("removed-fn"),
+        );
+        let runner = UpgradeRunner::new(config);
+        let report = runner.run(dir.path()).unwrap();
+
+        // The marker is tagged with the rule and a tracking id
+        let todo = &report.todos[0];
+        assert_eq!(
+            (todo.rule.as_deref(), todo.line, todo.note.as_str()),
+            (Some("removed-fn"), 2, "DeprecatedFn was removed")
+        );
+        let migrated = format!(
+            "func main() {{\n\t// TODO(refactor-dsl:removed-fn:{}): DeprecatedFn was removed\n\tx := DeprecatedFn()\n}}\n",
+            todo.id.as_deref().unwrap()
+        );
+        assert_eq!(fs::read_to_string(&file).unwrap(), migrated);
+        let lines: Vec<usize> = report.diagnostics.iter().map(|d| d.line).collect();
+        assert_eq!(lines, [2, 3]);
+        assert_eq!(report.manual_todos, 1);
+        // The deleted call is automatic, the marked one automatic with TODO
+        let todos: Vec<bool> = report.edits.iter().map(|e| e.todo).collect();
+        assert_eq!(todos, [false, true]);
+
+        // A second run recognizes the tagged marker
+        runner.run(dir.path()).unwrap();
+        assert_eq!(fs::read_to_string(&file).unwrap(), migrated);
+    }
+
+    #[test]
+    fn test_run_fixes_go_imports() {
+        let dir = TempDir::new().unwrap();
+        let file = dir.path().join("main.go");
+        fs::write(
+            &file,
+            "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(oldpkg.Connect())\n}\n",
+        )
+        .unwrap();
+
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(
+            TransformRule::new(TransformSpec::ReplacePattern {
+                pattern: r"oldpkg\.Connect\(\)".to_string(),
+                replacement: "pool.Connect(time.Second)".to_string(),
+            })
+            .with_import("github.com/acme/pool/v3"),
+        );
+        let report = UpgradeRunner::new(config).run(dir.path()).unwrap();
+
+        assert_eq!(report.edits[0].line, 11);
+        assert_eq!(
+            fs::read_to_string(&file).unwrap(),
+            "package main\n\nimport (\n\t\"fmt\"\n\t\"time\"\n\n\t\"github.com/acme/pool/v3\"\n)\n\nfunc main() {\n\tfmt.Println(pool.Connect(time.Second))\n}\n"
+        );
+    }
+
+    #[test]
+    fn test_run_rewrites_docs() {
+        let dir = TempDir::new().unwrap();
+        fs::create_dir_all(dir.path().join("docs/adr")).unwrap();
+        let adr = dir.path().join("docs/adr/0001-client.md");
+        fs::write(&adr, "Use `oldpkg.Do()`, not oldpkg.\n").unwrap();
+        fs::write(dir.path().join("main.go"), "oldpkg.Do()\n").unwrap();
+
+        let report = UpgradeRunner::new(config()).run(dir.path()).unwrap();
+        assert_eq!(report.files_modified(), 1);
+        assert_eq!(
+            fs::read_to_string(&adr).unwrap(),
+            "Use `oldpkg.Do()`, not oldpkg.\n"
+        );
+
+        fs::write(dir.path().join("main.go"), "oldpkg.Do()\n").unwrap();
+        let report = UpgradeRunner::new(config()).docs().run(dir.path()).unwrap();
+        assert_eq!(report.files_scanned, 2);
+        assert_eq!(report.files_modified(), 2);
+        assert_eq!(report.changes[0].path, adr);
+        assert_eq!(
+            fs::read_to_string(&adr).unwrap(),
+            "Use `newpkg.Do()`, not oldpkg.\n"
+        );
+    }
+
+    #[test]
+    fn test_run_dry_run_leaves_files() {
+        let dir = TempDir::new().unwrap();
+        let file = dir.path().join("main.go");
+        fs::write(&file, "oldpkg.Do()\n").unwrap();
+
+        let report = UpgradeRunner::new(config())
+            .dry_run()
+            .run(dir.path())
+            .unwrap();
+
+        assert_eq!(report.files_modified(), 1);
+        assert_eq!(fs::read_to_string(&file).unwrap(), "oldpkg.Do()\n");
+    }
+
+    #[test]
+    fn test_run_canary_stages_rollout() {
+        let dir = TempDir::new().unwrap();
+        fs::create_dir_all(dir.path().join("billing")).unwrap();
+        let canary = dir.path().join("billing/main.go");
+        let other = dir.path().join("main.go");
+        fs::write(&canary, "oldpkg.Do()\n").unwrap();
+        fs::write(&other, "oldpkg.Do()\n").unwrap();
+
+        let runner = UpgradeRunner::new(config());
+
+        let failed = runner
+            .run_canary(dir.path(), "billing/**", |report| {
+                assert_eq!(report.files_modified(), 1);
+                Ok(false)
+            })
+            .unwrap();
+        assert!(!failed.passed());
+        assert_eq!(fs::read_to_string(&canary).unwrap(), "oldpkg.Do()\n");
+        assert_eq!(fs::read_to_string(&other).unwrap(), "oldpkg.Do()\n");
+
+        // A check that fails to run reverts the canary too
+        let error = runner.run_canary(dir.path(), "billing/**", |_| {
+            Err(RefactorError::TransformFailed {
+                message: "build failed to start".to_string(),
+            })
+        });
+        assert!(error.is_err());
+        assert_eq!(fs::read_to_string(&canary).unwrap(), "oldpkg.Do()\n");
+
+        // So does a failure in the rest of the run, here a file that is not
+        // UTF-8 by the time it is read
+        let error = runner.run_canary(dir.path(), "billing/**", |_| {
+            fs::write(&other, [0xff, 0xfe]).unwrap();
+            Ok(true)
+        });
+        assert!(error.is_err());
+        assert_eq!(fs::read_to_string(&canary).unwrap(), "oldpkg.Do()\n");
+        fs::write(&other, "oldpkg.Do()\n").unwrap();
+
+        let passed = runner
+            .run_canary(dir.path(), "billing/**", |_| Ok(true))
+            .unwrap();
+        let CanaryOutcome::Passed {
+            canary: first,
+            rest,
+        } = passed
+        else {
+            panic!("canary should pass");
+        };
+        assert_eq!((first.files_scanned, rest.files_scanned), (1, 1));
+        assert_eq!(fs::read_to_string(&canary).unwrap(), "newpkg.Do()\n");
+        assert_eq!(fs::read_to_string(&other).unwrap(), "newpkg.Do()\n");
+
+        assert!(
+            runner
+                .run_canary(dir.path(), "auth/**", |_| Ok(true))
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_run_each_rule() {
+        let dir = TempDir::new().unwrap();
+        let file = dir.path().join("main.go");
+        fs::write(&file, "oldpkg.Do()\n").unwrap();
+        fs::write(dir.path().join("other.go"), "Do()\n").unwrap();
+
+        let mut config = config();
+        config.add_transform(
+            TransformRule::new(TransformSpec::ReplaceLiteral {
+                from: "newpkg".to_string(),
+                to: "pkg".to_string(),
+            })
+            .with_id("shorten"),
+        );
+        let runner = UpgradeRunner::new(config);
+
+        let mut steps = Vec::new();
+        let report = runner
+            .run_each_rule(dir.path(), |rule, run| {
+                steps.push((rule.name(), run.changes[0].transformed.clone()));
+                Ok(())
+            })
+            .unwrap();
+
+        assert_eq!(
+            steps,
+            [
+                (
+                    "replace_literal oldpkg -> newpkg".to_string(),
+                    "newpkg.Do()\n".to_string()
+                ),
+                ("shorten".to_string(), "pkg.Do()\n".to_string()),
+            ]
+        );
+        assert_eq!(report.files_modified(), 1);
+        assert_eq!(report.changes[0].original, "oldpkg.Do()\n");
+        assert_eq!(report.changes[0].transformed, "pkg.Do()\n");
+        assert_eq!(fs::read_to_string(&file).unwrap(), "pkg.Do()\n");
+
+        // In dry-run mode each rule's changes start from the previous rules'
+        fs::write(&file, "oldpkg.Do()\n").unwrap();
+        let mut patches = Vec::new();
+        let report = runner
+            .dry_run()
+            .run_each_rule(dir.path(), |_, run| {
+                patches.push(run.patch(dir.path()));
+                Ok(())
+            })
+            .unwrap();
+        assert_eq!(patches.len(), 2);
+        assert!(patches[0].starts_with("diff --git a/main.go b/main.go\n"));
+        assert!(patches[0].contains("\n-oldpkg.Do()\n") && patches[0].contains("\n+newpkg.Do()\n"));
+        assert!(patches[1].contains("\n-newpkg.Do()\n") && patches[1].contains("\n+pkg.Do()\n"));
+        assert_eq!(report.changes[0].transformed, "pkg.Do()\n");
+        assert_eq!(fs::read_to_string(&file).unwrap(), "oldpkg.Do()\n");
+
+        // Rules reading other files of a package see the earlier output too
+        fs::create_dir(dir.path().join("models")).unwrap();
+        let import = "package models\n\nimport \"example.com/mylib\"\n\n";
+        fs::write(
+            dir.path().join("models/types.go"),
+            format!("{}type Status = mylib.Status\n", import),
+        )
+        .unwrap();
+        fs::write(
+            dir.path().join("models/user.go"),
+            format!("{}var s Status\n", import),
+        )
+        .unwrap();
+        let mut config = UpgradeConfig::new("test", "test").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "type Status =".to_string(),
+            to: "type State =".to_string(),
+        });
+        config.add_transform(TransformSpec::RenameGoType {
+            package: Some("example.com/mylib".to_string()),
+            old_name: "Status".to_string(),
+            new_name: "Code".to_string(),
+            transitive: true,
+        });
+        let report = UpgradeRunner::new(config)
+            .dry_run()
+            .include("models/**")
+            .run_each_rule(dir.path(), |_, _| Ok(()))
+            .unwrap();
+        let changed: Vec<&Path> = report.changes.iter().map(|c| c.path.as_path()).collect();
+        assert_eq!(changed, [dir.path().join("models/types.go")]);
+    }
+
+    #[test]
+    fn test_run_only_files() {
+        let dir = TempDir::new().unwrap();
+        fs::create_dir_all(dir.path().join("billing")).unwrap();
+        let touched = dir.path().join("billing/main.go");
+        let other = dir.path().join("main.go");
+        fs::write(&touched, "oldpkg.Do()\n").unwrap();
+        fs::write(&other, "oldpkg.Do()\n").unwrap();
+
+        let report = UpgradeRunner::new(config())
+            .only_files(["billing/main.go", "billing/deleted.go"])
+            .run(dir.path())
+            .unwrap();
+
+        assert_eq!(report.files_scanned, 1);
+        assert_eq!(fs::read_to_string(&touched).unwrap(), "newpkg.Do()\n");
+        assert_eq!(fs::read_to_string(&other).unwrap(), "oldpkg.Do()\n");
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_run_packages_from_driver() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path().canonicalize().unwrap();
+        fs::create_dir_all(root.join("services")).unwrap();
+        fs::write(root.join("services/api.go"), "oldpkg.Do()\n").unwrap();
+        fs::write(root.join("stale.go"), "oldpkg.Do()\n").unwrap();
+        let response = format!(
+            r#"{{"Roots":["//services"],"Packages":[{{"ID":"//services","GoFiles":["{}/services/api.go"]}}]}}"#,
+            root.display()
+        );
+        let driver = GoPackagesDriver::new("sh").args(["-c", &format!("echo '{}'", response)]);
+
+        let report = UpgradeRunner::new(config())
+            .packages_driver(driver, ["//services/..."])
+            .run(&root)
+            .unwrap();
+        assert_eq!(report.files_scanned, 1);
+        assert_eq!(
+            fs::read_to_string(root.join("services/api.go")).unwrap(),
+            "newpkg.Do()\n"
+        );
+        assert_eq!(
+            fs::read_to_string(root.join("stale.go")).unwrap(),
+            "oldpkg.Do()\n"
+        );
+    }
+
+    #[test]
+    fn test_run_coordinates_build_variants() {
+        let dir = TempDir::new().unwrap();
+        let linux = dir.path().join("conn_linux.go");
+        let windows = dir.path().join("conn_windows.go");
+        fs::write(&linux, "package pool\n\nfunc Dial(addr string) {}\n").unwrap();
+        fs::write(&windows, "package pool\n\nfunc Dial(address string) {}\n").unwrap();
+        fs::write(dir.path().join("pool.go"), "package pool\n").unwrap();
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "func Dial(".to_string(),
+            to: "func Dial(ctx Context, ".to_string(),
+        });
+
+        // The windows variant is run although only the linux one changed
+        let report = UpgradeRunner::new(config.clone())
+            .only_files(["conn_linux.go"])
+            .run(dir.path())
+            .unwrap();
+        assert_eq!(report.files_scanned, 2);
+        assert_eq!(report.files_modified(), 2);
+        assert!(report.partial_variants.is_empty());
+
+        // A pattern matching one variant's parameter names only
+        fs::write(&linux, "package pool\n\nfunc Dial(addr string) {}\n").unwrap();
+        fs::write(&windows, "package pool\n\nfunc Dial(address string) {}\n").unwrap();
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "Dial(addr string)".to_string(),
+            to: "Dial(ctx Context, addr string)".to_string(),
+        });
+        let report = UpgradeRunner::new(config).run(dir.path()).unwrap();
+        assert_eq!(report.partial_variants.len(), 1);
+        assert_eq!(report.partial_variants[0].function, "Dial");
+        assert_eq!(report.partial_variants[0].unchanged, vec![windows]);
+    }
+
+    #[test]
+    fn test_run_blocks_name_collisions() {
+        let dir = TempDir::new().unwrap();
+        let users = dir.path().join("users.go");
+        let caller = dir.path().join("main.go");
+        fs::write(
+            &users,
+            "package users\n\nfunc GetUser() {}\n\nfunc FetchUser() {}\n",
+        )
+        .unwrap();
+        fs::write(&caller, "package users\n\nvar u = GetUser()\n").unwrap();
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::RenameFunction {
+            old_name: "GetUser".to_string(),
+            new_name: "FetchUser".to_string(),
+        });
+
+        let err = UpgradeRunner::new(config.clone())
+            .run(dir.path())
+            .unwrap_err();
+        assert!(
+            err.to_string()
+                .contains("FetchUser would be declared 2 times")
+        );
+        assert!(fs::read_to_string(&caller).unwrap().contains("GetUser()"));
+
+        let report = UpgradeRunner::new(config.clone())
+            .resolve_collisions()
+            .run(dir.path())
+            .unwrap();
+        assert_eq!(report.collisions.len(), 1);
+        assert_eq!(
+            report.collisions[0].resolved_as.as_deref(),
+            Some("FetchUser2")
+        );
+        assert_eq!(
+            fs::read_to_string(&caller).unwrap(),
+            "package users\n\nvar u = FetchUser2()\n"
+        );
+
+        // Packs pinned to older semantics keep the collision
+        fs::write(&caller, "package users\n\nvar u = GetUser()\n").unwrap();
+        fs::write(
+            &users,
+            "package users\n\nfunc GetUser() {}\n\nfunc FetchUser() {}\n",
+        )
+        .unwrap();
+        let report = UpgradeRunner::new(config)
+            .engine(SemanticsVersion::new(0, 6))
+            .run(dir.path())
+            .unwrap();
+        assert_eq!(report.files_modified(), 2);
+    }
+
+    #[test]
+    fn test_run_parallel_is_deterministic() {
+        let dir = TempDir::new().unwrap();
+        for name in ["a.go", "b.go", "c.go", "d.go"] {
+            fs::write(dir.path().join(name), "oldpkg.Do()\nDeprecatedFn()\n").unwrap();
+        }
+
+        let runner = UpgradeRunner::new(config()).dry_run();
+        let serial = runner.clone().jobs(1).run(dir.path()).unwrap();
+        let parallel = runner.jobs(4).run(dir.path()).unwrap();
+
+        let paths = |report: &RunReport| -> Vec<PathBuf> {
+            report.edits.iter().map(|e| e.path.clone()).collect()
+        };
+        assert_eq!(paths(&parallel), paths(&serial));
+        assert!(paths(&parallel).is_sorted());
+        assert_eq!(parallel.diagnostics.len(), 4);
+        assert_eq!(parallel.summary.files_changed, 4);
+    }
+
+    #[test]
+    fn test_run_reuses_cached_results() {
+        let dir = TempDir::new().unwrap();
+        fs::write(dir.path().join("a.go"), "x := DeprecatedFn(1)\n").unwrap();
+        fs::write(dir.path().join("b.go"), "oldpkg.Do()\n").unwrap();
+
+        let runner = UpgradeRunner::new(config()).cache(DEFAULT_CACHE_DIR);
+        let first = runner.run(dir.path()).unwrap();
+        assert_eq!((first.cache_hits, first.files_modified()), (0, 1));
+
+        // b.go was rewritten by the first run, so it is analyzed again.
+        let second = runner.run(dir.path()).unwrap();
+        assert_eq!(second.cache_hits, 1);
+        assert_eq!(second.diagnostics.len(), 1);
+        assert_eq!(second.diagnostics[0].path, dir.path().join("a.go"));
+
+        let third = runner.run(dir.path()).unwrap();
+        assert_eq!((third.cache_hits, third.files_scanned), (2, 2));
+    }
+
+    #[test]
+    fn test_cached_results_keep_overlaps() {
+        let dir = TempDir::new().unwrap();
+        fs::write(dir.path().join("a.go"), "Close()\n").unwrap();
+        let mut config = UpgradeConfig::new("t", "t").with_extensions(vec!["go".to_string()]);
+        // Both rules match, but neither changes the file
+        for (id, from) in [("close", "Close()"), ("paren", "()")] {
+            config.add_transform(
+                TransformRule::new(TransformSpec::ReplaceLiteral {
+                    from: from.to_string(),
+                    to: from.to_string(),
+                })
+                .with_id(id),
+            );
+        }
+
+        let runner = UpgradeRunner::new(config).cache(DEFAULT_CACHE_DIR);
+        let first = runner.run(dir.path()).unwrap();
+        let second = runner.run(dir.path()).unwrap();
+        assert_eq!(second.cache_hits, 1);
+        assert_eq!(first.overlaps.len(), 1);
+        assert_eq!(second.overlaps, first.overlaps);
+    }
+
+    #[test]
+    fn test_run_source_is_in_memory() {
+        let report = UpgradeRunner::new(config())
+            .run_source("main.go", "oldpkg.Do()\nDeprecatedFn()\n")
+            .unwrap();
+
+        assert_eq!(report.changes.len(), 1);
+        assert_eq!(
+            report.changes[0].transformed,
+            "newpkg.Do()\nDeprecatedFn()\n"
+        );
+        assert_eq!(report.diagnostics.len(), 1);
+        assert!(!Path::new("main.go").exists());
+    }
+
+    #[test]
+    fn test_run_files_returns_edits() {
+        use crate::transform::EditSet;
+
+        let report = UpgradeRunner::new(config())
+            .exclude("vendor/**")
+            .run_files([
+                (
+                    "cmd/main.go",
+                    "package main\n\nfunc main() {\n\toldpkg.Do()\n}\n".to_string(),
+                ),
+                ("vendor/x/x.go", "oldpkg.Do()\n".to_string()),
+                ("README.md", "oldpkg\n".to_string()),
+            ])
+            .unwrap();
+
+        assert_eq!(report.files_scanned, 1);
+        let change = &report.changes[0];
+        assert_eq!(change.path, Path::new("cmd/main.go"));
+
+        let edits = change.edits();
+        assert_eq!(edits.len(), 1);
+        assert_eq!(
+            &change.original[edits[0].start..edits[0].end],
+            "\toldpkg.Do()\n"
+        );
+        assert_eq!(edits[0].text, "\tnewpkg.Do()\n");
+
+        let mut set = EditSet::new();
+        edits.into_iter().for_each(|edit| set.push(edit));
+        assert_eq!(set.apply(&change.original).unwrap(), change.transformed);
+    }
+
+    #[test]
+    fn test_edit_lines_follow_later_rules() {
+        let mut config = UpgradeConfig::new("t", "t").with_extensions(vec!["txt".to_string()]);
+        config.add_transform(
+            TransformRule::new(TransformSpec::ReplaceLiteral {
+                from: "conn.Close()".to_string(),
+                to: "conn.Shutdown()".to_string(),
+            })
+            .with_id("close"),
+        );
+        config.add_transform(
+            TransformRule::new(TransformSpec::ReplacePattern {
+                pattern: r"setup\(\)".to_string(),
+                replacement: "setup()\ninit()\ninit2()".to_string(),
+            })
+            .with_id("init"),
+        );
+
+        let report = UpgradeRunner::new(config)
+            .run_files([("a.txt", "setup()\nwork()\nconn.Close()\n".to_string())])
+            .unwrap();
+        let lines: Vec<_> = report
+            .edits
+            .iter()
+            .map(|e| (e.rule.as_str(), e.line))
+            .collect();
+        assert_eq!(lines, [("close", 5), ("init", 1)]);
+        assert_eq!(
+            report.changes[0].transformed.lines().nth(4),
+            Some("conn.Shutdown()")
+        );
+    }
+
+    #[test]
+    fn test_run_skips_generated_files() {
+        let dir = TempDir::new().unwrap();
+        let generated = dir.path().join("api.pb.go");
+        let source = "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage api\n\nvar _ = oldpkg.Do\n";
+        fs::write(&generated, source).unwrap();
+        fs::write(dir.path().join("main.go"), "oldpkg.Do()\n").unwrap();
+
+        let report = UpgradeRunner::new(config()).run(dir.path()).unwrap();
+        assert_eq!((report.files_scanned, report.generated_skipped), (1, 1));
+        assert_eq!(fs::read_to_string(&generated).unwrap(), source);
+
+        let report = UpgradeRunner::new(config())
+            .include_generated()
+            .run(dir.path())
+            .unwrap();
+        assert_eq!(report.files_modified(), 1);
+        assert_ne!(fs::read_to_string(&generated).unwrap(), source);
+    }
+
+    #[test]
+    fn test_run_skips_vendored_code() {
+        let dir = TempDir::new().unwrap();
+        let vendored = dir.path().join("vendor/example.com/oldpkg/do.go");
+        fs::create_dir_all(vendored.parent().unwrap()).unwrap();
+        fs::write(&vendored, "oldpkg.Do()\n").unwrap();
+        fs::write(dir.path().join("main.go"), "oldpkg.Do()\n").unwrap();
+
+        // A vendor directory without modules.txt is the project's own code
+        let report = UpgradeRunner::new(config()).run(dir.path()).unwrap();
+        assert_eq!(report.files_modified(), 2);
+
+        fs::write(&vendored, "oldpkg.Do()\n").unwrap();
+        fs::write(
+            dir.path().join("vendor/modules.txt"),
+            "# example.com/oldpkg v1.0.0\nexample.com/oldpkg\n",
+        )
+        .unwrap();
+        let report = UpgradeRunner::new(config()).run(dir.path()).unwrap();
+        assert_eq!(report.files_scanned, 1);
+        assert_eq!(fs::read_to_string(&vendored).unwrap(), "oldpkg.Do()\n");
+    }
+
+    #[test]
+    fn test_run_follows_pinned_semantics() {
+        let source = "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage api\n\nfunc f() {\n\toldpkg.Do()\n}\n";
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(TransformSpec::ReplaceLiteral {
+            from: "oldpkg.Do()".to_string(),
+            to: "time.Sleep(0)".to_string(),
+        });
+
+        let current = UpgradeRunner::new(config.clone())
+            .run_files([("api.pb.go", source.to_string())])
+            .unwrap();
+        assert_eq!(current.semantics, semantics::CURRENT);
+        assert_eq!(current.generated_skipped, 1);
+
+        // Before 0.3 generated files were rewritten, before 0.2 without
+        // fixing imports
+        let pinned = UpgradeRunner::new(config.clone().with_engine(SemanticsVersion::new(0, 2)))
+            .run_files([("api.pb.go", source.to_string())])
+            .unwrap();
+        assert_eq!(pinned.semantics, SemanticsVersion::new(0, 2));
+        assert!(pinned.changes[0].transformed.contains("import \"time\""));
+        let oldest = UpgradeRunner::new(config.clone())
+            .engine(SemanticsVersion::new(0, 1))
+            .run_files([("api.pb.go", source.to_string())])
+            .unwrap();
+        assert!(!oldest.changes[0].transformed.contains("import"));
+
+        let future = UpgradeRunner::new(config.with_engine(SemanticsVersion::new(9, 0)));
+        assert!(future.run_files([("main.go", String::new())]).is_err());
+    }
+
+    #[test]
+    fn test_is_generated_needs_header() {
+        assert!(is_generated(
+            "// Code generated by mockgen. DO NOT EDIT.\npackage x\n"
+        ));
+        assert!(!is_generated(
+            "package x\n\n// Code generated by hand. DO NOT EDIT.\n"
+        ));
+        assert!(!is_generated(
+            "// Code generated by mockgen; please edit.\npackage x\n"
+        ));
+    }
+
+    #[test]
+    fn test_run_source_with_plugins() {
+        use crate::plugin::Match;
+
+        struct SkipTests;
+        impl SiteMatcher for SkipTests {
+            fn matches(&self, m: &Match) -> Result<bool> {
+                Ok(m.captures["1"] != "test")
+            }
+        }
+        struct Quote;
+        impl Rewriter for Quote {
+            fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+                Ok(Some(format!("Open({:?})", m.captures["1"])))
+            }
+        }
+
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(
+            TransformRule::new(TransformSpec::ReplacePattern {
+                pattern: r"Open\((\w+)\)".to_string(),
+                replacement: "Open($1)".to_string(),
+            })
+            .with_matcher("skip-tests")
+            .with_rewriter("quote"),
+        );
+        assert!(
+            UpgradeRunner::new(config.clone())
+                .run_source("a.go", "")
+                .is_err()
+        );
+
+        let report = UpgradeRunner::new(config)
+            .with_matcher("skip-tests", SkipTests)
+            .with_rewriter("quote", Quote)
+            .run_source("a.go", "Open(prod)\nOpen(test)\n")
+            .unwrap();
+        assert_eq!(
+            report.changes[0].transformed,
+            "Open(\"prod\")\nOpen(test)\n"
+        );
+    }
+}
@@ -0,0 +1,175 @@
+//! Rules rewriting the same code.
+//!
+//! Rules run in the order of the configuration, each on the output of the
+//! ones before it, so the result is deterministic. When two rules match the
+//! same code, such as a rename of `GetUser` and a signature change of
+//! `GetUser(id)`, that order decides the outcome: once the rename has run,
+//! the signature change no longer matches and is silently lost. [`detect`]
+//! finds the code two rules both match in a file's original content, and
+//! applies the pair in both orders: if the results agree the overlap is
+//! harmless, and if they differ the rules genuinely conflict and the run
+//! warns about it. Rules with plugins are not checked, as that would run
+//! the plugins again for every match.
+
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::path::{Path, PathBuf};
+
+use super::CompiledRule;
+use crate::error::Result;
+use crate::lang::LanguageAdapter;
+use crate::transform::{GuardedTransform, Site, splice};
+
+/// Two rules matching the same code in a file.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RuleOverlap {
+    /// File both rules match.
+    pub path: PathBuf,
+    /// 1-based line of the first code both rules match.
+    pub line: usize,
+    /// The rule that runs first.
+    pub first: String,
+    /// The rule that runs second, on the output of the first.
+    pub second: String,
+    /// Whether running the rules in the other order gives another result.
+    pub conflict: bool,
+}
+
+impl fmt::Display for RuleOverlap {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}:{}: rules {} and {} match the same code",
+            self.path.display(),
+            self.line,
+            self.first,
+            self.second
+        )?;
+        if self.conflict {
+            write!(
+                f,
+                "; the result depends on their order, and {} runs first",
+                self.first
+            )?;
+        }
+        Ok(())
+    }
+}
+
+/// The overlaps between the apply-mode `rules` in `original`, the content
+/// of the file at `path`: one per pair of rules, at the first code both
+/// match.
+pub(super) fn detect(
+    rules: &[CompiledRule<'_>],
+    adapter: Option<&dyn LanguageAdapter>,
+    path: &Path,
+    original: &str,
+) -> Result<Vec<RuleOverlap>> {
+    let find = |transform: &GuardedTransform, source: &str| match adapter {
+        Some(adapter) => adapter.find(transform, source, path),
+        None => transform.try_sites(source, path),
+    };
+    let apply = |transform: &GuardedTransform, source: &str| {
+        let sites = find(transform, source)?;
+        match adapter {
+            Some(adapter) => adapter.rewrite(source, &sites),
+            None => Ok(splice(source, &sites)),
+        }
+    };
+
+    // Rules with plugins are left out rather than calling the plugins again
+    let mut found: Vec<(&CompiledRule<'_>, Vec<Site>)> = Vec::new();
+    for compiled in rules
+        .iter()
+        .filter(|(rule, _)| !rule.is_suggest_only() && !rule.uses_plugins())
+    {
+        let sites = find(&compiled.1, original)?;
+        if !sites.is_empty() {
+            found.push((compiled, sites));
+        }
+    }
+    let rules = found;
+
+    let mut overlaps = Vec::new();
+    for (index, ((first, a), first_sites)) in rules.iter().enumerate() {
+        for ((second, b), second_sites) in &rules[index + 1..] {
+            let shared = first_sites
+                .iter()
+                .flat_map(|x| second_sites.iter().map(move |y| (x, y)))
+                .filter(|(x, y)| x.start < y.end && y.start < x.end)
+                .map(|(x, y)| x.start.min(y.start))
+                .min();
+            let Some(start) = shared else {
+                continue;
+            };
+            let forward = apply(b, &apply(a, original)?)?;
+            let backward = apply(a, &apply(b, original)?)?;
+            overlaps.push(RuleOverlap {
+                path: path.to_path_buf(),
+                line: original[..start].matches('\n').count() + 1,
+                first: first.name(),
+                second: second.name(),
+                conflict: forward != backward,
+            });
+        }
+    }
+    Ok(overlaps)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformRule, TransformSpec};
+
+    fn rule(id: &str, spec: TransformSpec) -> TransformRule {
+        TransformRule::new(spec).with_id(id)
+    }
+
+    fn rename(id: &str, old: &str, new: &str) -> TransformRule {
+        rule(
+            id,
+            TransformSpec::RenameFunction {
+                old_name: old.to_string(),
+                new_name: new.to_string(),
+            },
+        )
+    }
+
+    #[test]
+    fn test_detects_conflicting_rules() {
+        let rules = [
+            rename("rename-get-user", "GetUser", "FetchUser"),
+            rule(
+                "add-context",
+                TransformSpec::ReplacePattern {
+                    pattern: r"GetUser\((\w+)\)".to_string(),
+                    replacement: "GetUser(ctx, $1)".to_string(),
+                },
+            ),
+            rename("rename-close", "Close", "Shutdown"),
+            rename("rename-fetch-all", "FetchAll", "ListAll"),
+        ];
+        let compiled: Vec<CompiledRule<'_>> = rules
+            .iter()
+            .map(|rule| (rule, rule.to_transform().unwrap()))
+            .collect();
+        let source =
+            "func main() {\n\tdefer c.Close()\n\tu, _ := GetUser(id)\n\tall := FetchAll()\n}\n";
+
+        let overlaps = detect(&compiled, None, Path::new("main.go"), source).unwrap();
+        assert_eq!(overlaps.len(), 1);
+        assert_eq!(
+            (
+                overlaps[0].first.as_str(),
+                overlaps[0].second.as_str(),
+                overlaps[0].line,
+                overlaps[0].conflict
+            ),
+            ("rename-get-user", "add-context", 3, true)
+        );
+        assert_eq!(
+            overlaps[0].to_string(),
+            "main.go:3: rules rename-get-user and add-context match the same code; the result depends on their order, and rename-get-user runs first"
+        );
+    }
+}
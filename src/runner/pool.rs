@@ -0,0 +1,59 @@
+//! A small scoped worker pool with deterministic result ordering.
+
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::thread;
+
+/// Apply `f` to every item on up to `jobs` threads, returning the results in
+/// the same order as `items` regardless of which worker produced them.
+pub(crate) fn map<T, R, F>(items: &[T], jobs: usize, f: F) -> Vec<R>
+where
+    T: Sync,
+    R: Send,
+    F: Fn(&T) -> R + Sync,
+{
+    let jobs = jobs.clamp(1, items.len().max(1));
+    if jobs == 1 {
+        return items.iter().map(f).collect();
+    }
+
+    let next = AtomicUsize::new(0);
+    let mut indexed: Vec<(usize, R)> = thread::scope(|scope| {
+        let workers: Vec<_> = (0..jobs)
+            .map(|_| {
+                scope.spawn(|| {
+                    let mut done = Vec::new();
+                    loop {
+                        let i = next.fetch_add(1, Ordering::Relaxed);
+                        let Some(item) = items.get(i) else { break };
+                        done.push((i, f(item)));
+                    }
+                    done
+                })
+            })
+            .collect();
+        workers
+            .into_iter()
+            .flat_map(|w| w.join().expect("worker thread panicked"))
+            .collect()
+    });
+
+    indexed.sort_by_key(|(i, _)| *i);
+    indexed.into_iter().map(|(_, r)| r).collect()
+}
+
+/// Number of workers to use when none is configured.
+pub(crate) fn default_jobs() -> usize {
+    thread::available_parallelism().map_or(1, |n| n.get())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_map_preserves_order() {
+        let items: Vec<usize> = (0..100).collect();
+        assert_eq!(map(&items, 8, |i| i * 2), map(&items, 1, |i| i * 2));
+        assert!(map(&[] as &[usize], 4, |i| *i).is_empty());
+    }
+}
@@ -0,0 +1,158 @@
+//! How often each rule matched.
+//!
+//! A rule that matched nothing is a strong sign that its pattern is wrong:
+//! a typo in a name, a qualifier the code never uses, or a file filter that
+//! excludes every file. [`MatchStats`] counts the matches of every rule of
+//! a run, listing the rules that matched zero times last.
+
+use serde::Serialize;
+use std::collections::{BTreeSet, HashMap};
+use std::fmt;
+use std::path::Path;
+
+use super::RunReport;
+use crate::analyzer::UpgradeConfig;
+
+/// The matches of one rule.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct RuleMatches {
+    /// Name of the rule.
+    pub rule: String,
+    /// Sites the rule matched: rewritten, reported, or both.
+    pub matches: usize,
+    /// Files with a match.
+    pub files: usize,
+}
+
+/// The matches of every rule of a run, by decreasing count.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct MatchStats {
+    /// Every rule of the configuration, those with the most matches first.
+    pub rules: Vec<RuleMatches>,
+}
+
+impl MatchStats {
+    /// Count the matches `report`, a run of `config`, found for each rule.
+    pub fn new(config: &UpgradeConfig, report: &RunReport) -> Self {
+        let mut sites: HashMap<&str, BTreeSet<(&Path, usize)>> = HashMap::new();
+        let found = report
+            .edits
+            .iter()
+            .map(|e| (e.rule.as_str(), e.path.as_path(), e.line))
+            .chain(
+                report
+                    .diagnostics
+                    .iter()
+                    .map(|d| (d.rule.as_str(), d.path.as_path(), d.line)),
+            );
+        for (rule, path, line) in found {
+            sites.entry(rule).or_default().insert((path, line));
+        }
+
+        let mut rules: Vec<RuleMatches> = config
+            .transforms
+            .iter()
+            .map(|rule| {
+                let name = rule.name();
+                let sites = sites.get(name.as_str());
+                RuleMatches {
+                    matches: sites.map_or(0, BTreeSet::len),
+                    files: sites.map_or(0, |sites| {
+                        sites
+                            .iter()
+                            .map(|(path, _)| path)
+                            .collect::<BTreeSet<_>>()
+                            .len()
+                    }),
+                    rule: name,
+                }
+            })
+            .collect();
+        // Stable: rules with as many matches keep their configured order
+        rules.sort_by(|a, b| b.matches.cmp(&a.matches));
+        Self { rules }
+    }
+
+    /// The rules that matched nothing.
+    pub fn unmatched(&self) -> impl Iterator<Item = &RuleMatches> {
+        self.rules.iter().filter(|rule| rule.matches == 0)
+    }
+}
+
+impl fmt::Display for MatchStats {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for rule in &self.rules {
+            match rule.matches {
+                0 => writeln!(f, "{}: no matches; check its pattern", rule.rule)?,
+                matches => writeln!(
+                    f,
+                    "{}: {} match(es) in {} file(s)",
+                    rule.rule, matches, rule.files
+                )?,
+            }
+        }
+        write!(
+            f,
+            "{} of {} rule(s) matched",
+            self.rules.len() - self.unmatched().count(),
+            self.rules.len()
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformRule, TransformSpec};
+    use crate::runner::{Diagnostic, RuleEdit};
+
+    #[test]
+    fn test_counts_matches_and_unmatched_rules() {
+        let mut config = UpgradeConfig::new("test", "");
+        for (id, old) in [("rename-close", "Close"), ("rename-get", "GetUser")] {
+            config.add_transform(
+                TransformRule::new(TransformSpec::RenameFunction {
+                    old_name: old.to_string(),
+                    new_name: format!("New{}", old),
+                })
+                .with_id(id),
+            );
+        }
+        let edit = |path: &str, line| RuleEdit {
+            rule: "rename-get".to_string(),
+            path: path.into(),
+            line,
+            todo: false,
+        };
+        let report = RunReport {
+            edits: vec![edit("a.go", 3), edit("a.go", 9), edit("b.go", 1)],
+            // A site both rewritten and reported counts once
+            diagnostics: vec![Diagnostic {
+                rule: "rename-get".to_string(),
+                message: String::new(),
+                path: "b.go".into(),
+                line: 1,
+                column: 1,
+                text: String::new(),
+                suggestion: String::new(),
+            }],
+            ..Default::default()
+        };
+
+        let stats = MatchStats::new(&config, &report);
+        assert_eq!(
+            stats.rules[0],
+            RuleMatches {
+                rule: "rename-get".to_string(),
+                matches: 3,
+                files: 2
+            }
+        );
+        let unmatched: Vec<&str> = stats.unmatched().map(|r| r.rule.as_str()).collect();
+        assert_eq!(unmatched, ["rename-close"]);
+        assert_eq!(
+            stats.to_string(),
+            "rename-get: 3 match(es) in 2 file(s)\nrename-close: no matches; check its pattern\n1 of 2 rule(s) matched"
+        );
+    }
+}
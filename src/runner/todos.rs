@@ -0,0 +1,289 @@
+//! Tracking of the markers rules leave for manual work.
+//!
+//! Transforms leave a [`TODO_MARKER`] comment where they cannot complete a
+//! rewrite. The runner tags each marker a rule adds with the rule's id and
+//! a unique tracking id in UUID form,
+//! `// TODO(refactor-dsl:remove-deprecated:1b4e28ba-2fa1-41d2-883f-0016d3cca427):
+//! DeprecatedFn was removed`, so every marker traces back to the rule that
+//! left it and can be followed in reviews and issue trackers. Markers that
+//! were already in the file, tagged or not, keep the form they had.
+//!
+//! [`scan_todos`] lists the markers, tagged or not, left in a tree.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::runner::scan_todos;
+//!
+//! for todo in scan_todos(".")? {
+//!     println!("{}", todo);
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use similar::{ChangeTag, TextDiff};
+use std::collections::hash_map::RandomState;
+use std::fmt;
+use std::fs;
+use std::hash::BuildHasher;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{SystemTime, UNIX_EPOCH};
+use walkdir::WalkDir;
+
+use super::TODO_MARKER;
+use crate::error::Result;
+
+/// Regex matching a marker, tagged or not.
+pub(crate) const MARKER_PATTERN: &str = r"TODO\(refactor(?:-dsl)?(?::[^)\s]*)?\)";
+
+/// Prefix of a tagged marker, before the rule and tracking ids.
+const TAGGED_PREFIX: &str = "TODO(refactor-dsl";
+
+static MARKER: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"TODO\(refactor(?:-dsl)?(?::(?P<rule>[^:)\s]+)(?::(?P<id>[^:)\s]+))?)?\)")
+        .expect("invalid marker regex")
+});
+
+static TRACKING: AtomicU64 = AtomicU64::new(0);
+
+/// A marker left for manual work.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct TodoMarker {
+    /// File containing the marker.
+    pub path: PathBuf,
+    /// 1-based line of the marker.
+    pub line: usize,
+    /// Id of the rule that left it, if it is tagged.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rule: Option<String>,
+    /// Its tracking id, if it is tagged.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub id: Option<String>,
+    /// What it says is left to do.
+    pub note: String,
+}
+
+impl fmt::Display for TodoMarker {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}:{}:", self.path.display(), self.line)?;
+        if let Some(rule) = &self.rule {
+            write!(f, " [{}", rule)?;
+            if let Some(id) = &self.id {
+                write!(f, " {}", id)?;
+            }
+            write!(f, "]")?;
+        }
+        write!(f, " {}", self.note)
+    }
+}
+
+/// Whether `text` contains a marker, tagged or not.
+pub(crate) fn has_marker(text: &str) -> bool {
+    MARKER.is_match(text)
+}
+
+/// The markers in `text`, the content of `path`.
+pub fn find_todos(path: &Path, text: &str) -> Vec<TodoMarker> {
+    let mut todos = Vec::new();
+    for (index, line) in text.lines().enumerate() {
+        for caps in MARKER.captures_iter(line) {
+            let marker = caps.get(0).unwrap();
+            let rest = &line[marker.end()..];
+            // A marker in a string literal ends with it
+            let in_string = line[..marker.start()].matches('"').count() % 2 == 1;
+            let end = match rest.find("*/") {
+                Some(end) => end,
+                None if in_string => rest.find('"').unwrap_or(rest.len()),
+                None => rest.len(),
+            };
+            let note = rest[..end].trim_start_matches(':').trim();
+            todos.push(TodoMarker {
+                path: path.to_path_buf(),
+                line: index + 1,
+                rule: caps.name("rule").map(|m| m.as_str().to_string()),
+                id: caps.name("id").map(|m| m.as_str().to_string()),
+                note: note.to_string(),
+            });
+        }
+    }
+    todos
+}
+
+/// The markers in the text files under `root`, by file and line. Hidden
+/// and vendored directories are skipped.
+pub fn scan_todos(root: impl AsRef<Path>) -> Result<Vec<TodoMarker>> {
+    let root = root.as_ref();
+    let walker = WalkDir::new(root).into_iter().filter_entry(|entry| {
+        let name = entry.file_name().to_str().unwrap_or_default();
+        entry.depth() == 0
+            || !(name.starts_with('.') || matches!(name, "vendor" | "node_modules" | "target"))
+    });
+    let mut todos = Vec::new();
+    for entry in walker.filter_map(|e| e.ok()) {
+        if !entry.file_type().is_file() {
+            continue;
+        }
+        // Binary files are not code
+        let Ok(text) = fs::read_to_string(entry.path()) else {
+            continue;
+        };
+        let rel = entry.path().strip_prefix(root).unwrap_or(entry.path());
+        todos.extend(find_todos(rel, &text));
+    }
+    todos.sort_by(|a, b| (&a.path, a.line).cmp(&(&b.path, b.line)));
+    Ok(todos)
+}
+
+/// `after`, the result of `rule` rewriting `before` in the file at `path`,
+/// with the markers the rule added tagged with its id and a tracking id.
+///
+/// Lines the rule changed keep as many of their untagged markers as they
+/// had before, so a marker already in the file is not attributed to the
+/// rule because it rewrote the line.
+pub(crate) fn tag(before: &str, after: &str, rule: &str, path: &Path) -> String {
+    if !after.contains(TODO_MARKER) {
+        return after.to_string();
+    }
+    let rule: String = rule
+        .chars()
+        .map(|c| {
+            if c == ':' || c == '(' || c == ')' || c.is_whitespace() {
+                '-'
+            } else {
+                c
+            }
+        })
+        .collect();
+    let mut tagged = String::with_capacity(after.len());
+    // The lines the rule inserted in a run of changed lines, and the
+    // untagged markers on the lines it removed or rewrote there
+    let mut inserted: Vec<&str> = Vec::new();
+    let mut replaced = 0;
+    let flush = |inserted: &mut Vec<&str>, replaced: &mut usize, tagged: &mut String| {
+        for line in inserted.drain(..) {
+            let markers = line.matches(TODO_MARKER).count();
+            if markers <= *replaced {
+                *replaced -= markers;
+                tagged.push_str(line);
+                continue;
+            }
+            *replaced = 0;
+            let mut rest = line;
+            while let Some(start) = rest.find(TODO_MARKER) {
+                tagged.push_str(&rest[..start]);
+                tagged.push_str(&format!(
+                    "{}:{}:{})",
+                    TAGGED_PREFIX,
+                    rule,
+                    tracking_id(path, &rule, line)
+                ));
+                rest = &rest[start + TODO_MARKER.len()..];
+            }
+            tagged.push_str(rest);
+        }
+        *replaced = 0;
+    };
+    let diff = TextDiff::from_lines(before, after);
+    for change in diff.iter_all_changes() {
+        match change.tag() {
+            ChangeTag::Equal => {
+                flush(&mut inserted, &mut replaced, &mut tagged);
+                tagged.push_str(change.value());
+            }
+            ChangeTag::Delete => replaced += change.value().matches(TODO_MARKER).count(),
+            ChangeTag::Insert => inserted.push(change.value()),
+        }
+    }
+    flush(&mut inserted, &mut replaced, &mut tagged);
+    tagged
+}
+
+/// A new tracking id for a marker `rule` left on `line` of `path`, a
+/// random (version 4) UUID.
+fn tracking_id(path: &Path, rule: &str, line: &str) -> String {
+    let state = RandomState::new();
+    let nanos = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|elapsed| elapsed.as_nanos())
+        .unwrap_or_default();
+    let count = TRACKING.fetch_add(1, Ordering::Relaxed);
+    let hash =
+        |half: u8| state.hash_one((path, rule, line, nanos, count, std::process::id(), half));
+    let high = (hash(0) & !0xf000) | 0x4000;
+    let low = (hash(1) & 0x3fff_ffff_ffff_ffff) | 0x8000_0000_0000_0000;
+    format!(
+        "{:08x}-{:04x}-{:04x}-{:04x}-{:012x}",
+        high >> 32,
+        (high >> 16) & 0xffff,
+        high & 0xffff,
+        low >> 48,
+        low & 0xffff_ffff_ffff
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_tag_and_scan_markers() {
+        let path = Path::new("main.go");
+        let before = "// TODO(refactor): check flags\nx := DeprecatedFn()\n";
+        let after = "// TODO(refactor): check flags\n// TODO(refactor): DeprecatedFn was removed\nx := DeprecatedFn()\n";
+        let tagged = tag(before, after, "remove deprecated", path);
+        assert!(tagged.starts_with(
+            "// TODO(refactor): check flags\n// TODO(refactor-dsl:remove-deprecated:"
+        ));
+        // Every run gives new ids
+        assert_ne!(tagged, tag(before, after, "remove deprecated", path));
+        assert_eq!(tag(&tagged, &tagged, "other", path), tagged);
+        // A marker on a line the rule rewrote is not the rule's
+        let renamed = before.replace("DeprecatedFn", "NewFn");
+        let flagged = "// TODO(refactor): check flags; x := DeprecatedFn()\n";
+        assert_eq!(
+            tag(
+                flagged,
+                &flagged.replace("DeprecatedFn", "NewFn"),
+                "rename",
+                path
+            ),
+            flagged.replace("DeprecatedFn", "NewFn")
+        );
+        assert_eq!(tag(before, &renamed, "rename", path), renamed);
+
+        let todos = find_todos(path, &tagged);
+        assert_eq!(todos.len(), 2);
+        assert_eq!(todos[0].rule, None);
+        assert_eq!(todos[0].note, "check flags");
+        assert_eq!(todos[1].line, 2);
+        assert_eq!(todos[1].rule.as_deref(), Some("remove-deprecated"));
+        assert_eq!(todos[1].id.as_ref().map(String::len), Some(36));
+        assert_eq!(todos[1].note, "DeprecatedFn was removed");
+        assert!(has_marker(&tagged[31..]));
+
+        let dir = TempDir::new().unwrap();
+        fs::create_dir(dir.path().join("vendor")).unwrap();
+        fs::write(dir.path().join("main.go"), &tagged).unwrap();
+        fs::write(
+            dir.path().join("vendor/dep.go"),
+            "// TODO(refactor): not ours\n",
+        )
+        .unwrap();
+        fs::write(
+            dir.path().join("user.go"),
+            "u := User{Active: true /* TODO(refactor-dsl:add-email:0badc0de): set Email */}\n",
+        )
+        .unwrap();
+        let todos = scan_todos(dir.path()).unwrap();
+        assert_eq!(todos.len(), 3);
+        assert_eq!(
+            todos[2].to_string(),
+            "user.go:1: [add-email 0badc0de] set Email"
+        );
+    }
+}
@@ -0,0 +1,338 @@
+//! Functions defined once per build-tag variant.
+//!
+//! A Go package often defines the same function in several files, each
+//! built under different build constraints (`conn_linux.go` and
+//! `conn_windows.go`, or files with a `//go:build` line). A rewrite of the
+//! function has to reach every variant, or builds for the other platforms
+//! break. The runner runs the variants of every file it selects, and
+//! [`partial_changes`] reports definitions a run changed in some variants
+//! only, such as when a rule's pattern matches one variant's parameter
+//! names but not another's.
+
+use regex::Regex;
+use serde::Serialize;
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use crate::transform::FileChange;
+
+static FUNC: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?m)^func\s*(?:\(\s*(?:\w+\s+)?\*?\s*(\w+)[^)]*\)\s*)?(\w+)")
+        .expect("invalid func regex")
+});
+
+const GOOS: &[&str] = &[
+    "aix",
+    "android",
+    "darwin",
+    "dragonfly",
+    "freebsd",
+    "illumos",
+    "ios",
+    "js",
+    "linux",
+    "netbsd",
+    "openbsd",
+    "plan9",
+    "solaris",
+    "wasip1",
+    "windows",
+    "zos",
+];
+
+const GOARCH: &[&str] = &[
+    "386", "amd64", "arm", "arm64", "loong64", "mips", "mips64", "mips64le", "mipsle", "ppc64",
+    "ppc64le", "riscv64", "s390x", "wasm",
+];
+
+/// A function defined in several build-tag variants whose definition a run
+/// changed in some of them only.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct PartialVariantChange {
+    /// The function, qualified by its receiver type (`Client.Dial`).
+    pub function: String,
+    /// Variants whose definition was changed.
+    pub changed: Vec<PathBuf>,
+    /// Variants whose definition was left alone.
+    pub unchanged: Vec<PathBuf>,
+}
+
+impl fmt::Display for PartialVariantChange {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let list = |paths: &[PathBuf]| {
+            paths
+                .iter()
+                .map(|path| path.display().to_string())
+                .collect::<Vec<_>>()
+                .join(", ")
+        };
+        write!(
+            f,
+            "{} changed in {} but not in {}; builds with the other build tags will break",
+            self.function,
+            list(&self.changed),
+            list(&self.unchanged)
+        )
+    }
+}
+
+/// Returns true if the Go file at `path` is only built under some build
+/// constraints: a `//go:build` line before its package clause, or a GOOS
+/// or GOARCH suffix on its name.
+pub(super) fn is_build_variant(path: &Path, source: &str) -> bool {
+    let stem = path
+        .file_stem()
+        .and_then(|stem| stem.to_str())
+        .unwrap_or_default();
+    let stem = stem.strip_suffix("_test").unwrap_or(stem);
+    let mut parts = stem.split('_').skip(1).collect::<Vec<_>>();
+    if let Some(last) = parts.pop()
+        && (GOOS.contains(&last) || GOARCH.contains(&last))
+    {
+        return true;
+    }
+    source
+        .lines()
+        .take_while(|line| !line.starts_with("package "))
+        .any(|line| line.starts_with("//go:build ") || line.starts_with("// +build "))
+}
+
+/// The top-level functions defined in `source`, keyed by name qualified by
+/// receiver type, with their signatures (whitespace normalized).
+fn definitions(source: &str) -> BTreeMap<String, String> {
+    FUNC.captures_iter(source)
+        .map(|caps| {
+            let name = match caps.get(1) {
+                Some(receiver) => format!("{}.{}", receiver.as_str(), &caps[2]),
+                None => caps[2].to_string(),
+            };
+            let start = caps.get(0).map_or(0, |m| m.start());
+            (name, signature(&source[start..]))
+        })
+        .collect()
+}
+
+/// The signature at the start of `text`: everything up to the body's
+/// opening brace, or the end of the line for a function without a body.
+fn signature(text: &str) -> String {
+    let mut parens = 0usize;
+    let mut braces = 0usize;
+    let mut end = text.len();
+    for (i, c) in text.char_indices() {
+        match c {
+            '(' | '[' => parens += 1,
+            ')' | ']' => parens = parens.saturating_sub(1),
+            '{' if parens == 0 => {
+                let before = text[..i].trim_end();
+                if before.ends_with("interface") || before.ends_with("struct") {
+                    braces += 1;
+                } else if braces == 0 {
+                    end = i;
+                    break;
+                }
+            }
+            '}' if parens == 0 => braces = braces.saturating_sub(1),
+            '\n' if parens == 0 && braces == 0 => {
+                end = i;
+                break;
+            }
+            _ => {}
+        }
+    }
+    text[..end].split_whitespace().collect::<Vec<_>>().join(" ")
+}
+
+/// The functions of the Go file at `path` if it is a build-tag variant.
+fn variant_definitions(path: &Path, source: &str) -> Option<BTreeMap<String, String>> {
+    (path.extension().is_some_and(|ext| ext == "go") && is_build_variant(path, source))
+        .then(|| definitions(source))
+}
+
+/// Files among `candidates` that are build-tag variants of a file in
+/// `selected`: in the same directory and defining one of its functions.
+pub(super) fn siblings(selected: &[PathBuf], candidates: &[PathBuf]) -> Vec<PathBuf> {
+    let chosen: HashSet<&Path> = selected.iter().map(PathBuf::as_path).collect();
+    let mut by_dir: HashMap<&Path, Vec<&Path>> = HashMap::new();
+    for path in candidates
+        .iter()
+        .filter(|path| !chosen.contains(path.as_path()))
+    {
+        if let Some(dir) = path.parent() {
+            by_dir.entry(dir).or_default().push(path);
+        }
+    }
+    let mut read: HashMap<PathBuf, Option<BTreeMap<String, String>>> = HashMap::new();
+    let mut functions = |path: &Path| -> Option<BTreeSet<String>> {
+        read.entry(path.to_path_buf())
+            .or_insert_with(|| {
+                let source = fs::read_to_string(path).ok()?;
+                variant_definitions(path, &source)
+            })
+            .as_ref()
+            .map(|defs| defs.keys().cloned().collect())
+    };
+
+    let mut found = BTreeSet::new();
+    for path in selected {
+        let Some(dir) = path.parent().filter(|dir| by_dir.contains_key(dir)) else {
+            continue;
+        };
+        let Some(defined) = functions(path) else {
+            continue;
+        };
+        for candidate in &by_dir[dir] {
+            if functions(candidate).is_some_and(|other| !defined.is_disjoint(&other)) {
+                found.insert(candidate.to_path_buf());
+            }
+        }
+    }
+    found.into_iter().collect()
+}
+
+/// Functions whose definition `changes` rewrote in some build-tag variants
+/// but not in others. Variants without a change are read from disk.
+pub(super) fn partial_changes(changes: &[FileChange]) -> Vec<PartialVariantChange> {
+    let by_path: HashMap<&Path, &FileChange> = changes
+        .iter()
+        .map(|change| (change.path.as_path(), change))
+        .collect();
+    let mut seen = BTreeSet::new();
+    let mut partial = Vec::new();
+    for change in changes {
+        let Some(before) = variant_definitions(&change.path, &change.original) else {
+            continue;
+        };
+        let after = definitions(&change.transformed);
+        let Some(dir) = change.path.parent() else {
+            continue;
+        };
+        for (function, signature) in &before {
+            if after.get(function) == Some(signature)
+                || !seen.insert((dir.to_path_buf(), function.clone()))
+            {
+                continue;
+            }
+            let mut variant = PartialVariantChange {
+                function: function.clone(),
+                changed: Vec::new(),
+                unchanged: Vec::new(),
+            };
+            for path in go_files(dir, &by_path) {
+                match by_path.get(path.as_path()) {
+                    Some(other) => {
+                        let Some(defs) = variant_definitions(&path, &other.original) else {
+                            continue;
+                        };
+                        let Some(old) = defs.get(function) else {
+                            continue;
+                        };
+                        if definitions(&other.transformed).get(function) == Some(old) {
+                            variant.unchanged.push(path);
+                        } else {
+                            variant.changed.push(path);
+                        }
+                    }
+                    None => {
+                        let defines = fs::read_to_string(&path).ok().is_some_and(|source| {
+                            variant_definitions(&path, &source)
+                                .is_some_and(|defs| defs.contains_key(function))
+                        });
+                        if defines {
+                            variant.unchanged.push(path);
+                        }
+                    }
+                }
+            }
+            if !variant.unchanged.is_empty() {
+                partial.push(variant);
+            }
+        }
+    }
+    partial
+}
+
+/// The Go files in `dir`, on disk or among `changes`, sorted.
+pub(super) fn go_files(dir: &Path, changes: &HashMap<&Path, &FileChange>) -> Vec<PathBuf> {
+    let mut files: BTreeSet<PathBuf> = fs::read_dir(dir)
+        .into_iter()
+        .flatten()
+        .filter_map(|entry| entry.ok().map(|entry| entry.path()))
+        .filter(|path| path.extension().is_some_and(|ext| ext == "go"))
+        .collect();
+    files.extend(
+        changes
+            .keys()
+            .filter(|path| path.parent() == Some(dir))
+            .map(|path| path.to_path_buf()),
+    );
+    files.into_iter().collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_build_variants_and_definitions() {
+        assert!(is_build_variant(Path::new("conn_linux.go"), ""));
+        assert!(is_build_variant(
+            Path::new("conn_windows_amd64_test.go"),
+            ""
+        ));
+        assert!(!is_build_variant(Path::new("linux.go"), ""));
+        assert!(is_build_variant(
+            Path::new("conn_unix.go"),
+            "//go:build linux || darwin\n\npackage pool\n"
+        ));
+        assert!(!is_build_variant(
+            Path::new("conn.go"),
+            "package pool\n\n//go:build ignore\n"
+        ));
+
+        let defs = definitions(
+            "package pool\n\nfunc Dial(addr string,\n\ttimeout int) (*Conn, error) {\n}\n\n\
+             func (c *Client) Close() {}\n\nfunc Opts() interface{ Apply() } {\n}\n\nfunc asm(x int)\n",
+        );
+        assert_eq!(
+            defs["Dial"],
+            "func Dial(addr string, timeout int) (*Conn, error)"
+        );
+        assert_eq!(defs["Client.Close"], "func (c *Client) Close()");
+        assert_eq!(defs["Opts"], "func Opts() interface{ Apply() }");
+        assert_eq!(defs["asm"], "func asm(x int)");
+    }
+
+    #[test]
+    fn test_partial_changes() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let linux = dir.path().join("conn_linux.go");
+        let windows = dir.path().join("conn_windows.go");
+        fs::write(&windows, "package pool\n\nfunc Dial(address string) {}\n").unwrap();
+        let change = FileChange {
+            path: linux.clone(),
+            original: "package pool\n\nfunc Dial(addr string) {}\n".into(),
+            transformed: "package pool\n\nfunc Dial(ctx Context, addr string) {}\n".into(),
+        };
+
+        let partial = partial_changes(std::slice::from_ref(&change));
+        assert_eq!(
+            partial,
+            vec![PartialVariantChange {
+                function: "Dial".into(),
+                changed: vec![linux],
+                unchanged: vec![windows.clone()],
+            }]
+        );
+        assert!(partial[0].to_string().starts_with("Dial changed in"));
+
+        let both = FileChange {
+            path: windows,
+            original: "package pool\n\nfunc Dial(address string) {}\n".into(),
+            transformed: "package pool\n\nfunc Dial(ctx Context, address string) {}\n".into(),
+        };
+        assert!(partial_changes(&[change, both]).is_empty());
+    }
+}
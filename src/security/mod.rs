@@ -0,0 +1,435 @@
+//! Security-advisory driven upgrades.
+//!
+//! An upgrade pack that declares the dependency it migrates (`module`) and
+//! the version it migrates to (`to_version`) resolves every known advisory
+//! for that dependency fixed at or below that version. [`SecurityPlan`]
+//! matches a project's [`Advisory`]s, from `govulncheck -json` or
+//! `osv-scanner --format json` output, against candidate packs, and selects
+//! the packs that resolve at least one, those resolving the most first.
+//! Packs they `require` come along. The plan reports which advisories the
+//! migration resolves and which are left.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::runner::UpgradeRunner;
+//! use refactor::security::{self, SecurityPlan};
+//!
+//! let packs = vec![
+//!     UpgradeConfig::from_file("packs/net-v0.23.yaml")?,
+//!     UpgradeConfig::from_file("packs/jwt-v5.yaml")?,
+//! ];
+//! let advisories = security::scan("./service")?;
+//! let plan = SecurityPlan::new(packs, &advisories)?;
+//! println!("{}", plan);
+//! if let Some(config) = plan.upgrade_config() {
+//!     UpgradeRunner::new(config).run("./service")?;
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::Serialize;
+use serde_json::Value;
+use std::cmp::Ordering;
+use std::collections::BTreeMap;
+use std::fmt;
+use std::fs;
+use std::path::Path;
+use std::process::Command;
+
+use crate::analyzer::UpgradeConfig;
+use crate::error::{RefactorError, Result};
+use crate::pack::application_order;
+
+/// A known vulnerability affecting a dependency of the project.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Advisory {
+    /// Advisory id (`GO-2024-2687`, `GHSA-...`).
+    pub id: String,
+    /// Other ids of the advisory, such as CVEs.
+    pub aliases: Vec<String>,
+    /// One-line description.
+    pub summary: String,
+    /// The affected dependency.
+    pub module: String,
+    /// The version the project uses, if reported.
+    pub version: Option<String>,
+    /// The first version with a fix, if there is one.
+    pub fixed: Option<String>,
+}
+
+impl Advisory {
+    /// Returns true if `pack` migrates the affected dependency to a version
+    /// with the fix.
+    pub fn resolved_by(&self, pack: &UpgradeConfig) -> bool {
+        pack.module.as_deref() == Some(self.module.as_str())
+            && match (&pack.to_version, &self.fixed) {
+                (Some(to), Some(fixed)) => compare_versions(to, fixed) != Ordering::Less,
+                _ => false,
+            }
+    }
+}
+
+impl fmt::Display for Advisory {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.id)?;
+        if !self.aliases.is_empty() {
+            write!(f, " ({})", self.aliases.join(", "))?;
+        }
+        write!(f, ": {}", self.module)?;
+        if let Some(version) = &self.version {
+            write!(f, "@{}", version)?;
+        }
+        match &self.fixed {
+            Some(fixed) => write!(f, ", fixed in {}", fixed)?,
+            None => write!(f, ", no fix")?,
+        }
+        if !self.summary.is_empty() {
+            write!(f, " - {}", self.summary)?;
+        }
+        Ok(())
+    }
+}
+
+/// Run `govulncheck -json ./...` in `root` and collect the advisories it
+/// reports.
+pub fn scan(root: impl AsRef<Path>) -> Result<Vec<Advisory>> {
+    let output = Command::new("govulncheck")
+        .args(["-json", "./..."])
+        .current_dir(root.as_ref())
+        .output()
+        .map_err(|e| RefactorError::VulnScan {
+            message: format!("could not run govulncheck: {}", e),
+        })?;
+    if !output.status.success() {
+        return Err(RefactorError::VulnScan {
+            message: String::from_utf8_lossy(&output.stderr).trim().to_string(),
+        });
+    }
+    parse_govulncheck(&String::from_utf8_lossy(&output.stdout))
+}
+
+/// Load advisories from a file of `govulncheck -json` or
+/// `osv-scanner --format json` output.
+pub fn load(path: impl AsRef<Path>) -> Result<Vec<Advisory>> {
+    let content = fs::read_to_string(path)?;
+    match serde_json::from_str::<Value>(&content) {
+        Ok(value) if value.get("results").is_some() => parse_osv_scanner(&value),
+        _ => parse_govulncheck(&content),
+    }
+}
+
+/// Parse the stream of JSON messages `govulncheck -json` prints. Each
+/// affected module is reported once per advisory.
+pub fn parse_govulncheck(output: &str) -> Result<Vec<Advisory>> {
+    let mut entries: BTreeMap<String, &Value> = BTreeMap::new();
+    let messages = serde_json::Deserializer::from_str(output)
+        .into_iter::<Value>()
+        .collect::<std::result::Result<Vec<_>, _>>()?;
+    for osv in messages.iter().filter_map(|m| m.get("osv")) {
+        if let Some(id) = osv["id"].as_str() {
+            entries.insert(id.to_string(), osv);
+        }
+    }
+
+    let mut advisories: Vec<Advisory> = Vec::new();
+    for finding in messages.iter().filter_map(|m| m.get("finding")) {
+        let (Some(id), Some(frame)) = (finding["osv"].as_str(), finding["trace"].get(0)) else {
+            continue;
+        };
+        let Some(module) = frame["module"].as_str() else {
+            continue;
+        };
+        if advisories.iter().any(|a| a.id == id && a.module == module) {
+            continue;
+        }
+        let entry = entries.get(id);
+        advisories.push(Advisory {
+            id: id.to_string(),
+            aliases: entry.map(|e| strings(&e["aliases"])).unwrap_or_default(),
+            summary: entry
+                .and_then(|e| e["summary"].as_str())
+                .unwrap_or_default()
+                .to_string(),
+            module: module.to_string(),
+            version: frame["version"].as_str().map(str::to_string),
+            fixed: finding["fixed_version"].as_str().map(str::to_string),
+        });
+    }
+    Ok(advisories)
+}
+
+/// Parse the JSON report of `osv-scanner --format json`.
+fn parse_osv_scanner(report: &Value) -> Result<Vec<Advisory>> {
+    let mut advisories = Vec::new();
+    let results = report["results"].as_array().into_iter().flatten();
+    for package in results.flat_map(|r| r["packages"].as_array().into_iter().flatten()) {
+        let Some(module) = package["package"]["name"].as_str() else {
+            continue;
+        };
+        let version = package["package"]["version"].as_str();
+        for vuln in package["vulnerabilities"].as_array().into_iter().flatten() {
+            let Some(id) = vuln["id"].as_str() else {
+                continue;
+            };
+            advisories.push(Advisory {
+                id: id.to_string(),
+                aliases: strings(&vuln["aliases"]),
+                summary: vuln["summary"].as_str().unwrap_or_default().to_string(),
+                module: module.to_string(),
+                version: version.map(str::to_string),
+                fixed: first_fix(vuln, module, version),
+            });
+        }
+    }
+    Ok(advisories)
+}
+
+/// The lowest `fixed` event of the OSV ranges affecting `module` that is
+/// newer than the installed `version`.
+fn first_fix(vuln: &Value, module: &str, version: Option<&str>) -> Option<String> {
+    vuln["affected"]
+        .as_array()
+        .into_iter()
+        .flatten()
+        .filter(|affected| affected["package"]["name"].as_str() == Some(module))
+        .flat_map(|affected| affected["ranges"].as_array().into_iter().flatten())
+        .flat_map(|range| range["events"].as_array().into_iter().flatten())
+        .filter_map(|event| event["fixed"].as_str())
+        .filter(|fixed| version.is_none_or(|v| compare_versions(fixed, v) == Ordering::Greater))
+        .min_by(|a, b| compare_versions(a, b))
+        .map(str::to_string)
+}
+
+fn strings(value: &Value) -> Vec<String> {
+    value
+        .as_array()
+        .into_iter()
+        .flatten()
+        .filter_map(|v| v.as_str().map(str::to_string))
+        .collect()
+}
+
+/// Compare the release parts of two versions (`v1.4.0`, `1.4`), ignoring
+/// pre-release and build suffixes.
+pub(crate) fn compare_versions(a: &str, b: &str) -> Ordering {
+    let parts = |version: &str| -> Vec<u64> {
+        let version = version.trim().trim_start_matches('v');
+        let release = version.split(['-', '+']).next().unwrap_or(version);
+        release
+            .split('.')
+            .map(|part| part.parse().unwrap_or(0))
+            .collect()
+    };
+    let (a, b) = (parts(a), parts(b));
+    (0..a.len().max(b.len()))
+        .map(|i| {
+            a.get(i)
+                .copied()
+                .unwrap_or(0)
+                .cmp(&b.get(i).copied().unwrap_or(0))
+        })
+        .find(|ordering| ordering.is_ne())
+        .unwrap_or(Ordering::Equal)
+}
+
+/// A pack selected by a [`SecurityPlan`].
+#[derive(Debug, Clone)]
+pub struct ResolvingPack {
+    /// The pack.
+    pub pack: UpgradeConfig,
+    /// Advisories the pack resolves; empty for packs only required by
+    /// another selected pack.
+    pub resolves: Vec<Advisory>,
+}
+
+/// The packs to apply to resolve a project's advisories.
+#[derive(Debug, Clone, Default)]
+pub struct SecurityPlan {
+    /// Selected packs in application order.
+    pub packs: Vec<ResolvingPack>,
+    /// Advisories no candidate pack resolves.
+    pub unresolved: Vec<Advisory>,
+}
+
+impl SecurityPlan {
+    /// Select the `candidates` that resolve some of `advisories`, and the
+    /// candidates they require. Packs resolving more advisories come first
+    /// unless a requirement says otherwise.
+    pub fn new(candidates: Vec<UpgradeConfig>, advisories: &[Advisory]) -> Result<Self> {
+        let resolves = |pack: &UpgradeConfig| -> Vec<Advisory> {
+            advisories
+                .iter()
+                .filter(|a| a.resolved_by(pack))
+                .cloned()
+                .collect()
+        };
+
+        let mut selected: Vec<UpgradeConfig> = Vec::new();
+        let mut rest: Vec<UpgradeConfig> = Vec::new();
+        for pack in candidates {
+            if resolves(&pack).is_empty() {
+                rest.push(pack);
+            } else {
+                selected.push(pack);
+            }
+        }
+        selected.sort_by_key(|pack| std::cmp::Reverse(resolves(pack).len()));
+
+        // Pull in required packs, transitively
+        let mut index = 0;
+        while index < selected.len() {
+            for required in selected[index].requires.clone() {
+                if let Some(at) = rest.iter().position(|p| p.name == required) {
+                    selected.push(rest.remove(at));
+                }
+            }
+            index += 1;
+        }
+
+        let packs: Vec<ResolvingPack> = application_order(selected)?
+            .into_iter()
+            .map(|pack| ResolvingPack {
+                resolves: resolves(&pack),
+                pack,
+            })
+            .collect();
+        let unresolved = advisories
+            .iter()
+            .filter(|a| !packs.iter().any(|p| a.resolved_by(&p.pack)))
+            .cloned()
+            .collect();
+        Ok(Self { packs, unresolved })
+    }
+
+    /// Returns true if no pack resolves an advisory.
+    pub fn is_empty(&self) -> bool {
+        self.packs.is_empty()
+    }
+
+    /// Advisories the selected packs resolve.
+    pub fn resolved(&self) -> impl Iterator<Item = &Advisory> {
+        self.packs.iter().flat_map(|p| &p.resolves)
+    }
+
+    /// The selected packs as one upgrade, or `None` if there are none.
+    pub fn upgrade_config(&self) -> Option<UpgradeConfig> {
+        let mut packs = self.packs.iter().map(|p| p.pack.clone());
+        let mut config = packs.next()?;
+        for pack in packs {
+            config.merge(pack);
+        }
+        Some(config)
+    }
+}
+
+impl fmt::Display for SecurityPlan {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for (index, selected) in self.packs.iter().enumerate() {
+            write!(f, "{}. {}", index + 1, selected.pack.name)?;
+            if selected.resolves.is_empty() {
+                writeln!(f, " (required)")?;
+            }
+            for advisory in &selected.resolves {
+                write!(f, "\n   resolves {}", advisory)?;
+            }
+            if !selected.resolves.is_empty() {
+                writeln!(f)?;
+            }
+        }
+        for advisory in &self.unresolved {
+            writeln!(f, "unresolved: {}", advisory)?;
+        }
+        write!(
+            f,
+            "{} advisory(ies) resolved by {} pack(s), {} unresolved",
+            self.resolved().count(),
+            self.packs.len(),
+            self.unresolved.len()
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const GOVULNCHECK: &str = r#"{"config": {"scanner_name": "govulncheck"}}
+{"osv": {"id": "GO-2024-2687", "aliases": ["CVE-2023-45288"], "summary": "HTTP/2 CONTINUATION flood in net/http"}}
+{"osv": {"id": "GO-2024-2611", "aliases": [], "summary": "Infinite loop in JSON unmarshaling"}}
+{
+  "finding": {
+    "osv": "GO-2024-2687",
+    "fixed_version": "v0.23.0",
+    "trace": [{"module": "golang.org/x/net", "version": "v0.17.0"}]
+  }
+}
+{"finding": {"osv": "GO-2024-2687", "fixed_version": "v0.23.0", "trace": [{"module": "golang.org/x/net", "version": "v0.17.0", "package": "golang.org/x/net/http2"}]}}
+{"finding": {"osv": "GO-2024-2611", "fixed_version": "v1.33.0", "trace": [{"module": "google.golang.org/protobuf", "version": "v1.31.0"}]}}
+"#;
+
+    fn pack(name: &str, module: &str, to: &str) -> UpgradeConfig {
+        let mut config = UpgradeConfig::new(name, name).with_module(module);
+        config.to_version = Some(to.to_string());
+        config
+    }
+
+    #[test]
+    fn test_parse_govulncheck() {
+        let advisories = parse_govulncheck(GOVULNCHECK).unwrap();
+        assert_eq!(advisories.len(), 2);
+        assert_eq!(
+            advisories[0].to_string(),
+            "GO-2024-2687 (CVE-2023-45288): golang.org/x/net@v0.17.0, fixed in v0.23.0 - HTTP/2 CONTINUATION flood in net/http"
+        );
+    }
+
+    #[test]
+    fn test_parse_osv_scanner() {
+        let report = serde_json::json!({"results": [{"packages": [{
+            "package": {"name": "github.com/golang-jwt/jwt/v4", "version": "4.5.0", "ecosystem": "Go"},
+            "vulnerabilities": [{
+                "id": "GHSA-mh63-6h87-95cp",
+                "aliases": ["CVE-2025-30204"],
+                "summary": "Excessive memory allocation during header parsing",
+                "affected": [{
+                    "package": {"name": "github.com/golang-jwt/jwt/v4", "ecosystem": "Go"},
+                    "ranges": [{"type": "SEMVER", "events": [
+                        {"introduced": "0"}, {"fixed": "4.5.2"},
+                        {"introduced": "5.0.0"}, {"fixed": "5.2.2"}
+                    ]}]
+                }]
+            }]
+        }]}]});
+        let advisories = parse_osv_scanner(&report).unwrap();
+        assert_eq!(advisories[0].fixed.as_deref(), Some("4.5.2"));
+        assert_eq!(advisories[0].version.as_deref(), Some("4.5.0"));
+    }
+
+    #[test]
+    fn test_plan_selects_resolving_packs() {
+        let advisories = parse_govulncheck(GOVULNCHECK).unwrap();
+        let plan = SecurityPlan::new(
+            vec![
+                pack("logging-v3", "github.com/acme/logging", "v3.0.0"),
+                pack("protobuf-v1.32", "google.golang.org/protobuf", "v1.32.0"),
+                pack("net-v0.24", "golang.org/x/net", "v0.24.0").requires("crypto-v0.21"),
+                pack("crypto-v0.21", "golang.org/x/crypto", "v0.21.0"),
+            ],
+            &advisories,
+        )
+        .unwrap();
+
+        let names: Vec<&str> = plan.packs.iter().map(|p| p.pack.name.as_str()).collect();
+        assert_eq!(names, ["crypto-v0.21", "net-v0.24"]);
+        assert_eq!(plan.resolved().count(), 1);
+        assert_eq!(plan.unresolved[0].id, "GO-2024-2611");
+        assert_eq!(
+            plan.upgrade_config().unwrap().name,
+            "crypto-v0.21+net-v0.24"
+        );
+        assert!(compare_versions("v1.10.0", "v1.9.3").is_gt());
+        assert!(compare_versions("v0.0.0-20240101", "0.0.0").is_eq());
+    }
+}
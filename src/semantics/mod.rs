@@ -0,0 +1,271 @@
+//! Versioned rewrite semantics of the engine.
+//!
+//! The same rules can rewrite code differently from one engine release to
+//! the next, for example when the engine starts fixing the imports of
+//! rewritten files. Each such change bumps the engine's
+//! [`SemanticsVersion`] and is recorded in [`CHANGELOG`], so what a release
+//! does to a pack can be looked up rather than discovered in a diff.
+//!
+//! A pack pins the semantics it was written and tested against with
+//! `engine: "0.3"`. The runner then follows that version wherever the change
+//! can be switched off ([`SemanticsChange::reproducible`]); the other changes
+//! since are reported by [`unreproducible_since`]. Plans, replay bundles and
+//! reports record the version they were made with, so old results can be
+//! reproduced.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::semantics::{self, SemanticsVersion};
+//!
+//! let pinned = SemanticsVersion::parse("0.1").unwrap();
+//! for change in semantics::changes_since(pinned) {
+//!     println!("{}", change);
+//! }
+//! assert!(pinned < semantics::CURRENT);
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::str::FromStr;
+
+/// A version of the engine's rewrite semantics (`0.3`). The minor version
+/// goes up with every change to how rules rewrite code.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize)]
+#[serde(try_from = "String", into = "String")]
+pub struct SemanticsVersion {
+    pub major: u32,
+    pub minor: u32,
+}
+
+impl SemanticsVersion {
+    /// Create a version.
+    pub const fn new(major: u32, minor: u32) -> Self {
+        Self { major, minor }
+    }
+
+    /// Parse a version such as `0.3` or `v0.3`.
+    pub fn parse(version: &str) -> Option<Self> {
+        let version = version.trim();
+        let version = version.strip_prefix('v').unwrap_or(version);
+        let (major, minor) = version.split_once('.')?;
+        Some(Self::new(major.parse().ok()?, minor.parse().ok()?))
+    }
+}
+
+impl Default for SemanticsVersion {
+    fn default() -> Self {
+        CURRENT
+    }
+}
+
+impl fmt::Display for SemanticsVersion {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}.{}", self.major, self.minor)
+    }
+}
+
+impl FromStr for SemanticsVersion {
+    type Err = String;
+
+    fn from_str(value: &str) -> Result<Self, Self::Err> {
+        Self::parse(value).ok_or_else(|| format!("invalid engine version '{}'", value))
+    }
+}
+
+impl TryFrom<String> for SemanticsVersion {
+    type Error = String;
+
+    fn try_from(value: String) -> Result<Self, Self::Error> {
+        value.parse()
+    }
+}
+
+impl From<SemanticsVersion> for String {
+    fn from(version: SemanticsVersion) -> Self {
+        version.to_string()
+    }
+}
+
+/// A change to how rules rewrite code.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+pub struct SemanticsChange {
+    /// The version that introduced the change.
+    pub version: SemanticsVersion,
+    /// What changed.
+    pub summary: &'static str,
+    /// Extensions of the files affected; empty for all files.
+    pub extensions: &'static [&'static str],
+    /// Whether the runner can still follow the semantics from before the
+    /// change, for packs pinned to an older version.
+    pub reproducible: bool,
+}
+
+impl SemanticsChange {
+    /// Returns true if the change affects files with one of `extensions`
+    /// (any file if `extensions` is empty).
+    pub fn affects(&self, extensions: &[String]) -> bool {
+        self.extensions.is_empty()
+            || extensions.is_empty()
+            || extensions
+                .iter()
+                .any(|ext| self.extensions.contains(&ext.as_str()))
+    }
+}
+
+impl fmt::Display for SemanticsChange {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}", self.version, self.summary)?;
+        if !self.extensions.is_empty() {
+            write!(f, " [{}]", self.extensions.join(", "))?;
+        }
+        Ok(())
+    }
+}
+
+/// Imports of rewritten Go files are fixed.
+pub(crate) const GO_IMPORTS: SemanticsVersion = SemanticsVersion::new(0, 2);
+/// Generated files are skipped.
+pub(crate) const SKIP_GENERATED: SemanticsVersion = SemanticsVersion::new(0, 3);
+/// GOPATH packages are told apart from the standard library.
+pub(crate) const GOPATH_IMPORTS: SemanticsVersion = SemanticsVersion::new(0, 5);
+/// Build-tag variants of a selected file are rewritten with it.
+pub(crate) const BUILD_VARIANTS: SemanticsVersion = SemanticsVersion::new(0, 6);
+/// Renames that collide with a name in a Go package block the run.
+pub(crate) const NAME_COLLISIONS: SemanticsVersion = SemanticsVersion::new(0, 7);
+/// Vendored Go dependencies are skipped.
+pub(crate) const SKIP_VENDORED: SemanticsVersion = SemanticsVersion::new(0, 8);
+
+/// Every version of the rewrite semantics, oldest first.
+pub const CHANGELOG: &[SemanticsChange] = &[
+    SemanticsChange {
+        version: SemanticsVersion::new(0, 1),
+        summary: "Rules rewrite every match in the files the upgrade selects, in rule order, \
+                  and files are written as the last rule left them.",
+        extensions: &[],
+        reproducible: true,
+    },
+    SemanticsChange {
+        version: GO_IMPORTS,
+        summary: "Imports of rewritten Go files are fixed: packages the new code references \
+                  are imported and imports whose last use was rewritten away are removed.",
+        extensions: &["go"],
+        reproducible: true,
+    },
+    SemanticsChange {
+        version: SKIP_GENERATED,
+        summary: "Files with a \"Code generated ... DO NOT EDIT.\" header are skipped unless \
+                  generated files are included.",
+        extensions: &[],
+        reproducible: true,
+    },
+    SemanticsChange {
+        version: SemanticsVersion::new(0, 4),
+        summary: "A Go import added by a rewrite whose name is already taken by another \
+                  import or a declaration is added under an alias, and the rewritten code \
+                  uses the alias.",
+        extensions: &["go"],
+        reproducible: false,
+    },
+    SemanticsChange {
+        version: GOPATH_IMPORTS,
+        summary: "In GOPATH mode, packages found in the GOPATH are not taken for standard \
+                  library packages when imports are added or aliased.",
+        extensions: &["go"],
+        reproducible: true,
+    },
+    SemanticsChange {
+        version: BUILD_VARIANTS,
+        summary: "A Go file defining a function that other build-tag variants in its \
+                  directory also define is rewritten together with those variants, even \
+                  when they are outside the include globs or the files changed since a ref.",
+        extensions: &["go"],
+        reproducible: true,
+    },
+    SemanticsChange {
+        version: NAME_COLLISIONS,
+        summary: "A run whose rewrites would declare a name twice in a Go package, or \
+                  declare a name a file of the package imports, fails before any file is \
+                  written, unless collisions are resolved by suffixing the new name.",
+        extensions: &["go"],
+        reproducible: true,
+    },
+    SemanticsChange {
+        version: SKIP_VENDORED,
+        summary: "Files in the vendor directory of a Go module vendoring its dependencies \
+                  (one with a vendor/modules.txt) are skipped: they are copies of other \
+                  modules, replaced by the next go mod vendor.",
+        extensions: &[],
+        reproducible: true,
+    },
+];
+
+/// The semantics this engine implements: the newest version in
+/// [`CHANGELOG`].
+pub const CURRENT: SemanticsVersion = CHANGELOG[CHANGELOG.len() - 1].version;
+
+/// The changes after `version`, oldest first.
+pub fn changes_since(version: SemanticsVersion) -> impl Iterator<Item = &'static SemanticsChange> {
+    CHANGELOG
+        .iter()
+        .filter(move |change| change.version > version)
+}
+
+/// The changes after `pinned` that the engine cannot undo for files with
+/// one of `extensions`: a pack pinned to `pinned` may be rewritten
+/// differently than when it was written.
+pub fn unreproducible_since(
+    pinned: SemanticsVersion,
+    extensions: &[String],
+) -> Vec<&'static SemanticsChange> {
+    changes_since(pinned)
+        .filter(|change| !change.reproducible && change.affects(extensions))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_and_serde() {
+        assert_eq!(
+            SemanticsVersion::parse("v0.3"),
+            Some(SemanticsVersion::new(0, 3))
+        );
+        assert_eq!(SemanticsVersion::parse("1"), None);
+        assert_eq!(SemanticsVersion::new(0, 10).to_string(), "0.10");
+        assert!(SemanticsVersion::new(0, 9) < SemanticsVersion::new(0, 10));
+
+        let json = serde_json::to_string(&SemanticsVersion::new(0, 2)).unwrap();
+        assert_eq!(json, r#""0.2""#);
+        assert!(serde_json::from_str::<SemanticsVersion>(r#""latest""#).is_err());
+    }
+
+    #[test]
+    fn test_changelog() {
+        assert!(CHANGELOG.windows(2).all(|w| w[0].version < w[1].version));
+        assert_eq!(changes_since(CURRENT).count(), 0);
+        assert_eq!(
+            changes_since(SemanticsVersion::new(0, 3))
+                .map(|c| c.version)
+                .collect::<Vec<_>>(),
+            [
+                SemanticsVersion::new(0, 4),
+                SemanticsVersion::new(0, 5),
+                SemanticsVersion::new(0, 6),
+                SemanticsVersion::new(0, 7),
+                SemanticsVersion::new(0, 8)
+            ]
+        );
+
+        let go = ["go".to_string()];
+        let python = ["py".to_string()];
+        let pinned = SemanticsVersion::new(0, 1);
+        assert_eq!(
+            unreproducible_since(pinned, &go)[0].version,
+            SemanticsVersion::new(0, 4)
+        );
+        assert!(unreproducible_since(pinned, &python).is_empty());
+    }
+}
@@ -0,0 +1,75 @@
+//! GitHub Issues tracker.
+
+use super::{DEFAULT_LABEL, IssueTracker, TrackedIssue};
+use crate::error::{RefactorError, Result};
+use crate::github::{GitHubClient, Issue, IssueOps};
+
+/// Files findings as issues in a GitHub repository.
+pub struct GitHubTracker {
+    client: GitHubClient,
+    owner: String,
+    repo: String,
+    labels: Vec<String>,
+}
+
+impl GitHubTracker {
+    /// Create a tracker for `owner/repo`, labelling issues with `refactor`.
+    pub fn new(client: GitHubClient, owner: impl Into<String>, repo: impl Into<String>) -> Self {
+        Self {
+            client,
+            owner: owner.into(),
+            repo: repo.into(),
+            labels: vec![DEFAULT_LABEL.to_string()],
+        }
+    }
+
+    /// Use a different label to identify managed issues.
+    pub fn label(mut self, label: impl Into<String>) -> Self {
+        self.labels = vec![label.into()];
+        self
+    }
+
+    fn number(issue: &TrackedIssue) -> Result<u64> {
+        issue.id.parse().map_err(|_| RefactorError::IssueTracker {
+            message: format!("Invalid GitHub issue number: {}", issue.id),
+        })
+    }
+}
+
+impl From<Issue> for TrackedIssue {
+    fn from(issue: Issue) -> Self {
+        Self {
+            id: issue.number.to_string(),
+            url: issue.html_url,
+            title: issue.title,
+            body: issue.body.unwrap_or_default(),
+        }
+    }
+}
+
+impl IssueTracker for GitHubTracker {
+    fn open_issues(&self) -> Result<Vec<TrackedIssue>> {
+        Ok(self
+            .client
+            .list_open_issues(&self.owner, &self.repo, &self.labels)?
+            .into_iter()
+            .map(TrackedIssue::from)
+            .collect())
+    }
+
+    fn create_issue(&self, title: &str, body: &str) -> Result<TrackedIssue> {
+        self.client
+            .create_issue(&self.owner, &self.repo, title, body, &self.labels)
+            .map(TrackedIssue::from)
+    }
+
+    fn update_issue(&self, issue: &TrackedIssue, body: &str) -> Result<()> {
+        self.client
+            .update_issue_body(&self.owner, &self.repo, Self::number(issue)?, body)
+    }
+
+    fn close_issue(&self, issue: &TrackedIssue, comment: &str) -> Result<()> {
+        self.client
+            .close_issue(&self.owner, &self.repo, Self::number(issue)?, comment)
+    }
+}
@@ -0,0 +1,254 @@
+//! Jira tracker using the REST API (v2).
+
+use reqwest::blocking::{Client, RequestBuilder};
+use serde::Deserialize;
+use serde_json::json;
+
+use super::{DEFAULT_LABEL, IssueTracker, TrackedIssue};
+use crate::error::{RefactorError, Result};
+
+/// Transition names that resolve an issue, in order of preference.
+const CLOSING_TRANSITIONS: &[&str] = &["done", "closed", "close", "resolved", "resolve"];
+
+/// Issues requested per search page.
+const PAGE_SIZE: usize = 100;
+
+#[derive(Deserialize)]
+struct SearchResponse {
+    issues: Vec<JiraIssue>,
+    #[serde(default)]
+    total: usize,
+}
+
+#[derive(Deserialize)]
+struct JiraIssue {
+    key: String,
+    fields: JiraFields,
+}
+
+#[derive(Deserialize)]
+struct JiraFields {
+    summary: String,
+    description: Option<String>,
+}
+
+#[derive(Deserialize)]
+struct CreateResponse {
+    key: String,
+}
+
+#[derive(Deserialize)]
+struct TransitionsResponse {
+    transitions: Vec<Transition>,
+}
+
+#[derive(Deserialize)]
+struct Transition {
+    id: String,
+    name: String,
+}
+
+/// Files findings as issues in a Jira project.
+pub struct JiraTracker {
+    client: Client,
+    base_url: String,
+    project: String,
+    email: String,
+    token: String,
+    label: String,
+    issue_type: String,
+}
+
+impl JiraTracker {
+    /// Create a tracker for `project` on the Jira site at `base_url`,
+    /// authenticating with an account email and API token.
+    pub fn new(
+        base_url: impl Into<String>,
+        project: impl Into<String>,
+        email: impl Into<String>,
+        token: impl Into<String>,
+    ) -> Self {
+        Self {
+            client: Client::new(),
+            base_url: base_url.into().trim_end_matches('/').to_string(),
+            project: project.into(),
+            email: email.into(),
+            token: token.into(),
+            label: DEFAULT_LABEL.to_string(),
+            issue_type: "Task".to_string(),
+        }
+    }
+
+    /// Create a tracker using `JIRA_EMAIL` and `JIRA_API_TOKEN`.
+    pub fn from_env(base_url: impl Into<String>, project: impl Into<String>) -> Result<Self> {
+        let var = |name: &str| {
+            std::env::var(name).map_err(|_| RefactorError::IssueTracker {
+                message: format!("{} environment variable not set", name),
+            })
+        };
+        Ok(Self::new(
+            base_url,
+            project,
+            var("JIRA_EMAIL")?,
+            var("JIRA_API_TOKEN")?,
+        ))
+    }
+
+    /// Use a different label to identify managed issues.
+    pub fn label(mut self, label: impl Into<String>) -> Self {
+        self.label = label.into();
+        self
+    }
+
+    /// Set the issue type for new issues (default: `Task`).
+    pub fn issue_type(mut self, issue_type: impl Into<String>) -> Self {
+        self.issue_type = issue_type.into();
+        self
+    }
+
+    fn url(&self, path: &str) -> String {
+        format!("{}/rest/api/2/{}", self.base_url, path)
+    }
+
+    fn browse_url(&self, key: &str) -> String {
+        format!("{}/browse/{}", self.base_url, key)
+    }
+
+    fn send(&self, request: RequestBuilder, action: &str) -> Result<reqwest::blocking::Response> {
+        request
+            .basic_auth(&self.email, Some(&self.token))
+            .header("Accept", "application/json")
+            .send()?
+            .error_for_status()
+            .map_err(|e| RefactorError::IssueTracker {
+                message: format!("Failed to {}: {}", action, e),
+            })
+    }
+}
+
+impl IssueTracker for JiraTracker {
+    fn open_issues(&self) -> Result<Vec<TrackedIssue>> {
+        let jql = format!(
+            "project = \"{}\" AND labels = \"{}\" AND statusCategory != Done",
+            self.project, self.label
+        );
+        let mut issues = Vec::new();
+        loop {
+            let url = format!(
+                "{}?jql={}&fields=summary,description&startAt={}&maxResults={}",
+                self.url("search"),
+                urlencoding::encode(&jql),
+                issues.len(),
+                PAGE_SIZE
+            );
+            let response: SearchResponse = self
+                .send(self.client.get(url), "search Jira issues")?
+                .json()?;
+            let last = response.issues.is_empty();
+            issues.extend(response.issues.into_iter().map(|issue| TrackedIssue {
+                url: self.browse_url(&issue.key),
+                id: issue.key,
+                title: issue.fields.summary,
+                body: issue.fields.description.unwrap_or_default(),
+            }));
+            if last || issues.len() >= response.total {
+                return Ok(issues);
+            }
+        }
+    }
+
+    fn create_issue(&self, title: &str, body: &str) -> Result<TrackedIssue> {
+        let payload = json!({
+            "fields": {
+                "project": { "key": self.project },
+                "summary": title,
+                "description": body,
+                "issuetype": { "name": self.issue_type },
+                "labels": [self.label],
+            }
+        });
+        let created: CreateResponse = self
+            .send(
+                self.client.post(self.url("issue")).json(&payload),
+                "create Jira issue",
+            )?
+            .json()?;
+
+        Ok(TrackedIssue {
+            url: self.browse_url(&created.key),
+            id: created.key,
+            title: title.to_string(),
+            body: body.to_string(),
+        })
+    }
+
+    fn update_issue(&self, issue: &TrackedIssue, body: &str) -> Result<()> {
+        let payload = json!({ "fields": { "description": body } });
+        self.send(
+            self.client
+                .put(self.url(&format!("issue/{}", issue.id)))
+                .json(&payload),
+            &format!("update {}", issue.id),
+        )?;
+        Ok(())
+    }
+
+    fn close_issue(&self, issue: &TrackedIssue, comment: &str) -> Result<()> {
+        self.send(
+            self.client
+                .post(self.url(&format!("issue/{}/comment", issue.id)))
+                .json(&json!({ "body": comment })),
+            &format!("comment on {}", issue.id),
+        )?;
+
+        let transitions_url = self.url(&format!("issue/{}/transitions", issue.id));
+        let available: TransitionsResponse = self
+            .send(
+                self.client.get(&transitions_url),
+                &format!("list transitions for {}", issue.id),
+            )?
+            .json()?;
+        let transition = find_closing_transition(&available.transitions).ok_or_else(|| {
+            RefactorError::IssueTracker {
+                message: format!("No closing transition available for {}", issue.id),
+            }
+        })?;
+
+        self.send(
+            self.client
+                .post(&transitions_url)
+                .json(&json!({ "transition": { "id": transition.id } })),
+            &format!("close {}", issue.id),
+        )?;
+        Ok(())
+    }
+}
+
+fn find_closing_transition(transitions: &[Transition]) -> Option<&Transition> {
+    CLOSING_TRANSITIONS.iter().find_map(|name| {
+        transitions
+            .iter()
+            .find(|t| t.name.eq_ignore_ascii_case(name))
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_find_closing_transition() {
+        let transitions = vec![
+            Transition {
+                id: "11".to_string(),
+                name: "In Progress".to_string(),
+            },
+            Transition {
+                id: "31".to_string(),
+                name: "Done".to_string(),
+            },
+        ];
+        assert_eq!(find_closing_transition(&transitions).unwrap().id, "31");
+        assert!(find_closing_transition(&transitions[..1]).is_none());
+    }
+}
@@ -0,0 +1,413 @@
+//! Issue tracker integration for findings that need manual review.
+//!
+//! [`IssueSync`] files one issue per finding (such as a suggest-only rule
+//! match), keeps issue bodies current as code moves, and closes issues once
+//! a later run no longer reports the finding. Each issue carries a hidden
+//! fingerprint so findings are matched to issues across runs even when line
+//! numbers change. A partial run, with only some rules or files, declares
+//! what it rescanned ([`IssueSync::rules`], [`IssueSync::paths`]) so the
+//! issues of the rest stay open.
+//!
+//! Trackers implement [`IssueTracker`]; GitHub and Jira are provided.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::github::GitHubClient;
+//! use refactor::runner::UpgradeRunner;
+//! use refactor::tracker::{GitHubTracker, IssueSync};
+//!
+//! let config = UpgradeConfig::from_file("upgrade.yaml")?;
+//! let report = UpgradeRunner::new(config).dry_run().run("./project")?;
+//!
+//! let tracker = GitHubTracker::new(GitHubClient::from_env()?, "my-org", "my-repo");
+//! let result = IssueSync::new("./project")
+//!     .link_base("https://github.com/my-org/my-repo/blob/main")
+//!     .sync(&tracker, &report.diagnostics)?;
+//! println!("{}", result);
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+mod github;
+mod jira;
+
+pub use github::GitHubTracker;
+pub use jira::JiraTracker;
+
+use regex::Regex;
+use std::collections::{HashMap, HashSet};
+use std::fmt;
+use std::fmt::Write;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use crate::diff::fnv1a;
+use crate::error::Result;
+use crate::runner::Diagnostic;
+
+/// Default label applied to issues managed by this tool.
+pub const DEFAULT_LABEL: &str = "refactor";
+
+static MARKER: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"<!-- refactor-finding: ([0-9a-f]{16}) -->").expect("invalid marker regex")
+});
+
+/// An issue in a tracker.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TrackedIssue {
+    /// Tracker-specific identifier (issue number or key).
+    pub id: String,
+    /// Link to the issue.
+    pub url: String,
+    /// Issue title.
+    pub title: String,
+    /// Issue body.
+    pub body: String,
+}
+
+impl TrackedIssue {
+    /// The finding fingerprint embedded in the body, if any.
+    pub fn fingerprint(&self) -> Option<&str> {
+        MARKER
+            .captures(&self.body)
+            .and_then(|c| c.get(1))
+            .map(|m| m.as_str())
+    }
+
+    /// The rule and project-relative path of the finding, from the title.
+    pub fn finding(&self) -> Option<(&str, &Path)> {
+        let (rule, path) = self.title.strip_prefix("[refactor] ")?.rsplit_once(": ")?;
+        Some((rule, Path::new(path)))
+    }
+}
+
+/// A system that can file, update and close issues.
+pub trait IssueTracker {
+    /// Open issues managed by this tool.
+    fn open_issues(&self) -> Result<Vec<TrackedIssue>>;
+
+    /// File a new issue.
+    fn create_issue(&self, title: &str, body: &str) -> Result<TrackedIssue>;
+
+    /// Replace the body of an issue.
+    fn update_issue(&self, issue: &TrackedIssue, body: &str) -> Result<()>;
+
+    /// Close an issue with a comment.
+    fn close_issue(&self, issue: &TrackedIssue, comment: &str) -> Result<()>;
+}
+
+/// The outcome of syncing findings with a tracker.
+#[derive(Debug, Default)]
+pub struct SyncReport {
+    /// Links to newly filed issues.
+    pub created: Vec<String>,
+    /// Links to issues whose body was refreshed.
+    pub updated: Vec<String>,
+    /// Links to issues closed because their finding was resolved.
+    pub closed: Vec<String>,
+    /// Number of issues that were already current.
+    pub unchanged: usize,
+}
+
+impl fmt::Display for SyncReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for url in &self.created {
+            writeln!(f, "created {}", url)?;
+        }
+        for url in &self.updated {
+            writeln!(f, "updated {}", url)?;
+        }
+        for url in &self.closed {
+            writeln!(f, "closed  {}", url)?;
+        }
+        write!(
+            f,
+            "{} created, {} updated, {} closed, {} unchanged",
+            self.created.len(),
+            self.updated.len(),
+            self.closed.len(),
+            self.unchanged
+        )
+    }
+}
+
+/// Syncs findings with an issue tracker.
+pub struct IssueSync {
+    root: PathBuf,
+    link_base: Option<String>,
+    rules: Option<HashSet<String>>,
+    paths: Option<Vec<PathBuf>>,
+}
+
+impl IssueSync {
+    /// Create a sync for findings under the project `root`.
+    pub fn new(root: impl Into<PathBuf>) -> Self {
+        Self {
+            root: root.into(),
+            link_base: None,
+            rules: None,
+            paths: None,
+        }
+    }
+
+    /// Link findings to `{base}/{path}#L{line}` (e.g. a GitHub blob URL).
+    pub fn link_base(mut self, base: impl Into<String>) -> Self {
+        self.link_base = Some(base.into().trim_end_matches('/').to_string());
+        self
+    }
+
+    /// Only the rules with these ids ran: issues of other rules are left
+    /// open. By default every rule is taken to have run.
+    pub fn rules(mut self, ids: impl IntoIterator<Item = impl Into<String>>) -> Self {
+        self.rules = Some(ids.into_iter().map(Into::into).collect());
+        self
+    }
+
+    /// Only these files or directories were scanned: issues elsewhere are
+    /// left open. By default the whole root is taken to be scanned.
+    pub fn paths(mut self, paths: impl IntoIterator<Item = impl Into<PathBuf>>) -> Self {
+        self.paths = Some(
+            paths
+                .into_iter()
+                .map(|path| self.relative(&path.into()))
+                .collect(),
+        );
+        self
+    }
+
+    /// File issues for new findings, refresh existing ones, and close
+    /// issues whose findings were rescanned and are no longer reported.
+    pub fn sync(
+        &self,
+        tracker: &dyn IssueTracker,
+        diagnostics: &[Diagnostic],
+    ) -> Result<SyncReport> {
+        let mut report = SyncReport::default();
+        let mut open: HashMap<String, TrackedIssue> = tracker
+            .open_issues()?
+            .into_iter()
+            .filter_map(|issue| Some((issue.fingerprint()?.to_string(), issue)))
+            .collect();
+
+        for (fingerprint, diagnostic) in self.fingerprint_all(diagnostics) {
+            let body = self.issue_body(&fingerprint, diagnostic);
+            match open.remove(&fingerprint) {
+                Some(issue) if issue.body == body => report.unchanged += 1,
+                Some(issue) => {
+                    tracker.update_issue(&issue, &body)?;
+                    report.updated.push(issue.url);
+                }
+                None => {
+                    let issue = tracker.create_issue(&self.issue_title(diagnostic), &body)?;
+                    report.created.push(issue.url);
+                }
+            }
+        }
+
+        let mut resolved: Vec<TrackedIssue> = open
+            .into_values()
+            .filter(|issue| self.rescanned(issue))
+            .collect();
+        resolved.sort_by(|a, b| a.id.cmp(&b.id));
+        for issue in resolved {
+            tracker.close_issue(&issue, "Resolved: this finding is no longer reported.")?;
+            report.closed.push(issue.url);
+        }
+
+        Ok(report)
+    }
+
+    /// Assign each diagnostic a fingerprint that is stable across line moves.
+    fn fingerprint_all<'a>(&self, diagnostics: &'a [Diagnostic]) -> Vec<(String, &'a Diagnostic)> {
+        let mut occurrences: HashMap<(String, PathBuf, String), usize> = HashMap::new();
+        diagnostics
+            .iter()
+            .map(|d| {
+                let key = (d.rule.clone(), self.relative(&d.path), d.text.clone());
+                let index = occurrences.entry(key.clone()).or_default();
+                let input = format!("{}\0{}\0{}\0{}", key.0, key.1.display(), key.2, index);
+                *index += 1;
+                (format!("{:016x}", fnv1a(input.as_bytes())), d)
+            })
+            .collect()
+    }
+
+    /// Whether the run rescanned the rule and file of `issue`. An issue
+    /// whose title no longer names them is only closed after a full run.
+    fn rescanned(&self, issue: &TrackedIssue) -> bool {
+        if self.rules.is_none() && self.paths.is_none() {
+            return true;
+        }
+        let Some((rule, path)) = issue.finding() else {
+            return false;
+        };
+        self.rules.as_ref().is_none_or(|rules| rules.contains(rule))
+            && self
+                .paths
+                .as_ref()
+                .is_none_or(|paths| paths.iter().any(|scanned| path.starts_with(scanned)))
+    }
+
+    fn relative(&self, path: &Path) -> PathBuf {
+        path.strip_prefix(&self.root).unwrap_or(path).to_path_buf()
+    }
+
+    fn issue_title(&self, diagnostic: &Diagnostic) -> String {
+        format!(
+            "[refactor] {}: {}",
+            diagnostic.rule,
+            self.relative(&diagnostic.path).display()
+        )
+    }
+
+    fn issue_body(&self, fingerprint: &str, diagnostic: &Diagnostic) -> String {
+        let path = self.relative(&diagnostic.path);
+        let location = format!("{}:{}", path.display(), diagnostic.line);
+        let location = match &self.link_base {
+            Some(base) => format!(
+                "[{}]({}/{}#L{})",
+                location,
+                base,
+                path.display(),
+                diagnostic.line
+            ),
+            None => format!("`{}`", location),
+        };
+
+        let mut body = String::new();
+        writeln!(body, "{}", diagnostic.message).unwrap();
+        writeln!(body).unwrap();
+        writeln!(body, "- **Rule:** `{}`", diagnostic.rule).unwrap();
+        writeln!(body, "- **Location:** {}", location).unwrap();
+        writeln!(body, "- **Found:** `{}`", diagnostic.text).unwrap();
+        writeln!(body, "- **Suggested:** `{}`", diagnostic.suggestion).unwrap();
+        writeln!(body).unwrap();
+        write!(body, "<!-- refactor-finding: {} -->", fingerprint).unwrap();
+        body
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::RefCell;
+
+    #[derive(Default)]
+    struct MemoryTracker {
+        issues: RefCell<Vec<(TrackedIssue, bool)>>,
+    }
+
+    impl IssueTracker for MemoryTracker {
+        fn open_issues(&self) -> Result<Vec<TrackedIssue>> {
+            Ok(self
+                .issues
+                .borrow()
+                .iter()
+                .filter(|(_, open)| *open)
+                .map(|(issue, _)| issue.clone())
+                .collect())
+        }
+
+        fn create_issue(&self, title: &str, body: &str) -> Result<TrackedIssue> {
+            let mut issues = self.issues.borrow_mut();
+            let id = (issues.len() + 1).to_string();
+            let issue = TrackedIssue {
+                url: format!("issue/{}", id),
+                id,
+                title: title.to_string(),
+                body: body.to_string(),
+            };
+            issues.push((issue.clone(), true));
+            Ok(issue)
+        }
+
+        fn update_issue(&self, issue: &TrackedIssue, body: &str) -> Result<()> {
+            for (existing, _) in self.issues.borrow_mut().iter_mut() {
+                if existing.id == issue.id {
+                    existing.body = body.to_string();
+                }
+            }
+            Ok(())
+        }
+
+        fn close_issue(&self, issue: &TrackedIssue, _comment: &str) -> Result<()> {
+            for (existing, open) in self.issues.borrow_mut().iter_mut() {
+                if existing.id == issue.id {
+                    *open = false;
+                }
+            }
+            Ok(())
+        }
+    }
+
+    fn diagnostic(line: usize, text: &str) -> Diagnostic {
+        Diagnostic {
+            rule: "deprecated-fn".to_string(),
+            message: "DeprecatedFn is going away".to_string(),
+            path: PathBuf::from("/repo/src/main.go"),
+            line,
+            column: 1,
+            text: text.to_string(),
+            suggestion: "ReplacementFn(".to_string(),
+        }
+    }
+
+    #[test]
+    fn test_sync_lifecycle() {
+        let tracker = MemoryTracker::default();
+        let sync = IssueSync::new("/repo").link_base("https://github.com/o/r/blob/main/");
+
+        let first = sync
+            .sync(
+                &tracker,
+                &[
+                    diagnostic(3, "DeprecatedFn("),
+                    diagnostic(9, "DeprecatedFn("),
+                ],
+            )
+            .unwrap();
+        assert_eq!(first.created.len(), 2);
+
+        let issues = tracker.open_issues().unwrap();
+        assert_eq!(issues[0].title, "[refactor] deprecated-fn: src/main.go");
+        assert!(
+            issues[0]
+                .body
+                .contains("(https://github.com/o/r/blob/main/src/main.go#L3)")
+        );
+        assert!(issues[0].fingerprint().is_some());
+        assert_ne!(issues[0].fingerprint(), issues[1].fingerprint());
+
+        // Code moved down a line: same issue, refreshed body.
+        let second = sync
+            .sync(
+                &tracker,
+                &[
+                    diagnostic(4, "DeprecatedFn("),
+                    diagnostic(10, "DeprecatedFn("),
+                ],
+            )
+            .unwrap();
+        assert!(second.created.is_empty());
+        assert_eq!(second.updated.len(), 2);
+
+        // One occurrence fixed: its issue is closed.
+        let third = sync
+            .sync(&tracker, &[diagnostic(4, "DeprecatedFn(")])
+            .unwrap();
+        assert_eq!(third.unchanged, 1);
+        assert_eq!(third.closed, vec!["issue/2".to_string()]);
+        assert_eq!(tracker.open_issues().unwrap().len(), 1);
+
+        // Runs that did not rescan the rule or the file leave it open.
+        let other_rule = IssueSync::new("/repo").rules(["other-rule"]);
+        assert!(other_rule.sync(&tracker, &[]).unwrap().closed.is_empty());
+        let other_file = IssueSync::new("/repo")
+            .rules(["deprecated-fn"])
+            .paths(["/repo/src/other.go", "/repo/cmd"]);
+        assert!(other_file.sync(&tracker, &[]).unwrap().closed.is_empty());
+        let rescanned = IssueSync::new("/repo").paths(["/repo/src"]);
+        assert_eq!(rescanned.sync(&tracker, &[]).unwrap().closed.len(), 1);
+    }
+}
@@ -1,12 +1,17 @@
 //! AST-aware code transformations using tree-sitter.
+//!
+//! Matched nodes are rewritten as byte-range [`Edit`]s against the original
+//! source, so code outside the matched nodes is left byte-identical and
+//! comments attached to rewritten nodes stay with them.
 
 use super::Transform;
+use super::edit::{Edit, EditSet, expand_to_lines, line_indent, line_start, reindent};
 use crate::error::{RefactorError, Result};
 use crate::lang::LanguageRegistry;
-use crate::matcher::ast::AstMatch;
+use std::collections::HashSet;
 use std::path::Path;
 use streaming_iterator::StreamingIterator;
-use tree_sitter::QueryCursor;
+use tree_sitter::{Node, QueryCursor};
 
 /// AST-aware transformation builder.
 pub struct AstTransform {
@@ -82,10 +87,11 @@ impl AstTransform {
         self
     }
 
-    /// Finds all matches for the query in the source.
-    fn find_matches(&self, source: &str, path: &Path) -> Result<Vec<AstMatch>> {
+    /// Plans the edits for every captured node, against the original source.
+    fn plan_edits(&self, source: &str, path: &Path) -> Result<EditSet> {
+        let mut edits = EditSet::new();
         let Some(ref query_str) = self.query else {
-            return Ok(Vec::new());
+            return Ok(edits);
         };
 
         let lang = self.registry.detect(path).ok_or_else(|| {
@@ -101,67 +107,131 @@ impl AstTransform {
         let query = lang.query(query_str)?;
         let mut cursor = QueryCursor::new();
         let source_bytes = source.as_bytes();
-        let mut matches = Vec::new();
+        let mut seen = HashSet::new();
 
         let mut query_matches = cursor.matches(&query, tree.root_node(), source_bytes);
         while let Some(query_match) = query_matches.next() {
             for capture in query_match.captures {
                 let node = capture.node;
-                let capture_name = query.capture_names()[capture.index as usize].to_string();
-                let text = node.utf8_text(source_bytes).unwrap_or("").to_string();
-
-                matches.push(AstMatch {
-                    text,
-                    start_byte: node.start_byte(),
-                    end_byte: node.end_byte(),
-                    start_row: node.start_position().row,
-                    start_col: node.start_position().column,
-                    end_row: node.end_position().row,
-                    end_col: node.end_position().column,
-                    capture_name,
-                });
+                if !seen.insert((node.start_byte(), node.end_byte())) {
+                    continue;
+                }
+                let capture_name = &query.capture_names()[capture.index as usize];
+                self.plan_node(&mut edits, node, capture_name, source);
             }
         }
 
-        // Sort by start position in reverse order for safe replacement
-        matches.sort_by_key(|m| std::cmp::Reverse(m.start_byte));
-        Ok(matches)
-    }
-
-    /// Applies a single operation to the source at the given match.
-    fn apply_operation(
-        &self,
-        source: &mut String,
-        match_info: &AstMatch,
-        operation: &AstOperation,
-    ) -> Result<()> {
-        match operation {
-            AstOperation::Replace { replacement } => {
-                source.replace_range(match_info.start_byte..match_info.end_byte, replacement);
-            }
-            AstOperation::ReplaceWith { template } => {
-                // Simple template expansion: replace @capture with the matched text
-                let expanded =
-                    template.replace(&format!("@{}", match_info.capture_name), &match_info.text);
-                source.replace_range(match_info.start_byte..match_info.end_byte, &expanded);
-            }
-            AstOperation::Rename { from, to } => {
-                if match_info.text == *from {
-                    source.replace_range(match_info.start_byte..match_info.end_byte, to);
+        Ok(edits)
+    }
+
+    /// Plans the edit for a single captured node.
+    ///
+    /// Deleting a node also removes its leading and trailing comments and the
+    /// lines it occupied. Replacing a node re-indents multi-line replacement
+    /// text to the node's line, and comments inside the node that the
+    /// replacement drops are kept on the lines above it.
+    fn plan_node(&self, edits: &mut EditSet, node: Node, capture_name: &str, source: &str) {
+        let text = &source[node.start_byte()..node.end_byte()];
+        let indent = line_indent(source, node.start_byte());
+
+        let mut result = Some(text.to_string());
+        for operation in &self.operations {
+            result = match (operation, result) {
+                (_, None) | (AstOperation::Delete, _) => None,
+                (AstOperation::Replace { replacement }, _) => Some(reindent(replacement, indent)),
+                (AstOperation::ReplaceWith { template }, _) => {
+                    Some(reindent(template, indent).replace(&format!("@{}", capture_name), text))
                 }
+                (AstOperation::Rename { from, to }, Some(current)) => Some(if current == *from {
+                    to.clone()
+                } else {
+                    current
+                }),
+                (AstOperation::Wrap { prefix, suffix }, Some(current)) => Some(format!(
+                    "{}{}{}",
+                    reindent(prefix, indent),
+                    current,
+                    reindent(suffix, indent)
+                )),
+            };
+        }
+
+        match result {
+            None => {
+                let start = leading_comments_start(node, source);
+                let end = trailing_comment_end(node, source);
+                let (start, end) = expand_to_lines(source, start, end);
+                edits.push(Edit::delete(start, end));
             }
-            AstOperation::Wrap { prefix, suffix } => {
-                let wrapped = format!("{}{}{}", prefix, match_info.text, suffix);
-                source.replace_range(match_info.start_byte..match_info.end_byte, &wrapped);
-            }
-            AstOperation::Delete => {
-                source.replace_range(match_info.start_byte..match_info.end_byte, "");
+            Some(replacement) if replacement != text => {
+                let at = line_start(source, node.start_byte());
+                for comment in inner_comments(node) {
+                    let comment = &source[comment.start_byte()..comment.end_byte()];
+                    if !replacement.contains(comment) {
+                        edits.push(Edit::insert(at, format!("{}{}\n", indent, comment)));
+                    }
+                }
+                edits.push(Edit::replace(
+                    node.start_byte(),
+                    node.end_byte(),
+                    replacement,
+                ));
             }
+            Some(_) => {}
+        }
+    }
+}
+
+fn is_comment(node: Node) -> bool {
+    node.kind().contains("comment")
+}
+
+/// Start of the comments directly above `node` (no blank line between).
+fn leading_comments_start(node: Node, source: &str) -> usize {
+    let mut start = node.start_byte();
+    let mut prev = node.prev_sibling();
+    while let Some(comment) = prev.filter(|p| is_comment(*p)) {
+        let gap = &source[comment.end_byte()..start];
+        let own_line = source[line_start(source, comment.start_byte())..comment.start_byte()]
+            .trim()
+            .is_empty();
+        if !gap.trim().is_empty() || gap.matches('\n').count() > 1 || !own_line {
+            break;
+        }
+        start = comment.start_byte();
+        prev = comment.prev_sibling();
+    }
+    start
+}
+
+/// End of a comment trailing `node` on its last line, if any.
+fn trailing_comment_end(node: Node, source: &str) -> usize {
+    match node.next_sibling() {
+        Some(next)
+            if is_comment(next)
+                && next.start_position().row == node.end_position().row
+                && source[node.end_byte()..next.start_byte()].trim().is_empty() =>
+        {
+            next.end_byte()
         }
-        Ok(())
+        _ => node.end_byte(),
     }
 }
 
+/// Comment nodes nested anywhere inside `node`.
+fn inner_comments(node: Node) -> Vec<Node> {
+    let mut comments = Vec::new();
+    let mut cursor = node.walk();
+    for child in node.children(&mut cursor) {
+        if is_comment(child) {
+            comments.push(child);
+        } else {
+            comments.extend(inner_comments(child));
+        }
+    }
+    comments
+}
+
 impl Default for AstTransform {
     fn default() -> Self {
         Self::new()
@@ -174,16 +244,7 @@ impl Transform for AstTransform {
             return Ok(source.to_string());
         }
 
-        let matches = self.find_matches(source, path)?;
-        let mut result = source.to_string();
-
-        for match_info in matches {
-            for operation in &self.operations {
-                self.apply_operation(&mut result, &match_info, operation)?;
-            }
-        }
-
-        Ok(result)
+        self.plan_edits(source, path)?.apply(source)
     }
 
     fn describe(&self) -> String {
@@ -206,3 +267,48 @@ impl Transform for AstTransform {
         format!("AST query '{}': {}", query_desc, ops.join(", "))
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_delete_removes_attached_comments_and_lines() {
+        let source = "package main\n\nfunc main() {\n\tsetup()\n\n\t// legacy init\n\tlegacyInit() // deprecated\n\trun()\n}\n";
+        let transform = AstTransform::new()
+            .query(r#"((expression_statement (call_expression function: (identifier) @fn)) @stmt (#eq? @fn "legacyInit"))"#)
+            .delete();
+
+        let result = transform.apply(source, Path::new("main.go")).unwrap();
+        assert_eq!(
+            result,
+            "package main\n\nfunc main() {\n\tsetup()\n\n\trun()\n}\n"
+        );
+    }
+
+    #[test]
+    fn test_replace_preserves_untouched_code_and_inner_comments() {
+        let source = "package main\n\nfunc main() {\n\tx := compute(a, // first\n\t\tb)\n\ty  :=  2 // aligned\n}\n";
+        let transform = AstTransform::new()
+            .query("(call_expression) @call")
+            .replace("computeAll(\n\ta,\n\tb,\n)");
+
+        let result = transform.apply(source, Path::new("main.go")).unwrap();
+        assert_eq!(
+            result,
+            "package main\n\nfunc main() {\n\t// first\n\tx := computeAll(\n\t\ta,\n\t\tb,\n\t)\n\ty  :=  2 // aligned\n}\n"
+        );
+    }
+
+    #[test]
+    fn test_operations_compose() {
+        let source = "fn main() { old_name(); }\n";
+        let transform = AstTransform::new()
+            .query("(call_expression function: (identifier) @fn)")
+            .rename("old_name", "new_name")
+            .wrap("(", ")");
+
+        let result = transform.apply(source, Path::new("main.rs")).unwrap();
+        assert_eq!(result, "fn main() { (new_name)(); }\n");
+    }
+}
@@ -0,0 +1,539 @@
+//! Call-site rewrites that understand argument lists.
+//!
+//! A [`CallRewrite`] renames a function and edits the arguments of each call:
+//! removing, reordering and adding positional arguments, and renaming or
+//! adding keyword arguments (`name=value`, as in Python). Arguments are split
+//! at top-level commas, so nested calls, brackets and string literals are
+//! kept intact, and calls spanning several lines keep their layout.
+//!
+//! Definitions (`def f(...)`, `fn f(...)`, `func f(...)`, `function f(...)`,
+//! and Java method and constructor declarations such as `String f(...)`)
+//! are never rewritten. Java constructor calls are rewritten through their
+//! class name (`Client` matches `new Client(...)`).
+//!
+//! In Go files, references to the function that are not calls, such as a
+//! function value passed as a callback, are renamed with it, or adapted or
+//! marked when the arguments change (see [`FunctionValues`]). In other
+//! languages such names are as likely type positions (`List<Client>`), and
+//! are left alone.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::call::{CallArgument, CallRewrite};
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rewrite = CallRewrite::new("connect")
+//!     .rename("open")
+//!     .order(vec![1, 0])
+//!     .rename_keyword("timeout", "deadline")
+//!     .add_argument(CallArgument::keyword("retries", "3"));
+//! let transform = GuardedTransform::new(&rewrite.pattern(), "$0")?.rewriter(Arc::new(rewrite));
+//! let result = transform.apply("c = connect(port, host, timeout=5)\n", "db.py".as_ref())?;
+//! assert_eq!(result, "c = open(host, port, deadline=5, retries=3)\n");
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+use std::sync::Arc;
+
+use super::reference::FunctionValues;
+use super::{GuardedTransform, Transform, structural};
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// An argument to add to each call.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CallArgument {
+    /// Insert as a positional argument at this index (appended if past the
+    /// end).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub position: Option<usize>,
+
+    /// Add as a keyword argument with this name, unless the call already
+    /// passes it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub keyword: Option<String>,
+
+    /// Source text of the argument.
+    pub value: String,
+}
+
+impl CallArgument {
+    /// A positional argument inserted at `position`.
+    pub fn positional(position: usize, value: impl Into<String>) -> Self {
+        Self {
+            position: Some(position),
+            keyword: None,
+            value: value.into(),
+        }
+    }
+
+    /// A keyword argument `name=value`.
+    pub fn keyword(name: impl Into<String>, value: impl Into<String>) -> Self {
+        Self {
+            position: None,
+            keyword: Some(name.into()),
+            value: value.into(),
+        }
+    }
+}
+
+/// Renames a function and edits the arguments of its calls.
+///
+/// Edits are applied in this order: removals, reordering, keyword renames,
+/// additions, then the rename of the function itself.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct CallRewrite {
+    function: String,
+    new_name: Option<String>,
+    arity: Option<usize>,
+    remove: Vec<String>,
+    order: Vec<usize>,
+    keywords: BTreeMap<String, String>,
+    add: Vec<CallArgument>,
+    signature: Option<String>,
+}
+
+impl CallRewrite {
+    /// Rewrite calls of `function`, which may be qualified (`pool.connect`).
+    pub fn new(function: impl Into<String>) -> Self {
+        Self {
+            function: function.into(),
+            ..Default::default()
+        }
+    }
+
+    /// Rename the called function.
+    pub fn rename(mut self, new_name: impl Into<String>) -> Self {
+        self.new_name = Some(new_name.into());
+        self
+    }
+
+    /// Only rewrite calls passing exactly `arity` positional arguments.
+    pub fn arity(mut self, arity: usize) -> Self {
+        self.arity = Some(arity);
+        self
+    }
+
+    /// Remove an argument: a positional index (`"1"`) or a keyword name.
+    pub fn remove_argument(mut self, argument: impl Into<String>) -> Self {
+        self.remove.push(argument.into());
+        self
+    }
+
+    /// Reorder positional arguments: `order` lists original indices in their
+    /// new order. Arguments not listed follow in their original order.
+    pub fn order(mut self, order: Vec<usize>) -> Self {
+        self.order = order;
+        self
+    }
+
+    /// Rename a keyword argument.
+    pub fn rename_keyword(mut self, from: impl Into<String>, to: impl Into<String>) -> Self {
+        self.keywords.insert(from.into(), to.into());
+        self
+    }
+
+    /// Add an argument.
+    pub fn add_argument(mut self, argument: CallArgument) -> Self {
+        self.add.push(argument);
+        self
+    }
+
+    /// Adapt references to the function in Go code with function literals
+    /// of `signature`, its type before the rewrite
+    /// (`func(id int64) (*User, error)`), instead of marking them.
+    pub fn signature(mut self, signature: impl Into<String>) -> Self {
+        self.signature = Some(signature.into());
+        self
+    }
+
+    /// Regex matching calls (and definitions) of the function, and the lines
+    /// referring to it without calling it when the rewrite changes them (see
+    /// [`FunctionValues::pattern`]).
+    pub fn pattern(&self) -> String {
+        match self.references() {
+            Some(references) => format!("{}|{}", self.call_pattern(), references.pattern()),
+            None => self.call_pattern(),
+        }
+    }
+
+    /// Regex matching calls (and definitions) of the function. The argument
+    /// list is captured as `args`, a preceding definition keyword as `def`,
+    /// a preceding word (a Java return type, or `return`) as `word`, and the
+    /// type arguments of a Go generic call (`Find[User](...)`) as `targs`.
+    fn call_pattern(&self) -> String {
+        format!(
+            r"(?P<def>\b(?:def|fn|func|function)\s+)?(?P<word>\b[\w$]+(?:<[^()\n]*>|\[\])*\s+)?\b{}\s*(?P<targs>{}\s*)?{}",
+            regex::escape(&self.function),
+            structural::type_arguments(),
+            structural::argument_list()
+        )
+    }
+
+    /// The handling of references to the function that are not calls: renamed
+    /// with it when its arguments do not change, and adapted or marked when
+    /// they do.
+    fn references(&self) -> Option<FunctionValues> {
+        let references = FunctionValues::new(&self.function);
+        let changes_arguments = !self.remove.is_empty()
+            || !self.order.is_empty()
+            || !self.keywords.is_empty()
+            || !self.add.is_empty();
+        if !changes_arguments {
+            return self
+                .new_name
+                .as_ref()
+                .map(|new_name| references.rename(new_name));
+        }
+        Some(match &self.signature {
+            Some(signature) => references.signature(signature),
+            None => references,
+        })
+    }
+
+    /// Rewrite the argument list `args`, or return `None` if the call is
+    /// left alone.
+    fn rewrite_args(&self, args: &str) -> Option<String> {
+        let mut positional = Vec::new();
+        let mut keywords = Vec::new();
+        for arg in split_arguments(args) {
+            match keyword_name(arg) {
+                Some(name) => keywords.push((Some(name.to_string()), arg.to_string())),
+                None if arg.starts_with("**") => keywords.push((None, arg.to_string())),
+                None => positional.push((positional.len(), arg.to_string())),
+            }
+        }
+        if self.arity.is_some_and(|arity| arity != positional.len()) {
+            return None;
+        }
+
+        positional.retain(|(index, _)| !self.remove.contains(&index.to_string()));
+        keywords.retain(|(name, _)| name.as_ref().is_none_or(|n| !self.remove.contains(n)));
+
+        if !self.order.is_empty() {
+            let rank = |index: &usize| {
+                self.order
+                    .iter()
+                    .position(|i| i == index)
+                    .unwrap_or(self.order.len())
+            };
+            positional.sort_by_key(|(index, _)| rank(index));
+        }
+
+        for (name, arg) in &mut keywords {
+            if let Some(new) = name.as_ref().and_then(|n| self.keywords.get(n)) {
+                let value = arg.split_once('=').map_or("", |(_, v)| v.trim_start());
+                *arg = format!("{}={}", new, value);
+                *name = Some(new.clone());
+            }
+        }
+
+        let mut positional: Vec<String> = positional.into_iter().map(|(_, arg)| arg).collect();
+        for argument in &self.add {
+            match (&argument.keyword, argument.position) {
+                (Some(name), _) => {
+                    if keywords.iter().all(|(n, _)| n.as_ref() != Some(name)) {
+                        // Keyword arguments go before any `**kwargs`
+                        let at = keywords
+                            .iter()
+                            .position(|(n, _)| n.is_none())
+                            .unwrap_or(keywords.len());
+                        let arg = format!("{}={}", name, argument.value);
+                        keywords.insert(at, (Some(name.clone()), arg));
+                    }
+                }
+                (None, position) => {
+                    let at = position.unwrap_or(positional.len()).min(positional.len());
+                    positional.insert(at, argument.value.clone());
+                }
+            }
+        }
+
+        let args_out: Vec<String> = positional
+            .into_iter()
+            .chain(keywords.into_iter().map(|(_, arg)| arg))
+            .collect();
+        Some(join_arguments(args, &args_out))
+    }
+}
+
+impl Rewriter for CallRewrite {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        if m.captures.contains_key("line") {
+            let calls =
+                GuardedTransform::new(&self.call_pattern(), "$0")?.rewriter(Arc::new(self.clone()));
+            let rewrite_calls = |text: &str| {
+                calls
+                    .apply(text, &m.path)
+                    .unwrap_or_else(|_| text.to_string())
+            };
+            // References are only told apart from type positions in Go;
+            // elsewhere only the calls on the line are rewritten
+            if m.path.extension().is_none_or(|ext| ext != "go") {
+                let rewritten = rewrite_calls(&m.text);
+                return Ok((rewritten != m.text).then_some(rewritten));
+            }
+            return Ok(self
+                .references()
+                .and_then(|references| references.rewrite_line(m, &rewrite_calls)));
+        }
+        if m.captures.contains_key("def") {
+            return Ok(None);
+        }
+        let word = m.captures.get("word").map_or("", String::as_str);
+        if is_java_declaration(m, word) {
+            return Ok(None);
+        }
+        let args = m.captures.get("args").map_or("", String::as_str);
+        let Some(rewritten) = self.rewrite_args(args) else {
+            return Ok(None);
+        };
+        let name = self.new_name.as_deref().unwrap_or(&self.function);
+        let targs = m.captures.get("targs").map_or("", String::as_str);
+        Ok(Some(format!("{}{}{}({})", word, name, targs, rewritten)))
+    }
+}
+
+/// Returns true if the match is a Java method or constructor declaration:
+/// its name follows a return type or modifier rather than a keyword such as
+/// `return` or `new`.
+fn is_java_declaration(m: &Match, word: &str) -> bool {
+    const KEYWORDS: &[&str] = &["return", "throw", "new", "else", "case", "yield", "assert"];
+    let word = word.trim_end();
+    m.path.extension().is_some_and(|ext| ext == "java")
+        && !word.is_empty()
+        && !KEYWORDS.contains(&word)
+}
+
+/// Split an argument list at top-level commas, trimming each argument.
+pub(super) fn split_arguments(args: &str) -> Vec<&str> {
+    let mut parts = Vec::new();
+    let mut depth = 0usize;
+    let mut quote: Option<char> = None;
+    let mut escaped = false;
+    let mut start = 0;
+
+    for (i, c) in args.char_indices() {
+        if let Some(q) = quote {
+            if escaped {
+                escaped = false;
+            } else if c == '\\' {
+                escaped = true;
+            } else if c == q {
+                quote = None;
+            }
+            continue;
+        }
+        match c {
+            '"' | '\'' | '`' => quote = Some(c),
+            '(' | '[' | '{' => depth += 1,
+            ')' | ']' | '}' => depth = depth.saturating_sub(1),
+            ',' if depth == 0 => {
+                parts.push(&args[start..i]);
+                start = i + 1;
+            }
+            _ => {}
+        }
+    }
+    parts.push(&args[start..]);
+
+    parts
+        .into_iter()
+        .map(str::trim)
+        .filter(|part| !part.is_empty())
+        .collect()
+}
+
+/// The name of a keyword argument (`name=value`, but not `a == b`).
+fn keyword_name(arg: &str) -> Option<&str> {
+    let end = arg
+        .find(|c: char| !(c.is_alphanumeric() || c == '_'))
+        .unwrap_or(arg.len());
+    let (name, rest) = arg.split_at(end);
+    let rest = rest.trim_start();
+    let starts_ident = name
+        .chars()
+        .next()
+        .is_some_and(|c| c.is_alphabetic() || c == '_');
+    (starts_ident && rest.starts_with('=') && !rest.starts_with("==")).then_some(name)
+}
+
+/// Join rewritten arguments, keeping the layout of the original list: one
+/// argument per line (with any trailing comma) if it spanned lines.
+pub(super) fn join_arguments(original: &str, args: &[String]) -> String {
+    if !original.contains('\n') {
+        return args.join(", ");
+    }
+    let leading = &original[..original.len() - original.trim_start().len()];
+    let trailing = &original[original.trim_end().len()..];
+    let comma = if original.trim_end().ends_with(',') {
+        ","
+    } else {
+        ""
+    };
+    if args.is_empty() {
+        return String::new();
+    }
+    format!(
+        "{}{}{}{}",
+        leading,
+        args.join(&format!(",{}", leading)),
+        comma,
+        trailing
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use std::path::Path;
+    use std::sync::Arc;
+
+    fn apply(rewrite: CallRewrite, source: &str) -> String {
+        GuardedTransform::new(&rewrite.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(rewrite))
+            .apply(source, Path::new("app.py"))
+            .unwrap()
+    }
+
+    #[test]
+    fn test_positional_edits() {
+        let rewrite = CallRewrite::new("client.send")
+            .remove_argument("2")
+            .order(vec![1, 0])
+            .add_argument(CallArgument::positional(0, "ctx"));
+        assert_eq!(
+            apply(rewrite, "client.send(msg, to(a, b), True)\n"),
+            "client.send(ctx, to(a, b), msg)\n"
+        );
+    }
+
+    #[test]
+    fn test_keyword_edits() {
+        let rewrite = CallRewrite::new("fetch")
+            .rename_keyword("timeout", "deadline")
+            .remove_argument("verify")
+            .add_argument(CallArgument::keyword("retries", "3"))
+            .add_argument(CallArgument::keyword("deadline", "10"));
+        assert_eq!(
+            apply(
+                rewrite,
+                "fetch(url, timeout=t, verify=x == \"a,b\", **opts)\n"
+            ),
+            "fetch(url, deadline=t, retries=3, **opts)\n"
+        );
+    }
+
+    #[test]
+    fn test_multiline_call_keeps_layout() {
+        let rewrite = CallRewrite::new("connect").rename("open").order(vec![1, 0]);
+        let source = "conn = connect(\n    port,\n    host,\n)\n";
+        assert_eq!(
+            apply(rewrite, source),
+            "conn = open(\n    host,\n    port,\n)\n"
+        );
+    }
+
+    #[test]
+    fn test_skips_definitions_and_other_arities() {
+        let rewrite = CallRewrite::new("connect")
+            .arity(1)
+            .add_argument(CallArgument::positional(1, "30"));
+        let source = "def connect(host, port=80):\n    pass\nconnect(h)\nconnect(h, 10)\n";
+        assert_eq!(
+            apply(rewrite, source),
+            "def connect(host, port=80):\n    pass\nconnect(h, 30)\nconnect(h, 10)\n"
+        );
+    }
+
+    #[test]
+    fn test_java_declarations_and_constructors() {
+        let apply = |rewrite: CallRewrite, source: &str| {
+            GuardedTransform::new(&rewrite.pattern(), "$0")
+                .unwrap()
+                .rewriter(Arc::new(rewrite))
+                .apply(source, Path::new("App.java"))
+                .unwrap()
+        };
+        let rewrite = CallRewrite::new("connect").add_argument(CallArgument::positional(1, "30"));
+        let source = "public List<Conn> connect(String host) {\n  return connect(host);\n}\nConn c = pool.connect(h);\n";
+        assert_eq!(
+            apply(rewrite, source),
+            "public List<Conn> connect(String host) {\n  return connect(host, 30);\n}\nConn c = pool.connect(h, 30);\n"
+        );
+
+        let rewrite = CallRewrite::new("Client").order(vec![1, 0]);
+        let source = "public Client(int port, String host) {}\nvar c = new Client(80, \"a\");\n";
+        assert_eq!(
+            apply(rewrite.clone(), source),
+            "public Client(int port, String host) {}\nvar c = new Client(\"a\", 80);\n"
+        );
+        // Type positions are not function values
+        let source = "List<Client> all = load();\nall.add(new Client(80, \"a\")); // (Client) x\n";
+        assert_eq!(
+            apply(rewrite, source),
+            "List<Client> all = load();\nall.add(new Client(\"a\", 80)); // (Client) x\n"
+        );
+    }
+
+    #[test]
+    fn test_go_generic_calls() {
+        let rewrite = CallRewrite::new("lib.Find")
+            .rename("lib.Filter")
+            .add_argument(CallArgument::positional(1, "nil"));
+        let source = "func Find[T any](items []T) {}\nusers := lib.Find[User](all)\npairs := lib.Find[map[string][]int](m)\nn := lib.Find(ids)\n";
+        assert_eq!(
+            apply(rewrite, source),
+            "func Find[T any](items []T) {}\nusers := lib.Filter[User](all, nil)\npairs := lib.Filter[map[string][]int](m, nil)\nn := lib.Filter(ids, nil)\n"
+        );
+    }
+
+    #[test]
+    fn test_function_values() {
+        let apply = |rewrite: CallRewrite, source: &str| {
+            GuardedTransform::new(&rewrite.pattern(), "$0")
+                .unwrap()
+                .rewriter(Arc::new(rewrite))
+                .apply(source, Path::new("main.go"))
+                .unwrap()
+        };
+        let source = "\tf := mylib.Save\n\tgo mylib.Save(x, true)\n\tretry(mylib.Save, mylib.Save(y, false))\n";
+        let rewrite = CallRewrite::new("mylib.Save").remove_argument("1");
+        let marked = apply(rewrite.clone(), source);
+        assert_eq!(
+            marked,
+            "\t// TODO(refactor): mylib.Save is used as a value; adapt it to its new signature\n\tf := mylib.Save\n\tgo mylib.Save(x)\n\t// TODO(refactor): mylib.Save is used as a value; adapt it to its new signature\n\tretry(mylib.Save, mylib.Save(y))\n"
+        );
+        assert_eq!(apply(rewrite.clone(), &marked), marked);
+
+        assert_eq!(
+            apply(
+                rewrite.signature("func(data string, sync bool) error"),
+                source
+            ),
+            "\tf := func(data string, sync bool) error { return mylib.Save(data) }\n\tgo mylib.Save(x)\n\tretry(func(data string, sync bool) error { return mylib.Save(data) }, mylib.Save(y))\n"
+        );
+        assert_eq!(
+            apply(
+                CallRewrite::new("Helper").rename("Greet"),
+                "h := utils.Helper\nfmt.Println(h(), utils.Helper())\n"
+            ),
+            "h := utils.Greet\nfmt.Println(h(), utils.Greet())\n"
+        );
+    }
+
+    #[test]
+    fn test_keyword_name() {
+        assert_eq!(keyword_name("timeout = 5"), Some("timeout"));
+        assert_eq!(keyword_name("a == b"), None);
+        assert_eq!(keyword_name("f(x=1)"), None);
+        assert_eq!(keyword_name("\"k\"=1"), None);
+    }
+}
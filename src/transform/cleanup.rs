@@ -0,0 +1,391 @@
+//! Cleanup of Go code a rewrite left unused.
+//!
+//! Deleting the calls of a removed function (see
+//! [`RemovedCall`](super::RemovedCall)) can leave the local variables that
+//! fed them unused, which Go refuses to compile. [`clean`] finds local
+//! variables the rewrite left without a use and removes their declarations
+//! when the value has no side effects (`name := "db"`), or assigns the
+//! value to the blank identifier when it does (`data := load()` becomes
+//! `_ = load()`). Variables declared together with ones still in use are
+//! replaced by `_`, assigning with `=` where the others are already declared
+//! (`_, err = load()`). Imports whose last use goes with them are pruned by
+//! [`GoImports`](super::GoImports); [`removed_imports`] reports those.
+//!
+//! Only variables the rewrite made unused are touched: a variable unused
+//! before the rewrite is left for the developer.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::cleanup::{self, CleanupKind};
+//!
+//! let original = "func main() {\n\tname := \"db\"\n\tdata := load()\n\tDeprecatedFn(name, data)\n}\n";
+//! let rewritten = "func main() {\n\tname := \"db\"\n\tdata := load()\n}\n";
+//! let (cleaned, cleanups) = cleanup::clean(original, rewritten, "main.go".as_ref());
+//! assert_eq!(cleaned, "func main() {\n\t_ = load()\n}\n");
+//! assert_eq!(cleanups[0].kind, CleanupKind::Removed);
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fmt;
+use std::path::{Path, PathBuf};
+use std::sync::LazyLock;
+
+use super::imports::{code_only, imported_paths};
+
+/// A local variable declaration on one line: `a, b := value`, or
+/// `var a Type = value`.
+static DECLARATION: LazyLock<Regex> = LazyLock::new(|| {
+    let names = r"[A-Za-z_]\w*(?:[ \t]*,[ \t]*[A-Za-z_]\w*)*";
+    Regex::new(&format!(
+        r"^(?P<indent>[ \t]+)(?:var[ \t]+(?P<var>{n})(?:[ \t]+[^=\n]*?)?(?:[ \t]*=[ \t]*(?P<init>.*))?|(?P<short>{n})[ \t]*:=[ \t]*(?P<value>.*))$",
+        n = names
+    ))
+    .expect("invalid declaration regex")
+});
+
+/// Most rounds of cleanup: removing one declaration can leave the variables
+/// its value used without a use.
+const MAX_ROUNDS: usize = 8;
+
+/// What the cleanup did to a declaration or import.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum CleanupKind {
+    /// Removed the declaration of an unused variable.
+    Removed,
+    /// Replaced an unused variable by the blank identifier, keeping the
+    /// value for its side effects.
+    Blanked,
+    /// Pruned an import whose last use was removed.
+    Import,
+}
+
+/// One thing the cleanup removed.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Cleanup {
+    /// File cleaned.
+    pub path: PathBuf,
+    /// 1-based line in the rewritten file, before cleanup.
+    pub line: usize,
+    /// The variable or import path.
+    pub name: String,
+    /// What was done.
+    pub kind: CleanupKind,
+}
+
+impl fmt::Display for Cleanup {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let action = match self.kind {
+            CleanupKind::Removed => "removed unused variable",
+            CleanupKind::Blanked => "blank-assigned unused variable",
+            CleanupKind::Import => "pruned unused import",
+        };
+        write!(
+            f,
+            "{}:{}: {} {}",
+            self.path.display(),
+            self.line,
+            action,
+            self.name
+        )
+    }
+}
+
+/// Clean up the local variables the rewrite of `original` into `rewritten`
+/// left unused. Returns the cleaned text and what was cleaned.
+pub fn clean(original: &str, rewritten: &str, path: &Path) -> (String, Vec<Cleanup>) {
+    let before = code_only(original);
+    let code = code_only(rewritten);
+    let mut lines: Vec<Option<(String, String)>> = rewritten
+        .split_inclusive('\n')
+        .zip(code.split_inclusive('\n'))
+        .map(|(line, code)| Some((line.to_string(), code.to_string())))
+        .collect();
+    let mut cleanups = Vec::new();
+    let mut uses_before = HashMap::new();
+
+    for _ in 0..MAX_ROUNDS {
+        let current: String = lines
+            .iter()
+            .flatten()
+            .map(|(_, code)| code.as_str())
+            .collect();
+        let snapshot: Vec<Option<String>> = lines
+            .iter()
+            .map(|entry| entry.as_ref().map(|(_, code)| code.clone()))
+            .collect();
+        let mut changed = false;
+        for (index, entry) in lines.iter_mut().enumerate() {
+            let Some((line, code)) = entry.as_ref() else {
+                continue;
+            };
+            let Some(declaration) = Declaration::parse(code) else {
+                continue;
+            };
+            let unused: Vec<&str> = declaration
+                .names()
+                .filter(|name| *name != "_")
+                .filter(|name| {
+                    let used = *uses_before
+                        .entry(name.to_string())
+                        .or_insert_with(|| uses(&before, name));
+                    used > 1 && uses(&current, name) == 1
+                })
+                .collect();
+            if unused.is_empty() {
+                continue;
+            }
+
+            let record = |kind| {
+                unused.iter().map(move |name| Cleanup {
+                    path: path.to_path_buf(),
+                    line: index + 1,
+                    name: name.to_string(),
+                    kind,
+                })
+            };
+            let everything = declaration
+                .names()
+                .all(|name| name == "_" || unused.contains(&name));
+            let cleaned = if everything && declaration.is_pure() {
+                cleanups.extend(record(CleanupKind::Removed));
+                None
+            } else {
+                cleanups.extend(record(CleanupKind::Blanked));
+                // `:=` needs a new variable on its left
+                let assign = declaration.is_short()
+                    && declaration
+                        .names()
+                        .filter(|name| *name != "_" && !unused.contains(name))
+                        .all(|name| declared_before(&snapshot, index, name));
+                let blanked =
+                    Declaration::parse(line).map(|d| d.blank(&unused, everything, assign));
+                Some((
+                    blanked.unwrap_or_else(|| line.clone()),
+                    declaration.blank(&unused, everything, assign),
+                ))
+            };
+            *entry = cleaned;
+            changed = true;
+        }
+        if !changed {
+            break;
+        }
+    }
+
+    let cleaned = lines.into_iter().flatten().map(|(line, _)| line).collect();
+    cleanups.sort_by_key(|cleanup| cleanup.line);
+    (cleaned, cleanups)
+}
+
+/// The imports of `before` that `after` no longer has, as cleanups at the
+/// line of their spec in `before`.
+pub fn removed_imports(before: &str, after: &str, path: &Path) -> Vec<Cleanup> {
+    let remaining = imported_paths(after);
+    imported_paths(before)
+        .into_iter()
+        .filter(|import| !remaining.contains(import))
+        .map(|import| {
+            let quoted = format!("\"{}\"", import);
+            let line = before
+                .lines()
+                .position(|line| line.contains(&quoted))
+                .map_or(1, |index| index + 1);
+            Cleanup {
+                path: path.to_path_buf(),
+                line,
+                name: import,
+                kind: CleanupKind::Import,
+            }
+        })
+        .collect()
+}
+
+/// Returns true if `name` is declared before line `index` of `lines` in
+/// the same block, or as a parameter or result of the function whose body
+/// the block is.
+fn declared_before(lines: &[Option<String>], index: usize, name: &str) -> bool {
+    let indent = |line: &str| line.len() - line.trim_start_matches([' ', '\t']).len();
+    let Some(level) = lines[index].as_deref().map(indent) else {
+        return false;
+    };
+    let parameter = Regex::new(&format!(
+        r"[(,][ \t]*{}\b(?:[ \t]*,[ \t]*\w+)*[ \t]+[^,)\s]",
+        regex::escape(name)
+    ))
+    .expect("invalid parameter regex");
+    for line in lines[..index].iter().rev().flatten() {
+        if line.trim().is_empty() {
+            continue;
+        }
+        let at = indent(line);
+        if at > level {
+            continue;
+        }
+        if at < level {
+            // The start of the block; a function's parameters share the
+            // scope of its body
+            return line.contains("func") && parameter.is_match(line);
+        }
+        if Declaration::parse(line).is_some_and(|d| d.names().any(|n| n == name)) {
+            return true;
+        }
+    }
+    false
+}
+
+/// A parsed local variable declaration.
+struct Declaration<'a> {
+    line: &'a str,
+    names: regex::Match<'a>,
+    indent: &'a str,
+    value: Option<&'a str>,
+    short: bool,
+}
+
+impl<'a> Declaration<'a> {
+    fn parse(line: &'a str) -> Option<Self> {
+        let caps = DECLARATION.captures(line.trim_end_matches(['\n', '\r']))?;
+        let names = caps.name("short").or_else(|| caps.name("var"))?;
+        Some(Self {
+            line,
+            names,
+            indent: caps.name("indent").map_or("", |m| m.as_str()),
+            value: caps
+                .name("value")
+                .or_else(|| caps.name("init"))
+                .map(|m| m.as_str()),
+            short: caps.name("short").is_some(),
+        })
+    }
+
+    /// Returns true for a short variable declaration (`a := value`).
+    fn is_short(&self) -> bool {
+        self.short
+    }
+
+    fn names(&self) -> impl Iterator<Item = &'a str> + use<'a> {
+        self.names.as_str().split(',').map(str::trim)
+    }
+
+    /// Returns true if the value has no side effects: no calls or channel
+    /// receives, and no brackets left open for the next line.
+    fn is_pure(&self) -> bool {
+        let Some(value) = self.value else {
+            return true;
+        };
+        let opened = value.matches(['(', '[', '{']).count();
+        let closed = value.matches([')', ']', '}']).count();
+        !value.contains('(') && !value.contains("<-") && opened == closed
+    }
+
+    /// The line with the `unused` names replaced by `_`, or, if
+    /// `everything` is unused, the value assigned to blanks. With `assign`,
+    /// a short declaration becomes an assignment.
+    fn blank(&self, unused: &[&str], everything: bool, assign: bool) -> String {
+        let newline = &self.line[self.line.trim_end_matches(['\n', '\r']).len()..];
+        let blanks: Vec<&str> = self
+            .names()
+            .map(|name| if unused.contains(&name) { "_" } else { name })
+            .collect();
+        match self.value {
+            Some(value) if everything => {
+                format!(
+                    "{}{} = {}{}",
+                    self.indent,
+                    blanks.join(", "),
+                    value,
+                    newline
+                )
+            }
+            _ => {
+                let rest = &self.line[self.names.end()..];
+                let rest = if assign {
+                    rest.replacen(":=", "=", 1)
+                } else {
+                    rest.to_string()
+                };
+                format!(
+                    "{}{}{}",
+                    &self.line[..self.names.start()],
+                    blanks.join(", "),
+                    rest
+                )
+            }
+        }
+    }
+}
+
+/// The number of uses of `name` in `code`, not counting selectors (`x.name`).
+fn uses(code: &str, name: &str) -> usize {
+    let pattern =
+        Regex::new(&format!(r"(?:^|[^\w.]){}\b", regex::escape(name))).expect("invalid name regex");
+    pattern.find_iter(code).count()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_clean_unused_variables() {
+        let original = "func main() {\n\tname := \"db\"\n\tmsg := name + \"!\"\n\tuser, err := load(name)\n\tcount := 0\n\tDeprecatedFn(msg, user)\n\tfmt.Println(err, other.user)\n}\n";
+        let rewritten = "func main() {\n\tname := \"db\"\n\tmsg := name + \"!\"\n\tuser, err := load(name)\n\tcount := 0\n\tfmt.Println(err, other.user)\n}\n";
+        let (cleaned, cleanups) = clean(original, rewritten, Path::new("main.go"));
+        // `count` was unused before the rewrite, so it is left alone
+        assert_eq!(
+            cleaned,
+            "func main() {\n\tname := \"db\"\n\t_, err := load(name)\n\tcount := 0\n\tfmt.Println(err, other.user)\n}\n"
+        );
+        let found: Vec<(usize, &str, CleanupKind)> = cleanups
+            .iter()
+            .map(|c| (c.line, c.name.as_str(), c.kind))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                (3, "msg", CleanupKind::Removed),
+                (4, "user", CleanupKind::Blanked)
+            ]
+        );
+        assert_eq!(
+            cleanups[0].to_string(),
+            "main.go:3: removed unused variable msg"
+        );
+    }
+
+    #[test]
+    fn test_blanked_declaration_assigns_declared_variables() {
+        // `err` is a result of the function, and declared earlier in the
+        // `if` block; the nested block may still declare its own
+        let original = "func load(path string) (err error) {\n\tdata, err := read()\n\tuse(data)\n\tif path == \"\" {\n\t\tpart, err := read()\n\t\tuse(part)\n\t\terr = check()\n\t\tinfo, err := stat()\n\t\tuse(info, err)\n\t}\n\treturn err\n}\n";
+        let rewritten = "func load(path string) (err error) {\n\tdata, err := read()\n\tif path == \"\" {\n\t\tpart, err := read()\n\t\terr = check()\n\t\tinfo, err := stat()\n\t\tuse(err)\n\t}\n\treturn err\n}\n";
+        let (cleaned, _) = clean(original, rewritten, Path::new("main.go"));
+        assert_eq!(
+            cleaned,
+            "func load(path string) (err error) {\n\t_, err = read()\n\tif path == \"\" {\n\t\t_, err := read()\n\t\terr = check()\n\t\t_, err = stat()\n\t\tuse(err)\n\t}\n\treturn err\n}\n"
+        );
+
+        // A variable of a sibling block is out of scope
+        let original = "func main() {\n\tif a {\n\t\terr := f()\n\t\tuse(err)\n\t}\n\tdata, err := read()\n\tuse(data, err)\n}\n";
+        let rewritten = "func main() {\n\tif a {\n\t\terr := f()\n\t\tuse(err)\n\t}\n\tdata, err := read()\n\tuse(err)\n}\n";
+        let (cleaned, _) = clean(original, rewritten, Path::new("main.go"));
+        assert!(cleaned.contains("\t_, err := read()\n"));
+    }
+
+    #[test]
+    fn test_removed_imports() {
+        let before = "import (\n\t\"encoding/json\"\n\t\"fmt\"\n)\n";
+        let after = "import (\n\t\"fmt\"\n)\n";
+        let removed = removed_imports(before, after, Path::new("main.go"));
+        assert_eq!(removed.len(), 1);
+        assert_eq!(
+            (removed[0].line, removed[0].name.as_str()),
+            (2, "encoding/json")
+        );
+    }
+}
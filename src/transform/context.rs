@@ -0,0 +1,371 @@
+//! Threading a `context.Context` parameter through a Go function.
+//!
+//! Adding `ctx context.Context` as the first parameter of a function is one
+//! of the most common evolutions of a Go API. A [`ContextInjection`] adds the
+//! parameter to the function's declaration and passes a context at each of
+//! its calls: the `context.Context` parameter of the calling function when
+//! it has one, and `context.TODO()` otherwise, marking the calls whose
+//! callers still have to be given a context.
+//!
+//! Without a package, the declaration and unqualified calls are rewritten,
+//! as in the package declaring the function. With the import path of its
+//! package, calls qualified by the name each file imports the package under
+//! (`mylib.GetUser(...)`, `ml.GetUser(...)`), or unqualified after a dot
+//! import, are rewritten in files importing the package. Calls already
+//! passing a context are left alone, so the rewrite can run again.
+//!
+//! The function used as a value (`handler := mylib.GetUser`) is replaced
+//! with a function literal passing the context, given the function's type
+//! before the change; otherwise the line is marked for the author (see
+//! [`FunctionValues`](super::reference::FunctionValues)).
+//!
+//! Matches are whole top-level function declarations, as laid out by
+//! `gofmt`, so calls outside functions are not rewritten.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::context::ContextInjection;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let inject = ContextInjection::new("GetUser");
+//! let transform = GuardedTransform::new(&inject.pattern(), "$0")?.rewriter(Arc::new(inject));
+//! let result = transform.apply(
+//!     "func GetUser(id int) *User { return nil }\n\nfunc Handle(c context.Context) {\n\tGetUser(1)\n}\n\nfunc main() {\n\tGetUser(2)\n}\n",
+//!     "user.go".as_ref(),
+//! )?;
+//! assert_eq!(
+//!     result,
+//!     "func GetUser(ctx context.Context, id int) *User { return nil }\n\nfunc Handle(c context.Context) {\n\tGetUser(c, 1)\n}\n\nfunc main() {\n\tGetUser(context.TODO(), 2)\n}\n"
+//! );
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use std::ops::Range;
+use std::path::Path;
+use std::sync::LazyLock;
+
+use super::call::split_arguments;
+use super::go::{SKIPPED, imports_package, local_name};
+use super::reference::FunctionValues;
+use super::structural;
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// The head of a function declaration, up to the `(` of its parameters.
+static HEADER: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(&format!(
+        r"\Afunc\s*(?P<recv>\([^)]*\)\s*)?(?P<name>\w+)\s*(?:{}\s*)?\(",
+        structural::type_arguments()
+    ))
+    .expect("invalid function header regex")
+});
+
+/// A parenthesized list at the start of the text.
+static ARGUMENTS: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(&format!(r"\A{}", structural::argument_list())).expect("invalid argument list regex")
+});
+
+/// Adds a context parameter to a Go function and passes a context at its
+/// calls.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ContextInjection {
+    function: String,
+    package: Option<String>,
+    parameter: String,
+    fallback: String,
+    signature: Option<String>,
+}
+
+impl ContextInjection {
+    /// Add a context parameter to the function `function`.
+    pub fn new(function: impl Into<String>) -> Self {
+        Self {
+            function: function.into(),
+            package: None,
+            parameter: "ctx".to_string(),
+            fallback: "context.TODO()".to_string(),
+            signature: None,
+        }
+    }
+
+    /// Rewrite calls qualified by the package with this import path
+    /// (`example.com/mylib`), instead of the declaration and unqualified
+    /// calls.
+    pub fn package(mut self, package: impl Into<String>) -> Self {
+        self.package = Some(package.into().trim_matches('/').to_string());
+        self
+    }
+
+    /// Name of the parameter added to the declaration (default `ctx`).
+    pub fn parameter(mut self, name: impl Into<String>) -> Self {
+        self.parameter = name.into();
+        self
+    }
+
+    /// Context passed by callers without one in scope (default
+    /// `context.TODO()`).
+    pub fn fallback(mut self, expression: impl Into<String>) -> Self {
+        self.fallback = expression.into();
+        self
+    }
+
+    /// Replace the function used as a value with function literals of
+    /// `signature`, its type before the change (`func(id int) *User`),
+    /// instead of marking it.
+    pub fn signature(mut self, signature: impl Into<String>) -> Self {
+        self.signature = Some(signature.into());
+        self
+    }
+
+    /// Regex matching top-level function declarations: one-liners, or up to
+    /// the first `}` at the start of a line.
+    pub fn pattern(&self) -> String {
+        r"(?m)^func\b(?:[^\n]*\}$|(?s:.*?)\{\n(?s:.*?)^\})".to_string()
+    }
+
+    /// Regex matching files that may call the function: with a package,
+    /// files importing it.
+    pub fn file_pattern(&self) -> Option<String> {
+        self.package.as_deref().map(imports_package)
+    }
+
+    /// The declaration `function`, from the file at `path`, with the
+    /// parameter added and contexts passed at its calls, or `None` if
+    /// nothing changes. Calls are qualified by `qualifier`, the name the
+    /// file imports the package under, or unqualified if it is `None`.
+    fn inject(&self, function: &str, path: &Path, qualifier: Option<&str>) -> Option<String> {
+        let header = HEADER.captures(function)?;
+        let open = header.get(0).expect("capture group 0 always exists").end() - 1;
+        let params = ARGUMENTS.captures(&function[open..])?;
+        let body = open + params.get(0).expect("capture group 0 always exists").end();
+        let params = params.name("args").map_or("", |m| m.as_str());
+
+        let mut edits: Vec<(Range<usize>, String)> = Vec::new();
+        let mut context = context_parameter(params);
+        let declares = self.package.is_none()
+            && header.name("recv").is_none()
+            && header["name"] == self.function;
+        if declares && context.is_none() && !params.contains("context.Context") {
+            edits.push(insertion(
+                open + 1,
+                params,
+                &format!("{} context.Context", self.parameter),
+            ));
+            context = Some(self.parameter.as_str());
+        }
+
+        let value = context.unwrap_or(&self.fallback);
+        let calls = Regex::new(&format!(
+            r"(?P<skip>{})|(?P<qual>\b[A-Za-z_]\w*\s*\.\s*|\.\s*)?\b{}\s*(?:{}\s*)?\(",
+            SKIPPED,
+            regex::escape(&self.function),
+            structural::type_arguments()
+        ))
+        .expect("invalid call regex");
+        for call in calls.captures_iter(&function[body..]) {
+            if call.name("skip").is_some() {
+                continue;
+            }
+            let called = call
+                .name("qual")
+                .map(|q| q.as_str().trim_end().trim_end_matches('.').trim_end());
+            if called != qualifier {
+                continue;
+            }
+            let paren = body + call.get(0).expect("capture group 0 always exists").end() - 1;
+            let Some(args) = ARGUMENTS.captures(&function[paren..]) else {
+                continue;
+            };
+            let args = args.name("args").map_or("", |m| m.as_str());
+            // A call passing the parameter's name only passes a context if
+            // the name is in scope
+            let passes_context = split_arguments(args).first().is_some_and(|first| {
+                *first == value
+                    || first.starts_with("context.")
+                    || (*first == self.parameter && in_scope(function, params, &self.parameter))
+            });
+            if !passes_context {
+                edits.push(insertion(paren + 1, args, value));
+            }
+        }
+
+        let name = match qualifier {
+            Some(qualifier) => format!("{}.{}", qualifier, self.function),
+            None => self.function.clone(),
+        };
+        let mut references = FunctionValues::new(name).exact();
+        if let Some(signature) = &self.signature {
+            references = references.signature(signature);
+        }
+        let pass_context = |call: &str| {
+            let open = call.find('(').unwrap_or(call.len() - 1);
+            let (range, text) = insertion(open + 1, &call[open + 1..call.len() - 1], value);
+            let mut passed = call.to_string();
+            passed.replace_range(range, &text);
+            passed
+        };
+        edits.extend(
+            references
+                .edits(function, path, &pass_context)
+                .into_iter()
+                .filter(|(range, _)| range.start >= body || range.is_empty()),
+        );
+
+        if edits.is_empty() {
+            return None;
+        }
+        edits.sort_by_key(|(range, _)| range.start);
+        let mut injected = function.to_string();
+        for (range, text) in edits.into_iter().rev() {
+            injected.replace_range(range, &text);
+        }
+        Some(injected)
+    }
+}
+
+impl Rewriter for ContextInjection {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        // Calls are qualified by the name the file imports the package
+        // under, and unqualified without a package or after a dot import
+        let qualifier = self
+            .package
+            .as_deref()
+            .and_then(|package| local_name(&m.source, package));
+        Ok(self.inject(&m.text, &m.path, qualifier.as_deref()))
+    }
+}
+
+/// The name of the `context.Context` parameter in `params`, if it has a
+/// usable one.
+fn context_parameter(params: &str) -> Option<&str> {
+    split_arguments(params).into_iter().find_map(|param| {
+        let names = param.strip_suffix("context.Context")?;
+        let name = names.split(',').next()?.trim();
+        (!name.is_empty() && name != "_").then_some(name)
+    })
+}
+
+/// Returns true if `name` is declared in `function`, whose parameters are
+/// `params`: as a parameter, a variable, or a parameter of a function
+/// literal.
+fn in_scope(function: &str, params: &str, name: &str) -> bool {
+    let parameter = split_arguments(params)
+        .into_iter()
+        .any(|param| param.split_whitespace().next() == Some(name));
+    let name = regex::escape(name);
+    let variable = Regex::new(&format!(
+        r"(?:\b\w+\s*,\s*)*\b{name}\b(?:\s*,\s*\w+)*\s*:=|\bvar\s+{name}\b|\bfunc\s*\((?:[^)]*,)?\s*{name}\s"
+    ))
+    .expect("invalid declaration regex");
+    parameter || variable.is_match(function)
+}
+
+/// The edit inserting `value` as the first item of the list `list`, which
+/// starts at `offset`: on a line of its own if the list spans lines.
+fn insertion(offset: usize, list: &str, value: &str) -> (Range<usize>, String) {
+    let leading = &list[..list.len() - list.trim_start().len()];
+    if list.trim().is_empty() {
+        (offset..offset, value.to_string())
+    } else if leading.contains('\n') {
+        let at = offset + leading.len();
+        (at..at, format!("{},{}", value, leading))
+    } else {
+        (offset..offset, format!("{}, ", value))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use std::sync::Arc;
+
+    fn apply(inject: ContextInjection, source: &str) -> String {
+        GuardedTransform::new(&inject.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(inject))
+            .apply(source, "main.go".as_ref())
+            .unwrap()
+    }
+
+    #[test]
+    fn test_context_in_scope() {
+        let inject = ContextInjection::new("GetUser").package("example.com/mylib");
+
+        // A function with `ctx` in scope passes it, and a function without
+        // one gets the fallback even where `ctx` is already passed
+        assert_eq!(
+            apply(
+                inject.clone(),
+                "func serve(ctx context.Context) {\n\tmylib.GetUser(1)\n\tmylib.GetUser(ctx, 2)\n}\n\nfunc load() {\n\tmylib.GetUser(ctx, 3)\n}\n"
+            ),
+            "func serve(ctx context.Context) {\n\tmylib.GetUser(ctx, 1)\n\tmylib.GetUser(ctx, 2)\n}\n\nfunc load() {\n\tmylib.GetUser(context.TODO(), ctx, 3)\n}\n"
+        );
+
+        // `ctx` declared as a variable or a function literal's parameter
+        assert_eq!(
+            apply(
+                inject,
+                "func load() {\n\tvar ctx = newContext()\n\tmylib.GetUser(ctx, 1)\n}\n\nfunc main() {\n\trun(func(ctx context.Context) { mylib.GetUser(ctx, 2) })\n}\n"
+            ),
+            "func load() {\n\tvar ctx = newContext()\n\tmylib.GetUser(ctx, 1)\n}\n\nfunc main() {\n\trun(func(ctx context.Context) { mylib.GetUser(ctx, 2) })\n}\n"
+        );
+    }
+
+    #[test]
+    fn test_inject_context() {
+        let source = "func GetUser(ctx context.Context, id int) *User {\n\treturn nil\n}\n\nfunc (s *Server) GetUser() {}\n\nfunc load(ids []int) {\n\tfor _, id := range ids {\n\t\tmylib.GetUser(\n\t\t\tid,\n\t\t)\n\t\ts.GetUser()\n\t}\n}\n\nfunc serve(_ context.Context, r *Request) {\n\tmylib.GetUser(r.ID) // GetUser(x)\n\tmylib.GetUser(ctx, 1)\n}\n";
+        assert_eq!(
+            apply(
+                ContextInjection::new("GetUser").package("example.com/mylib/v2"),
+                source
+            ),
+            "func GetUser(ctx context.Context, id int) *User {\n\treturn nil\n}\n\nfunc (s *Server) GetUser() {}\n\nfunc load(ids []int) {\n\tfor _, id := range ids {\n\t\tmylib.GetUser(\n\t\t\tcontext.TODO(),\n\t\t\tid,\n\t\t)\n\t\ts.GetUser()\n\t}\n}\n\nfunc serve(_ context.Context, r *Request) {\n\tmylib.GetUser(context.TODO(), r.ID) // GetUser(x)\n\tmylib.GetUser(context.TODO(), ctx, 1)\n}\n"
+        );
+
+        // `ctx` only passes a context where it is declared
+        assert_eq!(
+            apply(
+                ContextInjection::new("GetUser").package("example.com/mylib"),
+                "func load() {\n\tctx, cancel := newContext()\n\tdefer cancel()\n\tmylib.GetUser(ctx, 1)\n}\n"
+            ),
+            "func load() {\n\tctx, cancel := newContext()\n\tdefer cancel()\n\tmylib.GetUser(ctx, 1)\n}\n"
+        );
+
+        let inject = ContextInjection::new("Save")
+            .parameter("c")
+            .fallback("context.Background()");
+        assert_eq!(
+            apply(
+                inject,
+                "func Save() error {\n\treturn Save()\n}\n\nfunc main() { Save(); db.Save() }\n"
+            ),
+            "func Save(c context.Context) error {\n\treturn Save(c)\n}\n\nfunc main() { Save(context.Background()); db.Save() }\n"
+        );
+
+        // The function used as a value
+        let source = "func serve(ctx context.Context) {\n\thandle(mylib.GetUser)\n}\n";
+        let inject = ContextInjection::new("GetUser").package("example.com/mylib");
+        assert_eq!(
+            apply(inject.clone(), source),
+            "func serve(ctx context.Context) {\n\t// TODO(refactor): mylib.GetUser is used as a value; adapt it to its new signature\n\thandle(mylib.GetUser)\n}\n"
+        );
+        assert_eq!(
+            apply(inject.signature("func(id int) *User"), source),
+            "func serve(ctx context.Context) {\n\thandle(func(id int) *User { return mylib.GetUser(ctx, id) })\n}\n"
+        );
+
+        // Generic functions, declared with type parameters and called with
+        // type arguments
+        assert_eq!(
+            apply(
+                ContextInjection::new("Load"),
+                "func Load[T any, S ~[]T](ids S) T {\n\treturn Load[T, S](ids)\n}\n"
+            ),
+            "func Load[T any, S ~[]T](ctx context.Context, ids S) T {\n\treturn Load[T, S](ctx, ids)\n}\n"
+        );
+    }
+}
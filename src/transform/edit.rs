@@ -0,0 +1,198 @@
+//! Span-based source edits that leave untouched code byte-identical.
+//!
+//! Rewrites are collected as [`Edit`]s against the original source and
+//! applied in one pass. Only the bytes inside an edit change, so comments,
+//! blank lines and alignment elsewhere in the file survive exactly.
+
+use crate::error::{RefactorError, Result};
+
+/// Replacement of the byte range `start..end` of the original source.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Edit {
+    /// Start byte offset (inclusive).
+    pub start: usize,
+    /// End byte offset (exclusive).
+    pub end: usize,
+    /// Replacement text.
+    pub text: String,
+}
+
+impl Edit {
+    /// Replace `start..end` with `text`.
+    pub fn replace(start: usize, end: usize, text: impl Into<String>) -> Self {
+        Self {
+            start,
+            end,
+            text: text.into(),
+        }
+    }
+
+    /// Insert `text` at `offset`.
+    pub fn insert(offset: usize, text: impl Into<String>) -> Self {
+        Self::replace(offset, offset, text)
+    }
+
+    /// Delete `start..end`.
+    pub fn delete(start: usize, end: usize) -> Self {
+        Self::replace(start, end, "")
+    }
+
+    fn contains(&self, other: &Edit) -> bool {
+        self.start <= other.start && other.end <= self.end && other.start < self.end
+    }
+}
+
+/// A set of non-overlapping edits to one source text.
+#[derive(Debug, Clone, Default)]
+pub struct EditSet {
+    edits: Vec<Edit>,
+}
+
+impl EditSet {
+    /// Creates an empty edit set.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Adds an edit.
+    pub fn push(&mut self, edit: Edit) {
+        self.edits.push(edit);
+    }
+
+    /// Returns true if there are no edits.
+    pub fn is_empty(&self) -> bool {
+        self.edits.is_empty()
+    }
+
+    /// Applies the edits to `source`.
+    ///
+    /// An edit nested inside another (e.g. from a capture within a larger
+    /// captured node) is dropped in favour of the outer edit. Insertions at
+    /// the same offset keep the order they were added in. Partially
+    /// overlapping edits are an error.
+    pub fn apply(&self, source: &str) -> Result<String> {
+        let mut edits: Vec<&Edit> = self.edits.iter().collect();
+        edits.sort_by(|a, b| {
+            a.start
+                .cmp(&b.start)
+                .then((a.start < a.end).cmp(&(b.start < b.end)))
+                .then(b.end.cmp(&a.end))
+        });
+
+        let mut result = String::with_capacity(source.len());
+        let mut cursor = 0;
+        let mut outer: Option<&Edit> = None;
+
+        for edit in edits {
+            if edit.end > source.len() || edit.start > edit.end {
+                return Err(RefactorError::TransformFailed {
+                    message: format!("Edit {}..{} is out of bounds", edit.start, edit.end),
+                });
+            }
+            if outer.is_some_and(|o| o.contains(edit)) {
+                continue;
+            }
+            if edit.start < cursor {
+                return Err(RefactorError::TransformFailed {
+                    message: format!(
+                        "Edit {}..{} overlaps an earlier edit ending at {}",
+                        edit.start, edit.end, cursor
+                    ),
+                });
+            }
+            result.push_str(&source[cursor..edit.start]);
+            result.push_str(&edit.text);
+            cursor = edit.end;
+            outer = Some(edit);
+        }
+
+        result.push_str(&source[cursor..]);
+        Ok(result)
+    }
+}
+
+/// Byte offset of the start of the line containing `offset`.
+pub fn line_start(source: &str, offset: usize) -> usize {
+    source[..offset].rfind('\n').map_or(0, |i| i + 1)
+}
+
+/// The leading whitespace of the line containing `offset`.
+pub fn line_indent(source: &str, offset: usize) -> &str {
+    let start = line_start(source, offset);
+    let line = &source[start..];
+    let width = line.len() - line.trim_start_matches([' ', '\t']).len();
+    &line[..width]
+}
+
+/// Widen `start..end` to whole lines (including the trailing newline) when
+/// nothing but whitespace shares those lines, so removing the span does not
+/// leave a blank or dangling line behind.
+pub fn expand_to_lines(source: &str, start: usize, end: usize) -> (usize, usize) {
+    let before = line_start(source, start);
+    let after = source[end..]
+        .find('\n')
+        .map_or(source.len(), |i| end + i + 1);
+
+    if source[before..start].trim().is_empty() && source[end..after].trim().is_empty() {
+        (before, after)
+    } else {
+        (start, end)
+    }
+}
+
+/// Indent every line after the first of `text` with `indent`, so multi-line
+/// replacements line up with the code they replace.
+pub fn reindent(text: &str, indent: &str) -> String {
+    if indent.is_empty() || !text.contains('\n') {
+        return text.to_string();
+    }
+    let mut lines = text.split('\n');
+    let mut result = lines.next().unwrap_or_default().to_string();
+    for line in lines {
+        result.push('\n');
+        if !line.is_empty() {
+            result.push_str(indent);
+        }
+        result.push_str(line);
+    }
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_apply_preserves_untouched_bytes() {
+        let source = "a := 1 // one\n\nb  :=  2\n";
+        let mut edits = EditSet::new();
+        edits.push(Edit::replace(0, 1, "x"));
+        assert_eq!(edits.apply(source).unwrap(), "x := 1 // one\n\nb  :=  2\n");
+    }
+
+    #[test]
+    fn test_apply_nested_and_overlapping() {
+        let mut nested = EditSet::new();
+        nested.push(Edit::replace(2, 3, "inner"));
+        nested.push(Edit::replace(0, 5, "outer"));
+        nested.push(Edit::insert(0, "> "));
+        assert_eq!(nested.apply("abcdef").unwrap(), "> outerf");
+
+        let mut overlapping = EditSet::new();
+        overlapping.push(Edit::replace(0, 3, "x"));
+        overlapping.push(Edit::replace(2, 5, "y"));
+        assert!(overlapping.apply("abcdef").is_err());
+    }
+
+    #[test]
+    fn test_expand_to_lines() {
+        let source = "a()\n    b()\nc(); d()\n";
+        assert_eq!(expand_to_lines(source, 8, 11), (4, 12));
+        assert_eq!(expand_to_lines(source, 12, 15), (12, 15));
+    }
+
+    #[test]
+    fn test_reindent() {
+        assert_eq!(reindent("f(\n  x,\n\n)", "\t"), "f(\n\t  x,\n\n\t)");
+    }
+}
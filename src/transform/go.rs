@@ -0,0 +1,558 @@
+//! Go type renames.
+//!
+//! A plain `rename_type` rewrites every word matching the old name,
+//! including those in strings, comments and field selectors (`cfg.Utils`).
+//! A [`TypeRename`] only rewrites the type itself, wherever Go code uses
+//! it: its declaration, composite literals (`utils := Utils{}`), pointer,
+//! slice and map types, method receivers and expressions (`Utils.Helper`,
+//! `(*Utils).Helper`), parameters, conversions and type assertions.
+//!
+//! Without a package, the type is renamed where it is used unqualified, as
+//! in the package declaring it. With the import path of its package, the
+//! type is renamed where it is qualified by the name each file imports the
+//! package under: the package name (`mylib.Utils`) or an alias
+//! (`ml.Utils`), or unqualified after a dot import. A client package
+//! re-exporting the type under its own name keeps its API: its alias
+//! (`type Utils = mylib.Utils`) and the type it defines from it
+//! (`type Tools mylib.Utils`) only have their right-hand side renamed, so
+//! the packages importing the client keep compiling.
+//!
+//! In [transitive](TypeRename::transitive) mode, the rename follows the type
+//! through such client packages: their aliases and defined types are
+//! renamed, with the declarations and signatures using them unqualified,
+//! and uses qualified by the client's package (`models.Utils`) are renamed
+//! in the packages importing it, found through the module's `go.mod`. The
+//! wrappers, fields and interfaces mentioning them, and their callers,
+//! follow in turn. Field names and composite literal keys spelled like the
+//! type are left alone, as their selectors are.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::go::TypeRename;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rename = TypeRename::new("Utils", "Helpers");
+//! let transform = GuardedTransform::new(&rename.pattern(), "$0")?.rewriter(Arc::new(rename));
+//! let result = transform.apply(
+//!     "// Utils helps.\nfunc use(u *Utils) string { return Utils.Helper(*u) + \"Utils\" }\n",
+//!     "main.go".as_ref(),
+//! )?;
+//! assert_eq!(
+//!     result,
+//!     "// Utils helps.\nfunc use(u *Helpers) string { return Helpers.Helper(*u) + \"Utils\" }\n"
+//! );
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// Go string and rune literals and comments, in which types are not renamed.
+pub(crate) const SKIPPED: &str =
+    r#""(?:[^"\\\n]|\\.)*"|`[^`]*`|'(?:[^'\\\n]|\\.)*'|//[^\n]*|/\*[\s\S]*?\*/"#;
+
+/// Files of each package directory re-exporting the type.
+type Reexports = Arc<Mutex<HashMap<PathBuf, Vec<PathBuf>>>>;
+
+/// Renames a Go type in the positions code uses it.
+#[derive(Debug, Clone)]
+pub struct TypeRename {
+    package: Option<String>,
+    old_name: String,
+    new_name: String,
+    transitive: bool,
+    reexports: Reexports,
+}
+
+impl TypeRename {
+    /// Rename the type `old_name` to `new_name`.
+    pub fn new(old_name: impl Into<String>, new_name: impl Into<String>) -> Self {
+        Self {
+            package: None,
+            old_name: old_name.into(),
+            new_name: new_name.into(),
+            transitive: false,
+            reexports: Reexports::default(),
+        }
+    }
+
+    /// Rename uses of the type qualified by the package with this import
+    /// path (`example.com/mylib`), instead of unqualified uses.
+    pub fn package(mut self, package: impl Into<String>) -> Self {
+        self.package = Some(package.into().trim_matches('/').to_string());
+        self
+    }
+
+    /// Also rename the client types defined from the type under its own
+    /// name (`type User mylib.User`), and uses of client re-exports
+    /// qualified by their package (`models.User`) in the packages importing
+    /// them.
+    pub fn transitive(mut self, transitive: bool) -> Self {
+        self.transitive = transitive;
+        self.reexports = Reexports::default();
+        self
+    }
+
+    /// Name the package is referred to by: the last segment of its import
+    /// path, skipping a major version suffix (`mylib/v2` is `mylib`).
+    pub fn package_name(&self) -> Option<&str> {
+        self.package.as_deref().map(package_name)
+    }
+
+    /// Regex matching uses of the type, with any qualifier or selector
+    /// (`mylib.`, `.`) captured as `qual`. Strings and comments are matched
+    /// as `skip`, so names inside them are left alone.
+    pub fn pattern(&self) -> String {
+        format!(
+            r"(?P<skip>{})|(?P<qual>(?:\b[A-Za-z_]\w*\s*)?\.\s*)?\b{}\b",
+            SKIPPED,
+            regex::escape(&self.old_name)
+        )
+    }
+
+    /// Regex matching files that may use the type: with a package, files
+    /// importing it, and in transitive mode files naming the type, through
+    /// a re-export declared in another file of their package.
+    pub fn file_pattern(&self) -> Option<String> {
+        self.package.as_deref().map(|package| {
+            if self.transitive {
+                format!(
+                    r"{}|\b{}\b",
+                    imports_package(package),
+                    regex::escape(&self.old_name)
+                )
+            } else {
+                imports_package(package)
+            }
+        })
+    }
+
+    /// Whether the package of the file of `m` re-exports the type under its
+    /// own name (`type Utils = mylib.Utils`).
+    fn reexported(&self, m: &Match) -> bool {
+        let dir = m.path.parent().unwrap_or(Path::new(""));
+        self.declares_reexport(&m.source, dir, 0, m)
+            || self
+                .package_reexports(dir, 0, m)
+                .iter()
+                .any(|file| Some(file.as_os_str()) != m.path.file_name())
+    }
+
+    /// Whether the package `qualifier` refers to in the file of `m` is a
+    /// client package re-exporting the type.
+    fn reexported_by(&self, m: &Match, qualifier: &str) -> bool {
+        let dir = m.path.parent().unwrap_or(Path::new(""));
+        import_path(&m.source, qualifier)
+            .and_then(|import| client_dir(dir, &import))
+            .is_some_and(|dir| !self.package_reexports(&dir, 0, m).is_empty())
+    }
+
+    /// Files of the package in `dir` re-exporting the type, read once per
+    /// directory as the run of `m` sees them.
+    fn package_reexports(&self, dir: &Path, depth: usize, m: &Match) -> Vec<PathBuf> {
+        let lock = || self.reexports.lock().unwrap_or_else(|e| e.into_inner());
+        if let Some(files) = lock().get(dir) {
+            return files.clone();
+        }
+        let entries = fs::read_dir(if dir.as_os_str().is_empty() {
+            Path::new(".")
+        } else {
+            dir
+        });
+        let files: Vec<PathBuf> = entries
+            .into_iter()
+            .flatten()
+            .filter_map(|entry| entry.ok().map(|entry| entry.path()))
+            .filter(|file| file.extension().is_some_and(|e| e == "go"))
+            .filter(|file| {
+                m.read(file)
+                    .is_some_and(|text| self.declares_reexport(&text, dir, depth, m))
+            })
+            .filter_map(|file| file.file_name().map(PathBuf::from))
+            .collect();
+        lock().insert(dir.to_path_buf(), files.clone());
+        files
+    }
+
+    /// Whether `source`, a file of the package in `dir`, re-exports the
+    /// type under its own name: with an alias of or a type defined from the
+    /// library's type, or from a client package's re-export.
+    fn declares_reexport(&self, source: &str, dir: &Path, depth: usize, m: &Match) -> bool {
+        let Some(package) = self.package.as_deref() else {
+            return false;
+        };
+        let declaration = format!(
+            r"(?m)^\s*(?:type\s+{0}|(?P<grouped>{0}))\s*=?\s*\*?\s*(?P<qual>\w+)\s*\.\s*{0}\b",
+            regex::escape(&self.old_name)
+        );
+        let Ok(declaration) = Regex::new(&declaration) else {
+            return false;
+        };
+        let library = local_name(source, package);
+        declaration.captures_iter(source).any(|caps| {
+            if caps
+                .name("grouped")
+                .is_some_and(|name| !in_type_group(&source[..name.start()]))
+            {
+                return false;
+            }
+            let qualifier = &caps["qual"];
+            if library.as_deref() == Some(qualifier) {
+                return true;
+            }
+            depth < MAX_DEPTH
+                && import_path(source, qualifier)
+                    .and_then(|import| client_dir(dir, &import))
+                    .is_some_and(|dep| !self.package_reexports(&dep, depth + 1, m).is_empty())
+        })
+    }
+}
+
+/// How many client packages deep a transitive rename follows re-exports.
+const MAX_DEPTH: usize = 8;
+
+/// The import path of the package `source` refers to by `qualifier`.
+fn import_path(source: &str, qualifier: &str) -> Option<String> {
+    imports(source)
+        .into_iter()
+        .find(|(alias, path)| match alias.as_str() {
+            "" => package_name(path) == qualifier,
+            alias => alias == qualifier,
+        })
+        .map(|(_, path)| path)
+}
+
+/// The directory of the client package with import path `import`, found
+/// from the `go.mod` of the module containing `dir`.
+fn client_dir(dir: &Path, import: &str) -> Option<PathBuf> {
+    let start = if dir.as_os_str().is_empty() {
+        Path::new(".")
+    } else {
+        dir
+    };
+    for root in start.ancestors() {
+        let Ok(manifest) = fs::read_to_string(root.join("go.mod")) else {
+            continue;
+        };
+        let module = manifest
+            .lines()
+            .find_map(|line| line.trim().strip_prefix("module "))?
+            .trim()
+            .trim_matches('"');
+        return match import.strip_prefix(module) {
+            Some("") => Some(root.to_path_buf()),
+            Some(rest) if rest.starts_with('/') => Some(root.join(&rest[1..])),
+            _ => None,
+        };
+    }
+    None
+}
+
+/// Name a package is referred to by: the last segment of its import path,
+/// skipping a major version suffix (`mylib/v2` is `mylib`).
+pub(crate) fn package_name(package: &str) -> &str {
+    let mut segments = package.rsplit('/');
+    let last = segments.next().unwrap_or(package);
+    let is_version =
+        last.len() > 1 && last.starts_with('v') && last[1..].chars().all(|c| c.is_ascii_digit());
+    match segments.next() {
+        Some(parent) if is_version => parent,
+        _ => last,
+    }
+}
+
+/// The name `source` refers to the package with import path `package` by:
+/// the alias of its import (`ml "example.com/mylib"`), or its package name.
+/// `None` for a dot import (`. "example.com/mylib"`), whose names are used
+/// unqualified.
+pub(crate) fn local_name(source: &str, package: &str) -> Option<String> {
+    let suffix = format!("/{}", package);
+    match imports(source)
+        .into_iter()
+        .find(|(_, path)| path == package || path.ends_with(&suffix))
+    {
+        Some((alias, _)) if alias == "." => None,
+        Some((alias, _)) if !alias.is_empty() => Some(alias),
+        _ => Some(package_name(package).to_string()),
+    }
+}
+
+/// The imports of `source`, as the alias they are imported under (empty
+/// for none) and their import path. Blank imports (`_`) are included.
+fn imports(source: &str) -> Vec<(String, String)> {
+    let mut imports = Vec::new();
+    for line in source.lines() {
+        let line = line.trim();
+        // Imports come before any other declaration
+        if ["func ", "type ", "var ", "const "]
+            .iter()
+            .any(|keyword| line.starts_with(keyword))
+        {
+            break;
+        }
+        let spec = line
+            .strip_prefix("import")
+            .filter(|rest| rest.starts_with([' ', '\t', '"']))
+            .unwrap_or(line)
+            .trim_start();
+        let Some((alias, rest)) = spec.split_once('"') else {
+            continue;
+        };
+        let path = rest.split('"').next().unwrap_or("");
+        let alias = alias.trim();
+        if alias.chars().all(|c| c.is_alphanumeric() || c == '_') || alias == "." {
+            imports.push((alias.to_string(), path.to_string()));
+        }
+    }
+    imports
+}
+
+/// Regex matching the import of the package with import path `package`.
+pub(super) fn imports_package(package: &str) -> String {
+    format!(r#""(?:[^"\n]*/)?{}""#, regex::escape(package))
+}
+
+impl Rewriter for TypeRename {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        if m.captures.contains_key("skip") {
+            return Ok(None);
+        }
+        let qual = m.captures.get("qual");
+        let local = self
+            .package
+            .as_deref()
+            .map(|package| local_name(&m.source, package));
+        Ok(match (qual, local) {
+            (Some(qual), Some(Some(name)))
+                if qual.trim_end().trim_end_matches('.').trim_end() == name =>
+            {
+                Some(format!("{}{}", qual, self.new_name))
+            }
+            // Qualified by a client package re-exporting the type
+            (Some(qual), Some(Some(_)))
+                if self.transitive
+                    && self.reexported_by(m, qual.trim_end().trim_end_matches('.').trim_end()) =>
+            {
+                Some(format!("{}{}", qual, self.new_name))
+            }
+            // Unqualified, as in the package itself or after a dot import
+            (None, None | Some(None)) => Some(self.new_name.clone()),
+            // Unqualified in a client package re-exporting the type
+            (None, Some(Some(_)))
+                if self.transitive
+                    && !names_field(&m.source, m.start, m.text.len())
+                    && self.reexported(m) =>
+            {
+                Some(self.new_name.clone())
+            }
+            _ => None,
+        })
+    }
+}
+
+/// Whether the name at `start..start + len` of `source` names a struct
+/// field, parameter or composite literal key (`Status Status`,
+/// `Status: s`) rather than a type. Specs of a `type (...)` group declare
+/// types.
+fn names_field(source: &str, start: usize, len: usize) -> bool {
+    let (lines, before) = source[..start]
+        .rsplit_once('\n')
+        .unwrap_or(("", &source[..start]));
+    let before = before.trim_end();
+    if !(before.is_empty() || before.ends_with(['{', ',', '('])) {
+        return false;
+    }
+    if before.is_empty() && in_type_group(lines) {
+        return false;
+    }
+    let after = &source[start + len..];
+    let rest = after.trim_start_matches([' ', '\t']);
+    rest.starts_with(':')
+        || (rest.len() < after.len()
+            && rest.starts_with(|c: char| c.is_alphanumeric() || "_*[".contains(c)))
+}
+
+/// Whether the line after `before` is inside a `type (...)` group: the
+/// closest line opening a block opens one.
+fn in_type_group(before: &str) -> bool {
+    before
+        .lines()
+        .rev()
+        .map(str::trim)
+        .find(|line| line.ends_with(['{', '(']))
+        .is_some_and(|line| line.starts_with("type") && line.ends_with('('))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use std::path::Path;
+    use std::sync::Arc;
+
+    fn apply(rename: TypeRename, source: &str) -> String {
+        GuardedTransform::new(&rename.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(rename))
+            .apply(source, Path::new("main.go"))
+            .unwrap()
+    }
+
+    #[test]
+    fn test_renames_unqualified_type_positions() {
+        let source = "type Utils struct{}\n\nfunc (u *Utils) Helper() string { return \"Utils\" }\n\nfunc run(u Utils, all []Utils, m map[string]*Utils) {\n\tutils := Utils{}\n\tf := (*Utils).Helper\n\tg := Utils.Helper\n\tp := new(Utils)\n\t_, ok := x.(Utils)\n\t_ = cfg.Utils // field\n}\n";
+        assert_eq!(
+            apply(TypeRename::new("Utils", "Helpers"), source),
+            "type Helpers struct{}\n\nfunc (u *Helpers) Helper() string { return \"Utils\" }\n\nfunc run(u Helpers, all []Helpers, m map[string]*Helpers) {\n\tutils := Helpers{}\n\tf := (*Helpers).Helper\n\tg := Helpers.Helper\n\tp := new(Helpers)\n\t_, ok := x.(Helpers)\n\t_ = cfg.Utils // field\n}\n"
+        );
+    }
+
+    #[test]
+    fn test_renames_qualified_uses() {
+        let rename = TypeRename::new("Utils", "Helpers").package("example.com/mylib/v2");
+        assert_eq!(rename.package_name(), Some("mylib"));
+        assert_eq!(
+            apply(
+                rename,
+                "var u mylib.Utils\nvar p *mylib . Utils\ntype Utils int\nother.Utils{}\n"
+            ),
+            "var u mylib.Helpers\nvar p *mylib . Helpers\ntype Utils int\nother.Utils{}\n"
+        );
+    }
+
+    #[test]
+    fn test_resolves_aliased_and_dot_imports() {
+        let rename = TypeRename::new("Utils", "Helpers").package("example.com/mylib/v2");
+        assert_eq!(
+            apply(
+                rename.clone(),
+                "import (\n\t\"fmt\"\n\tml \"example.com/mylib/v2\"\n)\n\nvar u ml.Utils\nvar v mylib.Utils\n"
+            ),
+            "import (\n\t\"fmt\"\n\tml \"example.com/mylib/v2\"\n)\n\nvar u ml.Helpers\nvar v mylib.Utils\n"
+        );
+        assert_eq!(
+            apply(
+                rename,
+                "import . \"example.com/mylib/v2\"\n\nvar u Utils\nvar v cfg.Utils\n"
+            ),
+            "import . \"example.com/mylib/v2\"\n\nvar u Helpers\nvar v cfg.Utils\n"
+        );
+
+        let source = "import (\n\tml \"example.com/mylib\"\n\t_ \"example.com/driver\"\n)\n\nfunc f() { s := \"example.com/other\" }\n";
+        assert_eq!(
+            local_name(source, "example.com/mylib"),
+            Some("ml".to_string())
+        );
+        assert_eq!(
+            local_name(source, "example.com/driver"),
+            Some("_".to_string())
+        );
+        assert_eq!(
+            local_name(source, "example.com/other"),
+            Some("other".to_string())
+        );
+    }
+
+    #[test]
+    fn test_follows_client_aliases() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let types = dir.path().join("types.go");
+        let service = dir.path().join("service.go");
+        fs::write(
+            &types,
+            "package client\n\nimport \"example.com/mylib\"\n\ntype Status = mylib.Status\n\ntype Local mylib.Status\n",
+        )
+        .unwrap();
+        let source = "package client\n\ntype UserService struct {\n\tlast   Status\n\tStatus Status\n}\n\nfunc (s *UserService) ConnectToServer() (Status, error) {\n\tvar st Status\n\treturn s.Status, nil\n}\n";
+        fs::write(&service, source).unwrap();
+
+        let apply_to = |rename: &TypeRename, path: &Path, source: &str| {
+            GuardedTransform::new(&rename.pattern(), "$0")
+                .unwrap()
+                .rewriter(Arc::new(rename.clone()))
+                .apply(source, path)
+                .unwrap()
+        };
+        // By default the client keeps its API and only the alias's target
+        // is renamed
+        let rename = TypeRename::new("Status", "State").package("example.com/mylib");
+        let file_pattern = Regex::new(&rename.file_pattern().unwrap()).unwrap();
+        assert!(!file_pattern.is_match(source));
+        assert_eq!(apply_to(&rename, &service, source), source);
+        assert_eq!(
+            apply_to(&rename, &types, &fs::read_to_string(&types).unwrap()),
+            "package client\n\nimport \"example.com/mylib\"\n\ntype Status = mylib.State\n\ntype Local mylib.State\n"
+        );
+
+        let rename = rename.transitive(true);
+        let file_pattern = Regex::new(&rename.file_pattern().unwrap()).unwrap();
+        assert!(file_pattern.is_match(source));
+        assert_eq!(
+            apply_to(&rename, &service, source),
+            "package client\n\ntype UserService struct {\n\tlast   State\n\tStatus State\n}\n\nfunc (s *UserService) ConnectToServer() (State, error) {\n\tvar st State\n\treturn s.Status, nil\n}\n"
+        );
+        let grouped = "package client\n\nimport \"example.com/mylib\"\n\ntype (\n\tStatus mylib.Status\n)\n\nvar zero = Response{Status: Status{}}\n";
+        assert_eq!(
+            apply_to(&rename, &types, grouped),
+            "package client\n\nimport \"example.com/mylib\"\n\ntype (\n\tState mylib.State\n)\n\nvar zero = Response{Status: State{}}\n"
+        );
+
+        // Without the alias, an unqualified Status is the package's own type
+        let other = dir.path().join("other");
+        fs::create_dir(&other).unwrap();
+        let own = "package other\n\ntype Status int\n";
+        assert_eq!(apply_to(&rename, &other.join("status.go"), own), own);
+    }
+
+    #[test]
+    fn test_transitive_rename_through_client_packages() {
+        let dir = tempfile::TempDir::new().unwrap();
+        fs::write(
+            dir.path().join("go.mod"),
+            "module example.com/app\n\ngo 1.22\n",
+        )
+        .unwrap();
+        for package in ["models", "service"] {
+            fs::create_dir(dir.path().join(package)).unwrap();
+        }
+        let models = dir.path().join("models/user.go");
+        let models_source = "package models\n\nimport \"example.com/mylib\"\n\n// User is a library user.\ntype User mylib.User\n\nfunc Wrap(u *mylib.User) *User { return (*User)(u) }\n";
+        fs::write(&models, models_source).unwrap();
+        let service = dir.path().join("service/users.go");
+        let service_source = "package service\n\nimport \"example.com/app/models\"\n\ntype Users interface {\n\tGetUserByID(id string) (*models.User, error)\n}\n\ntype UserService struct {\n\tcache map[string]*models.User\n\tUser  string\n}\n";
+        fs::write(&service, service_source).unwrap();
+
+        let rename = TypeRename::new("User", "UserAccount").package("example.com/mylib");
+        let apply_to = |rename: &TypeRename, path: &Path, source: &str| {
+            GuardedTransform::new(&rename.pattern(), "$0")
+                .unwrap()
+                .rewriter(Arc::new(rename.clone()))
+                .apply(source, path)
+                .unwrap()
+        };
+        // By default the client's defined type keeps its name
+        assert_eq!(
+            apply_to(&rename, &models, models_source),
+            "package models\n\nimport \"example.com/mylib\"\n\n// User is a library user.\ntype User mylib.UserAccount\n\nfunc Wrap(u *mylib.UserAccount) *User { return (*User)(u) }\n"
+        );
+        assert_eq!(apply_to(&rename, &service, service_source), service_source);
+
+        let rename = rename.transitive(true);
+        assert_eq!(
+            apply_to(&rename, &models, models_source),
+            "package models\n\nimport \"example.com/mylib\"\n\n// User is a library user.\ntype UserAccount mylib.UserAccount\n\nfunc Wrap(u *mylib.UserAccount) *UserAccount { return (*UserAccount)(u) }\n"
+        );
+        assert_eq!(
+            apply_to(&rename, &service, service_source),
+            "package service\n\nimport \"example.com/app/models\"\n\ntype Users interface {\n\tGetUserByID(id string) (*models.UserAccount, error)\n}\n\ntype UserService struct {\n\tcache map[string]*models.UserAccount\n\tUser  string\n}\n"
+        );
+    }
+}
@@ -0,0 +1,758 @@
+//! Conditional transformations guarded by predicates on the match site.
+
+use super::{Transform, structural};
+use crate::codemod::VersionConstraint;
+use crate::error::{RefactorError, Result};
+use crate::lang::GoVersion;
+use crate::plugin::{Match, Rewriter, SiteMatcher};
+use globset::{Glob, GlobSet, GlobSetBuilder};
+use regex::{Captures, Regex};
+use std::collections::{BTreeMap, HashMap};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, LazyLock, Mutex};
+
+/// Matches source text that is a literal value (string, char, number, bool or nil).
+static LITERAL: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r#"^(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|`[^`]*`|-?(?:0[xXbBoO])?[0-9][0-9a-fA-F_]*(?:\.[0-9_]+)?(?:[eE][+-]?[0-9]+)?[a-zA-Z0-9]*|true|false|True|False|nil|null|None|undefined)$"#,
+    )
+    .expect("invalid literal regex")
+});
+
+/// Returns true if the given source text is a literal value.
+pub fn is_literal(text: &str) -> bool {
+    LITERAL.is_match(text.trim())
+}
+
+/// A predicate that decides whether a rewrite may fire.
+///
+/// File-level conditions (paths, file content, Go version) are checked once
+/// per file; site-level conditions (matched text, captures) are checked per
+/// match.
+/// All configured conditions must hold for the guard to hold.
+#[derive(Default, Clone)]
+pub struct Guard {
+    paths: Vec<String>,
+    file_contains: Vec<String>,
+    matched: Option<String>,
+    captures: Vec<(String, String)>,
+    literals: Vec<String>,
+    go_version: Option<String>,
+    go_feature: Option<String>,
+}
+
+impl Guard {
+    /// Creates a new guard with no conditions.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Requires the file path to match the glob pattern.
+    pub fn path(mut self, pattern: impl Into<String>) -> Self {
+        self.paths.push(pattern.into());
+        self
+    }
+
+    /// Requires the file content to match the regex pattern (and any
+    /// patterns given before).
+    pub fn file_contains(mut self, pattern: impl Into<String>) -> Self {
+        self.file_contains.push(pattern.into());
+        self
+    }
+
+    /// Requires the matched text to match the regex pattern.
+    pub fn matched(mut self, pattern: impl Into<String>) -> Self {
+        self.matched = Some(pattern.into());
+        self
+    }
+
+    /// Requires the named or numbered capture to match the regex pattern.
+    pub fn capture(mut self, name: impl Into<String>, pattern: impl Into<String>) -> Self {
+        self.captures.push((name.into(), pattern.into()));
+        self
+    }
+
+    /// Requires the named or numbered capture to be a literal value.
+    pub fn capture_is_literal(mut self, name: impl Into<String>) -> Self {
+        self.literals.push(name.into());
+        self
+    }
+
+    /// Requires the Go module containing the file to declare a language
+    /// version satisfying `constraint` (e.g. `>=1.22`) in its go.mod. Holds
+    /// for no file outside a Go module.
+    pub fn go_version(mut self, constraint: impl Into<String>) -> Self {
+        self.go_version = Some(constraint.into());
+        self
+    }
+
+    /// Requires the Go module containing the file to declare a language
+    /// version with `feature`, one of [`GoVersion::FEATURES`] (`loopvar`) or
+    /// a predeclared identifier (`min`). Holds for no file outside a Go
+    /// module.
+    pub fn go_feature(mut self, feature: impl Into<String>) -> Self {
+        self.go_feature = Some(feature.into());
+        self
+    }
+
+    /// Returns true if no conditions have been configured.
+    pub fn is_empty(&self) -> bool {
+        self.paths.is_empty()
+            && self.file_contains.is_empty()
+            && self.matched.is_none()
+            && self.captures.is_empty()
+            && self.literals.is_empty()
+            && self.go_version.is_none()
+            && self.go_feature.is_none()
+    }
+
+    fn compile(&self) -> Result<CompiledGuard> {
+        if let Some(feature) = &self.go_feature
+            && GoVersion::DEFAULT.supports(feature).is_none()
+        {
+            return Err(RefactorError::InvalidConfig(format!(
+                "Unknown Go feature '{}'; expected one of {} or a predeclared identifier",
+                feature,
+                GoVersion::FEATURES.join(", ")
+            )));
+        }
+        let go_version =
+            (self.go_version.is_some() || self.go_feature.is_some()).then(|| GoVersionGuard {
+                constraint: self.go_version.as_deref().map(VersionConstraint::parse),
+                feature: self.go_feature.clone(),
+                root: None,
+                modules: Mutex::default(),
+            });
+        let paths = if self.paths.is_empty() {
+            None
+        } else {
+            let mut builder = GlobSetBuilder::new();
+            for pattern in &self.paths {
+                builder.add(Glob::new(pattern)?);
+            }
+            Some(builder.build()?)
+        };
+
+        Ok(CompiledGuard {
+            paths,
+            file_contains: self
+                .file_contains
+                .iter()
+                .map(|pattern| Regex::new(pattern))
+                .collect::<std::result::Result<_, _>>()?,
+            matched: self.matched.as_deref().map(Regex::new).transpose()?,
+            captures: self
+                .captures
+                .iter()
+                .map(|(name, pattern)| Ok((name.clone(), Regex::new(pattern)?)))
+                .collect::<Result<_>>()?,
+            literals: self.literals.clone(),
+            go_version,
+        })
+    }
+
+    fn describe(&self) -> String {
+        let mut parts = Vec::new();
+        if !self.paths.is_empty() {
+            parts.push(format!("path in [{}]", self.paths.join(", ")));
+        }
+        for pattern in &self.file_contains {
+            parts.push(format!("file contains '{}'", pattern));
+        }
+        if let Some(pattern) = &self.matched {
+            parts.push(format!("match is '{}'", pattern));
+        }
+        for (name, pattern) in &self.captures {
+            parts.push(format!("${} is '{}'", name, pattern));
+        }
+        for name in &self.literals {
+            parts.push(format!("${} is a literal", name));
+        }
+        if let Some(constraint) = &self.go_version {
+            parts.push(format!("go version {}", constraint));
+        }
+        if let Some(feature) = &self.go_feature {
+            parts.push(format!("go has {}", feature));
+        }
+        parts.join(" and ")
+    }
+}
+
+struct CompiledGuard {
+    paths: Option<GlobSet>,
+    file_contains: Vec<Regex>,
+    matched: Option<Regex>,
+    captures: Vec<(String, Regex)>,
+    literals: Vec<String>,
+    go_version: Option<GoVersionGuard>,
+}
+
+impl CompiledGuard {
+    fn holds_for_file(&self, source: &str, path: &Path) -> bool {
+        if let Some(set) = &self.paths
+            && !path_suffixes(path).iter().any(|p| set.is_match(p))
+        {
+            return false;
+        }
+        if let Some(guard) = &self.go_version
+            && !guard.holds_for_file(path)
+        {
+            return false;
+        }
+        self.file_contains.iter().all(|re| re.is_match(source))
+    }
+
+    fn holds_for_site(&self, caps: &Captures) -> bool {
+        if let Some(re) = &self.matched
+            && !re.is_match(&caps[0])
+        {
+            return false;
+        }
+        for (name, re) in &self.captures {
+            match capture_text(caps, name) {
+                Some(text) if re.is_match(text) => {}
+                _ => return false,
+            }
+        }
+        self.literals
+            .iter()
+            .all(|name| capture_text(caps, name).is_some_and(is_literal))
+    }
+}
+
+/// A constraint on the Go version of a file's module, and the features
+/// that version must have.
+struct GoVersionGuard {
+    constraint: Option<VersionConstraint>,
+    feature: Option<String>,
+    /// Directory relative paths are resolved from, if not the working
+    /// directory.
+    root: Option<PathBuf>,
+    /// Module versions already looked up, by directory.
+    modules: Mutex<HashMap<PathBuf, Option<GoVersion>>>,
+}
+
+impl GoVersionGuard {
+    fn holds_for_file(&self, path: &Path) -> bool {
+        let path = match &self.root {
+            Some(root) if path.is_relative() => root.join(path),
+            _ => path.to_path_buf(),
+        };
+        let dir = path.parent().unwrap_or(&path);
+        let version = *self
+            .modules
+            .lock()
+            .expect("go version cache poisoned")
+            .entry(dir.to_path_buf())
+            .or_insert_with(|| GoVersion::discover(dir));
+        version.is_some_and(|v| {
+            self.constraint
+                .as_ref()
+                .is_none_or(|c| c.matches(&v.to_string()))
+                && self
+                    .feature
+                    .as_deref()
+                    .is_none_or(|f| v.supports(f) == Some(true))
+        })
+    }
+}
+
+/// Looks up a capture by name, falling back to its numeric index.
+fn capture_text<'a>(caps: &'a Captures, name: &str) -> Option<&'a str> {
+    caps.name(name)
+        .or_else(|| name.parse().ok().and_then(|i| caps.get(i)))
+        .map(|m| m.as_str())
+}
+
+/// Returns every trailing component sequence of a path, so that relative
+/// globs like `internal/**` match absolute paths.
+fn path_suffixes(path: &Path) -> Vec<PathBuf> {
+    let components: Vec<_> = path.components().collect();
+    (0..components.len())
+        .map(|i| components[i..].iter().collect())
+        .collect()
+}
+
+/// A regex replacement that only fires where its guards allow.
+///
+/// A [`SiteMatcher`] plugin can further restrict where it fires, and a
+/// [`Rewriter`] plugin can compute the replacement instead of the template.
+pub struct GuardedTransform {
+    pattern: Regex,
+    replacement: String,
+    when: Option<(Guard, CompiledGuard)>,
+    unless: Option<(Guard, CompiledGuard)>,
+    scope: Option<CompiledGuard>,
+    matcher: Option<Arc<dyn SiteMatcher>>,
+    rewriter: Option<Arc<dyn Rewriter>>,
+    overlay: Option<Arc<HashMap<PathBuf, String>>>,
+    /// Groups of repeated metavariables, with the group of their first
+    /// occurrence.
+    repeats: Vec<(usize, usize)>,
+}
+
+impl GuardedTransform {
+    /// Creates a guarded regex replacement with no guards.
+    ///
+    /// A group named for a later occurrence of a structural metavariable
+    /// (see [`structural::repeated_hole`]) must match the same text as the
+    /// group of its first occurrence.
+    pub fn new(pattern: &str, replacement: &str) -> Result<Self> {
+        let pattern = Regex::new(pattern)?;
+        let names: Vec<_> = pattern.capture_names().collect();
+        let repeats = names
+            .iter()
+            .enumerate()
+            .filter_map(|(index, name)| {
+                let first = structural::repeated_hole((*name)?)?;
+                let first = names.iter().position(|n| *n == Some(first))?;
+                Some((index, first))
+            })
+            .collect();
+        Ok(Self {
+            pattern,
+            repeats,
+            replacement: replacement.to_string(),
+            when: None,
+            unless: None,
+            scope: None,
+            matcher: None,
+            rewriter: None,
+            overlay: None,
+        })
+    }
+
+    /// Only fires where the guard holds.
+    pub fn when(mut self, guard: Guard) -> Result<Self> {
+        let compiled = guard.compile()?;
+        self.when = Some((guard, compiled));
+        Ok(self)
+    }
+
+    /// Never fires where the guard holds.
+    pub fn unless(mut self, guard: Guard) -> Result<Self> {
+        let compiled = guard.compile()?;
+        self.unless = Some((guard, compiled));
+        Ok(self)
+    }
+
+    /// Only fires in the files the guard holds for, such as the files a
+    /// rule is limited to.
+    pub fn within(mut self, guard: Guard) -> Result<Self> {
+        self.scope = Some(guard.compile()?);
+        Ok(self)
+    }
+
+    /// Resolves the relative paths of the files it is applied to from `root`
+    /// when looking up their Go module, instead of the working directory.
+    pub fn root(mut self, root: impl Into<PathBuf>) -> Self {
+        let root = root.into();
+        let guards = [self.when.as_mut(), self.unless.as_mut()]
+            .into_iter()
+            .flatten()
+            .map(|(_, compiled)| compiled)
+            .chain(self.scope.as_mut());
+        for guard in guards {
+            if let Some(go) = &mut guard.go_version {
+                go.root = Some(root.clone());
+            }
+        }
+        self
+    }
+
+    /// Passes the plugins `overlay`, the contents of files rewritten in
+    /// memory, to read instead of the files on disk.
+    pub fn overlay(mut self, overlay: Arc<HashMap<PathBuf, String>>) -> Self {
+        self.overlay = Some(overlay);
+        self
+    }
+
+    /// Only fires where the matcher accepts the match.
+    pub fn matcher(mut self, matcher: Arc<dyn SiteMatcher>) -> Self {
+        self.matcher = Some(matcher);
+        self
+    }
+
+    /// Computes replacements with the rewriter instead of the template.
+    pub fn rewriter(mut self, rewriter: Arc<dyn Rewriter>) -> Self {
+        self.rewriter = Some(rewriter);
+        self
+    }
+
+    /// Returns every site in the source where this transform would fire.
+    ///
+    /// Matches a plugin fails on are left out; [`try_sites`](Self::try_sites)
+    /// and [`Transform::apply`] report such failures.
+    pub fn sites(&self, source: &str, path: &Path) -> Vec<Site> {
+        self.collect_sites(source, path, false)
+            .expect("failures are skipped")
+    }
+
+    /// Returns every site in the source where this transform would fire,
+    /// failing if a plugin fails on a match. Each match is passed to the
+    /// plugins once, so [`splice`] can rewrite the source from the sites
+    /// without calling them again.
+    pub fn try_sites(&self, source: &str, path: &Path) -> Result<Vec<Site>> {
+        self.collect_sites(source, path, true)
+    }
+
+    fn collect_sites(&self, source: &str, path: &Path, fail: bool) -> Result<Vec<Site>> {
+        let mut sites = Vec::new();
+        let Some(unless_file) = self.check_file(source, path) else {
+            return Ok(sites);
+        };
+
+        let file: Arc<str> = Arc::from(source);
+        for caps in self.pattern.captures_iter(source) {
+            if !self.allows(&caps, unless_file) {
+                continue;
+            }
+            let replacement = match self.replacement_for(&caps, path, &file) {
+                Ok(Some(replacement)) => replacement,
+                Ok(None) => continue,
+                Err(e) if fail => return Err(e),
+                Err(_) => continue,
+            };
+            let whole = caps.get(0).expect("capture group 0 always exists");
+            sites.push(Site {
+                start: whole.start(),
+                end: whole.end(),
+                text: whole.as_str().to_string(),
+                replacement,
+            });
+        }
+        Ok(sites)
+    }
+
+    /// The replacement for an allowed match, or `None` if a plugin declines
+    /// it.
+    fn replacement_for(
+        &self,
+        caps: &Captures,
+        path: &Path,
+        source: &Arc<str>,
+    ) -> Result<Option<String>> {
+        let mut replacement = String::new();
+        caps.expand(&self.replacement, &mut replacement);
+        if self.matcher.is_none() && self.rewriter.is_none() {
+            return Ok(Some(replacement));
+        }
+
+        let mut captures = BTreeMap::new();
+        for (index, name) in self.pattern.capture_names().enumerate().skip(1) {
+            if let Some(m) = caps.get(index) {
+                captures.insert(index.to_string(), m.as_str().to_string());
+                if let Some(name) = name {
+                    captures.insert(name.to_string(), m.as_str().to_string());
+                }
+            }
+        }
+        let site = Match {
+            path: path.to_path_buf(),
+            text: caps[0].to_string(),
+            captures,
+            replacement,
+            source: Arc::clone(source),
+            start: caps.get(0).map_or(0, |m| m.start()),
+            overlay: self.overlay.clone(),
+        };
+
+        if let Some(matcher) = &self.matcher
+            && !matcher.matches(&site)?
+        {
+            return Ok(None);
+        }
+        match &self.rewriter {
+            Some(rewriter) => rewriter.rewrite(&site),
+            None => Ok(Some(site.replacement)),
+        }
+    }
+
+    /// Checks file-level guards; returns `None` if the `when` guard rejects
+    /// the file, otherwise whether the `unless` guard holds for the file.
+    fn check_file(&self, source: &str, path: &Path) -> Option<bool> {
+        if let Some(scope) = &self.scope
+            && !scope.holds_for_file(source, path)
+        {
+            return None;
+        }
+        if let Some((_, guard)) = &self.when
+            && !guard.holds_for_file(source, path)
+        {
+            return None;
+        }
+        Some(
+            self.unless
+                .as_ref()
+                .is_some_and(|(_, g)| g.holds_for_file(source, path)),
+        )
+    }
+
+    fn allows(&self, caps: &Captures, unless_file: bool) -> bool {
+        let repeated = |&(index, first): &(usize, usize)| {
+            caps.get(index).map(|m| m.as_str()) == caps.get(first).map(|m| m.as_str())
+        };
+        if !self.repeats.iter().all(repeated) {
+            return false;
+        }
+        let when = self.when.as_ref().map(|(_, g)| g);
+        let unless = self.unless.as_ref().map(|(_, g)| g);
+        when.is_none_or(|g| g.holds_for_site(caps))
+            && !(unless_file && unless.is_some_and(|g| g.holds_for_site(caps)))
+    }
+}
+
+/// A location where a guarded transform fires.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Site {
+    /// Byte offset of the start of the match.
+    pub start: usize,
+    /// Byte offset of the end of the match.
+    pub end: usize,
+    /// The matched text.
+    pub text: String,
+    /// The text the match would be replaced with.
+    pub replacement: String,
+}
+
+/// `source` with each of `sites`, found in it in order, replaced.
+pub fn splice(source: &str, sites: &[Site]) -> String {
+    let mut result = String::with_capacity(source.len());
+    let mut last = 0;
+    for site in sites {
+        result.push_str(&source[last..site.start]);
+        result.push_str(&site.replacement);
+        last = site.end;
+    }
+    result.push_str(&source[last..]);
+    result
+}
+
+impl Site {
+    /// Returns the 1-based line and column of the start of the match.
+    pub fn position(&self, source: &str) -> (usize, usize) {
+        let before = &source[..self.start];
+        let line = before.matches('\n').count() + 1;
+        let column = before
+            .rfind('\n')
+            .map_or(self.start, |i| self.start - i - 1)
+            + 1;
+        (line, column)
+    }
+}
+
+impl Transform for GuardedTransform {
+    fn apply(&self, source: &str, path: &Path) -> Result<String> {
+        let Some(unless_file) = self.check_file(source, path) else {
+            return Ok(source.to_string());
+        };
+
+        let file: Arc<str> = Arc::from(source);
+        let mut error = None;
+        let result = self
+            .pattern
+            .replace_all(source, |caps: &Captures| {
+                if error.is_none() && self.allows(caps, unless_file) {
+                    match self.replacement_for(caps, path, &file) {
+                        Ok(Some(replacement)) => return replacement,
+                        Ok(None) => {}
+                        Err(e) => error = Some(e),
+                    }
+                }
+                caps[0].to_string()
+            })
+            .into_owned();
+        match error {
+            Some(e) => Err(e),
+            None => Ok(result),
+        }
+    }
+
+    fn describe(&self) -> String {
+        let mut description = format!(
+            "Replace pattern '{}' with '{}'",
+            self.pattern.as_str(),
+            self.replacement
+        );
+        if let Some((guard, _)) = &self.when {
+            description.push_str(&format!(" when {}", guard.describe()));
+        }
+        if let Some((guard, _)) = &self.unless {
+            description.push_str(&format!(" unless {}", guard.describe()));
+        }
+        description
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_is_literal() {
+        assert!(is_literal("true"));
+        assert!(is_literal("42"));
+        assert!(is_literal("0x1F"));
+        assert!(is_literal("3.14"));
+        assert!(is_literal("\"hello\""));
+        assert!(is_literal(" nil "));
+        assert!(!is_literal("sync"));
+        assert!(!is_literal("opts.Sync"));
+        assert!(!is_literal("f(1)"));
+    }
+
+    #[test]
+    fn test_guard_literal_capture() {
+        let transform = GuardedTransform::new(r"Save\((\w+), ([^)]+)\)", "Save($1)")
+            .unwrap()
+            .when(Guard::new().capture_is_literal("2"))
+            .unwrap();
+
+        let source = "Save(data, true)\nSave(data, sync)\n";
+        let result = transform.apply(source, Path::new("main.go")).unwrap();
+        assert_eq!(result, "Save(data)\nSave(data, sync)\n");
+    }
+
+    #[test]
+    fn test_guard_path() {
+        let transform = GuardedTransform::new("old", "new")
+            .unwrap()
+            .when(Guard::new().path("internal/**"))
+            .unwrap();
+
+        let inside = transform
+            .apply("old()", Path::new("/repo/internal/db/store.go"))
+            .unwrap();
+        let outside = transform
+            .apply("old()", Path::new("/repo/cmd/main.go"))
+            .unwrap();
+        assert_eq!(inside, "new()");
+        assert_eq!(outside, "old()");
+    }
+
+    #[test]
+    fn test_guard_unless() {
+        let transform = GuardedTransform::new(r"log\.(\w+)", "slog.$1")
+            .unwrap()
+            .unless(Guard::new().capture("1", "^Fatal"))
+            .unwrap();
+
+        let result = transform
+            .apply("log.Info(x)\nlog.Fatalf(y)", Path::new("a.go"))
+            .unwrap();
+        assert_eq!(result, "slog.Info(x)\nlog.Fatalf(y)");
+    }
+
+    #[test]
+    fn test_guard_unless_file_contains() {
+        let transform = GuardedTransform::new("old", "new")
+            .unwrap()
+            .unless(Guard::new().file_contains("// legacy"))
+            .unwrap();
+
+        let result = transform
+            .apply("// legacy\nold()", Path::new("a.go"))
+            .unwrap();
+        assert_eq!(result, "// legacy\nold()");
+    }
+
+    #[test]
+    fn test_guard_go_version() {
+        let dir = tempfile::TempDir::new().unwrap();
+        std::fs::create_dir_all(dir.path().join("legacy")).unwrap();
+        std::fs::write(dir.path().join("go.mod"), "module a\n\ngo 1.22\n").unwrap();
+        std::fs::write(dir.path().join("legacy/go.mod"), "module b\n\ngo 1.20\n").unwrap();
+
+        // The copy is only redundant with per-iteration loop variables
+        let transform = GuardedTransform::new(r"\n\t*(\w+) := (\w+)\n", "\n")
+            .unwrap()
+            .when(Guard::new().go_version(">=1.22").capture("1", "^v$"))
+            .unwrap();
+        let source = "for _, v := range items {\n\tv := v\n\tgo use(v)\n}\n";
+
+        let modern = transform
+            .apply(source, &dir.path().join("main.go"))
+            .unwrap();
+        let legacy = transform
+            .apply(source, &dir.path().join("legacy/main.go"))
+            .unwrap();
+        assert_eq!(modern, "for _, v := range items {\n\tgo use(v)\n}\n");
+        assert_eq!(legacy, source);
+        assert_eq!(
+            transform
+                .apply(source, Path::new("/nonexistent/main.go"))
+                .unwrap(),
+            source
+        );
+
+        // Relative paths are looked up from the root, and features from
+        // the version
+        let transform = GuardedTransform::new(r"\n\t*(\w+) := (\w+)\n", "\n")
+            .unwrap()
+            .when(Guard::new().go_feature("loopvar").capture("1", "^v$"))
+            .unwrap()
+            .root(dir.path());
+        assert_eq!(
+            transform.apply(source, Path::new("main.go")).unwrap(),
+            modern
+        );
+        assert_eq!(
+            transform
+                .apply(source, Path::new("legacy/main.go"))
+                .unwrap(),
+            legacy
+        );
+        let below = GuardedTransform::new("v := v", "")
+            .unwrap()
+            .when(Guard::new().go_version("<1.22"))
+            .unwrap()
+            .root(dir.path());
+        assert_eq!(below.apply(source, Path::new("main.go")).unwrap(), source);
+        assert_ne!(
+            below.apply(source, Path::new("legacy/main.go")).unwrap(),
+            source
+        );
+        assert!(
+            GuardedTransform::new("x", "y")
+                .unwrap()
+                .when(Guard::new().go_feature("generic"))
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_guarded_sites() {
+        let transform = GuardedTransform::new(r"Save\((\w+), ([^)]+)\)", "Save($1)")
+            .unwrap()
+            .when(Guard::new().capture_is_literal("2"))
+            .unwrap();
+
+        let sites = transform.sites("Save(a, sync); Save(b, false)", Path::new("a.go"));
+        assert_eq!(sites.len(), 1);
+        assert_eq!(sites[0].start, 15);
+        assert_eq!(sites[0].text, "Save(b, false)");
+        assert_eq!(sites[0].replacement, "Save(b)");
+    }
+
+    #[test]
+    fn test_site_position() {
+        let site = Site {
+            start: 4,
+            end: 5,
+            text: "d".to_string(),
+            replacement: String::new(),
+        };
+        assert_eq!(site.position("ab\ncd\nef"), (2, 2));
+    }
+
+    #[test]
+    fn test_guard_describe() {
+        let transform = GuardedTransform::new("a", "b")
+            .unwrap()
+            .when(Guard::new().path("internal/**").capture_is_literal("1"))
+            .unwrap();
+        let description = transform.describe();
+        assert!(description.contains("when path in [internal/**]"));
+        assert!(description.contains("$1 is a literal"));
+    }
+}
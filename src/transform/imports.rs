@@ -0,0 +1,740 @@
+//! Import management for rewritten Go files.
+//!
+//! A rewrite can introduce a reference to a package the file does not import
+//! (`time.Second` in a new argument) or remove the last use of one.
+//! [`GoImports`] compares a file before and after a rewrite and adds or
+//! removes import specs the way `goimports` would: standard library imports
+//! are grouped first and specs are kept sorted within their group.
+//!
+//! Only imports affected by the rewrite are touched; pre-existing unused or
+//! unresolved imports are left for the developer.
+//!
+//! When a package the rewrite needs has the same name as something already
+//! in the file (a local `time` variable, or another package imported as
+//! `rand`), it is imported under an alias such as `stdtime` and the
+//! references on the rewritten lines are requalified, instead of producing
+//! code that does not compile.
+//!
+//! Standard library packages are told apart by their import path having no
+//! domain. GOPATH-mode code bases break that rule (`acme/billing/store`);
+//! [`GoImports::with_gopath`] classifies packages found in the GOPATH as
+//! third-party, and so does [`GoImports::with_packages`] for the packages a
+//! monorepo's build system defines.
+
+use regex::Regex;
+use similar::{ChangeTag, TextDiff};
+use std::collections::{BTreeMap, BTreeSet};
+use std::sync::LazyLock;
+
+use super::edit::{Edit, EditSet};
+use crate::lang::GoPath;
+
+static PACKAGE: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"(?m)^package[ \t]+\w+[^\n]*\n?").expect("invalid package regex"));
+
+static DECL: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r#"(?m)^import[ \t]*(?:\((?s:.*?)^\)|(?:[\w.]+[ \t]+)?"[^"\n]+")[^\n]*\n?"#)
+        .expect("invalid import regex")
+});
+
+static SPEC: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r#"^(?:import[ \t]+)?[ \t]*(?:(?P<name>[\w.]+)[ \t]+)?"(?P<path>[^"]+)""#)
+        .expect("invalid import spec regex")
+});
+
+static QUALIFIED: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?:^|[^\w.])([A-Za-z_]\w*)\.[A-Za-z_]").expect("invalid selector regex")
+});
+
+static SHORT_DECL: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"([A-Za-z_]\w*(?:[ \t]*,[ \t]*[A-Za-z_]\w*)*)[ \t]*:=")
+        .expect("invalid short declaration regex")
+});
+
+static NAMED_DECL: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"\b(?:var|const|type|func)[ \t]+([A-Za-z_]\w*)").expect("invalid declaration regex")
+});
+
+static PARAMS: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"\bfunc[ \t]*(?:\(([^()]*)\)[ \t]*)?\w*[ \t]*\(([^()]*)\)")
+        .expect("invalid parameter regex")
+});
+
+/// Standard library packages resolved by name.
+const STDLIB: &[&str] = &[
+    "bufio",
+    "bytes",
+    "context",
+    "crypto/sha256",
+    "database/sql",
+    "encoding/base64",
+    "encoding/hex",
+    "encoding/json",
+    "errors",
+    "fmt",
+    "io",
+    "io/fs",
+    "log",
+    "log/slog",
+    "maps",
+    "math",
+    "net",
+    "net/http",
+    "net/url",
+    "os",
+    "os/exec",
+    "path",
+    "path/filepath",
+    "reflect",
+    "regexp",
+    "runtime",
+    "slices",
+    "sort",
+    "strconv",
+    "strings",
+    "sync",
+    "sync/atomic",
+    "testing",
+    "text/template",
+    "time",
+    "unicode",
+    "unicode/utf8",
+];
+
+/// One import spec line inside an import declaration.
+#[derive(Debug, Clone)]
+struct Spec {
+    name: Option<String>,
+    path: String,
+    line: String,
+}
+
+impl Spec {
+    fn new(path: &str) -> Self {
+        Self {
+            name: None,
+            path: path.to_string(),
+            line: format!("\t\"{}\"", path),
+        }
+    }
+
+    fn aliased(path: &str, alias: &str) -> Self {
+        Self {
+            name: Some(alias.to_string()),
+            path: path.to_string(),
+            line: format!("\t{} \"{}\"", alias, path),
+        }
+    }
+
+    /// The name the package is referred to by in code.
+    fn local_name(&self) -> String {
+        self.name
+            .clone()
+            .unwrap_or_else(|| package_name(&self.path))
+    }
+}
+
+/// A line in an import block: a spec, or a comment kept verbatim.
+#[derive(Debug, Clone)]
+enum Line {
+    Spec(Spec),
+    Other(String),
+}
+
+/// An import declaration (single or parenthesized) and its byte span.
+#[derive(Debug, Clone)]
+struct Decl {
+    start: usize,
+    end: usize,
+    groups: Vec<Vec<Line>>,
+}
+
+impl Decl {
+    fn parse(source: &str, start: usize, end: usize) -> Self {
+        let text = &source[start..end];
+        let mut groups: Vec<Vec<Line>> = vec![Vec::new()];
+
+        if !text
+            .trim_start_matches("import")
+            .trim_start()
+            .starts_with('(')
+        {
+            if let Some(spec) = parse_spec(text.trim_end()) {
+                groups[0].push(Line::Spec(Spec {
+                    line: format!("\t{}", text.trim_end().trim_start_matches("import").trim()),
+                    ..spec
+                }));
+            }
+            return Self { start, end, groups };
+        }
+
+        let body = text.split_once('(').map_or("", |(_, rest)| {
+            rest.rsplit_once(')').map_or(rest, |(b, _)| b)
+        });
+        for line in body.lines() {
+            if line.trim().is_empty() {
+                if !groups.last().is_some_and(Vec::is_empty) {
+                    groups.push(Vec::new());
+                }
+            } else if let Some(spec) = parse_spec(line) {
+                groups.last_mut().unwrap().push(Line::Spec(spec));
+            } else {
+                groups
+                    .last_mut()
+                    .unwrap()
+                    .push(Line::Other(line.to_string()));
+            }
+        }
+        groups.retain(|g| !g.is_empty());
+        Self { start, end, groups }
+    }
+
+    fn specs(&self) -> impl Iterator<Item = &Spec> {
+        self.groups.iter().flatten().filter_map(|line| match line {
+            Line::Spec(spec) => Some(spec),
+            Line::Other(_) => None,
+        })
+    }
+
+    fn remove(&mut self, names: &BTreeSet<String>) {
+        for group in &mut self.groups {
+            group.retain(|line| !matches!(line, Line::Spec(s) if names.contains(&s.local_name())));
+        }
+        self.groups
+            .retain(|g| g.iter().any(|line| matches!(line, Line::Spec(_))));
+    }
+
+    fn add(&mut self, spec: Spec, is_std: &dyn Fn(&str) -> bool) {
+        let std = is_std(&spec.path);
+        let same_kind = |group: &Vec<Line>| {
+            group
+                .iter()
+                .any(|line| matches!(line, Line::Spec(s) if is_std(&s.path) == std))
+        };
+
+        let index = match self.groups.iter().position(same_kind) {
+            Some(index) => index,
+            None if std => {
+                self.groups.insert(0, Vec::new());
+                0
+            }
+            None => {
+                self.groups.push(Vec::new());
+                self.groups.len() - 1
+            }
+        };
+
+        let group = &mut self.groups[index];
+        let at = group
+            .iter()
+            .position(|line| matches!(line, Line::Spec(s) if s.path > spec.path))
+            .unwrap_or(group.len());
+        group.insert(at, Line::Spec(spec));
+    }
+
+    fn render(&self) -> String {
+        let lines: Vec<&Line> = self.groups.iter().flatten().collect();
+        match lines.as_slice() {
+            [] => String::new(),
+            [Line::Spec(spec)] => format!("import {}\n", spec.line.trim()),
+            _ => {
+                let groups: Vec<String> = self
+                    .groups
+                    .iter()
+                    .map(|group| {
+                        group
+                            .iter()
+                            .map(|line| match line {
+                                Line::Spec(spec) => format!("{}\n", spec.line),
+                                Line::Other(text) => format!("{}\n", text),
+                            })
+                            .collect()
+                    })
+                    .collect();
+                format!("import (\n{})\n", groups.join("\n"))
+            }
+        }
+    }
+}
+
+/// Adds and removes Go imports affected by a rewrite.
+#[derive(Debug, Clone)]
+pub struct GoImports {
+    known: BTreeMap<String, String>,
+    explicit: BTreeSet<String>,
+    gopath: Option<GoPath>,
+    packages: BTreeSet<String>,
+}
+
+impl GoImports {
+    /// Creates an import fixer that resolves standard library packages.
+    pub fn new() -> Self {
+        let known = STDLIB
+            .iter()
+            .map(|path| (package_name(path), path.to_string()))
+            .collect();
+        Self {
+            known,
+            explicit: BTreeSet::new(),
+            gopath: None,
+            packages: BTreeSet::new(),
+        }
+    }
+
+    /// Also resolve references to the package at `path`. Unlike guessed
+    /// standard library packages, it takes precedence over a different
+    /// package the file already imports under the same name.
+    pub fn with_import(mut self, path: impl Into<String>) -> Self {
+        let path = path.into();
+        self.known.insert(package_name(&path), path.clone());
+        self.explicit.insert(path);
+        self
+    }
+
+    /// Treat packages found in `gopath` as third-party, even if their import
+    /// path has no domain.
+    pub fn with_gopath(mut self, gopath: GoPath) -> Self {
+        self.gopath = Some(gopath);
+        self
+    }
+
+    /// Treat the packages with these import paths, such as those a
+    /// packages driver loaded, as third-party.
+    pub fn with_packages(mut self, paths: impl IntoIterator<Item = impl Into<String>>) -> Self {
+        self.packages.extend(paths.into_iter().map(Into::into));
+        self
+    }
+
+    /// Returns true if the package at `path` belongs to the standard
+    /// library.
+    fn is_std(&self, path: &str) -> bool {
+        is_std(path)
+            && !self.packages.contains(path)
+            && self
+                .gopath
+                .as_ref()
+                .is_none_or(|gopath| gopath.package_dir(path).is_none())
+    }
+
+    /// Fix the imports of `rewritten`, the result of rewriting `original`.
+    ///
+    /// Packages referenced by the rewrite but not imported are added if
+    /// they can be resolved; imports whose last use the rewrite removed are
+    /// dropped. Added packages whose name is already taken are aliased.
+    pub fn fix(&self, original: &str, rewritten: &str) -> String {
+        let before = qualifier_counts(original);
+        let introduced: Vec<&String> = qualifier_counts(rewritten)
+            .into_iter()
+            .filter(|(name, n)| *n > before.get(name).copied().unwrap_or(0))
+            .filter_map(|(name, _)| self.known.get_key_value(&name).map(|(k, _)| k))
+            .collect();
+
+        let existing: Vec<Spec> = DECL
+            .find_iter(rewritten)
+            .flat_map(|m| {
+                Decl::parse(rewritten, m.start(), m.end())
+                    .specs()
+                    .cloned()
+                    .collect::<Vec<_>>()
+            })
+            .collect();
+        let declared = declared_names(rewritten);
+        let mut taken: BTreeSet<String> = declared
+            .iter()
+            .cloned()
+            .chain(existing.iter().map(Spec::local_name))
+            .chain(qualifier_counts(rewritten).into_keys())
+            .collect();
+
+        let mut missing = Vec::new();
+        let mut requalify = Vec::new();
+        for name in introduced {
+            let path = &self.known[name];
+            let imported = existing.iter().find(|s| s.local_name() == *name);
+            let collides = match imported {
+                Some(spec) => spec.path != *path && self.explicit.contains(path),
+                None => declared.contains(name),
+            };
+            if collides {
+                let alias = match existing.iter().find(|s| s.path == *path) {
+                    Some(spec) => spec.local_name(),
+                    None => {
+                        let alias = alias_for(name, path, self.is_std(path), &taken);
+                        taken.insert(alias.clone());
+                        missing.push(Spec::aliased(path, &alias));
+                        alias
+                    }
+                };
+                requalify.push((name.clone(), alias));
+            } else if imported.is_none() && !before.contains_key(name) {
+                missing.push(Spec::new(path));
+            }
+        }
+
+        let rewritten = requalify
+            .iter()
+            .fold(rewritten.to_string(), |text, (name, alias)| {
+                requalify_changed_lines(original, &text, name, alias)
+            });
+        let rewritten = rewritten.as_str();
+        let before: BTreeSet<String> = before.into_keys().collect();
+        let after: BTreeSet<String> = qualifier_counts(rewritten).into_keys().collect();
+
+        let mut decls: Vec<Decl> = DECL
+            .find_iter(rewritten)
+            .map(|m| Decl::parse(rewritten, m.start(), m.end()))
+            .collect();
+        let imported: BTreeSet<String> = decls
+            .iter()
+            .flat_map(Decl::specs)
+            .map(Spec::local_name)
+            .collect();
+
+        let unused: BTreeSet<String> = imported
+            .iter()
+            .filter(|name| *name != "_" && *name != "." && before.contains(*name))
+            .filter(|name| !after.contains(*name))
+            .cloned()
+            .collect();
+
+        if unused.is_empty() && missing.is_empty() {
+            return rewritten.to_string();
+        }
+
+        let is_std = |path: &str| self.is_std(path);
+        let mut edits = EditSet::new();
+        let target = decls
+            .iter()
+            .position(|d| d.groups.iter().flatten().count() > 1)
+            .or(if decls.is_empty() { None } else { Some(0) });
+
+        for (index, decl) in decls.iter_mut().enumerate() {
+            let original_text = decl.render();
+            decl.remove(&unused);
+            if Some(index) == target {
+                for spec in &missing {
+                    decl.add(spec.clone(), &is_std);
+                }
+            }
+            let text = decl.render();
+            if text == original_text {
+                continue;
+            }
+            let end = if text.is_empty() && rewritten[decl.end..].starts_with('\n') {
+                decl.end + 1
+            } else {
+                decl.end
+            };
+            edits.push(Edit::replace(decl.start, end, text));
+        }
+
+        if target.is_none() && !missing.is_empty() {
+            let mut decl = Decl {
+                start: 0,
+                end: 0,
+                groups: Vec::new(),
+            };
+            for spec in missing {
+                decl.add(spec, &is_std);
+            }
+            let at = PACKAGE.find(rewritten).map_or(0, |m| m.end());
+            edits.push(Edit::insert(at, format!("\n{}", decl.render())));
+        }
+
+        edits
+            .apply(rewritten)
+            .unwrap_or_else(|_| rewritten.to_string())
+    }
+}
+
+impl Default for GoImports {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+fn parse_spec(line: &str) -> Option<Spec> {
+    let caps = SPEC.captures(line)?;
+    Some(Spec {
+        name: caps.name("name").map(|m| m.as_str().to_string()),
+        path: caps["path"].to_string(),
+        line: line.to_string(),
+    })
+}
+
+/// The package name `goimports` assumes for an import path.
+fn package_name(path: &str) -> String {
+    let mut elements = path.rsplit('/');
+    let mut last = elements.next().unwrap_or(path);
+    let is_version =
+        last.len() > 1 && last.starts_with('v') && last[1..].chars().all(|c| c.is_ascii_digit());
+    if is_version && let Some(prev) = elements.next() {
+        last = prev;
+    }
+    let last = last.strip_prefix("go-").unwrap_or(last);
+    last.split(['.', '-']).next().unwrap_or(last).to_string()
+}
+
+fn is_std(path: &str) -> bool {
+    !path.split('/').next().unwrap_or(path).contains('.')
+}
+
+/// Identifiers used as selector qualifiers (`pkg.Name`) outside comments
+/// and string literals, with the number of times each is used.
+fn qualifier_counts(source: &str) -> BTreeMap<String, usize> {
+    let code = code_only(source);
+    let mut counts = BTreeMap::new();
+    for caps in QUALIFIED.captures_iter(&code) {
+        *counts.entry(caps[1].to_string()).or_default() += 1;
+    }
+    counts
+}
+
+/// Names declared in the file: variables, constants, types, functions,
+/// parameters and receivers.
+fn declared_names(source: &str) -> BTreeSet<String> {
+    let code = code_only(source);
+    let mut names = BTreeSet::new();
+    for caps in SHORT_DECL.captures_iter(&code) {
+        names.extend(caps[1].split(',').map(|n| n.trim().to_string()));
+    }
+    for caps in NAMED_DECL.captures_iter(&code) {
+        names.insert(caps[1].to_string());
+    }
+    for caps in PARAMS.captures_iter(&code) {
+        for list in [caps.get(1), caps.get(2)].into_iter().flatten() {
+            let items: Vec<&str> = list.as_str().split(',').map(str::trim).collect();
+            // Parameters are either all named or all unnamed.
+            if items.iter().any(|item| item.contains(char::is_whitespace)) {
+                names.extend(
+                    items
+                        .iter()
+                        .filter_map(|item| item.split_whitespace().next())
+                        .map(str::to_string),
+                );
+            }
+        }
+    }
+    names
+}
+
+/// An unused alias for the package at `path`: `stdtime` for a standard
+/// library package, otherwise the parent path element plus the name
+/// (`acmepool`), with a numeric suffix if that is taken too.
+fn alias_for(name: &str, path: &str, std: bool, taken: &BTreeSet<String>) -> String {
+    let prefix = if std {
+        "std".to_string()
+    } else {
+        path.rsplit('/')
+            .filter(|e| {
+                package_name(e) != name && !(e.starts_with('v') && e[1..].parse::<u32>().is_ok())
+            })
+            .map(|e| {
+                e.chars()
+                    .filter(char::is_ascii_alphanumeric)
+                    .collect::<String>()
+            })
+            .find(|e| !e.is_empty())
+            .unwrap_or_else(|| "pkg".to_string())
+            .to_lowercase()
+    };
+    let base = format!("{}{}", prefix, name);
+    (1..)
+        .map(|n| {
+            if n == 1 {
+                base.clone()
+            } else {
+                format!("{}{}", base, n)
+            }
+        })
+        .find(|alias| !taken.contains(alias))
+        .unwrap()
+}
+
+/// Replace `name.` qualifiers with `alias.` on the lines the rewrite changed.
+fn requalify_changed_lines(original: &str, rewritten: &str, name: &str, alias: &str) -> String {
+    let pattern = Regex::new(&format!(r"(^|[^\w.]){}\.", regex::escape(name)))
+        .expect("invalid qualifier regex");
+    TextDiff::from_lines(original, rewritten)
+        .iter_all_changes()
+        .filter(|c| c.tag() != ChangeTag::Delete)
+        .map(|c| match c.tag() {
+            ChangeTag::Insert => pattern
+                .replace_all(c.value(), format!("${{1}}{}.", alias))
+                .into_owned(),
+            _ => c.value().to_string(),
+        })
+        .collect()
+}
+
+/// The import paths of `source`.
+pub(super) fn imported_paths(source: &str) -> BTreeSet<String> {
+    DECL.find_iter(source)
+        .flat_map(|m| {
+            Decl::parse(source, m.start(), m.end())
+                .specs()
+                .map(|spec| spec.path.clone())
+                .collect::<Vec<_>>()
+        })
+        .collect()
+}
+
+/// Blank out comments, string literals and rune literals, keeping newlines.
+pub(crate) fn code_only(source: &str) -> String {
+    let mut out = String::with_capacity(source.len());
+    let mut chars = source.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '/' if chars.peek() == Some(&'/') => {
+                while chars.peek().is_some_and(|&c| c != '\n') {
+                    chars.next();
+                }
+                out.push(' ');
+            }
+            '/' if chars.peek() == Some(&'*') => {
+                chars.next();
+                let mut prev = ' ';
+                for c in chars.by_ref() {
+                    if c == '\n' {
+                        out.push('\n');
+                    }
+                    if prev == '*' && c == '/' {
+                        break;
+                    }
+                    prev = c;
+                }
+                out.push(' ');
+            }
+            '"' | '\'' | '`' => {
+                let mut escaped = false;
+                for inner in chars.by_ref() {
+                    if inner == '\n' {
+                        out.push('\n');
+                    }
+                    if c != '`' && !escaped && inner == '\\' {
+                        escaped = true;
+                        continue;
+                    }
+                    if !escaped && inner == c {
+                        break;
+                    }
+                    escaped = false;
+                }
+                out.push_str("\"\"");
+            }
+            _ => out.push(c),
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_adds_missing_std_import_in_sorted_position() {
+        let original = "package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\n\t\"example.com/client\"\n)\n\nfunc main() {\n\tclient.Connect(os.Args[1])\n\tfmt.Println()\n}\n";
+        let rewritten = original.replace("os.Args[1])", "os.Args[1], 30*time.Second)");
+
+        let fixed = GoImports::new().fix(original, &rewritten);
+        assert!(fixed.starts_with(
+            "package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\t\"time\"\n\n\t\"example.com/client\"\n)\n"
+        ));
+    }
+
+    #[test]
+    fn test_removes_last_use_and_collapses_block() {
+        let original = "package main\n\nimport (\n\t\"fmt\"\n\tlegacy \"example.com/legacy/v2\"\n)\n\nfunc main() {\n\tlegacy.Init()\n\tfmt.Println(\"legacy.Init\")\n}\n";
+        let rewritten = original.replace("\tlegacy.Init()\n", "");
+
+        let fixed = GoImports::new().fix(original, &rewritten);
+        assert_eq!(
+            fixed,
+            "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"legacy.Init\")\n}\n"
+        );
+    }
+
+    #[test]
+    fn test_adds_first_import_and_rule_imports() {
+        let original = "package store\n\nfunc Open() {}\n";
+        let rewritten = "package store\n\nfunc Open() { _ = pool.New(time.Second) }\n";
+
+        let fixed = GoImports::new()
+            .with_import("github.com/acme/pool/v3")
+            .fix(original, rewritten);
+        assert_eq!(
+            fixed,
+            "package store\n\nimport (\n\t\"time\"\n\n\t\"github.com/acme/pool/v3\"\n)\n\nfunc Open() { _ = pool.New(time.Second) }\n"
+        );
+    }
+
+    #[test]
+    fn test_gopath_packages_are_not_std() {
+        let dir = tempfile::TempDir::new().unwrap();
+        std::fs::create_dir_all(dir.path().join("src/acme/billing/pool")).unwrap();
+        let original = "package store\n\nimport \"fmt\"\n\nfunc Open() { fmt.Println() }\n";
+        let rewritten = original.replace("fmt.Println()", "fmt.Println(pool.New())");
+
+        let fixed = GoImports::new()
+            .with_import("acme/billing/pool")
+            .with_gopath(GoPath::new([dir.path()]))
+            .fix(original, &rewritten);
+        assert!(fixed.contains("import (\n\t\"fmt\"\n\n\t\"acme/billing/pool\"\n)\n"));
+
+        let fixed = GoImports::new()
+            .with_import("acme/billing/pool")
+            .with_packages(["acme/billing/pool"])
+            .fix(original, &rewritten);
+        assert!(fixed.contains("import (\n\t\"fmt\"\n\n\t\"acme/billing/pool\"\n)\n"));
+    }
+
+    #[test]
+    fn test_untouched_when_nothing_changes() {
+        let source = "package main\n\nimport \"unused\"\n\nfunc main() {}\n";
+        assert_eq!(GoImports::new().fix(source, source), source);
+    }
+
+    #[test]
+    fn test_package_name() {
+        assert_eq!(package_name("net/http"), "http");
+        assert_eq!(package_name("github.com/acme/pool/v3"), "pool");
+        assert_eq!(package_name("gopkg.in/yaml.v3"), "yaml");
+        assert_eq!(package_name("github.com/go-redis/redis"), "redis");
+    }
+
+    #[test]
+    fn test_aliases_import_that_collides_with_local() {
+        let original =
+            "package main\n\nfunc wait(time int) {\n\tclient.Connect(addr)\n\t_ = time\n}\n";
+        let rewritten = original.replace("Connect(addr)", "Connect(addr, 30*time.Second)");
+
+        let fixed = GoImports::new().fix(original, &rewritten);
+        assert_eq!(
+            fixed,
+            "package main\n\nimport stdtime \"time\"\n\nfunc wait(time int) {\n\tclient.Connect(addr, 30*stdtime.Second)\n\t_ = time\n}\n"
+        );
+    }
+
+    #[test]
+    fn test_aliases_rule_import_that_collides_with_import() {
+        let original =
+            "package main\n\nimport \"math/rand\"\n\nfunc main() {\n\t_ = rand.Int()\n\tkey()\n}\n";
+        let rewritten = original.replace("key()", "rand.Read(buf)");
+
+        let fixed = GoImports::new()
+            .with_import("crypto/rand")
+            .fix(original, &rewritten);
+        assert!(fixed.contains("import (\n\tstdrand \"crypto/rand\"\n\t\"math/rand\"\n)\n"));
+        assert!(fixed.contains("\t_ = rand.Int()\n\tstdrand.Read(buf)\n"));
+    }
+
+    #[test]
+    fn test_declared_names() {
+        let names = declared_names(
+            "func (c *Client) Do(ctx context.Context, a, b int) {\n\tx, err := f()\n\tvar y = 1\n}\n",
+        );
+        let expected = ["a", "b", "c", "ctx", "err", "x", "y"];
+        assert_eq!(names, expected.iter().map(|n| n.to_string()).collect());
+    }
+}
@@ -0,0 +1,284 @@
+//! Class and method renames for Java.
+//!
+//! Java code refers to a class by its simple name once it is imported (or in
+//! its own package), and by its fully qualified name in imports, static
+//! imports and qualified references. A [`ClassRename`] follows all of these
+//! when a class is renamed or moved to another package; a [`MethodRename`]
+//! renames a method's calls, method references (`Client::connect`) and
+//! static imports where the receiver is known to be of its class.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::java::ClassRename;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rename = ClassRename::new("com.acme.Client", "com.acme.http.HttpClient");
+//! let transform = GuardedTransform::new(&rename.pattern(), "$0")?.rewriter(Arc::new(rename));
+//! let result = transform.apply(
+//!     "import com.acme.Client;\n\nClient c = new Client(url);\n",
+//!     "App.java".as_ref(),
+//! )?;
+//! assert_eq!(
+//!     result,
+//!     "import com.acme.http.HttpClient;\n\nHttpClient c = new HttpClient(url);\n"
+//! );
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// Splits a fully qualified name into its package and simple name.
+fn split_name(name: &str) -> (&str, &str) {
+    name.rsplit_once('.').unwrap_or(("", name))
+}
+
+/// Renames a class, or moves it to another package.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ClassRename {
+    old_name: String,
+    new_name: String,
+}
+
+impl ClassRename {
+    /// Rename the class `old_name` to `new_name`, both fully qualified
+    /// (`com.acme.Client`).
+    pub fn new(old_name: impl Into<String>, new_name: impl Into<String>) -> Self {
+        Self {
+            old_name: old_name.into(),
+            new_name: new_name.into(),
+        }
+    }
+
+    /// Regex matching the qualified name (captured as `qualified`) and
+    /// unqualified uses of the simple name (preceded by `pre`).
+    pub fn pattern(&self) -> String {
+        format!(
+            r"(?P<qualified>\b{})\b|(?P<pre>^|[^\w.$]){}\b",
+            regex::escape(&self.old_name),
+            regex::escape(split_name(&self.old_name).1)
+        )
+    }
+
+    /// Regex matching files that may refer to the class: files mentioning
+    /// its qualified name, importing its package with a wildcard, or in its
+    /// package.
+    pub fn file_pattern(&self) -> String {
+        let (package, _) = split_name(&self.old_name);
+        let package = regex::escape(package);
+        format!(
+            r"\b{}\b|\bimport\s+{}\.\*|(?m)^package\s+{}\s*;",
+            regex::escape(&self.old_name),
+            package,
+            package
+        )
+    }
+}
+
+impl Rewriter for ClassRename {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        if m.captures.contains_key("qualified") {
+            return Ok(Some(self.new_name.clone()));
+        }
+        let pre = m.captures.get("pre").map_or("", String::as_str);
+        Ok(Some(format!("{}{}", pre, split_name(&self.new_name).1)))
+    }
+}
+
+/// Renames a method of a class in the files that use the class.
+///
+/// A call or method reference is renamed when its receiver is the class
+/// itself, a new instance of it, or a variable declared with the class's
+/// type in the file. Unqualified calls, calls on `this` and `super`, and
+/// overriding declarations are renamed in subclasses of the class, in the
+/// class itself, and after a static import of the method. Calls on
+/// receivers of unknown type are left alone.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MethodRename {
+    class: String,
+    old_name: String,
+    new_name: String,
+}
+
+impl MethodRename {
+    /// Rename method `old_name` of `class` (fully qualified) to `new_name`.
+    pub fn new(
+        class: impl Into<String>,
+        old_name: impl Into<String>,
+        new_name: impl Into<String>,
+    ) -> Self {
+        Self {
+            class: class.into(),
+            old_name: old_name.into(),
+            new_name: new_name.into(),
+        }
+    }
+
+    /// Regex matching the method's name in static imports (after `pre`),
+    /// after a receiver (`sep`, a `.` or `::`), and in unqualified calls
+    /// (after `call`).
+    pub fn pattern(&self) -> String {
+        let method = regex::escape(&self.old_name);
+        format!(
+            r"(?P<pre>\bimport\s+static\s+{}\.){}\b|(?P<sep>(?:\.|::)\s*){}\b|(?P<call>^|[^\w$.:]){}\s*\(",
+            regex::escape(&self.class),
+            method,
+            method,
+            method
+        )
+    }
+
+    /// Returns true if `source` gives unqualified calls of the method to
+    /// the class: it declares or extends the class, or imports the method
+    /// statically.
+    fn unqualified(&self, source: &str) -> bool {
+        let simple = regex::escape(split_name(&self.class).1);
+        let pattern = format!(
+            r"\b(?:class|extends)\s+(?:[\w$]+\.)*{}\b|\bimport\s+static\s+{}\.(?:{}|\*)\s*;",
+            simple,
+            regex::escape(&self.class),
+            regex::escape(&self.old_name)
+        );
+        Regex::new(&pattern).is_ok_and(|re| re.is_match(source))
+    }
+
+    /// Returns true if `receiver`, the text before a `.` or `::`, is of the
+    /// class in `source`.
+    fn receives(&self, source: &str, receiver: &str) -> bool {
+        let simple = split_name(&self.class).1;
+        let escaped = regex::escape(simple);
+        let instance = format!(r"\bnew\s+(?:[\w$]+\.)*{}\s*\([^()]*\)$", escaped);
+        if Regex::new(&instance).is_ok_and(|re| re.is_match(receiver)) {
+            return true;
+        }
+        let start = receiver
+            .rfind(|c: char| !(c.is_alphanumeric() || c == '_' || c == '$' || c == '.'))
+            .map_or(0, |i| i + 1);
+        let receiver = &receiver[start..];
+        if receiver == simple || receiver == self.class {
+            return true;
+        }
+        if receiver == "this" || receiver == "super" {
+            return self.unqualified(source);
+        }
+        let variable = receiver.strip_prefix("this.").unwrap_or(receiver);
+        if variable.is_empty() || variable.contains('.') {
+            return false;
+        }
+        let variable = regex::escape(variable);
+        let declaration = format!(
+            r"\b{}(?:\s*<[^<>;]*>)?\s+{}\b|\bvar\s+{}\s*=\s*new\s+(?:[\w$]+\.)*{}\b",
+            escaped, variable, variable, escaped
+        );
+        Regex::new(&declaration).is_ok_and(|re| re.is_match(source))
+    }
+
+    /// Regex matching files that use the class.
+    pub fn file_pattern(&self) -> String {
+        format!(
+            r"\b{}\b|\b{}\b",
+            regex::escape(&self.class),
+            regex::escape(split_name(&self.class).1)
+        )
+    }
+}
+
+impl Rewriter for MethodRename {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        let capture = |name: &str| m.captures.get(name).map(String::as_str);
+        if let Some(pre) = capture("pre") {
+            return Ok(Some(format!("{}{}", pre, self.new_name)));
+        }
+        let source = &*m.source;
+        let renamed = if let Some(sep) = capture("sep") {
+            // A method reference, or a call rather than a field access
+            let end = m.start + m.text.len();
+            let call = sep.starts_with("::") || source[end..].trim_start().starts_with('(');
+            call && self.receives(source, source[..m.start].trim_end())
+        } else {
+            self.unqualified(source)
+        };
+        if !renamed {
+            return Ok(None);
+        }
+        let prefix = capture("sep").or(capture("call")).unwrap_or("");
+        let rest = &m.text[prefix.len() + self.old_name.len()..];
+        Ok(Some(format!("{}{}{}", prefix, self.new_name, rest)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{Guard, GuardedTransform, Transform};
+    use std::path::Path;
+    use std::sync::Arc;
+
+    fn rename_class(source: &str) -> String {
+        let rename = ClassRename::new("com.acme.Client", "com.acme.v2.AcmeClient");
+        GuardedTransform::new(&rename.pattern(), "$0")
+            .unwrap()
+            .when(Guard::new().file_contains(rename.file_pattern()))
+            .unwrap()
+            .rewriter(Arc::new(rename))
+            .apply(source, Path::new("App.java"))
+            .unwrap()
+    }
+
+    #[test]
+    fn test_class_rename() {
+        let source = "import com.acme.Client;\nimport static com.acme.Client.create;\n\nclass App {\n  Client c = create();\n  com.acme.Client.Builder b;\n  other.Client o;\n  HttpClient h;\n}\n";
+        assert_eq!(
+            rename_class(source),
+            "import com.acme.v2.AcmeClient;\nimport static com.acme.v2.AcmeClient.create;\n\nclass App {\n  AcmeClient c = create();\n  com.acme.v2.AcmeClient.Builder b;\n  other.Client o;\n  HttpClient h;\n}\n"
+        );
+
+        // A class of the same name from another package
+        let unrelated = "import org.other.Client;\n\nClient c;\n";
+        assert_eq!(rename_class(unrelated), unrelated);
+        let same_package = "package com.acme;\n\nclass Pool { Client c; }\n";
+        assert_eq!(
+            rename_class(same_package),
+            "package com.acme;\n\nclass Pool { AcmeClient c; }\n"
+        );
+    }
+
+    #[test]
+    fn test_method_rename() {
+        let rename = MethodRename::new("com.acme.Client", "connect", "open");
+        let transform = GuardedTransform::new(&rename.pattern(), "$0")
+            .unwrap()
+            .when(Guard::new().file_contains(rename.file_pattern()))
+            .unwrap()
+            .rewriter(Arc::new(rename));
+        let source = "import static com.acme.Client.connect;\n\nClient client = Client.create();\nvar a = connect(url);\nvar b = client.connect (url);\nhosts.forEach(Client::connect);\nint connected = 1;\n";
+        assert_eq!(
+            transform.apply(source, Path::new("App.java")).unwrap(),
+            "import static com.acme.Client.open;\n\nClient client = Client.create();\nvar a = open(url);\nvar b = client.open (url);\nhosts.forEach(Client::open);\nint connected = 1;\n"
+        );
+
+        // Receivers of other types, and a file with no static import
+        let mixed = "import com.acme.Client;\n\nvar c = new Client(url);\nc.connect(url);\nnew Client(url).connect(url);\nsocket.connect(addr);\nconnect(addr);\n";
+        assert_eq!(
+            transform.apply(mixed, Path::new("App.java")).unwrap(),
+            "import com.acme.Client;\n\nvar c = new Client(url);\nc.open(url);\nnew Client(url).open(url);\nsocket.connect(addr);\nconnect(addr);\n"
+        );
+
+        // A subclass overriding the method
+        let subclass = "class Pooled extends Client {\n  void connect(String url) { super.connect(url); }\n}\n";
+        assert_eq!(
+            transform.apply(subclass, Path::new("Pooled.java")).unwrap(),
+            "class Pooled extends Client {\n  void open(String url) { super.open(url); }\n}\n"
+        );
+
+        let unrelated = "socket.connect(addr);\n";
+        assert_eq!(
+            transform.apply(unrelated, Path::new("Net.java")).unwrap(),
+            unrelated
+        );
+    }
+}
@@ -0,0 +1,361 @@
+//! Module-aware rewrites for JavaScript and TypeScript.
+//!
+//! Clients of a JavaScript or TypeScript SDK refer to it through module
+//! specifiers, in ES module form (`import { connect } from '@acme/sdk'`,
+//! `export { connect } from '@acme/sdk'`, `import('@acme/sdk')`) or CommonJS
+//! form (`const { connect } = require('@acme/sdk')`). The patterns here
+//! recognize both, so upgrade rules can rename a module, rename one of its
+//! exports, or move an export to another module.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::javascript::MoveExport;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let moved = MoveExport::new("retry", "@acme/sdk", "@acme/sdk/retry");
+//! let transform = GuardedTransform::new(&moved.pattern(), "$0")?.rewriter(Arc::new(moved));
+//! let result = transform.apply(
+//!     "import { connect, retry } from '@acme/sdk';\n",
+//!     "client.ts".as_ref(),
+//! )?;
+//! assert_eq!(
+//!     result,
+//!     "import { connect } from '@acme/sdk';\nimport { retry } from '@acme/sdk/retry';\n"
+//! );
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use std::ops::Range;
+
+use super::call::{join_arguments, split_arguments};
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// Regex matching a reference to `module` (or one of its subpaths) as a
+/// module specifier. The text before the specifier is captured as `pre`,
+/// the subpath and closing quote as `post`.
+pub fn specifier_pattern(module: &str) -> String {
+    format!(
+        r#"(?P<pre>(?:\bfrom|\bimport|\bimport\s*\(|\brequire\s*\(|\.mock\s*\(|\bmodule)\s*['"]){}(?P<post>(?:/[^'"\n]*)?['"])"#,
+        regex::escape(module)
+    )
+}
+
+/// Regex matching files that import `module` itself, in either module form.
+pub fn imports_module(module: &str) -> String {
+    format!(
+        r#"(?:\bfrom|\bimport|\brequire\s*\()\s*\(?\s*['"]{}['"]"#,
+        regex::escape(module)
+    )
+}
+
+/// Moves a named export from one module to another, splitting the import
+/// statements of its clients.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MoveExport {
+    name: String,
+    from: String,
+    to: String,
+}
+
+impl MoveExport {
+    /// Move `name` from module `from` to module `to`.
+    pub fn new(name: impl Into<String>, from: impl Into<String>, to: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            from: from.into(),
+            to: to.into(),
+        }
+    }
+
+    /// Regex matching named imports and re-exports from the old module:
+    /// `import { ... } from`, `export { ... } from` and `const { ... } =
+    /// require(...)`.
+    pub fn pattern(&self) -> String {
+        let module = regex::escape(&self.from);
+        format!(
+            r#"(?:(?P<kw>import|export)(?P<type>[ \t]+type\b)?[ \t]*(?P<default>[\w$]+[ \t]*,[ \t]*)?\{{(?P<names>[^}}]*)\}}[ \t]*from[ \t]*(?P<quote>['"]){module}['"]|(?P<decl>const|let|var)[ \t]+\{{(?P<cjs_names>[^}}]*)\}}[ \t]*=[ \t]*require\([ \t]*(?P<cjs_quote>['"]){module}['"][ \t]*\))(?P<semi>;?)"#
+        )
+    }
+}
+
+impl Rewriter for MoveExport {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        let capture = |name: &str| m.captures.get(name).map_or("", String::as_str);
+        let commonjs = m.captures.contains_key("decl");
+        let (names, quote) = if commonjs {
+            (capture("cjs_names"), capture("cjs_quote"))
+        } else {
+            (capture("names"), capture("quote"))
+        };
+
+        let mut entries: Vec<String> = split_arguments(names)
+            .into_iter()
+            .map(str::to_string)
+            .collect();
+        let Some(index) = entries
+            .iter()
+            .position(|entry| imported_name(entry) == self.name)
+        else {
+            return Ok(None);
+        };
+        let entry = entries.remove(index);
+
+        let moved = if commonjs {
+            format!(
+                "{} {{ {} }} = require({q}{}{q}){}",
+                capture("decl"),
+                entry,
+                self.to,
+                capture("semi"),
+                q = quote
+            )
+        } else {
+            format!(
+                "{}{} {{ {} }} from {q}{}{q}{}",
+                capture("kw"),
+                capture("type"),
+                entry,
+                self.to,
+                capture("semi"),
+                q = quote
+            )
+        };
+        if entries.is_empty() && !m.captures.contains_key("default") {
+            return Ok(Some(moved));
+        }
+
+        let rest = if names.contains('\n') {
+            join_arguments(names, &entries)
+        } else {
+            let pad = if names.starts_with(' ') { " " } else { "" };
+            format!("{}{}{}", pad, entries.join(", "), pad)
+        };
+        let kept = m
+            .text
+            .replacen(&format!("{{{}}}", names), &format!("{{{}}}", rest), 1);
+        let kept = if entries.is_empty() {
+            // Only the default import is left: `import Sdk, {} from` -> `import Sdk from`
+            kept.replacen(&format!(", {{{}}}", rest), "", 1).replacen(
+                &format!(",{{{}}}", rest),
+                "",
+                1,
+            )
+        } else {
+            kept
+        };
+        Ok(Some(format!("{}\n{}", kept, moved)))
+    }
+}
+
+/// Renames an export of a module where clients refer to it: in imports and
+/// re-exports from the module, through the binding a named import of it
+/// gives, and as a member of the module (`sdk.createClient`,
+/// `require('@acme/sdk').createClient`). The same name from other modules,
+/// or as a member of other objects, is left alone.
+#[derive(Debug, Clone)]
+pub struct ExportRename {
+    old: String,
+    new: String,
+    /// Named imports and re-exports from the module.
+    named: Regex,
+    /// Bindings of the whole module: namespace, default and `require`.
+    namespaces: Regex,
+    /// Ends with a `require` of the module.
+    required: Regex,
+}
+
+impl ExportRename {
+    /// Rename the export `old` of `module` to `new`.
+    pub fn new(module: &str, old: impl Into<String>, new: impl Into<String>) -> Self {
+        let escaped = regex::escape(module);
+        let named = MoveExport::new("", module, "").pattern();
+        let namespaces = format!(
+            r#"import\s+(?:\*\s*as\s+)?(?P<esm>[\w$]+)\s*(?:,\s*\{{[^}}]*\}}\s*)?from\s*['"]{escaped}['"]|(?:const|let|var)\s+(?P<cjs>[\w$]+)\s*=\s*require\(\s*['"]{escaped}['"]\s*\)"#
+        );
+        let required = format!(r#"\brequire\(\s*['"]{escaped}['"]\s*\)$"#);
+        Self {
+            old: old.into(),
+            new: new.into(),
+            named: Regex::new(&named).expect("valid named import regex"),
+            namespaces: Regex::new(&namespaces).expect("valid namespace import regex"),
+            required: Regex::new(&required).expect("valid require regex"),
+        }
+    }
+
+    /// Regex matching the old name as an identifier, with the character
+    /// before it captured as `pre`.
+    pub fn pattern(&self) -> String {
+        format!(r"(?P<pre>^|[^\w$]){}\b", regex::escape(&self.old))
+    }
+
+    /// The import statements of the module in `source`, whether one binds
+    /// the old name itself, and the names bound to the whole module.
+    fn imports(&self, source: &str) -> (Vec<Range<usize>>, bool, Vec<String>) {
+        let mut statements = Vec::new();
+        let mut bound = false;
+        for caps in self.named.captures_iter(source) {
+            statements.push(caps.get(0).expect("group 0 always exists").range());
+            let names = caps.name("names").or(caps.name("cjs_names"));
+            bound |= names.is_some_and(|names| {
+                split_arguments(names.as_str()).into_iter().any(|entry| {
+                    let entry = entry.strip_prefix("type ").unwrap_or(entry).trim();
+                    entry == self.old
+                })
+            });
+        }
+        let namespaces = self
+            .namespaces
+            .captures_iter(source)
+            .filter_map(|caps| caps.name("esm").or(caps.name("cjs")))
+            .map(|m| m.as_str().to_string())
+            .collect();
+        (statements, bound, namespaces)
+    }
+}
+
+impl Rewriter for ExportRename {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        let pre = m.captures.get("pre").map_or("", String::as_str);
+        let start = m.start + pre.len();
+        let source = &*m.source;
+        let (statements, bound, namespaces) = self.imports(source);
+        let renamed = if let Some(statement) = statements.iter().find(|s| s.contains(&start)) {
+            // The exported name of an entry, not the alias it is bound to
+            let before = source[statement.start..start].trim_end();
+            let before = before.strip_suffix("type").unwrap_or(before).trim_end();
+            before.ends_with('{') || before.ends_with(',')
+        } else if pre == "." {
+            let object = source[..start - 1].trim_end();
+            let object = object.strip_suffix('?').unwrap_or(object);
+            let identifier = object
+                .rfind(|c: char| !(c.is_alphanumeric() || c == '_' || c == '$'))
+                .map_or(object, |i| &object[i + 1..]);
+            let member = object.len() > identifier.len()
+                && object[..object.len() - identifier.len()].ends_with('.');
+            (!member && namespaces.iter().any(|ns| ns == identifier))
+                || self.required.is_match(object)
+        } else {
+            bound
+        };
+        Ok(renamed.then(|| format!("{}{}", pre, self.new)))
+    }
+}
+
+/// The exported name an import entry refers to: `a` for `a`, `a as b`,
+/// `a: b` (CommonJS destructuring) and `type a`.
+fn imported_name(entry: &str) -> &str {
+    let entry = entry.strip_prefix("type ").unwrap_or(entry).trim_start();
+    let end = entry
+        .find(|c: char| c.is_whitespace() || c == ':' || c == '=')
+        .unwrap_or(entry.len());
+    &entry[..end]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use regex::Regex;
+    use std::path::Path;
+    use std::sync::Arc;
+
+    fn move_export(source: &str) -> String {
+        let moved = MoveExport::new("retry", "@acme/sdk", "@acme/sdk/retry");
+        GuardedTransform::new(&moved.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(moved))
+            .apply(source, Path::new("client.ts"))
+            .unwrap()
+    }
+
+    #[test]
+    fn test_move_export_esm() {
+        assert_eq!(
+            move_export("import { retry as r } from \"@acme/sdk\"\n"),
+            "import { retry as r } from \"@acme/sdk/retry\"\n"
+        );
+        assert_eq!(
+            move_export("import Sdk, { retry } from '@acme/sdk';\n"),
+            "import Sdk from '@acme/sdk';\nimport { retry } from '@acme/sdk/retry';\n"
+        );
+        assert_eq!(
+            move_export("export type { Options, retry } from '@acme/sdk';\n"),
+            "export type { Options } from '@acme/sdk';\nexport type { retry } from '@acme/sdk/retry';\n"
+        );
+        let source = "import { connect } from '@acme/sdk';\n";
+        assert_eq!(move_export(source), source);
+    }
+
+    #[test]
+    fn test_rename_export_is_scoped_to_the_module() {
+        let rename = ExportRename::new("@acme/sdk", "createClient", "connect");
+        let transform = GuardedTransform::new(&rename.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(rename));
+        let apply = |source: &str| transform.apply(source, Path::new("app.ts")).unwrap();
+
+        assert_eq!(
+            apply(
+                "import { createClient as mk } from '@acme/sdk';
+import { createClient } from 'other';
+mk(createClient(url));
+"
+            ),
+            "import { connect as mk } from '@acme/sdk';
+import { createClient } from 'other';
+mk(createClient(url));
+"
+        );
+        assert_eq!(
+            apply(
+                "import * as sdk from '@acme/sdk';
+sdk.createClient(url);
+http.createClient(url);
+require('@acme/sdk').createClient(url);
+"
+            ),
+            "import * as sdk from '@acme/sdk';
+sdk.connect(url);
+http.createClient(url);
+require('@acme/sdk').connect(url);
+"
+        );
+        assert_eq!(
+            apply(
+                "const { createClient } = require('@acme/sdk');
+export const c = createClient(url);
+"
+            ),
+            "const { connect } = require('@acme/sdk');
+export const c = connect(url);
+"
+        );
+    }
+
+    #[test]
+    fn test_move_export_commonjs() {
+        assert_eq!(
+            move_export("const {\n  connect,\n  retry: withRetry,\n} = require('@acme/sdk');\n"),
+            "const {\n  connect,\n} = require('@acme/sdk');\nconst { retry: withRetry } = require('@acme/sdk/retry');\n"
+        );
+    }
+
+    #[test]
+    fn test_specifier_pattern() {
+        let re = Regex::new(&specifier_pattern("@acme/sdk")).unwrap();
+        let source = "import { a } from '@acme/sdk/auth';\nconst b = require(\"@acme/sdk\");\nconst c = await import('@acme/sdk');\nimport d from '@acme/sdk-extra';\nconst e = '@acme/sdk';\n";
+        let result = re.replace_all(source, "${pre}@acme/client${post}");
+        assert_eq!(
+            result,
+            "import { a } from '@acme/client/auth';\nconst b = require(\"@acme/client\");\nconst c = await import('@acme/client');\nimport d from '@acme/sdk-extra';\nconst e = '@acme/sdk';\n"
+        );
+
+        let imports = Regex::new(&imports_module("@acme/sdk")).unwrap();
+        assert!(imports.is_match("const sdk = require('@acme/sdk')"));
+        assert!(!imports.is_match("import x from '@acme/sdk/auth'"));
+    }
+}
@@ -0,0 +1,306 @@
+//! Key renames in YAML, JSON and TOML configuration files.
+//!
+//! When a library renames a configuration option, the configuration files
+//! of its users have to follow. A [`KeyRename`] renames the key at a dotted
+//! path (`server.port`) to a new name, leaving its value, the other keys,
+//! comments and layout alone. The format follows the file's extension:
+//! `.yaml` and `.yml`, `.json`, or `.toml`, where the tables and dotted keys
+//! under a renamed table are renamed with it. Every occurrence is renamed:
+//! in each document of a YAML stream, and in each item of a list along the
+//! path (`servers.port` for `servers: [{port: 1}, {port: 2}]`).
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::keys::KeyRename;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rename = KeyRename::new("server.port", "listen_port");
+//! let transform = GuardedTransform::new(&rename.pattern(), "$0")?.rewriter(Arc::new(rename));
+//! let result = transform.apply(
+//!     "server:\n  host: db  # primary\n  port: 5432\nport: 1\n",
+//!     "config.yaml".as_ref(),
+//! )?;
+//! assert_eq!(result, "server:\n  host: db  # primary\n  listen_port: 5432\nport: 1\n");
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use std::path::Path;
+
+use super::position::{self, Step};
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// Renames the key at a dotted path.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct KeyRename {
+    key: String,
+    new_name: String,
+}
+
+impl KeyRename {
+    /// Rename the last segment of the dotted path `key` to `new_name`.
+    pub fn new(key: impl Into<String>, new_name: impl Into<String>) -> Self {
+        Self {
+            key: key.into(),
+            new_name: new_name.into(),
+        }
+    }
+
+    /// Regex matching a whole document mentioning the key's name, since
+    /// the path of a key depends on everything before it.
+    pub fn pattern(&self) -> String {
+        let name = self.key.rsplit('.').next().unwrap_or(&self.key);
+        format!(r"(?s)\A.*{}.*", regex::escape(name))
+    }
+
+    /// The renamed `source` of the file at `path`, or `None` if it has no
+    /// such key or is not YAML, JSON or TOML.
+    pub fn rename(&self, source: &str, path: &Path) -> Option<String> {
+        let segments: Vec<&str> = self.key.split('.').collect();
+        let extension = path.extension()?.to_str()?.to_ascii_lowercase();
+        let offsets = match extension.as_str() {
+            "json" if source.trim_start().starts_with('{') => key_offsets(source, &segments),
+            "yaml" | "yml" => yaml_documents(source)
+                .into_iter()
+                .flat_map(|(start, document)| {
+                    key_offsets(document, &segments)
+                        .into_iter()
+                        .map(move |offset| start + offset)
+                })
+                .collect(),
+            "toml" => toml_offsets(source, &segments),
+            _ => Vec::new(),
+        };
+        if offsets.is_empty() {
+            return None;
+        }
+
+        let name = segments[segments.len() - 1];
+        let mut renamed = source.to_string();
+        // Last first, so earlier offsets stay valid
+        for offset in offsets.into_iter().rev() {
+            renamed.replace_range(offset..offset + name.len(), &self.new_name);
+        }
+        Some(renamed)
+    }
+}
+
+impl Rewriter for KeyRename {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        Ok(self.rename(&m.text, &m.path))
+    }
+}
+
+/// The offsets of the key's name in a YAML or JSON document, following
+/// each item of the lists along the path.
+fn key_offsets<'a>(source: &str, segments: &[&'a str]) -> Vec<usize> {
+    let mut paths: Vec<Vec<Step<'a>>> = vec![Vec::new()];
+    for &segment in segments {
+        let step = |path: &[Step<'a>]| [path, &[Step::Key(segment)]].concat();
+        paths = paths
+            .into_iter()
+            .flat_map(|path| {
+                let keyed = step(&path);
+                if position::find(source, &keyed).is_some() {
+                    return vec![keyed];
+                }
+                // A list: the key in each of its items
+                (0..)
+                    .map(|index| [path.as_slice(), &[Step::Index(index)]].concat())
+                    .take_while(|item| position::find(source, item).is_some())
+                    .map(|item| step(&item))
+                    .filter(|keyed| position::find(source, keyed).is_some())
+                    .collect()
+            })
+            .collect();
+    }
+
+    let name = segments[segments.len() - 1];
+    let mut offsets: Vec<usize> = paths
+        .iter()
+        .filter_map(|path| {
+            let offset = position::find(source, path)?;
+            let quoted = source[offset..].starts_with(['"', '\'']);
+            let offset = offset + usize::from(quoted);
+            source[offset..].starts_with(name).then_some(offset)
+        })
+        .collect();
+    offsets.sort_unstable();
+    offsets
+}
+
+/// The documents of a YAML stream, separated by `---` lines, with their
+/// offsets.
+fn yaml_documents(source: &str) -> Vec<(usize, &str)> {
+    let mut documents = Vec::new();
+    let (mut start, mut offset) = (0, 0);
+    for line in source.split_inclusive('\n') {
+        if line.trim_end() == "---" {
+            documents.push((start, &source[start..offset]));
+            start = offset + line.len();
+        }
+        offset += line.len();
+    }
+    documents.push((start, &source[start..]));
+    documents
+}
+
+/// The offsets of the key's name in the table headers and keys of a TOML
+/// document whose path starts with `segments`.
+fn toml_offsets(source: &str, segments: &[&str]) -> Vec<usize> {
+    let renamed = segments.len() - 1;
+    let mut offsets = Vec::new();
+    let mut table: Vec<String> = Vec::new();
+    let mut start = 0;
+    for raw in source.split_inclusive('\n') {
+        start += raw.len();
+        let text = raw.trim_start();
+        let header = text.starts_with('[');
+        let (key, key_start) = if header {
+            let inner = text.trim_start_matches('[');
+            let Some(end) = inner.find(']') else {
+                continue;
+            };
+            (&inner[..end], start - inner.len())
+        } else if let Some((key, _)) = text.split_once('=')
+            && !text.starts_with('#')
+        {
+            (key, start - text.len())
+        } else {
+            continue;
+        };
+
+        let parts = key_segments(key);
+        if header {
+            table.clear();
+        }
+        let prefix = table.len();
+        let path: Vec<&str> = table
+            .iter()
+            .map(String::as_str)
+            .chain(parts.iter().map(|(name, _)| *name))
+            .collect();
+        if renamed >= prefix && path.starts_with(segments) {
+            offsets.push(key_start + parts[renamed - prefix].1);
+        }
+        if header {
+            table = parts.iter().map(|(name, _)| name.to_string()).collect();
+        }
+    }
+    offsets
+}
+
+/// The segments of a TOML key, without quotes, with their offsets in `key`.
+fn key_segments(key: &str) -> Vec<(&str, usize)> {
+    let mut segments = Vec::new();
+    let mut offset = 0;
+    for part in key.split('.') {
+        let name = part.trim();
+        let quoted = name.len() >= 2 && name.starts_with(['"', '\'']);
+        let at = offset + (part.len() - part.trim_start().len()) + usize::from(quoted);
+        let name = if quoted {
+            &name[1..name.len() - 1]
+        } else {
+            name
+        };
+        segments.push((name, at));
+        offset += part.len() + 1;
+    }
+    segments
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_rename_keys() {
+        let rename = KeyRename::new("server.port", "listen_port");
+        assert_eq!(
+            rename.rename(
+                "{\n  \"port\": 1,\n  \"server\": {\"host\": \"db\", \"port\": 5432}\n}\n",
+                Path::new("config.json")
+            ),
+            Some(
+                "{\n  \"port\": 1,\n  \"server\": {\"host\": \"db\", \"listen_port\": 5432}\n}\n"
+                    .to_string()
+            )
+        );
+        assert_eq!(
+            rename.rename(
+                "port = 1\n\n[server]\nhost = \"db\"\nport = 5432\n",
+                Path::new("config.toml")
+            ),
+            Some("port = 1\n\n[server]\nhost = \"db\"\nlisten_port = 5432\n".to_string())
+        );
+        assert_eq!(
+            rename.rename("server:\n  host: db\n", Path::new("config.yaml")),
+            None
+        );
+
+        // Every document, and every item of a list along the path
+        let yaml = "server:\n  port: 1\n---\nservers:\n  - host: a\n    port: 2\n  - port: 3\n";
+        assert_eq!(
+            KeyRename::new("server.port", "listen_port").rename(yaml, Path::new("app.yaml")),
+            Some(
+                "server:\n  listen_port: 1\n---\nservers:\n  - host: a\n    port: 2\n  - port: 3\n"
+                    .to_string()
+            )
+        );
+        assert_eq!(
+            KeyRename::new("servers.port", "listen_port").rename(yaml, Path::new("app.yaml")),
+            Some("server:\n  port: 1\n---\nservers:\n  - host: a\n    listen_port: 2\n  - listen_port: 3\n".to_string())
+        );
+        assert_eq!(
+            KeyRename::new("servers.port", "listen_port").rename(
+                "{\"servers\": [{\"port\": 1}, {\"host\": \"a\"}, {\"port\": 2}]}",
+                Path::new("app.json")
+            ),
+            Some(
+                "{\"servers\": [{\"listen_port\": 1}, {\"host\": \"a\"}, {\"listen_port\": 2}]}"
+                    .to_string()
+            )
+        );
+
+        // A key repeated in one document, and on one line
+        assert_eq!(
+            KeyRename::new("servers.port", "listen_port").rename(
+                "servers:\n  - port: 1\n  - port: 2\n  - port: 3\n",
+                Path::new("app.yaml")
+            ),
+            Some(
+                "servers:\n  - listen_port: 1\n  - listen_port: 2\n  - listen_port: 3\n"
+                    .to_string()
+            )
+        );
+        assert_eq!(
+            KeyRename::new("server.port", "listen_port").rename(
+                "{\"server\": {\"port\": 1}, \"client\": {\"server\": {\"port\": 2}}}",
+                Path::new("app.json")
+            ),
+            Some(
+                "{\"server\": {\"listen_port\": 1}, \"client\": {\"server\": {\"port\": 2}}}"
+                    .to_string()
+            )
+        );
+        assert_eq!(
+            KeyRename::new("server.port", "listen_port").rename(
+                "server:\n  port: 1\n---\nserver:\n  port: 2\n",
+                Path::new("app.yaml")
+            ),
+            Some("server:\n  listen_port: 1\n---\nserver:\n  listen_port: 2\n".to_string())
+        );
+
+        // Tables and dotted keys under a renamed table follow it
+        let table = KeyRename::new("server", "http");
+        assert_eq!(
+            table.rename(
+                "server.port = 1\n[server.tls]\ncert = \"a\"\n[client]\nserver = 2\n",
+                Path::new("config.toml")
+            ),
+            Some("http.port = 1\n[http.tls]\ncert = \"a\"\n[client]\nserver = 2\n".to_string())
+        );
+    }
+}
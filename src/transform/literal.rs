@@ -0,0 +1,389 @@
+//! Composite literal rewrites that understand field lists.
+//!
+//! When a struct gains, loses or renames fields (a v2 `Config` gaining
+//! `Port`, `User` gaining `Email`), every literal of the type has to follow.
+//! A [`LiteralRewrite`] edits the field list of each `Type{...}` literal:
+//! renaming keys, adding missing fields with a default value or a
+//! [`TODO_MARKER`](crate::runner::TODO_MARKER) comment, and converting
+//! positional literals (`Config{"db", 5}`) to keyed form, so a change in
+//! field order cannot silently assign values to the wrong fields.
+//!
+//! Elements are split at top-level commas, so nested literals, calls and
+//! strings are kept intact, and literals spanning several lines keep their
+//! layout. Comments are kept and do not count as elements, and a field
+//! whose TODO marker is already there is not marked again, so rewriting a
+//! literal twice changes nothing. Element literals of slices and maps (`[]Config{...}`), function
+//! bodies after a return type (`func f() Config {`) and Rust item
+//! definitions (`struct Config {`, `impl Config {`) are left alone.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::literal::{LiteralField, LiteralRewrite};
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rewrite = LiteralRewrite::new("pool.Config")
+//!     .fields(vec!["Host".to_string(), "Timeout".to_string()])
+//!     .rename_field("Timeout", "DialTimeout")
+//!     .add_field(LiteralField::new("Port", "5432"));
+//! let transform = GuardedTransform::new(&rewrite.pattern(), "$0")?.rewriter(Arc::new(rewrite));
+//! let result = transform.apply("c := pool.Config{\"db\", 5}\n", "main.go".as_ref())?;
+//! assert_eq!(result, "c := pool.Config{Host: \"db\", DialTimeout: 5, Port: 5432}\n");
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+use super::call::{join_arguments, split_arguments};
+use super::structural;
+use super::values::is_identifier;
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+use crate::runner::TODO_MARKER;
+
+/// A field to add to each literal.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct LiteralField {
+    /// Name of the field.
+    pub name: String,
+
+    /// Source text of its value. Without one, a TODO marker asks for it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub value: Option<String>,
+}
+
+impl LiteralField {
+    /// A field set to `value`.
+    pub fn new(name: impl Into<String>, value: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            value: Some(value.into()),
+        }
+    }
+
+    /// A field left for the author to set, marked with a TODO comment.
+    pub fn todo(name: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            value: None,
+        }
+    }
+}
+
+/// Renames, adds and keys the fields of a struct type's literals.
+///
+/// Edits are applied in this order: keying positional literals, field
+/// renames, then additions.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct LiteralRewrite {
+    type_name: String,
+    fields: Vec<String>,
+    renames: BTreeMap<String, String>,
+    add: Vec<LiteralField>,
+}
+
+impl LiteralRewrite {
+    /// Rewrite literals of `type_name`, which may be qualified
+    /// (`pool.Config`).
+    pub fn new(type_name: impl Into<String>) -> Self {
+        Self {
+            type_name: type_name.into(),
+            ..Default::default()
+        }
+    }
+
+    /// The type's fields in their declared order before the upgrade.
+    /// Positional literals with one value per field are converted to keyed
+    /// form; without the fields, positional literals are left alone.
+    pub fn fields(mut self, fields: Vec<String>) -> Self {
+        self.fields = fields;
+        self
+    }
+
+    /// Rename a field.
+    pub fn rename_field(mut self, from: impl Into<String>, to: impl Into<String>) -> Self {
+        self.renames.insert(from.into(), to.into());
+        self
+    }
+
+    /// Add a field, unless the literal already sets it.
+    pub fn add_field(mut self, field: LiteralField) -> Self {
+        self.add.push(field);
+        self
+    }
+
+    /// Regex matching literals of the type, with the field list captured as
+    /// `fields`. Where the type follows `]`, `)` or an item keyword, only the
+    /// opening brace is matched, with the prefix captured as `skip`, so
+    /// literals inside the braces are still found.
+    pub fn pattern(&self) -> String {
+        let type_name = regex::escape(&self.type_name);
+        format!(
+            r"(?P<skip>[\])]\s*|\b(?:struct|enum|union|impl|for|type)\s+)\b{t}\s*\{{|\b{t}\s*{fields}",
+            t = type_name,
+            fields = structural::field_list()
+        )
+    }
+
+    /// Rewrite the field list `fields`, or return `None` if the literal is
+    /// left alone.
+    fn rewrite_fields(&self, fields: &str) -> Option<String> {
+        let elements = split_arguments(fields);
+        let codes: Vec<String> = elements.iter().map(|e| without_comments(e)).collect();
+        // Comment-only elements, such as TODO markers, have no key
+        let keys: Vec<Option<&str>> = codes
+            .iter()
+            .filter(|code| !code.is_empty())
+            .map(|code| field_key(code))
+            .collect();
+        let mut changed = false;
+        let mut keyed: Vec<(String, String)> = if keys.iter().all(Option::is_some) {
+            codes
+                .iter()
+                .zip(&elements)
+                .map(|(code, element)| {
+                    let key = field_key(code).unwrap_or_default();
+                    (key.to_string(), element.to_string())
+                })
+                .collect()
+        } else if keys.iter().all(Option::is_none)
+            && keys.len() == self.fields.len()
+            && !codes.iter().any(|code| code.starts_with(".."))
+        {
+            changed = true;
+            let mut names = self.fields.iter();
+            codes
+                .iter()
+                .zip(&elements)
+                .map(|(code, element)| match code.is_empty() {
+                    true => (String::new(), element.to_string()),
+                    false => {
+                        let name = names.next().cloned().unwrap_or_default();
+                        let at = code_start(element);
+                        let element = format!("{}{}: {}", &element[..at], name, &element[at..]);
+                        (name, element)
+                    }
+                })
+                .collect()
+        } else {
+            return None;
+        };
+
+        for (name, element) in &mut keyed {
+            if let Some(new) = self.renames.get(name.as_str()) {
+                let at = code_start(element);
+                *element = format!("{}{}{}", &element[..at], new, &element[at + name.len()..]);
+                *name = new.clone();
+                changed = true;
+            }
+        }
+
+        let mut todos = Vec::new();
+        for field in &self.add {
+            if marked(fields, &field.name) || keyed.iter().any(|(name, _)| *name == field.name) {
+                continue;
+            }
+            match &field.value {
+                Some(value) => {
+                    keyed.push((field.name.clone(), format!("{}: {}", field.name, value)))
+                }
+                None => todos.push(format!("{}: set {}", TODO_MARKER, field.name)),
+            }
+            changed = true;
+        }
+        if !changed {
+            return None;
+        }
+
+        let elements: Vec<String> = keyed.into_iter().map(|(_, element)| element).collect();
+        let mut joined = join_arguments(fields, &elements);
+        if todos.is_empty() {
+            return Some(joined);
+        }
+        if fields.contains('\n') {
+            // One comment line per field, before the closing brace
+            let leading = &fields[..fields.len() - fields.trim_start().len()];
+            let trailing = joined[joined.trim_end().len()..].to_string();
+            joined.truncate(joined.trim_end().len());
+            for todo in &todos {
+                joined.push_str(&format!("{}// {}", leading, todo));
+            }
+            joined.push_str(&trailing);
+        } else {
+            for todo in &todos {
+                if !joined.is_empty() {
+                    joined.push(' ');
+                }
+                joined.push_str(&format!("/* {} */", todo));
+            }
+        }
+        Some(joined)
+    }
+}
+
+impl Rewriter for LiteralRewrite {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        if m.captures.contains_key("skip") {
+            return Ok(None);
+        }
+        let fields = m.captures.get("fields").map_or("", String::as_str);
+        let Some(rewritten) = self.rewrite_fields(fields) else {
+            return Ok(None);
+        };
+        let open = m.text.find('{').unwrap_or(m.text.len());
+        Ok(Some(format!("{}{{{}}}", &m.text[..open], rewritten)))
+    }
+}
+
+/// How TODO markers start, also once tagged with their rule.
+const TODO_MARKER_PREFIX: &str = "TODO(refactor";
+
+/// Whether `fields` has a TODO marker asking to set `name`.
+fn marked(fields: &str, name: &str) -> bool {
+    let set = format!("): set {}", name);
+    fields.match_indices(TODO_MARKER_PREFIX).any(|(at, _)| {
+        let rest = &fields[at..];
+        rest.find(')').is_some_and(|close| {
+            rest[close..].starts_with(&set)
+                && !rest[close + set.len()..].starts_with(|c: char| c.is_alphanumeric() || c == '_')
+        })
+    })
+}
+
+/// Offset of the code in `element`, after leading space and comments.
+fn code_start(element: &str) -> usize {
+    let mut rest = element;
+    loop {
+        let trimmed = rest.trim_start();
+        rest = if let Some(comment) = trimmed.strip_prefix("//") {
+            comment.find('\n').map_or("", |end| &comment[end..])
+        } else if let Some(comment) = trimmed.strip_prefix("/*") {
+            comment.find("*/").map_or("", |end| &comment[end + 2..])
+        } else {
+            return element.len() - trimmed.len();
+        };
+    }
+}
+
+/// `element` without its comments, trimmed. Strings are kept intact.
+fn without_comments(element: &str) -> String {
+    let mut code = String::new();
+    let mut chars = element.char_indices().peekable();
+    let mut quote: Option<char> = None;
+    let mut skip_to = 0;
+    while let Some((i, c)) = chars.next() {
+        if i < skip_to {
+            continue;
+        }
+        if let Some(q) = quote {
+            code.push(c);
+            if c == '\\' && q != '`' {
+                if let Some((_, escaped)) = chars.next() {
+                    code.push(escaped);
+                }
+            } else if c == q {
+                quote = None;
+            }
+            continue;
+        }
+        let rest = &element[i..];
+        if rest.starts_with("//") {
+            skip_to = rest.find('\n').map_or(element.len(), |end| i + end);
+        } else if rest.starts_with("/*") {
+            skip_to = rest.find("*/").map_or(element.len(), |end| i + end + 2);
+        } else {
+            if matches!(c, '"' | '\'' | '`') {
+                quote = Some(c);
+            }
+            code.push(c);
+        }
+    }
+    code.trim().to_string()
+}
+
+/// The key of a keyed element (`Name: value`, but not `a::b`).
+fn field_key(element: &str) -> Option<&str> {
+    let (key, value) = element.split_once(':')?;
+    let key = key.trim_end();
+    (is_identifier(key) && !value.starts_with(':')).then_some(key)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use std::path::Path;
+    use std::sync::Arc;
+
+    fn apply(rewrite: LiteralRewrite, source: &str) -> String {
+        GuardedTransform::new(&rewrite.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(rewrite))
+            .apply(source, Path::new("main.go"))
+            .unwrap()
+    }
+
+    #[test]
+    fn test_keyed_literals() {
+        let rewrite = LiteralRewrite::new("User")
+            .rename_field("Name", "FullName")
+            .add_field(LiteralField::new("Active", "true"))
+            .add_field(LiteralField::todo("Email"));
+        assert_eq!(
+            apply(
+                rewrite.clone(),
+                "u := &User{Name: \"ann\", Active: false}\n"
+            ),
+            "u := &User{FullName: \"ann\", Active: false /* TODO(refactor): set Email */}\n"
+        );
+        assert_eq!(
+            apply(
+                rewrite.clone(),
+                "u := User{\n\tName: name,\n\tAge:  3,\n}\n"
+            ),
+            "u := User{\n\tFullName: name,\n\tAge:  3,\n\tActive: true,\n\t// TODO(refactor): set Email\n}\n"
+        );
+        assert_eq!(
+            apply(
+                rewrite.clone(),
+                "func NewUser() User {\n\treturn User{Active: true}\n}\nusers := []User{{Name: n}}\n"
+            ),
+            "func NewUser() User {\n\treturn User{Active: true /* TODO(refactor): set Email */}\n}\nusers := []User{{Name: n}}\n"
+        );
+
+        // Rewriting again changes nothing, and marked literals still
+        // have their keys renamed
+        for done in [
+            "u := &User{FullName: \"ann\", Active: false /* TODO(refactor): set Email */}\n",
+            "u := User{\n\tFullName: name,\n\tAge:  3,\n\tActive: true,\n\t// TODO(refactor-dsl:add-email:1b4e28ba-2fa1-41d2-883f-0016d3cca427): set Email\n}\n",
+        ] {
+            assert_eq!(apply(rewrite.clone(), done), done);
+        }
+        assert_eq!(
+            apply(
+                rewrite,
+                "u := User{\n\t// The name\n\tName: \"a//b\",\n\tActive: true,\n\t// TODO(refactor): set Email\n}\n"
+            ),
+            "u := User{\n\t// The name\n\tFullName: \"a//b\",\n\tActive: true,\n\t// TODO(refactor): set Email\n}\n"
+        );
+    }
+
+    #[test]
+    fn test_positional_literals() {
+        let rewrite = LiteralRewrite::new("Config")
+            .fields(vec!["Host".to_string(), "Timeout".to_string()])
+            .add_field(LiteralField::new("Port", "8080"));
+        assert_eq!(
+            apply(rewrite.clone(), "c := pool.Config{host, time.Second}\n"),
+            "c := pool.Config{Host: host, Timeout: time.Second, Port: 8080}\n"
+        );
+        assert_eq!(
+            apply(rewrite.clone(), "c := Config{}\n"),
+            "c := Config{Port: 8080}\n"
+        );
+        // Too few values to know which field each one sets
+        assert_eq!(apply(rewrite, "c := Config{host}\n"), "c := Config{host}\n");
+    }
+}
@@ -0,0 +1,194 @@
+//! Updating Markdown docs after symbols are renamed.
+//!
+//! A migration leaves a client's own docs and ADRs mentioning the old names.
+//! [`DocReferences`] rewrites them from a [`SymbolMap`]: inside inline code
+//! spans, fenced code blocks and link destinations (API reference anchors
+//! such as `pool#Dial` or `struct.Client.html`), but never in prose, where a
+//! symbol's name may just be a word.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::analyzer::{SymbolKind, SymbolMap, SymbolMapping};
+//! use refactor::transform::Transform;
+//! use refactor::transform::markdown::DocReferences;
+//!
+//! let mut map = SymbolMap::new();
+//! map.insert(SymbolMapping::new(SymbolKind::Function, "pool.Dial", "pool.Connect"));
+//! let docs = DocReferences::new(&map)?;
+//! let result = docs.apply(
+//!     "Dial the pool with [`pool.Dial`](https://pkg.go.dev/acme/pool#Dial).\n",
+//!     "README.md".as_ref(),
+//! )?;
+//! assert_eq!(
+//!     result,
+//!     "Dial the pool with [`pool.Connect`](https://pkg.go.dev/acme/pool#Connect).\n"
+//! );
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::{Captures, Regex};
+use std::path::Path;
+use std::sync::LazyLock;
+
+use super::Transform;
+use crate::analyzer::{SymbolKind, SymbolMap};
+use crate::error::Result;
+
+/// File extensions treated as Markdown.
+pub const EXTENSIONS: &[&str] = &["md", "markdown", "mdx"];
+
+/// Inline code spans, link destinations and reference link definitions.
+static REFERENCES: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?m)`[^`\n]+`|\]\([^)\s]+|^[ \t]*\[[^\]\n]+\]:[ \t]*\S+")
+        .expect("invalid references regex")
+});
+
+/// Opening or closing line of a fenced code block.
+static FENCE: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"^[ \t]*(```|~~~)").expect("invalid fence regex"));
+
+/// Rewrites symbol references in Markdown.
+#[derive(Debug, Clone)]
+pub struct DocReferences {
+    renames: Vec<(Regex, String)>,
+}
+
+impl DocReferences {
+    /// Rewrite the renamed symbols of `map`. Qualified names are replaced
+    /// first, then their last segments, so both `pool.Dial` and `Dial`
+    /// are updated. Symbols that only moved are left alone.
+    pub fn new(map: &SymbolMap) -> Result<Self> {
+        let mut full = Vec::new();
+        let mut last = Vec::new();
+        for mapping in &map.symbols {
+            if mapping.old == mapping.new {
+                continue;
+            }
+            full.push((mapping.old.as_str(), mapping.new.as_str()));
+            let old = last_segment(&mapping.old);
+            let new = last_segment(&mapping.new);
+            if mapping.kind != SymbolKind::Module && old != mapping.old && old != new {
+                last.push((old, new));
+            }
+        }
+
+        let renames = full
+            .into_iter()
+            .chain(last)
+            .map(|(old, new)| {
+                let pattern = format!(r"(^|[^\w$]){}\b", regex::escape(old));
+                Ok((Regex::new(&pattern)?, format!("${{1}}{}", new)))
+            })
+            .collect::<Result<_>>()?;
+        Ok(Self { renames })
+    }
+
+    /// Returns true if there is nothing to rewrite.
+    pub fn is_empty(&self) -> bool {
+        self.renames.is_empty()
+    }
+
+    fn rename(&self, text: &str) -> String {
+        self.renames
+            .iter()
+            .fold(text.to_string(), |text, (pattern, replacement)| {
+                pattern
+                    .replace_all(&text, replacement.as_str())
+                    .into_owned()
+            })
+    }
+
+    /// Rewrite the code spans and links of text outside code blocks.
+    fn rewrite_prose(&self, text: &str) -> String {
+        REFERENCES
+            .replace_all(text, |caps: &Captures<'_>| self.rename(&caps[0]))
+            .into_owned()
+    }
+}
+
+fn last_segment(name: &str) -> &str {
+    name.rsplit(['.', ':', '/', '#']).next().unwrap_or(name)
+}
+
+impl Transform for DocReferences {
+    fn apply(&self, source: &str, _path: &Path) -> Result<String> {
+        let mut result = String::with_capacity(source.len());
+        let mut fence: Option<&str> = None;
+        let mut prose = String::new();
+
+        for line in source.split_inclusive('\n') {
+            let marker = FENCE
+                .captures(line)
+                .map(|caps| caps.get(1).unwrap().as_str());
+            match (fence, marker) {
+                (None, Some(marker)) => {
+                    result.push_str(&self.rewrite_prose(&prose));
+                    prose.clear();
+                    result.push_str(line);
+                    fence = Some(marker);
+                }
+                (Some(open), Some(marker)) if open == marker => {
+                    result.push_str(line);
+                    fence = None;
+                }
+                (Some(_), _) => result.push_str(&self.rename(line)),
+                (None, None) => prose.push_str(line),
+            }
+        }
+        result.push_str(&self.rewrite_prose(&prose));
+        Ok(result)
+    }
+
+    fn describe(&self) -> String {
+        format!("Rewrite {} symbol reference(s) in docs", self.renames.len())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::SymbolMapping;
+
+    fn docs() -> DocReferences {
+        let mut map = SymbolMap::new();
+        map.insert(SymbolMapping::new(
+            SymbolKind::Function,
+            "pool.Dial",
+            "pool.Connect",
+        ));
+        map.insert(SymbolMapping::new(
+            SymbolKind::Type,
+            "acme::client::Client",
+            "acme::HttpClient",
+        ));
+        map.insert(
+            SymbolMapping::new(SymbolKind::Symbol, "retry", "retry")
+                .scope("@acme/sdk")
+                .new_scope("@acme/sdk/retry"),
+        );
+        DocReferences::new(&map).unwrap()
+    }
+
+    #[test]
+    fn test_rewrites_code_and_links_but_not_prose() {
+        let source = "# Dial\n\nDial once with `Client::new()`, see [Dial][dial].\n\n```go\nc, err := pool.Dial(addr)\nRedial()\n```\n\n[dial]: https://pkg.go.dev/example.com/acme/pool#Dial\n";
+        assert_eq!(
+            docs()
+                .apply(source, Path::new("docs/adr/0003-pooling.md"))
+                .unwrap(),
+            "# Dial\n\nDial once with `HttpClient::new()`, see [Dial][dial].\n\n```go\nc, err := pool.Connect(addr)\nRedial()\n```\n\n[dial]: https://pkg.go.dev/example.com/acme/pool#Connect\n"
+        );
+    }
+
+    #[test]
+    fn test_fences_must_match() {
+        let source = "~~~\n```\nDial()\n~~~\n`Dial`\n";
+        assert_eq!(
+            docs().apply(source, Path::new("README.md")).unwrap(),
+            "~~~\n```\nConnect()\n~~~\n`Connect`\n"
+        );
+        assert!(!docs().is_empty());
+        assert!(DocReferences::new(&SymbolMap::new()).unwrap().is_empty());
+    }
+}
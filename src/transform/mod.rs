@@ -1,14 +1,54 @@
 //! Transform DSL for code refactoring operations.
 
 pub mod ast;
+pub mod call;
+pub mod cleanup;
+pub mod context;
+pub mod edit;
 pub mod file;
+pub mod go;
+pub mod guard;
+pub mod imports;
+pub mod java;
+pub mod javascript;
+pub mod keys;
+pub mod literal;
+pub mod markdown;
+pub(crate) mod position;
+pub mod reference;
+pub mod removed;
+pub mod rust;
+pub mod strings;
+pub mod structural;
+pub mod symbol;
+pub mod tags;
 pub mod text;
+pub mod values;
 
 pub use ast::AstTransform;
+pub use call::{CallArgument, CallRewrite};
+pub use cleanup::{Cleanup, CleanupKind};
+pub use context::ContextInjection;
+pub use edit::{Edit, EditSet};
 pub use file::FileTransform;
+pub use go::TypeRename;
+pub use guard::{Guard, GuardedTransform, Site, splice};
+pub use imports::GoImports;
+pub use java::{ClassRename, MethodRename};
+pub use javascript::{ExportRename, MoveExport};
+pub use keys::KeyRename;
+pub use literal::{LiteralField, LiteralRewrite};
+pub use reference::FunctionValues;
+pub use removed::{Removal, RemovedCall};
+pub use rust::{PathRename, VariantRename};
+pub use strings::StringRewrite;
+pub use symbol::SymbolRename;
+pub use tags::TagRewrite;
 pub use text::TextTransform;
+pub use values::ValueMap;
 
 use crate::error::Result;
+use similar::{ChangeTag, TextDiff};
 use std::path::Path;
 
 /// A code transformation that can be applied to source files.
@@ -103,6 +143,34 @@ impl FileChange {
         self.original != self.transformed
     }
 
+    /// The change as line-granular edits against the original content, in
+    /// order. Applying them to `original` with an [`EditSet`] yields
+    /// `transformed`.
+    pub fn edits(&self) -> Vec<Edit> {
+        let mut edits = Vec::new();
+        let mut offset = 0;
+        let mut pending: Option<Edit> = None;
+        for change in TextDiff::from_lines(&self.original, &self.transformed).iter_all_changes() {
+            let len = change.value().len();
+            match change.tag() {
+                ChangeTag::Equal => {
+                    edits.extend(pending.take());
+                    offset += len;
+                }
+                ChangeTag::Delete => {
+                    pending.get_or_insert_with(|| Edit::insert(offset, "")).end += len;
+                    offset += len;
+                }
+                ChangeTag::Insert => {
+                    let edit = pending.get_or_insert_with(|| Edit::insert(offset, ""));
+                    edit.text.push_str(change.value());
+                }
+            }
+        }
+        edits.extend(pending);
+        edits
+    }
+
     /// Writes the transformed content to disk.
     pub fn apply(&self) -> Result<()> {
         if self.is_modified() {
@@ -0,0 +1,283 @@
+//! Positions of keys and list items in YAML and JSON documents.
+//!
+//! Rule files and configuration files are parsed into values without
+//! positions, so values are located afterwards by walking the text along
+//! the path of the value: the
+//! keys and list indices leading to it. JSON is walked token by token; YAML
+//! by indentation, which covers the block style rule files are written in.
+//! A path that cannot be followed to the end is located at its deepest
+//! step found.
+
+/// One step of the path to a value.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum Step<'a> {
+    /// A key of a mapping.
+    Key(&'a str),
+    /// An item of a list.
+    Index(usize),
+}
+
+/// The 1-based line and column of the value at `path` in `source`.
+pub(crate) fn locate(source: &str, path: &[Step<'_>]) -> (usize, usize) {
+    line_column(source, walk(source, path).0)
+}
+
+/// The byte offset of the value at `path` in `source` (of its key, for a
+/// key), or `None` if the path cannot be followed to the end.
+pub(crate) fn find(source: &str, path: &[Step<'_>]) -> Option<usize> {
+    let (offset, found) = walk(source, path);
+    found.then_some(offset)
+}
+
+/// The offset of the deepest step of `path` found, and whether that is the
+/// last one.
+fn walk(source: &str, path: &[Step<'_>]) -> (usize, bool) {
+    if source.trim_start().starts_with('{') {
+        json(source, path)
+    } else {
+        yaml(source, path)
+    }
+}
+
+/// The 1-based line and column of byte `offset` in `source`.
+pub(crate) fn line_column(source: &str, offset: usize) -> (usize, usize) {
+    let before = &source[..offset.min(source.len())];
+    let line_start = before.rfind('\n').map_or(0, |i| i + 1);
+    (
+        before.matches('\n').count() + 1,
+        before[line_start..].chars().count() + 1,
+    )
+}
+
+fn json(source: &str, path: &[Step<'_>]) -> (usize, bool) {
+    let mut cursor = Cursor {
+        bytes: source.as_bytes(),
+        at: 0,
+    };
+    cursor.skip_space();
+    let mut found = cursor.at;
+    for step in path {
+        let located = match (step, cursor.peek()) {
+            (Step::Key(key), Some(b'{')) => cursor.find_key(key),
+            (Step::Index(index), Some(b'[')) => cursor.find_item(*index),
+            _ => None,
+        };
+        match located {
+            Some(at) => found = at,
+            None => return (found, false),
+        }
+    }
+    (found, true)
+}
+
+/// A position in JSON text.
+struct Cursor<'a> {
+    bytes: &'a [u8],
+    at: usize,
+}
+
+impl Cursor<'_> {
+    fn peek(&self) -> Option<u8> {
+        self.bytes.get(self.at).copied()
+    }
+
+    fn skip_space(&mut self) {
+        while self.peek().is_some_and(|b| b.is_ascii_whitespace()) {
+            self.at += 1;
+        }
+    }
+
+    /// Skip the value at the cursor, up to the `,` or closing bracket
+    /// after it.
+    fn skip_value(&mut self) {
+        let mut depth = 0usize;
+        while let Some(b) = self.peek() {
+            match b {
+                b'"' => self.skip_string(),
+                b'{' | b'[' => {
+                    depth += 1;
+                    self.at += 1;
+                }
+                b'}' | b']' if depth == 0 => break,
+                b'}' | b']' => {
+                    depth -= 1;
+                    self.at += 1;
+                }
+                b',' if depth == 0 => break,
+                _ => self.at += 1,
+            }
+        }
+    }
+
+    fn skip_string(&mut self) {
+        self.at += 1;
+        while let Some(b) = self.peek() {
+            self.at += if b == b'\\' { 2 } else { 1 };
+            if b == b'"' {
+                break;
+            }
+        }
+    }
+
+    /// Move into the object at the cursor, to the value of `key`; returns
+    /// the offset of the key.
+    fn find_key(&mut self, key: &str) -> Option<usize> {
+        self.at += 1;
+        loop {
+            self.skip_space();
+            if self.peek() != Some(b'"') {
+                return None;
+            }
+            let start = self.at;
+            self.skip_string();
+            let name = std::str::from_utf8(&self.bytes[start + 1..self.at - 1]).ok()?;
+            self.skip_space();
+            if self.peek() != Some(b':') {
+                return None;
+            }
+            self.at += 1;
+            self.skip_space();
+            if name == key {
+                return Some(start);
+            }
+            self.skip_value();
+            if self.peek() != Some(b',') {
+                return None;
+            }
+            self.at += 1;
+        }
+    }
+
+    /// Move into the array at the cursor, to item `index`; returns its
+    /// offset.
+    fn find_item(&mut self, index: usize) -> Option<usize> {
+        self.at += 1;
+        for _ in 0..index {
+            self.skip_space();
+            self.skip_value();
+            if self.peek() != Some(b',') {
+                return None;
+            }
+            self.at += 1;
+        }
+        self.skip_space();
+        (self.peek() != Some(b']')).then_some(self.at)
+    }
+}
+
+/// A significant line of YAML: its offset, indentation and content.
+#[derive(Clone, Copy)]
+struct Line<'a> {
+    offset: usize,
+    indent: usize,
+    text: &'a str,
+}
+
+fn yaml(source: &str, path: &[Step<'_>]) -> (usize, bool) {
+    let mut offset = 0;
+    let mut block: Vec<Line<'_>> = Vec::new();
+    for raw in source.split_inclusive('\n') {
+        let text = raw.trim_end();
+        let content = text.trim_start();
+        if !content.is_empty() && !content.starts_with('#') && content != "---" {
+            block.push(Line {
+                offset: offset + text.len() - content.len(),
+                indent: text.len() - content.len(),
+                text: content,
+            });
+        }
+        offset += raw.len();
+    }
+
+    let mut found = block.first().map_or(0, |line| line.offset);
+    for step in path {
+        let Some(level) = block.first().map(|line| line.indent) else {
+            return (found, false);
+        };
+        let siblings = block.iter().enumerate().filter(|(_, l)| l.indent == level);
+        let located = match step {
+            Step::Key(key) => siblings
+                .filter_map(|(i, line)| Some((i, mapping_value(line.text, key)?)))
+                .next(),
+            Step::Index(index) => siblings
+                .filter_map(|(i, line)| Some((i, sequence_item(line.text)?)))
+                .nth(*index),
+        };
+        let Some((i, value)) = located else {
+            return (found, false);
+        };
+        let line = block[i];
+        found = line.offset;
+
+        // A sequence may sit at the indentation of its key
+        let children = block[i + 1..].iter().take_while(|l| {
+            l.indent > level
+                || (matches!(step, Step::Key(_))
+                    && l.indent == level
+                    && sequence_item(l.text).is_some())
+        });
+        let mut next = Vec::new();
+        if !value.is_empty() {
+            let column = line.text.len() - value.len();
+            next.push(Line {
+                offset: line.offset + column,
+                indent: line.indent + column,
+                text: value,
+            });
+        }
+        next.extend(children.copied());
+        block = next;
+    }
+    (found, true)
+}
+
+/// The value after `key:` if `text` starts with that key.
+fn mapping_value<'a>(text: &'a str, key: &str) -> Option<&'a str> {
+    let rest = [("\"", "\""), ("'", "'"), ("", "")]
+        .iter()
+        .find_map(|(open, close)| {
+            text.strip_prefix(open)?
+                .strip_prefix(key)?
+                .strip_prefix(close)
+        })?
+        .trim_start_matches([' ', '\t']);
+    let value = rest.strip_prefix(':')?;
+    (value.is_empty() || value.starts_with([' ', '\t'])).then(|| value.trim_start())
+}
+
+/// The content of a sequence item (`- content`), if `text` is one.
+fn sequence_item(text: &str) -> Option<&str> {
+    match text.strip_prefix('-')? {
+        "" => Some(""),
+        rest if rest.starts_with([' ', '\t']) => Some(rest.trim_start()),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_locate_yaml_and_json() {
+        let path = [
+            Step::Key("transforms"),
+            Step::Index(1),
+            Step::Key("new_name"),
+        ];
+        let yaml = "name: x\n# rules\ntransforms:\n- type: rename_function\n  new_name: A\n- type: rename_type\n  old_name: B\n  new_name: C\n";
+        assert_eq!(locate(yaml, &path), (8, 3));
+
+        let json = "{\n  \"name\": \"x\",\n  \"transforms\": [\n    {\"type\": \"a\", \"new_name\": \"A\"},\n    {\n      \"type\": \"b\",\n      \"new_name\": \"C\"\n    }\n  ]\n}\n";
+        assert_eq!(locate(json, &path), (7, 7));
+        // A missing key is located at the deepest step found
+        assert_eq!(
+            locate(
+                json,
+                &[Step::Key("transforms"), Step::Index(1), Step::Key("x")]
+            ),
+            (5, 5)
+        );
+        assert_eq!(find(yaml, &[Step::Key("transforms"), Step::Key("x")]), None);
+    }
+}
@@ -0,0 +1,312 @@
+//! References to a function that are not calls.
+//!
+//! Calls are not the only use of a function: Go code keeps functions in
+//! variables (`f := mylib.GetUser`), passes them as callbacks
+//! (`retry(mylib.Save)`) and takes method values (`utils.Helper`). When a
+//! rule changes the arguments of a function, these references stop
+//! compiling, yet no call shows where.
+//!
+//! [`FunctionValues`] finds them. References to a function that is only
+//! renamed are renamed. Given the Go function type the function had before
+//! the change (`func(id int64) (*User, error)`), a reference is replaced
+//! with an adapter: a function literal of that type calling the function as
+//! the rule rewrites its calls. Other references have their line marked
+//! with a [`TODO_MARKER`] comment for the author.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::call::{CallArgument, CallRewrite};
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rewrite = CallRewrite::new("mylib.Connect")
+//!     .add_argument(CallArgument::positional(1, "8080"))
+//!     .signature("func(host string) error");
+//! let transform = GuardedTransform::new(&rewrite.pattern(), "$0")?.rewriter(Arc::new(rewrite));
+//! let result = transform.apply("\tretry(mylib.Connect)\n", "main.go".as_ref())?;
+//! assert_eq!(
+//!     result,
+//!     "\tretry(func(host string) error { return mylib.Connect(host, 8080) })\n"
+//! );
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use std::ops::Range;
+use std::path::Path;
+use std::sync::LazyLock;
+
+use super::call::split_arguments;
+use super::go::SKIPPED;
+use super::removed::line_comment;
+use super::structural;
+use crate::plugin::Match;
+use crate::runner::{MARKER_PATTERN, TODO_MARKER, has_marker};
+
+/// A parenthesized list at the start of the text.
+static ARGUMENTS: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(&format!(r"\A{}", structural::argument_list())).expect("invalid argument list regex")
+});
+
+/// Words starting a Go type rather than naming a parameter.
+const TYPE_KEYWORDS: &[&str] = &["func", "map", "chan", "struct", "interface"];
+
+/// Finds and handles the references to a function that are not calls.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FunctionValues {
+    function: String,
+    new_name: Option<String>,
+    signature: Option<String>,
+    exact: bool,
+}
+
+impl FunctionValues {
+    /// References to `function`, which may be qualified (`mylib.GetUser`).
+    pub fn new(function: impl Into<String>) -> Self {
+        Self {
+            function: function.into(),
+            new_name: None,
+            signature: None,
+            exact: false,
+        }
+    }
+
+    /// Rename references to `new_name`, for a function whose arguments do
+    /// not change.
+    pub fn rename(mut self, new_name: impl Into<String>) -> Self {
+        self.new_name = Some(new_name.into());
+        self
+    }
+
+    /// Replace references in Go code with adapters of the function type
+    /// `signature` (`func(id int64) (*User, error)`).
+    pub fn signature(mut self, signature: impl Into<String>) -> Self {
+        self.signature = Some(signature.into());
+        self
+    }
+
+    /// Only find references written as the function's name, not method
+    /// values or selections through another receiver.
+    pub fn exact(mut self) -> Self {
+        self.exact = true;
+        self
+    }
+
+    /// Regex matching whole lines that refer to the function without calling
+    /// it, with the line in the group `line`. A TODO marker on the line
+    /// above is part of the match, captured as `marked`.
+    pub fn pattern(&self) -> String {
+        format!(
+            r"(?m:^(?P<marked>[ \t]*(?://|#)[ \t]*{}:[^\n]*\n)?(?P<line>[^\n]*\b{}\b[ \t]*(?:[^\w\s(\[:.={{<!][^\n]*)?$)\n?)",
+            MARKER_PATTERN,
+            regex::escape(&self.function)
+        )
+    }
+
+    /// The spans of the references to the function in `text`, from the file
+    /// at `path`, with the receiver or package qualifying them.
+    pub(crate) fn find(&self, text: &str, path: &Path) -> Vec<Range<usize>> {
+        let comments = if line_comment(path) == "#" {
+            r"|#[^\n]*"
+        } else {
+            ""
+        };
+        let pattern = Regex::new(&format!(
+            r"(?m)(?P<skip>{}{})|(?P<receiver>(?:[A-Za-z_][\w.]*)?\.\s*)?(?P<reference>\b{})\b[ \t]*(?:[^\w\s(\[:.={{<!]|$)",
+            SKIPPED,
+            comments,
+            regex::escape(&self.function)
+        ))
+        .expect("invalid reference regex");
+
+        let mut references = Vec::new();
+        for caps in pattern.captures_iter(text) {
+            let Some(reference) = caps.name("reference") else {
+                continue;
+            };
+            let receiver = caps.name("receiver");
+            if self.exact && receiver.is_some() {
+                continue;
+            }
+            let start = receiver.map_or(reference.start(), |r| r.start());
+            let line = text[..start].rfind('\n').map_or(0, |i| i + 1);
+            let head = text[line..].trim_start();
+            let import = ["import", "from ", "use ", "export ", "require"]
+                .iter()
+                .any(|keyword| head.starts_with(keyword));
+            if !import {
+                references.push(start..reference.end());
+            }
+        }
+        references
+    }
+
+    /// Edits of `text` handling its references to the function: adapters,
+    /// whose call of the function is rewritten by `rewrite_call`, or markers
+    /// above the lines of references that cannot be adapted. Lines already
+    /// marked are left alone.
+    pub(crate) fn edits(
+        &self,
+        text: &str,
+        path: &Path,
+        rewrite_call: &dyn Fn(&str) -> String,
+    ) -> Vec<(Range<usize>, String)> {
+        let mut edits = Vec::new();
+        let mut marked = None;
+        for reference in self.find(text, path) {
+            if let Some(adapter) = self.adapter(&text[reference.clone()], path, rewrite_call) {
+                edits.push((reference, adapter));
+                continue;
+            }
+            let line = text[..reference.start].rfind('\n').map_or(0, |i| i + 1);
+            let above = text[..line.saturating_sub(1)]
+                .rsplit('\n')
+                .next()
+                .unwrap_or("");
+            if marked == Some(line) || (line > 0 && has_marker(above)) {
+                continue;
+            }
+            marked = Some(line);
+            let rest = &text[line..];
+            let indent = &rest[..rest.len() - rest.trim_start_matches([' ', '\t']).len()];
+            edits.push((line..line, format!("{}{}\n", indent, self.marker(path))));
+        }
+        edits.sort_by_key(|(range, _)| range.start);
+        edits
+    }
+
+    /// The line matched by [`pattern`](Self::pattern) with its references
+    /// handled and the calls around them rewritten by `rewrite_calls`, or
+    /// `None` if nothing changes.
+    pub(crate) fn rewrite_line(
+        &self,
+        m: &Match,
+        rewrite_calls: &dyn Fn(&str) -> String,
+    ) -> Option<String> {
+        let text = m.text.strip_suffix('\n').unwrap_or(&m.text);
+        let newline = &m.text[text.len()..];
+        let mut rewritten = String::new();
+        let mut last = 0;
+        for (range, replacement) in self.edits(text, &m.path, rewrite_calls) {
+            rewritten.push_str(&rewrite_calls(&text[last..range.start]));
+            rewritten.push_str(&replacement);
+            last = range.end;
+        }
+        rewritten.push_str(&rewrite_calls(&text[last..]));
+        (rewritten != text).then(|| rewritten + newline)
+    }
+
+    /// The replacement for the reference `reference`, if it can be adapted.
+    fn adapter(
+        &self,
+        reference: &str,
+        path: &Path,
+        rewrite_call: &dyn Fn(&str) -> String,
+    ) -> Option<String> {
+        if let Some(new_name) = &self.new_name {
+            let receiver = &reference[..reference.len() - self.function.len()];
+            return Some(format!("{}{}", receiver, new_name));
+        }
+        let signature = self.signature.as_deref()?;
+        if path.extension().and_then(|e| e.to_str()) != Some("go") || reference.starts_with('.') {
+            return None;
+        }
+        go_adapter(signature, reference, rewrite_call)
+    }
+
+    /// The comment marking a reference for the author.
+    fn marker(&self, path: &Path) -> String {
+        format!(
+            "{} {}: {} is used as a value; adapt it to its new signature",
+            line_comment(path),
+            TODO_MARKER,
+            self.function
+        )
+    }
+}
+
+/// A Go function literal of the function type `signature`, calling
+/// `function` with its parameters in a call rewritten by `rewrite_call`.
+fn go_adapter(
+    signature: &str,
+    function: &str,
+    rewrite_call: &dyn Fn(&str) -> String,
+) -> Option<String> {
+    let signature = signature.trim().strip_prefix("func")?.trim_start();
+    let params = ARGUMENTS.captures(signature)?;
+    let results = signature[params.get(0)?.end()..].trim();
+    let list = params.name("args").map_or("", |m| m.as_str()).trim();
+    let items = split_arguments(list);
+
+    // Parameters are either all named or all unnamed
+    let named = items.iter().any(|item| {
+        let mut words = item.split_whitespace();
+        let first = words.next().unwrap_or("");
+        words.next().is_some()
+            && first.chars().all(|c| c.is_alphanumeric() || c == '_')
+            && !TYPE_KEYWORDS.contains(&first)
+    });
+    let mut arguments = Vec::new();
+    let mut declared = Vec::new();
+    for (index, item) in items.iter().enumerate() {
+        let (name, kind) = if named {
+            let name = item.split_whitespace().next().unwrap_or(item);
+            (name.to_string(), item[name.len()..].trim())
+        } else {
+            (format!("p{}", index), *item)
+        };
+        let variadic = if kind.starts_with("...") { "..." } else { "" };
+        if !named {
+            declared.push(format!("{} {}", name, kind));
+        }
+        arguments.push(format!("{}{}", name, variadic));
+    }
+    let params = if named {
+        list.to_string()
+    } else {
+        declared.join(", ")
+    };
+
+    let call = rewrite_call(&format!("{}({})", function, arguments.join(", ")));
+    Some(if results.is_empty() {
+        format!("func({}) {{ {} }}", params, call)
+    } else {
+        format!("func({}) {} {{ return {} }}", params, results, call)
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_references_and_adapters() {
+        let values = FunctionValues::new("Helper");
+        let source = "import \"x/Helper\"\nh := utils.Helper\nfmt.Println(\"Helper\", Helper(), f(Helper)) // Helper\n";
+        let found: Vec<&str> = values
+            .find(source, Path::new("main.go"))
+            .into_iter()
+            .map(|r| &source[r])
+            .collect();
+        assert_eq!(found, ["utils.Helper", "Helper"]);
+        assert_eq!(values.exact().find(source, Path::new("main.go")).len(), 1);
+
+        let call = |call: &str| call.replace("Get(", "Fetch(ctx, ");
+        assert_eq!(
+            go_adapter(
+                "func(id int64, opts ...Option) (*User, error)",
+                "Get",
+                &call
+            ),
+            Some(
+                "func(id int64, opts ...Option) (*User, error) { return Fetch(ctx, id, opts...) }"
+                    .to_string()
+            )
+        );
+        assert_eq!(
+            go_adapter("func(string, map[string]int)", "Get", &call),
+            Some("func(p0 string, p1 map[string]int) { Fetch(ctx, p0, p1) }".to_string())
+        );
+    }
+}
@@ -0,0 +1,223 @@
+//! Handling calls of removed functions.
+//!
+//! When a release removes a function outright (`DeprecatedFn` in v2), no
+//! rename fixes its callers. A [`RemovedCall`] handles each call with a
+//! [`Removal`] strategy: deleting the call, replacing it with another
+//! expression, marking it with a [`TODO_MARKER`] comment, or replacing it
+//! with a statement that fails loudly at run time (`panic(...)` in Go,
+//! `raise NotImplementedError(...)` in Python).
+//!
+//! Calls are only deleted or replaced by a failure when they are a
+//! statement of their own, so their result is unused; other calls get a
+//! TODO marker instead. Calls already marked are left alone, as are
+//! definitions and calls in comments.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::removed::{Removal, RemovedCall};
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let removal = RemovedCall::new("DeprecatedFn", Removal::Todo);
+//! let transform = GuardedTransform::new(&removal.pattern(), "$0")?.rewriter(Arc::new(removal));
+//! let result = transform.apply("\tv := DeprecatedFn(1)\n", "main.go".as_ref())?;
+//! assert_eq!(
+//!     result,
+//!     "\t// TODO(refactor): DeprecatedFn was removed\n\tv := DeprecatedFn(1)\n"
+//! );
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::path::Path;
+
+use super::structural;
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+use crate::runner::{MARKER_PATTERN, TODO_MARKER};
+
+/// What to do with each call of a removed function.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Removal {
+    /// Delete the call, when its result is unused.
+    Delete,
+    /// Replace the call with an expression.
+    Replace,
+    /// Keep the call, with a TODO comment above it.
+    #[default]
+    Todo,
+    /// Replace the call with a statement failing at run time, when its
+    /// result is unused.
+    Fail,
+}
+
+impl fmt::Display for Removal {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let name = match self {
+            Removal::Delete => "delete",
+            Removal::Replace => "replace",
+            Removal::Todo => "todo",
+            Removal::Fail => "fail",
+        };
+        write!(f, "{}", name)
+    }
+}
+
+/// Handles the calls of a removed function.
+///
+/// With [`Removal::Replace`], the replacement is the rule's template, in
+/// which `${args}` is the call's argument list.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RemovedCall {
+    function: String,
+    strategy: Removal,
+}
+
+impl RemovedCall {
+    /// Handle calls of `function`, which may be qualified (`mylib.Old`).
+    pub fn new(function: impl Into<String>, strategy: Removal) -> Self {
+        Self {
+            function: function.into(),
+            strategy,
+        }
+    }
+
+    /// Regex matching the lines calling the function, from the start of the
+    /// line (`indent`, then the code before the call as `before`) to its
+    /// end (`after`), with the arguments in `args`. A TODO marker on the
+    /// line above is captured as `marked`, and a preceding definition
+    /// keyword as `def`.
+    pub fn pattern(&self) -> String {
+        format!(
+            r"(?m)^(?P<marked>[ \t]*(?://|#)[ \t]*{}:[^\n]*\n)?(?P<indent>[ \t]*)(?P<before>[^\n]*?)(?P<def>\b(?:def|fn|func|function)\s+)?\b{}\s*(?:{}\s*)?{}(?P<after>[^\n]*)\n?",
+            MARKER_PATTERN,
+            regex::escape(&self.function),
+            structural::type_arguments(),
+            structural::argument_list()
+        )
+    }
+
+    /// The comment marking a call for the author.
+    fn marker(&self, path: &Path) -> String {
+        format!(
+            "{} {}: {} was removed",
+            line_comment(path),
+            TODO_MARKER,
+            self.function
+        )
+    }
+}
+
+impl Rewriter for RemovedCall {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        let capture = |name: &str| m.captures.get(name).map_or("", String::as_str);
+        let (indent, before, after) = (capture("indent"), capture("before"), capture("after"));
+        let trimmed = before.trim_start();
+        let commented = trimmed.starts_with(['#', '*']) || before.contains("//");
+        let selected = before.ends_with('.') && !self.function.contains('.');
+        if m.captures.contains_key("def") || commented || selected {
+            return Ok(None);
+        }
+        if m.captures.contains_key("marked") && self.strategy == Removal::Todo {
+            return Ok(None);
+        }
+
+        let newline = if m.text.ends_with('\n') { "\n" } else { "" };
+        let start = capture("marked").len();
+        let line = &m.text[start..];
+        let rest = after.trim_start().trim_start_matches(';').trim_start();
+        let unused = trimmed.is_empty()
+            && (rest.is_empty() || rest.starts_with("//") || rest.starts_with('#'));
+
+        let handled = match self.strategy {
+            Removal::Delete if unused => Some(String::new()),
+            Removal::Replace => Some(format!(
+                "{}{}{}{}{}",
+                indent, before, m.replacement, after, newline
+            )),
+            Removal::Fail if unused => failure(
+                &m.path,
+                &format!("{}: {} was removed", TODO_MARKER, self.function),
+            )
+            .map(|statement| format!("{}{}{}{}", indent, statement, after, newline)),
+            _ => None,
+        };
+        Ok(Some(match handled {
+            Some(handled) => format!("{}{}", &m.text[..start], handled),
+            None if m.captures.contains_key("marked") => return Ok(None),
+            None => format!("{}{}\n{}", indent, self.marker(&m.path), line),
+        }))
+    }
+}
+
+/// The line comment prefix of the language of `path`.
+pub(super) fn line_comment(path: &Path) -> &'static str {
+    match path.extension().and_then(|e| e.to_str()) {
+        Some("py" | "rb" | "sh" | "yaml" | "yml" | "toml") => "#",
+        _ => "//",
+    }
+}
+
+/// A statement failing at run time with `message`, in the language of
+/// `path`, if it is known.
+fn failure(path: &Path, message: &str) -> Option<String> {
+    let message = format!("\"{}\"", message.replace('\\', "\\\\").replace('"', "\\\""));
+    let statement = match path.extension().and_then(|e| e.to_str())? {
+        "go" => format!("panic({})", message),
+        "rs" => format!("unimplemented!({})", message),
+        "py" => format!("raise NotImplementedError({})", message),
+        "rb" => format!("raise NotImplementedError, {}", message),
+        "java" => format!("throw new UnsupportedOperationException({})", message),
+        "cs" => format!("throw new NotSupportedException({})", message),
+        "js" | "jsx" | "mjs" | "cjs" | "ts" | "tsx" => format!("throw new Error({})", message),
+        _ => return None,
+    };
+    Some(statement)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+
+    fn apply(removal: RemovedCall, template: &str, source: &str, path: &str) -> String {
+        GuardedTransform::new(&removal.pattern(), template)
+            .unwrap()
+            .rewriter(std::sync::Arc::new(removal))
+            .apply(source, Path::new(path))
+            .unwrap()
+    }
+
+    const SOURCE: &str = "func main() {\n\t// Using DeprecatedFn (should be removed)\n\tDeprecatedFn()\n\tv := DeprecatedFn(2)\n\tc.DeprecatedFn()\n}\n";
+
+    #[test]
+    fn test_delete_and_fail_unused_calls() {
+        let delete = RemovedCall::new("DeprecatedFn", Removal::Delete);
+        let deleted = apply(delete, "$0", SOURCE, "main.go");
+        assert_eq!(
+            deleted,
+            "func main() {\n\t// Using DeprecatedFn (should be removed)\n\t// TODO(refactor): DeprecatedFn was removed\n\tv := DeprecatedFn(2)\n\tc.DeprecatedFn()\n}\n"
+        );
+        // Marked calls are not marked again
+        let again = RemovedCall::new("DeprecatedFn", Removal::Delete);
+        assert_eq!(apply(again, "$0", &deleted, "main.go"), deleted);
+
+        let fail = RemovedCall::new("legacy.reset", Removal::Fail);
+        assert_eq!(
+            apply(fail, "$0", "    legacy.reset(db)  # cleanup\n", "jobs.py"),
+            "    raise NotImplementedError(\"TODO(refactor): legacy.reset was removed\")  # cleanup\n"
+        );
+    }
+
+    #[test]
+    fn test_replace_calls() {
+        let replace = RemovedCall::new("DeprecatedFn", Removal::Replace);
+        assert_eq!(
+            apply(replace, "FetchUser(${args})", SOURCE, "main.go"),
+            "func main() {\n\t// Using DeprecatedFn (should be removed)\n\tFetchUser()\n\tv := FetchUser(2)\n\tc.DeprecatedFn()\n}\n"
+        );
+    }
+}
@@ -0,0 +1,260 @@
+//! Path and enum variant renames for Rust.
+//!
+//! Rust code names an item through a path (`acme::client::Client`), either
+//! in full or after bringing it into scope with a `use` declaration, which
+//! may group several items (`use acme::client::{Client, Options};`). A
+//! [`PathRename`] follows an item (or a module) that was renamed or moved,
+//! splitting grouped imports when the item moves to another module. A
+//! [`VariantRename`] renames an enum variant in qualified uses
+//! (`Shape::Circle`) and grouped imports of the enum's variants.
+//!
+//! Function and type names used unqualified after an import are renamed with
+//! `rename_function` and `rename_type`, and changed signatures with
+//! [`CallRewrite`](super::CallRewrite).
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::rust::PathRename;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rename = PathRename::new("acme::client::Client", "acme::Client");
+//! let transform = GuardedTransform::new(&rename.pattern(), "$0")?.rewriter(Arc::new(rename));
+//! let result = transform.apply(
+//!     "use acme::client::{Client, Options};\n",
+//!     "src/main.rs".as_ref(),
+//! )?;
+//! assert_eq!(result, "use acme::client::{Options};\nuse acme::Client;\n");
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+
+use super::call::{join_arguments, split_arguments};
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// Splits a path into its parent and last segment.
+fn split_path(path: &str) -> (&str, &str) {
+    path.rsplit_once("::").unwrap_or(("", path))
+}
+
+/// The leading segment of a `use` group entry (`Client` for `Client`,
+/// `Client as C` and `Client::Builder`) and the rest of the entry.
+fn split_entry(entry: &str) -> (&str, &str) {
+    let end = entry
+        .find(|c: char| !(c.is_alphanumeric() || c == '_'))
+        .unwrap_or(entry.len());
+    entry.split_at(end)
+}
+
+/// Rewrites the entries of a `use` group, keeping its layout.
+fn rewrite_group(names: &str, entries: &[String]) -> String {
+    if names.contains('\n') {
+        join_arguments(names, entries)
+    } else {
+        let pad = if names.starts_with(' ') { " " } else { "" };
+        format!("{}{}{}", pad, entries.join(", "), pad)
+    }
+}
+
+/// Renames or moves an item or module, in paths and `use` declarations.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PathRename {
+    old_path: String,
+    new_path: String,
+}
+
+impl PathRename {
+    /// Rename the item at `old_path` to `new_path` (`acme::client::Client`
+    /// to `acme::Client`).
+    pub fn new(old_path: impl Into<String>, new_path: impl Into<String>) -> Self {
+        Self {
+            old_path: old_path.into(),
+            new_path: new_path.into(),
+        }
+    }
+
+    /// Regex matching `use` groups of the old parent module (captured as
+    /// `names`, with any visibility as `vis`), and the old path itself
+    /// (preceded by `pre`), including as a prefix of longer paths.
+    pub fn pattern(&self) -> String {
+        format!(
+            r"(?P<vis>\bpub(?:\([^)]*\))?\s+)?\buse\s+{}::\{{(?P<names>[^{{}}]*)\}}\s*;|(?P<pre>(?:^|[^\w:])(?:::)?){}\b",
+            regex::escape(split_path(&self.old_path).0),
+            regex::escape(&self.old_path)
+        )
+    }
+}
+
+impl Rewriter for PathRename {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        let Some(names) = m.captures.get("names") else {
+            let pre = m.captures.get("pre").map_or("", String::as_str);
+            return Ok(Some(format!("{}{}", pre, self.new_path)));
+        };
+
+        let (old_parent, old_name) = split_path(&self.old_path);
+        let (new_parent, new_name) = split_path(&self.new_path);
+        let mut entries: Vec<String> = split_arguments(names)
+            .into_iter()
+            .map(str::to_string)
+            .collect();
+        let Some(index) = entries
+            .iter()
+            .position(|entry| split_entry(entry).0 == old_name)
+        else {
+            return Ok(None);
+        };
+
+        if old_parent == new_parent {
+            let rest = split_entry(&entries[index]).1.to_string();
+            entries[index] = format!("{}{}", new_name, rest);
+            let group = format!("{{{}}}", names);
+            return Ok(Some(m.text.replacen(
+                &group,
+                &format!("{{{}}}", rewrite_group(names, &entries)),
+                1,
+            )));
+        }
+
+        let entry = entries.remove(index);
+        let vis = m.captures.get("vis").map_or("", String::as_str);
+        let moved = format!("{}use {}{};", vis, self.new_path, split_entry(&entry).1);
+        if entries.is_empty() {
+            return Ok(Some(moved));
+        }
+        let kept = m.text.replacen(
+            &format!("{{{}}}", names),
+            &format!("{{{}}}", rewrite_group(names, &entries)),
+            1,
+        );
+        Ok(Some(format!("{}\n{}", kept, moved)))
+    }
+}
+
+/// Renames a variant of an enum.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VariantRename {
+    enum_name: String,
+    old_name: String,
+    new_name: String,
+}
+
+impl VariantRename {
+    /// Rename variant `old_name` of `enum_name` to `new_name`.
+    pub fn new(
+        enum_name: impl Into<String>,
+        old_name: impl Into<String>,
+        new_name: impl Into<String>,
+    ) -> Self {
+        Self {
+            enum_name: enum_name.into(),
+            old_name: old_name.into(),
+            new_name: new_name.into(),
+        }
+    }
+
+    /// Regex matching the qualified variant (`Shape::Circle`, captured as
+    /// `variant`) and groups of the enum's variants (`Shape::{...}`,
+    /// captured as `group`).
+    pub fn pattern(&self) -> String {
+        format!(
+            r"\b{}::(?:(?P<variant>{})\b|\{{(?P<group>[^{{}}]*)\}})",
+            regex::escape(&self.enum_name),
+            regex::escape(&self.old_name)
+        )
+    }
+}
+
+impl Rewriter for VariantRename {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        if m.captures.contains_key("variant") {
+            return Ok(Some(format!("{}::{}", self.enum_name, self.new_name)));
+        }
+        let group = m.captures.get("group").map_or("", String::as_str);
+        let entry = Regex::new(&format!(r"(^|[\s,]){}\b", regex::escape(&self.old_name)))?;
+        if !entry.is_match(group) {
+            return Ok(None);
+        }
+        let group = entry.replace(group, format!("${{1}}{}", self.new_name));
+        Ok(Some(format!("{}::{{{}}}", self.enum_name, group)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use std::path::Path;
+    use std::sync::Arc;
+
+    fn rename_path(old_path: &str, new_path: &str, source: &str) -> String {
+        let rename = PathRename::new(old_path, new_path);
+        GuardedTransform::new(&rename.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(rename))
+            .apply(source, Path::new("src/lib.rs"))
+            .unwrap()
+    }
+
+    #[test]
+    fn test_path_rename_moves_item() {
+        let source = "use acme::client::Client;\nuse acme::client::ClientBuilder;\nlet c = ::acme::client::Client::new();\nlet d = other::acme::client::Client::new();\n";
+        assert_eq!(
+            rename_path("acme::client::Client", "acme::Client", source),
+            "use acme::Client;\nuse acme::client::ClientBuilder;\nlet c = ::acme::Client::new();\nlet d = other::acme::client::Client::new();\n"
+        );
+        assert_eq!(
+            rename_path(
+                "acme::client::Client",
+                "acme::Client",
+                "pub(crate) use acme::client::{\n    Client as C,\n    Options,\n};\n"
+            ),
+            "pub(crate) use acme::client::{\n    Options,\n};\npub(crate) use acme::Client as C;\n"
+        );
+        assert_eq!(
+            rename_path(
+                "acme::client::Client",
+                "acme::Client",
+                "use acme::client::{Client};\n"
+            ),
+            "use acme::Client;\n"
+        );
+    }
+
+    #[test]
+    fn test_path_rename_in_place() {
+        assert_eq!(
+            rename_path(
+                "acme::connect",
+                "acme::open",
+                "use acme::{connect, Options};\nacme::connect(url);\n"
+            ),
+            "use acme::{open, Options};\nacme::open(url);\n"
+        );
+        // Renaming a module renames the paths below it
+        assert_eq!(
+            rename_path(
+                "acme::client",
+                "acme::net",
+                "use acme::{client::Client, Error};\nuse acme::client::Options;\n"
+            ),
+            "use acme::{net::Client, Error};\nuse acme::net::Options;\n"
+        );
+    }
+
+    #[test]
+    fn test_variant_rename() {
+        let rename = VariantRename::new("Shape", "Circle", "Round");
+        let transform = GuardedTransform::new(&rename.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(rename));
+        let source = "use geo::Shape::{Circle, Square};\nmatch s {\n    Shape::Circle { r } => r,\n    Shape::CircleSector => 0,\n}\nlet t = Shape::{Square};\n";
+        assert_eq!(
+            transform.apply(source, Path::new("src/lib.rs")).unwrap(),
+            "use geo::Shape::{Round, Square};\nmatch s {\n    Shape::Round { r } => r,\n    Shape::CircleSector => 0,\n}\nlet t = Shape::{Square};\n"
+        );
+    }
+}
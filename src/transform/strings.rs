@@ -0,0 +1,172 @@
+//! String literal rewrites for configuration keys and endpoint paths.
+//!
+//! Renaming an API often renames the strings its users pass around: a
+//! configuration key (`"server.port"` becoming `"http.port"`) or an
+//! endpoint path (`"/v1/users"` becoming `"/v2/users"`). A
+//! [`StringRewrite`] rewrites the content of string literals, whatever
+//! their quotes, keeping the quotes: literals equal to the old content, or
+//! with [`prefix`](StringRewrite::prefix) starting with it. Limited to one
+//! argument of calls to a function, it leaves the same string used for
+//! anything else alone.
+//!
+//! Contents are compared as written in the source, escapes included.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::strings::StringRewrite;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rewrite = StringRewrite::new("server.port", "http.port").function("viper.Get");
+//! let transform = GuardedTransform::new(&rewrite.pattern(), "$0")?.rewriter(Arc::new(rewrite));
+//! let result = transform.apply(
+//!     "p := viper.Get(\"server.port\")\nlog(\"server.port\")\n",
+//!     "main.go".as_ref(),
+//! )?;
+//! assert_eq!(result, "p := viper.Get(\"http.port\")\nlog(\"server.port\")\n");
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use super::structural;
+use super::values::map_argument;
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// Quotes of string literals.
+const QUOTES: [char; 3] = ['"', '\'', '`'];
+
+/// Rewrites the content of string literals.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct StringRewrite {
+    from: String,
+    to: String,
+    prefix: bool,
+    function: Option<String>,
+    argument: Option<String>,
+}
+
+impl StringRewrite {
+    /// Rewrite literals containing exactly `from` to contain `to`.
+    pub fn new(from: impl Into<String>, to: impl Into<String>) -> Self {
+        Self {
+            from: from.into(),
+            to: to.into(),
+            prefix: false,
+            function: None,
+            argument: None,
+        }
+    }
+
+    /// Also rewrite literals starting with `from`, keeping the rest of
+    /// their content.
+    pub fn prefix(mut self) -> Self {
+        self.prefix = true;
+        self
+    }
+
+    /// Only rewrite literals passed to `function`, which may be qualified
+    /// (`viper.Get`).
+    pub fn function(mut self, function: impl Into<String>) -> Self {
+        self.function = Some(function.into());
+        self
+    }
+
+    /// The argument of the function to rewrite: a positional index (`"1"`)
+    /// or a keyword name. Defaults to the first argument.
+    pub fn argument(mut self, argument: impl Into<String>) -> Self {
+        self.argument = Some(argument.into());
+        self
+    }
+
+    /// Regex matching string literals, or calls of the function (arguments
+    /// in `args`). Whole literals are matched, so quotes inside a literal,
+    /// such as those of a Go struct tag, never start one.
+    pub fn pattern(&self) -> String {
+        match &self.function {
+            Some(function) => format!(
+                r"(?P<def>\b(?:def|fn|func|function)\s+)?\b{}\s*(?:{}\s*)?{}",
+                regex::escape(function),
+                structural::type_arguments(),
+                structural::argument_list()
+            ),
+            None => structural::LITERALS.to_string(),
+        }
+    }
+
+    /// The rewritten `literal`, or `None` if it is not a string literal
+    /// this rewrite applies to.
+    fn rewrite_literal(&self, literal: &str) -> Option<String> {
+        let quote = literal.chars().next().filter(|c| QUOTES.contains(c))?;
+        let content = literal
+            .strip_prefix(quote)?
+            .strip_suffix(quote)
+            .filter(|_| literal.len() >= 2)?;
+        let rest = match content.strip_prefix(self.from.as_str())? {
+            "" => "",
+            rest if self.prefix => rest,
+            _ => return None,
+        };
+        Some(format!("{q}{}{}{q}", self.to, rest, q = quote))
+    }
+}
+
+impl Rewriter for StringRewrite {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        if m.captures.contains_key("def") {
+            return Ok(None);
+        }
+        let Some(args) = m.captures.get("args") else {
+            return Ok(self.rewrite_literal(&m.text));
+        };
+        let argument = self.argument.as_deref().unwrap_or("0");
+        // The argument list closes the match; type arguments may precede it
+        let open = m.text.len() - args.len() - 2;
+        Ok(
+            map_argument(args, argument, |value| self.rewrite_literal(value))
+                .map(|args| format!("{}({})", &m.text[..open], args)),
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use std::sync::Arc;
+
+    fn apply(rewrite: StringRewrite, source: &str) -> String {
+        GuardedTransform::new(&rewrite.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(rewrite))
+            .apply(source, "main.go".as_ref())
+            .unwrap()
+    }
+
+    #[test]
+    fn test_rewrite_strings() {
+        let paths = StringRewrite::new("/v1/", "/v2/").prefix();
+        assert_eq!(
+            apply(
+                paths,
+                "get(\"/v1/users\")\nget(`/v1/`)\nget(\"/api/v1/\")\nget('/v1/x')\nget(`\"/v1/\"`)\n"
+            ),
+            "get(\"/v2/users\")\nget(`/v2/`)\nget(\"/api/v1/\")\nget('/v2/x')\nget(`\"/v1/\"`)\n"
+        );
+
+        let key = StringRewrite::new("port", "http.port")
+            .function("cfg.Set")
+            .argument("1");
+        assert_eq!(
+            apply(
+                key,
+                "cfg.Set(\"port\", \"port\")\ncfg.Set(\"port\")\nfunc cfg.Set(a, b string) {}\n"
+            ),
+            "cfg.Set(\"port\", \"http.port\")\ncfg.Set(\"port\")\nfunc cfg.Set(a, b string) {}\n"
+        );
+        assert_eq!(
+            apply(StringRewrite::new("port", "p"), "x := \"ports\"\n"),
+            "x := \"ports\"\n"
+        );
+    }
+}
@@ -0,0 +1,459 @@
+//! Structural search-and-replace templates with metavariables.
+//!
+//! A template is code with `$name` holes, e.g. `GetUser($id)`. Each hole
+//! matches one expression, with balanced brackets and string literals; the
+//! rest of the template matches literally, ignoring whitespace differences.
+//! Templates compile to regexes, so they run on the same engine (and accept
+//! the same guards) as `replace_pattern` rules.
+//!
+//! A hole written directly inside brackets or between commas (an argument,
+//! element or field) matches any expression, including ones with spaces such
+//! as `a + b`. Elsewhere a hole matches a single operand: an identifier,
+//! selector, literal, or call or index expression.
+//!
+//! A template of several lines matches a sequence of statements, starting
+//! at the beginning of a line, and `...` matches any code in between: other
+//! statements, the body of a block, or the remaining arguments of a call.
+//! Each `...` of the replacement stands for the code the `...` in the same
+//! position of the pattern matched, so a rewrite can restructure an idiom
+//! around code it keeps, such as a call and the check of its result:
+//!
+//! ```text
+//! $s := Connect($h)
+//! ...
+//! if $s != OK {
+//!     ...
+//! }
+//! ```
+//!
+//! The lines of a replacement after the first are indented like the line
+//! the match starts on.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::structural::parse_rewrite;
+//! use refactor::transform::{GuardedTransform, Transform};
+//!
+//! let spec = parse_rewrite("GetUser($id) => FetchUser(ctx, $id)")?;
+//! let (pattern, replacement) = spec.to_pattern_replacement();
+//! let transform = GuardedTransform::new(&pattern, &replacement)?;
+//! let result = transform.apply("u := GetUser(ids[0])", "main.go".as_ref())?;
+//! assert_eq!(result, "u := FetchUser(ctx, ids[0])");
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use std::collections::{HashMap, HashSet};
+
+use crate::analyzer::TransformSpec;
+use crate::error::{RefactorError, Result};
+
+/// Separates the pattern from the replacement in a one-line rewrite.
+pub const ARROW: &str = "=>";
+
+/// Matches any code in a template.
+pub const ELLIPSIS: &str = "...";
+
+/// Bracket nesting depth a hole can match.
+const MAX_DEPTH: usize = 3;
+
+/// Capture group holding the indentation of a statement sequence.
+const INDENT: &str = "_indent";
+
+/// Separates a metavariable from the number of its occurrence in the
+/// capture groups of its later occurrences, such as `x__2`.
+const REPEAT: &str = "__";
+
+#[derive(Debug, PartialEq)]
+enum Token<'a> {
+    Hole(&'a str),
+    Word(&'a str),
+    Punct(char),
+    Ellipsis,
+    Space,
+}
+
+/// Parse a one-line rewrite such as `GetUser($x) => FetchUser($x)`.
+pub fn parse_rewrite(expr: &str) -> Result<TransformSpec> {
+    let (pattern, replacement) = expr.split_once(ARROW).ok_or_else(|| {
+        RefactorError::InvalidConfig(format!(
+            "Rewrite '{}' must have the form 'pattern {} replacement'",
+            expr, ARROW
+        ))
+    })?;
+    let (pattern, replacement) = (pattern.trim(), replacement.trim());
+    if pattern.is_empty() {
+        return Err(RefactorError::InvalidConfig(format!(
+            "Rewrite '{}' has an empty pattern",
+            expr
+        )));
+    }
+
+    let bound: HashSet<&str> = holes(pattern).collect();
+    if let Some(unbound) = holes(replacement).find(|h| !bound.contains(h)) {
+        return Err(RefactorError::InvalidConfig(format!(
+            "Metavariable ${} is used in the replacement but not in the pattern",
+            unbound
+        )));
+    }
+    if ellipses(replacement) > ellipses(pattern) {
+        return Err(RefactorError::InvalidConfig(format!(
+            "Rewrite '{}' has more '{}' in the replacement than in the pattern",
+            expr, ELLIPSIS
+        )));
+    }
+
+    Ok(TransformSpec::ReplaceStructural {
+        pattern: pattern.to_string(),
+        replacement: replacement.to_string(),
+    })
+}
+
+/// Returns true if `template` spans several lines, so it matches a
+/// sequence of statements.
+pub fn is_statements(template: &str) -> bool {
+    template.trim().contains('\n')
+}
+
+/// Compile a template to a regex with one named group per metavariable,
+/// and one per `...`.
+///
+/// The regex engine has no backreferences, so the later occurrences of a
+/// repeated metavariable are captured as `x__2`, `x__3` and so on, and a
+/// [`GuardedTransform`](super::GuardedTransform) only fires where they
+/// match the same text as the first (see [`repeated_hole`]).
+pub fn compile_pattern(template: &str) -> String {
+    let tokens = tokenize(template);
+    let significant: Vec<(usize, &Token)> = tokens
+        .iter()
+        .enumerate()
+        .filter(|(_, t)| **t != Token::Space)
+        .collect();
+
+    let mut regex = String::new();
+    if is_statements(template) {
+        regex.push_str(&format!(r"(?m:^)(?P<{}>[ \t]*)", INDENT));
+    }
+    let mut seen: HashMap<&str, usize> = HashMap::new();
+    let mut ellipses = 0;
+    for (n, (i, token)) in significant.iter().enumerate() {
+        if n > 0 {
+            let (prev_i, prev) = significant[n - 1];
+            if *prev == Token::Ellipsis || **token == Token::Ellipsis {
+                // An ellipsis takes the whitespace around it
+            } else {
+                let spaced = prev_i + 1 < *i;
+                let words = !matches!(prev, Token::Punct(_)) && !matches!(token, Token::Punct(_));
+                regex.push_str(if spaced && words { r"\s+" } else { r"\s*" });
+            }
+        }
+
+        match token {
+            Token::Word(word) => {
+                let boundary = word.starts_with(|c: char| c.is_alphanumeric() || c == '_');
+                if n == 0 && boundary {
+                    regex.push_str(r"\b");
+                }
+                regex.push_str(&regex::escape(word));
+                if n + 1 == significant.len() && boundary {
+                    regex.push_str(r"\b");
+                }
+            }
+            Token::Punct(c) => regex.push_str(&regex::escape(&c.to_string())),
+            Token::Hole(name) => {
+                let before = n.checked_sub(1).map(|p| significant[p].1);
+                let after = significant.get(n + 1).map(|(_, t)| *t);
+                let wide = matches!(before, Some(Token::Punct('(' | '[' | '{' | ',')))
+                    && matches!(after, Some(Token::Punct(')' | ']' | '}' | ',')));
+                let hole = if wide { wide_hole() } else { narrow_hole() };
+                let occurrence = seen.entry(*name).or_default();
+                *occurrence += 1;
+                if *occurrence == 1 {
+                    regex.push_str(&format!("(?P<{}>{})", name, hole));
+                } else {
+                    regex.push_str(&format!("(?P<{}{}{}>{})", name, REPEAT, occurrence, hole));
+                }
+            }
+            Token::Ellipsis => {
+                ellipses += 1;
+                regex.push_str(&format!(
+                    r"(?P<{}>\s*(?:{})*?\s*)",
+                    ellipsis(ellipses),
+                    group_contents()
+                ));
+            }
+            Token::Space => {}
+        }
+    }
+    regex
+}
+
+/// Convert the replacement template of `pattern` to regex replacement
+/// syntax.
+pub fn compile_replacement(pattern: &str, template: &str) -> String {
+    let statements = is_statements(pattern);
+    let template = if statements {
+        template.trim()
+    } else {
+        template
+    };
+    let tokens = tokenize(template);
+    let beside_ellipsis = |i: usize| {
+        tokens[i] == Token::Space
+            && (tokens.get(i + 1) == Some(&Token::Ellipsis)
+                || i.checked_sub(1).map(|p| &tokens[p]) == Some(&Token::Ellipsis))
+    };
+
+    let mut replacement = String::new();
+    if statements {
+        replacement.push_str(&format!("${{{}}}", INDENT));
+    }
+    let mut ellipses = 0;
+    for (i, raw) in raw_tokens(template).into_iter().enumerate() {
+        match &tokens[i] {
+            Token::Hole(name) => replacement.push_str(&format!("${{{}}}", name)),
+            Token::Ellipsis => {
+                ellipses += 1;
+                replacement.push_str(&format!("${{{}}}", ellipsis(ellipses)));
+            }
+            // The code an ellipsis matched keeps its own whitespace
+            Token::Space if beside_ellipsis(i) => {}
+            Token::Space if statements => {
+                replacement.push_str(&raw.replace('\n', &format!("\n${{{}}}", INDENT)))
+            }
+            _ => replacement.push_str(&raw.replace('$', "$$")),
+        }
+    }
+    replacement
+}
+
+/// The metavariable a capture group is a later occurrence of, such as `x`
+/// for `x__2`.
+pub fn repeated_hole(group: &str) -> Option<&str> {
+    let (name, occurrence) = group.rsplit_once(REPEAT)?;
+    let numbered = !occurrence.is_empty() && occurrence.bytes().all(|b| b.is_ascii_digit());
+    (numbered && !name.is_empty()).then_some(name)
+}
+
+/// Capture group of the `n`th ellipsis of a pattern, from 1.
+fn ellipsis(n: usize) -> String {
+    format!("_ellipsis{}", n)
+}
+
+fn ellipses(template: &str) -> usize {
+    tokenize(template)
+        .iter()
+        .filter(|t| **t == Token::Ellipsis)
+        .count()
+}
+
+/// `template` without its ellipses, for checking that it parses.
+pub(crate) fn without_ellipses(template: &str) -> String {
+    tokenize(template)
+        .into_iter()
+        .zip(raw_tokens(template))
+        .filter(|(token, _)| *token != Token::Ellipsis)
+        .map(|(_, raw)| raw)
+        .collect()
+}
+
+fn holes(template: &str) -> impl Iterator<Item = &str> {
+    tokenize(template).into_iter().filter_map(|t| match t {
+        Token::Hole(name) => Some(name),
+        _ => None,
+    })
+}
+
+fn tokenize(template: &str) -> Vec<Token<'_>> {
+    raw_tokens(template)
+        .into_iter()
+        .map(|raw| {
+            if let Some(name) = raw.strip_prefix('$').filter(|n| !n.is_empty()) {
+                Token::Hole(name)
+            } else if raw == ELLIPSIS {
+                Token::Ellipsis
+            } else if raw.trim().is_empty() {
+                Token::Space
+            } else if raw.chars().count() == 1 && !is_word_char(raw.chars().next().unwrap()) {
+                Token::Punct(raw.chars().next().unwrap())
+            } else {
+                Token::Word(raw)
+            }
+        })
+        .collect()
+}
+
+/// Split a template into holes, words, ellipses, whitespace runs and single
+/// punctuation characters, keeping every byte.
+///
+/// `...` right after an operand, as in `f(args...)`, is Go's variadic
+/// spread, not an ellipsis.
+fn raw_tokens(template: &str) -> Vec<&str> {
+    let mut tokens: Vec<&str> = Vec::new();
+    let mut rest = template;
+    while let Some(c) = rest.chars().next() {
+        let spread = tokens
+            .last()
+            .is_some_and(|t| t.ends_with(|c: char| is_word_char(c) || c == ')' || c == ']'));
+        let len = if rest.starts_with(ELLIPSIS) && !spread {
+            ELLIPSIS.len()
+        } else if c == '$' && rest[1..].starts_with(is_ident_start) {
+            1 + rest[1..]
+                .find(|c: char| !is_word_char(c))
+                .unwrap_or(rest.len() - 1)
+        } else if c.is_whitespace() {
+            rest.find(|c: char| !c.is_whitespace())
+                .unwrap_or(rest.len())
+        } else if is_word_char(c) {
+            rest.find(|c: char| !is_word_char(c)).unwrap_or(rest.len())
+        } else {
+            c.len_utf8()
+        };
+        tokens.push(&rest[..len]);
+        rest = &rest[len..];
+    }
+    tokens
+}
+
+fn is_ident_start(c: char) -> bool {
+    c.is_alphabetic() || c == '_'
+}
+
+fn is_word_char(c: char) -> bool {
+    c.is_alphanumeric() || c == '_'
+}
+
+/// String, rune and raw string literals.
+pub(crate) const LITERALS: &str = r#""(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*'|`[^`]*`"#;
+
+/// Balanced bracket groups nested up to [`MAX_DEPTH`] deep.
+fn groups() -> String {
+    let inner = group_contents();
+    format!(r"\((?:{i})*\)|\[(?:{i})*\]|\{{(?:{i})*\}}", i = inner)
+}
+
+/// One item of the contents of a bracket group: a character, a literal or
+/// a nested group.
+fn group_contents() -> String {
+    let mut inner = format!(r#"[^()\[\]{{}}"'`]|{}"#, LITERALS);
+    for _ in 0..MAX_DEPTH {
+        inner = format!(
+            r#"[^()\[\]{{}}"'`]|{lit}|\((?:{i})*\)|\[(?:{i})*\]|\{{(?:{i})*\}}"#,
+            lit = LITERALS,
+            i = inner
+        );
+    }
+    inner
+}
+
+/// Regex matching a parenthesized argument list, which may span lines, with
+/// its contents in the group `args`.
+pub(crate) fn argument_list() -> String {
+    format!(r"\((?P<args>(?:{})*)\)", group_contents())
+}
+
+/// Regex matching the type arguments of a Go generic function
+/// (`[User]`, `[string, []int]`).
+pub(crate) fn type_arguments() -> String {
+    format!(r"\[(?:{})*\]", group_contents())
+}
+
+/// Regex matching a braced field list, which may span lines, with its
+/// contents in the group `fields`.
+pub(crate) fn field_list() -> String {
+    format!(r"\{{(?P<fields>(?:{})*)\}}", group_contents())
+}
+
+/// Regex matching one argument of a call.
+pub(crate) fn argument() -> String {
+    wide_hole()
+}
+
+fn wide_hole() -> String {
+    format!(r#"(?:[^()\[\]{{}},;"'`\n]|{}|{})+?"#, LITERALS, groups())
+}
+
+fn narrow_hole() -> String {
+    format!(r#"(?:[\w.]|{}|{})+"#, LITERALS, groups())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use std::path::Path;
+
+    fn rewrite(expr: &str, source: &str) -> String {
+        let (pattern, replacement) = parse_rewrite(expr).unwrap().to_pattern_replacement();
+        GuardedTransform::new(&pattern, &replacement)
+            .unwrap()
+            .apply(source, Path::new("main.go"))
+            .unwrap()
+    }
+
+    #[test]
+    fn test_holes_match_expressions() {
+        assert_eq!(
+            rewrite(
+                "GetUser($x) => FetchUser($x)",
+                "a := GetUser(ids[f(1, 2)])\nb := GetUser( c + d )\nXGetUser(e)\n"
+            ),
+            "a := FetchUser(ids[f(1, 2)])\nb := FetchUser(c + d)\nXGetUser(e)\n"
+        );
+        assert_eq!(
+            rewrite(
+                "$c.Connect($addr, $opts) => $c.Dial(ctx, $addr)",
+                "defer pool.conns[0].Connect(\"a,b\", Options{Retry: 1})\n"
+            ),
+            "defer pool.conns[0].Dial(ctx, \"a,b\")\n"
+        );
+    }
+
+    #[test]
+    fn test_repeated_holes_match_the_same_text() {
+        assert_eq!(
+            rewrite(
+                "$x == $x => true",
+                "a := n == n\nb := n == m\nc := f(x) == f(x)\n"
+            ),
+            "a := true\nb := n == m\nc := true\n"
+        );
+        assert_eq!(repeated_hole("x__2"), Some("x"));
+        assert_eq!(repeated_hole("x"), None);
+        assert_eq!(repeated_hole("_ellipsis1"), None);
+    }
+
+    #[test]
+    fn test_parse_rewrite_errors() {
+        assert!(parse_rewrite("GetUser($x)").is_err());
+        assert!(parse_rewrite(" => FetchUser()").is_err());
+        assert!(parse_rewrite("GetUser($x) => FetchUser($y)").is_err());
+    }
+
+    #[test]
+    fn test_replacement_escapes_dollars() {
+        assert_eq!(
+            compile_replacement("f($x)", "f($x, \"$\")"),
+            "f(${x}, \"$$\")"
+        );
+    }
+
+    #[test]
+    fn test_statement_sequences() {
+        let expr = "$s := Connect($h)\n...\nif $s != OK {\n    ...\n} => conn, err := Dial(ctx, $h)\n...\nif err != nil {\n    ...\n}";
+        let source = "func f() {\n\ts := Connect(host)\n\tlog(s)\n\tif s != OK {\n\t\tcleanup()\n\t\treturn s\n\t}\n}\n";
+        assert_eq!(
+            rewrite(expr, source),
+            "func f() {\n\tconn, err := Dial(ctx, host)\n\tlog(s)\n\tif err != nil {\n\t\tcleanup()\n\t\treturn s\n\t}\n}\n"
+        );
+        // A spread is not an ellipsis
+        assert_eq!(
+            rewrite(
+                "Connect($h, ...) => Dial($h, ...)",
+                "Connect(a, b...)\nConnect(c)\n"
+            ),
+            "Dial(a, b...)\nConnect(c)\n"
+        );
+        assert!(parse_rewrite("f($x) => g($x, ...)").is_err());
+    }
+}
@@ -0,0 +1,157 @@
+//! Renaming a package's own symbols across its module.
+//!
+//! Upgrade rules usually assume the renamed API lives in an external
+//! library: every call site is a client, and the library's own code is not
+//! touched. A [`SymbolRename`] instead renames a symbol of a package inside
+//! the module being processed (a Go `internal/` package, say), updating its
+//! declaration and unqualified uses within the package and the qualified
+//! uses (`store.Load`) in the rest of the module.
+//!
+//! The package is identified by its directory relative to the module root;
+//! other packages refer to it by the alias of their import, or by the
+//! directory's last segment, the default package name. Methods of the same
+//! name are left alone.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::symbol::SymbolRename;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rename = SymbolRename::new("internal/store", "Load", "Fetch");
+//! let transform = GuardedTransform::new(&rename.pattern(), "$0")?.rewriter(Arc::new(rename));
+//! let result = transform.apply("v, err := store.Load(key)\n", "cmd/api/main.go".as_ref())?;
+//! assert_eq!(result, "v, err := store.Fetch(key)\n");
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use std::path::Path;
+
+use super::go::local_name;
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// Renames a symbol of one package throughout the module containing it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SymbolRename {
+    package: String,
+    old_name: String,
+    new_name: String,
+}
+
+impl SymbolRename {
+    /// Rename `old_name` to `new_name` in the package in directory
+    /// `package` (relative to the module root, e.g. `internal/store`).
+    pub fn new(
+        package: impl Into<String>,
+        old_name: impl Into<String>,
+        new_name: impl Into<String>,
+    ) -> Self {
+        Self {
+            package: package.into().trim_matches('/').to_string(),
+            old_name: old_name.into(),
+            new_name: new_name.into(),
+        }
+    }
+
+    /// Name the package is referred to by in other packages.
+    pub fn package_name(&self) -> &str {
+        self.package.rsplit('/').next().unwrap_or(&self.package)
+    }
+
+    /// Regex matching uses of the symbol, qualified (captured as `qual`) or
+    /// not. A preceding method receiver is captured as `recv`.
+    pub fn pattern(&self) -> String {
+        format!(
+            r"(?P<recv>\bfunc\s*\([^)]*\)\s*)?(?:\b(?P<qual>[A-Za-z_]\w*)\.)?\b{}\b",
+            regex::escape(&self.old_name)
+        )
+    }
+
+    /// Regex matching files that may use the symbol: files of a package with
+    /// the same name, and files importing the package's directory.
+    pub fn file_pattern(&self) -> String {
+        format!(
+            r#"(?m)^package\s+{}\b|"(?:[^"\n]*/)?{}""#,
+            regex::escape(self.package_name()),
+            regex::escape(&self.package)
+        )
+    }
+
+    /// Returns true if `path` is a file of the package.
+    fn in_package(&self, path: &Path) -> bool {
+        path.parent()
+            .is_some_and(|dir| dir.ends_with(Path::new(&self.package)))
+    }
+}
+
+impl Rewriter for SymbolRename {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        if m.captures.contains_key("recv") {
+            return Ok(None);
+        }
+        if self.in_package(&m.path) {
+            return Ok((!m.captures.contains_key("qual")).then(|| self.new_name.clone()));
+        }
+        Ok(
+            match (m.captures.get("qual"), local_name(&m.source, &self.package)) {
+                (Some(qual), Some(name)) if *qual == name => {
+                    Some(format!("{}.{}", qual, self.new_name))
+                }
+                // Unqualified after a dot import
+                (None, None) => Some(self.new_name.clone()),
+                _ => None,
+            },
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{Guard, GuardedTransform, Transform};
+    use std::sync::Arc;
+
+    fn apply(source: &str, path: &str) -> String {
+        let rename = SymbolRename::new("internal/store", "Load", "Fetch");
+        GuardedTransform::new(&rename.pattern(), "$0")
+            .unwrap()
+            .when(Guard::new().file_contains(rename.file_pattern()))
+            .unwrap()
+            .rewriter(Arc::new(rename))
+            .apply(source, Path::new(path))
+            .unwrap()
+    }
+
+    #[test]
+    fn test_renames_within_package() {
+        let source = "package store\n\nfunc Load(key string) {}\n\nfunc (c *Cache) Load() {}\n\nvar loader = Load\n\nfunc get() { Load(\"a\"); c.Load() }\n";
+        assert_eq!(
+            apply(source, "/repo/internal/store/store.go"),
+            "package store\n\nfunc Fetch(key string) {}\n\nfunc (c *Cache) Load() {}\n\nvar loader = Fetch\n\nfunc get() { Fetch(\"a\"); c.Load() }\n"
+        );
+    }
+
+    #[test]
+    fn test_renames_qualified_uses_in_importers() {
+        let source = "package api\n\nimport \"example.com/app/internal/store\"\n\nfunc h() { store.Load(k); cache.Load(); Load() }\n";
+        assert_eq!(
+            apply(source, "/repo/cmd/api/main.go"),
+            "package api\n\nimport \"example.com/app/internal/store\"\n\nfunc h() { store.Fetch(k); cache.Load(); Load() }\n"
+        );
+
+        // Another package named store, not importing this one
+        let other = "package store\n\nfunc Load() {}\n";
+        assert_eq!(apply(other, "/repo/pkg/store/store.go"), other);
+        let unrelated = "package api\n\nfunc h() { store.Load() }\n";
+        assert_eq!(apply(unrelated, "/repo/cmd/api/main.go"), unrelated);
+
+        // Imported under an alias
+        let aliased = "package api\n\nimport db \"example.com/app/internal/store\"\n\nfunc h() { db.Load(k); store.Load() }\n";
+        assert_eq!(
+            apply(aliased, "/repo/cmd/api/main.go"),
+            "package api\n\nimport db \"example.com/app/internal/store\"\n\nfunc h() { db.Fetch(k); store.Load() }\n"
+        );
+    }
+}
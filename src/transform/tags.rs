@@ -0,0 +1,301 @@
+//! Go struct tag rewrites.
+//!
+//! Renaming a Go field changes its serialized name unless a tag pins it,
+//! and API migrations often have to keep serialized names stable, or rename
+//! them on purpose. A [`TagRewrite`] edits the tags of struct fields:
+//! renaming the name under a key (`json:"user_id"` to `json:"uid"`), adding
+//! a key the tag lacks (`yaml:"user_id"`) and removing one. Other keys,
+//! options such as `omitempty` and the layout of the tag are kept.
+//!
+//! A rewrite may be limited to the fields of one struct type and to one
+//! field. Keys are only added to fields without a tag when the rewrite is
+//! limited to one field, so a rule never tags every field of every struct.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::tags::TagRewrite;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let rewrite = TagRewrite::new()
+//!     .type_name("User")
+//!     .rename("json", "user_id", "uid")
+//!     .add("yaml", "uid");
+//! let transform = GuardedTransform::new(&rewrite.pattern(), "$0")?.rewriter(Arc::new(rewrite));
+//! let result = transform.apply(
+//!     "type User struct {\n\tID int `json:\"user_id,omitempty\" db:\"id\"`\n}\n",
+//!     "user.go".as_ref(),
+//! )?;
+//! assert_eq!(
+//!     result,
+//!     "type User struct {\n\tID int `json:\"uid,omitempty\" db:\"id\" yaml:\"uid\"`\n}\n"
+//! );
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use std::collections::BTreeMap;
+use std::sync::LazyLock;
+
+use super::structural;
+use super::values::is_identifier;
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// A field declaration with a tag at the end of its line.
+static TAGGED: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"(?m)^(?P<decl>[^`\n]*?)`(?P<tag>[^`\n]*)`").expect("invalid tagged field regex")
+});
+
+/// One `key:"value"` entry of a tag.
+static ENTRY: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r#"(?P<space>\s*)(?P<key>[^\s:"]+):"(?P<value>(?:[^"\\]|\\.)*)""#)
+        .expect("invalid tag entry regex")
+});
+
+/// Renames, adds and removes the keys of struct field tags.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct TagRewrite {
+    type_name: Option<String>,
+    field: Option<String>,
+    rename: BTreeMap<String, BTreeMap<String, String>>,
+    add: BTreeMap<String, String>,
+    remove: Vec<String>,
+}
+
+impl TagRewrite {
+    /// A rewrite of the tags of every struct's fields that changes nothing.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Only rewrite the fields of the struct type `name`.
+    pub fn type_name(mut self, name: impl Into<String>) -> Self {
+        self.type_name = Some(name.into());
+        self
+    }
+
+    /// Only rewrite the tag of the field `name`.
+    pub fn field(mut self, name: impl Into<String>) -> Self {
+        self.field = Some(name.into());
+        self
+    }
+
+    /// Rename the name `from` under `key` to `to`, keeping its options.
+    pub fn rename(
+        mut self,
+        key: impl Into<String>,
+        from: impl Into<String>,
+        to: impl Into<String>,
+    ) -> Self {
+        self.rename
+            .entry(key.into())
+            .or_default()
+            .insert(from.into(), to.into());
+        self
+    }
+
+    /// Add `key:"value"` to tags without `key`.
+    pub fn add(mut self, key: impl Into<String>, value: impl Into<String>) -> Self {
+        self.add.insert(key.into(), value.into());
+        self
+    }
+
+    /// Remove `key` from tags.
+    pub fn remove(mut self, key: impl Into<String>) -> Self {
+        self.remove.push(key.into());
+        self
+    }
+
+    /// Regex matching struct types, with the field list captured as
+    /// `fields`.
+    pub fn pattern(&self) -> String {
+        let head = match &self.type_name {
+            Some(name) => format!(r"\b{}\s+struct", regex::escape(name)),
+            None => r"\bstruct".to_string(),
+        };
+        format!(r"{}\s*{}", head, structural::field_list())
+    }
+
+    /// Rewrite the tags in the field list `fields`, or return `None` if
+    /// none changes.
+    fn rewrite_fields(&self, fields: &str) -> Option<String> {
+        let mut changed = false;
+        let lines: Vec<String> = fields
+            .split('\n')
+            .map(|line| match self.rewrite_line(line) {
+                Some(rewritten) => {
+                    changed = true;
+                    rewritten
+                }
+                None => line.to_string(),
+            })
+            .collect();
+        changed.then(|| lines.join("\n"))
+    }
+
+    /// Rewrite the tag of the field declared on `line`.
+    fn rewrite_line(&self, line: &str) -> Option<String> {
+        let Some(caps) = TAGGED.captures(line) else {
+            // Untagged fields only gain a tag when the rule names them
+            let (decl, comment) = match line.find("//") {
+                Some(i) => line.split_at(i),
+                None => (line, ""),
+            };
+            if self.field.is_none() || !self.selects(decl) {
+                return None;
+            }
+            let tag = self.rewrite_tag("")?;
+            let decl = decl.trim_end();
+            let comment = if comment.is_empty() {
+                String::new()
+            } else {
+                format!(" {}", comment)
+            };
+            return Some(format!("{} `{}`{}", decl, tag, comment));
+        };
+        if !self.selects(&caps["decl"]) {
+            return None;
+        }
+        let tag = caps.name("tag").expect("tag group exists");
+        let rewritten = self.rewrite_tag(tag.as_str())?;
+        if rewritten.trim().is_empty() {
+            return Some(format!(
+                "{}{}",
+                line[..tag.start() - 1].trim_end(),
+                &line[tag.end() + 1..]
+            ));
+        }
+        Some(format!(
+            "{}{}{}",
+            &line[..tag.start()],
+            rewritten,
+            &line[tag.end()..]
+        ))
+    }
+
+    /// Returns true if the field declaration `decl` declares a field this
+    /// rewrite applies to.
+    fn selects(&self, decl: &str) -> bool {
+        let names = field_names(decl);
+        !names.is_empty()
+            && self
+                .field
+                .as_ref()
+                .is_none_or(|field| names.contains(&field.as_str()))
+    }
+
+    /// The rewritten tag content, or `None` if it does not change.
+    fn rewrite_tag(&self, tag: &str) -> Option<String> {
+        let mut rewritten = String::new();
+        let mut keys = Vec::new();
+        let mut last = 0;
+        for caps in ENTRY.captures_iter(tag) {
+            let whole = caps.get(0).expect("capture group 0 always exists");
+            rewritten.push_str(&tag[last..whole.start()]);
+            last = whole.end();
+            let key = &caps["key"];
+            keys.push(key.to_string());
+            if self.remove.iter().any(|k| k == key) {
+                continue;
+            }
+            let value = &caps["value"];
+            let (name, options) = value.split_at(value.find(',').unwrap_or(value.len()));
+            match self.rename.get(key).and_then(|names| names.get(name)) {
+                Some(new) => {
+                    rewritten.push_str(&format!("{}{}:\"{}{}\"", &caps["space"], key, new, options))
+                }
+                None => rewritten.push_str(whole.as_str()),
+            }
+        }
+        rewritten.push_str(&tag[last..]);
+        // The first remaining entry takes the place of a removed one
+        if !tag.starts_with(char::is_whitespace) {
+            rewritten = rewritten.trim_start().to_string();
+        }
+
+        for (key, value) in &self.add {
+            if !keys.contains(key) {
+                if !rewritten.trim_end().is_empty() {
+                    rewritten.truncate(rewritten.trim_end().len());
+                    rewritten.push(' ');
+                }
+                rewritten.push_str(&format!("{}:\"{}\"", key, value));
+            }
+        }
+        (rewritten != tag).then_some(rewritten)
+    }
+}
+
+impl Rewriter for TagRewrite {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        let Some(fields) = m.captures.get("fields") else {
+            return Ok(None);
+        };
+        let open = m.text.find('{').unwrap_or(m.text.len());
+        Ok(self
+            .rewrite_fields(fields)
+            .map(|fields| format!("{}{{{}}}", &m.text[..open], fields)))
+    }
+}
+
+/// The names of the fields `decl` declares: `A, B int` declares `A` and
+/// `B`, and `*pool.Config` embeds `Config`.
+fn field_names(decl: &str) -> Vec<&str> {
+    let mut names = Vec::new();
+    for part in decl.split(',') {
+        let mut words = part.split_whitespace();
+        let Some(word) = words.next() else {
+            break;
+        };
+        let name = word.trim_start_matches('*');
+        let name = name.rsplit('.').next().unwrap_or(name);
+        if !is_identifier(name) {
+            break;
+        }
+        names.push(name);
+        if words.next().is_some() {
+            break;
+        }
+    }
+    names
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use std::sync::Arc;
+
+    fn apply(rewrite: TagRewrite, source: &str) -> String {
+        GuardedTransform::new(&rewrite.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(rewrite))
+            .apply(source, "user.go".as_ref())
+            .unwrap()
+    }
+
+    #[test]
+    fn test_rewrite_tags() {
+        let source = "type User struct {\n\tID   int    `json:\"user_id\"  db:\"id\"`\n\tName string // display name\n}\n\ntype Group struct {\n\tID int `json:\"user_id\"`\n}\n";
+        assert_eq!(
+            apply(
+                TagRewrite::new()
+                    .type_name("User")
+                    .rename("json", "user_id", "uid")
+                    .remove("db"),
+                source
+            ),
+            "type User struct {\n\tID   int    `json:\"uid\"`\n\tName string // display name\n}\n\ntype Group struct {\n\tID int `json:\"user_id\"`\n}\n"
+        );
+        assert_eq!(
+            apply(TagRewrite::new().field("Name").add("json", "name"), source),
+            "type User struct {\n\tID   int    `json:\"user_id\"  db:\"id\"`\n\tName string `json:\"name\"` // display name\n}\n\ntype Group struct {\n\tID int `json:\"user_id\"`\n}\n"
+        );
+        assert_eq!(
+            apply(TagRewrite::new().remove("json"), source),
+            "type User struct {\n\tID   int    `db:\"id\"`\n\tName string // display name\n}\n\ntype Group struct {\n\tID int\n}\n"
+        );
+    }
+}
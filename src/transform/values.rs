@@ -0,0 +1,291 @@
+//! Value mapping tables for arguments and comparisons.
+//!
+//! When a library replaces magic values with named ones (v1 `Status`
+//! integers becoming v2 `ConnectionStatus` names, string mode flags becoming
+//! enum options), a [`ValueMap`] rewrites each old value to its new one:
+//! in one argument of calls to a function, and where an expression is
+//! compared against a value with `==` or `!=` (either side). Values are
+//! source text, so numbers, strings and constants can all be mapped; values
+//! not in the table are left alone.
+//!
+//! # Example
+//!
+//! ```rust
+//! use refactor::transform::values::ValueMap;
+//! use refactor::transform::{GuardedTransform, Transform};
+//! use std::sync::Arc;
+//!
+//! let map = ValueMap::new()
+//!     .function("pool.SetMode")
+//!     .argument("1")
+//!     .compared("conn.Status()")
+//!     .value(r#""fast""#, "pool.ModeFast")
+//!     .value("2", "pool.StatusReady");
+//! let transform = GuardedTransform::new(&map.pattern(), "$0")?.rewriter(Arc::new(map));
+//! let result = transform.apply(
+//!     "pool.SetMode(p, \"fast\")\nif conn.Status() == 2 {\n",
+//!     "main.go".as_ref(),
+//! )?;
+//! assert_eq!(result, "pool.SetMode(p, pool.ModeFast)\nif conn.Status() == pool.StatusReady {\n");
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use std::collections::BTreeMap;
+
+use super::call::{join_arguments, split_arguments};
+use super::structural;
+use crate::error::Result;
+use crate::plugin::{Match, Rewriter};
+
+/// Comparison operators whose operands are mapped.
+const OPERATORS: &str = r"===|!==|==|!=";
+
+/// Rewrites old values to new ones in call arguments and comparisons.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ValueMap {
+    function: Option<String>,
+    argument: Option<String>,
+    compared: Option<String>,
+    values: BTreeMap<String, String>,
+}
+
+impl ValueMap {
+    /// An empty table that maps nothing.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Map an argument of calls to `function`, which may be qualified
+    /// (`pool.SetMode`).
+    pub fn function(mut self, function: impl Into<String>) -> Self {
+        self.function = Some(function.into());
+        self
+    }
+
+    /// The argument to map: a positional index (`"1"`) or a keyword name.
+    /// Defaults to the first argument.
+    pub fn argument(mut self, argument: impl Into<String>) -> Self {
+        self.argument = Some(argument.into());
+        self
+    }
+
+    /// Map the values `expression` is compared with (`conn.Status()`).
+    pub fn compared(mut self, expression: impl Into<String>) -> Self {
+        self.compared = Some(expression.into());
+        self
+    }
+
+    /// Map `old` to `new`.
+    pub fn value(mut self, old: impl Into<String>, new: impl Into<String>) -> Self {
+        self.values.insert(old.into(), new.into());
+        self
+    }
+
+    /// Regex matching calls of the function (arguments in `args`) and
+    /// comparisons of the expression with a mapped value, on either side.
+    pub fn pattern(&self) -> String {
+        // Longest first, so `10` is not taken for `1`
+        let mut values: Vec<&String> = self.values.keys().collect();
+        values.sort_by_key(|value| std::cmp::Reverse(value.len()));
+        let values = values
+            .iter()
+            .map(|value| regex::escape(value))
+            .collect::<Vec<_>>()
+            .join("|");
+
+        let mut alternatives = Vec::new();
+        if let Some(function) = &self.function {
+            alternatives.push(format!(
+                r"(?P<def>\b(?:def|fn|func|function)\s+)?\b{}\s*(?:{}\s*)?{}",
+                regex::escape(function),
+                structural::type_arguments(),
+                structural::argument_list()
+            ));
+        }
+        if let (Some(expression), false) = (&self.compared, values.is_empty()) {
+            let subject = word_bounded(expression);
+            alternatives.push(format!(
+                r"{}\s*(?:{})\s*(?P<value>{})(?P<after>[^\w.]|$)",
+                subject, OPERATORS, values
+            ));
+            alternatives.push(format!(
+                r"(?P<before>^|[^\w.])(?P<reversed>{})\s*(?:{})\s*{}",
+                values, OPERATORS, subject
+            ));
+        }
+        if alternatives.is_empty() {
+            // Nothing to map: never match
+            return r"[^\s\S]".to_string();
+        }
+        format!("(?m:{})", alternatives.join("|"))
+    }
+
+    /// Rewrite the argument list `args`, or return `None` if the mapped
+    /// argument is missing or holds no value in the table.
+    fn rewrite_args(&self, args: &str) -> Option<String> {
+        let argument = self.argument.as_deref().unwrap_or("0");
+        map_argument(args, argument, |value| self.values.get(value).cloned())
+    }
+}
+
+/// Rewrite `argument` (a positional index or keyword name) of the argument
+/// list `args` with `map`, which is given its value; returns `None` if the
+/// argument is missing or `map` leaves it alone.
+pub(super) fn map_argument(
+    args: &str,
+    argument: &str,
+    map: impl Fn(&str) -> Option<String>,
+) -> Option<String> {
+    let mut rewritten: Vec<String> = Vec::new();
+    let mut changed = false;
+    let mut position = 0;
+    for arg in split_arguments(args) {
+        let keyword = arg
+            .split_once('=')
+            .filter(|(name, rest)| is_identifier(name.trim()) && !rest.starts_with('='));
+        let mapped = match keyword {
+            Some((name, value)) if name.trim() == argument => {
+                map(value.trim()).map(|new| format!("{}={}", name, leading_space(value) + &new))
+            }
+            Some(_) => None,
+            None => {
+                position += 1;
+                (argument == (position - 1).to_string())
+                    .then(|| map(arg))
+                    .flatten()
+            }
+        };
+        changed |= mapped.is_some();
+        rewritten.push(mapped.unwrap_or_else(|| arg.to_string()));
+    }
+    changed.then(|| join_arguments(args, &rewritten))
+}
+
+impl Rewriter for ValueMap {
+    fn rewrite(&self, m: &Match) -> Result<Option<String>> {
+        if m.captures.contains_key("def") {
+            return Ok(None);
+        }
+        if let Some(args) = m.captures.get("args") {
+            // The argument list closes the match; type arguments may precede it
+            let open = m.text.len() - args.len() - 2;
+            return Ok(self
+                .rewrite_args(args)
+                .map(|args| format!("{}({})", &m.text[..open], args)));
+        }
+        let mapped = |key: &str| {
+            m.captures
+                .get(key)
+                .and_then(|value| self.values.get(value).map(|new| (value, new)))
+        };
+        if let Some((value, new)) = mapped("value") {
+            let after = m.captures.get("after").map_or("", String::as_str);
+            let head = &m.text[..m.text.len() - after.len() - value.len()];
+            return Ok(Some(format!("{}{}{}", head, new, after)));
+        }
+        if let Some((value, new)) = mapped("reversed") {
+            let before = m.captures.get("before").map_or("", String::as_str);
+            let tail = &m.text[before.len() + value.len()..];
+            return Ok(Some(format!("{}{}{}", before, new, tail)));
+        }
+        Ok(None)
+    }
+}
+
+/// `expression` as a regex, bounded like a word where it starts or ends
+/// with one.
+fn word_bounded(expression: &str) -> String {
+    let is_word = |c: Option<char>| c.is_some_and(|c| c.is_alphanumeric() || c == '_');
+    format!(
+        "{}{}{}",
+        if is_word(expression.chars().next()) {
+            r"\b"
+        } else {
+            ""
+        },
+        regex::escape(expression),
+        if is_word(expression.chars().last()) {
+            r"\b"
+        } else {
+            ""
+        }
+    )
+}
+
+pub(super) fn is_identifier(name: &str) -> bool {
+    name.chars()
+        .next()
+        .is_some_and(|c| c.is_alphabetic() || c == '_')
+        && name.chars().all(|c| c.is_alphanumeric() || c == '_')
+}
+
+/// The whitespace `value` starts with, to keep `mode = "fast"` spaced.
+fn leading_space(value: &str) -> String {
+    value[..value.len() - value.trim_start().len()].to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::transform::{GuardedTransform, Transform};
+    use std::sync::Arc;
+
+    fn apply(map: ValueMap, source: &str, path: &str) -> String {
+        GuardedTransform::new(&map.pattern(), "$0")
+            .unwrap()
+            .rewriter(Arc::new(map))
+            .apply(source, path.as_ref())
+            .unwrap()
+    }
+
+    #[test]
+    fn test_map_call_arguments() {
+        let map = ValueMap::new()
+            .function("set_mode")
+            .argument("mode")
+            .value("'fast'", "Mode.FAST")
+            .value("'safe'", "Mode.SAFE");
+        assert_eq!(
+            apply(
+                map.clone(),
+                "def set_mode(mode='fast'):\n    pass\nset_mode(mode = 'safe')\nset_mode(mode='other')\n",
+                "app.py"
+            ),
+            "def set_mode(mode='fast'):\n    pass\nset_mode(mode = Mode.SAFE)\nset_mode(mode='other')\n"
+        );
+
+        let positional = ValueMap::new()
+            .function("pool.SetStatus")
+            .argument("1")
+            .value("1", "pool.StatusIdle")
+            .value("10", "pool.StatusClosed");
+        assert_eq!(
+            apply(
+                positional,
+                "pool.SetStatus(c, 10)\npool.SetStatus(1, 1)\n",
+                "main.go"
+            ),
+            "pool.SetStatus(c, pool.StatusClosed)\npool.SetStatus(1, pool.StatusIdle)\n"
+        );
+    }
+
+    #[test]
+    fn test_map_comparisons() {
+        let map = ValueMap::new()
+            .compared("c.Status()")
+            .value("1", "pool.StatusIdle")
+            .value("2", "pool.StatusReady");
+        assert_eq!(
+            apply(
+                map,
+                "if c.Status() == 1 || 2 != c.Status() {\n}\nif c.Status() == 12 {\n}\nif b.Status() == 1 {\n}\n",
+                "main.go"
+            ),
+            "if c.Status() == pool.StatusIdle || pool.StatusReady != c.Status() {\n}\nif c.Status() == 12 {\n}\nif b.Status() == 1 {\n}\n"
+        );
+        assert_eq!(
+            apply(ValueMap::new().value("1", "2"), "x == 1\n", "main.go"),
+            "x == 1\n"
+        );
+    }
+}
@@ -0,0 +1,493 @@
+//! Post-rewrite build verification.
+//!
+//! After rules are applied, [`BuildCheck`] runs the project's compiler or
+//! type checker and parses the errors it reports. Each error is tagged with
+//! the rules whose edits landed on the same line, so a migration that leaves
+//! code uncompilable points straight at the rule responsible. [`TestSuite`]
+//! goes one step further and runs the project's tests.
+//!
+//! GOPATH-mode Go projects have no go.mod to detect; [`BuildCheck::gopath`]
+//! and [`TestSuite::gopath`] build and test them with the go command in
+//! GOPATH mode. Example and tooling programs the root build skips are found
+//! with [`AuxiliaryProgram::discover`] and built one by one.
+//!
+//! Monorepos built with Bazel (a `MODULE.bazel` or `WORKSPACE` file at the
+//! root) or Please (a `.plzconfig`) and without a go.mod are built and
+//! tested through their build system. Where both are present the go command
+//! is used, unless a command is given.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::verify::BuildCheck;
+//!
+//! if let Some(check) = BuildCheck::detect("./project") {
+//!     let report = check.run("./project")?;
+//!     for (file, errors) in report.by_file() {
+//!         println!("{}: {} error(s)", file.display(), errors.len());
+//!     }
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use regex::Regex;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::fmt;
+use std::path::{Component, Path, PathBuf};
+use std::process::Command;
+use std::sync::LazyLock;
+
+use crate::error::Result;
+use crate::lang::GoPath;
+use crate::runner::RuleEdit;
+
+mod programs;
+mod suite;
+
+pub use programs::{AUXILIARY_DIRS, AuxiliaryProgram, Exclusion};
+pub use suite::{TestReport, TestSuite};
+
+/// `path:line:col: message` (go, gcc-style) and `path(line,col): message` (tsc).
+static LOCATED: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r"^(?P<path>[^\s:()][^:()]*?)(?::(?P<line>\d+):(?:(?P<col>\d+):)?|\((?P<tline>\d+),(?P<tcol>\d+)\):)\s*(?P<msg>.+)$",
+    )
+    .expect("invalid build error regex")
+});
+
+/// Rust-style `--> path:line:col` following an `error: message` line.
+static ARROW: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"^\s*--> (?P<path>[^:]+):(?P<line>\d+):(?P<col>\d+)$")
+        .expect("invalid build error regex")
+});
+
+/// Root files of the monorepo build systems, with the program building there.
+const MONOREPO_BUILDS: &[(&str, &str)] = &[
+    ("MODULE.bazel", "bazel"),
+    ("WORKSPACE", "bazel"),
+    ("WORKSPACE.bazel", "bazel"),
+    (".plzconfig", "plz"),
+];
+
+/// The build system program of a monorepo rooted at `root`.
+fn monorepo_build(root: &Path) -> Option<&'static str> {
+    MONOREPO_BUILDS
+        .iter()
+        .find(|(file, _)| root.join(file).exists())
+        .map(|(_, program)| *program)
+}
+
+/// A command that type-checks or builds a project.
+#[derive(Debug, Clone)]
+pub struct BuildCheck {
+    program: String,
+    args: Vec<String>,
+    env: Vec<(String, String)>,
+}
+
+impl BuildCheck {
+    /// Create a build check from a program and its arguments.
+    pub fn new(
+        program: impl Into<String>,
+        args: impl IntoIterator<Item = impl Into<String>>,
+    ) -> Self {
+        Self {
+            program: program.into(),
+            args: args.into_iter().map(Into::into).collect(),
+            env: Vec::new(),
+        }
+    }
+
+    /// Build a GOPATH-mode Go project whose packages live in `gopath`.
+    pub fn gopath(gopath: &GoPath) -> Self {
+        gopath.env().into_iter().fold(
+            Self::new("go", ["build", "./..."]),
+            |check, (key, value)| check.env(key, value),
+        )
+    }
+
+    /// Set an environment variable for the command.
+    pub fn env(mut self, key: impl Into<String>, value: impl Into<String>) -> Self {
+        self.env.push((key.into(), value.into()));
+        self
+    }
+
+    /// Parse a build check from a shell-style command line, with quoted
+    /// arguments (`go build -tags 'integration e2e' ./...`). `None` if it
+    /// is empty or has an unterminated quote.
+    pub fn from_command_line(command: &str) -> Option<Self> {
+        let mut parts = split_command_line(command)?.into_iter();
+        let program = parts.next()?;
+        Some(Self::new(program, parts))
+    }
+
+    /// Detect the build check for a project from its manifest files.
+    pub fn detect(root: impl AsRef<Path>) -> Option<Self> {
+        let root = root.as_ref();
+        if root.join("go.mod").exists() {
+            Some(Self::new("go", ["build", "./..."]))
+        } else if let Some(program) = monorepo_build(root) {
+            Some(Self::new(program, ["build", "//..."]))
+        } else if root.join("Cargo.toml").exists() {
+            Some(Self::new(
+                "cargo",
+                ["check", "--quiet", "--message-format=short"],
+            ))
+        } else if root.join("tsconfig.json").exists() {
+            Some(Self::new("npx", ["tsc", "--noEmit", "--pretty", "false"]))
+        } else {
+            None
+        }
+    }
+
+    /// The command line this check runs.
+    pub fn command_line(&self) -> String {
+        command_line(&self.program, &self.args)
+    }
+
+    /// Run the check in `root` and collect the errors it reports.
+    pub fn run(&self, root: impl AsRef<Path>) -> Result<VerifyReport> {
+        let root = root.as_ref();
+        let (success, text) = run_command(&self.program, &self.args, &self.env, root)?;
+
+        Ok(VerifyReport {
+            command: self.command_line(),
+            success,
+            errors: parse_errors(&text, root),
+            output: text,
+        })
+    }
+}
+
+/// Run a command in `root`, returning its exit status and combined output.
+fn run_command(
+    program: &str,
+    args: &[String],
+    env: &[(String, String)],
+    root: &Path,
+) -> Result<(bool, String)> {
+    let output = Command::new(program)
+        .args(args)
+        .envs(env.iter().map(|(key, value)| (key, value)))
+        .current_dir(root)
+        .output()?;
+
+    let mut text = String::from_utf8_lossy(&output.stdout).into_owned();
+    text.push_str(&String::from_utf8_lossy(&output.stderr));
+    Ok((output.status.success(), text))
+}
+
+/// Join a program and its arguments for display.
+fn command_line(program: &str, args: &[String]) -> String {
+    std::iter::once(program)
+        .chain(args.iter().map(String::as_str))
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+/// A single error reported by the build check.
+#[derive(Debug, Clone, Serialize)]
+pub struct BuildError {
+    /// File containing the error.
+    pub path: PathBuf,
+    /// 1-based line number.
+    pub line: usize,
+    /// 1-based column number, if reported.
+    pub column: Option<usize>,
+    /// The error message.
+    pub message: String,
+    /// Rules whose edits are on the same line.
+    pub rules: Vec<String>,
+}
+
+impl fmt::Display for BuildError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}:{}", self.path.display(), self.line)?;
+        if let Some(column) = self.column {
+            write!(f, ":{}", column)?;
+        }
+        write!(f, ": {}", self.message)?;
+        if !self.rules.is_empty() {
+            write!(f, " (from rule: {})", self.rules.join(", "))?;
+        }
+        Ok(())
+    }
+}
+
+/// The result of a build check.
+#[derive(Debug, Clone, Serialize)]
+pub struct VerifyReport {
+    /// The command that was run.
+    pub command: String,
+    /// Whether the command exited successfully.
+    pub success: bool,
+    /// Errors parsed from the command output.
+    pub errors: Vec<BuildError>,
+    /// Raw command output.
+    pub output: String,
+}
+
+impl VerifyReport {
+    /// Returns true if the build succeeded.
+    pub fn passed(&self) -> bool {
+        self.success
+    }
+
+    /// Group errors by file.
+    pub fn by_file(&self) -> BTreeMap<&Path, Vec<&BuildError>> {
+        let mut grouped: BTreeMap<&Path, Vec<&BuildError>> = BTreeMap::new();
+        for error in &self.errors {
+            grouped.entry(error.path.as_path()).or_default().push(error);
+        }
+        grouped
+    }
+
+    /// Tag each error with the rules whose edits landed on its line.
+    pub fn implicate(&mut self, edits: &[RuleEdit]) {
+        for error in &mut self.errors {
+            for edit in edits {
+                if edit.line == error.line
+                    && normalize(&edit.path) == error.path
+                    && !error.rules.contains(&edit.rule)
+                {
+                    error.rules.push(edit.rule.clone());
+                }
+            }
+        }
+    }
+}
+
+impl fmt::Display for VerifyReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.success {
+            return write!(f, "Verification passed: {}", self.command);
+        }
+
+        writeln!(f, "Verification failed: {}", self.command)?;
+        for (path, errors) in self.by_file() {
+            writeln!(f, "{} ({} error(s))", path.display(), errors.len())?;
+            for error in errors {
+                writeln!(f, "  {}", error)?;
+            }
+        }
+        if self.errors.is_empty() {
+            write!(f, "{}", self.output.trim_end())?;
+        }
+        Ok(())
+    }
+}
+
+/// Parse located errors out of build output, resolving paths against `root`.
+fn parse_errors(output: &str, root: &Path) -> Vec<BuildError> {
+    let mut errors = Vec::new();
+    let mut pending: Option<String> = None;
+
+    for line in output.lines() {
+        if let Some(caps) = ARROW.captures(line) {
+            if let Some(message) = pending.take() {
+                errors.push(BuildError {
+                    path: normalize(&root.join(&caps["path"])),
+                    line: caps["line"].parse().unwrap_or(0),
+                    column: caps["col"].parse().ok(),
+                    message,
+                    rules: Vec::new(),
+                });
+            }
+        } else if let Some(caps) = LOCATED.captures(line) {
+            // Before the `error` prefix, which files such as errors.go have
+            let line = caps.name("line").or(caps.name("tline"));
+            let column = caps.name("col").or(caps.name("tcol"));
+            errors.push(BuildError {
+                path: normalize(&root.join(&caps["path"])),
+                line: line.and_then(|m| m.as_str().parse().ok()).unwrap_or(0),
+                column: column.and_then(|m| m.as_str().parse().ok()),
+                message: caps["msg"].to_string(),
+                rules: Vec::new(),
+            });
+        } else if let Some(message) = line.strip_prefix("error") {
+            pending = message
+                .split_once(": ")
+                .map(|(_, message)| message.to_string());
+        }
+    }
+
+    errors
+}
+
+/// The words of a shell-style command line: single quotes keep their
+/// contents as is, double quotes allow backslash escapes, and a backslash
+/// outside quotes escapes the next character. `None` for an unterminated
+/// quote.
+pub(crate) fn split_command_line(command: &str) -> Option<Vec<String>> {
+    let mut words = Vec::new();
+    let mut word: Option<String> = None;
+    let mut chars = command.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            c if c.is_whitespace() => words.extend(word.take()),
+            '\'' => {
+                let word = word.get_or_insert_with(String::new);
+                loop {
+                    match chars.next()? {
+                        '\'' => break,
+                        c => word.push(c),
+                    }
+                }
+            }
+            '"' => {
+                let word = word.get_or_insert_with(String::new);
+                loop {
+                    match chars.next()? {
+                        '"' => break,
+                        '\\' => match chars.next()? {
+                            c @ ('"' | '\\' | '$' | '`') => word.push(c),
+                            c => {
+                                word.push('\\');
+                                word.push(c);
+                            }
+                        },
+                        c => word.push(c),
+                    }
+                }
+            }
+            '\\' => {
+                if let Some(c) = chars.next() {
+                    word.get_or_insert_with(String::new).push(c);
+                }
+            }
+            c => word.get_or_insert_with(String::new).push(c),
+        }
+    }
+    words.extend(word);
+    Some(words)
+}
+
+/// Remove `.` components so paths from build output compare with walked paths.
+fn normalize(path: &Path) -> PathBuf {
+    path.components()
+        .filter(|c| !matches!(c, Component::CurDir))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_go_errors() {
+        let output = "# example.com/app\n./main.go:12:5: undefined: FetchUser\n./db/store.go:3:2: \"time\" imported and not used\n";
+        let errors = parse_errors(output, Path::new("/repo"));
+        assert_eq!(errors.len(), 2);
+        assert_eq!(errors[0].path, PathBuf::from("/repo/main.go"));
+        assert_eq!(errors[0].line, 12);
+        assert_eq!(errors[0].column, Some(5));
+        assert_eq!(errors[0].message, "undefined: FetchUser");
+    }
+
+    #[test]
+    fn test_parse_rust_errors() {
+        let output =
+            "error[E0425]: cannot find function `fetch` in this scope\n --> src/main.rs:3:5\n  |\n";
+        let errors = parse_errors(output, Path::new("/repo"));
+        assert_eq!(errors.len(), 1);
+        assert_eq!(errors[0].path, PathBuf::from("/repo/src/main.rs"));
+        assert_eq!(errors[0].line, 3);
+        assert_eq!(
+            errors[0].message,
+            "cannot find function `fetch` in this scope"
+        );
+    }
+
+    #[test]
+    fn test_parse_errors_in_error_files() {
+        let output = "./errors.go:8:2: undefined: Wrap\n";
+        let errors = parse_errors(output, Path::new("/repo"));
+        assert_eq!(errors.len(), 1);
+        assert_eq!(errors[0].path, PathBuf::from("/repo/errors.go"));
+        assert_eq!((errors[0].line, errors[0].column), (8, Some(2)));
+    }
+
+    #[test]
+    fn test_from_command_line() {
+        let check = BuildCheck::from_command_line(
+            r#"go build -tags 'integration e2e' -o "bin/my app" ./..."#,
+        )
+        .unwrap();
+        assert_eq!(check.program, "go");
+        assert_eq!(
+            check.args,
+            [
+                "build",
+                "-tags",
+                "integration e2e",
+                "-o",
+                "bin/my app",
+                "./..."
+            ]
+        );
+        assert!(BuildCheck::from_command_line("go build 'oops").is_none());
+        assert!(BuildCheck::from_command_line("  ").is_none());
+    }
+
+    #[test]
+    fn test_parse_tsc_errors() {
+        let output = "src/app.ts(7,10): error TS2304: Cannot find name 'fetchUser'.\n";
+        let errors = parse_errors(output, Path::new("/repo"));
+        assert_eq!(errors.len(), 1);
+        assert_eq!(errors[0].line, 7);
+        assert_eq!(errors[0].column, Some(10));
+    }
+
+    #[test]
+    fn test_implicate_and_group() {
+        let mut report = VerifyReport {
+            command: "go build ./...".to_string(),
+            success: false,
+            errors: parse_errors(
+                "./main.go:12:5: undefined: FetchUser\n./main.go:20:1: other\n",
+                Path::new("/repo"),
+            ),
+            output: String::new(),
+        };
+        report.implicate(&[RuleEdit {
+            rule: "rename-get-user".to_string(),
+            path: PathBuf::from("/repo/./main.go"),
+            line: 12,
+            todo: false,
+        }]);
+
+        assert_eq!(report.errors[0].rules, vec!["rename-get-user"]);
+        assert!(report.errors[1].rules.is_empty());
+        assert_eq!(report.by_file().len(), 1);
+        assert!(report.to_string().contains("(from rule: rename-get-user)"));
+    }
+
+    #[test]
+    fn test_detect() {
+        let dir = tempfile::TempDir::new().unwrap();
+        assert!(BuildCheck::detect(dir.path()).is_none());
+        std::fs::write(dir.path().join("go.mod"), "module example.com/app\n").unwrap();
+        let check = BuildCheck::detect(dir.path()).unwrap();
+        assert_eq!(check.command_line(), "go build ./...");
+        std::fs::write(dir.path().join("MODULE.bazel"), "").unwrap();
+        let check = BuildCheck::detect(dir.path()).unwrap();
+        assert_eq!(check.command_line(), "go build ./...");
+        std::fs::remove_file(dir.path().join("go.mod")).unwrap();
+        let check = BuildCheck::detect(dir.path()).unwrap();
+        assert_eq!(check.command_line(), "bazel build //...");
+    }
+
+    #[test]
+    fn test_gopath_environment() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let gopath = GoPath::new([dir.path()]);
+        assert_eq!(BuildCheck::gopath(&gopath).command_line(), "go build ./...");
+
+        let check = BuildCheck::new("sh", ["-c", "echo $GO111MODULE $GOPATH"])
+            .env("GO111MODULE", "off")
+            .env("GOPATH", "/legacy");
+        let report = check.run(dir.path()).unwrap();
+        assert_eq!(report.output.trim(), "off /legacy");
+    }
+}
@@ -0,0 +1,261 @@
+//! Example and tooling programs outside the main build.
+//!
+//! Go repositories keep example and tooling programs under `examples/`,
+//! `cmd/` and `tools/`. Rules rewrite them with the rest of the tree, but
+//! `go build ./...` at the root often skips them: they may be modules of
+//! their own, live under a directory the go command ignores (`_examples/`),
+//! or only build with a tag (`//go:build ignore`). [`AuxiliaryProgram`]
+//! finds these programs so each can be built on its own after a migration.
+
+use serde::Serialize;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use walkdir::WalkDir;
+
+use super::BuildCheck;
+use crate::error::Result;
+
+/// Directories holding example and tooling programs.
+pub const AUXILIARY_DIRS: &[&str] = &["examples", "cmd", "tools"];
+
+/// Why `go build ./...` at the project root does not build a program.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Exclusion {
+    /// The program is in a module of its own.
+    Module,
+    /// The program is under a directory the go command ignores (`_` or `.`
+    /// prefix, `testdata`).
+    Ignored,
+    /// The program only builds with build tags.
+    Constrained,
+}
+
+/// A `package main` under one of the [`AUXILIARY_DIRS`].
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct AuxiliaryProgram {
+    /// Directory of the program, relative to the project root.
+    pub dir: PathBuf,
+    /// Root of the module the program belongs to, relative to the project
+    /// root; the program is built from there.
+    pub module: PathBuf,
+    /// Why the root build skips the program, if it does.
+    pub exclusion: Option<Exclusion>,
+    /// Tags the program's build constraints need.
+    pub tags: Vec<String>,
+}
+
+impl AuxiliaryProgram {
+    /// The programs under the [`AUXILIARY_DIRS`] of the project at `root`,
+    /// by directory. Programs in `skip` (directories relative to `root`, or
+    /// their parents) are left out, as are programs outside any module.
+    pub fn discover(root: impl AsRef<Path>, skip: &[String]) -> Result<Vec<Self>> {
+        let root = root.as_ref();
+        let mut programs = Vec::new();
+        let walker = WalkDir::new(root).into_iter().filter_entry(|entry| {
+            let name = entry.file_name().to_str().unwrap_or_default();
+            !matches!(name, ".git" | "vendor" | "node_modules" | "target")
+        });
+        for entry in walker.filter_map(|e| e.ok()) {
+            if !entry.file_type().is_dir() {
+                continue;
+            }
+            let dir = entry.path().strip_prefix(root).unwrap_or(entry.path());
+            let auxiliary = dir.components().any(|c| {
+                let name = c.as_os_str().to_str().unwrap_or_default();
+                AUXILIARY_DIRS.contains(&name.trim_start_matches(['_', '.']))
+            });
+            if !auxiliary || skip.iter().any(|skip| dir.starts_with(skip)) {
+                continue;
+            }
+            let Some(constraints) = main_package(entry.path())? else {
+                continue;
+            };
+            let Some(module) = dir
+                .ancestors()
+                .find(|ancestor| root.join(ancestor).join("go.mod").is_file())
+            else {
+                continue;
+            };
+
+            let package = dir.strip_prefix(module).unwrap_or(dir);
+            let ignored = package.components().any(|c| {
+                let name = c.as_os_str().to_str().unwrap_or_default();
+                name.starts_with(['_', '.']) || name == "testdata"
+            });
+            let tags = constraints.as_deref().map(tags).unwrap_or_default();
+            let exclusion = if !module.as_os_str().is_empty() {
+                Some(Exclusion::Module)
+            } else if ignored {
+                Some(Exclusion::Ignored)
+            } else if constraints.is_some() {
+                Some(Exclusion::Constrained)
+            } else {
+                None
+            };
+            programs.push(Self {
+                dir: dir.to_path_buf(),
+                module: module.to_path_buf(),
+                exclusion,
+                tags,
+            });
+        }
+        programs.sort_by(|a, b| a.dir.cmp(&b.dir));
+        Ok(programs)
+    }
+
+    /// A check building the program, to run in [`module`](Self::module).
+    /// The binary is discarded.
+    pub fn check(&self) -> BuildCheck {
+        let package = match self.dir.strip_prefix(&self.module) {
+            Ok(package) if !package.as_os_str().is_empty() => {
+                format!("./{}", package.display())
+            }
+            _ => ".".to_string(),
+        };
+        let mut args = vec!["build".to_string()];
+        if !self.tags.is_empty() {
+            args.push(format!("-tags={}", self.tags.join(",")));
+        }
+        let null = if cfg!(windows) { "NUL" } else { "/dev/null" };
+        args.extend(["-o".to_string(), null.to_string(), package]);
+        BuildCheck::new("go", args)
+    }
+}
+
+impl fmt::Display for AuxiliaryProgram {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.dir.display())?;
+        match self.exclusion {
+            Some(Exclusion::Module) => write!(f, " (module {})", self.module.display()),
+            Some(Exclusion::Ignored) => write!(f, " (ignored by go build ./...)"),
+            Some(Exclusion::Constrained) => write!(f, " (tags: {})", self.tags.join(", ")),
+            None => Ok(()),
+        }
+    }
+}
+
+/// If `dir` holds a `package main`, its build constraint: the `//go:build`
+/// expression shared by all of its files, or `None` if any file has none.
+fn main_package(dir: &Path) -> Result<Option<Option<String>>> {
+    let mut is_main = false;
+    let mut constraint = None;
+    let mut unconstrained = false;
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        let name = path
+            .file_name()
+            .and_then(|n| n.to_str())
+            .unwrap_or_default();
+        if !name.ends_with(".go") || name.ends_with("_test.go") || !path.is_file() {
+            continue;
+        }
+        let source = fs::read_to_string(&path)?;
+        let mut build = None;
+        for line in source.lines().map(str::trim) {
+            if let Some(expression) = line.strip_prefix("//go:build ") {
+                build = Some(expression.trim().to_string());
+            } else if let Some(package) = line.strip_prefix("package ") {
+                is_main |= package.split_whitespace().next() == Some("main");
+                break;
+            }
+        }
+        match build {
+            Some(build) => constraint = constraint.or(Some(build)),
+            None => unconstrained = true,
+        }
+    }
+    Ok(is_main.then(|| constraint.filter(|_| !unconstrained)))
+}
+
+/// The tags a `//go:build` expression requires: its identifiers that are
+/// not negated, except Go version tags.
+fn tags(expression: &str) -> Vec<String> {
+    let mut tags = Vec::new();
+    let mut negated = false;
+    let mut word = String::new();
+    for c in expression.chars().chain(std::iter::once(' ')) {
+        if c.is_alphanumeric() || c == '_' || c == '.' {
+            word.push(c);
+            continue;
+        }
+        if !word.is_empty() {
+            if !negated && !word.starts_with("go1") && !tags.contains(&word) {
+                tags.push(word.clone());
+            }
+            word.clear();
+            negated = false;
+        }
+        if c == '!' {
+            negated = true;
+        }
+    }
+    tags
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn write(root: &Path, path: &str, content: &str) {
+        let path = root.join(path);
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, content).unwrap();
+    }
+
+    #[test]
+    fn test_discover_programs_outside_the_build() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path();
+        write(root, "go.mod", "module example.com/pool\n");
+        write(root, "pool.go", "package pool\n");
+        write(root, "cmd/poolctl/main.go", "package main\n");
+        write(
+            root,
+            "examples/go.mod",
+            "module example.com/pool/examples\n",
+        );
+        write(root, "examples/basic/main.go", "package main\n");
+        write(root, "_examples/demo/main.go", "// Demo.\npackage main\n");
+        write(
+            root,
+            "tools/gen/main.go",
+            "//go:build ignore && !windows\n\npackage main\n",
+        );
+        write(root, "tools/lib/lib.go", "package lib\n");
+
+        let programs = AuxiliaryProgram::discover(root, &[]).unwrap();
+        let found: Vec<(&Path, Option<Exclusion>)> = programs
+            .iter()
+            .map(|p| (p.dir.as_path(), p.exclusion))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                (Path::new("_examples/demo"), Some(Exclusion::Ignored)),
+                (Path::new("cmd/poolctl"), None),
+                (Path::new("examples/basic"), Some(Exclusion::Module)),
+                (Path::new("tools/gen"), Some(Exclusion::Constrained)),
+            ]
+        );
+
+        let basic = &programs[2];
+        assert_eq!(basic.module, PathBuf::from("examples"));
+        assert!(basic.check().command_line().ends_with(" ./basic"));
+        assert_eq!(programs[3].tags, ["ignore"]);
+        assert!(
+            programs[3]
+                .check()
+                .command_line()
+                .starts_with("go build -tags=ignore -o ")
+        );
+        assert_eq!(programs[3].to_string(), "tools/gen (tags: ignore)");
+
+        let skipped =
+            AuxiliaryProgram::discover(root, &["examples".to_string(), "tools/gen".to_string()])
+                .unwrap();
+        assert_eq!(skipped.len(), 2);
+    }
+}
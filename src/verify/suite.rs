@@ -0,0 +1,206 @@
+//! Running a project's tests after rewriting.
+
+use regex::Regex;
+use serde::Serialize;
+use std::fmt;
+use std::path::Path;
+use std::sync::LazyLock;
+
+use super::{command_line, run_command};
+use crate::error::Result;
+use crate::lang::GoPath;
+
+/// `--- FAIL: TestName (0.01s)` (go) and `test path::name ... FAILED` (cargo).
+static FAILED_TEST: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(r"^\s*(?:--- FAIL: (?P<go>\S+)|test (?P<rust>\S+) \.\.\. FAILED$)")
+        .expect("invalid test failure regex")
+});
+
+/// A command that runs a project's tests.
+#[derive(Debug, Clone)]
+pub struct TestSuite {
+    program: String,
+    args: Vec<String>,
+    env: Vec<(String, String)>,
+}
+
+impl TestSuite {
+    /// Create a test suite from a program and its arguments.
+    pub fn new(
+        program: impl Into<String>,
+        args: impl IntoIterator<Item = impl Into<String>>,
+    ) -> Self {
+        Self {
+            program: program.into(),
+            args: args.into_iter().map(Into::into).collect(),
+            env: Vec::new(),
+        }
+    }
+
+    /// Test a GOPATH-mode Go project whose packages live in `gopath`.
+    /// `pattern` is the package pattern (default `./...`).
+    pub fn gopath(gopath: &GoPath, pattern: Option<&str>) -> Self {
+        let suite = Self::new("go", ["test", pattern.unwrap_or("./...")]);
+        gopath
+            .env()
+            .into_iter()
+            .fold(suite, |suite, (key, value)| suite.env(key, value))
+    }
+
+    /// Set an environment variable for the command.
+    pub fn env(mut self, key: impl Into<String>, value: impl Into<String>) -> Self {
+        self.env.push((key.into(), value.into()));
+        self
+    }
+
+    /// Parse a test suite from a shell-style command line, with quoted
+    /// arguments. `None` if it is empty or has an unterminated quote.
+    pub fn from_command_line(command: &str) -> Option<Self> {
+        let mut parts = super::split_command_line(command)?.into_iter();
+        let program = parts.next()?;
+        Some(Self::new(program, parts))
+    }
+
+    /// Detect the test command for a project from its manifest files.
+    ///
+    /// `pattern` selects what to test: a package pattern for Go (default
+    /// `./...`), a target pattern for Bazel and Please without a go.mod
+    /// (default `//...`), a test name filter for Cargo, or arguments passed
+    /// through to `npm test`.
+    pub fn detect(root: impl AsRef<Path>, pattern: Option<&str>) -> Option<Self> {
+        let root = root.as_ref();
+        let pattern = pattern.map(str::to_string);
+        if root.join("go.mod").exists() {
+            Some(Self::new(
+                "go",
+                ["test".to_string(), pattern.unwrap_or("./...".to_string())],
+            ))
+        } else if let Some(program) = super::monorepo_build(root) {
+            Some(Self::new(
+                program,
+                ["test".to_string(), pattern.unwrap_or("//...".to_string())],
+            ))
+        } else if root.join("Cargo.toml").exists() {
+            Some(Self::new(
+                "cargo",
+                std::iter::once("test".to_string()).chain(pattern),
+            ))
+        } else if root.join("package.json").exists() {
+            let passthrough = pattern.map(|p| ["--".to_string(), p]);
+            Some(Self::new(
+                "npm",
+                std::iter::once("test".to_string()).chain(passthrough.into_iter().flatten()),
+            ))
+        } else {
+            None
+        }
+    }
+
+    /// The command line this suite runs.
+    pub fn command_line(&self) -> String {
+        command_line(&self.program, &self.args)
+    }
+
+    /// Run the tests in `root`.
+    pub fn run(&self, root: impl AsRef<Path>) -> Result<TestReport> {
+        let (success, output) = run_command(&self.program, &self.args, &self.env, root.as_ref())?;
+
+        Ok(TestReport {
+            command: self.command_line(),
+            success,
+            failures: parse_failures(&output),
+            output,
+        })
+    }
+}
+
+/// The result of running a test suite.
+#[derive(Debug, Clone, Serialize)]
+pub struct TestReport {
+    /// The command that was run.
+    pub command: String,
+    /// Whether the command exited successfully.
+    pub success: bool,
+    /// Names of failing tests parsed from the output.
+    pub failures: Vec<String>,
+    /// Raw command output.
+    pub output: String,
+}
+
+impl TestReport {
+    /// Returns true if the tests passed.
+    pub fn passed(&self) -> bool {
+        self.success
+    }
+}
+
+impl fmt::Display for TestReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.success {
+            return write!(f, "Tests passed: {}", self.command);
+        }
+
+        write!(f, "Tests failed: {}", self.command)?;
+        if self.failures.is_empty() {
+            write!(f, "\n{}", self.output.trim_end())?;
+        }
+        for name in &self.failures {
+            write!(f, "\n  FAIL {}", name)?;
+        }
+        Ok(())
+    }
+}
+
+fn parse_failures(output: &str) -> Vec<String> {
+    let mut failures: Vec<String> = Vec::new();
+    for caps in output.lines().filter_map(|line| FAILED_TEST.captures(line)) {
+        let name = caps.name("go").or(caps.name("rust")).unwrap().as_str();
+        if !failures.iter().any(|f| f == name) {
+            failures.push(name.to_string());
+        }
+    }
+    failures
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_failures() {
+        let go = "=== RUN   TestConnect\n--- FAIL: TestConnect (0.00s)\n    client_test.go:12: timeout\nFAIL\nFAIL\texample.com/app\t0.01s\n";
+        assert_eq!(parse_failures(go), vec!["TestConnect"]);
+
+        let rust = "test client::tests::connect ... FAILED\ntest client::tests::ok ... ok\n";
+        assert_eq!(parse_failures(rust), vec!["client::tests::connect"]);
+    }
+
+    #[test]
+    fn test_detect() {
+        let dir = tempfile::TempDir::new().unwrap();
+        assert!(TestSuite::detect(dir.path(), None).is_none());
+
+        std::fs::write(dir.path().join("go.mod"), "module example.com/app\n").unwrap();
+        assert_eq!(
+            TestSuite::detect(dir.path(), None).unwrap().command_line(),
+            "go test ./..."
+        );
+        assert_eq!(
+            TestSuite::detect(dir.path(), Some("./client/..."))
+                .unwrap()
+                .command_line(),
+            "go test ./client/..."
+        );
+
+        std::fs::write(dir.path().join(".plzconfig"), "").unwrap();
+        assert_eq!(
+            TestSuite::detect(dir.path(), None).unwrap().command_line(),
+            "go test ./..."
+        );
+        std::fs::remove_file(dir.path().join("go.mod")).unwrap();
+        assert_eq!(
+            TestSuite::detect(dir.path(), None).unwrap().command_line(),
+            "plz test //..."
+        );
+    }
+}
@@ -0,0 +1,458 @@
+//! Upgrade rules as a `go vet` analyzer.
+//!
+//! `go vet -vettool=$(which refactor)` runs the binary as an analysis tool:
+//! the go command asks for its version (`-V=full`) and flags (`-flags`),
+//! then runs it once per package with a JSON `.cfg` file listing the
+//! package's sources. [`VetAnalyzer`] answers the package runs. Each file
+//! goes through the same pipeline as `refactor upgrade` (rules chain,
+//! excluded and generated files are skipped, TODO markers are tagged), so
+//! `-fix` rewrites exactly what an upgrade would. Each rewrite is reported
+//! in the `analysis.Diagnostic` shape go vet and gopls use, with its edits
+//! as a `SuggestedFix` in byte offsets, so `go vet -json` prints findings
+//! editors and CI already understand. Findings of `suggest` rules carry no
+//! fix.
+//!
+//! ```text
+//! {"example.com/client": {"refactor": [{"posn": "/src/client/main.go:4:7", "end": "/src/client/main.go:4:15",
+//!   "message": "GetUser is now FetchUser", "category": "rename-get-user",
+//!   "suggested_fixes": [{"message": "GetUser is now FetchUser",
+//!     "edits": [{"filename": "/src/client/main.go", "start": 34, "end": 42, "new": "FetchUser("}]}]}]}}
+//! ```
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::analyzer::UpgradeConfig;
+//! use refactor::vet::{VetAnalyzer, VetConfig};
+//!
+//! let analyzer = VetAnalyzer::new(UpgradeConfig::from_file("upgrade.yaml")?)?;
+//! let config = VetConfig::from_file("vet.cfg")?;
+//! for diagnostic in analyzer.run(&config)? {
+//!     eprintln!("{}", diagnostic);
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::analyzer::UpgradeConfig;
+use crate::error::Result;
+use crate::runner::UpgradeRunner;
+use crate::transform::edit::Edit;
+
+/// Name the findings are reported under.
+pub const ANALYZER: &str = "refactor";
+
+/// Environment variable naming the upgrade configuration to vet with. When
+/// it is not set, the rule files of the project config are used.
+pub const CONFIG_VAR: &str = "REFACTOR_VET_CONFIG";
+
+/// The flags the tool accepts, as the go command asks for them with
+/// `-flags`.
+pub const FLAGS: &str = r#"[{"Name":"json","Bool":true,"Usage":"emit JSON output"},{"Name":"fix","Bool":true,"Usage":"apply all suggested fixes"},{"Name":"allow_plugins","Bool":true,"Usage":"let the upgrade config start its plugins"}]"#;
+
+/// The package description the go command passes to a vet tool.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Deserialize)]
+pub struct VetConfig {
+    /// Package id, the key of the package in JSON output.
+    #[serde(rename = "ID")]
+    pub id: String,
+    /// Import path of the package.
+    #[serde(rename = "ImportPath", default)]
+    pub import_path: String,
+    /// Directory of the package.
+    #[serde(rename = "Dir", default)]
+    pub dir: PathBuf,
+    /// Go sources of the package.
+    #[serde(rename = "GoFiles", default)]
+    pub go_files: Vec<PathBuf>,
+    /// File the tool writes its facts to. This analyzer has none, but the
+    /// go command expects the file.
+    #[serde(rename = "VetxOutput", default)]
+    pub vetx_output: Option<PathBuf>,
+    /// The package is only a dependency of the packages being vetted and
+    /// gets no diagnostics.
+    #[serde(rename = "VetxOnly", default)]
+    pub vetx_only: bool,
+}
+
+impl VetConfig {
+    /// Load the `.cfg` file at `path`.
+    pub fn from_file(path: impl AsRef<Path>) -> Result<Self> {
+        Ok(serde_json::from_str(&fs::read_to_string(path)?)?)
+    }
+}
+
+/// A finding, in the JSON shape of `analysis.Diagnostic`.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct VetDiagnostic {
+    /// Start of the match, `file:line:column`.
+    pub posn: String,
+    /// End of the match, `file:line:column`.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub end: String,
+    /// What the rule says about the match.
+    pub message: String,
+    /// Id of the rule that matched.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub category: String,
+    /// The rewrite.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub suggested_fixes: Vec<SuggestedFix>,
+}
+
+impl fmt::Display for VetDiagnostic {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}", self.posn, self.message)
+    }
+}
+
+/// A rewrite offered with a diagnostic.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SuggestedFix {
+    /// Description of the rewrite.
+    pub message: String,
+    /// Its edits.
+    pub edits: Vec<VetEdit>,
+}
+
+/// A text edit in byte offsets of a file.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct VetEdit {
+    /// File to edit.
+    pub filename: PathBuf,
+    /// Start byte offset (inclusive).
+    pub start: usize,
+    /// End byte offset (exclusive).
+    pub end: usize,
+    /// Replacement text.
+    pub new: String,
+}
+
+/// Reports the rewrites and findings of an upgrade as vet diagnostics.
+pub struct VetAnalyzer {
+    runner: UpgradeRunner,
+    root: PathBuf,
+}
+
+impl VetAnalyzer {
+    /// Run the rules of `config`.
+    pub fn new(config: UpgradeConfig) -> Result<Self> {
+        Self::with_runner(UpgradeRunner::new(config))
+    }
+
+    /// Run `runner`, with the globs of the project it is configured for.
+    /// Nothing is written. Fails if a rule does not compile.
+    pub fn with_runner(runner: UpgradeRunner) -> Result<Self> {
+        let runner = runner.dry_run();
+        runner.run_files(Vec::<(PathBuf, String)>::new())?;
+        Ok(Self {
+            runner,
+            root: PathBuf::new(),
+        })
+    }
+
+    /// Match the runner's globs against paths relative to `root`, the
+    /// directory of the project config, and look up the go.mod of a file
+    /// from there.
+    pub fn root(mut self, root: impl Into<PathBuf>) -> Self {
+        self.root = root.into();
+        self.runner = self.runner.root(&self.root);
+        self
+    }
+
+    /// The diagnostics for `source`, the content of `path`: one per
+    /// rewritten site, with the edits of the rewrite as its fix, and one
+    /// per finding of a suggest rule, without a fix.
+    pub fn analyze(&self, path: &Path, source: &str) -> Result<Vec<VetDiagnostic>> {
+        let rel = path.strip_prefix(&self.root).unwrap_or(path);
+        let report = self
+            .runner
+            .run_files([(rel.to_path_buf(), source.to_string())])?;
+        let posn = |line: usize, column: usize| format!("{}:{}:{}", path.display(), line, column);
+
+        let mut diagnostics: Vec<VetDiagnostic> = report
+            .diagnostics
+            .iter()
+            .map(|finding| VetDiagnostic {
+                posn: posn(finding.line, finding.column),
+                end: String::new(),
+                message: finding.message.clone(),
+                category: finding.rule.clone(),
+                suggested_fixes: Vec::new(),
+            })
+            .collect();
+        let Some(change) = report.changes.first() else {
+            return Ok(diagnostics);
+        };
+
+        let config = self.runner.config();
+        let message = |rule: &str| {
+            config
+                .transforms
+                .iter()
+                .find(|t| t.name() == rule)
+                .map_or_else(
+                    || config.description.clone(),
+                    |t| t.message.clone().unwrap_or_else(|| t.spec.describe()),
+                )
+        };
+        let edits = change.edits();
+        let mut rewrites: Vec<(usize, VetDiagnostic, Vec<VetEdit>)> = Vec::new();
+        for edit in &report.edits {
+            let line = original_line(source, &edits, edit.line);
+            let before = source.lines().nth(line - 1).unwrap_or_default();
+            let after = change.transformed.lines().nth(edit.line - 1);
+            let (start, end) = changed_columns(before, after.unwrap_or(before));
+            rewrites.push((
+                line,
+                VetDiagnostic {
+                    posn: posn(line, start),
+                    end: end.map(|end| posn(line, end)).unwrap_or_default(),
+                    message: message(&edit.rule),
+                    category: edit.rule.clone(),
+                    suggested_fixes: Vec::new(),
+                },
+                Vec::new(),
+            ));
+        }
+        if rewrites.is_empty() {
+            let line = edits.first().map_or(1, |e| line_of(source, e.start));
+            rewrites.push((
+                line,
+                VetDiagnostic {
+                    posn: posn(line, 1),
+                    end: String::new(),
+                    message: config.description.clone(),
+                    category: config.name.clone(),
+                    suggested_fixes: Vec::new(),
+                },
+                Vec::new(),
+            ));
+        }
+
+        // Each edit goes to the first rewrite on its lines, or the first
+        // rewrite of the file (an import fix), so -fix applies it once
+        for edit in edits {
+            let first = line_of(source, edit.start);
+            let last = first + source[edit.start..edit.end].matches('\n').count().max(1);
+            let index = rewrites
+                .iter()
+                .position(|(line, ..)| (first..last).contains(line))
+                .unwrap_or(0);
+            rewrites[index].2.push(VetEdit {
+                filename: path.to_path_buf(),
+                start: edit.start,
+                end: edit.end,
+                new: edit.text,
+            });
+        }
+        for (_, mut diagnostic, edits) in rewrites {
+            if !edits.is_empty() {
+                diagnostic.suggested_fixes.push(SuggestedFix {
+                    message: diagnostic.message.clone(),
+                    edits,
+                });
+            }
+            diagnostics.push(diagnostic);
+        }
+        Ok(diagnostics)
+    }
+
+    /// The diagnostics for the sources of the package `config` describes,
+    /// none for a dependency-only package. Writes the facts file the go
+    /// command expects.
+    pub fn run(&self, config: &VetConfig) -> Result<Vec<VetDiagnostic>> {
+        if let Some(vetx) = &config.vetx_output {
+            fs::write(vetx, "")?;
+        }
+        if config.vetx_only {
+            return Ok(Vec::new());
+        }
+        let mut diagnostics = Vec::new();
+        for file in &config.go_files {
+            let path = config.dir.join(file);
+            diagnostics.extend(self.analyze(&path, &fs::read_to_string(&path)?)?);
+        }
+        Ok(diagnostics)
+    }
+}
+
+/// `diagnostics` of the package `id` in the JSON tree `go vet -json` prints.
+pub fn json_tree(id: &str, diagnostics: &[VetDiagnostic]) -> Result<String> {
+    let tree = BTreeMap::from([(id, BTreeMap::from([(ANALYZER, diagnostics)]))]);
+    Ok(serde_json::to_string_pretty(&tree)?)
+}
+
+/// Apply the suggested fixes of `diagnostics` to their files, returning how
+/// many files changed. An edit overlapping one applied before it is skipped.
+pub fn apply_fixes(diagnostics: &[VetDiagnostic]) -> Result<usize> {
+    let mut by_file: HashMap<&Path, Vec<&VetEdit>> = HashMap::new();
+    for edit in diagnostics
+        .iter()
+        .flat_map(|d| &d.suggested_fixes)
+        .flat_map(|fix| &fix.edits)
+    {
+        by_file.entry(&edit.filename).or_default().push(edit);
+    }
+
+    let mut changed = 0;
+    for (path, edits) in by_file {
+        let source = fs::read_to_string(path)?;
+        let mut kept: Vec<&VetEdit> = Vec::new();
+        for edit in edits {
+            if edit.start <= edit.end
+                && edit.end <= source.len()
+                && kept
+                    .iter()
+                    .all(|k| edit.end <= k.start || k.end <= edit.start)
+            {
+                kept.push(edit);
+            }
+        }
+        kept.sort_by_key(|edit| edit.start);
+        let mut fixed = source.clone();
+        for edit in kept.iter().rev() {
+            fixed.replace_range(edit.start..edit.end, &edit.new);
+        }
+        if fixed != source {
+            fs::write(path, fixed)?;
+            changed += 1;
+        }
+    }
+    Ok(changed)
+}
+
+/// The 1-based line of `offset` in `source`.
+fn line_of(source: &str, offset: usize) -> usize {
+    source[..offset].matches('\n').count() + 1
+}
+
+/// The line of `source` that `line` of the source rewritten by the
+/// line-level `edits` comes from.
+fn original_line(source: &str, edits: &[Edit], line: usize) -> usize {
+    let mut delta = 0isize;
+    for edit in edits {
+        let start = line_of(source, edit.start);
+        let removed = source[edit.start..edit.end].matches('\n').count();
+        let inserted = edit.text.matches('\n').count();
+        let new_start = start.saturating_add_signed(delta);
+        if line < new_start {
+            break;
+        }
+        if line < new_start + inserted {
+            return start + (line - new_start).min(removed.saturating_sub(1));
+        }
+        delta += inserted as isize - removed as isize;
+    }
+    line.saturating_add_signed(-delta).max(1)
+}
+
+/// The 1-based byte columns of `before` where it differs from `after`: the
+/// start, and the end unless the lines are the same.
+fn changed_columns(before: &str, after: &str) -> (usize, Option<usize>) {
+    if before == after {
+        return (1, None);
+    }
+    let prefix = before
+        .char_indices()
+        .zip(after.chars())
+        .find(|((_, a), b)| a != b)
+        .map_or(before.len().min(after.len()), |((i, _), _)| i);
+    let suffix = before[prefix..]
+        .chars()
+        .rev()
+        .zip(after[prefix..].chars().rev())
+        .take_while(|(a, b)| a == b)
+        .map(|(a, _)| a.len_utf8())
+        .sum::<usize>();
+    (prefix + 1, Some(before.len() - suffix + 1))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::analyzer::{TransformRule, TransformSpec};
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_vet_package() {
+        let mut config =
+            UpgradeConfig::new("test", "Test upgrade").with_extensions(vec!["go".to_string()]);
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "GetUser".to_string(),
+                new_name: "FetchUser".to_string(),
+            })
+            .with_id("rename-get-user")
+            .with_message("GetUser is now FetchUser"),
+        );
+        config.add_transform(
+            TransformRule::new(TransformSpec::RenameFunction {
+                old_name: "Legacy".to_string(),
+                new_name: "Modern".to_string(),
+            })
+            .with_id("legacy")
+            .with_message("Legacy is going away")
+            .suggest_only(),
+        );
+        let analyzer = VetAnalyzer::new(config).unwrap();
+
+        let dir = TempDir::new().unwrap();
+        let source = "package main\n\nfunc main() {\n\tu := GetUser(1)\n\tLegacy()\n}\n";
+        fs::write(dir.path().join("main.go"), source).unwrap();
+        let generated =
+            "// Code generated by mockgen. DO NOT EDIT.\n\npackage main\n\nvar _ = GetUser\n";
+        fs::write(dir.path().join("mock.go"), generated).unwrap();
+        let cfg = format!(
+            r#"{{"ID": "example.com/client", "Compiler": "gc", "Dir": {:?}, "GoFiles": ["main.go", "mock.go"], "VetxOutput": {:?}}}"#,
+            dir.path(),
+            dir.path().join("vet.out")
+        );
+        fs::write(dir.path().join("vet.cfg"), cfg).unwrap();
+
+        let vet = VetConfig::from_file(dir.path().join("vet.cfg")).unwrap();
+        let diagnostics = analyzer.run(&vet).unwrap();
+        assert!(dir.path().join("vet.out").exists());
+        assert_eq!(diagnostics.len(), 2);
+        let main = dir.path().join("main.go");
+        assert_eq!(
+            diagnostics[0].to_string(),
+            format!("{}:5:2: Legacy is going away", main.display())
+        );
+        assert!(diagnostics[0].suggested_fixes.is_empty());
+        assert_eq!(
+            diagnostics[1].to_string(),
+            format!("{}:4:7: GetUser is now FetchUser", main.display())
+        );
+        assert_eq!(diagnostics[1].end, format!("{}:4:10", main.display()));
+        assert_eq!(diagnostics[1].category, "rename-get-user");
+
+        let tree: serde_json::Value =
+            serde_json::from_str(&json_tree(&vet.id, &diagnostics).unwrap()).unwrap();
+        let edit = &tree["example.com/client"]["refactor"][1]["suggested_fixes"][0]["edits"][0];
+        assert_eq!(edit["start"], 28);
+        assert_eq!(edit["new"], "\tu := FetchUser(1)\n");
+
+        assert_eq!(apply_fixes(&diagnostics).unwrap(), 1);
+        assert_eq!(
+            fs::read_to_string(&main).unwrap(),
+            "package main\n\nfunc main() {\n\tu := FetchUser(1)\n\tLegacy()\n}\n"
+        );
+        assert_eq!(
+            fs::read_to_string(dir.path().join("mock.go")).unwrap(),
+            generated
+        );
+        assert_eq!(analyzer.run(&vet).unwrap().len(), 1);
+
+        let dependency = VetConfig {
+            vetx_only: true,
+            ..vet
+        };
+        assert!(analyzer.run(&dependency).unwrap().is_empty());
+    }
+}
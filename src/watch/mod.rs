@@ -0,0 +1,126 @@
+//! Polling file watcher for iterative rule development.
+//!
+//! [`FileWatcher`] snapshots the size and modification time of every file
+//! under a set of paths and reports which ones changed since the last poll.
+//! The `watch` command uses it to re-run a rule file in dry-run mode each
+//! time the rules or the target code are saved.
+//!
+//! # Example
+//!
+//! ```rust,no_run
+//! use refactor::watch::FileWatcher;
+//! use std::time::Duration;
+//!
+//! let mut watcher = FileWatcher::new(["upgrade.yaml", "./project"])?;
+//! loop {
+//!     let changed = watcher.wait(Duration::from_millis(500))?;
+//!     println!("{} file(s) changed", changed.len());
+//! }
+//! # Ok::<(), refactor::error::RefactorError>(())
+//! ```
+
+use std::collections::{BTreeSet, HashMap};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::thread;
+use std::time::{Duration, SystemTime};
+use walkdir::WalkDir;
+
+use crate::error::Result;
+
+type Stamp = (SystemTime, u64);
+
+/// Watches files and directories for changes by polling.
+pub struct FileWatcher {
+    paths: Vec<PathBuf>,
+    snapshot: HashMap<PathBuf, Stamp>,
+}
+
+impl FileWatcher {
+    /// Start watching `paths` (files, or directories watched recursively).
+    /// Hidden directories such as `.git` are skipped.
+    pub fn new(paths: impl IntoIterator<Item = impl Into<PathBuf>>) -> Result<Self> {
+        let paths: Vec<PathBuf> = paths.into_iter().map(Into::into).collect();
+        let snapshot = snapshot(&paths)?;
+        Ok(Self { paths, snapshot })
+    }
+
+    /// Files added, modified or removed since the last poll, in path order.
+    pub fn poll(&mut self) -> Result<Vec<PathBuf>> {
+        let current = snapshot(&self.paths)?;
+        let mut changed: BTreeSet<PathBuf> = current
+            .iter()
+            .filter(|(path, stamp)| self.snapshot.get(*path) != Some(stamp))
+            .map(|(path, _)| path.clone())
+            .collect();
+        changed.extend(
+            self.snapshot
+                .keys()
+                .filter(|path| !current.contains_key(*path))
+                .cloned(),
+        );
+        self.snapshot = current;
+        Ok(changed.into_iter().collect())
+    }
+
+    /// Block until something changes, polling every `interval`.
+    pub fn wait(&mut self, interval: Duration) -> Result<Vec<PathBuf>> {
+        loop {
+            thread::sleep(interval);
+            let changed = self.poll()?;
+            if !changed.is_empty() {
+                return Ok(changed);
+            }
+        }
+    }
+}
+
+fn snapshot(paths: &[PathBuf]) -> Result<HashMap<PathBuf, Stamp>> {
+    let mut stamps = HashMap::new();
+    for root in paths {
+        let walker = WalkDir::new(root)
+            .into_iter()
+            .filter_entry(|e| e.depth() == 0 || !is_hidden(e.path()));
+        for entry in walker.filter_map(|e| e.ok()) {
+            if !entry.file_type().is_file() {
+                continue;
+            }
+            let metadata = fs::metadata(entry.path())?;
+            stamps.insert(
+                entry.path().to_path_buf(),
+                (metadata.modified()?, metadata.len()),
+            );
+        }
+    }
+    Ok(stamps)
+}
+
+fn is_hidden(path: &Path) -> bool {
+    path.file_name()
+        .and_then(|n| n.to_str())
+        .is_some_and(|n| n.starts_with('.'))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_poll_reports_changes() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let main = dir.path().join("main.go");
+        let util = dir.path().join("util.go");
+        fs::write(&main, "package main\n").unwrap();
+        fs::write(&util, "package main\n").unwrap();
+        fs::create_dir(dir.path().join(".git")).unwrap();
+
+        let mut watcher = FileWatcher::new([dir.path()]).unwrap();
+        assert!(watcher.poll().unwrap().is_empty());
+
+        fs::write(&main, "package main\n\nfunc main() {}\n").unwrap();
+        fs::remove_file(&util).unwrap();
+        fs::write(dir.path().join(".git/index"), "x").unwrap();
+        assert_eq!(watcher.poll().unwrap(), vec![main, util]);
+        assert!(watcher.poll().unwrap().is_empty());
+    }
+}
@@ -77,6 +77,47 @@ func (u Utils) Helper() string {
 	return "helper"
 }
 
+func (i Item) ID() string {
+	return i.Key
+}
+
+// Simulated generic library code
+type Keyed interface {
+	ID() string
+}
+
+type Cache[K comparable, V any] struct {
+	items map[K]V
+}
+
+func NewCache[K comparable, V any]() *Cache[K, V] {
+	return &Cache[K, V]{items: make(map[K]V)}
+}
+
+func FilterBy[T any](items []T, keep func(T) bool) []T {
+	var kept []T
+	for _, item := range items {
+		if keep(item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func Index[T Keyed](items []T) map[string]T {
+	index := make(map[string]T, len(items))
+	for _, item := range items {
+		index[item.ID()] = item
+	}
+	return index
+}
+
+// describeUtils uses Utils as a parameter, a pointer and in method expressions.
+func describeUtils(u Utils, p *Utils) string {
+	helper := Utils.Helper
+	return helper(u) + (*Utils).Helper(p)
+}
+
 func main() {
 	fmt.Println("=== Client Application ===\n")
 
@@ -125,6 +166,15 @@ func main() {
 	utils := Utils{}
 	greeting := utils.Helper()
 	fmt.Printf("Greeting: %s\n", greeting)
+	fmt.Printf("Described: %s\n", describeUtils(utils, &utils))
+
+	// Using generics (FilterBy becomes Select, NewCache becomes NewStore,
+	// Cache becomes Store)
+	found := FilterBy[Item](results, func(i Item) bool { return i.Value != "" })
+	everything := FilterBy(moreResults, func(Item) bool { return true })
+	cache := NewCache[string, Item]()
+	var _ *Cache[string, Item] = cache
+	fmt.Printf("Indexed: %d items\n", len(Index(append(found, everything...))))
 
 	fmt.Println("\n=== Done ===")
 }
@@ -174,3 +224,9 @@ func (s *UserService) GetHelperMessage() string {
 	utils := Utils{}
 	return utils.Helper()
 }
+
+// latest returns the last of the items, constrained by Keyed (should become
+// Identifiable).
+func latest[T Keyed](items []T) T {
+	return items[len(items)-1]
+}
@@ -0,0 +1,25 @@
+// Client application importing mylib v1.0.0 under an alias.
+//
+// Uses of the library are qualified by the alias, not by the package name.
+package main
+
+import (
+	"fmt"
+
+	ml "mylib"
+)
+
+// describe uses the library through the alias.
+func describe(id int64) string {
+	user, err := ml.GetUser(id)
+	if err != nil {
+		return err.Error()
+	}
+	var utils ml.Utils
+	return fmt.Sprintf("%s: %s", user.Name, utils.Helper())
+}
+
+func main() {
+	fmt.Println(describe(1))
+	fmt.Println(greet(2))
+}
@@ -0,0 +1,13 @@
+// Client code dot-importing mylib v1.0.0.
+//
+// Uses of the library are unqualified.
+package main
+
+import . "mylib"
+
+// greet uses the library through the dot import.
+func greet(id int64) string {
+	user, _ := GetUser(id)
+	utils := Utils{}
+	return utils.FormatUser(user)
+}
@@ -0,0 +1,7 @@
+module client_imports
+
+go 1.21
+
+require mylib v1.0.0
+
+replace mylib => ../library_v1
@@ -111,3 +111,43 @@ func (u Utils) FormatUser(user *User) string {
 func (u Utils) CreateConfigMap() map[string]string {
 	return map[string]string{"version": "1.0.0"}
 }
+
+// ID returns the key identifying the item.
+func (i Item) ID() string {
+	return i.Key
+}
+
+// Keyed is implemented by values identified by a key.
+type Keyed interface {
+	ID() string
+}
+
+// Cache holds values by key.
+type Cache[K comparable, V any] struct {
+	items map[K]V
+}
+
+// NewCache creates an empty cache.
+func NewCache[K comparable, V any]() *Cache[K, V] {
+	return &Cache[K, V]{items: make(map[K]V)}
+}
+
+// FilterBy returns the items that keep accepts.
+func FilterBy[T any](items []T, keep func(T) bool) []T {
+	var kept []T
+	for _, item := range items {
+		if keep(item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// Index maps items by their ID.
+func Index[T Keyed](items []T) map[string]T {
+	index := make(map[string]T, len(items))
+	for _, item := range items {
+		index[item.ID()] = item
+	}
+	return index
+}
@@ -12,6 +12,9 @@
 // - Parse now returns ParseResult instead of (string, error)
 // - DeprecatedFn has been removed
 // - Utils renamed to Helpers
+// - Keyed renamed to Identifiable, also in type constraints
+// - Cache renamed to Store, and NewCache to NewStore
+// - FilterBy renamed to Select
 package mylib
 
 import (
@@ -137,3 +140,43 @@ func (h Helpers) FormatUser(user *UserAccount) string {
 func (h Helpers) CreateConfigMap() map[string]string {
 	return map[string]string{"version": "2.0.0"}
 }
+
+// ID returns the key identifying the item.
+func (i Item) ID() string {
+	return i.Key
+}
+
+// Identifiable is implemented by values identified by a key (renamed from Keyed).
+type Identifiable interface {
+	ID() string
+}
+
+// Store holds values by key (renamed from Cache).
+type Store[K comparable, V any] struct {
+	items map[K]V
+}
+
+// NewStore creates an empty store (renamed from NewCache).
+func NewStore[K comparable, V any]() *Store[K, V] {
+	return &Store[K, V]{items: make(map[K]V)}
+}
+
+// Select returns the items that keep accepts (renamed from FilterBy).
+func Select[T any](items []T, keep func(T) bool) []T {
+	var kept []T
+	for _, item := range items {
+		if keep(item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// Index maps items by their ID.
+func Index[T Identifiable](items []T) map[string]T {
+	index := make(map[string]T, len(items))
+	for _, item := range items {
+		index[item.ID()] = item
+	}
+	return index
+}
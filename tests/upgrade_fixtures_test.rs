@@ -3,7 +3,9 @@
 //! These tests verify that the analyzer correctly detects API changes
 //! between library versions and generates appropriate codemods.
 
-use refactor::analyzer::{ApiExtractor, ChangeDetector, FileContent, UpgradeGenerator};
+use refactor::analyzer::{
+    ApiExtractor, ChangeDetector, FileContent, TransformRule, TransformSpec, UpgradeGenerator,
+};
 use refactor::lang::LanguageRegistry;
 use refactor::prelude::*;
 use std::fs;
@@ -208,6 +210,143 @@ fn test_go_library_change_detection() {
     assert!(!changes.is_empty(), "Expected to detect API changes");
 }
 
+/// Test that the Go type rename covers every position the client uses
+/// `Utils` in.
+#[test]
+fn test_go_type_rename_on_client() {
+    let client = Path::new("tests/fixtures/go_library/client/main.go");
+    if !client.exists() {
+        eprintln!("Skipping test: fixture not found at {:?}", client);
+        return;
+    }
+
+    let rule = TransformRule::new(TransformSpec::RenameGoType {
+        package: None,
+        old_name: "Utils".to_string(),
+        new_name: "Helpers".to_string(),
+        transitive: false,
+    });
+    let source = fs::read_to_string(client).unwrap();
+    let result = rule.to_transform().unwrap().apply(&source, client).unwrap();
+
+    for expected in [
+        "type Helpers struct{}",
+        "func (u Helpers) Helper() string",
+        "func describeUtils(u Helpers, p *Helpers) string",
+        "helper := Helpers.Helper",
+        "(*Helpers).Helper(p)",
+        "utils := Helpers{}",
+    ] {
+        assert!(result.contains(expected), "missing {:?}", expected);
+    }
+    // Only the type is renamed: not comments, variables or other names
+    assert!(result.contains("// Using Utils (should become Helpers)"));
+    assert!(result.contains("greeting := utils.Helper()"));
+    assert!(result.contains("describeUtils(utils, &utils)"));
+    assert!(!result.contains("Utils{}"));
+}
+
+/// Test that renames reach the generic code of the client: explicit
+/// instantiations, inferred calls and type constraints.
+#[test]
+fn test_go_generics_on_client() {
+    let client = Path::new("tests/fixtures/go_library/client/main.go");
+    if !client.exists() {
+        eprintln!("Skipping test: fixture not found at {:?}", client);
+        return;
+    }
+
+    let rules = [
+        TransformSpec::RenameFunction {
+            old_name: "FilterBy".to_string(),
+            new_name: "Select".to_string(),
+        },
+        TransformSpec::RenameFunction {
+            old_name: "NewCache".to_string(),
+            new_name: "NewStore".to_string(),
+        },
+        TransformSpec::RenameGoType {
+            package: None,
+            old_name: "Cache".to_string(),
+            new_name: "Store".to_string(),
+            transitive: false,
+        },
+        TransformSpec::RenameGoType {
+            package: None,
+            old_name: "Keyed".to_string(),
+            new_name: "Identifiable".to_string(),
+            transitive: false,
+        },
+    ];
+    let mut result = fs::read_to_string(client).unwrap();
+    for spec in rules {
+        let transform = TransformRule::new(spec).to_transform().unwrap();
+        result = transform.apply(&result, client).unwrap();
+    }
+
+    for expected in [
+        "func Select[T any](items []T, keep func(T) bool) []T",
+        "found := Select[Item](results,",
+        "everything := Select(moreResults,",
+        "func NewStore[K comparable, V any]() *Store[K, V]",
+        "return &Store[K, V]{items: make(map[K]V)}",
+        "cache := NewStore[string, Item]()",
+        "var _ *Store[string, Item] = cache",
+        "type Identifiable interface",
+        "func Index[T Identifiable](items []T) map[string]T",
+        "func latest[T Identifiable](items []T) T",
+    ] {
+        assert!(result.contains(expected), "missing {:?}", expected);
+    }
+    assert!(!result.contains("FilterBy("));
+    assert!(!result.contains("Cache["));
+}
+
+/// Test that Go rewrites resolve aliased and dot imports of the library.
+#[test]
+fn test_go_aliased_and_dot_imports() {
+    let client = Path::new("tests/fixtures/go_library/client_imports");
+    if !client.exists() {
+        eprintln!("Skipping test: fixture not found at {:?}", client);
+        return;
+    }
+
+    let rules = [
+        TransformSpec::RenameGoType {
+            package: Some("mylib".to_string()),
+            old_name: "Utils".to_string(),
+            new_name: "Helpers".to_string(),
+            transitive: false,
+        },
+        TransformSpec::InjectContext {
+            function: "GetUser".to_string(),
+            package: Some("mylib".to_string()),
+            parameter: None,
+            fallback: None,
+            signature: None,
+        },
+    ];
+    let rewrite = |file: &str| {
+        let path = client.join(file);
+        let mut result = fs::read_to_string(&path).unwrap();
+        for spec in rules.clone() {
+            let transform = TransformRule::new(spec).to_transform().unwrap();
+            result = transform.apply(&result, &path).unwrap();
+        }
+        result
+    };
+
+    let aliased = rewrite("aliased.go");
+    assert!(aliased.contains("user, err := ml.GetUser(context.TODO(), id)"));
+    assert!(aliased.contains("var utils ml.Helpers"));
+    assert!(!aliased.contains("Utils"));
+
+    let dotted = rewrite("dotted.go");
+    assert!(dotted.contains("user, _ := GetUser(context.TODO(), id)"));
+    assert!(dotted.contains("utils := Helpers{}"));
+    assert!(!dotted.contains("Utils"));
+}
+
 /// Test that Java library changes are detected correctly.
 #[test]
 fn test_java_library_change_detection() {